@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// client calls the HTTP API of the server at base.
+type client struct {
+	base  string
+	token string
+	http  *http.Client
+}
+
+func newClient(base, token string) *client {
+	return &client{base: base, token: token, http: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// todo is a todo as the API sends it.
+type todo struct {
+	ID        string   `json:"id"`
+	Ref       string   `json:"ref,omitempty"`
+	ListID    string   `json:"listId,omitempty"`
+	Title     string   `json:"title"`
+	Completed bool     `json:"completed"`
+	CreateAt  string   `json:"createAt"`
+	DueDate   string   `json:"dueDate,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+}
+
+// name is how the todo is shown and can be named on the command line:
+// its reference, or its id for todos without one.
+func (t todo) name() string {
+	if t.Ref != "" {
+		return t.Ref
+	}
+	return t.ID
+}
+
+// apiError is an error response from the server.
+type apiError struct {
+	Status  int
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *apiError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("server answered %d %s", e.Status, http.StatusText(e.Status))
+	}
+	return e.Message
+}
+
+// do sends in, if not nil, as JSON with the given headers and decodes the
+// response into out, if not nil. Error responses are returned as
+// *apiError.
+func (c *client) do(ctx context.Context, method, path string, header http.Header, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, body)
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		e := &apiError{Status: resp.StatusCode}
+		json.NewDecoder(resp.Body).Decode(e)
+		if resp.StatusCode == http.StatusUnauthorized && e.Code != "totp_required" && c.token != "" {
+			e.Message += " (run todocli login to sign in again)"
+		}
+		return e
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("reading the response to %s %s: %w", method, path, err)
+	}
+	return nil
+}
+
+// todoFilter narrows listTodos to the todos matching the fields set.
+type todoFilter struct {
+	ListID     string
+	AssignedTo string
+	DueBefore  string
+}
+
+func (c *client) listTodos(ctx context.Context, f todoFilter) ([]todo, error) {
+	q := url.Values{}
+	for k, v := range map[string]string{"list": f.ListID, "assigned_to": f.AssignedTo, "due_before": f.DueBefore} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	path := "/todo"
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	var resp struct {
+		Data []todo `json:"data"`
+	}
+	err := c.do(ctx, http.MethodGet, path, nil, nil, &resp)
+	return resp.Data, err
+}
+
+// findTodo looks up the todo named by its id or reference.
+func (c *client) findTodo(ctx context.Context, name string) (todo, error) {
+	todos, err := c.listTodos(ctx, todoFilter{})
+	if err != nil {
+		return todo{}, err
+	}
+	for _, t := range todos {
+		if t.ID == name || strings.EqualFold(t.Ref, name) {
+			return t, nil
+		}
+	}
+	return todo{}, fmt.Errorf("%s: todo not found", name)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// config is the configuration file, YAML like the server's:
+//
+//	server: https://todo.example.com
+//	token: todo_...
+type config struct {
+	Server string `yaml:"server,omitempty"`
+	Token  string `yaml:"token,omitempty"`
+	// TokenID names Token on the server, so logout can revoke it.
+	TokenID string `yaml:"tokenId,omitempty"`
+}
+
+// defaultConfigPath is todocli/config.yaml in the user's configuration
+// directory, such as ~/.config on Linux.
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "todocli", "config.yaml")
+}
+
+// readConfig reads the configuration file at path, which need not exist.
+func readConfig(path string) (config, error) {
+	var c config
+	if path == "" {
+		return c, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return c, err
+	}
+	if err := yaml.Unmarshal(b, &c); err != nil {
+		return c, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+// writeConfig saves c to path, readable only by the user since it holds
+// the token.
+func writeConfig(path string, c config) error {
+	if path == "" {
+		return errors.New("no configuration file: pass --config")
+	}
+	b, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0o600)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+func loginCmd(o *options) *cobra.Command {
+	var email, name string
+	cmd := &cobra.Command{
+		Use:   "login",
+		Short: "Sign in and save an API token for the other commands",
+		Long: "Sign in with your email and password, then create an API token for todocli and save it,\n" +
+			"with the server URL, to the configuration file. The password is only sent to sign in.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			in := bufio.NewReader(os.Stdin)
+			if email == "" {
+				email = prompt(in, "Email: ", false)
+			}
+			password := prompt(in, "Password: ", true)
+			c := newClient(o.serverURL(), "")
+			session, code, err := signIn(cmd.Context(), c, in, email, password)
+			if err != nil {
+				return err
+			}
+			c.token = session
+			// The session was only needed to create the API token.
+			defer c.do(context.WithoutCancel(cmd.Context()), http.MethodPost, "/auth/logout", nil, nil, nil)
+
+			if name == "" {
+				host, _ := os.Hostname()
+				name = strings.TrimSpace("todocli " + host)
+			}
+			var header http.Header
+			if code != "" {
+				header = http.Header{"X-Otp": {code}}
+			}
+			var created struct {
+				ID    string `json:"token_id"`
+				Token string `json:"token"`
+			}
+			if err := c.do(cmd.Context(), http.MethodPost, "/auth/tokens", header, map[string]string{"name": name}, &created); err != nil {
+				return fmt.Errorf("creating a token: %w", err)
+			}
+			conf := o.conf
+			conf.Server, conf.Token, conf.TokenID = o.serverURL(), created.Token, created.ID
+			if err := writeConfig(o.configFile, conf); err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "Signed in to %s, token saved to %s\n", conf.Server, o.configFile)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&email, "email", "", "email to sign in with (default asked)")
+	cmd.Flags().StringVar(&name, "name", "", `name of the API token (default "todocli <hostname>")`)
+	return cmd
+}
+
+// signIn signs in with email and password, asking for a two-factor code
+// if the account needs one. It returns the session's access token and the
+// code, which creating a token asks for again.
+func signIn(ctx context.Context, c *client, in *bufio.Reader, email, password string) (string, string, error) {
+	creds := map[string]string{"email": email, "password": password}
+	var resp struct {
+		Token string `json:"token"`
+	}
+	err := c.do(ctx, http.MethodPost, "/auth/login", nil, creds, &resp)
+	var e *apiError
+	if errors.As(err, &e) && e.Code == "totp_required" {
+		creds["code"] = prompt(in, "Two-factor code: ", false)
+		err = c.do(ctx, http.MethodPost, "/auth/login", nil, creds, &resp)
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("signing in: %w", err)
+	}
+	return resp.Token, creds["code"], nil
+}
+
+func logoutCmd(o *options) *cobra.Command {
+	return &cobra.Command{
+		Use:   "logout",
+		Short: "Revoke the saved API token and forget it",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			conf := o.conf
+			if conf.Token == "" {
+				return errors.New("not signed in")
+			}
+			if conf.TokenID != "" {
+				c := newClient(o.serverURL(), conf.Token)
+				var e *apiError
+				err := c.do(cmd.Context(), http.MethodDelete, "/auth/tokens/"+url.PathEscape(conf.TokenID), nil, nil, nil)
+				// A token that is already gone is as good as revoked.
+				if err != nil && !(errors.As(err, &e) && (e.Status == http.StatusNotFound || e.Status == http.StatusUnauthorized)) {
+					return fmt.Errorf("revoking the token: %w", err)
+				}
+			}
+			conf.Token, conf.TokenID = "", ""
+			return writeConfig(o.configFile, conf)
+		},
+	}
+}
+
+// prompt asks for a line of input on the terminal, without echoing it if
+// secret.
+func prompt(in *bufio.Reader, label string, secret bool) string {
+	fmt.Fprint(os.Stderr, label)
+	if secret && term.IsTerminal(int(os.Stdin.Fd())) {
+		b, _ := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		return string(b)
+	}
+	line, _ := in.ReadString('\n')
+	if secret {
+		return strings.TrimRight(line, "\r\n")
+	}
+	return strings.TrimSpace(line)
+}
@@ -0,0 +1,140 @@
+// Command todocli is a terminal client for the todo service, talking to
+// its HTTP API:
+//
+//	todocli login
+//	todocli add Buy milk --due 2026-10-20
+//	todocli list
+//	todocli done TODO-42
+//	todocli rm TODO-42
+//	todocli search milk
+//
+// Todos are named by their id or their reference, such as TODO-42. The
+// server URL and API token come from --server and --token, the
+// TODOCLI_SERVER and TODOCLI_TOKEN environment variables, or the
+// configuration file login writes, in that order.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+// defaultServer is where the server is found when nothing says otherwise.
+const defaultServer = "http://localhost:8080"
+
+// options are the flags every command takes.
+type options struct {
+	configFile string
+	server     string
+	token      string
+	output     string
+	// conf is the configuration file as read before the command runs.
+	conf config
+}
+
+func main() {
+	if err := rootCmd().Execute(); err != nil {
+		os.Exit(1)
+	}
+}
+
+func rootCmd() *cobra.Command {
+	o := &options{}
+	cmd := &cobra.Command{
+		Use:          "todocli",
+		Short:        "Manage your todos from the terminal",
+		SilenceUsage: true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if o.output != "table" && o.output != "json" {
+				return fmt.Errorf("--output must be table or json, not %q", o.output)
+			}
+			var err error
+			o.conf, err = readConfig(o.configFile)
+			return err
+		},
+	}
+	f := cmd.PersistentFlags()
+	f.StringVar(&o.configFile, "config", defaultConfigPath(), "configuration file")
+	f.StringVar(&o.server, "server", "", "server URL (default from TODOCLI_SERVER, the configuration file or "+defaultServer+")")
+	f.StringVar(&o.token, "token", "", "API token (default from TODOCLI_TOKEN or the configuration file)")
+	f.StringVarP(&o.output, "output", "o", "table", "output format: table or json")
+	cmd.AddCommand(
+		loginCmd(o),
+		logoutCmd(o),
+		addCmd(o),
+		listCmd(o),
+		doneCmd(o),
+		rmCmd(o),
+		searchCmd(o),
+	)
+	return cmd
+}
+
+// serverURL is the server to talk to, without a trailing slash.
+func (o *options) serverURL() string {
+	s := firstSet(o.server, os.Getenv("TODOCLI_SERVER"), o.conf.Server, defaultServer)
+	return strings.TrimRight(s, "/")
+}
+
+// client returns a client for the server, signed in with the API token.
+func (o *options) client() (*client, error) {
+	token := firstSet(o.token, os.Getenv("TODOCLI_TOKEN"), o.conf.Token)
+	if token == "" {
+		return nil, fmt.Errorf("not signed in: run todocli login, or pass --token")
+	}
+	return newClient(o.serverURL(), token), nil
+}
+
+func firstSet(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// printJSON writes v indented, for --output json.
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// printTodos writes todos in the chosen output format.
+func (o *options) printTodos(todos []todo) error {
+	if o.output == "json" {
+		if todos == nil {
+			todos = []todo{}
+		}
+		return printJSON(todos)
+	}
+	if len(todos) == 0 {
+		fmt.Println("No todos.")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tDONE\tTITLE\tDUE\tTAGS")
+	for _, t := range todos {
+		done := ""
+		if t.Completed {
+			done = "x"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", t.name(), done, t.Title, t.DueDate, strings.Join(t.Tags, ","))
+	}
+	return w.Flush()
+}
+
+// printDone reports a change to a todo, or prints it as JSON.
+func (o *options) printDone(message string, v any) error {
+	if o.output == "json" {
+		return printJSON(v)
+	}
+	fmt.Println(message)
+	return nil
+}
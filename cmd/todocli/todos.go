@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+func addCmd(o *options) *cobra.Command {
+	var req struct {
+		Title   string   `json:"title"`
+		DueDate string   `json:"dueDate,omitempty"`
+		ListID  string   `json:"listId,omitempty"`
+		Tags    []string `json:"tags,omitempty"`
+	}
+	cmd := &cobra.Command{
+		Use:   "add TITLE...",
+		Short: "Add a todo",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := o.client()
+			if err != nil {
+				return err
+			}
+			req.Title = strings.Join(args, " ")
+			var resp struct {
+				ID string `json:"todo_id"`
+			}
+			if err := c.do(cmd.Context(), http.MethodPost, "/todo", nil, req, &resp); err != nil {
+				return err
+			}
+			return o.printDone("Added "+resp.ID, map[string]string{"id": resp.ID})
+		},
+	}
+	cmd.Flags().StringVar(&req.DueDate, "due", "", "due date, as 2006-01-02")
+	cmd.Flags().StringVar(&req.ListID, "list", "", "id of the list to add it to")
+	cmd.Flags().StringSliceVar(&req.Tags, "tag", nil, "tag it, can be repeated")
+	return cmd
+}
+
+func listCmd(o *options) *cobra.Command {
+	var (
+		f         todoFilter
+		all, done bool
+	)
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List open todos",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := o.client()
+			if err != nil {
+				return err
+			}
+			todos, err := c.listTodos(cmd.Context(), f)
+			if err != nil {
+				return err
+			}
+			shown := []todo{}
+			for _, t := range todos {
+				if all || t.Completed == done {
+					shown = append(shown, t)
+				}
+			}
+			return o.printTodos(shown)
+		},
+	}
+	cmd.Flags().BoolVarP(&all, "all", "a", false, "list completed todos too")
+	cmd.Flags().BoolVar(&done, "done", false, "list completed todos only")
+	cmd.Flags().StringVar(&f.ListID, "list", "", "only todos in the list with this id")
+	cmd.Flags().StringVar(&f.AssignedTo, "assigned-to", "", "only todos assigned to this user id, or me")
+	cmd.Flags().StringVar(&f.DueBefore, "due-before", "", "only todos due before this date, as 2006-01-02")
+	cmd.MarkFlagsMutuallyExclusive("all", "done")
+	return cmd
+}
+
+func doneCmd(o *options) *cobra.Command {
+	var undo bool
+	cmd := &cobra.Command{
+		Use:   "done ID|REF...",
+		Short: "Mark todos as completed",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := o.client()
+			if err != nil {
+				return err
+			}
+			var changed []todo
+			for _, name := range args {
+				t, err := c.findTodo(cmd.Context(), name)
+				if err != nil {
+					return err
+				}
+				// Updates replace the title as well as the completion.
+				req := map[string]any{"title": t.Title, "completed": !undo}
+				if err := c.do(cmd.Context(), http.MethodPut, "/todo/"+url.PathEscape(t.ID), nil, req, nil); err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+				t.Completed = !undo
+				changed = append(changed, t)
+				if o.output == "json" {
+					continue
+				}
+				if undo {
+					fmt.Printf("%s: reopened\n", t.name())
+				} else {
+					fmt.Printf("%s: done\n", t.name())
+				}
+			}
+			if o.output == "json" {
+				return printJSON(changed)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&undo, "undo", false, "mark them as open again instead")
+	return cmd
+}
+
+func rmCmd(o *options) *cobra.Command {
+	return &cobra.Command{
+		Use:     "rm ID|REF...",
+		Aliases: []string{"delete"},
+		Short:   "Delete todos",
+		Args:    cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := o.client()
+			if err != nil {
+				return err
+			}
+			for _, name := range args {
+				// The server takes references in place of ids.
+				if err := c.do(cmd.Context(), http.MethodDelete, "/todo/"+url.PathEscape(name), nil, nil, nil); err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+				if o.output != "json" {
+					fmt.Printf("%s: deleted\n", name)
+				}
+			}
+			if o.output == "json" {
+				return printJSON(map[string][]string{"deleted": args})
+			}
+			return nil
+		},
+	}
+}
+
+func searchCmd(o *options) *cobra.Command {
+	var (
+		tag, listID string
+		completed   string
+	)
+	cmd := &cobra.Command{
+		Use:   "search QUERY...",
+		Short: "Search todos by their title",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := o.client()
+			if err != nil {
+				return err
+			}
+			q := url.Values{"q": {strings.Join(args, " ")}}
+			for k, v := range map[string]string{"tag": tag, "list": listID, "completed": completed} {
+				if v != "" {
+					q.Set(k, v)
+				}
+			}
+			var resp struct {
+				Data []todo `json:"data"`
+			}
+			if err := c.do(cmd.Context(), http.MethodGet, "/todo/search?"+q.Encode(), nil, nil, &resp); err != nil {
+				return err
+			}
+			return o.printTodos(resp.Data)
+		},
+	}
+	cmd.Flags().StringVar(&tag, "tag", "", "only todos with this tag")
+	cmd.Flags().StringVar(&listID, "list", "", "only todos in the list with this id")
+	cmd.Flags().StringVar(&completed, "completed", "", "only completed (true) or open (false) todos")
+	return cmd
+}
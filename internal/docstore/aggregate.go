@@ -0,0 +1,292 @@
+package docstore
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// aggregate runs pipeline over docs.
+func aggregate(docs []bson.D, pipeline bson.A) ([]bson.D, error) {
+	for _, s := range pipeline {
+		stage, ok := s.(bson.D)
+		if !ok || len(stage) != 1 {
+			return nil, fmt.Errorf("docstore: a pipeline stage must be a document with one field")
+		}
+		var err error
+		if docs, err = runStage(docs, stage[0]); err != nil {
+			return nil, err
+		}
+	}
+	return docs, nil
+}
+
+func runStage(docs []bson.D, stage bson.E) ([]bson.D, error) {
+	switch stage.Key {
+	case "$match":
+		q, ok := stage.Value.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("docstore: $match needs a document")
+		}
+		var out []bson.D
+		for _, d := range docs {
+			ok, err := matches(d, q)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				out = append(out, d)
+			}
+		}
+		return out, nil
+	case "$group":
+		return group(docs, stage.Value)
+	case "$sort":
+		spec, ok := stage.Value.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("docstore: $sort needs a document")
+		}
+		out := slices.Clone(docs)
+		sortDocs(out, spec)
+		return out, nil
+	case "$unwind":
+		path, ok := stage.Value.(string)
+		if !ok || !strings.HasPrefix(path, "$") {
+			return nil, fmt.Errorf("docstore: $unwind needs a field path")
+		}
+		path = path[1:]
+		var out []bson.D
+		for _, d := range docs {
+			v, _ := lookupOne(d, path)
+			a, ok := v.(bson.A)
+			if !ok {
+				if v != nil {
+					out = append(out, d)
+				}
+				continue
+			}
+			for _, e := range a {
+				u, err := set(copyValue(d).(bson.D), path, e)
+				if err != nil {
+					return nil, err
+				}
+				out = append(out, u)
+			}
+		}
+		return out, nil
+	case "$skip", "$limit":
+		n := int(number(stage.Value))
+		if n < 0 || number(stage.Value) != float64(n) {
+			return nil, fmt.Errorf("docstore: %s needs a non-negative integer", stage.Key)
+		}
+		if stage.Key == "$skip" {
+			return docs[min(n, len(docs)):], nil
+		}
+		return docs[:min(n, len(docs))], nil
+	}
+	return nil, fmt.Errorf("docstore: unsupported pipeline stage %s", stage.Key)
+}
+
+func group(docs []bson.D, spec any) ([]bson.D, error) {
+	fields, ok := spec.(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("docstore: $group needs a document")
+	}
+	idExpr, ok := get(fields, "_id")
+	if !ok {
+		return nil, fmt.Errorf("docstore: $group needs an _id")
+	}
+	var order []string
+	groups := map[string]bson.D{}
+	for _, d := range docs {
+		id, err := eval(d, idExpr)
+		if err != nil {
+			return nil, err
+		}
+		k, err := key(id)
+		if err != nil {
+			return nil, err
+		}
+		out, seen := groups[k]
+		if !seen {
+			order = append(order, k)
+			out = bson.D{{Key: "_id", Value: id}}
+		}
+		for _, f := range fields {
+			if f.Key == "_id" {
+				continue
+			}
+			acc, ok := f.Value.(bson.D)
+			if !ok || len(acc) != 1 {
+				return nil, fmt.Errorf("docstore: $group field %s needs one accumulator", f.Key)
+			}
+			v, err := eval(d, acc[0].Value)
+			if err != nil {
+				return nil, err
+			}
+			old, had := get(out, f.Key)
+			next, err := accumulate(acc[0].Key, old, had, v)
+			if err != nil {
+				return nil, err
+			}
+			if out, err = set(out, f.Key, next); err != nil {
+				return nil, err
+			}
+		}
+		groups[k] = out
+	}
+	result := make([]bson.D, 0, len(order))
+	for _, k := range order {
+		result = append(result, groups[k])
+	}
+	return result, nil
+}
+
+func accumulate(op string, old any, had bool, v any) (any, error) {
+	switch op {
+	case "$sum":
+		if typeOrder(v) != 2 {
+			v = int32(0)
+		}
+		if !had {
+			return v, nil
+		}
+		return add(old, v)
+	case "$first":
+		if had {
+			return old, nil
+		}
+		return v, nil
+	case "$last":
+		return v, nil
+	case "$min", "$max":
+		if v == nil {
+			return old, nil
+		}
+		c := compare(v, old)
+		if !had || old == nil || op == "$min" && c < 0 || op == "$max" && c > 0 {
+			return v, nil
+		}
+		return old, nil
+	case "$push", "$addToSet":
+		a, _ := old.(bson.A)
+		if op == "$addToSet" && containsValue(a, v) {
+			return a, nil
+		}
+		return append(a, v), nil
+	}
+	return nil, fmt.Errorf("docstore: unsupported accumulator %s", op)
+}
+
+// eval evaluates an aggregation expression against doc.
+func eval(doc bson.D, expr any) (any, error) {
+	switch e := expr.(type) {
+	case string:
+		switch {
+		case e == "$$ROOT":
+			return doc, nil
+		case strings.HasPrefix(e, "$$"):
+			return nil, fmt.Errorf("docstore: unsupported variable %s", e)
+		case strings.HasPrefix(e, "$"):
+			v, _ := lookupOne(doc, e[1:])
+			return v, nil
+		}
+		return e, nil
+	case bson.A:
+		out := make(bson.A, len(e))
+		for i, x := range e {
+			v, err := eval(doc, x)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = v
+		}
+		return out, nil
+	case bson.D:
+		if len(e) == 1 && strings.HasPrefix(e[0].Key, "$") {
+			return evalOperator(doc, e[0])
+		}
+		out := bson.D{}
+		for _, f := range e {
+			v, err := eval(doc, f.Value)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, bson.E{Key: f.Key, Value: v})
+		}
+		return out, nil
+	}
+	return expr, nil
+}
+
+func evalOperator(doc bson.D, op bson.E) (any, error) {
+	arg, err := eval(doc, op.Value)
+	if err != nil {
+		return nil, err
+	}
+	switch op.Key {
+	case "$literal":
+		return op.Value, nil
+	case "$bsonSize":
+		d, ok := arg.(bson.D)
+		if !ok {
+			return nil, nil
+		}
+		raw, err := bson.Marshal(d)
+		if err != nil {
+			return nil, err
+		}
+		return int32(len(raw)), nil
+	case "$add":
+		args, ok := arg.(bson.A)
+		if !ok {
+			args = bson.A{arg}
+		}
+		var sum any = int32(0)
+		for _, a := range args {
+			if a == nil {
+				return nil, nil
+			}
+			if sum, err = add(sum, a); err != nil {
+				return nil, fmt.Errorf("docstore: $add: %w", err)
+			}
+		}
+		return sum, nil
+	case "$cond":
+		var cond, then, otherwise any
+		switch a := arg.(type) {
+		case bson.A:
+			if len(a) != 3 {
+				return nil, fmt.Errorf("docstore: $cond needs three arguments")
+			}
+			cond, then, otherwise = a[0], a[1], a[2]
+		case bson.D:
+			cond, _ = get(a, "if")
+			then, _ = get(a, "then")
+			otherwise, _ = get(a, "else")
+		}
+		if truthy(cond) {
+			return then, nil
+		}
+		return otherwise, nil
+	}
+	return nil, fmt.Errorf("docstore: unsupported expression operator %s", op.Key)
+}
+
+// sortDocs sorts docs by spec, a document of paths mapped to 1 or -1.
+func sortDocs(docs []bson.D, spec bson.D) {
+	slices.SortStableFunc(docs, func(a, b bson.D) int {
+		for _, f := range spec {
+			c := compare(first(a, f.Key), first(b, f.Key))
+			if number(f.Value) < 0 {
+				c = -c
+			}
+			if c != 0 {
+				return c
+			}
+		}
+		return 0
+	})
+}
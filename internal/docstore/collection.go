@@ -0,0 +1,605 @@
+package docstore
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// Collection is a handle on one collection, with the methods of
+// *mongo.Collection that the store supports. Options it has no use for,
+// such as hints and collations, are ignored.
+type Collection struct {
+	store *Store
+	name  string
+}
+
+// Name returns the collection's name.
+func (c *Collection) Name() string {
+	return c.name
+}
+
+// collect applies opts to a fresh options struct.
+func collect[T any](opts []options.Lister[T]) (T, error) {
+	var o T
+	for _, l := range opts {
+		if l == nil {
+			continue
+		}
+		for _, set := range l.List() {
+			if err := set(&o); err != nil {
+				return o, err
+			}
+		}
+	}
+	return o, nil
+}
+
+func flag(b *bool) bool {
+	return b != nil && *b
+}
+
+// read runs fn with the collection's documents locked for reading.
+func (c *Collection) read(fn func(*collection) error) error {
+	c.store.mu.RLock()
+	defer c.store.mu.RUnlock()
+	if c.store.closed {
+		return ErrClosed
+	}
+	coll, ok := c.store.collections[c.name]
+	if !ok {
+		coll = &collection{name: c.name}
+	}
+	return fn(coll)
+}
+
+// write runs fn in a batch, committed once it returns.
+func (c *Collection) write(fn func(*batch) error) error {
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+	b, err := c.store.begin(c.name)
+	if err != nil {
+		return err
+	}
+	return b.commit(fn(b))
+}
+
+// find returns the documents matching filter, sorted and paged.
+func find(coll *collection, filter, sort any, skip, limit int64) ([]bson.D, error) {
+	q, err := toDoc(filter)
+	if err != nil {
+		return nil, err
+	}
+	docs, err := coll.scan(q)
+	if err != nil {
+		return nil, err
+	}
+	if sort != nil {
+		spec, err := toDoc(sort)
+		if err != nil {
+			return nil, err
+		}
+		sortDocs(docs, spec)
+	}
+	docs = docs[min(int(skip), len(docs)):]
+	if limit < 0 {
+		limit = -limit
+	}
+	if limit > 0 && int(limit) < len(docs) {
+		docs = docs[:limit]
+	}
+	return docs, nil
+}
+
+func deref(n *int64) int64 {
+	if n == nil {
+		return 0
+	}
+	return *n
+}
+
+func cursor(docs []bson.D, projection any) (*mongo.Cursor, error) {
+	out := make([]any, len(docs))
+	for i, d := range docs {
+		p, err := project(d, projection)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = p
+	}
+	return mongo.NewCursorFromDocuments(out, nil, nil)
+}
+
+func single(doc bson.D, projection any, err error) *mongo.SingleResult {
+	if err == nil && doc == nil {
+		err = mongo.ErrNoDocuments
+	}
+	if err != nil {
+		return mongo.NewSingleResultFromDocument(bson.D{}, err, nil)
+	}
+	p, err := project(doc, projection)
+	if err != nil {
+		return mongo.NewSingleResultFromDocument(bson.D{}, err, nil)
+	}
+	return mongo.NewSingleResultFromDocument(p, nil, nil)
+}
+
+// project applies a projection of either inclusions or exclusions.
+func project(doc bson.D, projection any) (bson.D, error) {
+	if projection == nil {
+		return doc, nil
+	}
+	spec, err := toDoc(projection)
+	if err != nil || len(spec) == 0 {
+		return doc, err
+	}
+	// _id is included unless excluded, so its flag only counts when it is
+	// the only field.
+	include := len(spec) == 1 && truthy(spec[0].Value)
+	for _, f := range spec {
+		if f.Key != "_id" && truthy(f.Value) {
+			include = true
+		}
+	}
+	if !include {
+		out := copyValue(doc).(bson.D)
+		for _, f := range spec {
+			out = unset(out, f.Key)
+		}
+		return out, nil
+	}
+	out := bson.D{}
+	if v, ok := get(spec, "_id"); !ok || truthy(v) {
+		if id, ok := get(doc, "_id"); ok {
+			out = append(out, bson.E{Key: "_id", Value: id})
+		}
+	}
+	for _, f := range spec {
+		if f.Key == "_id" || !truthy(f.Value) {
+			continue
+		}
+		if v, ok := lookupOne(doc, f.Key); ok {
+			if out, err = set(out, f.Key, copyValue(v)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return out, nil
+}
+
+// Find returns the documents matching filter.
+func (c *Collection) Find(_ context.Context, filter any, opts ...options.Lister[options.FindOptions]) (*mongo.Cursor, error) {
+	o, err := collect(opts)
+	if err != nil {
+		return nil, err
+	}
+	var docs []bson.D
+	err = c.read(func(coll *collection) error {
+		docs, err = find(coll, filter, o.Sort, deref(o.Skip), deref(o.Limit))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cursor(docs, o.Projection)
+}
+
+// FindOne returns the first document matching filter.
+func (c *Collection) FindOne(_ context.Context, filter any, opts ...options.Lister[options.FindOneOptions]) *mongo.SingleResult {
+	o, err := collect(opts)
+	if err != nil {
+		return single(nil, nil, err)
+	}
+	var doc bson.D
+	err = c.read(func(coll *collection) error {
+		docs, err := find(coll, filter, o.Sort, deref(o.Skip), 1)
+		if len(docs) > 0 {
+			doc = docs[0]
+		}
+		return err
+	})
+	return single(doc, o.Projection, err)
+}
+
+// CountDocuments counts the documents matching filter.
+func (c *Collection) CountDocuments(_ context.Context, filter any, opts ...options.Lister[options.CountOptions]) (int64, error) {
+	o, err := collect(opts)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	err = c.read(func(coll *collection) error {
+		docs, err := find(coll, filter, nil, deref(o.Skip), deref(o.Limit))
+		n = int64(len(docs))
+		return err
+	})
+	return n, err
+}
+
+// Aggregate runs pipeline over the collection.
+func (c *Collection) Aggregate(_ context.Context, pipeline any, _ ...options.Lister[options.AggregateOptions]) (*mongo.Cursor, error) {
+	v, err := toValue(pipeline)
+	if err != nil {
+		return nil, err
+	}
+	stages, ok := v.(bson.A)
+	if !ok {
+		return nil, fmt.Errorf("docstore: a pipeline must be an array of stages")
+	}
+	var docs []bson.D
+	err = c.read(func(coll *collection) error {
+		all, err := coll.scan(bson.D{})
+		if err == nil {
+			docs, err = aggregate(all, stages)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cursor(docs, nil)
+}
+
+// insert adds doc, giving it an ObjectID if it has no _id.
+func insert(b *batch, v any) (any, error) {
+	doc, err := toDoc(v)
+	if err != nil {
+		return nil, err
+	}
+	id, ok := get(doc, "_id")
+	if !ok {
+		id = bson.NewObjectID()
+		doc = append(bson.D{{Key: "_id", Value: id}}, doc...)
+	}
+	k, err := key(id)
+	if err != nil {
+		return nil, err
+	}
+	if _, taken := b.c.docs[k]; taken {
+		return nil, mongo.WriteException{WriteErrors: []mongo.WriteError{{
+			Code:    11000,
+			Message: fmt.Sprintf("E11000 duplicate key error collection: %s index: _id_ dup key: { _id: %v }", b.c.name, id),
+		}}}
+	}
+	return id, b.put(k, doc)
+}
+
+// InsertOne adds a document.
+func (c *Collection) InsertOne(_ context.Context, document any, _ ...options.Lister[options.InsertOneOptions]) (*mongo.InsertOneResult, error) {
+	var id any
+	err := c.write(func(b *batch) (err error) {
+		id, err = insert(b, document)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mongo.InsertOneResult{InsertedID: id, Acknowledged: true}, nil
+}
+
+// InsertMany adds documents, a slice, in order, stopping at the first that
+// fails.
+func (c *Collection) InsertMany(_ context.Context, documents any, _ ...options.Lister[options.InsertManyOptions]) (*mongo.InsertManyResult, error) {
+	v := reflect.ValueOf(documents)
+	if v.Kind() != reflect.Slice {
+		return nil, fmt.Errorf("docstore: InsertMany needs a slice, not %T", documents)
+	}
+	res := &mongo.InsertManyResult{Acknowledged: true}
+	err := c.write(func(b *batch) error {
+		for i := range v.Len() {
+			id, err := insert(b, v.Index(i).Interface())
+			if err != nil {
+				return err
+			}
+			res.InsertedIDs = append(res.InsertedIDs, id)
+		}
+		return nil
+	})
+	return res, err
+}
+
+// remove deletes up to limit documents matching filter, the first in sort
+// order, and returns them.
+func remove(b *batch, filter, sort any, limit int64) ([]bson.D, error) {
+	docs, err := find(b.c, filter, sort, 0, limit)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range docs {
+		id, _ := get(d, "_id")
+		k, err := key(id)
+		if err == nil {
+			err = b.put(k, nil)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return docs, nil
+}
+
+// DeleteOne deletes the first document matching filter.
+func (c *Collection) DeleteOne(_ context.Context, filter any, _ ...options.Lister[options.DeleteOneOptions]) (*mongo.DeleteResult, error) {
+	var n int
+	err := c.write(func(b *batch) error {
+		docs, err := remove(b, filter, nil, 1)
+		n = len(docs)
+		return err
+	})
+	return &mongo.DeleteResult{DeletedCount: int64(n), Acknowledged: true}, err
+}
+
+// DeleteMany deletes every document matching filter.
+func (c *Collection) DeleteMany(_ context.Context, filter any, _ ...options.Lister[options.DeleteManyOptions]) (*mongo.DeleteResult, error) {
+	var n int
+	err := c.write(func(b *batch) error {
+		docs, err := remove(b, filter, nil, 0)
+		n = len(docs)
+		return err
+	})
+	return &mongo.DeleteResult{DeletedCount: int64(n), Acknowledged: true}, err
+}
+
+// FindOneAndDelete deletes the first document matching filter and returns
+// it.
+func (c *Collection) FindOneAndDelete(_ context.Context, filter any, opts ...options.Lister[options.FindOneAndDeleteOptions]) *mongo.SingleResult {
+	o, err := collect(opts)
+	if err != nil {
+		return single(nil, nil, err)
+	}
+	var doc bson.D
+	err = c.write(func(b *batch) error {
+		docs, err := remove(b, filter, o.Sort, 1)
+		if len(docs) > 0 {
+			doc = docs[0]
+		}
+		return err
+	})
+	return single(doc, o.Projection, err)
+}
+
+// updated is what update did to one document.
+type updated struct {
+	before, after bson.D
+	upserted      any
+}
+
+// update applies u, update operators or a replacement document, to up to
+// limit documents matching filter, inserting one if there are none and
+// upsert is set.
+func update(b *batch, filter, u, sort any, limit int64, upsert, replace bool) ([]updated, error) {
+	q, err := toDoc(filter)
+	if err != nil {
+		return nil, err
+	}
+	uv, err := toValue(u)
+	if err != nil {
+		return nil, err
+	}
+	ud, ok := uv.(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("docstore: pipeline updates are not supported")
+	}
+	if replace != isReplacement(ud) {
+		if replace {
+			return nil, fmt.Errorf("docstore: a replacement cannot contain update operators")
+		}
+		return nil, fmt.Errorf("docstore: an update needs update operators")
+	}
+	docs, err := find(b.c, q, sort, 0, limit)
+	if err != nil {
+		return nil, err
+	}
+	var out []updated
+	if len(docs) == 0 && upsert {
+		start, err := seed(q)
+		if err != nil {
+			return nil, err
+		}
+		doc := start
+		if replace {
+			doc = copyValue(ud).(bson.D)
+			if id, ok := get(start, "_id"); ok {
+				doc = append(bson.D{{Key: "_id", Value: id}}, unset(doc, "_id")...)
+			}
+		} else if doc, err = apply(start, ud, true); err != nil {
+			return nil, err
+		}
+		id, err := insert(b, doc)
+		if err != nil {
+			return nil, err
+		}
+		after := b.c.docs[mustKey(id)]
+		return []updated{{after: after, upserted: id}}, nil
+	}
+	for _, before := range docs {
+		id, _ := get(before, "_id")
+		var after bson.D
+		if replace {
+			if newID, ok := get(ud, "_id"); ok && !equal(newID, id) {
+				return out, fmt.Errorf("docstore: the _id field cannot be changed")
+			}
+			after = append(bson.D{{Key: "_id", Value: id}}, unset(copyValue(ud).(bson.D), "_id")...)
+		} else if after, err = apply(before, ud, false); err != nil {
+			return out, err
+		}
+		if err := b.put(mustKey(id), after); err != nil {
+			return out, err
+		}
+		out = append(out, updated{before: before, after: after})
+	}
+	return out, nil
+}
+
+// mustKey returns the key of an _id already stored, which cannot fail.
+func mustKey(id any) string {
+	k, _ := key(id)
+	return k
+}
+
+func updateResult(res []updated) *mongo.UpdateResult {
+	r := &mongo.UpdateResult{Acknowledged: true}
+	for _, u := range res {
+		if u.upserted != nil {
+			r.UpsertedCount++
+			r.UpsertedID = u.upserted
+			continue
+		}
+		r.MatchedCount++
+		if compare(u.before, u.after) != 0 {
+			r.ModifiedCount++
+		}
+	}
+	return r
+}
+
+// UpdateOne updates the first document matching filter.
+func (c *Collection) UpdateOne(_ context.Context, filter, u any, opts ...options.Lister[options.UpdateOneOptions]) (*mongo.UpdateResult, error) {
+	o, err := collect(opts)
+	if err != nil {
+		return nil, err
+	}
+	var res []updated
+	err = c.write(func(b *batch) (err error) {
+		res, err = update(b, filter, u, nil, 1, flag(o.Upsert), false)
+		return err
+	})
+	return updateResult(res), err
+}
+
+// UpdateMany updates every document matching filter.
+func (c *Collection) UpdateMany(_ context.Context, filter, u any, opts ...options.Lister[options.UpdateManyOptions]) (*mongo.UpdateResult, error) {
+	o, err := collect(opts)
+	if err != nil {
+		return nil, err
+	}
+	var res []updated
+	err = c.write(func(b *batch) (err error) {
+		res, err = update(b, filter, u, nil, 0, flag(o.Upsert), false)
+		return err
+	})
+	return updateResult(res), err
+}
+
+// ReplaceOne replaces the first document matching filter.
+func (c *Collection) ReplaceOne(_ context.Context, filter, replacement any, opts ...options.Lister[options.ReplaceOptions]) (*mongo.UpdateResult, error) {
+	o, err := collect(opts)
+	if err != nil {
+		return nil, err
+	}
+	var res []updated
+	err = c.write(func(b *batch) (err error) {
+		res, err = update(b, filter, replacement, nil, 1, flag(o.Upsert), true)
+		return err
+	})
+	return updateResult(res), err
+}
+
+// FindOneAndUpdate updates the first document matching filter and returns
+// it as it was before, or after if the options say so.
+func (c *Collection) FindOneAndUpdate(_ context.Context, filter, u any, opts ...options.Lister[options.FindOneAndUpdateOptions]) *mongo.SingleResult {
+	o, err := collect(opts)
+	if err != nil {
+		return single(nil, nil, err)
+	}
+	var doc bson.D
+	err = c.write(func(b *batch) error {
+		res, err := update(b, filter, u, o.Sort, 1, flag(o.Upsert), false)
+		if len(res) > 0 {
+			doc = res[0].before
+			if o.ReturnDocument != nil && *o.ReturnDocument == options.After {
+				doc = res[0].after
+			}
+		}
+		return err
+	})
+	return single(doc, o.Projection, err)
+}
+
+// CreateIndexes records the indexes in models, as IndexView.CreateMany
+// does, and returns their names. An index already there by that name is
+// left as it is. Unique indexes are enforced from then on and TTL indexes
+// expire documents.
+func (c *Collection) CreateIndexes(_ context.Context, models []mongo.IndexModel) ([]string, error) {
+	var names []string
+	err := c.write(func(b *batch) error {
+		for _, m := range models {
+			ix, err := newIndex(m)
+			if err != nil {
+				return err
+			}
+			names = append(names, ix.name)
+			if hasIndex(b.c, ix.name) {
+				continue
+			}
+			if ix.unique {
+				for _, id := range b.c.ids {
+					doc := b.c.docs[id]
+					if k, ok := ix.key(doc); ok {
+						if _, taken := ix.entries[k]; taken {
+							return ix.duplicate(c.name, doc)
+						}
+						ix.entries[k] = id
+					}
+				}
+			}
+			b.c.indexes = append(b.c.indexes, ix)
+		}
+		return nil
+	})
+	return names, err
+}
+
+func hasIndex(c *collection, name string) bool {
+	for _, ix := range c.indexes {
+		if ix.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func newIndex(m mongo.IndexModel) (*index, error) {
+	keys, err := toDoc(m.Keys)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("docstore: an index needs keys")
+	}
+	var o options.IndexOptions
+	if m.Options != nil {
+		if o, err = collect([]options.Lister[options.IndexOptions]{m.Options}); err != nil {
+			return nil, err
+		}
+	}
+	ix := &index{keys: keys, unique: flag(o.Unique), ttl: -1, entries: map[string]string{}}
+	if o.Name != nil {
+		ix.name = *o.Name
+	} else {
+		var parts []string
+		for _, k := range keys {
+			parts = append(parts, fmt.Sprintf("%s_%v", k.Key, k.Value))
+		}
+		ix.name = strings.Join(parts, "_")
+	}
+	if o.ExpireAfterSeconds != nil {
+		ix.ttl = time.Duration(*o.ExpireAfterSeconds) * time.Second
+	}
+	if o.PartialFilterExpression != nil {
+		if ix.partial, err = toDoc(o.PartialFilterExpression); err != nil {
+			return nil, err
+		}
+		// Catch unsupported operators now rather than on every write.
+		if _, err := matches(bson.D{}, ix.partial); err != nil {
+			return nil, err
+		}
+	}
+	return ix, nil
+}
@@ -0,0 +1,258 @@
+package docstore
+
+import (
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// matches reports whether doc satisfies the query filter q.
+func matches(doc bson.D, q bson.D) (bool, error) {
+	for _, e := range q {
+		ok, err := matchField(doc, e)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchField(doc bson.D, e bson.E) (bool, error) {
+	switch e.Key {
+	case "$and", "$or", "$nor":
+		clauses, ok := e.Value.(bson.A)
+		if !ok || len(clauses) == 0 {
+			return false, fmt.Errorf("docstore: %s needs a non-empty array", e.Key)
+		}
+		for _, c := range clauses {
+			q, ok := c.(bson.D)
+			if !ok {
+				return false, fmt.Errorf("docstore: %s needs documents", e.Key)
+			}
+			ok, err := matches(doc, q)
+			if err != nil {
+				return false, err
+			}
+			switch {
+			case e.Key == "$and" && !ok:
+				return false, nil
+			case e.Key == "$or" && ok:
+				return true, nil
+			case e.Key == "$nor" && ok:
+				return false, nil
+			}
+		}
+		return e.Key != "$or", nil
+	}
+	if strings.HasPrefix(e.Key, "$") {
+		return false, fmt.Errorf("docstore: unsupported query operator %s", e.Key)
+	}
+	values := lookup(doc, e.Key)
+	if ops, ok := operators(e.Value); ok {
+		for _, op := range ops {
+			ok, err := matchOperator(values, op)
+			if err != nil || !ok {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+	return matchEqual(values, e.Value), nil
+}
+
+// operators returns v as a list of query operators if it is one, as in
+// {"$gt": 1}, rather than a document to compare against.
+func operators(v any) (bson.D, bool) {
+	d, ok := v.(bson.D)
+	if !ok || len(d) == 0 || !strings.HasPrefix(d[0].Key, "$") {
+		return nil, false
+	}
+	return d, true
+}
+
+// matchEqual reports whether any of the values equals want, or is an array
+// holding it. A missing field equals null.
+func matchEqual(values []any, want any) bool {
+	if len(values) == 0 {
+		return want == nil
+	}
+	for _, v := range values {
+		if equal(v, want) {
+			return true
+		}
+		if a, ok := v.(bson.A); ok {
+			for _, e := range a {
+				if equal(e, want) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// matchCompare reports whether any of the values, or any element of them,
+// compares to want as ok says. Only values of the same type compare, as in
+// Mongo, where {$gt: 1} never matches a string.
+func matchCompare(values []any, want any, ok func(int) bool) bool {
+	test := func(v any) bool {
+		return typeOrder(v) == typeOrder(want) && ok(compare(v, want))
+	}
+	for _, v := range values {
+		if test(v) {
+			return true
+		}
+		if a, isArray := v.(bson.A); isArray {
+			for _, e := range a {
+				if test(e) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func matchOperator(values []any, op bson.E) (bool, error) {
+	switch op.Key {
+	case "$eq":
+		return matchEqual(values, op.Value), nil
+	case "$ne":
+		return !matchEqual(values, op.Value), nil
+	case "$gt":
+		return matchCompare(values, op.Value, func(c int) bool { return c > 0 }), nil
+	case "$gte":
+		return matchCompare(values, op.Value, func(c int) bool { return c >= 0 }), nil
+	case "$lt":
+		return matchCompare(values, op.Value, func(c int) bool { return c < 0 }), nil
+	case "$lte":
+		return matchCompare(values, op.Value, func(c int) bool { return c <= 0 }), nil
+	case "$in", "$nin":
+		choices, ok := op.Value.(bson.A)
+		if !ok {
+			return false, fmt.Errorf("docstore: %s needs an array", op.Key)
+		}
+		found := false
+		for _, c := range choices {
+			if matchEqual(values, c) {
+				found = true
+				break
+			}
+		}
+		return found == (op.Key == "$in"), nil
+	case "$exists":
+		return (len(values) > 0) == truthy(op.Value), nil
+	case "$size":
+		n := number(op.Value)
+		for _, v := range values {
+			if a, ok := v.(bson.A); ok && float64(len(a)) == n {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$elemMatch":
+		q, ok := op.Value.(bson.D)
+		if !ok {
+			return false, fmt.Errorf("docstore: $elemMatch needs a document")
+		}
+		for _, v := range values {
+			a, ok := v.(bson.A)
+			if !ok {
+				continue
+			}
+			for _, e := range a {
+				var ok bool
+				var err error
+				if ops, isOps := operators(q); isOps {
+					ok, err = matchOperators([]any{e}, ops)
+				} else if d, isDoc := e.(bson.D); isDoc {
+					ok, err = matches(d, q)
+				}
+				if err != nil {
+					return false, err
+				}
+				if ok {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	case "$not":
+		ops, ok := operators(op.Value)
+		if !ok {
+			return false, fmt.Errorf("docstore: $not needs an operator document")
+		}
+		ok, err := matchOperators(values, ops)
+		return !ok, err
+	case "$type":
+		want, ok := op.Value.(string)
+		if !ok {
+			return false, fmt.Errorf("docstore: $type needs a type alias")
+		}
+		for _, v := range values {
+			if typeName(v) == want || want == "number" && typeOrder(v) == 2 {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return false, fmt.Errorf("docstore: unsupported query operator %s", op.Key)
+}
+
+func matchOperators(values []any, ops bson.D) (bool, error) {
+	for _, op := range ops {
+		ok, err := matchOperator(values, op)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// typeName returns the $type alias of v.
+func typeName(v any) string {
+	switch v.(type) {
+	case float64:
+		return "double"
+	case string:
+		return "string"
+	case bson.D:
+		return "object"
+	case bson.A:
+		return "array"
+	case bson.Binary:
+		return "binData"
+	case bson.ObjectID:
+		return "objectId"
+	case bool:
+		return "bool"
+	case bson.DateTime:
+		return "date"
+	case nil, bson.Null:
+		return "null"
+	case int32:
+		return "int"
+	case int64:
+		return "long"
+	case bson.Timestamp:
+		return "timestamp"
+	case bson.Decimal128:
+		return "decimal"
+	}
+	return ""
+}
+
+// truthy reports whether v counts as true where Mongo wants a flag, as in
+// {$exists: 1}.
+func truthy(v any) bool {
+	switch v := v.(type) {
+	case nil, bson.Null, bson.Undefined:
+		return false
+	case bool:
+		return v
+	case int32, int64, float64:
+		return number(v) != 0
+	}
+	return true
+}
@@ -0,0 +1,386 @@
+// Package docstore is an embedded document store answering the subset of
+// MongoDB's collection API the service uses, so that it can run without a
+// Mongo server. Documents are kept in memory and, given a Backend, written
+// through to disk.
+//
+// Queries, updates and aggregation pipelines follow Mongo's semantics for
+// the operators they support and fail on the others, rather than silently
+// matching differently. There are no transactions: each write is applied
+// and persisted on its own, as on a standalone Mongo server.
+package docstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// Backend persists documents. Load replays every stored document at
+// startup; Write stores a batch of changes, all or none of them.
+type Backend interface {
+	Load(fn func(collection string, doc bson.Raw) error) error
+	Write(changes []Change) error
+	Close() error
+}
+
+// Change is one document written to a Backend. ID is opaque but stable for
+// a given _id; a nil Doc deletes the document.
+type Change struct {
+	Collection string
+	ID         []byte
+	Doc        bson.Raw
+}
+
+// ErrClosed is returned by operations on a closed Store.
+var ErrClosed = errors.New("docstore: closed")
+
+// Store holds every collection.
+type Store struct {
+	mu          sync.RWMutex
+	backend     Backend
+	collections map[string]*collection
+	closed      bool
+	stop        chan struct{}
+	done        chan struct{}
+}
+
+// Open loads the documents kept by backend, or starts empty if it is nil,
+// and starts expiring documents as TTL indexes say.
+func Open(backend Backend) (*Store, error) {
+	s := &Store{
+		backend:     backend,
+		collections: map[string]*collection{},
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	if backend != nil {
+		err := backend.Load(func(name string, raw bson.Raw) error {
+			doc, err := decode(raw)
+			if err != nil {
+				return err
+			}
+			id, _ := get(doc, "_id")
+			k, err := key(id)
+			if err != nil {
+				return err
+			}
+			return s.collection(name).put(k, doc)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("docstore: load: %w", err)
+		}
+	}
+	go s.expireLoop()
+	return s, nil
+}
+
+// Close stops expiring documents and closes the backend.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+	close(s.stop)
+	<-s.done
+	if s.backend != nil {
+		return s.backend.Close()
+	}
+	return nil
+}
+
+// Ping reports whether the store is open.
+func (s *Store) Ping(context.Context) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return ErrClosed
+	}
+	return nil
+}
+
+// Collection returns the named collection, which need not exist yet.
+func (s *Store) Collection(name string) *Collection {
+	return &Collection{store: s, name: name}
+}
+
+// ListCollectionNames returns the names of the collections holding
+// documents that match filter, which is applied to {name: <name>}.
+func (s *Store) ListCollectionNames(_ context.Context, filter any, _ ...options.Lister[options.ListCollectionsOptions]) ([]string, error) {
+	q, err := toDoc(filter)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var names []string
+	for name, c := range s.collections {
+		if len(c.ids) == 0 {
+			continue
+		}
+		ok, err := matches(bson.D{{Key: "name", Value: name}}, q)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// collection returns the named collection, creating it if need be. The
+// caller must hold the write lock.
+func (s *Store) collection(name string) *collection {
+	c, ok := s.collections[name]
+	if !ok {
+		c = &collection{name: name, docs: map[string]bson.D{}}
+		s.collections[name] = c
+	}
+	return c
+}
+
+// collection is a collection's documents, in insertion order, and indexes.
+type collection struct {
+	name    string
+	ids     []string
+	docs    map[string]bson.D
+	indexes []*index
+}
+
+// put stores doc under id, or deletes the document if doc is nil, keeping
+// the unique indexes up to date.
+func (c *collection) put(id string, doc bson.D) error {
+	old := c.docs[id]
+	for _, ix := range c.indexes {
+		if !ix.unique || doc == nil {
+			continue
+		}
+		if k, ok := ix.key(doc); ok {
+			if owner, taken := ix.entries[k]; taken && owner != id {
+				return ix.duplicate(c.name, doc)
+			}
+		}
+	}
+	for _, ix := range c.indexes {
+		if !ix.unique {
+			continue
+		}
+		if old != nil {
+			if k, ok := ix.key(old); ok && ix.entries[k] == id {
+				delete(ix.entries, k)
+			}
+		}
+		if doc != nil {
+			if k, ok := ix.key(doc); ok {
+				ix.entries[k] = id
+			}
+		}
+	}
+	switch {
+	case doc == nil && old != nil:
+		delete(c.docs, id)
+		c.ids = slices.DeleteFunc(c.ids, func(k string) bool { return k == id })
+	case doc != nil:
+		if old == nil {
+			c.ids = append(c.ids, id)
+		}
+		c.docs[id] = doc
+	}
+	return nil
+}
+
+// scan returns the documents matching q, in insertion order.
+func (c *collection) scan(q bson.D) ([]bson.D, error) {
+	var found []bson.D
+	for _, id := range c.ids {
+		doc := c.docs[id]
+		ok, err := matches(doc, q)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			found = append(found, doc)
+		}
+	}
+	return found, nil
+}
+
+// change is one document put in a batch, with what it replaced.
+type change struct {
+	id       string
+	old, new bson.D
+}
+
+// batch collects the changes of one operation, applied in memory as they
+// are made and persisted together by commit.
+type batch struct {
+	store *Store
+	c     *collection
+	done  []change
+}
+
+func (s *Store) begin(name string) (*batch, error) {
+	if s.closed {
+		return nil, ErrClosed
+	}
+	return &batch{store: s, c: s.collection(name)}, nil
+}
+
+func (b *batch) put(id string, doc bson.D) error {
+	old := b.c.docs[id]
+	if err := b.c.put(id, doc); err != nil {
+		return err
+	}
+	b.done = append(b.done, change{id: id, old: old, new: doc})
+	return nil
+}
+
+// commit persists the changes made so far. If that fails they are undone
+// and the backend's error returned; otherwise err, the outcome of the
+// operation itself, is, since the changes made before an operation failed
+// stand as they would in Mongo.
+func (b *batch) commit(err error) error {
+	if len(b.done) == 0 || b.store.backend == nil {
+		return err
+	}
+	changes := make([]Change, len(b.done))
+	for i, ch := range b.done {
+		changes[i] = Change{Collection: b.c.name, ID: []byte(ch.id)}
+		if ch.new != nil {
+			raw, merr := bson.Marshal(ch.new)
+			if merr != nil {
+				b.undo()
+				return merr
+			}
+			changes[i].Doc = raw
+		}
+	}
+	if werr := b.store.backend.Write(changes); werr != nil {
+		b.undo()
+		return fmt.Errorf("docstore: write: %w", werr)
+	}
+	return err
+}
+
+func (b *batch) undo() {
+	for i := len(b.done) - 1; i >= 0; i-- {
+		// Restoring the earlier state cannot break a unique index.
+		b.c.put(b.done[i].id, b.done[i].old)
+	}
+	b.done = nil
+}
+
+// index is a collection index. Only unique and TTL indexes do anything;
+// the others are recorded so that creating them again is a no-op.
+type index struct {
+	name    string
+	keys    bson.D
+	unique  bool
+	partial bson.D
+	// ttl is how long after the time in the first key a document expires,
+	// or negative if the index is not a TTL index.
+	ttl     time.Duration
+	entries map[string]string
+}
+
+// key returns the index key of doc, or false if the index leaves doc out.
+func (ix *index) key(doc bson.D) (string, bool) {
+	if ix.partial != nil {
+		if ok, err := matches(doc, ix.partial); err != nil || !ok {
+			return "", false
+		}
+	}
+	values := make(bson.A, len(ix.keys))
+	for i, k := range ix.keys {
+		values[i] = first(doc, k.Key)
+	}
+	k, err := key(values)
+	return k, err == nil
+}
+
+func (ix *index) duplicate(collection string, doc bson.D) error {
+	dup := bson.D{}
+	for _, k := range ix.keys {
+		dup = append(dup, bson.E{Key: k.Key, Value: first(doc, k.Key)})
+	}
+	return mongo.WriteException{WriteErrors: []mongo.WriteError{{
+		Code:    11000,
+		Message: fmt.Sprintf("E11000 duplicate key error collection: %s index: %s dup key: %v", collection, ix.name, dup),
+	}}}
+}
+
+// expireLoop deletes expired documents each minute, as Mongo's TTL monitor
+// does.
+func (s *Store) expireLoop() {
+	defer close(s.done)
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-t.C:
+			s.expire(now)
+		}
+	}
+}
+
+// expire deletes the documents whose TTL indexes say they have expired by
+// now. Failures are left for the next round.
+func (s *Store) expire(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	for _, c := range s.collections {
+		for _, ix := range c.indexes {
+			if ix.ttl < 0 {
+				continue
+			}
+			b := &batch{store: s, c: c}
+			for _, id := range slices.Clone(c.ids) {
+				if expired(c.docs[id], ix, now) {
+					if b.put(id, nil) != nil {
+						break
+					}
+				}
+			}
+			if b.commit(nil) != nil {
+				return
+			}
+		}
+	}
+}
+
+// expired reports whether doc has expired under the TTL index ix: the
+// field holds a date, or an array with one, at least ix.ttl before now.
+func expired(doc bson.D, ix *index, now time.Time) bool {
+	if ix.partial != nil {
+		if ok, err := matches(doc, ix.partial); err != nil || !ok {
+			return false
+		}
+	}
+	v, _ := lookupOne(doc, ix.keys[0].Key)
+	values := bson.A{v}
+	if a, ok := v.(bson.A); ok {
+		values = a
+	}
+	for _, v := range values {
+		if t, ok := v.(bson.DateTime); ok && !t.Time().Add(ix.ttl).After(now) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,237 @@
+package docstore
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+type user struct {
+	ID      string    `bson:"_id"`
+	Email   string    `bson:"email"`
+	Age     int       `bson:"age"`
+	Tags    []string  `bson:"tags,omitempty"`
+	Members []member  `bson:"members,omitempty"`
+	Expires time.Time `bson:"expiresAt,omitempty"`
+}
+
+type member struct {
+	UserID string `bson:"userId"`
+	Role   string `bson:"role"`
+}
+
+// mapBackend keeps changes in a map, standing in for a file.
+type mapBackend map[[2]string]bson.Raw
+
+func (m mapBackend) Load(fn func(string, bson.Raw) error) error {
+	for k, doc := range m {
+		if err := fn(k[0], doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m mapBackend) Write(changes []Change) error {
+	for _, c := range changes {
+		k := [2]string{c.Collection, string(c.ID)}
+		if c.Doc == nil {
+			delete(m, k)
+		} else {
+			m[k] = c.Doc
+		}
+	}
+	return nil
+}
+
+func (mapBackend) Close() error { return nil }
+
+func open(t *testing.T, b Backend) *Store {
+	t.Helper()
+	s, err := Open(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestCollection(t *testing.T) {
+	ctx := context.Background()
+	backend := mapBackend{}
+	users := open(t, backend).Collection("users")
+	if _, err := users.CreateIndexes(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "email", Value: 1}}, Options: options.Index().SetUnique(true)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []user{
+		{ID: "a", Email: "a@example.com", Age: 30, Tags: []string{"x", "y"}, Members: []member{{"b", "owner"}}},
+		{ID: "b", Email: "b@example.com", Age: 20},
+		{ID: "c", Email: "c@example.com", Age: 40, Tags: []string{"y"}},
+	} {
+		if _, err := users.InsertOne(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := users.InsertOne(ctx, user{ID: "d", Email: "a@example.com"})
+	if !mongo.IsDuplicateKeyError(err) {
+		t.Errorf("duplicate email: err = %v", err)
+	}
+	_, err = users.InsertOne(ctx, user{ID: "a", Email: "other@example.com"})
+	if !mongo.IsDuplicateKeyError(err) {
+		t.Errorf("duplicate _id: err = %v", err)
+	}
+
+	ids := func(filter any, opts ...options.Lister[options.FindOptions]) []string {
+		t.Helper()
+		cur, err := users.Find(ctx, filter, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var found []user
+		if err := cur.All(ctx, &found); err != nil {
+			t.Fatal(err)
+		}
+		out := []string{}
+		for _, u := range found {
+			out = append(out, u.ID)
+		}
+		return out
+	}
+	for _, c := range []struct {
+		name   string
+		filter any
+		opts   []options.Lister[options.FindOptions]
+		want   []string
+	}{
+		{"all", bson.M{}, nil, []string{"a", "b", "c"}},
+		{"sorted", bson.M{}, []options.Lister[options.FindOptions]{options.Find().SetSort(bson.D{{Key: "age", Value: -1}})}, []string{"c", "a", "b"}},
+		{"paged", bson.M{}, []options.Lister[options.FindOptions]{options.Find().SetSort(bson.D{{Key: "age", Value: 1}}).SetSkip(1).SetLimit(1)}, []string{"a"}},
+		{"range", bson.M{"age": bson.M{"$gte": 30, "$lt": 40}}, nil, []string{"a"}},
+		{"array element", bson.M{"tags": "y"}, nil, []string{"a", "c"}},
+		{"in", bson.M{"_id": bson.M{"$in": []string{"b", "c", "z"}}}, nil, []string{"b", "c"}},
+		{"missing field", bson.M{"tags": bson.M{"$exists": false}}, nil, []string{"b"}},
+		{"ne", bson.M{"tags": bson.M{"$ne": "x"}}, nil, []string{"b", "c"}},
+		{"nested path", bson.M{"members.userId": "b"}, nil, []string{"a"}},
+		{"elemMatch", bson.M{"members": bson.M{"$elemMatch": bson.M{"userId": "b", "role": "owner"}}}, nil, []string{"a"}},
+		{"or", bson.M{"$or": []bson.M{{"age": 20}, {"tags": bson.M{"$size": 1}}}}, nil, []string{"b", "c"}},
+	} {
+		if got := ids(c.filter, c.opts...); !slices.Equal(got, c.want) {
+			t.Errorf("%s: found %v, want %v", c.name, got, c.want)
+		}
+	}
+	if _, err := users.Find(ctx, bson.M{"email": bson.M{"$regex": "a"}}); err == nil {
+		t.Error("an unsupported operator matched instead of failing")
+	}
+
+	res, err := users.UpdateOne(ctx, bson.M{"_id": "b"}, bson.M{
+		"$set":      bson.M{"email": "bob@example.com"},
+		"$inc":      bson.M{"age": 1},
+		"$addToSet": bson.M{"tags": "x"},
+	})
+	if err != nil || res.MatchedCount != 1 || res.ModifiedCount != 1 {
+		t.Fatalf("UpdateOne = %+v, %v", res, err)
+	}
+	var b user
+	if err := users.FindOne(ctx, bson.M{"_id": "b"}).Decode(&b); err != nil {
+		t.Fatal(err)
+	}
+	if b.Email != "bob@example.com" || b.Age != 21 || len(b.Tags) != 1 {
+		t.Errorf("updated user = %+v", b)
+	}
+	if _, err := users.UpdateOne(ctx, bson.M{"_id": "b"}, bson.M{"$set": bson.M{"email": "c@example.com"}}); !mongo.IsDuplicateKeyError(err) {
+		t.Errorf("update to a taken email: err = %v", err)
+	}
+	if _, err := users.UpdateMany(ctx, bson.M{}, bson.M{"$pull": bson.M{"tags": "y"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(bson.M{"tags": "y"}); len(got) != 0 {
+		t.Errorf("pulled tag still on %v", got)
+	}
+
+	var before user
+	err = users.FindOneAndUpdate(ctx, bson.M{"_id": "c"}, bson.M{"$unset": bson.M{"tags": ""}}).Decode(&before)
+	if err != nil || before.Age != 40 {
+		t.Errorf("FindOneAndUpdate before = %+v, %v", before, err)
+	}
+	var upserted bson.M
+	err = users.FindOneAndUpdate(ctx, bson.M{"email": "new@example.com"}, bson.M{"$setOnInsert": bson.M{"age": 5}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&upserted)
+	if _, isOID := upserted["_id"].(bson.ObjectID); err != nil || !isOID || upserted["email"] != "new@example.com" || upserted["age"] != int32(5) {
+		t.Errorf("FindOneAndUpdate upsert = %v, %v", upserted, err)
+	}
+	if err := users.FindOne(ctx, bson.M{"_id": "zz"}).Err(); err != mongo.ErrNoDocuments {
+		t.Errorf("FindOne of nothing: err = %v", err)
+	}
+
+	var projected bson.M
+	if err := users.FindOne(ctx, bson.M{"_id": "a"}, options.FindOne().SetProjection(bson.M{"email": 0, "members": 0})).Decode(&projected); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := projected["email"]; ok || projected["age"] == nil {
+		t.Errorf("projected = %v", projected)
+	}
+	var idOnly bson.M
+	if err := users.FindOne(ctx, bson.M{"_id": "a"}, options.FindOne().SetProjection(bson.M{"_id": 1})).Decode(&idOnly); err != nil {
+		t.Fatal(err)
+	}
+	if len(idOnly) != 1 || idOnly["_id"] != "a" {
+		t.Errorf("projected to the _id = %v", idOnly)
+	}
+
+	cur, err := users.Aggregate(ctx, []bson.M{
+		{"$match": bson.M{"age": bson.M{"$gt": 0}}},
+		{"$group": bson.M{"_id": nil, "n": bson.M{"$sum": 1}, "age": bson.M{"$sum": "$age"}, "oldest": bson.M{"$max": "$age"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var totals []struct {
+		N      int `bson:"n"`
+		Age    int `bson:"age"`
+		Oldest int `bson:"oldest"`
+	}
+	if err := cur.All(ctx, &totals); err != nil || len(totals) != 1 || totals[0].N != 4 || totals[0].Age != 96 || totals[0].Oldest != 40 {
+		t.Errorf("aggregate = %+v, %v", totals, err)
+	}
+
+	if res, err := users.DeleteMany(ctx, bson.M{"age": bson.M{"$lt": 30}}); err != nil || res.DeletedCount != 2 {
+		t.Errorf("DeleteMany = %+v, %v", res, err)
+	}
+
+	// Everything written reached the backend: a store opened on it again
+	// holds the same documents.
+	reopened := open(t, backend).Collection("users")
+	n, err := reopened.CountDocuments(ctx, bson.M{})
+	if err != nil || n != 2 {
+		t.Errorf("reopened: %d documents, %v, want 2", n, err)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	ctx := context.Background()
+	s := open(t, nil)
+	c := s.Collection("sessions")
+	if _, err := c.CreateIndexes(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(1)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	c.InsertOne(ctx, user{ID: "old", Expires: now.Add(-time.Minute)})
+	c.InsertOne(ctx, user{ID: "new", Expires: now.Add(time.Minute)})
+	c.InsertOne(ctx, user{ID: "never"})
+	s.expire(now)
+	if n, _ := c.CountDocuments(ctx, bson.M{}); n != 2 {
+		t.Errorf("%d documents left, want 2", n)
+	}
+	if err := c.FindOne(ctx, bson.M{"_id": "old"}).Err(); err != mongo.ErrNoDocuments {
+		t.Errorf("expired document: err = %v", err)
+	}
+}
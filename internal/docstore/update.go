@@ -0,0 +1,335 @@
+package docstore
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// isReplacement reports whether u replaces a document rather than
+// updating it with operators.
+func isReplacement(u bson.D) bool {
+	return len(u) == 0 || !strings.HasPrefix(u[0].Key, "$")
+}
+
+// apply returns doc with the update operators in u applied. doc is left
+// as it was. insert says whether the document is being upserted, which is
+// when $setOnInsert applies.
+func apply(doc bson.D, u bson.D, insert bool) (bson.D, error) {
+	doc = copyValue(doc).(bson.D)
+	for _, op := range u {
+		fields, ok := op.Value.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("docstore: %s needs a document", op.Key)
+		}
+		if op.Key == "$setOnInsert" && !insert {
+			continue
+		}
+		for _, f := range fields {
+			if f.Key == "_id" && op.Key != "$setOnInsert" {
+				if old, ok := get(doc, "_id"); ok && !equal(old, f.Value) {
+					return nil, fmt.Errorf("docstore: the _id field cannot be changed")
+				}
+			}
+			var err error
+			doc, err = applyField(doc, op.Key, f)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return doc, nil
+}
+
+func applyField(doc bson.D, op string, f bson.E) (bson.D, error) {
+	value := copyValue(f.Value)
+	switch op {
+	case "$set", "$setOnInsert":
+		return set(doc, f.Key, value)
+	case "$unset":
+		return unset(doc, f.Key), nil
+	case "$inc":
+		old := first(doc, f.Key)
+		if old == nil {
+			return set(doc, f.Key, value)
+		}
+		sum, err := add(old, value)
+		if err != nil {
+			return nil, fmt.Errorf("docstore: $inc %s: %w", f.Key, err)
+		}
+		return set(doc, f.Key, sum)
+	case "$min", "$max":
+		old, ok := lookupOne(doc, f.Key)
+		c := compare(value, old)
+		if !ok || op == "$min" && c < 0 || op == "$max" && c > 0 {
+			return set(doc, f.Key, value)
+		}
+		return doc, nil
+	case "$push", "$addToSet":
+		old, ok := lookupOne(doc, f.Key)
+		a, isArray := old.(bson.A)
+		if ok && !isArray {
+			return nil, fmt.Errorf("docstore: %s %s: the field is not an array", op, f.Key)
+		}
+		items := bson.A{value}
+		if d, isDoc := value.(bson.D); isDoc && len(d) > 0 && d[0].Key == "$each" {
+			if items, ok = d[0].Value.(bson.A); !ok {
+				return nil, fmt.Errorf("docstore: $each needs an array")
+			}
+		}
+		for _, item := range items {
+			if op == "$addToSet" && containsValue(a, item) {
+				continue
+			}
+			a = append(a, item)
+		}
+		if a == nil {
+			a = bson.A{}
+		}
+		return set(doc, f.Key, a)
+	case "$pull":
+		old, ok := lookupOne(doc, f.Key)
+		if !ok {
+			return doc, nil
+		}
+		a, isArray := old.(bson.A)
+		if !isArray {
+			return nil, fmt.Errorf("docstore: $pull %s: the field is not an array", f.Key)
+		}
+		kept := bson.A{}
+		for _, item := range a {
+			pull, err := pulls(item, value)
+			if err != nil {
+				return nil, err
+			}
+			if !pull {
+				kept = append(kept, item)
+			}
+		}
+		return set(doc, f.Key, kept)
+	case "$rename":
+		to, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("docstore: $rename %s needs a field name", f.Key)
+		}
+		old, ok := lookupOne(doc, f.Key)
+		if !ok {
+			return doc, nil
+		}
+		return set(unset(doc, f.Key), to, old)
+	}
+	return nil, fmt.Errorf("docstore: unsupported update operator %s", op)
+}
+
+// pulls reports whether $pull with cond removes item: cond is either a
+// value to remove or, for arrays of documents, a query they must match.
+func pulls(item, cond any) (bool, error) {
+	if ops, ok := operators(cond); ok {
+		return matchOperators([]any{item}, ops)
+	}
+	if q, ok := cond.(bson.D); ok {
+		if d, isDoc := item.(bson.D); isDoc {
+			return matches(d, q)
+		}
+		return false, nil
+	}
+	return equal(item, cond), nil
+}
+
+func containsValue(a bson.A, v any) bool {
+	for _, e := range a {
+		if equal(e, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupOne returns the value at path without descending into arrays, as
+// update operators address a single field.
+func lookupOne(doc bson.D, path string) (any, bool) {
+	var v any = doc
+	for _, key := range strings.Split(path, ".") {
+		switch c := v.(type) {
+		case bson.D:
+			var ok bool
+			if v, ok = get(c, key); !ok {
+				return nil, false
+			}
+		case bson.A:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(c) {
+				return nil, false
+			}
+			v = c[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// set returns doc with the value at path set, creating any documents on
+// the way.
+func set(doc bson.D, path string, value any) (bson.D, error) {
+	v, err := setIn(doc, path, value)
+	if err != nil {
+		return nil, err
+	}
+	return v.(bson.D), nil
+}
+
+func setIn(container any, path string, value any) (any, error) {
+	key, rest, nested := strings.Cut(path, ".")
+	switch c := container.(type) {
+	case bson.D:
+		for i, e := range c {
+			if e.Key != key {
+				continue
+			}
+			if !nested {
+				c[i].Value = value
+				return c, nil
+			}
+			v, err := setIn(e.Value, rest, value)
+			if err != nil {
+				return nil, err
+			}
+			c[i].Value = v
+			return c, nil
+		}
+		if !nested {
+			return append(c, bson.E{Key: key, Value: value}), nil
+		}
+		v, err := setIn(bson.D{}, rest, value)
+		if err != nil {
+			return nil, err
+		}
+		return append(c, bson.E{Key: key, Value: v}), nil
+	case bson.A:
+		i, err := strconv.Atoi(key)
+		if err != nil || i < 0 {
+			return nil, fmt.Errorf("docstore: cannot set %s in an array", key)
+		}
+		for len(c) <= i {
+			c = append(c, nil)
+		}
+		if !nested {
+			c[i] = value
+			return c, nil
+		}
+		inner := c[i]
+		if inner == nil {
+			inner = bson.D{}
+		}
+		v, err := setIn(inner, rest, value)
+		if err != nil {
+			return nil, err
+		}
+		c[i] = v
+		return c, nil
+	}
+	return nil, fmt.Errorf("docstore: cannot set %s in a %s", key, typeName(container))
+}
+
+// unset returns doc without the value at path.
+func unset(doc bson.D, path string) bson.D {
+	key, rest, nested := strings.Cut(path, ".")
+	for i, e := range doc {
+		if e.Key != key {
+			continue
+		}
+		if !nested {
+			return append(doc[:i:i], doc[i+1:]...)
+		}
+		switch v := e.Value.(type) {
+		case bson.D:
+			doc[i].Value = unset(v, rest)
+		case bson.A:
+			if j, err := strconv.Atoi(rest); err == nil && j >= 0 && j < len(v) {
+				// Mongo leaves a null behind rather than shifting the array.
+				v[j] = nil
+			} else if inner, after, ok := strings.Cut(rest, "."); ok {
+				if j, err := strconv.Atoi(inner); err == nil && j >= 0 && j < len(v) {
+					if d, isDoc := v[j].(bson.D); isDoc {
+						v[j] = unset(d, after)
+					}
+				}
+			}
+		}
+		return doc
+	}
+	return doc
+}
+
+// add sums two numbers, keeping the wider of their types.
+func add(a, b any) (any, error) {
+	if typeOrder(a) != 2 || typeOrder(b) != 2 {
+		return nil, fmt.Errorf("cannot add a %s and a %s", typeName(a), typeName(b))
+	}
+	switch {
+	case isType[float64](a) || isType[float64](b):
+		return number(a) + number(b), nil
+	case isType[int64](a) || isType[int64](b):
+		return toInt64(a) + toInt64(b), nil
+	}
+	return a.(int32) + b.(int32), nil
+}
+
+func isType[T any](v any) bool {
+	_, ok := v.(T)
+	return ok
+}
+
+func toInt64(v any) int64 {
+	switch v := v.(type) {
+	case int32:
+		return int64(v)
+	case int64:
+		return v
+	}
+	return int64(number(v))
+}
+
+// seed returns the document an upsert starts from: the equality fields of
+// its filter.
+func seed(q bson.D) (bson.D, error) {
+	doc := bson.D{}
+	for _, e := range q {
+		if strings.HasPrefix(e.Key, "$") {
+			if e.Key != "$and" {
+				continue
+			}
+			clauses, _ := e.Value.(bson.A)
+			for _, c := range clauses {
+				if cq, ok := c.(bson.D); ok {
+					inner, err := seed(cq)
+					if err != nil {
+						return nil, err
+					}
+					for _, f := range inner {
+						if doc, err = set(doc, f.Key, f.Value); err != nil {
+							return nil, err
+						}
+					}
+				}
+			}
+			continue
+		}
+		value := e.Value
+		if ops, ok := operators(value); ok {
+			eq, found := get(ops, "$eq")
+			if !found {
+				continue
+			}
+			value = eq
+		}
+		var err error
+		if doc, err = set(doc, e.Key, copyValue(value)); err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
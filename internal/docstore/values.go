@@ -0,0 +1,253 @@
+package docstore
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// Documents are held decoded as bson.D, with embedded documents as bson.D
+// and arrays as bson.A, so that filters and updates, which go through the
+// same encoding, compare like for like: an ID is an ObjectID on both sides,
+// a time a bson.DateTime.
+
+// toDoc encodes v, a document of any type the driver accepts, and decodes
+// it again as a bson.D.
+func toDoc(v any) (bson.D, error) {
+	if v == nil {
+		return bson.D{}, nil
+	}
+	raw, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return decode(raw)
+}
+
+func decode(raw bson.Raw) (bson.D, error) {
+	d := bson.D{}
+	if err := bson.Unmarshal(raw, &d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// toValue is toDoc for values that need not be documents, such as an
+// aggregation pipeline.
+func toValue(v any) (any, error) {
+	d, err := toDoc(bson.D{{Key: "v", Value: v}})
+	if err != nil {
+		return nil, err
+	}
+	return d[0].Value, nil
+}
+
+// copyValue deep-copies v, so that updates never change documents that
+// readers may be holding.
+func copyValue(v any) any {
+	switch v := v.(type) {
+	case bson.D:
+		d := make(bson.D, len(v))
+		for i, e := range v {
+			d[i] = bson.E{Key: e.Key, Value: copyValue(e.Value)}
+		}
+		return d
+	case bson.A:
+		a := make(bson.A, len(v))
+		for i, e := range v {
+			a[i] = copyValue(e)
+		}
+		return a
+	}
+	return v
+}
+
+func get(d bson.D, key string) (any, bool) {
+	for _, e := range d {
+		if e.Key == key {
+			return e.Value, true
+		}
+	}
+	return nil, false
+}
+
+// lookup returns the values at a dotted path, descending into arrays as
+// queries do: "members.userId" finds the userId of every member.
+func lookup(v any, path string) []any {
+	if path == "" {
+		return []any{v}
+	}
+	key, rest, _ := strings.Cut(path, ".")
+	switch v := v.(type) {
+	case bson.D:
+		field, ok := get(v, key)
+		if !ok {
+			return nil
+		}
+		return lookup(field, rest)
+	case bson.A:
+		if i, err := strconv.Atoi(key); err == nil {
+			if i < 0 || i >= len(v) {
+				return nil
+			}
+			return lookup(v[i], rest)
+		}
+		var found []any
+		for _, e := range v {
+			if _, ok := e.(bson.D); ok {
+				found = append(found, lookup(e, path)...)
+			}
+		}
+		return found
+	}
+	return nil
+}
+
+// first returns the value at path, or nil if there is none, for sorting
+// and grouping.
+func first(d bson.D, path string) any {
+	if found := lookup(d, path); len(found) > 0 {
+		return found[0]
+	}
+	return nil
+}
+
+// typeOrder ranks BSON types as MongoDB sorts them.
+func typeOrder(v any) int {
+	switch v.(type) {
+	case bson.MinKey:
+		return 0
+	case nil, bson.Null, bson.Undefined:
+		return 1
+	case int32, int64, float64, bson.Decimal128:
+		return 2
+	case string, bson.Symbol:
+		return 3
+	case bson.D:
+		return 4
+	case bson.A:
+		return 5
+	case bson.Binary:
+		return 6
+	case bson.ObjectID:
+		return 7
+	case bool:
+		return 8
+	case bson.DateTime:
+		return 9
+	case bson.Timestamp:
+		return 10
+	case bson.Regex:
+		return 11
+	case bson.MaxKey:
+		return 13
+	}
+	return 12
+}
+
+func number(v any) float64 {
+	switch v := v.(type) {
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return math.NaN()
+}
+
+// compare orders a and b as MongoDB does, first by type and then by value.
+func compare(a, b any) int {
+	if ta, tb := typeOrder(a), typeOrder(b); ta != tb {
+		return cmp(ta, tb)
+	}
+	switch a := a.(type) {
+	case int32, int64, float64:
+		// Integers beyond 2^53 lose precision, as they do in Mongo's own
+		// mixed comparisons.
+		if ia, ok := a.(int64); ok {
+			if ib, ok := b.(int64); ok {
+				return cmp(ia, ib)
+			}
+		}
+		return cmp(number(a), number(b))
+	case string:
+		return strings.Compare(a, b.(string))
+	case bson.D:
+		bd := b.(bson.D)
+		for i := 0; i < len(a) && i < len(bd); i++ {
+			if c := strings.Compare(a[i].Key, bd[i].Key); c != 0 {
+				return c
+			}
+			if c := compare(a[i].Value, bd[i].Value); c != 0 {
+				return c
+			}
+		}
+		return cmp(len(a), len(bd))
+	case bson.A:
+		ba := b.(bson.A)
+		for i := 0; i < len(a) && i < len(ba); i++ {
+			if c := compare(a[i], ba[i]); c != 0 {
+				return c
+			}
+		}
+		return cmp(len(a), len(ba))
+	case bson.Binary:
+		bb := b.(bson.Binary)
+		if len(a.Data) != len(bb.Data) {
+			return cmp(len(a.Data), len(bb.Data))
+		}
+		if a.Subtype != bb.Subtype {
+			return cmp(a.Subtype, bb.Subtype)
+		}
+		return bytes.Compare(a.Data, bb.Data)
+	case bson.ObjectID:
+		ob := b.(bson.ObjectID)
+		return bytes.Compare(a[:], ob[:])
+	case bool:
+		bb := b.(bool)
+		if a == bb {
+			return 0
+		}
+		if !a {
+			return -1
+		}
+		return 1
+	case bson.DateTime:
+		return cmp(a, b.(bson.DateTime))
+	case bson.Timestamp:
+		return a.Compare(b.(bson.Timestamp))
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+func cmp[T int | int64 | float64 | byte | bson.DateTime](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func equal(a, b any) bool {
+	return typeOrder(a) == typeOrder(b) && compare(a, b) == 0
+}
+
+// key identifies a document by its _id, whatever the type of the ID.
+func key(id any) (string, error) {
+	if id == nil {
+		id = bson.Null{}
+	}
+	typ, data, err := bson.MarshalValue(id)
+	if err != nil {
+		return "", err
+	}
+	return string(rune(typ)) + string(data), nil
+}
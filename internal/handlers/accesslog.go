@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/middleware"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// TODO_ACCESS_LOG names a file to log every request to, apart from the
+// application's logs, in the combined log format web servers use or as
+// JSON with TODO_ACCESS_LOG_FORMAT=json. The file is rotated once it
+// reaches TODO_ACCESS_LOG_MAX_SIZE_MB (100). Rotated files are kept for
+// TODO_ACCESS_LOG_MAX_AGE_DAYS (30, 0 for ever), at most
+// TODO_ACCESS_LOG_MAX_FILES of them (0 for no limit), and gzipped with
+// TODO_ACCESS_LOG_COMPRESS=true.
+
+var accessLogConf = struct {
+	Path      string
+	Format    string
+	MaxSizeMB int
+	MaxAge    int
+	MaxFiles  int
+	Compress  bool
+}{
+	Path:      envString("TODO_ACCESS_LOG", ""),
+	Format:    envString("TODO_ACCESS_LOG_FORMAT", "combined"),
+	MaxSizeMB: envInt("TODO_ACCESS_LOG_MAX_SIZE_MB", 100),
+	MaxAge:    envInt("TODO_ACCESS_LOG_MAX_AGE_DAYS", 30),
+	MaxFiles:  envInt("TODO_ACCESS_LOG_MAX_FILES", 0),
+	Compress:  envBool("TODO_ACCESS_LOG_COMPRESS"),
+}
+
+// accessLog is the access log file, if there is one.
+var accessLog io.WriteCloser
+
+func openAccessLog() {
+	if accessLogConf.Path == "" {
+		return
+	}
+	accessLog = &lumberjack.Logger{
+		Filename:   accessLogConf.Path,
+		MaxSize:    accessLogConf.MaxSizeMB,
+		MaxAge:     accessLogConf.MaxAge,
+		MaxBackups: accessLogConf.MaxFiles,
+		Compress:   accessLogConf.Compress,
+	}
+}
+
+func closeAccessLog() {
+	if accessLog != nil {
+		accessLog.Close()
+	}
+}
+
+// accessEntry is an access log line in JSON.
+type accessEntry struct {
+	Time      time.Time `json:"time"`
+	Remote    string    `json:"remote"`
+	User      ID        `json:"user,omitempty"`
+	Method    string    `json:"method"`
+	URI       string    `json:"uri"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Bytes     int       `json:"bytes"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"userAgent,omitempty"`
+	Duration  float64   `json:"durationMs"`
+	RequestID string    `json:"requestId,omitempty"`
+}
+
+// logAccess writes requests to the access log. It runs inside
+// requestLogger, which learns who made them.
+func logAccess(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		e := accessEntry{
+			Time:      start,
+			Remote:    clientIP(r.RemoteAddr),
+			User:      requestUser(r.Context()),
+			Method:    r.Method,
+			URI:       r.RequestURI,
+			Proto:     r.Proto,
+			Status:    status,
+			Bytes:     ww.BytesWritten(),
+			Referer:   r.Referer(),
+			UserAgent: r.UserAgent(),
+			Duration:  float64(time.Since(start).Microseconds()) / 1000,
+			RequestID: middleware.GetReqID(r.Context()),
+		}
+		var line []byte
+		if accessLogConf.Format == "json" {
+			line, _ = json.Marshal(e)
+			line = append(line, '\n')
+		} else {
+			line = []byte(e.combined())
+		}
+		accessLog.Write(line)
+	})
+}
+
+// combined formats e in the combined log format.
+func (e accessEntry) combined() string {
+	user := "-"
+	if !e.User.IsZero() {
+		user = e.User.String()
+	}
+	return fmt.Sprintf("%s - %s [%s] %s %d %d %s %s\n",
+		e.Remote, user, e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(e.Method+" "+e.URI+" "+e.Proto), e.Status, e.Bytes,
+		quoteOrDash(e.Referer), quoteOrDash(e.UserAgent))
+}
+
+func quoteOrDash(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	return strconv.Quote(s)
+}
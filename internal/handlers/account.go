@@ -0,0 +1,291 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/sangin4208/go-todo/internal/storage"
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Accounts without a password (OAuth, LDAP) re-authenticate for deletion by
+// signing in again: their session must be younger than reauthWindow.
+const reauthWindow = 5 * time.Minute
+
+// accountHandlers covers the caller's own account as a whole.
+func accountHandlers() http.Handler {
+	rg := chi.NewRouter()
+	rg.Group(func(r chi.Router) {
+		r.Get("/settings", fetchSettings)
+		r.Put("/settings", updateSettings)
+		r.Post("/export", createExport)
+		r.Get("/export/{id}", fetchExport)
+		r.Get("/notifications", fetchNotifications)
+		r.Put("/notifications", updateNotifications)
+		r.Post("/slack/link", createChatLink(slackProvider))
+		r.Delete("/slack", unlinkChat(slackProvider))
+		r.Post("/telegram/link", createChatLink(telegramProvider))
+		r.Delete("/telegram", unlinkChat(telegramProvider))
+		if pushEnabled() {
+			r.Mount("/push", pushHandlers())
+		}
+		if len(taskServices) > 0 {
+			r.Mount("/sync", syncHandlers())
+		}
+		if inboundEnabled() {
+			r.Get("/inbox", fetchInbox)
+			r.Post("/inbox", createInbox)
+			r.Delete("/inbox", deleteInbox)
+		}
+		if smsEnabled() {
+			r.Put("/phone", startPhoneVerification)
+			r.Post("/phone/verify", confirmPhone)
+			r.Delete("/phone", deletePhone)
+		}
+		r.Delete("/", deleteAccount)
+	})
+	return rg
+}
+
+func fetchSettings(w http.ResponseWriter, r *http.Request) {
+	u, ok := loadCurrentUser(w, r)
+	if !ok {
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"data": renderer.M{
+			"timeZone": u.location().String(),
+			"language": requestLang(r.Context()).String(),
+		},
+	})
+}
+
+// updateSettings sets the caller's time zone. Their language is the one
+// their client asks for, and not kept.
+func updateSettings(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		TimeZone string `json:"timeZone" validate:"required,timezone"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	user := currentUser(r.Context())
+	if err := updateOne(r.Context(), db.Collection(usersCollection), bson.M{"_id": user}, bson.M{"$set": bson.M{"timeZone": req.TimeZone}}); err != nil {
+		writeError(w, r, internalError("error updating settings", err))
+		return
+	}
+	forgetUserZone(r.Context(), user)
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"message": translate(r.Context(), "settings updated successfully"),
+	})
+}
+
+// deleteAccount removes the caller and everything they own, and anonymizes
+// what they contributed to other people's lists, all in one transaction.
+// Standalone servers cannot run one, so every step is also idempotent and
+// the user document goes last: a failed deletion can simply be retried.
+func deleteAccount(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	if hasBody(r) && !decodeJSON(w, r, &req) {
+		return
+	}
+	u, ok := loadCurrentUser(w, r)
+	if !ok {
+		return
+	}
+	if !reauthenticate(w, r, u, req.Password, req.Code) {
+		return
+	}
+	if err := purgeUser(r.Context(), u); err != nil {
+		writeError(w, r, internalError("error deleting account", err))
+		return
+	}
+	securityEvent(r, "account.deleted", u.Email, u.ID.String())
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"message": translate(r.Context(), "account deleted successfully"),
+	})
+}
+
+// reauthenticate confirms the caller is present: their password (or a fresh
+// session for password-less accounts) plus a second factor if enabled.
+func reauthenticate(w http.ResponseWriter, r *http.Request, u userModel, password, code string) bool {
+	fail := func(message, code string) bool {
+		writeError(w, r, &apiError{Status: http.StatusUnauthorized, Code: code, Message: message})
+		return false
+	}
+	if len(u.PasswordHash) > 0 {
+		if bcrypt.CompareHashAndPassword(u.PasswordHash, []byte(password)) != nil {
+			return fail("your password is required", "reauth_required")
+		}
+	} else {
+		var s sessionModel
+		p := currentPrincipal(r.Context())
+		if p.SessionID.IsZero() || db.Collection(sessionsCollection).FindOne(r.Context(), bson.M{"_id": p.SessionID}).Decode(&s) != nil ||
+			time.Since(s.CreateAt) > reauthWindow {
+			return fail("sign in again to confirm", "reauth_required")
+		}
+	}
+	if u.TOTPEnabled {
+		ok, err := checkSecondFactor(r.Context(), u, code)
+		if err != nil {
+			writeError(w, r, internalError("error checking second factor", err))
+			return false
+		}
+		if !ok {
+			return fail("a valid two-factor code is required", "totp_required")
+		}
+	}
+	return true
+}
+
+func purgeUser(ctx context.Context, u userModel) error {
+	var gone []todoModel
+	var removed []attachmentModel
+	err := withTransaction(ctx, func(ctx context.Context) error {
+		var err error
+		gone, removed, err = purgeUserData(ctx, u)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	// Blobs and announcements are outside the transaction, so they go once
+	// it has committed.
+	deleteBlobs(ctx, removed)
+	for _, tm := range gone {
+		publishChange(ctx, eventDeleted, tm)
+	}
+	if len(gone) > 0 {
+		wakeOutbox()
+	}
+	return nil
+}
+
+// purgeUserData removes the user's documents and returns the todos and
+// attachments removed with them, the todos to announce and the
+// attachments' blobs still to be deleted. Their todos go the way deleteList
+// sends a list's: tombstoned, for the other members' delta sync, and
+// recorded in the outbox.
+func purgeUserData(ctx context.Context, u userModel) ([]todoModel, []attachmentModel, error) {
+	var lists []listModel
+	if err := storage.FindAll(ctx, db.Collection(listsCollection), bson.M{"ownerId": u.ID}, &lists,
+		options.Find().SetProjection(bson.M{"_id": 1})); err != nil {
+		return nil, nil, err
+	}
+	listIDs := make([]ID, 0, len(lists))
+	for _, l := range lists {
+		listIDs = append(listIDs, l.ID)
+	}
+	// Everything the user owns goes, including todos others added to their
+	// lists, just as deleting a list does.
+	owned := todoScope{WorkspaceID: u.WorkspaceID, OwnerID: u.ID, ListIDs: listIDs}
+	ownedTodos, _, err := serverFrom(ctx).todos.List(ctx, owned, TodoFilter{}, 0, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	todoIDs := make([]ID, 0, len(ownedTodos))
+	for _, tm := range ownedTodos {
+		todoIDs = append(todoIDs, tm.ID)
+	}
+
+	removed, err := removeAttachments(ctx, bson.M{"todoId": bson.M{"$in": todoIDs}})
+	if err != nil {
+		return nil, nil, err
+	}
+	type step struct {
+		collection string
+		selector   bson.M
+		update     bson.M // nil removes the matches
+	}
+	apply := func(steps ...step) error {
+		for _, s := range steps {
+			var err error
+			if s.update == nil {
+				_, err = db.Collection(s.collection).DeleteMany(ctx, s.selector)
+			} else {
+				_, err = db.Collection(s.collection).UpdateMany(ctx, s.selector, s.update)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	// Comments and shares go before the todos, so that a retry still finds
+	// the todos they hang off.
+	if err := apply(
+		step{commentsCollection, bson.M{"todoId": bson.M{"$in": todoIDs}}, nil},
+		step{sharesCollection, bson.M{"$or": []bson.M{{"ownerId": u.ID}, {"targetId": bson.M{"$in": append(todoIDs, listIDs...)}}}}, nil},
+	); err != nil {
+		return nil, nil, err
+	}
+	todos := serverFrom(ctx).todos
+	gone, err := todos.DeleteMany(ctx, owned, TodoFilter{})
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := recordTombstones(ctx, gone...); err != nil {
+		return nil, nil, err
+	}
+	for _, tm := range gone {
+		if err := recordEvent(ctx, eventDeleted, tm); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := apply(
+		step{storage.TodoEventsCollection, bson.M{"todoId": bson.M{"$in": todoIDs}}, nil},
+		step{storage.TodoSnapshotsCollection, bson.M{"_id": bson.M{"$in": todoIDs}}, nil},
+		step{listsCollection, bson.M{"ownerId": u.ID}, nil},
+		// Contributions elsewhere stay, detached from the account.
+		step{listsCollection, bson.M{"members.userId": u.ID}, bson.M{"$pull": bson.M{"members": bson.M{"userId": u.ID}}}},
+	); err != nil {
+		return nil, nil, err
+	}
+	assignedTo := todoScope{WorkspaceID: u.WorkspaceID, AssigneeID: u.ID}
+	assigned, _, err := todos.List(ctx, assignedTo, TodoFilter{AssigneeID: u.ID}, 0, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, tm := range assigned {
+		if _, err := todos.Assign(ctx, assignedTo, tm.ID, ""); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := apply(
+		step{storage.TodoEventsCollection, bson.M{"assigneeId": u.ID}, bson.M{"$unset": bson.M{"assigneeId": ""}}},
+		step{commentsCollection, bson.M{"authorId": u.ID}, bson.M{"$unset": bson.M{"authorId": ""}}},
+		step{attachmentsCollection, bson.M{"uploaderId": u.ID}, bson.M{"$unset": bson.M{"uploaderId": ""}}},
+		step{activityCollection, bson.M{"actorId": u.ID}, bson.M{"$unset": bson.M{"actorId": ""}}},
+		step{activityCollection, bson.M{"audience": u.ID}, bson.M{"$pull": bson.M{"audience": u.ID}}},
+		step{tombstonesCollection, bson.M{"audience": u.ID}, bson.M{"$pull": bson.M{"audience": u.ID}}},
+		step{sessionsCollection, bson.M{"userId": u.ID}, nil},
+		step{webhooksCollection, bson.M{"ownerId": u.ID}, nil},
+		step{deliveriesCollection, bson.M{"ownerId": u.ID}, nil},
+		step{tokensCollection, bson.M{"userId": u.ID}, nil},
+		step{exportsCollection, bson.M{"userId": u.ID}, nil},
+		step{resetsCollection, bson.M{"userId": u.ID}, nil},
+		step{verificationsCollection, bson.M{"userId": u.ID}, nil},
+		step{remindersCollection, bson.M{"userId": u.ID}, nil},
+		step{scheduledRemindersCollection, bson.M{"$or": []bson.M{{"userId": u.ID}, {"todoId": bson.M{"$in": todoIDs}}}}, nil},
+		step{chatLinksCollection, bson.M{"userId": u.ID}, nil},
+		step{pushSubscriptionsCollection, bson.M{"userId": u.ID}, nil},
+		step{inboxAliasesCollection, bson.M{"userId": u.ID}, nil},
+		step{syncConnectionsCollection, bson.M{"userId": u.ID}, nil},
+		step{syncMappingsCollection, bson.M{"todoId": bson.M{"$in": todoIDs}}, nil},
+		step{syncStatesCollection, bson.M{"userId": u.ID}, nil},
+		step{phoneVerificationsCollection, bson.M{"_id": u.ID}, nil},
+		step{smsUsageCollection, bson.M{"userId": u.ID}, nil},
+		step{smsRemindersCollection, bson.M{"userId": u.ID}, nil},
+	); err != nil {
+		return nil, nil, err
+	}
+	return gone, removed, deleteOne(ctx, db.Collection(usersCollection), bson.M{"_id": u.ID})
+}
@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/sangin4208/go-todo/internal/storage"
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+const activityCollection string = "activity"
+
+type (
+	fieldChange struct {
+		Old interface{} `bson:"old,omitempty" json:"old,omitempty"`
+		New interface{} `bson:"new,omitempty" json:"new,omitempty"`
+	}
+	activityModel struct {
+		ID       ID                     `bson:"_id,omitempty"`
+		TodoID   ID                     `bson:"todoId"`
+		ActorID  ID                     `bson:"actorId"`
+		Action   string                 `bson:"action"`
+		Changes  map[string]fieldChange `bson:"changes,omitempty"`
+		Audience []ID                   `bson:"audience"`
+		CreateAt time.Time              `bson:"createAt"`
+	}
+	activity struct {
+		ID       string                 `json:"id"`
+		TodoID   string                 `json:"todoId"`
+		ActorID  string                 `json:"actorId"`
+		Action   string                 `json:"action"`
+		Changes  map[string]fieldChange `json:"changes,omitempty"`
+		CreateAt string                 `json:"createAt"`
+	}
+)
+
+func activityHandlers() http.Handler {
+	rg := chi.NewRouter()
+	rg.Group(func(r chi.Router) {
+		r.Get("/", fetchActivity)
+	})
+	return rg
+}
+
+// fetchActivity is the feed of everything that happened to todos the caller
+// can see.
+func fetchActivity(w http.ResponseWriter, r *http.Request) {
+	writeActivity(w, r, bson.M{"audience": currentUser(r.Context())})
+}
+
+func fetchTodoActivity(w http.ResponseWriter, r *http.Request) {
+	tm, ok := readableTodo(w, r)
+	if !ok {
+		return
+	}
+	writeActivity(w, r, bson.M{"todoId": tm.ID})
+}
+
+func writeActivity(w http.ResponseWriter, r *http.Request, filter bson.M) {
+	skip, limit := pagination(r)
+	var entries []activityModel
+	total, err := storage.FindPage(r.Context(), db.Collection(activityCollection), filter, "-createAt", skip, limit, &entries)
+	if err != nil {
+		writeError(w, r, internalError("error fetching activity", err))
+		return
+	}
+	data := []activity{}
+	for _, a := range entries {
+		data = append(data, toActivity(r.Context(), a))
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"data":   data,
+		"total":  total,
+		"offset": skip,
+		"limit":  limit,
+	})
+}
+
+func toActivity(ctx context.Context, a activityModel) activity {
+	return activity{
+		ID:       a.ID.String(),
+		TodoID:   a.TodoID.String(),
+		ActorID:  a.ActorID.String(),
+		Action:   a.Action,
+		Changes:  unsealTitleChange(a.Changes),
+		CreateAt: formatTime(ctx, a.CreateAt),
+	}
+}
+
+// recordActivity appends an audit entry for a todo mutation. Failing to
+// record is logged but does not fail the mutation itself.
+func recordActivity(ctx context.Context, actor ID, action string, before, after todoModel) {
+	tm := after
+	if action == eventDeleted {
+		tm = before
+	}
+	a := activityModel{
+		ID:       newID(),
+		TodoID:   tm.ID,
+		ActorID:  actor,
+		Action:   action,
+		Changes:  diffTodo(before, after),
+		Audience: audience(ctx, tm),
+		CreateAt: time.Now(),
+	}
+	if c, ok := a.Changes["title"]; ok {
+		// Titles are kept as encrypted here as in the todo itself.
+		c.Old, _ = seal(before.Title)
+		c.New, _ = seal(after.Title)
+		a.Changes["title"] = c
+	}
+	if _, err := db.Collection(activityCollection).InsertOne(ctx, &a); err != nil {
+		slog.ErrorContext(ctx, "recording activity", "err", err)
+	}
+}
+
+// unsealTitleChange decrypts the title change of an activity entry, if it
+// has one. Titles that fail to decrypt are left as they are.
+func unsealTitleChange(changes map[string]fieldChange) map[string]fieldChange {
+	c, ok := changes["title"]
+	if !ok {
+		return changes
+	}
+	if s, ok := c.Old.(string); ok {
+		if pt, err := unseal(s); err == nil {
+			c.Old = pt
+		}
+	}
+	if s, ok := c.New.(string); ok {
+		if pt, err := unseal(s); err == nil {
+			c.New = pt
+		}
+	}
+	out := make(map[string]fieldChange, len(changes))
+	for k, v := range changes {
+		out[k] = v
+	}
+	out["title"] = c
+	return out
+}
+
+// diffTodo lists the user-visible fields that differ between two versions
+// of a todo. Either side may be the zero value for creates and deletes.
+func diffTodo(before, after todoModel) map[string]fieldChange {
+	fields := []struct {
+		name          string
+		before, after interface{}
+	}{
+		{"title", before.Title, after.Title},
+		{"completed", before.Completed, after.Completed},
+		{"dueDate", formatDueDate(before.DueDate), formatDueDate(after.DueDate)},
+		{"tags", before.Tags, after.Tags},
+		{"listId", before.ListID.String(), after.ListID.String()},
+		{"assigneeId", before.AssigneeID.String(), after.AssigneeID.String()},
+	}
+	diff := map[string]fieldChange{}
+	for _, f := range fields {
+		if !reflect.DeepEqual(f.before, f.after) {
+			diff[f.name] = fieldChange{Old: f.before, New: f.after}
+		}
+	}
+	return diff
+}
@@ -0,0 +1,262 @@
+package handlers
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"github.com/sangin4208/go-todo/internal/storage"
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// adminHandlers is mounted behind requireRole(roleAdmin).
+func adminHandlers() http.Handler {
+	rg := chi.NewRouter()
+	rg.Group(func(r chi.Router) {
+		r.Get("/users", fetchUsers)
+		r.Put("/users/{id}/role", setUserRole)
+		r.Put("/users/{id}/disabled", setUserDisabled)
+		r.Delete("/users/{id}/2fa", resetUserTOTP)
+		r.Get("/users/{id}/usage", fetchUserUsage)
+		r.Handle("/vars", expvar.Handler())
+		r.Get("/migrations", fetchMigrations)
+		r.With(requireDefaultWorkspace).Mount("/jobs", jobHandlers())
+		r.Post("/migrations", applyMigrations)
+		r.With(requireDefaultWorkspace).Post("/backup", backupDatabase)
+		r.With(requireDefaultWorkspace).Post("/restore", restoreDatabase)
+		r.With(requireDefaultWorkspace).Post("/encryption/rotate", rotateEncryption)
+		r.With(requireDefaultWorkspace).Post("/search/reindex", reindexSearch)
+		r.With(requireDefaultWorkspace).Mount("/maintenance", maintenanceHandlers())
+		if devMode {
+			r.With(requireDefaultWorkspace).Post("/seed", seedDatabase)
+		}
+	})
+	return rg
+}
+
+type adminUser struct {
+	ID               string `json:"id"`
+	Email            string `json:"email"`
+	Role             string `json:"role"`
+	Disabled         bool   `json:"disabled"`
+	EmailVerified    bool   `json:"emailVerified"`
+	TwoFactorEnabled bool   `json:"twoFactorEnabled"`
+	CreateAt         string `json:"createAt"`
+}
+
+// fetchUsers pages through the workspace's users, optionally filtered by
+// a case-insensitive ?q= substring of their email.
+func fetchUsers(w http.ResponseWriter, r *http.Request) {
+	filter := bson.M{"workspaceId": currentWorkspace(r.Context())}
+	if q := strings.TrimSpace(r.URL.Query().Get("q")); q != "" {
+		filter["email"] = bson.Regex{Pattern: regexp.QuoteMeta(strings.ToLower(q))}
+	}
+	skip, limit := pagination(r)
+	var users []userModel
+	total, err := storage.FindPage(r.Context(), db.Collection(usersCollection), filter, "email", skip, limit, &users)
+	if err != nil {
+		writeError(w, r, internalError("error fetching users", err))
+		return
+	}
+	data := []adminUser{}
+	for _, u := range users {
+		data = append(data, adminUser{
+			ID:               u.ID.String(),
+			Email:            u.Email,
+			Role:             u.Role,
+			Disabled:         u.Disabled,
+			EmailVerified:    !u.Unverified,
+			TwoFactorEnabled: u.TOTPEnabled,
+			CreateAt:         formatTime(r.Context(), u.CreateAt),
+		})
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"data":   data,
+		"total":  total,
+		"offset": skip,
+		"limit":  limit,
+	})
+}
+
+func setUserRole(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSpace(chi.URLParam(r, "id"))
+	if !validID(id) {
+		writeError(w, r, apiErr(http.StatusBadRequest, "The id is invalid"))
+		return
+	}
+	var req struct {
+		Role string `json:"role" validate:"oneof=admin member viewer"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	err := updateOne(r.Context(), db.Collection(usersCollection), bson.M{
+		"_id":         toID(id),
+		"workspaceId": currentWorkspace(r.Context()),
+	}, bson.M{"$set": bson.M{"role": req.Role}})
+	if err == mongo.ErrNoDocuments {
+		writeError(w, r, apiErr(http.StatusNotFound, "user not found"))
+		return
+	}
+	if err != nil {
+		writeError(w, r, internalError("error updating role", err))
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"message": translate(r.Context(), "role updated successfully"),
+	})
+}
+
+// setUserDisabled blocks or restores sign-in for an account. Disabling
+// revokes its sessions; access tokens already issued lapse within
+// accessTokenTTL.
+func setUserDisabled(w http.ResponseWriter, r *http.Request) {
+	id, ok := adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Disabled bool `json:"disabled"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if req.Disabled && id == currentUser(r.Context()) {
+		writeError(w, r, apiErr(http.StatusBadRequest, "you cannot disable your own account"))
+		return
+	}
+	update := bson.M{"$unset": bson.M{"disabled": ""}}
+	if req.Disabled {
+		update = bson.M{"$set": bson.M{"disabled": true}}
+	}
+	err := withTransaction(r.Context(), func(ctx context.Context) error {
+		err := updateOne(ctx, db.Collection(usersCollection), bson.M{"_id": id, "workspaceId": currentWorkspace(ctx)}, update)
+		if err == nil && req.Disabled {
+			_, err = db.Collection(sessionsCollection).DeleteMany(ctx, bson.M{"userId": id})
+		}
+		return err
+	})
+	if err == mongo.ErrNoDocuments {
+		writeError(w, r, apiErr(http.StatusNotFound, "user not found"))
+		return
+	}
+	if err != nil {
+		writeError(w, r, internalError("error updating user", err))
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"message": translate(r.Context(), "user updated successfully"),
+	})
+}
+
+// resetUserTOTP turns off two-factor authentication for a user who lost
+// their authenticator and recovery codes.
+func resetUserTOTP(w http.ResponseWriter, r *http.Request) {
+	id, ok := adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+	err := updateOne(r.Context(), db.Collection(usersCollection), bson.M{"_id": id, "workspaceId": currentWorkspace(r.Context())}, bson.M{
+		"$unset": bson.M{
+			"totpSecret":        "",
+			"totpPendingSecret": "",
+			"totpEnabled":       "",
+			"recoveryCodes":     "",
+		},
+	})
+	if err == mongo.ErrNoDocuments {
+		writeError(w, r, apiErr(http.StatusNotFound, "user not found"))
+		return
+	}
+	if err != nil {
+		writeError(w, r, internalError("error resetting two-factor authentication", err))
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"message": translate(r.Context(), "two-factor authentication reset"),
+	})
+}
+
+type storageUsage struct {
+	Documents int `json:"documents" bson:"documents"`
+	Bytes     int `json:"bytes" bson:"bytes"`
+}
+
+// fetchUserUsage reports how many documents, and how many bytes of them,
+// each collection holds for a user. The bytes of attachments include
+// their stored files; todos are measured as BSON whatever backend keeps
+// them.
+func fetchUserUsage(w http.ResponseWriter, r *http.Request) {
+	id, ok := adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+	n, err := db.Collection(usersCollection).CountDocuments(r.Context(), bson.M{"_id": id, "workspaceId": currentWorkspace(r.Context())})
+	if err == nil && n == 0 {
+		writeError(w, r, apiErr(http.StatusNotFound, "user not found"))
+		return
+	}
+	var owned []todoModel
+	if err == nil {
+		owned, _, err = serverFrom(r.Context()).todos.List(r.Context(), todoScope{WorkspaceID: currentWorkspace(r.Context()), OwnerID: id}, TodoFilter{}, 0, 0)
+	}
+	todoUsage := storageUsage{Documents: len(owned)}
+	for _, tm := range owned {
+		doc, merr := bson.Marshal(tm)
+		if merr != nil {
+			err = merr
+			break
+		}
+		todoUsage.Bytes += len(doc)
+	}
+	usage := renderer.M{"todos": todoUsage}
+	docBytes := bson.M{"$bsonSize": "$$ROOT"}
+	for name, q := range map[string]struct {
+		collection string
+		filter     bson.M
+		bytes      any
+	}{
+		"lists":       {listsCollection, bson.M{"ownerId": id}, docBytes},
+		"comments":    {commentsCollection, bson.M{"authorId": id}, docBytes},
+		"exports":     {exportsCollection, bson.M{"userId": id}, docBytes},
+		"attachments": {attachmentsCollection, bson.M{"uploaderId": id}, bson.M{"$add": bson.A{docBytes, "$size"}}},
+	} {
+		if err != nil {
+			break
+		}
+		var u []storageUsage
+		err = storage.AggregateAll(r.Context(), db.Collection(q.collection), []bson.M{
+			{"$match": q.filter},
+			{"$group": bson.M{
+				"_id":       nil,
+				"documents": bson.M{"$sum": 1},
+				"bytes":     bson.M{"$sum": q.bytes},
+			}},
+		}, &u)
+		if len(u) == 0 {
+			u = append(u, storageUsage{})
+		}
+		usage[name] = u[0]
+	}
+	if err != nil {
+		writeError(w, r, internalError("error fetching usage", err))
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"data": usage,
+	})
+}
+
+func adminTargetUser(w http.ResponseWriter, r *http.Request) (ID, bool) {
+	id := strings.TrimSpace(chi.URLParam(r, "id"))
+	if !validID(id) {
+		writeError(w, r, apiErr(http.StatusBadRequest, "The id is invalid"))
+		return "", false
+	}
+	return toID(id), true
+}
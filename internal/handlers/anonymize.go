@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	mrand "math/rand/v2"
+	"strings"
+	"unicode"
+
+	"github.com/sangin4208/go-todo/internal/storage"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// An anonymized backup, POST /admin/backup?anonymize=true, keeps the shape
+// of production data (documents, IDs, references between them, counts,
+// timestamps and the length of every text) so developers can restore it to
+// reproduce performance problems, without the content:
+//
+//   - free text is scrambled letter by letter,
+//   - emails and tags become pseudonyms, consistent within one backup so
+//     uniqueness and grouping survive but different across backups,
+//   - every user's password becomes seedPassword and two-factor
+//     authentication, linked identities and phone numbers are removed,
+//   - sessions, tokens, reset and verification codes and finished exports
+//     are left out entirely, as are webhook secrets, delivery logs,
+//     undelivered events, Slack connections, chat link codes, push
+//     subscriptions, SMS records, inbound addresses and task sync
+//     connections.
+var anonymizedFields = map[string][]anonymizedField{
+	usersCollection: {
+		{"email", pseudonymousEmail},
+		{"passwordHash", devPassword},
+		{"totpPendingSecret", removed},
+		{"totpSecret", removed},
+		{"totpEnabled", removed},
+		{"recoveryCodes", removed},
+		{"identities", removed},
+		{"phone", removed},
+		{"notifications.sms", removed},
+	},
+	workspacesCollection: {{"name", scrambled}},
+	listsCollection: {
+		{"name", scrambled},
+		{"slack", removed},
+	},
+	commentsCollection:    {{"body", scrambled}},
+	attachmentsCollection: {{"name", scrambled}},
+	storage.TodoEventsCollection: {
+		{"title", scrambled},
+		{"todo.title", scrambled},
+		{"todo.tags", pseudonymous("tag")},
+	},
+	storage.TodoSnapshotsCollection: {
+		{"todo.title", scrambled},
+		{"todo.tags", pseudonymous("tag")},
+	},
+	webhooksCollection: {{"secret", removed}},
+	activityCollection: {
+		{"changes.title.old", scrambled},
+		{"changes.title.new", scrambled},
+		{"changes.tags.old", pseudonymous("tag")},
+		{"changes.tags.new", pseudonymous("tag")},
+	},
+}
+
+// unanonymizable collections hold secrets or copies of user data that
+// cannot be usefully scrambled.
+var unanonymizable = map[string]bool{
+	sessionsCollection:           true,
+	tokensCollection:             true,
+	resetsCollection:             true,
+	verificationsCollection:      true,
+	exportsCollection:            true,
+	deliveriesCollection:         true,
+	outboxCollection:             true,
+	chatLinksCollection:          true,
+	pushSubscriptionsCollection:  true,
+	inboxAliasesCollection:       true,
+	syncConnectionsCollection:    true,
+	syncMappingsCollection:       true,
+	syncStatesCollection:         true,
+	phoneVerificationsCollection: true,
+	smsUsageCollection:           true,
+	smsRemindersCollection:       true,
+}
+
+// anonymizedTodoFields are those of the todo collection, whatever
+// TODO_MONGO_COLLECTION names it.
+var anonymizedTodoFields = []anonymizedField{
+	{"title", scrambled},
+	{"tags", pseudonymous("tag")},
+}
+
+type anonymizedField struct {
+	path string
+	// rewrite returns the field's new value, or false to remove it.
+	rewrite func(a *anonymizer, v interface{}) (interface{}, bool)
+}
+
+// anonymizer holds the state of one anonymized backup.
+type anonymizer struct {
+	// key makes pseudonyms unguessable and unique to the backup.
+	key          []byte
+	passwordHash []byte
+	// todos names the todo collection.
+	todos string
+}
+
+func newAnonymizer(todos string) (*anonymizer, error) {
+	a := &anonymizer{key: make([]byte, 32), todos: todos}
+	if _, err := rand.Read(a.key); err != nil {
+		return nil, err
+	}
+	var err error
+	a.passwordHash, err = bcrypt.GenerateFromPassword([]byte(seedPassword), bcrypt.DefaultCost)
+	return a, err
+}
+
+// document anonymizes one document of the collection, returning false if
+// it should be left out of the backup.
+func (a *anonymizer) document(collection string, raw bson.Raw) (bson.Raw, bool, error) {
+	if unanonymizable[collection] {
+		return nil, false, nil
+	}
+	fields, ok := anonymizedFields[collection]
+	if collection == a.todos {
+		fields, ok = anonymizedTodoFields, true
+	}
+	if !ok {
+		return raw, true, nil
+	}
+	var d bson.D
+	if err := bson.Unmarshal(raw, &d); err != nil {
+		return nil, false, err
+	}
+	for _, f := range fields {
+		d = rewritePath(d, strings.Split(f.path, "."), func(v interface{}) (interface{}, bool) {
+			return f.rewrite(a, v)
+		})
+	}
+	out, err := bson.Marshal(d)
+	return out, true, err
+}
+
+// rewritePath applies rewrite to the field at path, if d has it.
+func rewritePath(d bson.D, path []string, rewrite func(interface{}) (interface{}, bool)) bson.D {
+	for i, e := range d {
+		if e.Key != path[0] {
+			continue
+		}
+		if len(path) > 1 {
+			if sub, ok := e.Value.(bson.D); ok {
+				d[i].Value = rewritePath(sub, path[1:], rewrite)
+			}
+			return d
+		}
+		v, keep := rewrite(e.Value)
+		if !keep {
+			return append(d[:i:i], d[i+1:]...)
+		}
+		d[i].Value = v
+		return d
+	}
+	return d
+}
+
+// scramble replaces every letter and digit of s with a random one of the
+// same kind, keeping its length, spacing and punctuation.
+func (a *anonymizer) scramble(s string) string {
+	const lower, digits = "abcdefghijklmnopqrstuvwxyz", "0123456789"
+	var b strings.Builder
+	for _, c := range s {
+		switch {
+		case unicode.IsUpper(c):
+			b.WriteByte(lower[mrand.IntN(len(lower))] - 'a' + 'A')
+		case unicode.IsLetter(c):
+			b.WriteByte(lower[mrand.IntN(len(lower))])
+		case unicode.IsDigit(c):
+			b.WriteByte(digits[mrand.IntN(len(digits))])
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// pseudonym always maps the same s to the same name within a backup.
+func (a *anonymizer) pseudonym(prefix, s string) string {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(s))
+	return prefix + "-" + hex.EncodeToString(mac.Sum(nil)[:6])
+}
+
+func scrambled(a *anonymizer, v interface{}) (interface{}, bool) {
+	if s, ok := v.(string); ok {
+		return a.scramble(s), true
+	}
+	return v, true
+}
+
+// pseudonymous renames a string, or each string of an array.
+func pseudonymous(prefix string) func(*anonymizer, interface{}) (interface{}, bool) {
+	return func(a *anonymizer, v interface{}) (interface{}, bool) {
+		switch v := v.(type) {
+		case string:
+			return a.pseudonym(prefix, v), true
+		case bson.A:
+			out := make(bson.A, len(v))
+			for i, e := range v {
+				out[i], _ = pseudonymous(prefix)(a, e)
+			}
+			return out, true
+		}
+		return v, true
+	}
+}
+
+func pseudonymousEmail(a *anonymizer, v interface{}) (interface{}, bool) {
+	if s, ok := v.(string); ok {
+		return a.pseudonym("user", s) + "@example.invalid", true
+	}
+	return v, true
+}
+
+// devPassword lets developers sign in as anyone who had a password.
+func devPassword(a *anonymizer, v interface{}) (interface{}, bool) {
+	return bson.Binary{Data: a.passwordHash}, true
+}
+
+func removed(*anonymizer, interface{}) (interface{}, bool) {
+	return nil, false
+}
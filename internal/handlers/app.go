@@ -0,0 +1,661 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/sangin4208/go-todo/internal/model"
+	"github.com/sangin4208/go-todo/internal/storage"
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// collectionName holds the todos, TODO_MONGO_COLLECTION, unless a
+// Server's Config names another.
+var collectionName = envString("TODO_MONGO_COLLECTION", "todo")
+
+type todoModel = model.Todo
+
+type todo struct {
+	ID         string   `json:"id"`
+	Ref        string   `json:"ref,omitempty"`
+	ListID     string   `json:"listId,omitempty" validate:"omitempty,id"`
+	AssigneeID string   `json:"assigneeId,omitempty"`
+	Title      string   `json:"title" validate:"required,max=500"`
+	Completed  bool     `json:"completed"`
+	CreateAt   string   `json:"createAt"`
+	DueDate    string   `json:"dueDate,omitempty" validate:"omitempty,datetime=2006-01-02"`
+	Tags       []string `json:"tags,omitempty" validate:"max=20,dive,notblank,max=50"`
+	ExpiresAt  string   `json:"expiresAt,omitempty" validate:"omitempty,future"`
+	// Version changes whenever the todo does; offline clients send
+	// it back as the base of their edits.
+	Version string `json:"version,omitempty"`
+}
+
+// openShared sets up what every Server in the process shares.
+func openShared() error {
+	if err := initTracing(); err != nil {
+		return fmt.Errorf("tracing: %w", err)
+	}
+	if err := initSentry(); err != nil {
+		return fmt.Errorf("sentry: %w", err)
+	}
+	openAccessLog()
+	var err error
+	mqttClient, err = openMQTT()
+	return err
+}
+
+// render returns the renderer of the Server r is served by.
+func render(r *http.Request) *renderer.Render {
+	return serverFrom(r.Context()).rnd
+}
+
+// openServices connects s to the services it needs besides storage: the
+// rate limit store, the blob store and the event broker.
+func (s *Server) openServices() error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoConf.Timeout)
+	defer cancel()
+	var err error
+	if s.writeBuckets, err = openWriteBuckets(ctx); err != nil {
+		return err
+	}
+	if s.blobs, err = openBlobStore(); err != nil {
+		return err
+	}
+	s.broker, err = openBroker()
+	return err
+}
+
+// closeServices disconnects what openServices connected.
+func (s *Server) closeServices() {
+	if s.broker != nil {
+		s.broker.Close()
+	}
+}
+
+// open connects s to everything serving needs. Only Mongo may be
+// unreachable at first: its setup is retried in the background, with
+// requests answered 503 until it succeeds. The embedded database is ready
+// at once.
+func (s *Server) open() error {
+	ctx, cancel := context.WithTimeout(s.ctx, mongoConf.Timeout)
+	defer cancel()
+	var err error
+	if s.db, err = s.openDatabase(ctx); err != nil {
+		return err
+	}
+	if s.todos, err = s.openTodoRepository(ctx); err != nil {
+		s.db.Close(ctx)
+		return err
+	}
+	if changeStreams && !s.todosInMongo() {
+		s.db.Close(ctx)
+		return errors.New("TODO_CHANGE_STREAMS requires TODO_STORAGE=mongo or events")
+	}
+	if err := retryWithBackoff("database setup", mongoConf.Retries, s.setupDatabase); err != nil {
+		slog.Warn("starting without a database, requests will fail until it is reachable")
+		go retryWithBackoff("database setup", 0, func() error {
+			if s.ctx.Err() != nil {
+				return nil
+			}
+			return s.setupDatabase()
+		})
+	}
+	return nil
+}
+
+// setupDatabase prepares the database for serving: default workspace,
+// migrations and indexes. Every step is idempotent, so it can simply be
+// retried.
+func (s *Server) setupDatabase() error {
+	ctx, cancel := context.WithTimeout(s.ctx, mongoConf.Timeout)
+	defer cancel()
+	steps := []func() error{
+		func() error { return ensureWorkspaces(ctx) },
+		func() error {
+			if skipMigrations {
+				return nil
+			}
+			_, err := runMigrations(ctx)
+			return err
+		},
+		func() error {
+			if !s.todosInMongo() {
+				return nil
+			}
+			return ensureTodoIndexes(ctx)
+		},
+		func() error { return ensureIndex(ctx, db.Collection(usersCollection), true, "workspaceId", "email") },
+		func() error { return ensureIndex(ctx, db.Collection(sessionsCollection), true, "refreshHash") },
+		func() error { return ensureTTLIndex(ctx, db.Collection(sessionsCollection), "expiresAt") },
+		func() error { return ensureIndex(ctx, db.Collection(tokensCollection), true, "hash") },
+		func() error { return ensureIndex(ctx, db.Collection(resetsCollection), true, "hash") },
+		func() error { return ensureTTLIndex(ctx, db.Collection(resetsCollection), "expiresAt") },
+		func() error { return ensureIndex(ctx, db.Collection(verificationsCollection), true, "hash") },
+		func() error { return ensureTTLIndex(ctx, db.Collection(verificationsCollection), "expiresAt") },
+		func() error { return ensureTTLIndex(ctx, db.Collection(exportsCollection), "expiresAt") },
+		func() error { return ensureIndex(ctx, db.Collection(attachmentsCollection), false, "todoId") },
+		func() error { return ensureIndex(ctx, db.Collection(webhooksCollection), false, "ownerId") },
+		func() error {
+			return ensureIndex(ctx, db.Collection(scheduledRemindersCollection), false, "todoId", "userId")
+		},
+		func() error { return ensureIndex(ctx, db.Collection(jobsCollection), true, "key") },
+		func() error { return ensureIndex(ctx, db.Collection(jobsCollection), false, "status", "runAt") },
+		func() error { return ensureTTLIndex(ctx, db.Collection(jobsCollection), "expiresAt") },
+		func() error {
+			return ensureIndex(ctx, db.Collection(deliveriesCollection), false, "webhookId", "-createAt")
+		},
+		func() error {
+			return ensureIndex(ctx, db.Collection(deliveriesCollection), false, "status", "nextAttemptAt")
+		},
+		func() error {
+			return ensureIndex(ctx, db.Collection(deliveriesCollection), false, "webhookId", "eventId")
+		},
+		func() error {
+			return ensureIndex(ctx, db.Collection(outboxCollection), false, "lockedUntil", "createAt")
+		},
+		func() error { return ensureTTLIndex(ctx, db.Collection(deliveriesCollection), "expiresAt") },
+		func() error {
+			return ensureIndex(ctx, db.Collection(storage.TodoEventsCollection), true, "todoId", "seq")
+		},
+		func() error { return ensureIndex(ctx, db.Collection(remindersCollection), true, "todoId", "userId") },
+		func() error { return ensureTTLIndex(ctx, db.Collection(remindersCollection), "expiresAt") },
+		func() error { return ensureIndex(ctx, db.Collection(chatLinksCollection), true, "hash") },
+		func() error { return ensureTTLIndex(ctx, db.Collection(chatLinksCollection), "expiresAt") },
+		func() error { return ensureIndex(ctx, db.Collection(pushSubscriptionsCollection), true, "endpoint") },
+		func() error { return ensureIndex(ctx, db.Collection(pushSubscriptionsCollection), false, "userId") },
+		func() error { return ensureIndex(ctx, db.Collection(inboxAliasesCollection), false, "userId") },
+		func() error { return ensureTTLIndex(ctx, db.Collection(phoneVerificationsCollection), "expiresAt") },
+		func() error { return ensureIndex(ctx, db.Collection(syncConnectionsCollection), false, "userId") },
+		func() error { return ensureIndex(ctx, db.Collection(syncConnectionsCollection), false, "nextSyncAt") },
+		func() error {
+			return ensureIndex(ctx, db.Collection(syncMappingsCollection), true, "connectionId", "todoId")
+		},
+		func() error { return ensureIndex(ctx, db.Collection(syncMappingsCollection), false, "todoId") },
+		func() error { return ensureTTLIndex(ctx, db.Collection(syncStatesCollection), "expiresAt") },
+		func() error {
+			return ensureIndex(ctx, db.Collection(tombstonesCollection), false, "workspaceId", "deletedAt")
+		},
+		func() error { return ensureTTLIndex(ctx, db.Collection(tombstonesCollection), "expiresAt") },
+		func() error { return ensureTTLIndex(ctx, db.Collection(smsUsageCollection), "expiresAt") },
+		func() error { return ensureIndex(ctx, db.Collection(smsRemindersCollection), true, "todoId", "userId") },
+		func() error { return ensureTTLIndex(ctx, db.Collection(smsRemindersCollection), "expiresAt") },
+		func() error { return s.loadShareKey(ctx) },
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return err
+		}
+	}
+	s.ready.Store(true)
+	return nil
+}
+
+// requireDatabase answers 503 while the server runs without a database or
+// the circuit breaker is open.
+func requireDatabase(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok, retry := databaseAvailable(r.Context()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+			writeError(w, r, apiErr(http.StatusServiceUnavailable, "database unavailable"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// databaseAvailable reports whether requests needing the database can be
+// served and, if not, roughly how long until they may be.
+func databaseAvailable(ctx context.Context) (bool, time.Duration) {
+	if !serverFrom(ctx).ready.Load() {
+		return false, 5 * time.Second
+	}
+	if state, wait := dbBreaker.state(); state == breakerOpen {
+		return false, wait
+	}
+	return true, 0
+}
+
+// renderPage answers r with the page the named templates make of data.
+func renderPage(w http.ResponseWriter, r *http.Request, names []string, data any) {
+	renderTemplate(w, r, http.StatusOK, names, "", data)
+}
+
+// renderTemplate answers r with status and the template called name, or
+// the first file's if name is empty, from the named template files. It is
+// rendered before anything is written, so a template failing halfway is
+// answered with a server error rather than half a page.
+func renderTemplate(w http.ResponseWriter, r *http.Request, status int, files []string, name string, data any) {
+	var buf bytes.Buffer
+	t, err := loadTemplates(files)
+	if err == nil {
+		// The cached templates are cloned, never executed, to bind the
+		// helpers to the request.
+		t, err = t.Clone()
+	}
+	if err == nil {
+		t.Funcs(localeFuncs(r.Context()))
+		if name == "" {
+			err = t.Execute(&buf, data)
+		} else {
+			err = t.ExecuteTemplate(&buf, name, data)
+		}
+	}
+	if err != nil {
+		writeError(w, r, internalError("error rendering page", err))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+func fetchTodos(w http.ResponseWriter, r *http.Request) {
+	var filter TodoFilter
+	if l := r.URL.Query().Get("list"); l != "" {
+		if !validID(l) {
+			writeError(w, r, apiErr(http.StatusBadRequest, "The list id is invalid"))
+			return
+		}
+		filter.ListID = toID(l)
+	}
+	if a := r.URL.Query().Get("assigned_to"); a != "" {
+		if a == "me" {
+			filter.AssigneeID = currentUser(r.Context())
+		} else if validID(a) {
+			filter.AssigneeID = toID(a)
+		} else {
+			writeError(w, r, apiErr(http.StatusBadRequest, "assigned_to must be me or a user id"))
+			return
+		}
+	}
+	if d := r.URL.Query().Get("due_before"); d != "" {
+		due, err := parseDueDate(d)
+		if err != nil {
+			writeError(w, r, apiErr(http.StatusBadRequest, "due_before must be formatted as 2006-01-02"))
+			return
+		}
+		filter.DueBefore = due
+	}
+	todos, _, err := findTodos(r.Context(), currentPrincipal(r.Context()), filter, 0, 0)
+	if err != nil {
+		writeError(w, r, internalError("error fetching todos", err))
+		return
+	}
+	var todoList []todo
+	for _, t := range todos {
+		todoList = append(todoList, toTodo(r.Context(), t))
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"data": todoList,
+	})
+}
+
+func createTodo(w http.ResponseWriter, r *http.Request) {
+	var t todo
+	if !decodeJSON(w, r, &t) {
+		return
+	}
+	// decodeJSON has checked both dates.
+	dueDate, _ := parseDueDate(t.DueDate)
+	var expiresAt time.Time
+	if t.ExpiresAt != "" {
+		expiresAt, _ = time.Parse(time.RFC3339, t.ExpiresAt)
+	}
+	tm := todoModel{
+		ID:        newID(),
+		ListID:    idOrEmpty(t.ListID),
+		Title:     t.Title,
+		Completed: false,
+		CreateAt:  time.Now(),
+		DueDate:   dueDate,
+		Tags:      t.Tags,
+		ExpiresAt: expiresAt,
+	}
+	err := insertTodo(r.Context(), currentPrincipal(r.Context()), &tm)
+	if err == errListNotFound {
+		writeError(w, r, apiErr(http.StatusNotFound, "list not found"))
+		return
+	}
+	if err == errQuotaExceeded {
+		quotaExceeded(w, r, "open todo")
+		return
+	}
+	if err != nil {
+		writeError(w, r, internalError("error creating todo", err))
+		return
+	}
+
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"message": translate(r.Context(), "todo created successfully"),
+		"todo_id": tm.ID.String(),
+	})
+}
+
+func deleteTodo(w http.ResponseWriter, r *http.Request) {
+	id, ok := todoIDParam(w, r)
+	if !ok {
+		return
+	}
+	err := removeTodo(r.Context(), currentPrincipal(r.Context()), id)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, r, apiErr(http.StatusNotFound, "todo not found"))
+		return
+	}
+	if err != nil {
+		writeError(w, r, internalError("error deleting todo", err))
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"message": translate(r.Context(), "todo deleted successfully"),
+	})
+}
+
+func updateTodo(w http.ResponseWriter, r *http.Request) {
+	id, ok := todoIDParam(w, r)
+	if !ok {
+		return
+	}
+	var t todo
+	if !decodeJSON(w, r, &t) {
+		return
+	}
+	_, err := setTodo(r.Context(), currentPrincipal(r.Context()), id, t.Title, t.Completed)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, r, apiErr(http.StatusNotFound, "todo not found"))
+		return
+	}
+	if err != nil {
+		writeError(w, r, internalError("failed to update todo", err))
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"message": translate(r.Context(), "todo updated successfully"),
+	})
+}
+
+// Run is the todo command: it serves HTTP and gRPC on the configured
+// addresses until interrupted or sent SIGTERM, then shuts down gracefully.
+// Started with --seed or --replay it does that instead and exits.
+func Run() {
+	loadConfig()
+	s, err := newServer(Config{})
+	if err != nil {
+		fatal("startup", "err", err)
+	}
+	command = s
+	if seedFlag {
+		runSeed(s.ctx)
+		return
+	}
+	if replayFlag {
+		runReplay(s.ctx)
+		return
+	}
+	logBuild()
+	logConfig()
+	go watchConfig()
+	stopChan := make(chan os.Signal, 1)
+	signal.Notify(stopChan, os.Interrupt, syscall.SIGTERM)
+	s.startWorkers()
+
+	srv := &http.Server{
+		Addr:         serverConf.Addr,
+		Handler:      s,
+		ReadTimeout:  serverConf.ReadTimeout,
+		WriteTimeout: serverConf.WriteTimeout,
+		IdleTimeout:  serverConf.IdleTimeout,
+		ErrorLog:     slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
+	}
+	srv.Protocols, srv.HTTP2 = serverProtocols()
+
+	lis, err := listen(serverConf.Addr, "http")
+	if err != nil {
+		fatal("listen", "err", err)
+	}
+	go func() {
+		var err error
+		if tlsEnabled() {
+			slog.Info("listening with TLS", "addr", lis.Addr().String())
+			srv.TLSConfig = newTLSConfig()
+			err = srv.ServeTLS(lis, serverConf.TLSCert, serverConf.TLSKey)
+		} else {
+			slog.Info("listening", "addr", lis.Addr().String())
+			err = srv.Serve(lis)
+		}
+		if err != nil && err != http.ErrServerClosed && !errors.Is(err, net.ErrClosed) {
+			slog.Error("serve", "err", err)
+		}
+	}()
+	redirects := serveRedirects()
+
+	gs := newGRPCServer()
+	grpcLis, err := listen(serverConf.GRPCAddr, "grpc")
+	if err != nil {
+		fatal("grpc listen", "err", err)
+	}
+	go func() {
+		slog.Info("gRPC listening", "addr", grpcLis.Addr().String())
+		if err := gs.Serve(grpcLis); err != nil && !errors.Is(err, net.ErrClosed) {
+			slog.Error("grpc serve", "err", err)
+		}
+	}()
+	upgradeReady()
+	writePIDFile()
+	go handleUpgrades(stopChan)
+	<-stopChan
+	draining.Store(true)
+	slog.Info("shutting down server")
+	ctx, cancle := context.WithTimeout(context.Background(), serverConf.ShutdownTimeout)
+	srv.Shutdown(ctx)
+	if redirects != nil {
+		redirects.Shutdown(ctx)
+	}
+	gs.GracefulStop()
+	if mqttClient != nil {
+		mqttClient.Disconnect(250)
+	}
+	removePIDFile()
+	shutdownTracing(ctx)
+	flushSentry()
+	closeAccessLog()
+	// Only now that no request is running can the pool be closed.
+	s.Close(ctx)
+	defer func() {
+		cancle()
+		slog.Info("server gracefully stopped")
+	}()
+}
+
+// router routes every HTTP endpoint.
+func router() http.Handler {
+	r := chi.NewRouter()
+	r.Use(compressResponses)
+	r.Use(requestID)
+	r.Use(realIP)
+	r.Use(filterIPs)
+	r.Use(securityHeaders)
+	r.Use(versionHeader)
+	r.Use(localize)
+	r.Use(traceRequests)
+	r.Use(requestLogger)
+	openAccessLog()
+	if accessLog != nil {
+		r.Use(logAccess)
+	}
+	r.Use(instrumentRequests)
+	r.Use(recoverPanics)
+	if c := corsHandler(); c != nil {
+		r.Use(c)
+	}
+	r.Get("/healthz", healthCheck)
+	r.Get("/readyz", readinessCheck)
+	r.Get("/version", versionHandler)
+	r.Handle("/metrics", metricsHandler())
+	r.Handle("/static/*", staticHandler())
+	if debugConf.Enabled {
+		r.Mount("/debug", debugHandlers())
+	}
+	r.Get("/.well-known/caldav", wellKnownCalDAV)
+	r.Group(func(r chi.Router) {
+		r.Use(shedLoad)
+		r.Use(enforceMaintenance)
+		r.Use(requireDatabase)
+		r.Group(func(r chi.Router) {
+			r.Use(protectCSRF)
+			r.Get("/s/{token}", viewShare)
+			r.Group(func(r chi.Router) {
+				r.Use(resolveTenant)
+				r.Use(limitWrites(writeIPKey, func() int { return liveConf().WriteIPRate }))
+				r.Use(pageSession)
+				r.Get("/", homeHandler)
+				r.Post("/login", pageLogin)
+				r.Post("/logout", pageLogout)
+				r.With(requirePageAuth, forgetResponses).Mount("/ui", pageHandlers())
+			})
+		})
+		r.Post("/workspaces", createWorkspace)
+		r.Get("/downloads/exports/{id}", downloadExport)
+		if demoMode {
+			r.Post("/demo", startDemo)
+		}
+		if slackSigningSecret != "" {
+			r.Post("/slack/commands", slackCommand)
+		}
+		if inboundEnabled() {
+			r.Post("/inbound/mailgun", receiveMailgun)
+		}
+		if len(taskServices) > 0 {
+			r.Get("/sync/{provider}/callback", syncCallback)
+		}
+		if telegramConf.Token != "" && telegramConf.WebhookSecret != "" {
+			r.Post("/telegram/webhook", telegramWebhook)
+		}
+		r.Group(func(r chi.Router) {
+			r.Use(resolveTenant)
+			r.Use(limitWrites(writeIPKey, func() int { return liveConf().WriteIPRate }))
+			r.Mount("/auth", authHandlers())
+			r.Mount(davPrefix, davHandler())
+			r.Group(func(r chi.Router) {
+				r.Use(requireAuth)
+				r.Use(limitWrites(writeTokenKey, func() int { return liveConf().WriteTokenRate }))
+				r.Use(forgetResponses)
+				r.Mount("/todo", todoHandlers())
+				r.Mount("/lists", listHandlers())
+				r.Mount("/shares", shareHandlers())
+				r.Mount("/account", accountHandlers())
+				r.Mount("/activity", activityHandlers())
+				r.Mount("/stats", statsHandlers())
+				r.Mount("/webhooks", webhookHandlers())
+				r.Get("/quota", fetchQuota)
+				r.Get("/features", fetchFeatures)
+				r.With(requireFeature("sync")).Get("/sync", fetchChanges)
+				r.With(requireFeature("sync"), requireRole(roleAdmin, roleMember)).Post("/sync/push", pushChanges)
+				r.With(requireFeature("graphql")).Post("/graphql", graphqlHandler)
+				r.Mount("/zapier", zapierHandlers())
+				r.With(requireRole(roleAdmin)).Mount("/admin", adminHandlers())
+			})
+		})
+	})
+	return r
+}
+
+// startWorkers starts what runs in the background of serving s: jobs,
+// expiry, syncing and watching for changes, until s is closed. Mail
+// delivery and the Telegram bot serve the whole process, and are started
+// with the first Server, the one Telegram users reach.
+func (s *Server) startWorkers() {
+	ctx := s.ctx
+	if demoMode {
+		go cleanupDemos(ctx)
+	}
+	if changeStreams {
+		go watchTodos(ctx)
+	}
+	go expireTodos(ctx)
+	go watchMaintenance(ctx)
+	go campaign(ctx)
+	runJobs(ctx)
+	go dispatchOutbox(ctx)
+	if len(taskServices) > 0 {
+		go syncTasks(ctx)
+	}
+	processWorkers.Do(func() {
+		deliverMail()
+		if telegramConf.Token != "" {
+			startTelegram(ctx)
+		}
+	})
+}
+
+// processWorkers starts the workers the process runs once.
+var processWorkers sync.Once
+
+func todoHandlers() http.Handler {
+	rg := chi.NewRouter()
+	rg.Group(func(r chi.Router) {
+		r.With(cacheResponses).Get("/", fetchTodos)
+		r.Get("/search", searchTodos)
+		r.Get("/ws", watchTodosWS)
+		r.Get("/events", streamEvents)
+		r.Mount("/{id}/comments", commentHandlers())
+		r.Mount("/{id}/attachments", attachmentHandlers())
+		r.Mount("/{id}/reminders", scheduledReminderHandlers())
+		r.Get("/{id}/activity", fetchTodoActivity)
+		r.Group(func(r chi.Router) {
+			r.Use(requireRole(roleAdmin, roleMember))
+			r.Post("/", createTodo)
+			r.Post("/import/trello", importTrello)
+			r.Post("/import/todoist", importTodoist)
+			r.Put("/{id}", updateTodo)
+			r.Delete("/{id}", deleteTodo)
+			r.Put("/{id}/assignee", assignTodoHandler)
+			r.Delete("/{id}/assignee", unassignTodoHandler)
+		})
+	})
+	return rg
+}
+
+func toTodo(ctx context.Context, t todoModel) todo {
+	return todo{
+		ID:         t.ID.String(),
+		Ref:        t.Ref,
+		ListID:     t.ListID.String(),
+		AssigneeID: t.AssigneeID.String(),
+		Title:      t.Title,
+		Completed:  t.Completed,
+		CreateAt:   formatTime(ctx, t.CreateAt),
+		DueDate:    formatDueDate(t.DueDate),
+		Tags:       t.Tags,
+		ExpiresAt:  formatTime(ctx, t.ExpiresAt),
+		Version:    todoVersion(t),
+	}
+}
+
+func parseDueDate(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.ParseInLocation("2006-01-02", s, time.Local)
+}
+
+func formatDueDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format("2006-01-02")
+}
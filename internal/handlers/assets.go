@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/sangin4208/go-todo/internal/web"
+)
+
+// Pages and the static files under /static/ come from the copies built
+// into the binary, see package web. TODO_ASSETS_DIR names a directory
+// laid out the same way, such as internal/web in a checkout, to serve
+// instead. In dev mode, see devMode, it defaults to internal/web when
+// the server is started from a checkout, and templates are parsed again
+// whenever they change, so edits show on the next request without
+// restarting.
+
+var assetsDir = envString("TODO_ASSETS_DIR", "")
+
+// assets returns the templates and static files to serve.
+func assets() fs.FS {
+	if assetsDir != "" {
+		return os.DirFS(assetsDir)
+	}
+	if devMode {
+		if fi, err := os.Stat("internal/web"); err == nil && fi.IsDir() {
+			return os.DirFS("internal/web")
+		}
+	}
+	return web.FS
+}
+
+func staticHandler() http.Handler {
+	static, err := fs.Sub(assets(), "static")
+	if err != nil {
+		// Only a malformed path can fail, and "static" is not one.
+		panic(err)
+	}
+	files := http.StripPrefix("/static/", http.FileServerFS(static))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Files only, no directory listings.
+		if strings.HasSuffix(r.URL.Path, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		files.ServeHTTP(w, r)
+	})
+}
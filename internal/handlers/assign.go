@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+var errAssigneeNotMember = errors.New("assignee is not a member of the todo's list")
+
+func assignTodoHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := todoIDParam(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		UserID string `json:"userId"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if !validID(req.UserID) {
+		writeError(w, r, apiErr(http.StatusBadRequest, "userId is invalid"))
+		return
+	}
+	_, err := assignTodo(r.Context(), currentPrincipal(r.Context()), id, toID(req.UserID))
+	writeAssignResult(w, r, err, "todo assigned successfully")
+}
+
+func unassignTodoHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := todoIDParam(w, r)
+	if !ok {
+		return
+	}
+	_, err := assignTodo(r.Context(), currentPrincipal(r.Context()), id, "")
+	writeAssignResult(w, r, err, "todo unassigned successfully")
+}
+
+func writeAssignResult(w http.ResponseWriter, r *http.Request, err error, message string) {
+	switch {
+	case err == nil:
+		render(r).JSON(w, http.StatusOK, renderer.M{
+			"message": translate(r.Context(), message),
+		})
+	case err == mongo.ErrNoDocuments:
+		writeError(w, r, apiErr(http.StatusNotFound, "todo not found"))
+	case err == errAssigneeNotMember:
+		writeError(w, r, apiErr(http.StatusUnprocessableEntity, err.Error()))
+	default:
+		writeError(w, r, internalError("error assigning todo", err))
+	}
+}
+
+// assignTodo sets (or, with an empty assignee, clears) who is responsible
+// for a todo. Personal todos can only be assigned to their owner; list todos
+// to the list's owner or members.
+func assignTodo(ctx context.Context, p principal, id, assignee ID) (todoModel, error) {
+	tm, err := getTodo(ctx, p, id)
+	if err != nil {
+		return tm, err
+	}
+	if !assignee.IsZero() {
+		ok := assignee == tm.UserID
+		if !ok && !tm.ListID.IsZero() {
+			if ok, err = isListMember(ctx, assignee, tm.ListID); err != nil {
+				return tm, err
+			}
+		}
+		if !ok {
+			return tm, errAssigneeNotMember
+		}
+	}
+
+	scope, err := todoAccess(ctx, p, true)
+	if err != nil {
+		return tm, err
+	}
+	before := tm
+	err = atomically(ctx, func(ctx context.Context) error {
+		var err error
+		if tm, err = serverFrom(ctx).todos.Assign(ctx, scope, id, assignee); err != nil {
+			return err
+		}
+		return recordEvent(ctx, eventUpdated, tm)
+	})
+	if err != nil {
+		return tm, err
+	}
+	publishChange(ctx, eventUpdated, tm)
+	recordActivity(ctx, p.UserID, eventUpdated, before, tm)
+	notifyAssignment(ctx, p.UserID, tm)
+	return tm, nil
+}
@@ -0,0 +1,293 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/sangin4208/go-todo/internal/storage"
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+const attachmentsCollection string = "attachments"
+
+var (
+	maxAttachmentSize = int64(envInt("TODO_MAX_ATTACHMENT_MB", 10)) << 20
+	// attachmentLinkTTL is how long a presigned download link works.
+	attachmentLinkTTL = time.Duration(envInt("TODO_ATTACHMENT_LINK_TTL_SECONDS", 300)) * time.Second
+)
+
+type (
+	// attachmentModel describes a file kept in the blob store under Key.
+	attachmentModel struct {
+		ID          ID        `bson:"_id,omitempty"`
+		TodoID      ID        `bson:"todoId"`
+		UploaderID  ID        `bson:"uploaderId"`
+		Name        string    `bson:"name"`
+		ContentType string    `bson:"contentType"`
+		Size        int64     `bson:"size"`
+		Key         string    `bson:"key"`
+		CreateAt    time.Time `bson:"createAt"`
+	}
+	attachment struct {
+		ID          string `json:"id"`
+		UploaderID  string `json:"uploaderId"`
+		Name        string `json:"name"`
+		ContentType string `json:"contentType"`
+		Size        int64  `json:"size"`
+		CreateAt    string `json:"createAt"`
+	}
+)
+
+// attachmentHandlers is mounted under /todo/{id}/attachments.
+func attachmentHandlers() http.Handler {
+	rg := chi.NewRouter()
+	rg.Group(func(r chi.Router) {
+		r.Get("/", fetchAttachments)
+		r.Get("/{attachmentId}", downloadAttachment)
+		r.Group(func(r chi.Router) {
+			r.Use(requireRole(roleAdmin, roleMember))
+			r.Post("/", uploadAttachment)
+			r.Delete("/{attachmentId}", deleteAttachment)
+		})
+	})
+	return rg
+}
+
+func fetchAttachments(w http.ResponseWriter, r *http.Request) {
+	tm, ok := readableTodo(w, r)
+	if !ok {
+		return
+	}
+	skip, limit := pagination(r)
+	var attachments []attachmentModel
+	total, err := storage.FindPage(r.Context(), db.Collection(attachmentsCollection), bson.M{"todoId": tm.ID}, "createAt", skip, limit, &attachments)
+	if err != nil {
+		writeError(w, r, internalError("error fetching attachments", err))
+		return
+	}
+	data := []attachment{}
+	for _, a := range attachments {
+		data = append(data, toAttachment(r.Context(), a))
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"data":   data,
+		"total":  total,
+		"offset": skip,
+		"limit":  limit,
+	})
+}
+
+// uploadAttachment takes the file in the "file" field of a multipart form.
+func uploadAttachment(w http.ResponseWriter, r *http.Request) {
+	tm, ok := readableTodo(w, r)
+	if !ok {
+		return
+	}
+	// Allow a little over the limit for the rest of the form.
+	r.Body = http.MaxBytesReader(w, r.Body, maxAttachmentSize+1<<20)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		writeError(w, r, &apiError{
+			Status:  http.StatusBadRequest,
+			Message: "a file is required, no larger than " + strconv.FormatInt(maxAttachmentSize>>20, 10) + "MB",
+			Err:     err,
+		})
+		return
+	}
+	defer file.Close()
+	if header.Size > maxAttachmentSize {
+		writeError(w, r, apiErr(http.StatusRequestEntityTooLarge, "the file must be no larger than "+strconv.FormatInt(maxAttachmentSize>>20, 10)+"MB"))
+		return
+	}
+	a, err := storeAttachment(r.Context(), tm.ID, currentUser(r.Context()), header.Filename, header.Header.Get("Content-Type"), header.Size, file)
+	if err != nil {
+		writeError(w, r, internalError("error storing attachment", err))
+		return
+	}
+	render(r).JSON(w, http.StatusCreated, renderer.M{
+		"message":       translate(r.Context(), "attachment uploaded successfully"),
+		"attachment_id": a.ID.String(),
+	})
+}
+
+// storeAttachment puts the file in the blob store and records it as an
+// attachment of the todo.
+func storeAttachment(ctx context.Context, todo, uploader ID, name, contentType string, size int64, file io.Reader) (attachmentModel, error) {
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	a := attachmentModel{
+		ID:          newID(),
+		TodoID:      todo,
+		UploaderID:  uploader,
+		Name:        name,
+		ContentType: contentType,
+		Size:        size,
+		CreateAt:    time.Now(),
+	}
+	a.Key = "attachments/" + todo.String() + "/" + a.ID.String()
+	blobs := serverFrom(ctx).blobs
+	if err := blobs.Put(ctx, a.Key, file, a.Size, a.ContentType); err != nil {
+		return a, err
+	}
+	if _, err := db.Collection(attachmentsCollection).InsertOne(ctx, &a); err != nil {
+		if err := blobs.Delete(context.Background(), a.Key); err != nil {
+			slog.ErrorContext(ctx, "deleting attachment", "key", a.Key, "err", err)
+		}
+		return a, err
+	}
+	return a, nil
+}
+
+// downloadAttachment redirects to a presigned link when the blob store
+// offers one, and streams the file itself otherwise.
+func downloadAttachment(w http.ResponseWriter, r *http.Request) {
+	a, ok := readableAttachment(w, r)
+	if !ok {
+		return
+	}
+	blobs := serverFrom(r.Context()).blobs
+	link, err := blobs.URL(r.Context(), a.Key, a.Name, attachmentLinkTTL)
+	if err == nil && link != "" {
+		http.Redirect(w, r, link, http.StatusFound)
+		return
+	}
+	var rc io.ReadCloser
+	if err == nil {
+		rc, err = blobs.Get(r.Context(), a.Key)
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		writeError(w, r, apiErr(http.StatusNotFound, "attachment contents not found"))
+		return
+	}
+	if err != nil {
+		writeError(w, r, internalError("error fetching attachment", err))
+		return
+	}
+	defer rc.Close()
+	w.Header().Set("Content-Type", a.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(a.Size, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": a.Name}))
+	if _, err := io.Copy(w, rc); err != nil {
+		slog.ErrorContext(r.Context(), "deleting attachment", "key", a.Key, "err", err)
+	}
+}
+
+// deleteAttachment lets uploaders remove their own files and todo owners
+// remove anything on their todos.
+func deleteAttachment(w http.ResponseWriter, r *http.Request) {
+	tm, ok := readableTodo(w, r)
+	if !ok {
+		return
+	}
+	id := strings.TrimSpace(chi.URLParam(r, "attachmentId"))
+	if !validID(id) {
+		writeError(w, r, apiErr(http.StatusBadRequest, "The attachment id is invalid"))
+		return
+	}
+	user := currentUser(r.Context())
+	filter := bson.M{"_id": toID(id), "todoId": tm.ID}
+	if tm.UserID != user {
+		filter["uploaderId"] = user
+	}
+	n, err := deleteAttachments(r.Context(), filter)
+	if err == nil && n == 0 {
+		writeError(w, r, apiErr(http.StatusNotFound, "attachment not found"))
+		return
+	}
+	if err != nil {
+		writeError(w, r, internalError("error deleting attachment", err))
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"message": translate(r.Context(), "attachment deleted successfully"),
+	})
+}
+
+// readableAttachment loads the {attachmentId} attachment of the {id} todo
+// if the caller can read the todo, writing an error response otherwise.
+func readableAttachment(w http.ResponseWriter, r *http.Request) (attachmentModel, bool) {
+	var a attachmentModel
+	tm, ok := readableTodo(w, r)
+	if !ok {
+		return a, false
+	}
+	id := strings.TrimSpace(chi.URLParam(r, "attachmentId"))
+	if !validID(id) {
+		writeError(w, r, apiErr(http.StatusBadRequest, "The attachment id is invalid"))
+		return a, false
+	}
+	err := db.Collection(attachmentsCollection).FindOne(r.Context(), bson.M{"_id": toID(id), "todoId": tm.ID}).Decode(&a)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, r, apiErr(http.StatusNotFound, "attachment not found"))
+		return a, false
+	}
+	if err != nil {
+		writeError(w, r, internalError("error fetching attachment", err))
+		return a, false
+	}
+	return a, true
+}
+
+// deleteAttachments removes the matching attachments and their blobs,
+// returning how many there were. A blob that cannot be deleted is only
+// logged, since its attachment is already gone.
+func deleteAttachments(ctx context.Context, filter bson.M) (int, error) {
+	found, err := removeAttachments(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	deleteBlobs(ctx, found)
+	return len(found), nil
+}
+
+// removeAttachments removes the matching attachments but not their blobs,
+// which are left to deleteBlobs once a transaction removing them commits.
+func removeAttachments(ctx context.Context, filter bson.M) ([]attachmentModel, error) {
+	var found []attachmentModel
+	if err := storage.FindAll(ctx, db.Collection(attachmentsCollection), filter, &found); err != nil {
+		return nil, err
+	}
+	if len(found) == 0 {
+		return nil, nil
+	}
+	ids := make([]ID, 0, len(found))
+	for _, a := range found {
+		ids = append(ids, a.ID)
+	}
+	if _, err := db.Collection(attachmentsCollection).DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}}); err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+func deleteBlobs(ctx context.Context, removed []attachmentModel) {
+	blobs := serverFrom(ctx).blobs
+	for _, a := range removed {
+		if err := blobs.Delete(ctx, a.Key); err != nil {
+			slog.ErrorContext(ctx, "deleting attachment", "key", a.Key, "err", err)
+		}
+	}
+}
+
+func toAttachment(ctx context.Context, a attachmentModel) attachment {
+	return attachment{
+		ID:          a.ID.String(),
+		UploaderID:  a.UploaderID.String(),
+		Name:        a.Name,
+		ContentType: a.ContentType,
+		Size:        a.Size,
+		CreateAt:    formatTime(ctx, a.CreateAt),
+	}
+}
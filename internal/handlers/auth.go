@@ -0,0 +1,421 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	usersCollection string = "users"
+	minPasswordLen         = 8
+)
+
+type ctxKey int
+
+const (
+	principalKey ctxKey = iota
+	workspaceKey
+)
+
+const (
+	roleAdmin  = "admin"
+	roleMember = "member"
+	roleViewer = "viewer"
+)
+
+// principal is the authenticated caller attached to the request context.
+type principal struct {
+	UserID      ID
+	WorkspaceID ID
+	Role        string
+	// SessionID is empty for API keys.
+	SessionID ID
+	// Unverified callers have not confirmed their email and are limited to
+	// the viewer role.
+	Unverified bool
+	// ReadOnly and ListID narrow what a scoped API key may do.
+	ReadOnly bool
+	ListID   ID
+}
+
+type tokenClaims struct {
+	Role       string `json:"role"`
+	Workspace  string `json:"ws"`
+	Session    string `json:"sid,omitempty"`
+	Unverified bool   `json:"uv,omitempty"`
+	jwt.RegisteredClaims
+}
+
+var (
+	errWrongWorkspace  = errors.New("token belongs to another workspace")
+	errAccountDisabled = errors.New("account is disabled")
+)
+
+type (
+	userModel struct {
+		ID           ID         `bson:"_id,omitempty"`
+		WorkspaceID  ID         `bson:"workspaceId"`
+		Email        string     `bson:"email"`
+		PasswordHash []byte     `bson:"passwordHash,omitempty"`
+		Role         string     `bson:"role"`
+		Identities   []identity `bson:"identities,omitempty"`
+		CreateAt     time.Time  `bson:"createAt"`
+		Unverified   bool       `bson:"unverified,omitempty"`
+		Disabled     bool       `bson:"disabled,omitempty"`
+		// TOTPPending holds a secret between enrollment and verification.
+		TOTPPending   string   `bson:"totpPendingSecret,omitempty"`
+		TOTPSecret    string   `bson:"totpSecret,omitempty"`
+		TOTPEnabled   bool     `bson:"totpEnabled,omitempty"`
+		RecoveryCodes []string `bson:"recoveryCodes,omitempty"`
+		// Phone is a verified number for SMS reminders, see sms.go.
+		Phone string `bson:"phone,omitempty"`
+		// Notifications says which emails and texts the user gets.
+		Notifications notificationSettings `bson:"notifications,omitempty"`
+		// TimeZone is the IANA name of the zone the user's timestamps and
+		// digests are in, UTC if empty.
+		TimeZone string `bson:"timeZone,omitempty"`
+	}
+	credentials struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+		// Code is a TOTP or recovery code, required once 2FA is enabled.
+		Code string `json:"code,omitempty"`
+	}
+)
+
+func authHandlers() http.Handler {
+	rg := chi.NewRouter()
+	rg.Group(func(r chi.Router) {
+		r.Post("/register", register)
+		r.Post("/login", login)
+		r.Post("/refresh", refreshSession)
+		r.Post("/forgot", forgotPassword)
+		r.Post("/reset", resetPassword)
+		r.Get("/verify", verifyEmail)
+		r.With(requireAuth).Post("/verify/resend", resendVerification)
+		r.With(requireAuth).Post("/logout", logout)
+		r.With(requireAuth).Post("/introspect", introspect)
+		r.Mount("/sessions", sessionHandlers())
+		r.Mount("/tokens", tokenHandlers())
+		r.Mount("/oauth", oauthHandlers())
+		r.Mount("/2fa", totpHandlers())
+	})
+	return rg
+}
+
+func register(w http.ResponseWriter, r *http.Request) {
+	var c credentials
+	if !decodeJSON(w, r, &c) {
+		return
+	}
+	c.Email = strings.ToLower(strings.TrimSpace(c.Email))
+	if !strings.Contains(c.Email, "@") {
+		writeError(w, r, apiErr(http.StatusBadRequest, "a valid email is required"))
+		return
+	}
+	if len(c.Password) < minPasswordLen {
+		writeError(w, r, apiErr(http.StatusBadRequest, "password must be at least 8 characters"))
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(c.Password), bcrypt.DefaultCost)
+	if err != nil {
+		writeError(w, r, internalError("error creating user", err))
+		return
+	}
+	u := userModel{
+		ID:           newID(),
+		WorkspaceID:  currentWorkspace(r.Context()),
+		Email:        c.Email,
+		PasswordHash: hash,
+		Role:         roleMember,
+		CreateAt:     time.Now(),
+		Unverified:   true,
+	}
+	// The first account in a fresh workspace administers it.
+	if n, err := db.Collection(usersCollection).CountDocuments(r.Context(), bson.M{"workspaceId": u.WorkspaceID}); err == nil && n == 0 {
+		u.Role = roleAdmin
+	}
+	if _, err := db.Collection(usersCollection).InsertOne(r.Context(), &u); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			writeError(w, r, apiErr(http.StatusConflict, "email is already registered"))
+			return
+		}
+		writeError(w, r, internalError("error creating user", err))
+		return
+	}
+	if err := sendVerification(r.Context(), u); err != nil {
+		slog.ErrorContext(r.Context(), "sending verification", "email", u.Email, "err", err)
+	}
+	issueToken(w, r, http.StatusCreated, u)
+}
+
+func login(w http.ResponseWriter, r *http.Request) {
+	var c credentials
+	if !decodeJSON(w, r, &c) {
+		return
+	}
+	if !checkLoginLockout(w, r, c.Email) {
+		return
+	}
+	u, err := signIn(r, c)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	issueToken(w, r, http.StatusOK, u)
+}
+
+// signIn checks c against the directory, if there is one, or the local
+// accounts, then against the user's second factor either way, recording
+// the attempt for lockouts, and returns the user
+// signing in or the error to answer with. Callers check the lockout
+// first, with checkLoginLockout or loginLockedFor.
+func signIn(r *http.Request, c credentials) (userModel, error) {
+	if ldapConf != nil {
+		dn, email, err := ldapAuthenticate(strings.TrimSpace(c.Email), c.Password)
+		switch {
+		case err == nil:
+			u, err := userForIdentity(r.Context(), currentWorkspace(r.Context()), identity{Provider: "ldap", Subject: dn}, email)
+			if err != nil {
+				return userModel{}, internalError("error signing in", err)
+			}
+			return secondFactor(r, c, u)
+		case ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials):
+			loginFailed(r, c.Email, "invalid directory credentials")
+			return userModel{}, apiErr(http.StatusUnauthorized, "invalid email or password")
+		case err != errLDAPUserNotFound:
+			slog.ErrorContext(r.Context(), "ldap login", "err", err)
+			return userModel{}, apiErr(http.StatusServiceUnavailable, "directory is unavailable")
+		}
+		// Users missing from the directory fall back to local accounts.
+	}
+
+	var u userModel
+	err := db.Collection(usersCollection).FindOne(r.Context(), bson.M{
+		"workspaceId": currentWorkspace(r.Context()),
+		"email":       strings.ToLower(strings.TrimSpace(c.Email)),
+	}).Decode(&u)
+	if err == nil {
+		err = bcrypt.CompareHashAndPassword(u.PasswordHash, []byte(c.Password))
+	}
+	if err != nil {
+		loginFailed(r, c.Email, "invalid password")
+		return userModel{}, apiErr(http.StatusUnauthorized, "invalid email or password")
+	}
+	return secondFactor(r, c, u)
+}
+
+// secondFactor completes signing in u, whose password has been checked,
+// asking for a two-factor code if u has enrolled.
+func secondFactor(r *http.Request, c credentials, u userModel) (userModel, error) {
+	if u.TOTPEnabled {
+		ok, err := checkSecondFactor(r.Context(), u, c.Code)
+		if err != nil {
+			return userModel{}, internalError("error signing in", err)
+		}
+		if !ok {
+			// Asking for the code is the normal second step, not a failure.
+			if c.Code != "" {
+				loginFailed(r, c.Email, "invalid two-factor code")
+			}
+			return userModel{}, &apiError{
+				Status:  http.StatusUnauthorized,
+				Code:    "totp_required",
+				Message: "a valid two-factor code is required",
+			}
+		}
+	}
+	loginSucceeded(r, u)
+	return u, nil
+}
+
+func signToken(ctx context.Context, p principal, expires time.Time) (string, error) {
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, tokenClaims{
+		Role:       p.Role,
+		Workspace:  p.WorkspaceID.String(),
+		Session:    p.SessionID.String(),
+		Unverified: p.Unverified,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   p.UserID.String(),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(expires),
+		},
+	}).SignedString(serverFrom(ctx).jwtSecret)
+}
+
+// parseToken validates a signed token and returns the user it was issued to.
+func parseToken(ctx context.Context, token string) (principal, error) {
+	var claims tokenClaims
+	_, err := jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (interface{}, error) {
+		return serverFrom(ctx).jwtSecret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil {
+		return principal{}, err
+	}
+	if !validID(claims.Subject) || !validID(claims.Workspace) {
+		return principal{}, jwt.ErrTokenInvalidClaims
+	}
+	p := principal{
+		UserID:      toID(claims.Subject),
+		WorkspaceID: toID(claims.Workspace),
+		Role:        claims.Role,
+		Unverified:  claims.Unverified,
+	}
+	if validID(claims.Session) {
+		p.SessionID = toID(claims.Session)
+	}
+	return p, nil
+}
+
+// authenticate resolves token through the configured authenticators.
+func authenticate(ctx context.Context, token string) (principal, error) {
+	p, err := serverFrom(ctx).authenticators.Authenticate(ctx, token)
+	// Accounts created before roles existed are members.
+	if err == nil && p.Role == "" {
+		p.Role = roleMember
+	}
+	if err == nil && (p.Unverified || p.ReadOnly) {
+		p.Role = roleViewer
+	}
+	return p, err
+}
+
+// userPrincipal is the principal u acts as outside a request, as when
+// todos arrive by chat or email, following the same role rules as
+// authenticate.
+func userPrincipal(u userModel) principal {
+	p := principal{UserID: u.ID, WorkspaceID: u.WorkspaceID, Role: u.Role, Unverified: u.Unverified}
+	if p.Role == "" {
+		p.Role = roleMember
+	}
+	if p.Unverified {
+		p.Role = roleViewer
+	}
+	return p
+}
+
+// scopedPaths are the only routes open to keys restricted to a single
+// list; the storage layer confines them to that list's todos.
+var scopedPaths = []string{"/todo", "/graphql", "/zapier"}
+
+func allowedForScope(p principal, r *http.Request) bool {
+	if p.ListID.IsZero() {
+		return true
+	}
+	if r.Method == http.MethodGet && (r.URL.Path == "/lists" || r.URL.Path == "/lists/") {
+		return true
+	}
+	for _, prefix := range scopedPaths {
+		if r.URL.Path == prefix || strings.HasPrefix(r.URL.Path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func bearerToken(header string) string {
+	const prefix = "Bearer "
+	if len(header) > len(prefix) && strings.EqualFold(header[:len(prefix)], prefix) {
+		return strings.TrimSpace(header[len(prefix):])
+	}
+	return ""
+}
+
+// requestToken returns the token the request offers, wherever it is.
+func requestToken(r *http.Request) string {
+	token := bearerToken(r.Header.Get("Authorization"))
+	if token == "" {
+		token = websocketToken(r)
+	}
+	if token == "" {
+		token = eventStreamToken(r)
+	}
+	if token == "" {
+		token = apiKey(r)
+	}
+	return token
+}
+
+// requireAuth rejects requests without a valid bearer token for the
+// request's workspace, or outside a scoped token's reach, and stores the
+// caller in the request context. WebSocket handshakes may instead offer the
+// token as a subprotocol, see wsProtocol, event streams as a query
+// parameter, see eventStreamToken, and API tokens may come in the X-API-Key
+// header, see apiKey.
+func requireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := authenticate(r.Context(), requestToken(r))
+		if err == nil && p.WorkspaceID != currentWorkspace(r.Context()) {
+			err = errWrongWorkspace
+		}
+		if err != nil {
+			writeError(w, r, apiErr(http.StatusUnauthorized, "authentication required"))
+			return
+		}
+		if !allowedForScope(p, r) {
+			writeError(w, r, apiErr(http.StatusForbidden, "token is restricted to a single list"))
+			return
+		}
+		noteRequestUser(r.Context(), p.UserID)
+		ctx := context.WithValue(r.Context(), principalKey, p)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requireRole only lets callers holding one of roles through. It must run
+// after requireAuth.
+func requireRole(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !hasRole(r.Context(), roles...) {
+				if currentPrincipal(r.Context()).Unverified {
+					writeError(w, r, &apiError{
+						Status:  http.StatusForbidden,
+						Code:    "email_unverified",
+						Message: "confirm your email address first",
+					})
+					return
+				}
+				writeError(w, r, apiErr(http.StatusForbidden, "insufficient permissions"))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func hasRole(ctx context.Context, roles ...string) bool {
+	p, _ := ctx.Value(principalKey).(principal)
+	for _, role := range roles {
+		if p.Role == role {
+			return true
+		}
+	}
+	return false
+}
+
+// canWrite reports whether the caller may modify todos.
+func canWrite(ctx context.Context) bool {
+	return hasRole(ctx, roleAdmin, roleMember)
+}
+
+func currentPrincipal(ctx context.Context) principal {
+	p, _ := ctx.Value(principalKey).(principal)
+	return p
+}
+
+func currentUser(ctx context.Context) ID {
+	p, _ := ctx.Value(principalKey).(principal)
+	return p.UserID
+}
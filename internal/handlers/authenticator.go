@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/thedevsaddam/renderer"
+)
+
+// Authenticator turns a bearer token into the principal it stands for.
+// Implementations return errUnsupportedToken for tokens they do not
+// recognise so the next one configured can try.
+type Authenticator interface {
+	Authenticate(ctx context.Context, token string) (principal, error)
+}
+
+var (
+	errUnsupportedToken = errors.New("unsupported token")
+	errInactiveToken    = errors.New("token is not active")
+)
+
+// authenticatorNames is TODO_AUTHENTICATORS, which picks the authenticators
+// to try, in order, from "jwt", "apikey" and "introspection".
+var authenticatorNames = envString("TODO_AUTHENTICATORS", "jwt,apikey")
+
+// newAuthenticators returns the authenticators authenticatorNames picks.
+func newAuthenticators() (chainAuthenticator, error) {
+	var authenticators chainAuthenticator
+	for _, name := range strings.Split(authenticatorNames, ",") {
+		switch strings.TrimSpace(name) {
+		case "jwt":
+			authenticators = append(authenticators, jwtAuthenticator{})
+		case "apikey":
+			authenticators = append(authenticators, apiKeyAuthenticator{})
+		case "introspection":
+			a, err := newIntrospectionAuthenticator()
+			if err != nil {
+				return nil, err
+			}
+			authenticators = append(authenticators, a)
+		default:
+			return nil, fmt.Errorf("TODO_AUTHENTICATORS: unknown authenticator %q", name)
+		}
+	}
+	return authenticators, nil
+}
+
+type chainAuthenticator []Authenticator
+
+func (c chainAuthenticator) Authenticate(ctx context.Context, token string) (principal, error) {
+	for _, a := range c {
+		p, err := a.Authenticate(ctx, token)
+		if err != errUnsupportedToken {
+			return p, err
+		}
+	}
+	return principal{}, errUnsupportedToken
+}
+
+// jwtAuthenticator accepts the session tokens this service signs.
+type jwtAuthenticator struct{}
+
+func (jwtAuthenticator) Authenticate(ctx context.Context, token string) (principal, error) {
+	if strings.HasPrefix(token, apiTokenPrefix) {
+		return principal{}, errUnsupportedToken
+	}
+	p, err := parseToken(ctx, token)
+	// Anything that is not a JWT, or one signed by someone else, may
+	// belong to another authenticator.
+	if errors.Is(err, jwt.ErrTokenMalformed) || errors.Is(err, jwt.ErrTokenSignatureInvalid) {
+		return p, errUnsupportedToken
+	}
+	return p, err
+}
+
+// apiKeyAuthenticator accepts long-lived API keys.
+type apiKeyAuthenticator struct{}
+
+func (apiKeyAuthenticator) Authenticate(ctx context.Context, token string) (principal, error) {
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return principal{}, errUnsupportedToken
+	}
+	return lookupAPIToken(ctx, token)
+}
+
+// introspectionAuthenticator validates opaque tokens against a remote
+// OAuth 2.0 introspection endpoint (RFC 7662), configured with
+// TODO_INTROSPECTION_URL, TODO_INTROSPECTION_CLIENT_ID and
+// TODO_INTROSPECTION_CLIENT_SECRET. Remote subjects are linked to local
+// accounts by email the first time they are seen.
+type introspectionAuthenticator struct {
+	endpoint     string
+	clientID     string
+	clientSecret string
+	client       *http.Client
+
+	mu    sync.Mutex
+	cache map[string]cachedPrincipal
+}
+
+type cachedPrincipal struct {
+	p       principal
+	expires time.Time
+}
+
+// introspectionCacheTTL bounds how long a remote answer is trusted, and so
+// how long a remotely revoked token keeps working.
+const introspectionCacheTTL = time.Minute
+
+// introspectionConf is where the introspection authenticator checks tokens.
+var introspectionConf = struct {
+	URL, ClientID, ClientSecret string
+}{
+	URL:          envString("TODO_INTROSPECTION_URL", ""),
+	ClientID:     envString("TODO_INTROSPECTION_CLIENT_ID", ""),
+	ClientSecret: envString("TODO_INTROSPECTION_CLIENT_SECRET", ""),
+}
+
+func newIntrospectionAuthenticator() (*introspectionAuthenticator, error) {
+	a := &introspectionAuthenticator{
+		endpoint:     introspectionConf.URL,
+		clientID:     introspectionConf.ClientID,
+		clientSecret: introspectionConf.ClientSecret,
+		client:       &http.Client{Timeout: 5 * time.Second},
+		cache:        map[string]cachedPrincipal{},
+	}
+	if a.endpoint == "" {
+		return nil, errors.New("TODO_INTROSPECTION_URL is required for the introspection authenticator")
+	}
+	return a, nil
+}
+
+func (a *introspectionAuthenticator) Authenticate(ctx context.Context, token string) (principal, error) {
+	if token == "" {
+		return principal{}, errUnsupportedToken
+	}
+	key := hashAPIToken(token)
+	a.mu.Lock()
+	c, ok := a.cache[key]
+	a.mu.Unlock()
+	if ok && time.Now().Before(c.expires) {
+		return c.p, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.endpoint,
+		strings.NewReader(url.Values{"token": {token}}.Encode()))
+	if err != nil {
+		return principal{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if a.clientID != "" {
+		req.SetBasicAuth(a.clientID, a.clientSecret)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return principal{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return principal{}, fmt.Errorf("introspection: unexpected status %s", resp.Status)
+	}
+	var ir struct {
+		Active   bool   `json:"active"`
+		Subject  string `json:"sub"`
+		Email    string `json:"email"`
+		Username string `json:"username"`
+		Expires  int64  `json:"exp"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&ir); err != nil {
+		return principal{}, err
+	}
+	if !ir.Active || ir.Subject == "" {
+		return principal{}, errInactiveToken
+	}
+	email := ir.Email
+	if email == "" && strings.Contains(ir.Username, "@") {
+		email = ir.Username
+	}
+	u, err := userForIdentity(ctx, currentWorkspace(ctx), identity{Provider: "introspection", Subject: ir.Subject}, email)
+	if err != nil {
+		return principal{}, err
+	}
+	if u.Disabled {
+		return principal{}, errAccountDisabled
+	}
+	p := principal{UserID: u.ID, WorkspaceID: u.WorkspaceID, Role: u.Role, Unverified: u.Unverified}
+
+	expires := time.Now().Add(introspectionCacheTTL)
+	if ir.Expires > 0 && time.Unix(ir.Expires, 0).Before(expires) {
+		expires = time.Unix(ir.Expires, 0)
+	}
+	a.mu.Lock()
+	for k, v := range a.cache {
+		if time.Now().After(v.expires) {
+			delete(a.cache, k)
+		}
+	}
+	a.cache[key] = cachedPrincipal{p: p, expires: expires}
+	a.mu.Unlock()
+	return p, nil
+}
+
+// introspect reports whether a token is valid for the caller's workspace,
+// in the spirit of RFC 7662, so other services can check tokens issued
+// here. The token may be sent as a form field or in a JSON body.
+func introspect(w http.ResponseWriter, r *http.Request) {
+	token := r.PostFormValue("token")
+	if token == "" && isJSON(r) {
+		var req struct {
+			Token string `json:"token"`
+		}
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		token = req.Token
+	}
+	p, err := authenticate(r.Context(), strings.TrimSpace(token))
+	if err != nil || p.WorkspaceID != currentWorkspace(r.Context()) {
+		render(r).JSON(w, http.StatusOK, renderer.M{
+			"active": false,
+		})
+		return
+	}
+	resp := renderer.M{
+		"active":    true,
+		"sub":       p.UserID.String(),
+		"workspace": p.WorkspaceID.String(),
+		"role":      p.Role,
+		"read_only": p.ReadOnly,
+	}
+	if !p.ListID.IsZero() {
+		resp["list_id"] = p.ListID.String()
+	}
+	render(r).JSON(w, http.StatusOK, resp)
+}
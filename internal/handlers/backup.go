@@ -0,0 +1,366 @@
+package handlers
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sangin4208/go-todo/internal/storage"
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// A backup is a gzip stream of BSON documents, one per stored document,
+// each naming its collection:
+//
+//	{"c": "users", "d": {...the user...}}
+//
+// It covers every collection in the database. Todos kept in another
+// TODO_STORAGE backend are read and restored through it, as documents of
+// the todo collection, so a backup can also move them between backends.
+type backupEntry struct {
+	Collection string   `bson:"c"`
+	Document   bson.Raw `bson:"d"`
+}
+
+// Ways to restore a document whose _id (or other unique key) is taken.
+const (
+	conflictSkip      = "skip"
+	conflictOverwrite = "overwrite"
+	conflictFail      = "fail"
+)
+
+type restoreCounts struct {
+	Inserted  int `json:"inserted"`
+	Replaced  int `json:"replaced"`
+	Skipped   int `json:"skipped"`
+	Conflicts int `json:"conflicts"`
+}
+
+// requireDefaultWorkspace confines a route to callers signed in to the
+// default workspace, for operations spanning every workspace.
+func requireDefaultWorkspace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if currentWorkspace(r.Context()) != defaultWorkspace {
+			writeError(w, r, apiErr(http.StatusForbidden, "only administrators of the default workspace may do this"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// backupDatabase streams a backup of every collection, anonymized with
+// ?anonymize=true (see anonymizedFields). Once streaming has begun errors
+// can only be logged, leaving a truncated file that restore rejects.
+func backupDatabase(w http.ResponseWriter, r *http.Request) {
+	var anon *anonymizer
+	kind := "backup"
+	srv := serverFrom(r.Context())
+	names, err := db.ListCollectionNames(r.Context(), bson.M{})
+	if err == nil && r.URL.Query().Get("anonymize") == "true" {
+		anon, err = newAnonymizer(srv.collection)
+		kind = "anonymized"
+	}
+	if err != nil {
+		writeError(w, r, internalError("error listing collections", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf(`attachment; filename="todo-%s-%s.bson.gz"`, kind, time.Now().UTC().Format("20060102-150405")))
+	zw := gzip.NewWriter(w)
+	for _, name := range names {
+		if strings.HasPrefix(name, "system.") || (name == srv.collection && !srv.todosInMongo()) {
+			continue
+		}
+		if err := backupCollection(r.Context(), zw, name, anon); err != nil {
+			slog.Error("backup", "file", name, "err", err)
+			return
+		}
+	}
+	if !srv.todosInMongo() {
+		if err := backupTodos(r.Context(), zw, srv.collection, anon); err != nil {
+			slog.Error("backup", "file", srv.collection, "err", err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		slog.Error("backup", "err", err)
+	}
+}
+
+// backupCollection writes the collection's documents to w, passing each
+// through anon unless it is nil.
+func backupCollection(ctx context.Context, w io.Writer, name string, anon *anonymizer) error {
+	cur, err := db.Collection(name).Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		doc := cur.Current
+		if anon != nil {
+			var keep bool
+			if doc, keep, err = anon.document(name, doc); err != nil {
+				return err
+			} else if !keep {
+				continue
+			}
+		}
+		b, err := bson.Marshal(backupEntry{Collection: name, Document: doc})
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+// backupTodos writes the todos of every user, read from the todo
+// repository, to w as documents of the collection name, sealed as they
+// would be in Mongo.
+func backupTodos(ctx context.Context, w io.Writer, name string, anon *anonymizer) error {
+	cur, err := db.Collection(usersCollection).Find(ctx, bson.M{},
+		options.Find().SetProjection(bson.M{"_id": 1, "workspaceId": 1}))
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		var u userModel
+		if err := cur.Decode(&u); err != nil {
+			return err
+		}
+		owned, _, err := serverFrom(ctx).todos.List(ctx, todoScope{WorkspaceID: u.WorkspaceID, OwnerID: u.ID}, TodoFilter{}, 0, 0)
+		if err != nil {
+			return err
+		}
+		for _, tm := range owned {
+			if err := sealTodo(&tm); err != nil {
+				return err
+			}
+			doc, err := bson.Marshal(tm)
+			if err != nil {
+				return err
+			}
+			if anon != nil {
+				if doc, _, err = anon.document(name, doc); err != nil {
+					return err
+				}
+			}
+			b, err := bson.Marshal(backupEntry{Collection: name, Document: doc})
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write(b); err != nil {
+				return err
+			}
+		}
+	}
+	return cur.Err()
+}
+
+// restoreDatabase loads a backup from the request body. ?dry_run=true only
+// counts what would happen; ?on_conflict= is skip (the default), overwrite
+// or fail, which stops at the first conflict leaving what came before it
+// restored.
+func restoreDatabase(w http.ResponseWriter, r *http.Request) {
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+	onConflict := r.URL.Query().Get("on_conflict")
+	switch onConflict {
+	case "":
+		onConflict = conflictSkip
+	case conflictSkip, conflictOverwrite, conflictFail:
+	default:
+		writeError(w, r, apiErr(http.StatusBadRequest, "on_conflict must be one of skip, overwrite or fail"))
+		return
+	}
+	zr, err := gzip.NewReader(r.Body)
+	if err != nil {
+		writeError(w, r, &apiError{
+			Status:  http.StatusBadRequest,
+			Message: "the backup is not gzip compressed",
+			Err:     err,
+		})
+		return
+	}
+	counts := map[string]*restoreCounts{}
+	err = readBackup(zr, func(e backupEntry) error {
+		c, ok := counts[e.Collection]
+		if !ok {
+			c = &restoreCounts{}
+			counts[e.Collection] = c
+		}
+		return restoreDocument(r.Context(), e, onConflict, dryRun, c)
+	})
+	status, message := http.StatusOK, "backup restored successfully"
+	if dryRun {
+		message = "dry run completed"
+	}
+	switch {
+	case mongo.IsDuplicateKeyError(err):
+		status, message = http.StatusConflict, "restore stopped at a conflicting document"
+	case err == errBadBackup:
+		status, message = http.StatusBadRequest, "the backup is malformed or truncated"
+	case err != nil:
+		status, message = http.StatusInternalServerError, "error restoring backup"
+	}
+	resp := renderer.M{
+		"message":     translate(r.Context(), message),
+		"dryRun":      dryRun,
+		"collections": counts,
+	}
+	if err != nil {
+		resp["error"] = err.Error()
+	}
+	render(r).JSON(w, status, resp)
+}
+
+var errBadBackup = errors.New("malformed backup")
+
+// readBackup calls f with each entry of a backup.
+func readBackup(r io.Reader, f func(backupEntry) error) error {
+	br := bufio.NewReader(r)
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(br, size[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errBadBackup
+		}
+		n := binary.LittleEndian.Uint32(size[:])
+		if n < 5 || n > 64<<20 {
+			return errBadBackup
+		}
+		doc := make([]byte, n)
+		copy(doc, size[:])
+		if _, err := io.ReadFull(br, doc[4:]); err != nil {
+			return errBadBackup
+		}
+		var e backupEntry
+		if err := bson.Unmarshal(doc, &e); err != nil || e.Collection == "" || strings.HasPrefix(e.Collection, "system.") {
+			return errBadBackup
+		}
+		if err := f(e); err != nil {
+			return err
+		}
+	}
+}
+
+func restoreDocument(ctx context.Context, e backupEntry, onConflict string, dryRun bool, c *restoreCounts) error {
+	if srv := serverFrom(ctx); e.Collection == srv.collection && !srv.todosInMongo() {
+		return restoreTodo(ctx, e, onConflict, dryRun, c)
+	}
+	coll := db.Collection(e.Collection)
+	id := e.Document.Lookup("_id")
+	if dryRun {
+		n, err := coll.CountDocuments(ctx, bson.M{"_id": id})
+		switch {
+		case err != nil:
+			return err
+		case n == 0:
+			c.Inserted++
+		case onConflict == conflictOverwrite:
+			c.Conflicts++
+			c.Replaced++
+		default:
+			c.Conflicts++
+			c.Skipped++
+		}
+		return nil
+	}
+	if onConflict == conflictOverwrite {
+		res, err := coll.ReplaceOne(ctx, bson.M{"_id": id}, e.Document, options.Replace().SetUpsert(true))
+		if err != nil {
+			return err
+		}
+		if res.MatchedCount > 0 {
+			c.Conflicts++
+			c.Replaced++
+		} else {
+			c.Inserted++
+		}
+		return nil
+	}
+	_, err := coll.InsertOne(ctx, e.Document)
+	if mongo.IsDuplicateKeyError(err) {
+		c.Conflicts++
+		if onConflict == conflictFail {
+			return err
+		}
+		c.Skipped++
+		return nil
+	}
+	if err == nil {
+		c.Inserted++
+	}
+	return err
+}
+
+// restoreTodo restores a todo through the todo repository, as
+// restoreDocument does other documents. A todo conflicts with one of the
+// same ID belonging to the same user.
+func restoreTodo(ctx context.Context, e backupEntry, onConflict string, dryRun bool, c *restoreCounts) error {
+	var tm todoModel
+	if err := bson.Unmarshal(e.Document, &tm); err != nil || tm.ID.IsZero() {
+		return errBadBackup
+	}
+	// The repository seals it again.
+	if err := unsealTodo(&tm); err != nil {
+		return err
+	}
+	owner := todoScope{WorkspaceID: tm.WorkspaceID, OwnerID: tm.UserID}
+	todos := serverFrom(ctx).todos
+	_, err := todos.Get(ctx, owner, tm.ID)
+	exists := err == nil
+	if err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+	if dryRun {
+		switch {
+		case !exists:
+			c.Inserted++
+		case onConflict == conflictOverwrite:
+			c.Conflicts++
+			c.Replaced++
+		default:
+			c.Conflicts++
+			c.Skipped++
+		}
+		return nil
+	}
+	if exists {
+		c.Conflicts++
+		switch onConflict {
+		case conflictFail:
+			return storage.DuplicateKey("_id_", tm.ID)
+		case conflictSkip:
+			c.Skipped++
+			return nil
+		}
+		if _, err := todos.Delete(ctx, owner, tm.ID); err != nil {
+			return err
+		}
+	}
+	if err := todos.Create(ctx, &tm); err != nil {
+		return err
+	}
+	if exists {
+		c.Replaced++
+	} else {
+		c.Inserted++
+	}
+	return nil
+}
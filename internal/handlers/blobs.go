@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	s3creds "github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// BlobStore keeps attachment contents outside the database. Keys are
+// generated by the server and are safe to use as paths.
+type BlobStore interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Get opens the blob; a missing blob gives os.ErrNotExist.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+	// URL returns a link that downloads the blob directly from the store
+	// for ttl, or "" if the store cannot hand out links and the server
+	// must stream the blob itself.
+	URL(ctx context.Context, key, filename string, ttl time.Duration) (string, error)
+}
+
+// blobConf selects the store with TODO_BLOB_STORAGE: "fs" keeps blobs
+// under TODO_BLOB_DIR, "s3" in a bucket on any S3-compatible service.
+var blobConf = struct {
+	Storage   string
+	Dir       string
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	Insecure  bool
+}{
+	Storage:   envString("TODO_BLOB_STORAGE", "fs"),
+	Dir:       envString("TODO_BLOB_DIR", "blobs"),
+	Endpoint:  envString("TODO_S3_ENDPOINT", "s3.amazonaws.com"),
+	Region:    envString("TODO_S3_REGION", ""),
+	Bucket:    envString("TODO_S3_BUCKET", ""),
+	AccessKey: envString("TODO_S3_ACCESS_KEY", ""),
+	SecretKey: envString("TODO_S3_SECRET_KEY", ""),
+	Insecure:  envBool("TODO_S3_INSECURE"),
+}
+
+func openBlobStore() (BlobStore, error) {
+	switch blobConf.Storage {
+	case "fs":
+		return fsBlobStore{dir: blobConf.Dir}, os.MkdirAll(blobConf.Dir, 0700)
+	case "s3":
+		if blobConf.Bucket == "" {
+			return nil, errors.New("TODO_S3_BUCKET is required for TODO_BLOB_STORAGE=s3")
+		}
+		client, err := minio.New(blobConf.Endpoint, &minio.Options{
+			Creds:  s3creds.NewStaticV4(blobConf.AccessKey, blobConf.SecretKey, ""),
+			Secure: !blobConf.Insecure,
+			Region: blobConf.Region,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return s3BlobStore{client: client, bucket: blobConf.Bucket}, nil
+	}
+	return nil, fmt.Errorf("unknown TODO_BLOB_STORAGE %q", blobConf.Storage)
+}
+
+// fsBlobStore keeps each blob in a file named by its key.
+type fsBlobStore struct {
+	dir string
+}
+
+func (s fsBlobStore) path(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(key))
+}
+
+func (s fsBlobStore) Put(_ context.Context, key string, r io.Reader, _ int64, _ string) error {
+	p := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	// Write to a temporary file first so readers never see half a blob.
+	f, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (s fsBlobStore) Get(_ context.Context, key string) (io.ReadCloser, error) {
+	return os.Open(s.path(key))
+}
+
+func (s fsBlobStore) Delete(_ context.Context, key string) error {
+	err := os.Remove(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (fsBlobStore) URL(context.Context, string, string, time.Duration) (string, error) {
+	return "", nil
+}
+
+// s3BlobStore keeps blobs in one bucket and hands out presigned links, so
+// downloads bypass the server.
+type s3BlobStore struct {
+	client *minio.Client
+	bucket string
+}
+
+func (s s3BlobStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	_, err := s.client.PutObject(ctx, s.bucket, key, r, size, minio.PutObjectOptions{ContentType: contentType})
+	return err
+}
+
+func (s s3BlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// GetObject is lazy; Stat finds out whether the object exists.
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (s s3BlobStore) Delete(ctx context.Context, key string) error {
+	return s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{})
+}
+
+func (s s3BlobStore) URL(ctx context.Context, key, filename string, ttl time.Duration) (string, error) {
+	params := url.Values{}
+	params.Set("response-content-disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	u, err := s.client.PresignedGetObject(ctx, s.bucket, key, ttl, params)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// JSON request bodies are decoded strictly: they must be sent as
+// application/json, be no larger than TODO_MAX_BODY_BYTES (1MB), hold a
+// single value and name no fields the handler doesn't know. A typo'd field
+// is then reported instead of silently dropped, and nothing a client sends
+// can hold a handler reading for long.
+
+var maxBodyBytes = int64(envInt("TODO_MAX_BODY_BYTES", 1<<20))
+
+// decodeJSON decodes r's body into v and checks it with validRequest,
+// answering 415, 413, 400 or 422 and returning false if it can't.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	if !isJSON(r) {
+		writeError(w, r, &apiError{
+			Status:  http.StatusUnsupportedMediaType,
+			Code:    "unsupported_media_type",
+			Message: "the request body must be JSON, sent as application/json",
+		})
+		return false
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == nil && dec.Decode(&struct{}{}) != io.EOF {
+		err = errors.New("unexpected data after the JSON value")
+	}
+	if err == nil {
+		return validRequest(w, r, v)
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, r, &apiError{
+			Status:  http.StatusRequestEntityTooLarge,
+			Code:    "body_too_large",
+			Message: "the request body must be no larger than " + strconv.FormatInt(maxBodyBytes, 10) + " bytes",
+		})
+		return false
+	}
+	if err == io.EOF {
+		err = errors.New("the request body is empty")
+	}
+	writeError(w, r, &apiError{
+		Status:  http.StatusBadRequest,
+		Message: "invalid request body",
+		Err:     err,
+	})
+	return false
+}
+
+// isJSON reports whether r's body is declared as JSON, including
+// application/*+json types.
+func isJSON(r *http.Request) bool {
+	t, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && (t == "application/json" || strings.HasPrefix(t, "application/") && strings.HasSuffix(t, "+json"))
+}
+
+// hasBody reports whether r came with a body, for handlers where one is
+// optional.
+func hasBody(r *http.Request) bool {
+	return r.ContentLength != 0
+}
@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"github.com/sangin4208/go-todo/internal/docstore"
+	"go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// boltPath is the database file used when TODO_STORAGE=bolt.
+var boltPath = envString("TODO_BOLT_PATH", "todo.bolt")
+
+// boltDocuments holds a bucket per collection of the embedded database.
+var boltDocuments = []byte("documents")
+
+// boltDocumentStore keeps the embedded database in the Bolt file the todos
+// are in, in a bucket per collection under boltDocuments. Bolt orders keys
+// by their bytes, so documents come back in _id order rather than the
+// order they were inserted in, which Mongo does not promise either.
+type boltDocumentStore struct {
+	db *bbolt.DB
+}
+
+func (s boltDocumentStore) Load(fn func(collection string, doc bson.Raw) error) error {
+	return s.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltDocuments).ForEachBucket(func(name []byte) error {
+			return tx.Bucket(boltDocuments).Bucket(name).ForEach(func(_, doc []byte) error {
+				return fn(string(name), doc)
+			})
+		})
+	})
+}
+
+func (s boltDocumentStore) Write(changes []docstore.Change) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		for _, c := range changes {
+			b, err := tx.Bucket(boltDocuments).CreateBucketIfNotExists([]byte(c.Collection))
+			if err != nil {
+				return err
+			}
+			if c.Doc == nil {
+				err = b.Delete(c.ID)
+			} else {
+				err = b.Put(c.ID, c.Doc)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Close closes the file, todo repository and all, at shutdown.
+func (s boltDocumentStore) Close() error {
+	return s.db.Close()
+}
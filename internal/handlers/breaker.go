@@ -0,0 +1,220 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/sangin4208/go-todo/internal/storage"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// errBreakerOpen is returned instead of calling the database while the
+// breaker is open.
+var errBreakerOpen = errors.New("database unavailable")
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// circuitBreaker stops calls to a failing database. After Threshold
+// consecutive failures it opens and fails calls at once for Cooldown; then
+// it lets one call through, closing again if that succeeds and reopening if
+// it fails.
+type circuitBreaker struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+	trips     int
+}
+
+var dbBreaker = &circuitBreaker{
+	Threshold: envInt("TODO_BREAKER_FAILURES", 5),
+	Cooldown:  time.Duration(envInt("TODO_BREAKER_COOLDOWN_SECONDS", 30)) * time.Second,
+}
+
+func init() {
+	expvar.Publish("databaseBreaker", expvar.Func(func() interface{} {
+		state, _ := dbBreaker.state()
+		dbBreaker.mu.Lock()
+		defer dbBreaker.mu.Unlock()
+		return map[string]interface{}{
+			"state":    state,
+			"failures": dbBreaker.failures,
+			"trips":    dbBreaker.trips,
+		}
+	}))
+}
+
+// state reports the breaker's state and, when open, how long until it next
+// lets a call through.
+func (b *circuitBreaker) state() (string, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openUntil.IsZero() {
+		return breakerClosed, 0
+	}
+	if wait := time.Until(b.openUntil); wait > 0 {
+		return breakerOpen, wait
+	}
+	return breakerHalfOpen, 0
+}
+
+// allow reports whether a call may go ahead. While half-open only one call
+// at a time is let through.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openUntil.IsZero() {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// done records the outcome of a call allowed through. Missing documents and
+// callers going away say nothing about the database's health.
+func (b *circuitBreaker) done(err error) {
+	if err == mongo.ErrNoDocuments || errors.Is(err, context.Canceled) {
+		err = nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if err == nil {
+		b.failures = 0
+		b.openUntil = time.Time{}
+		return
+	}
+	b.failures++
+	if b.failures >= b.Threshold || !b.openUntil.IsZero() {
+		if b.openUntil.IsZero() {
+			b.trips++
+		}
+		b.openUntil = time.Now().Add(b.Cooldown)
+	}
+}
+
+// breakerTodoRepository passes calls through dbBreaker.
+type breakerTodoRepository struct {
+	next TodoRepository
+}
+
+func (b breakerTodoRepository) List(ctx context.Context, s todoScope, f TodoFilter, skip, limit int) ([]todoModel, int, error) {
+	if !dbBreaker.allow() {
+		return nil, 0, errBreakerOpen
+	}
+	todos, total, err := b.next.List(ctx, s, f, skip, limit)
+	dbBreaker.done(err)
+	return todos, total, err
+}
+
+func (b breakerTodoRepository) Get(ctx context.Context, s todoScope, id ID) (todoModel, error) {
+	if !dbBreaker.allow() {
+		return todoModel{}, errBreakerOpen
+	}
+	tm, err := b.next.Get(ctx, s, id)
+	dbBreaker.done(err)
+	return tm, err
+}
+
+func (b breakerTodoRepository) Create(ctx context.Context, tm *todoModel) error {
+	if !dbBreaker.allow() {
+		return errBreakerOpen
+	}
+	err := b.next.Create(ctx, tm)
+	dbBreaker.done(err)
+	return err
+}
+
+func (b breakerTodoRepository) Update(ctx context.Context, s todoScope, id ID, title string, completed bool) (todoModel, todoModel, error) {
+	if !dbBreaker.allow() {
+		return todoModel{}, todoModel{}, errBreakerOpen
+	}
+	before, after, err := b.next.Update(ctx, s, id, title, completed)
+	dbBreaker.done(err)
+	return before, after, err
+}
+
+func (b breakerTodoRepository) Assign(ctx context.Context, s todoScope, id, assignee ID) (todoModel, error) {
+	if !dbBreaker.allow() {
+		return todoModel{}, errBreakerOpen
+	}
+	tm, err := b.next.Assign(ctx, s, id, assignee)
+	dbBreaker.done(err)
+	return tm, err
+}
+
+func (b breakerTodoRepository) Delete(ctx context.Context, s todoScope, id ID) (todoModel, error) {
+	if !dbBreaker.allow() {
+		return todoModel{}, errBreakerOpen
+	}
+	tm, err := b.next.Delete(ctx, s, id)
+	dbBreaker.done(err)
+	return tm, err
+}
+
+func (b breakerTodoRepository) CountOpen(ctx context.Context, user ID) (int, error) {
+	if !dbBreaker.allow() {
+		return 0, errBreakerOpen
+	}
+	n, err := b.next.CountOpen(ctx, user)
+	dbBreaker.done(err)
+	return n, err
+}
+
+func (b breakerTodoRepository) DeleteExpired(ctx context.Context, now time.Time) ([]todoModel, error) {
+	if !dbBreaker.allow() {
+		return nil, errBreakerOpen
+	}
+	expired, err := b.next.DeleteExpired(ctx, now)
+	dbBreaker.done(err)
+	return expired, err
+}
+
+func (b breakerTodoRepository) DeleteMany(ctx context.Context, s todoScope, f TodoFilter) ([]todoModel, error) {
+	if !dbBreaker.allow() {
+		return nil, errBreakerOpen
+	}
+	removed, err := b.next.DeleteMany(ctx, s, f)
+	dbBreaker.done(err)
+	return removed, err
+}
+
+func (b breakerTodoRepository) Count(ctx context.Context, s todoScope, f TodoFilter) (int, error) {
+	if !dbBreaker.allow() {
+		return 0, errBreakerOpen
+	}
+	n, err := b.next.Count(ctx, s, f)
+	dbBreaker.done(err)
+	return n, err
+}
+
+func (b breakerTodoRepository) CountTags(ctx context.Context, s todoScope, f TodoFilter) ([]storage.TagCount, error) {
+	if !dbBreaker.allow() {
+		return nil, errBreakerOpen
+	}
+	tags, err := b.next.CountTags(ctx, s, f)
+	dbBreaker.done(err)
+	return tags, err
+}
+
+func (b breakerTodoRepository) CountByDay(ctx context.Context, s todoScope, f TodoFilter, completed bool, loc *time.Location) (map[string]int, error) {
+	if !dbBreaker.allow() {
+		return nil, errBreakerOpen
+	}
+	days, err := b.next.CountByDay(ctx, s, f, completed, loc)
+	dbBreaker.done(err)
+	return days, err
+}
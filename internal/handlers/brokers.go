@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+)
+
+// brokerConf selects where todo events are published with
+// TODO_EVENT_BROKER: "nats" publishes to the server at TODO_NATS_URL,
+// "kafka" to the comma-separated TODO_KAFKA_BROKERS, and "" (the default)
+// nowhere. TODO_EVENT_TOPIC names the subject or topic; "{event}" in it is
+// replaced with the event type, e.g. "todos.{event}" publishes to
+// todos.todo.created, todos.todo.updated and so on.
+var brokerConf = struct {
+	Broker  string
+	NATSURL string
+	Brokers string
+	Topic   string
+}{
+	Broker:  envString("TODO_EVENT_BROKER", ""),
+	NATSURL: envString("TODO_NATS_URL", nats.DefaultURL),
+	Brokers: envString("TODO_KAFKA_BROKERS", "localhost:9092"),
+	Topic:   envString("TODO_EVENT_TOPIC", "todo-events"),
+}
+
+// EventPublisher sends todo events to a message broker. key identifies the
+// todo, so brokers that partition keep each todo's events in order.
+type EventPublisher interface {
+	Publish(ctx context.Context, topic, key string, body []byte, headers map[string]string) error
+	Close() error
+}
+
+// brokerMessage is the body of a published event. Unlike webhookPayload it
+// names the workspace, since consumers see events from all of them.
+type brokerMessage struct {
+	ID          string `json:"id"`
+	Event       string `json:"event"`
+	CreatedAt   string `json:"createdAt"`
+	WorkspaceID string `json:"workspaceId"`
+	Todo        todo   `json:"todo"`
+}
+
+func openBroker() (EventPublisher, error) {
+	switch brokerConf.Broker {
+	case "":
+		return nil, nil
+	case "nats":
+		nc, err := nats.Connect(brokerConf.NATSURL, nats.Name("go-todo"), nats.MaxReconnects(-1))
+		if err != nil {
+			return nil, err
+		}
+		return natsPublisher{conn: nc}, nil
+	case "kafka":
+		return kafkaPublisher{writer: &kafka.Writer{
+			Addr:         kafka.TCP(strings.Split(brokerConf.Brokers, ",")...),
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+			BatchTimeout: 50 * time.Millisecond,
+		}}, nil
+	}
+	return nil, fmt.Errorf("unknown TODO_EVENT_BROKER %q", brokerConf.Broker)
+}
+
+// publishToBroker publishes the event, under its ID so that consumers can
+// drop the duplicates of an event published again after a failure.
+func publishToBroker(ctx context.Context, id ID, typ string, tm todoModel) error {
+	broker := serverFrom(ctx).broker
+	if broker == nil {
+		return nil
+	}
+	body, err := json.Marshal(brokerMessage{
+		ID:          id.String(),
+		Event:       typ,
+		CreatedAt:   time.Now().UTC().Format(time.RFC3339),
+		WorkspaceID: tm.WorkspaceID.String(),
+		Todo:        toTodo(ctx, tm),
+	})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	return broker.Publish(ctx, eventTopic(typ), tm.ID.String(), body, map[string]string{
+		"event-id":   id.String(),
+		"event-type": typ,
+	})
+}
+
+func eventTopic(typ string) string {
+	return strings.ReplaceAll(brokerConf.Topic, "{event}", typ)
+}
+
+type natsPublisher struct {
+	conn *nats.Conn
+}
+
+// Publish waits for the server to have the message, which is as much as core
+// NATS promises; use JetStream on the subject for durability.
+func (p natsPublisher) Publish(ctx context.Context, topic, key string, body []byte, headers map[string]string) error {
+	msg := nats.NewMsg(topic)
+	msg.Data = body
+	for k, v := range headers {
+		msg.Header.Set(k, v)
+	}
+	msg.Header.Set("todo-id", key)
+	if err := p.conn.PublishMsg(msg); err != nil {
+		return err
+	}
+	return p.conn.FlushWithContext(ctx)
+}
+
+func (p natsPublisher) Close() error {
+	return p.conn.Drain()
+}
+
+type kafkaPublisher struct {
+	writer *kafka.Writer
+}
+
+func (p kafkaPublisher) Publish(ctx context.Context, topic, key string, body []byte, headers map[string]string) error {
+	msg := kafka.Message{Topic: topic, Key: []byte(key), Value: body}
+	for k, v := range headers {
+		msg.Headers = append(msg.Headers, kafka.Header{Key: k, Value: []byte(v)})
+	}
+	return p.writer.WriteMessages(ctx, msg)
+}
+
+func (p kafkaPublisher) Close() error {
+	return p.writer.Close()
+}
@@ -0,0 +1,436 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-ical"
+	"github.com/emersion/go-webdav"
+	"github.com/emersion/go-webdav/caldav"
+	"github.com/go-chi/chi"
+	"github.com/sangin4208/go-todo/internal/storage"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// CalDAV serves todos as VTODO resources, so that task apps such as Apple
+// Reminders and Thunderbird sync without a custom client. Clients sign in
+// with HTTP Basic auth, using an API token as the password, and find their
+// way from /.well-known/caldav. Each user gets one calendar for todos
+// outside lists and one per list they belong to:
+//
+//	/dav/me/                             the principal
+//	/dav/me/calendars/                   the calendar home
+//	/dav/me/calendars/todos/             todos outside lists
+//	/dav/me/calendars/<listId>/          a list
+//	/dav/me/calendars/<listId>/<id>.ics  a todo
+//
+// As over the REST API, the due date and categories are only taken when a
+// todo is created; later changes to them are ignored.
+
+const (
+	davPrefix        = "/dav"
+	davPrincipalPath = davPrefix + "/me/"
+	davHomePath      = davPrincipalPath + "calendars/"
+	// davTodosCalendar holds the todos outside lists.
+	davTodosCalendar = "todos"
+	davMaxObjectSize = 64 << 10
+)
+
+func init() {
+	// chi answers 405 to methods it does not know.
+	for _, m := range []string{"PROPFIND", "PROPPATCH", "REPORT", "MKCOL"} {
+		chi.RegisterMethod(m)
+	}
+}
+
+func davHandler() http.Handler {
+	r := chi.NewRouter()
+	r.Use(requireDAVAuth)
+	r.Handle("/*", &caldav.Handler{Backend: davBackend{}, Prefix: davPrefix})
+	return r
+}
+
+// requireDAVAuth is requireAuth for CalDAV clients, which only speak Basic
+// auth. List-scoped keys are refused, as the calendars span every list.
+func requireDAVAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, token, _ := r.BasicAuth()
+		p, err := authenticate(r.Context(), token)
+		if err == nil && p.WorkspaceID != currentWorkspace(r.Context()) {
+			err = errWrongWorkspace
+		}
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="todo", charset="UTF-8"`)
+			writeError(w, r, apiErr(http.StatusUnauthorized, "authentication required"))
+			return
+		}
+		if !p.ListID.IsZero() {
+			writeError(w, r, apiErr(http.StatusForbidden, "token is restricted to a single list"))
+			return
+		}
+		// Objects are single todos; nothing a client sends need be large.
+		r.Body = http.MaxBytesReader(w, r.Body, davMaxObjectSize)
+		noteRequestUser(r.Context(), p.UserID)
+		ctx := context.WithValue(r.Context(), principalKey, p)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// wellKnownCalDAV points clients at the principal; the redirect is followed
+// with credentials, so it needs none itself.
+func wellKnownCalDAV(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, davPrincipalPath, http.StatusMovedPermanently)
+}
+
+type davBackend struct{}
+
+func (davBackend) CurrentUserPrincipal(ctx context.Context) (string, error) {
+	return davPrincipalPath, nil
+}
+
+func (davBackend) CalendarHomeSetPath(ctx context.Context) (string, error) {
+	return davHomePath, nil
+}
+
+func (davBackend) CreateCalendar(ctx context.Context, calendar *caldav.Calendar) error {
+	return webdav.NewHTTPError(http.StatusForbidden, errors.New("create a list instead"))
+}
+
+func (davBackend) ListCalendars(ctx context.Context) ([]caldav.Calendar, error) {
+	p := currentPrincipal(ctx)
+	ids, err := accessibleLists(ctx, p, false)
+	if err != nil {
+		return nil, err
+	}
+	var lists []listModel
+	if err := storage.FindAll(ctx, db.Collection(listsCollection), bson.M{"_id": bson.M{"$in": ids}}, &lists); err != nil {
+		return nil, err
+	}
+	cals := []caldav.Calendar{davCalendar(davTodosCalendar, "Todos")}
+	for _, l := range lists {
+		cals = append(cals, davCalendar(l.ID.String(), l.Name))
+	}
+	return cals, nil
+}
+
+func (davBackend) GetCalendar(ctx context.Context, p string) (*caldav.Calendar, error) {
+	name, obj := splitDAVPath(p)
+	if obj != "" {
+		return nil, errDAVNotFound
+	}
+	if name == davTodosCalendar {
+		cal := davCalendar(name, "Todos")
+		return &cal, nil
+	}
+	listID, err := davList(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	var l listModel
+	if err := db.Collection(listsCollection).FindOne(ctx, bson.M{"_id": listID}).Decode(&l); err != nil {
+		return nil, davError(err)
+	}
+	cal := davCalendar(name, l.Name)
+	return &cal, nil
+}
+
+func (davBackend) GetCalendarObject(ctx context.Context, p string, req *caldav.CalendarCompRequest) (*caldav.CalendarObject, error) {
+	tm, err := davTodo(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	return davObject(tm)
+}
+
+func (davBackend) ListCalendarObjects(ctx context.Context, p string, req *caldav.CalendarCompRequest) ([]caldav.CalendarObject, error) {
+	name, obj := splitDAVPath(p)
+	if obj != "" {
+		return nil, errDAVNotFound
+	}
+	listID, err := davList(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	// With no list to filter on every readable todo comes back, and those
+	// in lists are left to their own calendars.
+	found, _, err := findTodos(ctx, currentPrincipal(ctx), TodoFilter{ListID: listID}, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	objs := make([]caldav.CalendarObject, 0, len(found))
+	for _, tm := range found {
+		if tm.ListID != listID {
+			continue
+		}
+		o, err := davObject(tm)
+		if err != nil {
+			return nil, err
+		}
+		objs = append(objs, *o)
+	}
+	return objs, nil
+}
+
+func (b davBackend) QueryCalendarObjects(ctx context.Context, p string, query *caldav.CalendarQuery) ([]caldav.CalendarObject, error) {
+	objs, err := b.ListCalendarObjects(ctx, p, &query.CompRequest)
+	if err != nil {
+		return nil, err
+	}
+	return caldav.Filter(query, objs)
+}
+
+// PutCalendarObject updates the title and completion of an existing todo,
+// or creates one. A new todo takes its ID from the object name when that is
+// a valid ID not already taken, as clients expect to find it where they put
+// it; otherwise it gets a new one, and the client learns its path from
+// Location.
+func (davBackend) PutCalendarObject(ctx context.Context, p string, cal *ical.Calendar, opts *caldav.PutCalendarObjectOptions) (*caldav.CalendarObject, error) {
+	pr := currentPrincipal(ctx)
+	if pr.Role == roleViewer {
+		return nil, webdav.NewHTTPError(http.StatusForbidden, errors.New("insufficient permissions"))
+	}
+	kind, _, err := caldav.ValidateCalendarObject(cal)
+	if err != nil {
+		return nil, caldav.NewPreconditionError(caldav.PreconditionValidCalendarObjectResource)
+	}
+	if kind != ical.CompToDo {
+		return nil, caldav.NewPreconditionError(caldav.PreconditionSupportedCalendarComponent)
+	}
+	var vtodo *ical.Component
+	for _, c := range cal.Children {
+		if c.Name == ical.CompToDo {
+			vtodo = c
+		}
+	}
+	title, _ := vtodo.Props.Text(ical.PropSummary)
+	title = strings.TrimSpace(title)
+	if title == "" {
+		return nil, webdav.NewHTTPError(http.StatusBadRequest, errors.New("title is required"))
+	}
+	status, _ := vtodo.Props.Text(ical.PropStatus)
+	completed := strings.EqualFold(status, "COMPLETED")
+
+	name, obj := splitDAVPath(p)
+	listID, err := davList(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	tm, err := davTodo(ctx, p)
+	switch {
+	case err == nil:
+		if opts.IfNoneMatch.IsWildcard() {
+			return nil, webdav.NewHTTPError(http.StatusPreconditionFailed, errors.New("todo already exists"))
+		}
+		if err := davCheckIfMatch(tm, opts.IfMatch); err != nil {
+			return nil, err
+		}
+		tm, err = setTodo(ctx, pr, tm.ID, title, completed)
+		if err == mongo.ErrNoDocuments {
+			// Readable but not writable, as in a read-only list.
+			return nil, webdav.NewHTTPError(http.StatusForbidden, errors.New("todo is read-only"))
+		}
+		if err != nil {
+			return nil, davError(err)
+		}
+		return davObject(tm)
+	case err != errDAVNotFound:
+		return nil, err
+	case opts.IfMatch.IsSet():
+		return nil, webdav.NewHTTPError(http.StatusPreconditionFailed, errors.New("todo not found"))
+	}
+
+	tm = todoModel{ID: newID(), ListID: listID, Title: title, CreateAt: time.Now()}
+	if id := strings.TrimSuffix(obj, ".ics"); validID(id) {
+		tm.ID = toID(id)
+	}
+	if due := vtodo.Props.Get(ical.PropDue); due != nil {
+		if d, err := due.DateTime(time.Local); err == nil {
+			tm.DueDate, _ = parseDueDate(d.In(time.Local).Format("2006-01-02"))
+		}
+	}
+	if cats := vtodo.Props.Get(ical.PropCategories); cats != nil {
+		tm.Tags, _ = cats.TextList()
+	}
+	err = insertTodo(ctx, pr, &tm)
+	if mongo.IsDuplicateKeyError(err) {
+		// The name is the ID of a todo in another calendar, or one the
+		// caller cannot see. Every backend refuses to create a todo over
+		// an existing ID, whatever its scope, so it is left alone.
+		tm.ID = newID()
+		err = insertTodo(ctx, pr, &tm)
+	}
+	if err != nil {
+		return nil, davError(err)
+	}
+	if completed {
+		if tm, err = setTodo(ctx, pr, tm.ID, title, true); err != nil {
+			return nil, davError(err)
+		}
+	}
+	return davObject(tm)
+}
+
+func (davBackend) DeleteCalendarObject(ctx context.Context, p string) error {
+	pr := currentPrincipal(ctx)
+	if pr.Role == roleViewer {
+		return webdav.NewHTTPError(http.StatusForbidden, errors.New("insufficient permissions"))
+	}
+	tm, err := davTodo(ctx, p)
+	if err != nil {
+		return err
+	}
+	return davError(removeTodo(ctx, pr, tm.ID))
+}
+
+var errDAVNotFound = webdav.NewHTTPError(http.StatusNotFound, errors.New("not found"))
+
+// davError maps storage errors to the status a client should see.
+func davError(err error) error {
+	switch err {
+	case mongo.ErrNoDocuments:
+		return errDAVNotFound
+	case errListNotFound:
+		return webdav.NewHTTPError(http.StatusForbidden, err)
+	case errQuotaExceeded:
+		return webdav.NewHTTPError(http.StatusInsufficientStorage, err)
+	}
+	return err
+}
+
+// splitDAVPath splits a path under the calendar home into the calendar and
+// object names, either of which may be empty.
+func splitDAVPath(p string) (calendar, object string) {
+	rest, ok := strings.CutPrefix(path.Clean(p)+"/", davHomePath)
+	if !ok {
+		return "", ""
+	}
+	calendar, object, _ = strings.Cut(strings.TrimSuffix(rest, "/"), "/")
+	return calendar, object
+}
+
+// davList returns the list a calendar stands for, none for the todos
+// calendar.
+func davList(ctx context.Context, calendar string) (ID, error) {
+	if calendar == davTodosCalendar {
+		return "", nil
+	}
+	if !validID(calendar) {
+		return "", errDAVNotFound
+	}
+	ids, err := accessibleLists(ctx, currentPrincipal(ctx), false)
+	if err != nil {
+		return "", err
+	}
+	if !containsID(ids, toID(calendar)) {
+		return "", errDAVNotFound
+	}
+	return toID(calendar), nil
+}
+
+// davTodo finds the todo at p, which must be in the calendar p names.
+func davTodo(ctx context.Context, p string) (todoModel, error) {
+	calendar, obj := splitDAVPath(p)
+	id := strings.TrimSuffix(obj, ".ics")
+	if calendar == "" || !validID(id) {
+		return todoModel{}, errDAVNotFound
+	}
+	listID, err := davList(ctx, calendar)
+	if err != nil {
+		return todoModel{}, err
+	}
+	tm, err := getTodo(ctx, currentPrincipal(ctx), toID(id))
+	if err != nil {
+		return tm, davError(err)
+	}
+	if tm.ListID != listID {
+		return tm, errDAVNotFound
+	}
+	return tm, nil
+}
+
+func davCheckIfMatch(tm todoModel, ifMatch webdav.ConditionalMatch) error {
+	if !ifMatch.IsSet() {
+		return nil
+	}
+	o, err := davObject(tm)
+	if err != nil {
+		return err
+	}
+	ok, err := ifMatch.MatchETag(o.ETag)
+	if err != nil {
+		return webdav.NewHTTPError(http.StatusBadRequest, err)
+	}
+	if !ok {
+		return webdav.NewHTTPError(http.StatusPreconditionFailed, errors.New("todo has changed"))
+	}
+	return nil
+}
+
+func davCalendar(name, title string) caldav.Calendar {
+	return caldav.Calendar{
+		Path:                  davHomePath + name + "/",
+		Name:                  title,
+		MaxResourceSize:       davMaxObjectSize,
+		SupportedComponentSet: []string{ical.CompToDo},
+	}
+}
+
+// davObject renders tm as a VTODO. The ETag is a digest of the rendering,
+// so it changes whenever anything a client sees does.
+func davObject(tm todoModel) (*caldav.CalendarObject, error) {
+	calendar := davTodosCalendar
+	if !tm.ListID.IsZero() {
+		calendar = tm.ListID.String()
+	}
+	modTime := tm.CreateAt
+	if tm.CompletedAt.After(modTime) {
+		modTime = tm.CompletedAt
+	}
+
+	vtodo := ical.NewComponent(ical.CompToDo)
+	vtodo.Props.SetText(ical.PropUID, tm.ID.String())
+	vtodo.Props.SetDateTime(ical.PropDateTimeStamp, modTime.UTC())
+	vtodo.Props.SetDateTime(ical.PropCreated, tm.CreateAt.UTC())
+	vtodo.Props.SetText(ical.PropSummary, tm.Title)
+	if tm.Completed {
+		vtodo.Props.SetText(ical.PropStatus, "COMPLETED")
+		if !tm.CompletedAt.IsZero() {
+			vtodo.Props.SetDateTime(ical.PropCompleted, tm.CompletedAt.UTC())
+		}
+	} else {
+		vtodo.Props.SetText(ical.PropStatus, "NEEDS-ACTION")
+	}
+	if !tm.DueDate.IsZero() {
+		vtodo.Props.SetDate(ical.PropDue, tm.DueDate)
+	}
+	if len(tm.Tags) > 0 {
+		cats := ical.NewProp(ical.PropCategories)
+		cats.SetTextList(tm.Tags)
+		vtodo.Props.Set(cats)
+	}
+	cal := ical.NewCalendar()
+	cal.Props.SetText(ical.PropVersion, "2.0")
+	cal.Props.SetText(ical.PropProductID, "-//go-todo//CalDAV//EN")
+	cal.Children = append(cal.Children, vtodo)
+
+	var buf bytes.Buffer
+	if err := ical.NewEncoder(&buf).Encode(cal); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	return &caldav.CalendarObject{
+		Path:          davHomePath + calendar + "/" + tm.ID.String() + ".ics",
+		ModTime:       modTime,
+		ContentLength: int64(buf.Len()),
+		ETag:          hex.EncodeToString(sum[:16]),
+		Data:          cal,
+	}, nil
+}
@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// changeStreams makes every instance learn of todo changes by watching the
+// todo collection rather than from its own writes, so clients see changes
+// made through other instances or straight in the database. It requires
+// TODO_STORAGE=mongo or events, and a replica set.
+var changeStreams = envBool("TODO_CHANGE_STREAMS")
+
+// todoChange is the part of a change stream event watchTodos uses.
+type todoChange struct {
+	OperationType string `bson:"operationType"`
+	DocumentKey   struct {
+		ID ID `bson:"_id"`
+	} `bson:"documentKey"`
+	FullDocument             *todoModel `bson:"fullDocument"`
+	FullDocumentBeforeChange *todoModel `bson:"fullDocumentBeforeChange"`
+}
+
+// watchTodos publishes changes to the todo collection until ctx is
+// canceled. A broken stream is reopened after the last event it delivered.
+func watchTodos(ctx context.Context) {
+	// open allows change streams only with todos in Mongo.
+	m, _ := mongoOf(ctx)
+	name := serverFrom(ctx).collection
+	// Pre-images let deletions reach the todo's audience; without them
+	// (before MongoDB 6.0) a deleted todo is known only by its ID.
+	err := m.RunCommand(ctx, bson.D{
+		{Key: "collMod", Value: name},
+		{Key: "changeStreamPreAndPostImages", Value: bson.M{"enabled": true}},
+	}).Err()
+	if err != nil {
+		slog.Warn("todo change stream: pre-images unavailable", "err", err)
+	}
+	var resume bson.Raw
+	retryWithBackoff("todo change stream", 0, func() error {
+		if ctx.Err() != nil {
+			return nil
+		}
+		opts := options.ChangeStream().
+			SetFullDocument(options.UpdateLookup).
+			SetFullDocumentBeforeChange(options.WhenAvailable)
+		if resume != nil {
+			opts.SetResumeAfter(resume)
+		}
+		cs, err := m.Database.Collection(name).Watch(ctx, mongo.Pipeline{}, opts)
+		if err != nil {
+			return err
+		}
+		defer cs.Close(ctx)
+		for {
+			// TryNext rather than Next: the client-wide timeout applies to
+			// each call and would otherwise end a quiet stream.
+			if !cs.TryNext(ctx) {
+				if err := cs.Err(); err != nil {
+					return err
+				}
+				if cs.ID() == 0 {
+					return errors.New("stream closed by the server")
+				}
+				time.Sleep(time.Second)
+				continue
+			}
+			var c todoChange
+			if err := cs.Decode(&c); err != nil {
+				slog.Error("todo change stream", "err", err)
+			} else {
+				applyTodoChange(ctx, c)
+			}
+			resume = cs.ResumeToken()
+		}
+	})
+}
+
+func applyTodoChange(ctx context.Context, c todoChange) {
+	var e event
+	switch c.OperationType {
+	case "insert":
+		e.Type = eventCreated
+	case "update", "replace":
+		e.Type = eventUpdated
+	case "delete":
+		e.Type = eventDeleted
+	default:
+		return
+	}
+	switch {
+	case c.FullDocument != nil:
+		e.Todo = *c.FullDocument
+	case c.FullDocumentBeforeChange != nil:
+		e.Todo = *c.FullDocumentBeforeChange
+	default:
+		e.Todo.ID = c.DocumentKey.ID
+	}
+	if c := serverFrom(ctx).todoCache; c != nil {
+		c.Invalidate(ctx, e.Todo)
+	}
+	if err := unsealTodo(&e.Todo); err != nil {
+		slog.Error("todo change stream", "err", err)
+		return
+	}
+	e.Audience = audience(ctx, e.Todo)
+	serverFrom(ctx).changes.publish(e)
+}
@@ -0,0 +1,203 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// Chat integrations, Slack and Telegram, let users work on their todos from
+// a chat app. A chat account is linked to a todo account through a short
+// code the user asks for here and sends to the bot; the link is kept as an
+// identity of the user, like an OAuth login.
+
+const (
+	chatLinksCollection string = "chat_links"
+	chatLinkTTL                = 10 * time.Minute
+	// chatListLimit is how many todos a chat listing shows.
+	chatListLimit = 20
+)
+
+var errChatNotLinked = errors.New("chat account not linked")
+
+type (
+	// chatLinkModel is a pending link of a chat account to a user,
+	// completed when the chat account sends the code.
+	chatLinkModel struct {
+		ID        ID        `bson:"_id,omitempty"`
+		UserID    ID        `bson:"userId"`
+		Provider  string    `bson:"provider"`
+		Hash      string    `bson:"hash"`
+		ExpiresAt time.Time `bson:"expiresAt"`
+	}
+	// chatReply answers a chat command. Public replies report a change and
+	// may be shown to the whole channel, the rest only to the sender.
+	chatReply struct {
+		Text   string
+		Public bool
+	}
+)
+
+// createChatLink returns a handler giving out a code that links the
+// caller's account to the provider's account that sends it.
+func createChatLink(provider string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b := make([]byte, 5)
+		_, err := rand.Read(b)
+		code := base32.StdEncoding.EncodeToString(b)
+		if err == nil {
+			_, err = db.Collection(chatLinksCollection).InsertOne(r.Context(), &chatLinkModel{
+				ID:        newID(),
+				UserID:    currentUser(r.Context()),
+				Provider:  provider,
+				Hash:      hashAPIToken(code),
+				ExpiresAt: time.Now().Add(chatLinkTTL),
+			})
+		}
+		if err != nil {
+			writeError(w, r, internalError("error creating link code", err))
+			return
+		}
+		render(r).JSON(w, http.StatusCreated, renderer.M{
+			"message":   translate(r.Context(), "send the code to the bot to finish linking"),
+			"code":      code,
+			"expiresIn": int(chatLinkTTL.Seconds()),
+		})
+	}
+}
+
+// unlinkChat returns a handler removing the caller's links to provider.
+func unlinkChat(provider string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := updateOne(r.Context(), db.Collection(usersCollection), bson.M{"_id": currentUser(r.Context())},
+			bson.M{"$pull": bson.M{"identities": bson.M{"provider": provider}}}); err != nil {
+			writeError(w, r, internalError("error unlinking chat account", err))
+			return
+		}
+		render(r).JSON(w, http.StatusOK, renderer.M{
+			"message": translate(r.Context(), "chat account unlinked successfully"),
+		})
+	}
+}
+
+// chatLink links the chat account id to the user who asked for code.
+func chatLink(ctx context.Context, id identity, code string) chatReply {
+	var l chatLinkModel
+	err := db.Collection(chatLinksCollection).FindOneAndDelete(ctx, bson.M{
+		"hash":      hashAPIToken(strings.ToUpper(code)),
+		"provider":  id.Provider,
+		"expiresAt": bson.M{"$gt": time.Now()},
+	}).Decode(&l)
+	if err == mongo.ErrNoDocuments {
+		return chatReply{Text: "That code is invalid or has expired."}
+	}
+	// A chat account is linked to one user at a time.
+	if err == nil {
+		_, err = db.Collection(usersCollection).UpdateMany(ctx, bson.M{"identities": bson.M{"$elemMatch": bson.M{
+			"provider": id.Provider,
+			"subject":  id.Subject,
+		}}}, bson.M{"$pull": bson.M{"identities": id}})
+	}
+	var u userModel
+	if err == nil {
+		err = db.Collection(usersCollection).FindOneAndUpdate(ctx, bson.M{"_id": l.UserID},
+			bson.M{"$addToSet": bson.M{"identities": id}}).Decode(&u)
+	}
+	if err != nil {
+		return chatReply{Text: "Something went wrong: " + err.Error()}
+	}
+	return chatReply{Text: "Linked to " + u.Email + "."}
+}
+
+// chatUser finds the user linked to the chat account id and the principal
+// commands run as.
+func chatUser(ctx context.Context, id identity) (userModel, principal, error) {
+	var u userModel
+	err := db.Collection(usersCollection).FindOne(ctx, bson.M{"identities": bson.M{"$elemMatch": bson.M{
+		"provider": id.Provider,
+		"subject":  id.Subject,
+	}}}).Decode(&u)
+	if err == mongo.ErrNoDocuments || err == nil && u.Disabled {
+		return u, principal{}, errChatNotLinked
+	}
+	if err != nil {
+		return u, principal{}, err
+	}
+	return u, userPrincipal(u), nil
+}
+
+// chatAdd adds a todo titled title to the list, or to none. usage is how
+// the command is written in the chat app.
+func chatAdd(ctx context.Context, p principal, listID ID, title, usage string) chatReply {
+	if p.Role == roleViewer {
+		return chatReply{Text: "You may not add todos."}
+	}
+	if title == "" {
+		return chatReply{Text: "Usage: " + usage + " <title>"}
+	}
+	tm := todoModel{ID: newID(), ListID: listID, Title: title, CreateAt: time.Now()}
+	if err := insertTodo(ctx, p, &tm); err != nil {
+		return chatReply{Text: "Could not add the todo: " + err.Error()}
+	}
+	return chatReply{Text: "Added " + tm.Ref + ": " + tm.Title, Public: true}
+}
+
+// chatList lists the open todos matching f.
+func chatList(ctx context.Context, p principal, f TodoFilter) chatReply {
+	open := false
+	f.Completed = &open
+	todos, total, err := findTodos(ctx, p, f, 0, chatListLimit)
+	if err != nil {
+		return chatReply{Text: "Could not list todos: " + err.Error()}
+	}
+	if total == 0 {
+		return chatReply{Text: "Nothing to do."}
+	}
+	var b strings.Builder
+	for _, tm := range todos {
+		fmt.Fprintf(&b, "• %s %s", tm.Ref, tm.Title)
+		if !tm.DueDate.IsZero() {
+			fmt.Fprintf(&b, ", due %s", formatDueDate(tm.DueDate))
+		}
+		b.WriteString("\n")
+	}
+	if total > len(todos) {
+		fmt.Fprintf(&b, "and %d more", total-len(todos))
+	}
+	return chatReply{Text: b.String()}
+}
+
+// chatDone completes the todo with reference ref.
+func chatDone(ctx context.Context, p principal, ref, usage string) chatReply {
+	if p.Role == roleViewer {
+		return chatReply{Text: "You may not change todos."}
+	}
+	// Only the prefix is case-insensitive; the base58 digits are not.
+	if len(ref) > len(refPrefix) && strings.EqualFold(ref[:len(refPrefix)], refPrefix) {
+		ref = refPrefix + ref[len(refPrefix):]
+	}
+	if !isTodoRef(ref) {
+		return chatReply{Text: "Usage: " + usage + " <ref>, such as " + usage + " T-8f"}
+	}
+	found, _, err := findTodos(ctx, p, TodoFilter{Ref: ref}, 0, 1)
+	if err != nil {
+		return chatReply{Text: "Could not find the todo: " + err.Error()}
+	}
+	if len(found) == 0 {
+		return chatReply{Text: "No todo " + ref + "."}
+	}
+	tm, err := setTodo(ctx, p, found[0].ID, found[0].Title, true)
+	if err != nil {
+		return chatReply{Text: "Could not complete the todo: " + err.Error()}
+	}
+	return chatReply{Text: "Completed " + tm.Ref + ": " + tm.Title, Public: true}
+}
@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/sangin4208/go-todo/internal/storage"
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+const (
+	commentsCollection string = "comments"
+	defaultPageSize           = 20
+	maxPageSize               = 100
+	maxCommentLen             = 4000
+)
+
+type (
+	commentModel struct {
+		ID       ID        `bson:"_id,omitempty"`
+		TodoID   ID        `bson:"todoId"`
+		AuthorID ID        `bson:"authorId"`
+		Body     string    `bson:"body"`
+		CreateAt time.Time `bson:"createAt"`
+	}
+	comment struct {
+		ID       string `json:"id"`
+		AuthorID string `json:"authorId"`
+		Body     string `json:"body"`
+		CreateAt string `json:"createAt"`
+	}
+)
+
+// commentHandlers is mounted under /todo/{id}/comments.
+func commentHandlers() http.Handler {
+	rg := chi.NewRouter()
+	rg.Group(func(r chi.Router) {
+		r.Get("/", fetchComments)
+		r.Group(func(r chi.Router) {
+			r.Use(requireRole(roleAdmin, roleMember))
+			r.Post("/", createComment)
+			r.Delete("/{commentId}", deleteComment)
+		})
+	})
+	return rg
+}
+
+func fetchComments(w http.ResponseWriter, r *http.Request) {
+	tm, ok := readableTodo(w, r)
+	if !ok {
+		return
+	}
+	skip, limit := pagination(r)
+	var comments []commentModel
+	total, err := storage.FindPage(r.Context(), db.Collection(commentsCollection), bson.M{"todoId": tm.ID}, "createAt", skip, limit, &comments)
+	if err != nil {
+		writeError(w, r, internalError("error fetching comments", err))
+		return
+	}
+	data := []comment{}
+	for _, c := range comments {
+		data = append(data, toComment(r.Context(), c))
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"data":   data,
+		"total":  total,
+		"offset": skip,
+		"limit":  limit,
+	})
+}
+
+func createComment(w http.ResponseWriter, r *http.Request) {
+	tm, ok := readableTodo(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Body string `json:"body" validate:"notblank,max=4000"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	req.Body = strings.TrimSpace(req.Body)
+	c := commentModel{
+		ID:       newID(),
+		TodoID:   tm.ID,
+		AuthorID: currentUser(r.Context()),
+		Body:     req.Body,
+		CreateAt: time.Now(),
+	}
+	if _, err := db.Collection(commentsCollection).InsertOne(r.Context(), &c); err != nil {
+		writeError(w, r, internalError("error creating comment", err))
+		return
+	}
+	render(r).JSON(w, http.StatusCreated, renderer.M{
+		"message":    translate(r.Context(), "comment created successfully"),
+		"comment_id": c.ID.String(),
+	})
+}
+
+// deleteComment lets authors remove their own comments and todo owners
+// moderate anything on their todos.
+func deleteComment(w http.ResponseWriter, r *http.Request) {
+	tm, ok := readableTodo(w, r)
+	if !ok {
+		return
+	}
+	id := strings.TrimSpace(chi.URLParam(r, "commentId"))
+	if !validID(id) {
+		writeError(w, r, apiErr(http.StatusBadRequest, "The comment id is invalid"))
+		return
+	}
+	user := currentUser(r.Context())
+	filter := bson.M{"_id": toID(id), "todoId": tm.ID}
+	if tm.UserID != user {
+		filter["authorId"] = user
+	}
+	err := deleteOne(r.Context(), db.Collection(commentsCollection), filter)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, r, apiErr(http.StatusNotFound, "comment not found"))
+		return
+	}
+	if err != nil {
+		writeError(w, r, internalError("error deleting comment", err))
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"message": translate(r.Context(), "comment deleted successfully"),
+	})
+}
+
+// readableTodo loads the {id} todo if the caller can read it, writing an
+// error response otherwise.
+func readableTodo(w http.ResponseWriter, r *http.Request) (todoModel, bool) {
+	id, ok := todoIDParam(w, r)
+	if !ok {
+		return todoModel{}, false
+	}
+	tm, err := getTodo(r.Context(), currentPrincipal(r.Context()), id)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, r, apiErr(http.StatusNotFound, "todo not found"))
+		return tm, false
+	}
+	if err != nil {
+		writeError(w, r, internalError("error fetching todo", err))
+		return tm, false
+	}
+	return tm, true
+}
+
+// pagination reads ?offset= and ?limit= with sane defaults and bounds.
+func pagination(r *http.Request) (skip, limit int) {
+	skip, _ = strconv.Atoi(r.URL.Query().Get("offset"))
+	limit, _ = strconv.Atoi(r.URL.Query().Get("limit"))
+	if skip < 0 {
+		skip = 0
+	}
+	if limit <= 0 {
+		limit = defaultPageSize
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+	return skip, limit
+}
+
+func toComment(ctx context.Context, c commentModel) comment {
+	return comment{
+		ID:       c.ID.String(),
+		AuthorID: c.AuthorID.String(),
+		Body:     c.Body,
+		CreateAt: formatTime(ctx, c.CreateAt),
+	}
+}
@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Responses are gzipped, or deflated for clients only taking that, when
+// they are at least TODO_COMPRESS_MIN_BYTES long (1024) and of one of the
+// TODO_COMPRESS_TYPES, so that large todo lists and exports travel small
+// over slow links while tiny responses and already compressed files are
+// left alone. TODO_COMPRESS_LEVEL trades CPU for size, from 1 to 9 (5); 0
+// turns compression off.
+
+var compressConf = struct {
+	Level    int
+	MinBytes int
+	Types    []string
+}{
+	Level:    envInt("TODO_COMPRESS_LEVEL", 5),
+	MinBytes: envInt("TODO_COMPRESS_MIN_BYTES", 1024),
+	Types: splitSetting(envString("TODO_COMPRESS_TYPES", "application/json, application/graphql-response+json, "+
+		"application/xml, text/xml, text/html, text/css, text/plain, text/csv, text/calendar, "+
+		"application/javascript, image/svg+xml")),
+}
+
+var (
+	gzipWriters  sync.Pool
+	flateWriters sync.Pool
+)
+
+func compressResponses(next http.Handler) http.Handler {
+	if compressConf.Level == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := acceptedEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// acceptedEncoding picks gzip or deflate from an Accept-Encoding header,
+// preferring gzip, or returns "" if the client takes neither.
+func acceptedEncoding(header string) string {
+	q := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		weight := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				weight = f
+			}
+		}
+		q[strings.ToLower(strings.TrimSpace(name))] = weight
+	}
+	for _, enc := range []string{"gzip", "deflate"} {
+		weight, ok := q[enc]
+		if !ok {
+			weight, ok = q["*"]
+		}
+		if ok && weight > 0 {
+			return enc
+		}
+	}
+	return ""
+}
+
+// compressWriter holds back the start of a compressible response until it
+// knows whether it reaches the size worth compressing.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	status   int
+	// held is the body so far while undecided.
+	held []byte
+	// passThrough is set once the response is known to go uncompressed.
+	passThrough bool
+	enc         io.WriteCloser
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.status != 0 || w.passThrough {
+		return
+	}
+	if status < 200 {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if !w.compressible(status) {
+		w.passThrough = true
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	w.status = status
+}
+
+func (w *compressWriter) compressible(status int) bool {
+	if status == http.StatusNoContent || status == http.StatusNotModified || status == http.StatusPartialContent {
+		return false
+	}
+	h := w.Header()
+	if h.Get("Content-Encoding") != "" {
+		return false
+	}
+	if n, err := strconv.Atoi(h.Get("Content-Length")); err == nil && n < compressConf.MinBytes {
+		return false
+	}
+	t, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	return err == nil && slices.Contains(compressConf.Types, t)
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if w.status == 0 && !w.passThrough {
+		w.WriteHeader(http.StatusOK)
+	}
+	switch {
+	case w.passThrough:
+		return w.ResponseWriter.Write(p)
+	case w.enc != nil:
+		return w.enc.Write(p)
+	}
+	w.held = append(w.held, p...)
+	if len(w.held) >= compressConf.MinBytes {
+		if err := w.startCompressing(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *compressWriter) startCompressing() error {
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", w.encoding)
+	w.ResponseWriter.WriteHeader(w.status)
+	if w.encoding == "gzip" {
+		gw, _ := gzipWriters.Get().(*gzip.Writer)
+		if gw == nil {
+			gw, _ = gzip.NewWriterLevel(w.ResponseWriter, compressConf.Level)
+		} else {
+			gw.Reset(w.ResponseWriter)
+		}
+		w.enc = gw
+	} else {
+		fw, _ := flateWriters.Get().(*flate.Writer)
+		if fw == nil {
+			fw, _ = flate.NewWriter(w.ResponseWriter, compressConf.Level)
+		} else {
+			fw.Reset(w.ResponseWriter)
+		}
+		w.enc = fw
+	}
+	_, err := w.enc.Write(w.held)
+	w.held = nil
+	return err
+}
+
+// close finishes the response, sending a held one too small to compress
+// as it is.
+func (w *compressWriter) close() {
+	switch {
+	case w.enc != nil:
+		w.enc.Close()
+		switch enc := w.enc.(type) {
+		case *gzip.Writer:
+			gzipWriters.Put(enc)
+		case *flate.Writer:
+			flateWriters.Put(enc)
+		}
+	case w.status != 0 && !w.passThrough:
+		w.ResponseWriter.WriteHeader(w.status)
+		w.ResponseWriter.Write(w.held)
+	}
+}
+
+// Flush sends what is held compressed, a flushing handler being one whose
+// response is still coming.
+func (w *compressWriter) Flush() {
+	if w.status == 0 && !w.passThrough {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.passThrough && w.enc == nil {
+		if w.startCompressing() != nil {
+			return
+		}
+	}
+	if f, ok := w.enc.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
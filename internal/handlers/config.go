@@ -0,0 +1,401 @@
+package handlers
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// serverConf configures the listeners. HTTP is served on TODO_ADDR
+// (":8080") and gRPC on TODO_GRPC_ADDR (":9090"), with the HTTP timeouts
+// TODO_READ_TIMEOUT_SECONDS, TODO_WRITE_TIMEOUT_SECONDS and
+// TODO_IDLE_TIMEOUT_SECONDS (60 each). On shutdown requests get
+// TODO_SHUTDOWN_TIMEOUT_SECONDS (5) to finish. See tls.go for HTTPS.
+var serverConf = struct {
+	Addr, GRPCAddr                                          string
+	TLSCert, TLSKey, RedirectAddr                           string
+	ACMEDomains, ACMEEmail, ACMEDirectory, ACMECacheDir     string
+	H2C                                                     bool
+	HTTP2MaxStreams                                         int
+	ReadTimeout, WriteTimeout, IdleTimeout, ShutdownTimeout time.Duration
+}{
+	Addr:            envString("TODO_ADDR", ":8080"),
+	GRPCAddr:        envString("TODO_GRPC_ADDR", ":9090"),
+	TLSCert:         envString("TODO_TLS_CERT", ""),
+	TLSKey:          envString("TODO_TLS_KEY", ""),
+	RedirectAddr:    envString("TODO_HTTP_REDIRECT_ADDR", ""),
+	ACMEDomains:     envString("TODO_ACME_DOMAINS", ""),
+	ACMEEmail:       envString("TODO_ACME_EMAIL", ""),
+	ACMEDirectory:   envString("TODO_ACME_DIRECTORY", ""),
+	ACMECacheDir:    envString("TODO_ACME_CACHE_DIR", "acme"),
+	H2C:             envBool("TODO_H2C"),
+	HTTP2MaxStreams: envInt("TODO_HTTP2_MAX_STREAMS", 250),
+	ReadTimeout:     time.Duration(envInt("TODO_READ_TIMEOUT_SECONDS", 60)) * time.Second,
+	WriteTimeout:    time.Duration(envInt("TODO_WRITE_TIMEOUT_SECONDS", 60)) * time.Second,
+	IdleTimeout:     time.Duration(envInt("TODO_IDLE_TIMEOUT_SECONDS", 60)) * time.Second,
+	ShutdownTimeout: time.Duration(envInt("TODO_SHUTDOWN_TIMEOUT_SECONDS", 5)) * time.Second,
+}
+
+// configErrors collects settings from the environment or the configuration
+// file that could not be read, reported by loadConfig.
+var configErrors []error
+
+// A setting is one TODO_* value as the server sees it, and where it came
+// from: "default", "env", "file", "flag" or "config", for a Config given
+// to New.
+type setting struct {
+	Value, Source string
+}
+
+// settings records every setting read, for the startup dump.
+var settings = map[string]setting{}
+
+// configFile is the configuration file named by --config or TODO_CONFIG.
+var configFile = configPath()
+
+// fileSettings holds the values from configFile. It is read while the
+// package variables are initialized, before any setting, since those are
+// read into variables too.
+var fileSettings = readConfigFile(configFile)
+
+// lookupSetting finds the named setting in the environment, which overrides
+// the configuration file, and records it.
+func lookupSetting(name string) (string, bool) {
+	if v, ok := os.LookupEnv(name); ok && v != "" {
+		settings[name] = setting{v, "env"}
+		return v, true
+	}
+	if v, ok := fileSettings[name]; ok {
+		settings[name] = setting{v, "file"}
+		return v, true
+	}
+	return "", false
+}
+
+func envString(name, def string) string {
+	if v, ok := lookupSetting(name); ok {
+		return v
+	}
+	settings[name] = setting{def, "default"}
+	return def
+}
+
+// envInt reads an integer setting, recording a configErrors entry if it is
+// set to anything else.
+func envInt(name string, def int) int {
+	s, ok := lookupSetting(name)
+	if !ok {
+		settings[name] = setting{strconv.Itoa(def), "default"}
+		return def
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		configErrors = append(configErrors, fmt.Errorf("%s: %q is not a number", name, s))
+		return def
+	}
+	return v
+}
+
+// envBool reads a setting that is on only when set to "true".
+func envBool(name string) bool {
+	return envString(name, "false") == "true"
+}
+
+// splitSetting splits a comma-separated setting, dropping blanks.
+func splitSetting(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// configPath finds the configuration file in the command line ahead of
+// flag parsing, which happens too late for it.
+func configPath() string {
+	args := os.Args[1:]
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || name != "config" {
+			continue
+		}
+		if hasValue {
+			return value
+		}
+		if i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return os.Getenv("TODO_CONFIG")
+}
+
+// readConfigFile reads a YAML (.yaml, .yml) or TOML (.toml) configuration
+// file into settings. Its top level groups settings into sections, such as
+// server, storage, auth and notifications, that are not part of the names;
+// nested keys are joined with underscores and upper cased, so
+//
+//	storage:
+//	  mongo:
+//	    uri: mongodb://db:27017
+//
+// sets TODO_MONGO_URI.
+func readConfigFile(path string) map[string]string {
+	if path == "" {
+		return nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		configErrors = append(configErrors, fmt.Errorf("config file: %w", err))
+		return nil
+	}
+	var doc map[string]interface{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &doc)
+	case ".toml":
+		err = toml.Unmarshal(b, &doc)
+	default:
+		err = fmt.Errorf("%q files are not supported, use .yaml or .toml", ext)
+	}
+	if err != nil {
+		configErrors = append(configErrors, fmt.Errorf("config file %s: %w", path, err))
+		return nil
+	}
+	values := map[string]string{}
+	for section, v := range doc {
+		if m, ok := v.(map[string]interface{}); ok {
+			flattenSettings(values, "TODO", m)
+		} else {
+			flattenSettings(values, "TODO", map[string]interface{}{section: v})
+		}
+	}
+	return values
+}
+
+func flattenSettings(values map[string]string, prefix string, m map[string]interface{}) {
+	for k, v := range m {
+		name := prefix + "_" + strings.ToUpper(strings.ReplaceAll(k, "-", "_"))
+		switch v := v.(type) {
+		case map[string]interface{}:
+			flattenSettings(values, name, v)
+		case []interface{}, nil:
+			configErrors = append(configErrors, fmt.Errorf("config file: %s must be a single value", name))
+		default:
+			values[name] = fmt.Sprint(v)
+		}
+	}
+}
+
+// secretSettings marks the settings whose values are left out of the
+// startup dump.
+var secretSettings = []string{"SECRET", "PASSWORD", "TOKEN", "PRIVATE_KEY", "SIGNING_KEY"}
+
+// logConfig logs the effective configuration, with secrets and the
+// passwords in connection strings redacted. Settings left empty are
+// skipped.
+func logConfig() {
+	names := make([]string, 0, len(settings))
+	for name, s := range settings {
+		if s.Value != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s := settings[name]
+		slog.Info("config", "name", name, "value", redactSetting(name, s.Value), "source", s.Source)
+	}
+}
+
+func redactSetting(name, value string) string {
+	for _, secret := range secretSettings {
+		if strings.Contains(name, secret) {
+			return "[redacted]"
+		}
+	}
+	if u, err := url.Parse(value); err == nil && u.User != nil {
+		return u.Redacted()
+	}
+	return value
+}
+
+// loadConfig applies the command line flags over the settings read from
+// the environment and the configuration file and checks the result,
+// exiting if anything is wrong. It must run before the settings are used,
+// so first thing in Run. Flags take precedence over environment
+// variables, which take precedence over the configuration file and then
+// the defaults.
+func loadConfig() {
+	flags := []struct {
+		name, setting, usage string
+		value                *string
+	}{
+		{"addr", "TODO_ADDR", "HTTP listen address", &serverConf.Addr},
+		{"grpc-addr", "TODO_GRPC_ADDR", "gRPC listen address", &serverConf.GRPCAddr},
+		{"tls-cert", "TODO_TLS_CERT", "TLS certificate file, to serve HTTPS", &serverConf.TLSCert},
+		{"tls-key", "TODO_TLS_KEY", "TLS private key file", &serverConf.TLSKey},
+		{"acme-domains", "TODO_ACME_DOMAINS", "host names to get Let's Encrypt certificates for", &serverConf.ACMEDomains},
+		{"http-redirect-addr", "TODO_HTTP_REDIRECT_ADDR", "address redirecting plain HTTP to HTTPS", &serverConf.RedirectAddr},
+		{"mongo-uri", "TODO_MONGO_URI", "MongoDB connection string", &mongoConf.URI},
+		{"mongo-db", "TODO_MONGO_DB", "MongoDB database", &mongoConf.Database},
+		{"mongo-collection", "TODO_MONGO_COLLECTION", "MongoDB collection holding todos", &collectionName},
+		{"public-url", "TODO_PUBLIC_URL", "URL the server is reached at, for links in emails", &publicURL},
+		{"maintenance", "TODO_MAINTENANCE", "maintenance mode: off, read-only or full", &maintenanceConf.Mode},
+	}
+	for _, f := range flags {
+		flag.StringVar(f.value, f.name, *f.value, f.usage+" ("+f.setting+")")
+	}
+	seedFlags()
+	flag.BoolVar(&replayFlag, "replay", false, "rebuild todos from the event log (TODO_STORAGE=events), then exit")
+	flag.String("config", "", "YAML or TOML configuration file, overridden by the environment (TODO_CONFIG)")
+	flag.Parse()
+	for _, f := range flags {
+		if flagSet(f.name) {
+			settings[f.setting] = setting{*f.value, "flag"}
+		}
+	}
+	if err := configure(); err != nil {
+		fatal("invalid configuration", "err", err)
+	}
+}
+
+// configure completes the settings once everything overriding them has
+// been applied, and checks them.
+func configure() error {
+	if settings["TODO_PUBLIC_URL"].Source == "default" {
+		scheme, host, defaultPort := "http", "localhost", "80"
+		if tlsEnabled() {
+			scheme, defaultPort = "https", "443"
+		}
+		if domains := acmeDomains(); len(domains) > 0 {
+			host = domains[0]
+		}
+		// Sockets have no port; the proxy in front serves the default.
+		if _, port, err := net.SplitHostPort(serverConf.Addr); err == nil && isTCPAddr(serverConf.Addr) && port != defaultPort {
+			host = net.JoinHostPort(host, port)
+		}
+		publicURL = scheme + "://" + host
+		settings["TODO_PUBLIC_URL"] = setting{publicURL, "default"}
+	}
+	publicURL = strings.TrimRight(publicURL, "/")
+	registerOAuthProviders()
+	registerTaskServices()
+	readLiveSettings().store()
+	return validateConfig()
+}
+
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		set = set || f.Name == name
+	})
+	return set
+}
+
+func validateConfig() error {
+	errs := append([]error(nil), configErrors...)
+	errs = append(errs, liveConf().validate()...)
+	if debugConf.Enabled && debugConf.Token == "" {
+		errs = append(errs, errors.New("TODO_DEBUG requires TODO_DEBUG_TOKEN"))
+	}
+	if corsConf.Credentials && slices.Contains(splitSetting(corsConf.Origins), "*") {
+		errs = append(errs, errors.New("TODO_CORS_CREDENTIALS cannot be used with TODO_CORS_ORIGINS=*"))
+	}
+	if loadConf.MaxQueued < 0 || loadConf.QueueTimeout < 0 {
+		errs = append(errs, errors.New("TODO_MAX_QUEUED and TODO_QUEUE_TIMEOUT_MS must not be negative"))
+	}
+	switch {
+	case rateLimitStore != "memory" && rateLimitStore != "redis":
+		errs = append(errs, fmt.Errorf("TODO_RATE_LIMIT_STORE must be memory or redis, not %q", rateLimitStore))
+	case rateLimitStore == "redis" && cacheConf.URL == "":
+		errs = append(errs, errors.New("TODO_RATE_LIMIT_STORE=redis requires TODO_REDIS_URL"))
+	}
+	if accessLogConf.Format != "combined" && accessLogConf.Format != "json" {
+		errs = append(errs, fmt.Errorf("TODO_ACCESS_LOG_FORMAT must be combined or json, not %q", accessLogConf.Format))
+	}
+	if accessLogConf.MaxSizeMB <= 0 {
+		errs = append(errs, errors.New("TODO_ACCESS_LOG_MAX_SIZE_MB must be positive"))
+	}
+	if accessLogConf.MaxAge < 0 || accessLogConf.MaxFiles < 0 {
+		errs = append(errs, errors.New("TODO_ACCESS_LOG_MAX_AGE_DAYS and TODO_ACCESS_LOG_MAX_FILES must not be negative"))
+	}
+	if responseCacheConf.TTL > 0 && responseCacheConf.MaxEntries <= 0 {
+		errs = append(errs, errors.New("TODO_RESPONSE_CACHE_MAX_ENTRIES must be positive"))
+	}
+	if compressConf.Level < 0 || compressConf.Level > 9 {
+		errs = append(errs, fmt.Errorf("TODO_COMPRESS_LEVEL must be between 0 and 9, not %d", compressConf.Level))
+	}
+	if logFormat != "json" && logFormat != "text" {
+		errs = append(errs, fmt.Errorf("TODO_LOG_FORMAT must be json or text, not %q", logFormat))
+	}
+	for name, addr := range map[string]string{"TODO_ADDR": serverConf.Addr, "TODO_GRPC_ADDR": serverConf.GRPCAddr} {
+		if err := checkListenAddr(addr); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %q is not a listen address such as :8080, unix:/run/todo.sock or systemd", name, addr))
+		}
+	}
+	if _, err := strconv.ParseUint(socketMode, 8, 32); err != nil {
+		errs = append(errs, fmt.Errorf("TODO_SOCKET_MODE: %q is not an octal mode such as 0660", socketMode))
+	}
+	if serverConf.ACMEDomains != "" && serverConf.TLSCert != "" {
+		errs = append(errs, errors.New("TODO_ACME_DOMAINS and TODO_TLS_CERT cannot both be set"))
+	} else if serverConf.ACMEDomains != "" {
+		for _, d := range acmeDomains() {
+			if strings.ContainsAny(d, ":/ ") || !strings.Contains(d, ".") {
+				errs = append(errs, fmt.Errorf("TODO_ACME_DOMAINS: %q is not a host name", d))
+			}
+		}
+	} else if (serverConf.TLSCert == "") != (serverConf.TLSKey == "") {
+		errs = append(errs, errors.New("TODO_TLS_CERT and TODO_TLS_KEY must be set together"))
+	} else if tlsEnabled() {
+		if _, err := tls.LoadX509KeyPair(serverConf.TLSCert, serverConf.TLSKey); err != nil {
+			errs = append(errs, fmt.Errorf("TODO_TLS_CERT, TODO_TLS_KEY: %w", err))
+		}
+	}
+	if serverConf.H2C && tlsEnabled() {
+		errs = append(errs, errors.New("TODO_H2C is for plain listeners; over TLS HTTP/2 is negotiated"))
+	}
+	if serverConf.HTTP2MaxStreams <= 0 {
+		errs = append(errs, errors.New("TODO_HTTP2_MAX_STREAMS must be positive"))
+	}
+	if serverConf.RedirectAddr != "" {
+		if !tlsEnabled() {
+			errs = append(errs, errors.New("TODO_HTTP_REDIRECT_ADDR needs TLS, with TODO_TLS_CERT and TODO_TLS_KEY or TODO_ACME_DOMAINS"))
+		} else if _, _, err := net.SplitHostPort(serverConf.RedirectAddr); err != nil {
+			errs = append(errs, fmt.Errorf("TODO_HTTP_REDIRECT_ADDR: %q is not a listen address such as :80", serverConf.RedirectAddr))
+		}
+	}
+	for name, d := range map[string]time.Duration{
+		"TODO_READ_TIMEOUT_SECONDS":     serverConf.ReadTimeout,
+		"TODO_WRITE_TIMEOUT_SECONDS":    serverConf.WriteTimeout,
+		"TODO_IDLE_TIMEOUT_SECONDS":     serverConf.IdleTimeout,
+		"TODO_SHUTDOWN_TIMEOUT_SECONDS": serverConf.ShutdownTimeout,
+		"TODO_MONGO_TIMEOUT_SECONDS":    mongoConf.Timeout,
+	} {
+		if d <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be positive", name))
+		}
+	}
+	if idFormat != "objectid" && idFormat != "uuid" {
+		errs = append(errs, fmt.Errorf("TODO_ID_FORMAT must be objectid or uuid, not %q", idFormat))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/go-chi/cors"
+)
+
+// Browser apps served from other origins may call the API once their
+// origins are listed in TODO_CORS_ORIGINS, comma separated, such as
+// https://app.example.com,https://*.example.net, or * for any. Without it
+// no CORS headers are sent and browsers keep such apps out.
+// TODO_CORS_METHODS and TODO_CORS_HEADERS list what the apps may send,
+// TODO_CORS_CREDENTIALS=true lets them send cookies, which needs explicit
+// origins, and TODO_CORS_MAX_AGE_SECONDS (600) is how long browsers may
+// cache a preflight's answer.
+
+var corsConf = struct {
+	Origins, Methods, Headers string
+	Credentials               bool
+	MaxAge                    int
+}{
+	Origins:     envString("TODO_CORS_ORIGINS", ""),
+	Methods:     envString("TODO_CORS_METHODS", "GET,POST,PUT,PATCH,DELETE"),
+	Headers:     envString("TODO_CORS_HEADERS", "Authorization,Content-Type,X-API-Key,X-OTP,X-Workspace,X-Request-ID"),
+	Credentials: envBool("TODO_CORS_CREDENTIALS"),
+	MaxAge:      envInt("TODO_CORS_MAX_AGE_SECONDS", 600),
+}
+
+// corsHandler answers preflight requests itself, ahead of authentication
+// and rate limits, and adds the CORS headers to responses for allowed
+// origins. It is nil unless TODO_CORS_ORIGINS is set.
+func corsHandler() func(http.Handler) http.Handler {
+	origins := splitSetting(corsConf.Origins)
+	if len(origins) == 0 {
+		return nil
+	}
+	return cors.Handler(cors.Options{
+		AllowedOrigins:   origins,
+		AllowedMethods:   splitSetting(corsConf.Methods),
+		AllowedHeaders:   splitSetting(corsConf.Headers),
+		ExposedHeaders:   []string{"Content-Disposition", "Retry-After", "WWW-Authenticate", requestIDHeader},
+		AllowCredentials: corsConf.Credentials,
+		MaxAge:           corsConf.MaxAge,
+	})
+}
@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/sangin4208/go-todo/internal/docstore"
+	"github.com/sangin4208/go-todo/internal/storage"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// database holds users, lists and every other collection. It is Mongo
+// unless todos are kept in SQLite, Bolt or memory, in which case the rest
+// is kept alongside them in a docstore, so that those backends need no
+// database server at all.
+type database interface {
+	Collection(name string) collection
+	ListCollectionNames(ctx context.Context, filter any, opts ...options.Lister[options.ListCollectionsOptions]) ([]string, error)
+	Ping(ctx context.Context) error
+	Close(ctx context.Context) error
+}
+
+// collection is the part of *mongo.Collection the handlers use, which
+// *docstore.Collection implements too.
+type collection = storage.Collection
+
+// mongoDatabase is a database on a Mongo server.
+type mongoDatabase struct {
+	*mongo.Database
+}
+
+func (d mongoDatabase) Collection(name string) collection {
+	return d.Database.Collection(name)
+}
+
+func (d mongoDatabase) Ping(ctx context.Context) error {
+	return d.Client().Ping(ctx, nil)
+}
+
+func (d mongoDatabase) Close(ctx context.Context) error {
+	return d.Client().Disconnect(ctx)
+}
+
+// embeddedDatabase is a database kept by the process itself.
+type embeddedDatabase struct {
+	*docstore.Store
+}
+
+func (d embeddedDatabase) Collection(name string) collection {
+	return d.Store.Collection(name)
+}
+
+func (d embeddedDatabase) Close(context.Context) error {
+	return d.Store.Close()
+}
+
+// openDatabase connects to Mongo or, when todos are kept in SQLite or
+// Bolt, opens the embedded database in the same file. With todos in memory the rest
+// is kept in memory as well, and lost on exit just the same.
+func (s *Server) openDatabase(ctx context.Context) (database, error) {
+	var backend docstore.Backend
+	switch s.storage {
+	case "sqlite":
+		conn, err := storage.OpenSQLite(ctx, sqlitePath)
+		if err != nil {
+			return nil, err
+		}
+		s.sqliteFile, backend = conn, sqliteDocumentStore{db: conn}
+	case "bolt":
+		b, err := storage.OpenBolt(boltPath, boltDocuments)
+		if err != nil {
+			return nil, err
+		}
+		s.boltFile, backend = b, boltDocumentStore{db: b}
+	case "memory":
+		// No backend: the store lives and dies with the Server.
+	default:
+		return connectMongo(s.mongoURI, s.mongoDatabase)
+	}
+	store, err := docstore.Open(backend)
+	if err != nil {
+		backend.Close()
+		return nil, err
+	}
+	return embeddedDatabase{store}, nil
+}
+
+// db is the database of the Server each call's context belongs to.
+var db database = serverDatabase{}
+
+// serverDatabase is db, finding the database to use in the context.
+type serverDatabase struct{}
+
+func (serverDatabase) Collection(name string) collection {
+	return serverCollection(name)
+}
+
+func (serverDatabase) ListCollectionNames(ctx context.Context, filter any, opts ...options.Lister[options.ListCollectionsOptions]) ([]string, error) {
+	return serverFrom(ctx).db.ListCollectionNames(ctx, filter, opts...)
+}
+
+func (serverDatabase) Ping(ctx context.Context) error {
+	return serverFrom(ctx).db.Ping(ctx)
+}
+
+func (serverDatabase) Close(ctx context.Context) error {
+	return serverFrom(ctx).db.Close(ctx)
+}
+
+// serverCollection is the named collection in the database of the Server
+// each call's context belongs to.
+type serverCollection string
+
+func (c serverCollection) in(ctx context.Context) collection {
+	return serverFrom(ctx).db.Collection(string(c))
+}
+
+func (c serverCollection) Name() string {
+	return string(c)
+}
+
+func (c serverCollection) Find(ctx context.Context, filter any, opts ...options.Lister[options.FindOptions]) (*mongo.Cursor, error) {
+	return c.in(ctx).Find(ctx, filter, opts...)
+}
+
+func (c serverCollection) FindOne(ctx context.Context, filter any, opts ...options.Lister[options.FindOneOptions]) *mongo.SingleResult {
+	return c.in(ctx).FindOne(ctx, filter, opts...)
+}
+
+func (c serverCollection) CountDocuments(ctx context.Context, filter any, opts ...options.Lister[options.CountOptions]) (int64, error) {
+	return c.in(ctx).CountDocuments(ctx, filter, opts...)
+}
+
+func (c serverCollection) Aggregate(ctx context.Context, pipeline any, opts ...options.Lister[options.AggregateOptions]) (*mongo.Cursor, error) {
+	return c.in(ctx).Aggregate(ctx, pipeline, opts...)
+}
+
+func (c serverCollection) InsertOne(ctx context.Context, document any, opts ...options.Lister[options.InsertOneOptions]) (*mongo.InsertOneResult, error) {
+	return c.in(ctx).InsertOne(ctx, document, opts...)
+}
+
+func (c serverCollection) InsertMany(ctx context.Context, documents any, opts ...options.Lister[options.InsertManyOptions]) (*mongo.InsertManyResult, error) {
+	return c.in(ctx).InsertMany(ctx, documents, opts...)
+}
+
+func (c serverCollection) DeleteOne(ctx context.Context, filter any, opts ...options.Lister[options.DeleteOneOptions]) (*mongo.DeleteResult, error) {
+	return c.in(ctx).DeleteOne(ctx, filter, opts...)
+}
+
+func (c serverCollection) DeleteMany(ctx context.Context, filter any, opts ...options.Lister[options.DeleteManyOptions]) (*mongo.DeleteResult, error) {
+	return c.in(ctx).DeleteMany(ctx, filter, opts...)
+}
+
+func (c serverCollection) UpdateOne(ctx context.Context, filter, update any, opts ...options.Lister[options.UpdateOneOptions]) (*mongo.UpdateResult, error) {
+	return c.in(ctx).UpdateOne(ctx, filter, update, opts...)
+}
+
+func (c serverCollection) UpdateMany(ctx context.Context, filter, update any, opts ...options.Lister[options.UpdateManyOptions]) (*mongo.UpdateResult, error) {
+	return c.in(ctx).UpdateMany(ctx, filter, update, opts...)
+}
+
+func (c serverCollection) ReplaceOne(ctx context.Context, filter, replacement any, opts ...options.Lister[options.ReplaceOptions]) (*mongo.UpdateResult, error) {
+	return c.in(ctx).ReplaceOne(ctx, filter, replacement, opts...)
+}
+
+func (c serverCollection) FindOneAndDelete(ctx context.Context, filter any, opts ...options.Lister[options.FindOneAndDeleteOptions]) *mongo.SingleResult {
+	return c.in(ctx).FindOneAndDelete(ctx, filter, opts...)
+}
+
+func (c serverCollection) FindOneAndUpdate(ctx context.Context, filter, update any, opts ...options.Lister[options.FindOneAndUpdateOptions]) *mongo.SingleResult {
+	return c.in(ctx).FindOneAndUpdate(ctx, filter, update, opts...)
+}
+
+// todoCollection is the collection todos are kept in by the mongo and
+// events backends.
+func todoCollection(ctx context.Context) collection {
+	s := serverFrom(ctx)
+	return s.db.Collection(s.collection)
+}
+
+// mongoOf returns the Mongo database of the Server ctx belongs to, if it
+// has one.
+func mongoOf(ctx context.Context) (mongoDatabase, bool) {
+	m, ok := serverFrom(ctx).db.(mongoDatabase)
+	return m, ok
+}
+
+// createIndexes creates indexes on c, whichever database it is in.
+func createIndexes(ctx context.Context, c collection, models ...mongo.IndexModel) ([]string, error) {
+	switch c := c.(type) {
+	case serverCollection:
+		return createIndexes(ctx, c.in(ctx), models...)
+	case *mongo.Collection:
+		return c.Indexes().CreateMany(ctx, models)
+	case *docstore.Collection:
+		return c.CreateIndexes(ctx, models)
+	}
+	return nil, fmt.Errorf("cannot create indexes on a %T", c)
+}
+
+func ensureTodoIndexes(ctx context.Context) error {
+	indexes := storage.TodoIndexes
+	if serverFrom(ctx).storage == "mongo" {
+		indexes = append(indexes, storage.TodoTTLIndex)
+	}
+	names, err := createIndexes(ctx, todoCollection(ctx), indexes...)
+	if err == nil {
+		slog.Info("todo indexes ready", "indexes", names)
+	}
+	return err
+}
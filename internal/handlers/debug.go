@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// With TODO_DEBUG=true, /debug serves the Go runtime's profiles under
+// /debug/pprof and its variables under /debug/vars, for capturing CPU,
+// heap and goroutine profiles from a running server, e.g.
+//
+//	go tool pprof -http=: -H "Authorization: Bearer $TOKEN" https://todo.example.com/debug/pprof/profile?seconds=30
+//
+// Profiles reveal a good deal about the server, so TODO_DEBUG_TOKEN must
+// be set and given as a bearer token.
+
+var debugConf = struct {
+	Enabled bool
+	Token   string
+}{
+	Enabled: envBool("TODO_DEBUG"),
+	Token:   envString("TODO_DEBUG_TOKEN", ""),
+}
+
+func debugHandlers() http.Handler {
+	r := chi.NewRouter()
+	r.Use(requireBearer("debug", debugConf.Token))
+	r.Use(noWriteDeadline)
+	r.HandleFunc("/pprof/*", pprof.Index)
+	r.HandleFunc("/pprof/cmdline", pprof.Cmdline)
+	r.HandleFunc("/pprof/profile", pprof.Profile)
+	r.HandleFunc("/pprof/symbol", pprof.Symbol)
+	r.HandleFunc("/pprof/trace", pprof.Trace)
+	r.Handle("/vars", expvar.Handler())
+	return r
+}
+
+// noWriteDeadline lifts the server's write timeout, which CPU profiles and
+// execution traces taking longer than it would otherwise run into.
+func noWriteDeadline(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NewResponseController(w).SetWriteDeadline(time.Time{})
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,380 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sangin4208/go-todo/internal/storage"
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// Delta sync lets offline clients catch up without downloading everything.
+// GET /sync returns every todo along with a token; GET /sync?since=<token>
+// then returns only the todos changed since, by their UpdatedAt, and the
+// IDs of those deleted, from tombstones kept for syncTombstoneTTL. A client
+// whose token is older than that gets 410 and starts over. Changes made
+// around the time a token is handed out may be returned twice, never not
+// at all. Todos that Mongo expires on its own, or that leave the client's
+// view because a list stopped being shared with them, are not reported;
+// clients drop the first once their expiresAt passes, and the second on
+// their next full sync.
+//
+// Edits made offline go back in batches to POST /sync/push, each naming the
+// version of the todo it was made to. An edit to a todo that has changed
+// since is a conflict, settled by the batch's strategy, by default
+// TODO_SYNC_CONFLICTS:
+//
+//   - last-write-wins applies whichever of the two changes was made later,
+//     the edit going by the time the client says it was made;
+//   - manual applies neither and returns the todo as it is now, for the
+//     client to settle and push again on top of.
+//
+// Edits to deleted todos are conflicts that no strategy applies.
+
+const (
+	tombstonesCollection string = "tombstones"
+	// syncOverlap is how far before the response a token points, so that
+	// writes still in flight when a sync runs are seen by the next.
+	syncOverlap = 30 * time.Second
+	// maxSyncBatch bounds the edits pushed in one request.
+	maxSyncBatch = 100
+
+	strategyLastWriteWins = "last-write-wins"
+	strategyManual        = "manual"
+)
+
+var (
+	syncTombstoneTTL     = time.Duration(envInt("TODO_SYNC_TOMBSTONE_DAYS", 30)) * 24 * time.Hour
+	syncConflictStrategy = envString("TODO_SYNC_CONFLICTS", strategyManual)
+)
+
+type (
+	// syncMutation is one offline edit. ID is the client's own name for
+	// it, echoed back in its result.
+	syncMutation struct {
+		ID          string `json:"id"`
+		Op          string `json:"op"`
+		TodoID      string `json:"todoId"`
+		BaseVersion string `json:"baseVersion"`
+		// At is when the edit was made, in RFC 3339.
+		At        string   `json:"at"`
+		Title     *string  `json:"title"`
+		Completed *bool    `json:"completed"`
+		ListID    string   `json:"listId"`
+		DueDate   string   `json:"dueDate"`
+		Tags      []string `json:"tags"`
+	}
+	syncResult struct {
+		ID       string        `json:"id"`
+		Status   string        `json:"status"`
+		Error    string        `json:"error,omitempty"`
+		Todo     *todo         `json:"todo,omitempty"`
+		Conflict *syncConflict `json:"conflict,omitempty"`
+	}
+	// syncConflict describes an edit made to a stale or deleted todo and
+	// how it was settled: "client" or "server" for the change that won,
+	// "manual" when it was left to the client.
+	syncConflict struct {
+		Reason     string       `json:"reason"`
+		Resolution string       `json:"resolution"`
+		Server     *todo        `json:"server,omitempty"`
+		Client     syncMutation `json:"client"`
+	}
+)
+
+// tombstoneModel records a deleted todo, with what decided who could see it
+// and, in Audience, everyone who could see it when it was deleted, as its
+// list may be deleted with it.
+type tombstoneModel struct {
+	ID          ID        `bson:"_id"`
+	TodoID      ID        `bson:"todoId"`
+	WorkspaceID ID        `bson:"workspaceId"`
+	UserID      ID        `bson:"userId"`
+	ListID      ID        `bson:"listId,omitempty"`
+	AssigneeID  ID        `bson:"assigneeId,omitempty"`
+	Audience    []ID      `bson:"audience,omitempty"`
+	DeletedAt   time.Time `bson:"deletedAt"`
+	ExpiresAt   time.Time `bson:"expiresAt"`
+}
+
+// recordTombstones notes that deleted are gone, for delta sync. Call it
+// before deleting their list, if that goes too.
+func recordTombstones(ctx context.Context, deleted ...todoModel) error {
+	if len(deleted) == 0 {
+		return nil
+	}
+	now := time.Now()
+	docs := make([]interface{}, len(deleted))
+	for i, tm := range deleted {
+		docs[i] = tombstoneModel{
+			ID:          newID(),
+			TodoID:      tm.ID,
+			WorkspaceID: tm.WorkspaceID,
+			UserID:      tm.UserID,
+			ListID:      tm.ListID,
+			AssigneeID:  tm.AssigneeID,
+			Audience:    audience(ctx, tm),
+			DeletedAt:   now,
+			ExpiresAt:   now.Add(syncTombstoneTTL),
+		}
+	}
+	_, err := db.Collection(tombstonesCollection).InsertMany(ctx, docs)
+	return err
+}
+
+func fetchChanges(w http.ResponseWriter, r *http.Request) {
+	ctx, p := r.Context(), currentPrincipal(r.Context())
+	now := time.Now()
+	var since time.Time
+	if token := r.URL.Query().Get("since"); token != "" {
+		var ok bool
+		if since, ok = parseSyncToken(token); !ok {
+			writeError(w, r, apiErr(http.StatusBadRequest, "invalid sync token"))
+			return
+		}
+		if since.Before(now.Add(-syncTombstoneTTL)) {
+			writeError(w, r, apiErr(http.StatusGone, "sync token expired, sync again without one"))
+			return
+		}
+	}
+	changed, _, err := findTodos(ctx, p, TodoFilter{UpdatedAfter: since}, 0, 0)
+	deleted := []string{}
+	if err == nil && !since.IsZero() {
+		deleted, err = findTombstones(ctx, p, since)
+	}
+	if err != nil {
+		writeError(w, r, internalError("failed to fetch changes", err))
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"data": renderer.M{
+			"todos":   mapSlice(changed, func(t todoModel) todo { return toTodo(r.Context(), t) }),
+			"deleted": deleted,
+			"token":   syncToken(now.Add(-syncOverlap)),
+		},
+	})
+}
+
+// findTombstones returns the IDs of todos p could see that were deleted
+// after since, whether or not their list is still there.
+func findTombstones(ctx context.Context, p principal, since time.Time) ([]string, error) {
+	lists, err := accessibleLists(ctx, p, false)
+	if err != nil {
+		return nil, err
+	}
+	var stones []tombstoneModel
+	err = storage.FindAll(ctx, db.Collection(tombstonesCollection), bson.M{
+		"workspaceId": p.WorkspaceID,
+		"deletedAt":   bson.M{"$gt": since},
+		"$or": []bson.M{
+			{"audience": p.UserID},
+			{"userId": p.UserID},
+			{"assigneeId": p.UserID},
+			{"listId": bson.M{"$in": lists}},
+		},
+	}, &stones)
+	ids := make([]string, 0, len(stones))
+	for _, t := range stones {
+		ids = append(ids, t.TodoID.String())
+	}
+	return ids, err
+}
+
+// syncToken encodes a point in time; clients treat it as opaque.
+func syncToken(t time.Time) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(t.UnixMilli(), 36)))
+}
+
+func parseSyncToken(token string) (time.Time, bool) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return time.Time{}, false
+	}
+	ms, err := strconv.ParseInt(string(b), 36, 64)
+	if err != nil || ms <= 0 {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(ms), true
+}
+
+// todoVersion identifies the state tm is in, for conflict detection.
+func todoVersion(tm todoModel) string {
+	return strconv.FormatInt(tm.ChangedAt().UnixMilli(), 36)
+}
+
+func pushChanges(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Strategy  string         `json:"strategy" validate:"omitempty,oneof=last-write-wins manual"`
+		Mutations []syncMutation `json:"mutations"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if req.Strategy == "" {
+		req.Strategy = syncConflictStrategy
+	}
+	if len(req.Mutations) > maxSyncBatch {
+		writeError(w, r, apiErr(http.StatusRequestEntityTooLarge, "at most "+strconv.Itoa(maxSyncBatch)+" mutations per request"))
+		return
+	}
+	ctx, p := r.Context(), currentPrincipal(r.Context())
+	results := make([]syncResult, 0, len(req.Mutations))
+	for _, m := range req.Mutations {
+		res, err := applyMutation(ctx, p, m, req.Strategy)
+		if err != nil {
+			res = syncResult{Status: "error", Error: err.Error()}
+		}
+		res.ID = m.ID
+		results = append(results, res)
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"data": results,
+	})
+}
+
+// applyMutation applies one offline edit, unless it conflicts with a
+// change made since and strategy says otherwise. Edits that cannot apply at
+// all, being malformed or forbidden, are errors.
+func applyMutation(ctx context.Context, p principal, m syncMutation, strategy string) (syncResult, error) {
+	at := time.Now()
+	if m.At != "" {
+		t, err := time.Parse(time.RFC3339, m.At)
+		if err != nil {
+			return syncResult{}, errors.New("at must be an RFC 3339 timestamp")
+		}
+		at = t
+	}
+	if m.Op == "create" {
+		return createMutation(ctx, p, m)
+	}
+	if m.Op != "update" && m.Op != "delete" {
+		return syncResult{}, errors.New("op must be create, update or delete")
+	}
+	if !validID(m.TodoID) {
+		return syncResult{}, errors.New("invalid todoId")
+	}
+	// Each round settles the edit against the todo as read; if another
+	// change gets in before it is applied, the next round settles it
+	// against that.
+	for range maxSyncRounds {
+		current, err := getTodo(ctx, p, toID(m.TodoID))
+		if err == mongo.ErrNoDocuments {
+			if m.Op == "delete" {
+				// Deleted either way.
+				return syncResult{Status: "applied"}, nil
+			}
+			return syncResult{Status: "conflict", Conflict: &syncConflict{Reason: "deleted", Resolution: "server", Client: m}}, nil
+		}
+		if err != nil {
+			return syncResult{}, err
+		}
+		var c *syncConflict
+		if m.BaseVersion != todoVersion(current) {
+			server := toTodo(ctx, current)
+			c = &syncConflict{Reason: "stale", Resolution: strategyManual, Server: &server, Client: m}
+			if strategy == strategyManual {
+				return syncResult{Status: "conflict", Todo: &server, Conflict: c}, nil
+			}
+			if !at.After(current.ChangedAt()) {
+				c.Resolution = "server"
+				return syncResult{Status: "conflict", Todo: &server, Conflict: c}, nil
+			}
+			c.Resolution = "client"
+		}
+		res, err := applyChange(ctx, p, current, m)
+		if err == errTodoChanged {
+			continue
+		}
+		res.Conflict = c
+		return res, err
+	}
+	// Still changing: the edit loses to whatever is changing it.
+	return syncResult{Status: "conflict", Conflict: &syncConflict{Reason: "stale", Resolution: "server", Client: m}}, nil
+}
+
+// maxSyncRounds bounds how often applyMutation goes round for a todo that
+// keeps changing under it.
+const maxSyncRounds = 3
+
+var errTodoChanged = errors.New("todo changed since it was read")
+
+// applyChange applies an update or delete to current, as long as it is
+// unchanged; errTodoChanged means it has changed since it was read.
+func applyChange(ctx context.Context, p principal, current todoModel, m syncMutation) (syncResult, error) {
+	if m.Op == "delete" {
+		err := removeTodoAt(ctx, p, current.ID, current.ChangedAt())
+		if err == mongo.ErrNoDocuments && changedSince(ctx, p, current) {
+			err = errTodoChanged
+		}
+		if err != nil {
+			return syncResult{}, err
+		}
+		return syncResult{Status: "applied"}, nil
+	}
+	title, completed := current.Title, current.Completed
+	if m.Title != nil {
+		title = *m.Title
+	}
+	if m.Completed != nil {
+		completed = *m.Completed
+	}
+	if title == "" {
+		return syncResult{}, errors.New("title is required")
+	}
+	tm, err := setTodoAt(ctx, p, current.ID, current.ChangedAt(), title, completed)
+	if err == mongo.ErrNoDocuments {
+		if changedSince(ctx, p, current) {
+			return syncResult{}, errTodoChanged
+		}
+		return syncResult{}, errors.New("todo is read-only")
+	}
+	if err != nil {
+		return syncResult{}, err
+	}
+	t := toTodo(ctx, tm)
+	return syncResult{Status: "applied", Todo: &t}, nil
+}
+
+// changedSince reports whether the todo read as tm has since been changed
+// or deleted.
+func changedSince(ctx context.Context, p principal, tm todoModel) bool {
+	now, err := getTodo(ctx, p, tm.ID)
+	return err != nil || todoVersion(now) != todoVersion(tm)
+}
+
+func createMutation(ctx context.Context, p principal, m syncMutation) (syncResult, error) {
+	if m.Title == nil || *m.Title == "" {
+		return syncResult{}, errors.New("title is required")
+	}
+	dueDate, err := parseDueDate(m.DueDate)
+	if err != nil {
+		return syncResult{}, errors.New("dueDate must be formatted as 2006-01-02")
+	}
+	if m.ListID != "" && !validID(m.ListID) {
+		return syncResult{}, errors.New("invalid listId")
+	}
+	tm := todoModel{
+		ID:       newID(),
+		ListID:   idOrEmpty(m.ListID),
+		Title:    *m.Title,
+		CreateAt: time.Now(),
+		DueDate:  dueDate,
+		Tags:     m.Tags,
+	}
+	if err := insertTodo(ctx, p, &tm); err != nil {
+		return syncResult{}, err
+	}
+	if m.Completed != nil && *m.Completed {
+		if tm, err = setTodo(ctx, p, tm.ID, tm.Title, true); err != nil {
+			return syncResult{}, err
+		}
+	}
+	t := toTodo(ctx, tm)
+	return syncResult{Status: "applied", Todo: &t}, nil
+}
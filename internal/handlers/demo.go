@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/sangin4208/go-todo/internal/storage"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+const demoCookie = "todo_demo"
+
+var (
+	// demoMode lets anonymous visitors try the app in a throwaway
+	// workspace that is deleted after demoTTL. Enable with TODO_DEMO_MODE=true.
+	demoMode    = envBool("TODO_DEMO_MODE")
+	demoTTL     = time.Duration(envInt("TODO_DEMO_TTL_HOURS", 24)) * time.Hour
+	demosByIP   = newRateLimiter(func() int { return liveConf().DemoRate }, time.Hour)
+	demoJanitor = 10 * time.Minute
+)
+
+// startDemo signs the visitor into their demo workspace, creating one the
+// first time. The workspace is remembered in a cookie, which resolveTenant
+// falls back to, so returning visitors pick up where they left off.
+func startDemo(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(demoCookie); err == nil {
+		var ws workspaceModel
+		if db.Collection(workspacesCollection).FindOne(r.Context(), bson.M{
+			"slug":      c.Value,
+			"demo":      true,
+			"expiresAt": bson.M{"$gt": time.Now()},
+		}).Decode(&ws) == nil {
+			var u userModel
+			if db.Collection(usersCollection).FindOne(r.Context(), bson.M{"workspaceId": ws.ID}).Decode(&u) == nil {
+				issueToken(w, r, http.StatusOK, u)
+				return
+			}
+		}
+	}
+	if !demosByIP.allow(clientIP(r.RemoteAddr)) {
+		writeError(w, r, apiErr(http.StatusTooManyRequests, "too many requests, try again later"))
+		return
+	}
+	ws, u, err := createDemo(r.Context())
+	if err != nil {
+		writeError(w, r, internalError("error creating demo", err))
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     demoCookie,
+		Value:    ws.Slug,
+		Path:     "/",
+		Expires:  ws.ExpiresAt,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	issueToken(w, r, http.StatusCreated, u)
+}
+
+func createDemo(ctx context.Context) (workspaceModel, userModel, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return workspaceModel{}, userModel{}, err
+	}
+	now := time.Now()
+	ws := workspaceModel{
+		ID:        newID(),
+		Slug:      "demo-" + hex.EncodeToString(b),
+		Name:      "Demo",
+		CreateAt:  now,
+		Demo:      true,
+		ExpiresAt: now.Add(demoTTL),
+	}
+	if _, err := db.Collection(workspacesCollection).InsertOne(ctx, &ws); err != nil {
+		return ws, userModel{}, err
+	}
+	u := userModel{
+		ID:          newID(),
+		WorkspaceID: ws.ID,
+		Email:       "demo@" + ws.Slug + ".invalid",
+		Role:        roleAdmin,
+		CreateAt:    now,
+	}
+	_, err := db.Collection(usersCollection).InsertOne(ctx, &u)
+	return ws, u, err
+}
+
+// cleanupDemos periodically deletes expired demo workspaces along with
+// everything their users created, on the leader only, until ctx is
+// canceled.
+func cleanupDemos(ctx context.Context) {
+	tick := time.NewTicker(demoJanitor)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+		if !isLeader(ctx) {
+			continue
+		}
+		var expired []workspaceModel
+		if err := storage.FindAll(ctx, db.Collection(workspacesCollection), bson.M{
+			"demo":      true,
+			"expiresAt": bson.M{"$lte": time.Now()},
+		}, &expired); err != nil {
+			slog.Error("demo cleanup", "err", err)
+			continue
+		}
+		for _, ws := range expired {
+			if err := purgeWorkspace(ctx, ws.ID); err != nil {
+				slog.Error("demo cleanup", "workspace", ws.Slug, "err", err)
+			}
+		}
+	}
+}
+
+func purgeWorkspace(ctx context.Context, id ID) error {
+	var users []userModel
+	if err := storage.FindAll(ctx, db.Collection(usersCollection), bson.M{"workspaceId": id}, &users); err != nil {
+		return err
+	}
+	for _, u := range users {
+		if err := purgeUser(ctx, u); err != nil {
+			return err
+		}
+	}
+	return deleteOne(ctx, db.Collection(workspacesCollection), bson.M{"_id": id})
+}
@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+const (
+	digestDaily  = "daily"
+	digestWeekly = "weekly"
+	// defaultDigestTime is when digests go out, in the user's time zone,
+	// unless they choose otherwise.
+	defaultDigestTime = "08:00"
+)
+
+// digestWeekday is the day weekly digests go out, "monday" unless the user
+// chose another.
+func (n notificationSettings) digestWeekday() time.Weekday {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(d.String(), n.DigestWeekday) {
+			return d
+		}
+	}
+	return time.Monday
+}
+
+func (n notificationSettings) digestTime() string {
+	if n.DigestTime == "" {
+		return defaultDigestTime
+	}
+	return n.DigestTime
+}
+
+// location is the user's time zone.
+func (u userModel) location() *time.Location {
+	if loc, err := time.LoadLocation(u.TimeZone); err == nil {
+		return loc
+	}
+	return time.UTC
+}
+
+// sendDigests mails every user whose digest falls due by now and has not
+// gone out yet today.
+func sendDigests(ctx context.Context, now time.Time) error {
+	cur, err := db.Collection(usersCollection).Find(ctx, bson.M{
+		"disabled":             bson.M{"$ne": true},
+		"unverified":           bson.M{"$ne": true},
+		"notifications.digest": bson.M{"$in": []string{digestDaily, digestWeekly}},
+	})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		var u userModel
+		if err := cur.Decode(&u); err != nil {
+			return err
+		}
+		if err := digestUser(ctx, u, now); err != nil {
+			slog.Error("digest", "user_id", u.ID, "err", err)
+		}
+	}
+	return cur.Err()
+}
+
+func digestUser(ctx context.Context, u userModel, now time.Time) error {
+	ctx = withZone(ctx, u.location())
+	n := u.Notifications
+	local := now.In(u.location())
+	date := local.Format("2006-01-02")
+	if local.Format("15:04") < n.digestTime() || n.LastDigest == date {
+		return nil
+	}
+	since := now.AddDate(0, 0, -1)
+	if n.Digest == digestWeekly {
+		if local.Weekday() != n.digestWeekday() {
+			return nil
+		}
+		since = now.AddDate(0, 0, -7)
+	}
+	// Claiming the date first keeps other instances from sending it too.
+	res, err := db.Collection(usersCollection).UpdateOne(ctx,
+		bson.M{"_id": u.ID, "notifications.lastDigest": bson.M{"$ne": date}},
+		bson.M{"$set": bson.M{"notifications.lastDigest": date}})
+	if err != nil || res.ModifiedCount == 0 {
+		return err
+	}
+
+	// Due dates are days in the server's zone; compare them with the day
+	// it is for the user.
+	today, err := time.ParseInLocation("2006-01-02", date, time.Local)
+	if err != nil {
+		return err
+	}
+	scope := todoScope{WorkspaceID: u.WorkspaceID, OwnerID: u.ID, AssigneeID: u.ID}
+	open, done := false, true
+	todos := serverFrom(ctx).todos
+	due, _, err := todos.List(ctx, scope, TodoFilter{Completed: &open, DueBefore: today.AddDate(0, 0, 1)}, 0, 0)
+	if err != nil {
+		return err
+	}
+	completed, _, err := todos.List(ctx, scope, TodoFilter{Completed: &done, CompletedAfter: since}, 0, 0)
+	if err != nil {
+		return err
+	}
+	var overdue, dueToday, recent []todo
+	for _, tm := range due {
+		if tm.DueDate.Before(today) {
+			overdue = append(overdue, toTodo(ctx, tm))
+		} else {
+			dueToday = append(dueToday, toTodo(ctx, tm))
+		}
+	}
+	for _, tm := range completed {
+		recent = append(recent, toTodo(ctx, tm))
+	}
+	if len(overdue)+len(dueToday)+len(recent) == 0 {
+		return nil
+	}
+	queueMail(ctx, u.Email, "digest", map[string]interface{}{
+		"Frequency": n.Digest,
+		"Date":      date,
+		"Overdue":   overdue,
+		"DueToday":  dueToday,
+		"Completed": recent,
+	})
+	return nil
+}
@@ -0,0 +1,297 @@
+package handlers
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sangin4208/go-todo/internal/storage"
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// sealedPrefix marks an encrypted value, which reads
+// enc:<key id>:<base64 of nonce and ciphertext>.
+const sealedPrefix = "enc:"
+
+// Todo titles are encrypted with AES-256-GCM when TODO_ENCRYPTION_KEYS is
+// set to comma-separated id:key pairs, each key being 32 bytes in base64.
+// The first key encrypts; all of them decrypt, so a key is rotated by
+// putting a new one first, running POST /admin/encryption/rotate, and
+// dropping the old one once nothing uses it. Values stored before
+// encryption was enabled are read as they are.
+//
+// Encrypted titles cannot be searched or sorted by the database.
+var encryptionKeys, encryptionKeyID = loadEncryptionKeys(envString("TODO_ENCRYPTION_KEYS", ""))
+
+// loadEncryptionKeys parses TODO_ENCRYPTION_KEYS, recording configErrors
+// entries for keys it cannot use.
+func loadEncryptionKeys(spec string) (map[string]cipher.AEAD, string) {
+	if spec == "" {
+		return nil, ""
+	}
+	keys := make(map[string]cipher.AEAD)
+	current := ""
+	for _, pair := range strings.Split(spec, ",") {
+		id, key, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		raw, err := base64.StdEncoding.DecodeString(key)
+		if !ok || id == "" || err != nil || len(raw) != 32 {
+			configErrors = append(configErrors, fmt.Errorf("TODO_ENCRYPTION_KEYS: %q is not an id and a base64 32-byte key", id))
+			continue
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			configErrors = append(configErrors, fmt.Errorf("TODO_ENCRYPTION_KEYS: %s: %w", id, err))
+			continue
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			configErrors = append(configErrors, fmt.Errorf("TODO_ENCRYPTION_KEYS: %s: %w", id, err))
+			continue
+		}
+		keys[id] = aead
+		if current == "" {
+			current = id
+		}
+	}
+	return keys, current
+}
+
+// seal encrypts s with the current key, if encryption is enabled.
+func seal(s string) (string, error) {
+	if encryptionKeyID == "" || s == "" {
+		return s, nil
+	}
+	aead := encryptionKeys[encryptionKeyID]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(s)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	ct := aead.Seal(nonce, nonce, []byte(s), nil)
+	return sealedPrefix + encryptionKeyID + ":" + base64.RawStdEncoding.EncodeToString(ct), nil
+}
+
+// unseal decrypts a value from seal, returning any other value unchanged.
+func unseal(s string) (string, error) {
+	rest, ok := strings.CutPrefix(s, sealedPrefix)
+	if !ok {
+		return s, nil
+	}
+	id, data, _ := strings.Cut(rest, ":")
+	aead, ok := encryptionKeys[id]
+	if !ok {
+		return "", fmt.Errorf("unknown encryption key %q", id)
+	}
+	ct, err := base64.RawStdEncoding.DecodeString(data)
+	if err != nil || len(ct) < aead.NonceSize() {
+		return "", errors.New("malformed encrypted value")
+	}
+	pt, err := aead.Open(nil, ct[:aead.NonceSize()], ct[aead.NonceSize():], nil)
+	return string(pt), err
+}
+
+// sealedWithCurrentKey reports whether s needs no rotation.
+func sealedWithCurrentKey(s string) bool {
+	return s == "" || strings.HasPrefix(s, sealedPrefix+encryptionKeyID+":")
+}
+
+func sealTodo(tm *todoModel) error {
+	var err error
+	tm.Title, err = seal(tm.Title)
+	return err
+}
+
+// unsealTodo decrypts a todo read straight from the database.
+func unsealTodo(tm *todoModel) error {
+	var err error
+	tm.Title, err = unseal(tm.Title)
+	return err
+}
+
+func unsealTodos(todos []todoModel) error {
+	for i := range todos {
+		if err := unsealTodo(&todos[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encryptedTodoRepository encrypts titles on the way in and decrypts them
+// on the way out, so the layers below only ever hold ciphertext.
+type encryptedTodoRepository struct {
+	next TodoRepository
+}
+
+func (e encryptedTodoRepository) List(ctx context.Context, s todoScope, f TodoFilter, skip, limit int) ([]todoModel, int, error) {
+	todos, total, err := e.next.List(ctx, s, f, skip, limit)
+	if err == nil {
+		err = unsealTodos(todos)
+	}
+	return todos, total, err
+}
+
+func (e encryptedTodoRepository) Get(ctx context.Context, s todoScope, id ID) (todoModel, error) {
+	tm, err := e.next.Get(ctx, s, id)
+	if err == nil {
+		err = unsealTodo(&tm)
+	}
+	return tm, err
+}
+
+func (e encryptedTodoRepository) Create(ctx context.Context, tm *todoModel) error {
+	sealed := *tm
+	if err := sealTodo(&sealed); err != nil {
+		return err
+	}
+	err := e.next.Create(ctx, &sealed)
+	tm.ID = sealed.ID
+	return err
+}
+
+func (e encryptedTodoRepository) Update(ctx context.Context, s todoScope, id ID, title string, completed bool) (todoModel, todoModel, error) {
+	sealed, err := seal(title)
+	if err != nil {
+		return todoModel{}, todoModel{}, err
+	}
+	before, after, err := e.next.Update(ctx, s, id, sealed, completed)
+	if err == nil {
+		err = unsealTodo(&before)
+	}
+	if err == nil {
+		err = unsealTodo(&after)
+	}
+	return before, after, err
+}
+
+func (e encryptedTodoRepository) Assign(ctx context.Context, s todoScope, id, assignee ID) (todoModel, error) {
+	tm, err := e.next.Assign(ctx, s, id, assignee)
+	if err == nil {
+		err = unsealTodo(&tm)
+	}
+	return tm, err
+}
+
+func (e encryptedTodoRepository) Delete(ctx context.Context, s todoScope, id ID) (todoModel, error) {
+	tm, err := e.next.Delete(ctx, s, id)
+	if err == nil {
+		err = unsealTodo(&tm)
+	}
+	return tm, err
+}
+
+func (e encryptedTodoRepository) CountOpen(ctx context.Context, user ID) (int, error) {
+	return e.next.CountOpen(ctx, user)
+}
+
+func (e encryptedTodoRepository) DeleteExpired(ctx context.Context, now time.Time) ([]todoModel, error) {
+	expired, err := e.next.DeleteExpired(ctx, now)
+	if err == nil {
+		err = unsealTodos(expired)
+	}
+	return expired, err
+}
+
+func (e encryptedTodoRepository) DeleteMany(ctx context.Context, s todoScope, f TodoFilter) ([]todoModel, error) {
+	removed, err := e.next.DeleteMany(ctx, s, f)
+	if err == nil {
+		err = unsealTodos(removed)
+	}
+	return removed, err
+}
+
+func (e encryptedTodoRepository) Count(ctx context.Context, s todoScope, f TodoFilter) (int, error) {
+	return e.next.Count(ctx, s, f)
+}
+
+// CountTags passes through: only titles are encrypted.
+func (e encryptedTodoRepository) CountTags(ctx context.Context, s todoScope, f TodoFilter) ([]storage.TagCount, error) {
+	return e.next.CountTags(ctx, s, f)
+}
+
+func (e encryptedTodoRepository) CountByDay(ctx context.Context, s todoScope, f TodoFilter, completed bool, loc *time.Location) (map[string]int, error) {
+	return e.next.CountByDay(ctx, s, f, completed, loc)
+}
+
+// rotateEncryption re-encrypts with the current key every todo title, and
+// every title recorded in activity or the todo event log, that is plaintext
+// or uses another key. Only todos kept in Mongo can be rotated this way.
+func rotateEncryption(w http.ResponseWriter, r *http.Request) {
+	s := serverFrom(r.Context())
+	if encryptionKeyID == "" || !s.todosInMongo() {
+		writeError(w, r, apiErr(http.StatusBadRequest, "rotation needs TODO_ENCRYPTION_KEYS and TODO_STORAGE=mongo or events"))
+		return
+	}
+	ctx := r.Context()
+	n, err := rotateField(ctx, s.collection, "title")
+	if err == nil {
+		var entries int
+		entries, err = rotateField(ctx, activityCollection, "changes.title.old", "changes.title.new")
+		n += entries
+	}
+	if err == nil && s.storage == "events" {
+		var entries int
+		entries, err = rotateField(ctx, storage.TodoEventsCollection, "title", "todo.title")
+		n += entries
+		if err == nil {
+			entries, err = rotateField(ctx, storage.TodoSnapshotsCollection, "todo.title")
+			n += entries
+		}
+	}
+	if err != nil {
+		writeError(w, r, internalError("error rotating encryption key", err))
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"message":   translate(r.Context(), "encryption key rotated successfully"),
+		"rewritten": n,
+		"keyId":     encryptionKeyID,
+	})
+}
+
+// rotateField re-seals the string fields given by dotted paths in every
+// document of the collection that needs it, returning how many changed.
+func rotateField(ctx context.Context, collection string, paths ...string) (int, error) {
+	cur, err := db.Collection(collection).Find(ctx, bson.M{})
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(ctx)
+	n := 0
+	for cur.Next(ctx) {
+		set := bson.M{}
+		for _, path := range paths {
+			v, err := cur.Current.LookupErr(strings.Split(path, ".")...)
+			if err != nil {
+				continue
+			}
+			s, ok := v.StringValueOK()
+			if !ok || sealedWithCurrentKey(s) {
+				continue
+			}
+			pt, err := unseal(s)
+			if err != nil {
+				return n, err
+			}
+			if set[path], err = seal(pt); err != nil {
+				return n, err
+			}
+		}
+		if len(set) == 0 {
+			continue
+		}
+		if _, err := db.Collection(collection).UpdateOne(ctx,
+			bson.M{"_id": cur.Current.Lookup("_id")}, bson.M{"$set": set}); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, cur.Err()
+}
@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// Every error response is a JSON object with the same fields:
+//
+//	{"message": "todo not found", "code": "not_found", "requestId": "..."}
+//
+// message is for people and may change; code is for programs and does
+// not. Handlers answer errors with writeError, giving an apiError for the
+// status, code and message they want or any other error, which is mapped
+// to a status by what it is. Server errors are logged with their cause
+// but only described to the client, so database errors and the like don't
+// leak out.
+
+// apiError is an error as the client is told about it.
+type apiError struct {
+	Status int
+	// Code defaults to one named after Status, such as not_found.
+	Code    string
+	Message string
+	// Err is the cause. It is sent as the error field of client errors
+	// and only logged for server errors.
+	Err error
+}
+
+func (e *apiError) Error() string {
+	if e.Err == nil {
+		return e.Message
+	}
+	return e.Message + ": " + e.Err.Error()
+}
+
+func (e *apiError) Unwrap() error {
+	return e.Err
+}
+
+// apiErr is the error answered with status and message.
+func apiErr(status int, message string) *apiError {
+	return &apiError{Status: status, Message: message}
+}
+
+// internalError is a server error described to the client as message,
+// caused by err.
+func internalError(message string, err error) *apiError {
+	return &apiError{Status: http.StatusInternalServerError, Message: message, Err: err}
+}
+
+// statusError maps errors other than apiErrors to the response they
+// deserve, the rest being internal server errors.
+func statusError(err error) *apiError {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return &apiError{Status: http.StatusGatewayTimeout, Code: "timeout", Message: "the request timed out", Err: err}
+	case errors.Is(err, errBreakerOpen):
+		return &apiError{Status: http.StatusServiceUnavailable, Message: "database unavailable", Err: err}
+	case errors.Is(err, mongo.ErrNoDocuments), errors.Is(err, errListNotFound):
+		return &apiError{Status: http.StatusNotFound, Message: "not found", Err: err}
+	case errors.Is(err, errQuotaExceeded):
+		return &apiError{Status: http.StatusPaymentRequired, Code: "quota_exceeded", Message: "quota exceeded"}
+	case errors.Is(err, errForbidden):
+		return &apiError{Status: http.StatusForbidden, Message: "insufficient permissions"}
+	case mongo.IsDuplicateKeyError(err):
+		return &apiError{Status: http.StatusConflict, Message: "already exists", Err: err}
+	}
+	return internalError("internal server error", err)
+}
+
+// writeError answers r with err, as the only response to it.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var e *apiError
+	if !errors.As(err, &e) {
+		e = statusError(err)
+	} else if e.Status >= 500 && e.Err != nil {
+		// Timeouts and outages are worth telling apart from bugs even
+		// when a handler didn't expect them.
+		if se := statusError(e.Err); se.Status > 500 {
+			e = &apiError{Status: se.Status, Code: se.Code, Message: e.Message, Err: e.Err}
+		}
+	}
+	body := renderer.M{
+		"message": translate(r.Context(), e.Message),
+		"code":    e.Code,
+	}
+	if e.Code == "" {
+		body["code"] = statusCode(e.Status)
+	}
+	if e.Status >= 500 {
+		if e.Err != nil {
+			noteRequestError(r.Context(), e.Err)
+		}
+	} else if e.Err != nil {
+		body["error"] = e.Err.Error()
+	}
+	render(r).JSON(w, e.Status, body)
+}
+
+// statusCode is the code for errors with status that don't say otherwise,
+// such as not_found for 404.
+func statusCode(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return "error"
+	}
+	return strings.ReplaceAll(strings.ToLower(strings.ReplaceAll(text, "-", " ")), " ", "_")
+}
@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"context"
+	"sync"
+)
+
+const (
+	eventCreated = "todo.created"
+	eventUpdated = "todo.updated"
+	eventDeleted = "todo.deleted"
+	// eventCompleted is announced, alongside eventUpdated, when a todo is
+	// marked done. Live update streams do not carry it.
+	eventCompleted = "todo.completed"
+)
+
+type event struct {
+	Type string
+	Todo todoModel
+	// Audience holds the users allowed to see Todo.
+	Audience []ID
+	// Seq numbers the events published by this instance, from 1.
+	Seq uint64
+}
+
+// hubBacklog is how many recent events a hub keeps for replay.
+const hubBacklog = 256
+
+// hub fans out todo changes to every subscriber. Slow subscribers miss
+// events rather than blocking the writer.
+type hub struct {
+	mu   sync.Mutex
+	subs map[chan event]ID
+	seq  uint64
+	// recent holds the last hubBacklog events, oldest first.
+	recent []event
+	// listeners hear of every event, whoever may see it.
+	listeners []func(event)
+}
+
+func newHub() *hub {
+	return &hub{subs: make(map[chan event]ID)}
+}
+
+// subscribe returns a channel receiving changes to todos user can see.
+func (h *hub) subscribe(user ID) chan event {
+	ch := make(chan event, 16)
+	h.mu.Lock()
+	h.subs[ch] = user
+	h.mu.Unlock()
+	return ch
+}
+
+// subscribeSince is subscribe that also returns the events after seq that
+// user can see, or false if some have already been dropped from the
+// backlog. The channel only receives events after those.
+func (h *hub) subscribeSince(user ID, seq uint64) (chan event, []event, bool) {
+	ch := make(chan event, 16)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.subs[ch] = user
+	if seq > h.seq {
+		return ch, nil, false
+	}
+	if len(h.recent) > 0 && seq+1 < h.recent[0].Seq {
+		return ch, nil, false
+	}
+	var missed []event
+	for _, e := range h.recent {
+		if e.Seq > seq && containsID(e.Audience, user) {
+			missed = append(missed, e)
+		}
+	}
+	return ch, missed, true
+}
+
+// listen calls f with every event published from now on. f must not
+// block.
+func (h *hub) listen(f func(event)) {
+	h.mu.Lock()
+	h.listeners = append(h.listeners, f)
+	h.mu.Unlock()
+}
+
+func (h *hub) unsubscribe(ch chan event) {
+	h.mu.Lock()
+	delete(h.subs, ch)
+	h.mu.Unlock()
+}
+
+func (h *hub) publish(e event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.seq++
+	e.Seq = h.seq
+	if len(h.recent) == hubBacklog {
+		h.recent = append(h.recent[:0], h.recent[1:]...)
+	}
+	h.recent = append(h.recent, e)
+	for _, f := range h.listeners {
+		f(e)
+	}
+	for ch, user := range h.subs {
+		for _, u := range e.Audience {
+			if u == user {
+				select {
+				case ch <- e:
+				default:
+				}
+				break
+			}
+		}
+	}
+}
+
+// publishChange publishes a change made through this instance to live
+// update streams. With change streams on, every instance learns of writes
+// from watchTodos instead, so publishing here as well would deliver each
+// event twice. Webhooks and the broker hear of changes through the outbox,
+// see recordEvent.
+func publishChange(ctx context.Context, typ string, tm todoModel) {
+	if changeStreams {
+		return
+	}
+	serverFrom(ctx).changes.publish(event{Type: typ, Todo: tm, Audience: audience(ctx, tm)})
+}
+
+// announce tells the world outside the server, webhooks, the event broker,
+// MQTT and Slack, of a change. id identifies the event, so that announcing it
+// again after a failure does not duplicate webhook deliveries. Slack, which
+// has no such key, is told last, once the rest has succeeded.
+func announce(ctx context.Context, id ID, typ string, tm todoModel) error {
+	if err := notifyWebhooks(ctx, id, typ, tm); err != nil {
+		return err
+	}
+	if err := publishToBroker(ctx, id, typ, tm); err != nil {
+		return err
+	}
+	if err := publishToMQTT(ctx, typ, tm); err != nil {
+		return err
+	}
+	notifySlack(ctx, typ, tm)
+	return nil
+}
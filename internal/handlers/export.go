@@ -0,0 +1,289 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/sangin4208/go-todo/internal/storage"
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	exportsCollection string = "exports"
+	exportPending            = "pending"
+	exportReady              = "ready"
+	exportFailed             = "failed"
+	// Archives are kept for exportTTL; download links are valid for
+	// exportLinkTTL from when they are handed out.
+	exportTTL     = 7 * 24 * time.Hour
+	exportLinkTTL = time.Hour
+	// Archives live inside the export document, which Mongo caps at 16MB.
+	maxExportSize = 15 << 20
+)
+
+var errExportTooLarge = errors.New("export exceeds the maximum archive size")
+
+type exportModel struct {
+	ID        ID        `bson:"_id,omitempty"`
+	UserID    ID        `bson:"userId"`
+	Status    string    `bson:"status"`
+	Error     string    `bson:"error,omitempty"`
+	Archive   []byte    `bson:"archive,omitempty"`
+	CreateAt  time.Time `bson:"createAt"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+// createExport starts assembling an archive of everything the caller has
+// created. Poll fetchExport for the result.
+func createExport(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r.Context())
+	c := db.Collection(exportsCollection)
+	n, err := c.CountDocuments(r.Context(), bson.M{"userId": user, "status": exportPending})
+	if err == nil && n > 0 {
+		writeError(w, r, apiErr(http.StatusConflict, "an export is already in progress"))
+		return
+	}
+	e := exportModel{
+		ID:        newID(),
+		UserID:    user,
+		Status:    exportPending,
+		CreateAt:  time.Now(),
+		ExpiresAt: time.Now().Add(exportTTL),
+	}
+	if err == nil {
+		_, err = c.InsertOne(r.Context(), &e)
+	}
+	if err == nil {
+		if err = enqueueJob(r.Context(), jobExport, "", time.Now(), exportJob{ExportID: e.ID}); err != nil {
+			c.DeleteOne(r.Context(), bson.M{"_id": e.ID})
+		}
+	}
+	if err != nil {
+		writeError(w, r, internalError("error starting export", err))
+		return
+	}
+	render(r).JSON(w, http.StatusAccepted, renderer.M{
+		"message":   translate(r.Context(), "export started"),
+		"export_id": e.ID.String(),
+	})
+}
+
+func fetchExport(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSpace(chi.URLParam(r, "id"))
+	if !validID(id) {
+		writeError(w, r, apiErr(http.StatusBadRequest, "The id is invalid"))
+		return
+	}
+	var e exportModel
+	err := db.Collection(exportsCollection).FindOne(r.Context(), bson.M{
+		"_id":    toID(id),
+		"userId": currentUser(r.Context()),
+	}, options.FindOne().SetProjection(bson.M{"archive": 0})).Decode(&e)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, r, apiErr(http.StatusNotFound, "export not found"))
+		return
+	}
+	if err != nil {
+		writeError(w, r, internalError("error fetching export", err))
+		return
+	}
+	data := renderer.M{
+		"id":        e.ID.String(),
+		"status":    e.Status,
+		"createAt":  formatTime(r.Context(), e.CreateAt),
+		"expiresAt": formatTime(r.Context(), e.ExpiresAt),
+	}
+	if e.Status == exportFailed {
+		data["error"] = e.Error
+	}
+	if e.Status == exportReady {
+		data["downloadUrl"] = exportDownloadURL(r.Context(), e.ID, time.Now().Add(exportLinkTTL))
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"data": data,
+	})
+}
+
+// downloadExport serves an archive to anyone holding a valid, unexpired
+// signed link, so it can be opened straight from a browser.
+func downloadExport(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	if err != nil || !validID(id) || time.Now().Unix() > expires ||
+		!hmac.Equal([]byte(r.URL.Query().Get("sig")), []byte(exportSignature(r.Context(), id, expires))) {
+		writeError(w, r, apiErr(http.StatusForbidden, "invalid or expired download link"))
+		return
+	}
+	var e exportModel
+	err = db.Collection(exportsCollection).FindOne(r.Context(), bson.M{"_id": toID(id), "status": exportReady}).Decode(&e)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, r, apiErr(http.StatusNotFound, "export not found"))
+		return
+	}
+	if err != nil {
+		writeError(w, r, internalError("error fetching export", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="todo-export-`+e.CreateAt.Format("20060102")+`.zip"`)
+	w.Write(e.Archive)
+}
+
+// exportJob is the payload of jobExport.
+type exportJob struct {
+	ExportID ID `json:"exportId"`
+}
+
+// runExport builds the archive of a pending export. Exports deleted along
+// with their account in the meantime are skipped.
+func runExport(ctx context.Context, payload json.RawMessage) error {
+	var p exportJob
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return permanent(err)
+	}
+	var e exportModel
+	err := db.Collection(exportsCollection).FindOne(ctx, bson.M{"_id": p.ExportID, "status": exportPending},
+		options.FindOne().SetProjection(bson.M{"archive": 0})).Decode(&e)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	archive, err := buildExport(ctx, e.UserID)
+	if err == nil && len(archive) > maxExportSize {
+		err = permanent(errExportTooLarge)
+	}
+	if err != nil {
+		return err
+	}
+	return updateOne(ctx, db.Collection(exportsCollection), bson.M{"_id": e.ID},
+		bson.M{"$set": bson.M{"status": exportReady, "archive": archive}})
+}
+
+// failExport records why an export could not be built.
+func failExport(ctx context.Context, payload json.RawMessage, cause error) {
+	var p exportJob
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return
+	}
+	if err := updateOne(ctx, db.Collection(exportsCollection), bson.M{"_id": p.ExportID},
+		bson.M{"$set": bson.M{"status": exportFailed, "error": cause.Error()}}); err != nil && err != mongo.ErrNoDocuments {
+		slog.Error("export", "export_id", p.ExportID, "err", err)
+	}
+}
+
+// buildExport zips one JSON file per kind of data the user has created.
+func buildExport(ctx context.Context, user ID) ([]byte, error) {
+	var u userModel
+	if err := db.Collection(usersCollection).FindOne(ctx, bson.M{"_id": user}).Decode(&u); err != nil {
+		return nil, err
+	}
+	owned, _, err := serverFrom(ctx).todos.List(ctx, todoScope{WorkspaceID: u.WorkspaceID, OwnerID: user}, TodoFilter{}, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	// List is newest first; the export, like the rest of it, oldest first.
+	slices.Reverse(owned)
+	var lists []listModel
+	var comments []commentModel
+	var entries []activityModel
+	for _, q := range []struct {
+		collection string
+		filter     bson.M
+		result     interface{}
+	}{
+		{listsCollection, bson.M{"ownerId": user}, &lists},
+		{commentsCollection, bson.M{"authorId": user}, &comments},
+		{activityCollection, bson.M{"actorId": user}, &entries},
+	} {
+		if err := storage.FindAll(ctx, db.Collection(q.collection), q.filter, q.result, options.Find().SetSort(storage.SortKeys("createAt"))); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx = withZone(ctx, u.location())
+	files := map[string]interface{}{
+		"account.json": exportAccount(ctx, u),
+		"todos.json":   mapSlice(owned, func(t todoModel) todo { return toTodo(ctx, t) }),
+		"lists.json":   mapSlice(lists, func(l listModel) list { return toList(ctx, l) }),
+		"comments.json": mapSlice(comments, func(c commentModel) interface{} {
+			return struct {
+				TodoID string `json:"todoId"`
+				comment
+			}{c.TodoID.String(), toComment(ctx, c)}
+		}),
+		"activity.json": mapSlice(entries, func(a activityModel) activity { return toActivity(ctx, a) }),
+	}
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range files {
+		f, err := zw.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(data); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// exportAccount is the user document minus credentials and secrets.
+func exportAccount(ctx context.Context, u userModel) renderer.M {
+	providers := []string{}
+	for _, id := range u.Identities {
+		providers = append(providers, id.Provider)
+	}
+	return renderer.M{
+		"id":               u.ID.String(),
+		"workspaceId":      u.WorkspaceID.String(),
+		"email":            u.Email,
+		"role":             u.Role,
+		"emailVerified":    !u.Unverified,
+		"twoFactorEnabled": u.TOTPEnabled,
+		"linkedProviders":  providers,
+		"createAt":         formatTime(ctx, u.CreateAt),
+	}
+}
+
+func mapSlice[T, U any](in []T, f func(T) U) []U {
+	out := make([]U, 0, len(in))
+	for _, v := range in {
+		out = append(out, f(v))
+	}
+	return out
+}
+
+func exportDownloadURL(ctx context.Context, id ID, expires time.Time) string {
+	exp := expires.Unix()
+	return serverFrom(ctx).publicURL + "/downloads/exports/" + id.String() +
+		"?expires=" + strconv.FormatInt(exp, 10) + "&sig=" + exportSignature(ctx, id.String(), exp)
+}
+
+func exportSignature(ctx context.Context, id string, expires int64) string {
+	mac := hmac.New(sha256.New, serverFrom(ctx).jwtSecret)
+	mac.Write([]byte("export:" + id + ":" + strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/thedevsaddam/renderer"
+)
+
+// Newer capabilities sit behind feature flags so they can be rolled out a
+// little at a time and switched off again without a deploy. TODO_FEATURES
+// lists flags as name=rule, comma separated, where a rule is on, off, a
+// percentage of users such as 25%, or user IDs, any of them joined with |:
+//
+//	TODO_FEATURES=graphql=off, sync=10%|<user id>|<user id>
+//
+// A bare name turns the flag on. Percentages pick users by a hash of the
+// flag and their ID, so each user stays on the same side as the rollout
+// grows. Flags not listed keep their default. TODO_FEATURES is a live
+// setting, so a reload changes rollouts in place.
+
+// features are the known flags and whether they are on by default.
+var features = map[string]bool{
+	// graphql is POST /graphql.
+	"graphql": true,
+	// sync is the delta sync API, GET /sync and POST /sync/push.
+	"sync": true,
+}
+
+// featureRule says who a flag is on for.
+type featureRule struct {
+	All     bool
+	Percent int
+	Users   []ID
+}
+
+// parseFeatures reads TODO_FEATURES, recording configErrors entries for
+// what it can't read.
+func parseFeatures(s string) map[string]featureRule {
+	rules := map[string]featureRule{}
+	for _, entry := range splitSetting(s) {
+		name, spec, found := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if _, ok := features[name]; !ok {
+			configErrors = append(configErrors, fmt.Errorf("TODO_FEATURES: unknown feature %q", name))
+			continue
+		}
+		if !found {
+			spec = "on"
+		}
+		var rule featureRule
+		for _, term := range strings.Split(spec, "|") {
+			term = strings.TrimSpace(term)
+			switch {
+			case term == "on":
+				rule.All = true
+			case term == "off":
+			case strings.HasSuffix(term, "%"):
+				n, err := strconv.Atoi(strings.TrimSuffix(term, "%"))
+				if err != nil || n < 0 || n > 100 {
+					configErrors = append(configErrors, fmt.Errorf("TODO_FEATURES: %s: %q is not a percentage", name, term))
+					continue
+				}
+				rule.Percent = n
+			case validID(term):
+				rule.Users = append(rule.Users, toID(term))
+			default:
+				configErrors = append(configErrors, fmt.Errorf("TODO_FEATURES: %s: %q is not on, off, a percentage or a user ID", name, term))
+			}
+		}
+		rules[name] = rule
+	}
+	return rules
+}
+
+// featureEnabled reports whether the flag is on for the caller.
+func featureEnabled(ctx context.Context, name string) bool {
+	rule, ok := liveConf().Features[name]
+	if !ok {
+		return features[name]
+	}
+	if rule.All {
+		return true
+	}
+	user := currentUser(ctx)
+	if user.IsZero() {
+		return false
+	}
+	if slices.Contains(rule.Users, user) {
+		return true
+	}
+	return rule.Percent > 0 && featureBucket(name, user) < rule.Percent
+}
+
+// featureBucket places user in one of 100 buckets for the flag, apart
+// from the buckets of other flags so rollouts don't all pick the same
+// users first.
+func featureBucket(name string, user ID) int {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	h.Write([]byte{0})
+	h.Write([]byte(user.String()))
+	return int(h.Sum32() % 100)
+}
+
+// requireFeature answers 404 to callers the flag is off for, as though
+// the endpoint did not exist.
+func requireFeature(name string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !featureEnabled(r.Context(), name) {
+				writeError(w, r, &apiError{
+					Status:  http.StatusNotFound,
+					Code:    "feature_disabled",
+					Message: "this feature is not available",
+				})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// fetchFeatures lists the flags that are on for the caller, so clients
+// can show what they may use.
+func fetchFeatures(w http.ResponseWriter, r *http.Request) {
+	on := []string{}
+	for _, name := range slices.Sorted(maps.Keys(features)) {
+		if featureEnabled(r.Context(), name) {
+			on = append(on, name)
+		}
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{"features": on})
+}
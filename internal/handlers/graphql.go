@@ -0,0 +1,343 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	graphql "github.com/graph-gophers/graphql-go"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+const (
+	graphqlDefaultPage = 50
+	graphqlMaxPage     = 500
+)
+
+const graphqlSchema = `
+schema {
+	query: Query
+	mutation: Mutation
+	subscription: Subscription
+}
+
+type Query {
+	todos(completed: Boolean, tag: String, first: Int, offset: Int): TodoConnection!
+	todo(id: ID!): Todo
+	tags: [Tag!]!
+}
+
+type Mutation {
+	createTodo(input: CreateTodoInput!): Todo!
+	updateTodo(id: ID!, title: String!, completed: Boolean!): Todo!
+	deleteTodo(id: ID!): Boolean!
+}
+
+type Subscription {
+	todoChanged: TodoEvent!
+}
+
+type Todo {
+	id: ID!
+	title: String!
+	completed: Boolean!
+	createAt: String!
+	completedAt: String
+	dueDate: String
+	tags: [String!]!
+}
+
+type TodoConnection {
+	totalCount: Int!
+	nodes: [Todo!]!
+}
+
+type Tag {
+	name: String!
+	count: Int!
+}
+
+type TodoEvent {
+	type: String!
+	todo: Todo!
+}
+
+input CreateTodoInput {
+	title: String!
+	dueDate: String
+	tags: [String!]
+}
+`
+
+var errForbidden = errors.New("insufficient permissions")
+
+var gqlSchema = graphql.MustParseSchema(graphqlSchema, &gqlResolver{})
+
+type (
+	gqlResolver struct{}
+
+	todoResolver struct {
+		t todoModel
+	}
+
+	connectionResolver struct {
+		total int
+		todos []todoModel
+	}
+
+	tagResolver struct {
+		Tag   string
+		Total int
+	}
+
+	eventResolver struct {
+		e event
+	}
+)
+
+func (*gqlResolver) Todos(ctx context.Context, args struct {
+	Completed *bool
+	Tag       *string
+	First     *int32
+	Offset    *int32
+}) (*connectionResolver, error) {
+	filter := TodoFilter{Completed: args.Completed}
+	if args.Tag != nil {
+		filter.Tag = *args.Tag
+	}
+	limit, skip := graphqlDefaultPage, 0
+	if args.First != nil && *args.First > 0 {
+		limit = int(*args.First)
+	}
+	if limit > graphqlMaxPage {
+		limit = graphqlMaxPage
+	}
+	if args.Offset != nil && *args.Offset > 0 {
+		skip = int(*args.Offset)
+	}
+	todos, total, err := findTodos(ctx, currentPrincipal(ctx), filter, skip, limit)
+	if err != nil {
+		return nil, err
+	}
+	return &connectionResolver{total: total, todos: todos}, nil
+}
+
+func (*gqlResolver) Todo(ctx context.Context, args struct{ ID graphql.ID }) (*todoResolver, error) {
+	id, err := parseGraphQLID(args.ID)
+	if err != nil {
+		return nil, err
+	}
+	tm, err := getTodo(ctx, currentPrincipal(ctx), id)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &todoResolver{tm}, nil
+}
+
+func (*gqlResolver) Tags(ctx context.Context) ([]*tagResolver, error) {
+	p := currentPrincipal(ctx)
+	counts, err := serverFrom(ctx).todos.CountTags(ctx, todoScope{WorkspaceID: p.WorkspaceID, OwnerID: p.UserID}, TodoFilter{ListID: p.ListID})
+	tags := make([]*tagResolver, len(counts))
+	for i, c := range counts {
+		tags[i] = &tagResolver{Tag: c.Tag, Total: c.Total}
+	}
+	return tags, err
+}
+
+func (*gqlResolver) CreateTodo(ctx context.Context, args struct {
+	Input struct {
+		Title   string
+		DueDate *string
+		Tags    *[]string
+	}
+}) (*todoResolver, error) {
+	if !canWrite(ctx) {
+		return nil, errForbidden
+	}
+	if args.Input.Title == "" {
+		return nil, fmt.Errorf("title is required")
+	}
+	tm := todoModel{
+		ID:       newID(),
+		Title:    args.Input.Title,
+		CreateAt: time.Now(),
+	}
+	if args.Input.DueDate != nil {
+		dueDate, err := parseDueDate(*args.Input.DueDate)
+		if err != nil {
+			return nil, fmt.Errorf("dueDate must be formatted as 2006-01-02")
+		}
+		tm.DueDate = dueDate
+	}
+	if args.Input.Tags != nil {
+		tm.Tags = *args.Input.Tags
+	}
+	if err := insertTodo(ctx, currentPrincipal(ctx), &tm); err != nil {
+		return nil, err
+	}
+	return &todoResolver{tm}, nil
+}
+
+func (*gqlResolver) UpdateTodo(ctx context.Context, args struct {
+	ID        graphql.ID
+	Title     string
+	Completed bool
+}) (*todoResolver, error) {
+	if !canWrite(ctx) {
+		return nil, errForbidden
+	}
+	id, err := parseGraphQLID(args.ID)
+	if err != nil {
+		return nil, err
+	}
+	if args.Title == "" {
+		return nil, fmt.Errorf("the title field is required")
+	}
+	tm, err := setTodo(ctx, currentPrincipal(ctx), id, args.Title, args.Completed)
+	if err != nil {
+		return nil, err
+	}
+	return &todoResolver{tm}, nil
+}
+
+func (*gqlResolver) DeleteTodo(ctx context.Context, args struct{ ID graphql.ID }) (bool, error) {
+	if !canWrite(ctx) {
+		return false, errForbidden
+	}
+	id, err := parseGraphQLID(args.ID)
+	if err != nil {
+		return false, err
+	}
+	if err := removeTodo(ctx, currentPrincipal(ctx), id); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (*gqlResolver) TodoChanged(ctx context.Context) <-chan *eventResolver {
+	out := make(chan *eventResolver)
+	changes := serverFrom(ctx).changes
+	go func() {
+		ch := changes.subscribe(currentUser(ctx))
+		defer changes.unsubscribe(ch)
+		defer close(out)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e := <-ch:
+				select {
+				case out <- &eventResolver{e}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return out
+}
+
+func (r *todoResolver) ID() graphql.ID  { return graphql.ID(r.t.ID.String()) }
+func (r *todoResolver) Title() string   { return r.t.Title }
+func (r *todoResolver) Completed() bool { return r.t.Completed }
+func (r *todoResolver) Tags() []string  { return r.t.Tags }
+
+func (r *todoResolver) CreateAt(ctx context.Context) string {
+	return formatTime(ctx, r.t.CreateAt)
+}
+
+func (r *todoResolver) CompletedAt(ctx context.Context) *string {
+	if r.t.CompletedAt.IsZero() {
+		return nil
+	}
+	s := formatTime(ctx, r.t.CompletedAt)
+	return &s
+}
+
+func (r *todoResolver) DueDate() *string {
+	if r.t.DueDate.IsZero() {
+		return nil
+	}
+	s := formatDueDate(r.t.DueDate)
+	return &s
+}
+
+func (r *connectionResolver) TotalCount() int32 { return int32(r.total) }
+
+func (r *connectionResolver) Nodes() []*todoResolver {
+	nodes := make([]*todoResolver, 0, len(r.todos))
+	for _, t := range r.todos {
+		nodes = append(nodes, &todoResolver{t})
+	}
+	return nodes
+}
+
+func (r *tagResolver) Name() string   { return r.Tag }
+func (r *tagResolver) Count() int32   { return int32(r.Total) }
+func (r *eventResolver) Type() string { return r.e.Type }
+
+func (r *eventResolver) Todo() *todoResolver { return &todoResolver{r.e.Todo} }
+
+func parseGraphQLID(id graphql.ID) (ID, error) {
+	s := strings.TrimSpace(string(id))
+	if !validID(s) {
+		return "", fmt.Errorf("The id is invalid")
+	}
+	return toID(s), nil
+}
+
+// graphqlHandler executes queries and mutations as plain JSON. Subscriptions
+// are streamed back as server-sent events, one result per event.
+func graphqlHandler(w http.ResponseWriter, r *http.Request) {
+	var params struct {
+		Query         string                 `json:"query"`
+		OperationName string                 `json:"operationName"`
+		Variables     map[string]interface{} `json:"variables"`
+		// Extensions are part of the GraphQL over HTTP request format;
+		// none are supported, but clients may send them.
+		Extensions map[string]interface{} `json:"extensions"`
+	}
+	if !decodeJSON(w, r, &params) {
+		return
+	}
+
+	if !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		res := gqlSchema.Exec(r.Context(), params.Query, params.OperationName, params.Variables)
+		render(r).JSON(w, http.StatusOK, res)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, r, apiErr(http.StatusInternalServerError, "streaming unsupported"))
+		return
+	}
+	results, err := gqlSchema.Subscribe(r.Context(), params.Query, params.OperationName, params.Variables)
+	if err != nil {
+		writeError(w, r, &apiError{
+			Status:  http.StatusBadRequest,
+			Message: "invalid subscription",
+			Err:     err,
+		})
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for res := range results {
+		b, err := json.Marshal(res)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(w, "data: %s\n\n", b)
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/sangin4208/go-todo/todopb"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var errPermissionDenied = status.Error(codes.PermissionDenied, "insufficient permissions")
+
+type todoService struct {
+	todopb.UnimplementedTodoServiceServer
+}
+
+func newGRPCServer() *grpc.Server {
+	s := grpc.NewServer(
+		grpc.UnaryInterceptor(grpcUnaryAuth),
+		grpc.StreamInterceptor(grpcStreamAuth),
+	)
+	todopb.RegisterTodoServiceServer(s, &todoService{})
+	return s
+}
+
+func (todoService) List(ctx context.Context, req *todopb.ListRequest) (*todopb.ListResponse, error) {
+	todos, err := listTodos(ctx, currentPrincipal(ctx))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	res := &todopb.ListResponse{}
+	for _, t := range todos {
+		res.Todos = append(res.Todos, toProto(t))
+	}
+	return res, nil
+}
+
+func (todoService) Get(ctx context.Context, req *todopb.GetRequest) (*todopb.Todo, error) {
+	id, err := parseGRPCID(req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	tm, err := getTodo(ctx, currentPrincipal(ctx), id)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return toProto(tm), nil
+}
+
+func (todoService) Create(ctx context.Context, req *todopb.CreateRequest) (*todopb.Todo, error) {
+	if !canWrite(ctx) {
+		return nil, errPermissionDenied
+	}
+	if req.GetTitle() == "" {
+		return nil, status.Error(codes.InvalidArgument, "title is required")
+	}
+	tm := todoModel{
+		ID:       newID(),
+		Title:    req.GetTitle(),
+		CreateAt: time.Now(),
+		Tags:     req.GetTags(),
+	}
+	if req.GetDueDate() != nil {
+		tm.DueDate = req.GetDueDate().AsTime()
+	}
+	if err := insertTodo(ctx, currentPrincipal(ctx), &tm); err != nil {
+		return nil, grpcError(err)
+	}
+	return toProto(tm), nil
+}
+
+func (todoService) Update(ctx context.Context, req *todopb.UpdateRequest) (*todopb.Todo, error) {
+	if !canWrite(ctx) {
+		return nil, errPermissionDenied
+	}
+	id, err := parseGRPCID(req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	if req.GetTitle() == "" {
+		return nil, status.Error(codes.InvalidArgument, "the title field is required")
+	}
+	tm, err := setTodo(ctx, currentPrincipal(ctx), id, req.GetTitle(), req.GetCompleted())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return toProto(tm), nil
+}
+
+func (todoService) Delete(ctx context.Context, req *todopb.DeleteRequest) (*todopb.DeleteResponse, error) {
+	if !canWrite(ctx) {
+		return nil, errPermissionDenied
+	}
+	id, err := parseGRPCID(req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	if err := removeTodo(ctx, currentPrincipal(ctx), id); err != nil {
+		return nil, grpcError(err)
+	}
+	return &todopb.DeleteResponse{}, nil
+}
+
+func (todoService) Watch(req *todopb.WatchRequest, stream todopb.TodoService_WatchServer) error {
+	changes := serverFrom(stream.Context()).changes
+	ch := changes.subscribe(currentUser(stream.Context()))
+	defer changes.unsubscribe(ch)
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case e := <-ch:
+			if err := stream.Send(&todopb.Event{
+				Type: eventTypes[e.Type],
+				Todo: toProto(e.Todo),
+			}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+var eventTypes = map[string]todopb.Event_Type{
+	eventCreated: todopb.Event_TYPE_CREATED,
+	eventUpdated: todopb.Event_TYPE_UPDATED,
+	eventDeleted: todopb.Event_TYPE_DELETED,
+}
+
+func toProto(t todoModel) *todopb.Todo {
+	p := &todopb.Todo{
+		Id:        t.ID.String(),
+		Title:     t.Title,
+		Completed: t.Completed,
+		Tags:      t.Tags,
+	}
+	if !t.CreateAt.IsZero() {
+		p.CreateAt = timestamppb.New(t.CreateAt)
+	}
+	if !t.CompletedAt.IsZero() {
+		p.CompletedAt = timestamppb.New(t.CompletedAt)
+	}
+	if !t.DueDate.IsZero() {
+		p.DueDate = timestamppb.New(t.DueDate)
+	}
+	return p
+}
+
+func grpcUnaryAuth(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := grpcAuthenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func grpcStreamAuth(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if _, err := grpcAuthenticate(ss.Context()); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// grpcAuthenticate checks the bearer token in the "authorization" metadata,
+// mirroring requireAuth for HTTP.
+func grpcAuthenticate(ctx context.Context) (context.Context, error) {
+	if ok, _ := databaseAvailable(ctx); !ok {
+		return nil, status.Error(codes.Unavailable, "database unavailable")
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	var token string
+	if v := md.Get("authorization"); len(v) > 0 {
+		token = bearerToken(v[0])
+	}
+	var slug string
+	if v := md.Get(strings.ToLower(workspaceHeader)); len(v) > 0 {
+		slug = strings.ToLower(v[0])
+	}
+	ws, err := lookupWorkspace(ctx, slug)
+	var p principal
+	if err == nil {
+		ctx = context.WithValue(ctx, workspaceKey, ws)
+		p, err = authenticate(ctx, token)
+	}
+	if err == nil && ws != p.WorkspaceID {
+		err = errWrongWorkspace
+	}
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "authentication required")
+	}
+	return context.WithValue(ctx, principalKey, p), nil
+}
+
+func parseGRPCID(id string) (ID, error) {
+	id = strings.TrimSpace(id)
+	if !validID(id) {
+		return "", status.Error(codes.InvalidArgument, "The id is invalid")
+	}
+	return toID(id), nil
+}
+
+func grpcError(err error) error {
+	if err == mongo.ErrNoDocuments {
+		return status.Error(codes.NotFound, "todo not found")
+	}
+	if err == errQuotaExceeded {
+		return status.Error(codes.ResourceExhausted, "open todo quota exceeded")
+	}
+	return status.Error(codes.Internal, err.Error())
+}
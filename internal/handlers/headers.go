@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// Every response carries headers hardening the HTML pages against
+// injected content, framing and sniffing. Each one can be replaced, or
+// left out by setting it to off: TODO_CSP for Content-Security-Policy,
+// TODO_REFERRER_POLICY and TODO_FRAME_OPTIONS. Strict-Transport-Security
+// is sent while the server is reached over HTTPS, telling browsers to
+// refuse plain HTTP for TODO_HSTS_MAX_AGE_SECONDS (a year, 0 to not send
+// it).
+
+var headerConf = struct {
+	CSP, ReferrerPolicy, FrameOptions string
+	HSTSMaxAge                        int
+}{
+	CSP: envString("TODO_CSP", "default-src 'self'; script-src 'self' https://unpkg.com; style-src 'self' 'unsafe-inline' https://maxcdn.bootstrapcdn.com; "+
+		"img-src 'self' data:; object-src 'none'; base-uri 'self'; form-action 'self'; frame-ancestors 'none'"),
+	ReferrerPolicy: envString("TODO_REFERRER_POLICY", "strict-origin-when-cross-origin"),
+	FrameOptions:   envString("TODO_FRAME_OPTIONS", "DENY"),
+	HSTSMaxAge:     envInt("TODO_HSTS_MAX_AGE_SECONDS", 365*24*60*60),
+}
+
+func securityHeaders(next http.Handler) http.Handler {
+	headers := map[string]string{
+		"X-Content-Type-Options":  "nosniff",
+		"Content-Security-Policy": headerConf.CSP,
+		"Referrer-Policy":         headerConf.ReferrerPolicy,
+		"X-Frame-Options":         headerConf.FrameOptions,
+	}
+	for name, v := range headers {
+		if v == "" || v == "off" {
+			delete(headers, name)
+		}
+	}
+	hsts := ""
+	if headerConf.HSTSMaxAge > 0 {
+		hsts = "max-age=" + strconv.Itoa(headerConf.HSTSMaxAge) + "; includeSubDomains"
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hsts != "" && (tlsEnabled() || serverFrom(r.Context()).https()) {
+			w.Header().Set("Strict-Transport-Security", hsts)
+		}
+		for name, v := range headers {
+			w.Header().Set(name, v)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// Orchestrators probe two endpoints, both outside requireDatabase so they
+// can always be reached. /healthz answers as long as the process serves
+// requests at all; restarting it is the remedy when it does not. /readyz
+// checks what serving needs, answering 503 while the instance should get
+// no traffic: Mongo does not answer a ping, the breaker is open,
+// migrations are pending or the instance is shutting down. The job queue
+// is reported too, but a backlog is shared by all instances and does not
+// make this one unready.
+
+const (
+	readinessTimeout = 2 * time.Second
+	// jobBacklogAge is how overdue a job may get before the queue counts
+	// as backlogged.
+	jobBacklogAge = 10 * time.Minute
+)
+
+// Component states in /readyz.
+const (
+	healthOK       = "ok"
+	healthDegraded = "degraded"
+	healthFailing  = "failing"
+)
+
+// draining is set once the server starts shutting down.
+var draining atomic.Bool
+
+var startedAt = time.Now()
+
+type componentHealth struct {
+	Status string                 `json:"status"`
+	Detail map[string]interface{} `json:"detail,omitempty"`
+	Error  string                 `json:"error,omitempty"`
+}
+
+func healthCheck(w http.ResponseWriter, r *http.Request) {
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"status":   healthOK,
+		"instance": instanceID,
+		"uptime":   time.Since(startedAt).Round(time.Second).String(),
+	})
+}
+
+func readinessCheck(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+	components := map[string]componentHealth{
+		"database":   databaseHealth(ctx),
+		"migrations": migrationHealth(ctx),
+		"jobs":       jobHealth(ctx),
+	}
+	ready := !draining.Load()
+	for name, c := range components {
+		if c.Status == healthFailing && name != "jobs" {
+			ready = false
+		}
+	}
+	status, code := healthOK, http.StatusOK
+	if !ready {
+		status, code = healthFailing, http.StatusServiceUnavailable
+	}
+	render(r).JSON(w, code, renderer.M{
+		"status":     status,
+		"draining":   draining.Load(),
+		"components": components,
+	})
+}
+
+func databaseHealth(ctx context.Context) componentHealth {
+	state, _ := dbBreaker.state()
+	ready := serverFrom(ctx).ready.Load()
+	c := componentHealth{Status: healthOK, Detail: map[string]interface{}{
+		"connected": ready,
+		"breaker":   state,
+	}}
+	if !ready {
+		c.Status = healthFailing
+		return c
+	}
+	start := time.Now()
+	if err := db.Ping(ctx); err != nil {
+		c.Status, c.Error = healthFailing, err.Error()
+		return c
+	}
+	c.Detail["latencyMs"] = time.Since(start).Milliseconds()
+	if state == breakerOpen {
+		c.Status = healthFailing
+	}
+	return c
+}
+
+func migrationHealth(ctx context.Context) componentHealth {
+	if !serverFrom(ctx).ready.Load() {
+		return componentHealth{Status: healthFailing, Error: "database unavailable"}
+	}
+	applied, err := appliedMigrations(ctx)
+	if err != nil {
+		return componentHealth{Status: healthFailing, Error: err.Error()}
+	}
+	var pending []int
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; !ok {
+			pending = append(pending, m.Version)
+		}
+	}
+	c := componentHealth{Status: healthOK, Detail: map[string]interface{}{"pending": len(pending)}}
+	if len(pending) > 0 {
+		c.Status = healthFailing
+		c.Detail["versions"] = pending
+	}
+	return c
+}
+
+func jobHealth(ctx context.Context) componentHealth {
+	if !serverFrom(ctx).ready.Load() {
+		return componentHealth{Status: healthFailing, Error: "database unavailable"}
+	}
+	now := time.Now()
+	jobs := db.Collection(jobsCollection)
+	due, err := jobs.CountDocuments(ctx, bson.M{"status": bson.M{"$in": []string{jobQueued, jobRunning}}, "runAt": bson.M{"$lte": now}})
+	if err != nil {
+		return componentHealth{Status: healthFailing, Error: err.Error()}
+	}
+	overdue, err := jobs.CountDocuments(ctx, bson.M{"status": bson.M{"$in": []string{jobQueued, jobRunning}}, "runAt": bson.M{"$lte": now.Add(-jobBacklogAge)}})
+	if err != nil {
+		return componentHealth{Status: healthFailing, Error: err.Error()}
+	}
+	c := componentHealth{Status: healthOK, Detail: map[string]interface{}{
+		"due":     due,
+		"overdue": overdue,
+		"workers": jobWorkers,
+	}}
+	if overdue > 0 {
+		c.Status = healthDegraded
+	}
+	return c
+}
@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/sangin4208/go-todo/internal/model"
+)
+
+// idFormat picks the kind of ID given to new documents: "objectid" or
+// "uuid" (UUIDv7, whose time-ordered prefix keeps SQL indexes compact).
+// Either kind is accepted wherever an ID is expected, so switching leaves
+// existing documents reachable.
+var idFormat = envString("TODO_ID_FORMAT", "objectid")
+
+type ID = model.ID
+
+var errInvalidID = errors.New("invalid id")
+
+func newID() ID {
+	return model.NewID(idFormat)
+}
+
+// validID reports whether s is an ObjectID or a UUID.
+func validID(s string) bool {
+	return model.ValidID(s)
+}
+
+// toID converts a string already checked with validID.
+func toID(s string) ID {
+	return ID(strings.ToLower(s))
+}
+
+// idOrEmpty is toID that leaves an empty string empty.
+func idOrEmpty(s string) ID {
+	if s == "" {
+		return ""
+	}
+	return toID(s)
+}
@@ -0,0 +1,310 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/thedevsaddam/renderer"
+)
+
+// maxImportSize bounds an uploaded export.
+const maxImportSize = 10 << 20
+
+var (
+	errNothingToImport = errors.New("the export holds no todos")
+	// todoistSuffix is the project ID Todoist appends to file names in
+	// backups, as in "Inbox [2203306141].csv".
+	todoistSuffix = regexp.MustCompile(`\s*\[\d+\]$`)
+	todoistLabel  = regexp.MustCompile(`(^|\s)@([^\s@]+)`)
+)
+
+// importedList is a board or project read from an export, ready to become
+// a list.
+type importedList struct {
+	Name  string
+	Todos []todoModel
+}
+
+// importTrello takes the JSON export of a Trello board, from the board
+// menu's "Print, export and share". The board becomes a list and its open
+// cards todos, keeping labels as tags and due dates; archived cards are
+// left out.
+func importTrello(w http.ResponseWriter, r *http.Request) {
+	var board struct {
+		Name  string `json:"name"`
+		Cards []struct {
+			Name        string `json:"name"`
+			Closed      bool   `json:"closed"`
+			Due         string `json:"due"`
+			DueComplete bool   `json:"dueComplete"`
+			Labels      []struct {
+				Name  string `json:"name"`
+				Color string `json:"color"`
+			} `json:"labels"`
+		} `json:"cards"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxImportSize)).Decode(&board); err != nil {
+		writeError(w, r, &apiError{
+			Status:  http.StatusBadRequest,
+			Message: "invalid Trello export",
+			Err:     err,
+		})
+		return
+	}
+	l := importedList{Name: board.Name}
+	for _, c := range board.Cards {
+		if c.Closed || strings.TrimSpace(c.Name) == "" {
+			continue
+		}
+		tm := todoModel{Title: strings.TrimSpace(c.Name), Completed: c.DueComplete}
+		if d, err := time.Parse(time.RFC3339, c.Due); err == nil {
+			tm.DueDate, _ = parseDueDate(d.In(time.Local).Format("2006-01-02"))
+		}
+		for _, label := range c.Labels {
+			// Unnamed labels are only told apart by their color.
+			if label.Name != "" {
+				tm.Tags = appendTag(tm.Tags, label.Name)
+			} else if label.Color != "" {
+				tm.Tags = appendTag(tm.Tags, label.Color)
+			}
+		}
+		l.Todos = append(l.Todos, tm)
+	}
+	respondImport(w, r, []importedList{l})
+}
+
+// importTodoist takes a Todoist export: either a project exported as CSV,
+// named by the name query parameter, or a backup, a zip of one CSV per
+// project. Projects become lists and tasks todos, with @labels as tags.
+// Todoist keeps due dates as the words they were typed in, so only those in
+// a date format come through.
+func importTodoist(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportSize))
+	if err != nil {
+		writeError(w, r, &apiError{
+			Status:  http.StatusBadRequest,
+			Message: "invalid request body",
+			Err:     err,
+		})
+		return
+	}
+	var lists []importedList
+	if bytes.HasPrefix(data, []byte("PK\x03\x04")) {
+		lists, err = readTodoistBackup(data)
+	} else {
+		var l importedList
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			name = "Todoist"
+		}
+		l, err = readTodoistCSV(name, bytes.NewReader(data))
+		lists = append(lists, l)
+	}
+	if err != nil {
+		writeError(w, r, &apiError{
+			Status:  http.StatusBadRequest,
+			Message: "invalid Todoist export",
+			Err:     err,
+		})
+		return
+	}
+	respondImport(w, r, lists)
+}
+
+func readTodoistBackup(data []byte) ([]importedList, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	var lists []importedList
+	for _, f := range zr.File {
+		name := path.Base(f.Name)
+		if f.FileInfo().IsDir() || !strings.EqualFold(path.Ext(name), ".csv") {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		l, err := readTodoistCSV(todoistSuffix.ReplaceAllString(strings.TrimSuffix(name, path.Ext(name)), ""), rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, l)
+	}
+	return lists, nil
+}
+
+// readTodoistCSV reads a project in Todoist's CSV format, whose header row
+// names the columns and where tasks are the rows of TYPE "task".
+func readTodoistCSV(name string, r io.Reader) (importedList, error) {
+	l := importedList{Name: name}
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	header, err := cr.Read()
+	if err != nil {
+		return l, err
+	}
+	col := map[string]int{}
+	for i, h := range header {
+		// Files may start with a byte order mark.
+		col[strings.ToUpper(strings.TrimPrefix(strings.TrimSpace(h), "\ufeff"))] = i
+	}
+	typ, okType := col["TYPE"]
+	content, okContent := col["CONTENT"]
+	if !okType || !okContent {
+		return l, errors.New("missing TYPE or CONTENT column")
+	}
+	date, okDate := col["DATE"]
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return l, nil
+		}
+		if err != nil {
+			return l, err
+		}
+		if len(rec) <= content || len(rec) <= typ || rec[typ] != "task" {
+			continue
+		}
+		var tm todoModel
+		for _, m := range todoistLabel.FindAllStringSubmatch(rec[content], -1) {
+			tm.Tags = appendTag(tm.Tags, m[2])
+		}
+		tm.Title = strings.Join(strings.Fields(todoistLabel.ReplaceAllString(rec[content], "$1")), " ")
+		if tm.Title == "" {
+			continue
+		}
+		if okDate && len(rec) > date {
+			tm.DueDate = parseImportedDate(rec[date])
+		}
+		l.Todos = append(l.Todos, tm)
+	}
+}
+
+func parseImportedDate(s string) time.Time {
+	s = strings.TrimSpace(s)
+	for _, layout := range []string{"2006-01-02", "2006-01-02 15:04", "2006-01-02T15:04:05", time.RFC3339} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			d, _ := parseDueDate(t.In(time.Local).Format("2006-01-02"))
+			return d
+		}
+	}
+	return time.Time{}
+}
+
+// appendTag adds tag to tags unless it is empty or already there.
+func appendTag(tags []string, tag string) []string {
+	tag = strings.TrimSpace(tag)
+	if tag == "" {
+		return tags
+	}
+	for _, t := range tags {
+		if strings.EqualFold(t, tag) {
+			return tags
+		}
+	}
+	return append(tags, tag)
+}
+
+func respondImport(w http.ResponseWriter, r *http.Request, lists []importedList) {
+	p := currentPrincipal(r.Context())
+	if !p.ListID.IsZero() {
+		writeError(w, r, apiErr(http.StatusForbidden, "token is restricted to a single list"))
+		return
+	}
+	listIDs, n, err := importLists(r.Context(), p, lists)
+	ids := mapSlice(listIDs, ID.String)
+	switch {
+	case err == errNothingToImport:
+		writeError(w, r, apiErr(http.StatusBadRequest, err.Error()))
+	case err == errQuotaExceeded:
+		render(r).JSON(w, http.StatusPaymentRequired, renderer.M{
+			"message":  translate(r.Context(), "quota exceeded, the import is incomplete"),
+			"code":     "quota_exceeded",
+			"list_ids": ids,
+			"imported": n,
+		})
+	case err != nil:
+		render(r).JSON(w, http.StatusInternalServerError, renderer.M{
+			"message":  translate(r.Context(), "error importing todos"),
+			"error":    err.Error(),
+			"list_ids": ids,
+			"imported": n,
+		})
+	default:
+		render(r).JSON(w, http.StatusCreated, renderer.M{
+			"message":  translate(r.Context(), "todos imported successfully"),
+			"list_ids": ids,
+			"imported": n,
+		})
+	}
+}
+
+// importLists creates a list for each of lists holding its todos, through
+// insertTodo so quotas, events and activity apply as to any other todo. It
+// returns the lists created and the number of todos imported, which on
+// error is how far it got.
+func importLists(ctx context.Context, p principal, lists []importedList) ([]ID, int, error) {
+	empty := true
+	for _, l := range lists {
+		empty = empty && len(l.Todos) == 0
+	}
+	if empty {
+		return nil, 0, errNothingToImport
+	}
+	var ids []ID
+	n := 0
+	for _, il := range lists {
+		if len(il.Todos) == 0 {
+			continue
+		}
+		if err := checkQuota(liveConf().MaxLists, func() (int, error) {
+			return countOwnedLists(ctx, p.UserID)
+		}); err != nil {
+			return ids, n, err
+		}
+		name := strings.TrimSpace(il.Name)
+		if name == "" {
+			name = "Imported"
+		}
+		l := listModel{
+			ID:          newID(),
+			WorkspaceID: p.WorkspaceID,
+			OwnerID:     p.UserID,
+			Name:        name,
+			Members:     []listMember{},
+			CreateAt:    time.Now(),
+		}
+		if _, err := db.Collection(listsCollection).InsertOne(ctx, &l); err != nil {
+			return ids, n, err
+		}
+		ids = append(ids, l.ID)
+		for _, tm := range il.Todos {
+			completed := tm.Completed
+			tm.ID, tm.ListID, tm.Completed, tm.CreateAt = newID(), l.ID, false, time.Now()
+			if err := insertTodo(ctx, p, &tm); err != nil {
+				return ids, n, err
+			}
+			if completed {
+				if _, err := setTodo(ctx, p, tm.ID, tm.Title, true); err != nil {
+					return ids, n, err
+				}
+			}
+			n++
+		}
+	}
+	return ids, n, nil
+}
@@ -0,0 +1,220 @@
+package handlers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// inboundConf configures email intake: every user can get a private
+// address at TODO_INBOUND_DOMAIN, and mail forwarded to it becomes a todo.
+// Mail reaches the server through a Mailgun route that forwards to
+// POST /inbound/mailgun, signed with TODO_MAILGUN_SIGNING_KEY. The subject
+// becomes the title, the text a comment and attachments attachments.
+var inboundConf = struct {
+	Domain, SigningKey string
+}{
+	Domain:     strings.ToLower(envString("TODO_INBOUND_DOMAIN", "")),
+	SigningKey: envString("TODO_MAILGUN_SIGNING_KEY", ""),
+}
+
+const (
+	inboxAliasesCollection string = "inbox_aliases"
+	// inboundMaxSize bounds a forwarded message; Mailgun accepts 25MB.
+	inboundMaxSize = 30 << 20
+	// mailgunMaxSkew is how old a signed request may be, against replays.
+	mailgunMaxSkew = 5 * time.Minute
+)
+
+var (
+	aliasEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+	// replyPrefix matches what mail clients put before forwarded and
+	// replied-to subjects.
+	replyPrefix = regexp.MustCompile(`(?i)^\s*((fwd?|re|aw|wg)\s*:\s*)+`)
+)
+
+// inboxAliasModel maps the local part of an inbound address to its user.
+type inboxAliasModel struct {
+	Alias    string    `bson:"_id"`
+	UserID   ID        `bson:"userId"`
+	CreateAt time.Time `bson:"createAt"`
+}
+
+func inboundEnabled() bool {
+	return inboundConf.Domain != "" && inboundConf.SigningKey != ""
+}
+
+func fetchInbox(w http.ResponseWriter, r *http.Request) {
+	var a inboxAliasModel
+	err := db.Collection(inboxAliasesCollection).FindOne(r.Context(), bson.M{"userId": currentUser(r.Context())}).Decode(&a)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, r, apiErr(http.StatusNotFound, "no inbound address yet, POST to create one"))
+		return
+	}
+	if err != nil {
+		writeError(w, r, internalError("failed to fetch inbound address", err))
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"data": renderer.M{"address": a.Alias + "@" + inboundConf.Domain},
+	})
+}
+
+// createInbox gives the caller a new inbound address, retiring any old one
+// so that a leaked address can be replaced.
+func createInbox(w http.ResponseWriter, r *http.Request) {
+	ctx, user := r.Context(), currentUser(r.Context())
+	b := make([]byte, 10)
+	_, err := rand.Read(b)
+	a := inboxAliasModel{Alias: strings.ToLower(aliasEncoding.EncodeToString(b)), UserID: user, CreateAt: time.Now()}
+	if err == nil {
+		_, err = db.Collection(inboxAliasesCollection).DeleteMany(ctx, bson.M{"userId": user})
+	}
+	if err == nil {
+		_, err = db.Collection(inboxAliasesCollection).InsertOne(ctx, &a)
+	}
+	if err != nil {
+		writeError(w, r, internalError("error creating inbound address", err))
+		return
+	}
+	render(r).JSON(w, http.StatusCreated, renderer.M{
+		"message": translate(r.Context(), "inbound address created successfully"),
+		"data":    renderer.M{"address": a.Alias + "@" + inboundConf.Domain},
+	})
+}
+
+func deleteInbox(w http.ResponseWriter, r *http.Request) {
+	if _, err := db.Collection(inboxAliasesCollection).DeleteMany(r.Context(), bson.M{"userId": currentUser(r.Context())}); err != nil {
+		writeError(w, r, internalError("error deleting inbound address", err))
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"message": translate(r.Context(), "inbound address deleted successfully"),
+	})
+}
+
+// verifyMailgun checks the signature Mailgun puts on forwarded messages.
+func verifyMailgun(timestamp, token, signature string) bool {
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || time.Since(time.Unix(sec, 0)).Abs() > mailgunMaxSkew {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(inboundConf.SigningKey))
+	mac.Write([]byte(timestamp + token))
+	return hmac.Equal([]byte(hex.EncodeToString(mac.Sum(nil))), []byte(signature))
+}
+
+// receiveMailgun turns a message forwarded by a Mailgun route into a todo.
+// Mailgun retries on errors but not on 406, which is given for mail it
+// should drop.
+func receiveMailgun(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, inboundMaxSize)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		writeError(w, r, &apiError{
+			Status:  http.StatusBadRequest,
+			Message: "invalid request body",
+			Err:     err,
+		})
+		return
+	}
+	if !verifyMailgun(r.FormValue("timestamp"), r.FormValue("token"), r.FormValue("signature")) {
+		writeError(w, r, apiErr(http.StatusUnauthorized, "invalid Mailgun signature"))
+		return
+	}
+	ctx := r.Context()
+	u, err := inboxUser(ctx, r.FormValue("recipient"))
+	if err == mongo.ErrNoDocuments || err == nil && u.Disabled {
+		writeError(w, r, apiErr(http.StatusNotAcceptable, "unknown recipient"))
+		return
+	}
+	if err != nil {
+		writeError(w, r, internalError("error finding recipient", err))
+		return
+	}
+	p := userPrincipal(u)
+	if p.Role == roleViewer {
+		writeError(w, r, apiErr(http.StatusNotAcceptable, "recipient may not add todos"))
+		return
+	}
+	title := strings.TrimSpace(replyPrefix.ReplaceAllString(r.FormValue("subject"), ""))
+	if title == "" {
+		title = "(no subject)"
+	}
+	tm := todoModel{ID: newID(), Title: title, CreateAt: time.Now()}
+	if err := insertTodo(ctx, p, &tm); err != nil {
+		status := http.StatusInternalServerError
+		if err == errQuotaExceeded {
+			status = http.StatusNotAcceptable
+		}
+		writeError(w, r, &apiError{Status: status, Message: "error creating todo", Err: err})
+		return
+	}
+	// The todo exists now; failing past here would make Mailgun send the
+	// message again and create it twice, so the rest is best effort.
+	if body := []rune(strings.TrimSpace(r.FormValue("body-plain"))); len(body) > 0 {
+		if len(body) > maxCommentLen {
+			body = append(body[:maxCommentLen-1], '…')
+		}
+		c := commentModel{ID: newID(), TodoID: tm.ID, AuthorID: u.ID, Body: string(body), CreateAt: time.Now()}
+		if _, err := db.Collection(commentsCollection).InsertOne(ctx, &c); err != nil {
+			slog.ErrorContext(ctx, "inbound mail", "todo_id", tm.ID, "err", err)
+		}
+	}
+	for _, headers := range r.MultipartForm.File {
+		for _, h := range headers {
+			if h.Size > maxAttachmentSize {
+				slog.WarnContext(ctx, "inbound mail: skipping an attachment too large", "todo_id", tm.ID, "file", h.Filename)
+				continue
+			}
+			f, err := h.Open()
+			if err == nil {
+				_, err = storeAttachment(ctx, tm.ID, u.ID, h.Filename, h.Header.Get("Content-Type"), h.Size, f)
+				f.Close()
+			}
+			if err != nil {
+				slog.ErrorContext(ctx, "inbound mail", "todo_id", tm.ID, "err", err)
+			}
+		}
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"message": translate(r.Context(), "todo created successfully"),
+		"todo_id": tm.ID.String(),
+	})
+}
+
+// inboxUser finds the user whose inbound address is recipient.
+func inboxUser(ctx context.Context, recipient string) (userModel, error) {
+	var u userModel
+	addr, err := mail.ParseAddress(recipient)
+	if err != nil {
+		return u, mongo.ErrNoDocuments
+	}
+	local, domain, _ := strings.Cut(strings.ToLower(addr.Address), "@")
+	// Plus addressing, alias+anything@, reaches the same inbox.
+	local, _, _ = strings.Cut(local, "+")
+	if domain != inboundConf.Domain {
+		return u, mongo.ErrNoDocuments
+	}
+	var a inboxAliasModel
+	if err := db.Collection(inboxAliasesCollection).FindOne(ctx, bson.M{"_id": local}).Decode(&a); err != nil {
+		return u, err
+	}
+	err = db.Collection(usersCollection).FindOne(ctx, bson.M{"_id": a.UserID},
+		options.FindOne().SetProjection(bson.M{"passwordHash": 0})).Decode(&u)
+	return u, err
+}
@@ -0,0 +1,402 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/sangin4208/go-todo/internal/storage"
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// Background work goes through a job queue kept in Mongo, so it survives
+// restarts and is shared by every instance: each job is claimed by one
+// worker at a time and retried with backoff when it fails. Admins inspect
+// and retry jobs under /admin/jobs.
+
+const (
+	jobsCollection string = "jobs"
+
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+
+	// jobLease is how long a worker has to finish a job it claimed before
+	// another may claim it again.
+	jobLease = 5 * time.Minute
+	// A failing job is tried defaultJobAttempts times unless its kind says
+	// otherwise, the wait doubling from jobFirstRetry.
+	defaultJobAttempts = 5
+	jobFirstRetry      = 30 * time.Second
+	// jobRetention is how long finished jobs are kept for inspection.
+	jobRetention = 7 * 24 * time.Hour
+
+	jobExport           = "export"
+	jobWebhookDelivery  = "webhook.delivery"
+	jobReminder         = "reminder"
+	jobDueSoonReminders = "notifications.due-soon"
+	jobDigests          = "notifications.digests"
+	jobSMSReminders     = "notifications.sms"
+)
+
+// jobWorkers is how many jobs an instance runs at once, TODO_JOB_WORKERS.
+var jobWorkers = envInt("TODO_JOB_WORKERS", 4)
+
+// jobKick wakes a worker when a job is queued to run now.
+var jobKick = make(chan struct{}, 1)
+
+// jobKind is how one kind of job is run. Run gets the payload the job was
+// queued with; it is retried when it returns an error, unless the error is
+// permanent. Failed, if set, is called once the job has failed for good.
+type jobKind struct {
+	Run      func(ctx context.Context, payload json.RawMessage) error
+	Attempts int
+	Failed   func(ctx context.Context, payload json.RawMessage, err error)
+}
+
+var jobKinds = map[string]jobKind{
+	jobExport:          {Run: runExport, Attempts: 3, Failed: failExport},
+	jobWebhookDelivery: {Run: runDelivery},
+	jobReminder:        {Run: runScheduledReminder},
+	jobDueSoonReminders: {Run: func(ctx context.Context, _ json.RawMessage) error {
+		return sendReminders(ctx, time.Now())
+	}, Attempts: 1},
+	jobDigests: {Run: func(ctx context.Context, _ json.RawMessage) error {
+		return sendDigests(ctx, time.Now())
+	}, Attempts: 1},
+	jobSMSReminders: {Run: func(ctx context.Context, _ json.RawMessage) error {
+		if !smsEnabled() {
+			return nil
+		}
+		return sendSMSReminders(ctx, time.Now())
+	}, Attempts: 1},
+}
+
+// periodicJobs are queued once per period by the leader, see isLeader;
+// their keys keep a new leader from queueing a period again. Each run
+// catches up on whatever fell due since the last.
+var periodicJobs = []struct {
+	Kind  string
+	Every time.Duration
+}{
+	{jobDueSoonReminders, 15 * time.Minute},
+	{jobDigests, 15 * time.Minute},
+	{jobSMSReminders, 15 * time.Minute},
+}
+
+type (
+	jobModel struct {
+		ID   ID     `bson:"_id"`
+		Kind string `bson:"kind"`
+		// Key is unique among jobs, so queueing a job under a key already
+		// used does nothing. It defaults to the ID.
+		Key     string `bson:"key"`
+		Payload string `bson:"payload,omitempty"`
+		Status  string `bson:"status"`
+		// Attempts counts the runs started so far.
+		Attempts  int    `bson:"attempts"`
+		LastError string `bson:"lastError,omitempty"`
+		// RunAt is when a queued job is next due, and when a running one's
+		// lease lapses.
+		RunAt      time.Time `bson:"runAt"`
+		CreateAt   time.Time `bson:"createAt"`
+		FinishedAt time.Time `bson:"finishedAt,omitempty"`
+		ExpiresAt  time.Time `bson:"expiresAt,omitempty"`
+	}
+	job struct {
+		ID         string          `json:"id"`
+		Kind       string          `json:"kind"`
+		Key        string          `json:"key"`
+		Status     string          `json:"status"`
+		Attempts   int             `json:"attempts"`
+		LastError  string          `json:"lastError,omitempty"`
+		RunAt      string          `json:"runAt,omitempty"`
+		CreateAt   string          `json:"createAt"`
+		FinishedAt string          `json:"finishedAt,omitempty"`
+		Payload    json.RawMessage `json:"payload,omitempty"`
+	}
+)
+
+// permanentError marks a job failure that retrying cannot fix.
+type permanentError struct{ error }
+
+func permanent(err error) error {
+	return permanentError{err}
+}
+
+// enqueueJob queues a job of kind to run at runAt with payload, which is
+// marshaled as JSON. key, if not empty, keeps the job from being queued
+// twice.
+func enqueueJob(ctx context.Context, kind, key string, runAt time.Time, payload interface{}) error {
+	j := jobModel{
+		ID:       newID(),
+		Kind:     kind,
+		Key:      key,
+		Status:   jobQueued,
+		RunAt:    runAt,
+		CreateAt: time.Now(),
+	}
+	if j.Key == "" {
+		j.Key = j.ID.String()
+	}
+	if payload != nil {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		j.Payload = string(b)
+	}
+	_, err := db.Collection(jobsCollection).InsertOne(ctx, &j)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+	if err == nil && !runAt.After(time.Now()) {
+		select {
+		case jobKick <- struct{}{}:
+		default:
+		}
+	}
+	return err
+}
+
+// runJobs starts the workers running jobs as they fall due, and queues the
+// periodic jobs, until ctx is canceled.
+func runJobs(ctx context.Context) {
+	for i := 0; i < jobWorkers; i++ {
+		go jobWorker(ctx)
+	}
+	go schedulePeriodicJobs(ctx)
+}
+
+func jobWorker(ctx context.Context) {
+	poll := time.NewTicker(5 * time.Second)
+	defer poll.Stop()
+	for {
+		for {
+			j, err := claimJob(ctx, time.Now())
+			if err == mongo.ErrNoDocuments {
+				break
+			}
+			if err != nil {
+				slog.Error("jobs", "err", err)
+				break
+			}
+			if err := runJob(ctx, j); err != nil {
+				slog.Error("job failed", "job_id", j.ID, "kind", j.Kind, "err", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-jobKick:
+		case <-poll.C:
+		}
+	}
+}
+
+// claimJob takes the oldest job that is due, or whose worker's lease has
+// lapsed.
+func claimJob(ctx context.Context, now time.Time) (jobModel, error) {
+	var j jobModel
+	err := db.Collection(jobsCollection).FindOneAndUpdate(ctx,
+		bson.M{"status": bson.M{"$in": []string{jobQueued, jobRunning}}, "runAt": bson.M{"$lte": now}},
+		bson.M{
+			"$set": bson.M{"status": jobRunning, "runAt": now.Add(jobLease)},
+			"$inc": bson.M{"attempts": 1},
+		},
+		options.FindOneAndUpdate().SetSort(storage.SortKeys("runAt")).SetReturnDocument(options.After),
+	).Decode(&j)
+	return j, err
+}
+
+// runJob runs a claimed job and records the outcome, queueing a retry
+// after a failure unless attempts have run out.
+func runJob(ctx context.Context, j jobModel) error {
+	k, ok := jobKinds[j.Kind]
+	var err error
+	if !ok {
+		err = permanent(fmt.Errorf("unknown job kind %q", j.Kind))
+	} else {
+		runCtx, cancel := context.WithTimeout(ctx, jobLease)
+		err = k.Run(runCtx, json.RawMessage(j.Payload))
+		cancel()
+	}
+	now := time.Now()
+	var update bson.M
+	attempts := k.Attempts
+	if attempts == 0 {
+		attempts = defaultJobAttempts
+	}
+	switch {
+	case err == nil:
+		update = bson.M{
+			"$set":   bson.M{"status": jobSucceeded, "finishedAt": now, "expiresAt": now.Add(jobRetention)},
+			"$unset": bson.M{"lastError": ""},
+		}
+	case errors.As(err, new(permanentError)) || j.Attempts >= attempts:
+		update = bson.M{"$set": bson.M{
+			"status": jobFailed, "lastError": err.Error(), "finishedAt": now, "expiresAt": now.Add(jobRetention),
+		}}
+		if ok && k.Failed != nil {
+			k.Failed(ctx, json.RawMessage(j.Payload), err)
+		}
+	default:
+		update = bson.M{"$set": bson.M{
+			"status": jobQueued, "lastError": err.Error(), "runAt": now.Add(jobFirstRetry << (j.Attempts - 1)),
+		}}
+	}
+	if _, uerr := db.Collection(jobsCollection).UpdateOne(ctx, bson.M{"_id": j.ID}, update); uerr != nil {
+		return uerr
+	}
+	return err
+}
+
+func schedulePeriodicJobs(ctx context.Context) {
+	tick := time.NewTicker(time.Minute)
+	defer tick.Stop()
+	for now := time.Now(); ; {
+		if isLeader(ctx) {
+			for _, p := range periodicJobs {
+				slot := now.Truncate(p.Every)
+				key := p.Kind + "@" + slot.UTC().Format(time.RFC3339)
+				if err := enqueueJob(ctx, p.Kind, key, slot, nil); err != nil {
+					slog.Error("jobs: queueing", "kind", p.Kind, "err", err)
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case now = <-tick.C:
+		}
+	}
+}
+
+// jobHandlers is mounted under /admin/jobs.
+func jobHandlers() http.Handler {
+	rg := chi.NewRouter()
+	rg.Get("/", fetchJobs)
+	rg.Get("/{jobId}", fetchJob)
+	rg.Post("/{jobId}/retry", retryJob)
+	return rg
+}
+
+// fetchJobs pages through jobs, newest first, optionally filtered by
+// ?status= and ?kind=, leaving out payloads.
+func fetchJobs(w http.ResponseWriter, r *http.Request) {
+	filter := bson.M{}
+	if status := r.URL.Query().Get("status"); status != "" {
+		filter["status"] = status
+	}
+	if kind := r.URL.Query().Get("kind"); kind != "" {
+		filter["kind"] = kind
+	}
+	skip, limit := pagination(r)
+	var jobs []jobModel
+	total, err := storage.FindPage(r.Context(), db.Collection(jobsCollection), filter, "-createAt", skip, limit, &jobs)
+	if err != nil {
+		writeError(w, r, internalError("error fetching jobs", err))
+		return
+	}
+	data := []job{}
+	for _, j := range jobs {
+		out := toJob(j)
+		out.Payload = nil
+		data = append(data, out)
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"data":   data,
+		"total":  total,
+		"offset": skip,
+		"limit":  limit,
+	})
+}
+
+func fetchJob(w http.ResponseWriter, r *http.Request) {
+	j, ok := findJob(w, r)
+	if !ok {
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"data": toJob(j),
+	})
+}
+
+// retryJob queues a failed job to run again now, with a fresh set of
+// attempts.
+func retryJob(w http.ResponseWriter, r *http.Request) {
+	j, ok := findJob(w, r)
+	if !ok {
+		return
+	}
+	err := updateOne(r.Context(), db.Collection(jobsCollection), bson.M{"_id": j.ID, "status": jobFailed}, bson.M{
+		"$set":   bson.M{"status": jobQueued, "attempts": 0, "runAt": time.Now()},
+		"$unset": bson.M{"finishedAt": "", "expiresAt": ""},
+	})
+	if err == mongo.ErrNoDocuments {
+		writeError(w, r, apiErr(http.StatusConflict, "only failed jobs can be retried"))
+		return
+	}
+	if err != nil {
+		writeError(w, r, internalError("error retrying job", err))
+		return
+	}
+	select {
+	case jobKick <- struct{}{}:
+	default:
+	}
+	render(r).JSON(w, http.StatusAccepted, renderer.M{
+		"message": translate(r.Context(), "job queued"),
+	})
+}
+
+func findJob(w http.ResponseWriter, r *http.Request) (jobModel, bool) {
+	var j jobModel
+	id := strings.TrimSpace(chi.URLParam(r, "jobId"))
+	if !validID(id) {
+		writeError(w, r, apiErr(http.StatusBadRequest, "The job id is invalid"))
+		return j, false
+	}
+	err := db.Collection(jobsCollection).FindOne(r.Context(), bson.M{"_id": toID(id)}).Decode(&j)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, r, apiErr(http.StatusNotFound, "job not found"))
+		return j, false
+	}
+	if err != nil {
+		writeError(w, r, internalError("error fetching job", err))
+		return j, false
+	}
+	return j, true
+}
+
+func toJob(j jobModel) job {
+	out := job{
+		ID:        j.ID.String(),
+		Kind:      j.Kind,
+		Key:       j.Key,
+		Status:    j.Status,
+		Attempts:  j.Attempts,
+		LastError: j.LastError,
+		CreateAt:  j.CreateAt.UTC().Format(time.RFC3339),
+	}
+	if j.Status == jobQueued || j.Status == jobRunning {
+		out.RunAt = j.RunAt.UTC().Format(time.RFC3339)
+	}
+	if !j.FinishedAt.IsZero() {
+		out.FinishedAt = j.FinishedAt.UTC().Format(time.RFC3339)
+	}
+	if j.Payload != "" {
+		out.Payload = json.RawMessage(j.Payload)
+	}
+	return out
+}
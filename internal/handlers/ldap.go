@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+var errLDAPUserNotFound = errors.New("ldap: user not found")
+
+// ldapConfig is read from TODO_LDAP_* environment variables. LDAP login is
+// disabled unless TODO_LDAP_URL and TODO_LDAP_BASE_DN are set.
+type ldapConfig struct {
+	URL          string
+	BaseDN       string
+	Filter       string
+	BindDN       string
+	BindPassword string
+	EmailAttr    string
+	StartTLS     bool
+	SkipVerify   bool
+}
+
+var ldapConf *ldapConfig
+
+func init() {
+	url, base := envString("TODO_LDAP_URL", ""), envString("TODO_LDAP_BASE_DN", "")
+	if url == "" || base == "" {
+		return
+	}
+	ldapConf = &ldapConfig{
+		URL:          url,
+		BaseDN:       base,
+		Filter:       envString("TODO_LDAP_FILTER", ""),
+		BindDN:       envString("TODO_LDAP_BIND_DN", ""),
+		BindPassword: envString("TODO_LDAP_BIND_PASSWORD", ""),
+		EmailAttr:    envString("TODO_LDAP_EMAIL_ATTR", ""),
+		StartTLS:     envBool("TODO_LDAP_STARTTLS"),
+		SkipVerify:   envBool("TODO_LDAP_INSECURE_SKIP_VERIFY"),
+	}
+	if ldapConf.Filter == "" {
+		ldapConf.Filter = "(|(uid=%[1]s)(mail=%[1]s)(sAMAccountName=%[1]s))"
+	}
+	if ldapConf.EmailAttr == "" {
+		ldapConf.EmailAttr = "mail"
+	}
+}
+
+// ldapAuthenticate looks the user up with the service account, then binds
+// as that user to check the password. It returns the user's DN and email.
+func ldapAuthenticate(username, password string) (string, string, error) {
+	if password == "" {
+		// An empty password would be an unauthenticated bind, which many
+		// servers accept.
+		return "", "", ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("ldap: empty password"))
+	}
+	conn, err := ldap.DialURL(ldapConf.URL, ldap.DialWithTLSConfig(&tls.Config{
+		InsecureSkipVerify: ldapConf.SkipVerify,
+	}))
+	if err != nil {
+		return "", "", err
+	}
+	defer conn.Close()
+	if ldapConf.StartTLS {
+		if err := conn.StartTLS(&tls.Config{InsecureSkipVerify: ldapConf.SkipVerify}); err != nil {
+			return "", "", err
+		}
+	}
+	if ldapConf.BindDN != "" {
+		if err := conn.Bind(ldapConf.BindDN, ldapConf.BindPassword); err != nil {
+			return "", "", err
+		}
+	}
+
+	res, err := conn.Search(ldap.NewSearchRequest(
+		ldapConf.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(ldapConf.Filter, ldap.EscapeFilter(username)),
+		[]string{"dn", ldapConf.EmailAttr},
+		nil,
+	))
+	if err != nil {
+		return "", "", err
+	}
+	if len(res.Entries) != 1 {
+		return "", "", errLDAPUserNotFound
+	}
+	entry := res.Entries[0]
+	if err := conn.Bind(entry.DN, password); err != nil {
+		return "", "", err
+	}
+	return entry.DN, strings.ToLower(entry.GetAttributeValue(ldapConf.EmailAttr)), nil
+}
@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// With several instances sharing a database, the schedulers that scan for
+// work (queueing periodic jobs, expiring todos, removing demo workspaces)
+// run only on the leader, the instance holding the scheduler lease in
+// Mongo. The leader renews the lease well before it runs out; if it dies,
+// another instance takes over once it has.
+
+const (
+	leasesCollection string = "leases"
+	schedulerLease          = "scheduler"
+	// leaseTTL is how long a lease lasts unless renewed, and so how long
+	// schedulers may pause when the leader dies.
+	leaseTTL = 30 * time.Second
+)
+
+// instanceID names this instance as a lease holder, TODO_INSTANCE_ID or
+// the host name and process ID.
+var instanceID = envString("TODO_INSTANCE_ID", defaultInstanceID())
+
+func init() {
+	expvar.Publish("leader", expvar.Func(func() interface{} {
+		return map[string]interface{}{"instance": instanceID, "leading": command != nil && command.leading.Load()}
+	}))
+}
+
+type leaseModel struct {
+	Name      string    `bson:"_id"`
+	Holder    string    `bson:"holder"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+func defaultInstanceID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "todo"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// isLeader reports whether the schedulers should run on the instance ctx
+// belongs to.
+func isLeader(ctx context.Context) bool {
+	return serverFrom(ctx).leading.Load()
+}
+
+// campaign keeps trying to take or renew the scheduler lease until ctx is
+// canceled. Losing touch with Mongo for longer than the lease lasts gives
+// up leadership, as another instance may since have taken it.
+func campaign(ctx context.Context) {
+	leading := &serverFrom(ctx).leading
+	var renewed time.Time
+	for {
+		ok, err := acquireLease(ctx, schedulerLease, leaseTTL)
+		switch {
+		case err != nil:
+			slog.Error("leader election", "err", err)
+			if time.Since(renewed) >= leaseTTL && leading.Swap(false) {
+				slog.Warn("leader election: lost the scheduler lease")
+			}
+		case ok:
+			renewed = time.Now()
+			if !leading.Swap(true) {
+				slog.Info("leader election: leading the schedulers", "instance", instanceID)
+			}
+		default:
+			if leading.Swap(false) {
+				slog.Warn("leader election: lost the scheduler lease")
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(leaseTTL / 3):
+		}
+	}
+}
+
+// acquireLease takes the named lease for ttl, or extends it if this
+// instance holds it already, and reports whether it did. Another holder's
+// lease can only be taken once it has run out.
+func acquireLease(ctx context.Context, name string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	_, err := db.Collection(leasesCollection).UpdateOne(ctx,
+		bson.M{"_id": name, "$or": []bson.M{{"holder": instanceID}, {"expiresAt": bson.M{"$lte": now}}}},
+		bson.M{"$set": bson.M{"holder": instanceID, "expiresAt": now.Add(ttl)}},
+		options.UpdateOne().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		// The lease exists and is held by another instance.
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// releaseLeases gives up this instance's leases on shutdown, so another
+// instance takes over without waiting for them to run out.
+func releaseLeases(ctx context.Context) {
+	serverFrom(ctx).leading.Store(false)
+	if _, err := db.Collection(leasesCollection).DeleteMany(ctx, bson.M{"holder": instanceID}); err != nil {
+		slog.Error("leader election", "err", err)
+	}
+}
@@ -0,0 +1,226 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Besides host:port, TODO_ADDR and TODO_GRPC_ADDR take
+//
+//   - unix:/path/to/socket, to listen on a Unix domain socket for a reverse
+//     proxy on the same host. The socket is created with the permissions
+//     TODO_SOCKET_MODE, 0660 by default, so that only the proxy's group
+//     may connect.
+//   - systemd, to serve on a socket systemd passes in through socket
+//     activation. With several sockets, a FileDescriptorName= of http or
+//     grpc tells them apart; otherwise HTTP gets the first and gRPC the
+//     second.
+
+const (
+	unixAddrPrefix = "unix:"
+	systemdAddr    = "systemd"
+	// listenFDsStart is the first file descriptor systemd passes.
+	listenFDsStart = 3
+)
+
+var socketMode = envString("TODO_SOCKET_MODE", "0660")
+
+// checkListenAddr reports why addr cannot be listened on, if it cannot.
+func checkListenAddr(addr string) error {
+	if isTCPAddr(addr) {
+		_, _, err := net.SplitHostPort(addr)
+		return err
+	}
+	if addr != systemdAddr && strings.TrimPrefix(addr, unixAddrPrefix) == "" {
+		return errors.New("the socket path is missing")
+	}
+	return nil
+}
+
+func isTCPAddr(addr string) bool {
+	return addr != systemdAddr && !strings.HasPrefix(addr, unixAddrPrefix)
+}
+
+// listeners are the open listeners by service, handed over on upgrades.
+var (
+	listenersMu sync.Mutex
+	listeners   = map[string]net.Listener{}
+)
+
+// listen opens the listener for addr. name is the service it is for, http,
+// grpc or redirect, which picks the socket under systemd or passed on by
+// the process this one is upgrading.
+func listen(addr, name string) (net.Listener, error) {
+	lis, err := inheritedListener(name)
+	switch {
+	case err != nil || lis != nil:
+	case addr == systemdAddr:
+		lis, err = systemdListener(name)
+	case strings.HasPrefix(addr, unixAddrPrefix):
+		lis, err = listenUnix(strings.TrimPrefix(addr, unixAddrPrefix))
+	default:
+		lis, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	listenersMu.Lock()
+	listeners[name] = lis
+	listenersMu.Unlock()
+	return lis, nil
+}
+
+func listenUnix(path string) (net.Listener, error) {
+	mode, err := strconv.ParseUint(socketMode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("TODO_SOCKET_MODE: %q is not an octal mode", socketMode)
+	}
+	// A socket left behind by a process that did not shut down cleanly
+	// would make the listen fail.
+	if fi, err := os.Stat(path); err == nil && fi.Mode().Type() == fs.ModeSocket {
+		os.Remove(path)
+	}
+	lis, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, fs.FileMode(mode)); err != nil {
+		lis.Close()
+		return nil, err
+	}
+	return lis, nil
+}
+
+// systemdListener takes the socket systemd passed for name, following the
+// sd_listen_fds protocol: LISTEN_PID names the process the sockets are
+// for, LISTEN_FDS counts them from fd 3 and LISTEN_FDNAMES names them.
+func systemdListener(name string) (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, errors.New("no sockets passed by systemd")
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, errors.New("no sockets passed by systemd")
+	}
+	i := -1
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for j, fdName := range names {
+		if fdName == name && j < n {
+			i = j
+		}
+	}
+	if i < 0 {
+		// Unnamed sockets go in the order HTTP, gRPC.
+		i = map[string]int{"http": 0, "grpc": 1}[name]
+		if i >= n {
+			return nil, fmt.Errorf("systemd passed no socket for %s", name)
+		}
+	}
+	f := os.NewFile(uintptr(listenFDsStart+i), name)
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// upgradeEnv lists the services whose listeners an upgrading process
+// passed on, in the order of their file descriptors from fd 3. The
+// descriptor after them is a pipe to close once serving.
+const upgradeEnv = "TODO_UPGRADE_LISTENERS"
+
+var inherited = strings.Split(os.Getenv(upgradeEnv), ",")
+
+func inheritedListener(name string) (net.Listener, error) {
+	if os.Getenv(upgradeEnv) == "" {
+		return nil, nil
+	}
+	for i, n := range inherited {
+		if n == name {
+			f := os.NewFile(uintptr(listenFDsStart+i), name)
+			defer f.Close()
+			return net.FileListener(f)
+		}
+	}
+	return nil, nil
+}
+
+// upgradeReady tells the process being upgraded, if any, that this one is
+// serving and it can shut down.
+func upgradeReady() {
+	if os.Getenv(upgradeEnv) == "" {
+		return
+	}
+	f := os.NewFile(uintptr(listenFDsStart+len(inherited)), "ready")
+	f.Write([]byte{1})
+	f.Close()
+	os.Unsetenv(upgradeEnv)
+}
+
+// closeListeners stops accepting connections, leaving them to the process
+// that was passed the listeners. The servers carry on with the connections
+// they have.
+func closeListeners() {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	for _, lis := range listeners {
+		lis.Close()
+	}
+}
+
+// listenerFiles duplicates the open listeners for passing to a new
+// process, returning their services in the same order.
+func listenerFiles() ([]string, []*os.File, error) {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	var names []string
+	var files []*os.File
+	for name, lis := range listeners {
+		if u, ok := lis.(*net.UnixListener); ok {
+			// The socket must outlive this process closing it.
+			u.SetUnlinkOnClose(false)
+		}
+		fl, ok := lis.(interface{ File() (*os.File, error) })
+		if !ok {
+			continue
+		}
+		f, err := fl.File()
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, nil, err
+		}
+		names = append(names, name)
+		files = append(files, f)
+	}
+	return names, files, nil
+}
+
+// pidFile, TODO_PID_FILE, receives the process ID once the server is
+// serving, so that supervisors can follow upgrades.
+var pidFile = envString("TODO_PID_FILE", "")
+
+func writePIDFile() {
+	if pidFile == "" {
+		return
+	}
+	if err := os.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644); err != nil {
+		slog.Error("pid file", "err", err)
+	}
+}
+
+// removePIDFile removes the PID file on shutdown unless a new process has
+// taken it over.
+func removePIDFile() {
+	if pidFile == "" {
+		return
+	}
+	if b, err := os.ReadFile(pidFile); err == nil && strings.TrimSpace(string(b)) == strconv.Itoa(os.Getpid()) {
+		os.Remove(pidFile)
+	}
+}
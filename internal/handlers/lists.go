@@ -0,0 +1,358 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/sangin4208/go-todo/internal/storage"
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	listsCollection string = "lists"
+	permissionRead         = "read"
+	permissionWrite        = "write"
+)
+
+var errListNotFound = errors.New("list not found")
+
+type (
+	listMember struct {
+		UserID     ID     `bson:"userId" json:"userId"`
+		Permission string `bson:"permission" json:"permission"`
+	}
+	listModel struct {
+		ID          ID           `bson:"_id,omitempty"`
+		WorkspaceID ID           `bson:"workspaceId"`
+		OwnerID     ID           `bson:"ownerId"`
+		Name        string       `bson:"name"`
+		Members     []listMember `bson:"members"`
+		Slack       *listSlack   `bson:"slack,omitempty"`
+		CreateAt    time.Time    `bson:"createAt"`
+	}
+	list struct {
+		ID       string       `json:"id"`
+		OwnerID  string       `json:"ownerId"`
+		Name     string       `json:"name"`
+		Members  []listMember `json:"members"`
+		CreateAt string       `json:"createAt"`
+	}
+)
+
+func listHandlers() http.Handler {
+	rg := chi.NewRouter()
+	rg.Group(func(r chi.Router) {
+		r.With(cacheResponses).Get("/", fetchLists)
+		r.Group(func(r chi.Router) {
+			r.Use(requireRole(roleAdmin, roleMember))
+			r.Post("/", createList)
+			r.Delete("/{id}", deleteList)
+			r.Post("/{id}/members", addListMember)
+			r.Delete("/{id}/members/{userId}", removeListMember)
+			r.Put("/{id}/slack", connectListSlack)
+			r.Delete("/{id}/slack", disconnectListSlack)
+		})
+	})
+	return rg
+}
+
+func fetchLists(w http.ResponseWriter, r *http.Request) {
+	p := currentPrincipal(r.Context())
+	filter := bson.M{"$or": []bson.M{
+		{"ownerId": p.UserID},
+		{"members.userId": p.UserID},
+	}}
+	if !p.ListID.IsZero() {
+		filter["_id"] = p.ListID
+	}
+	var lists []listModel
+	if err := storage.FindAll(r.Context(), db.Collection(listsCollection), filter, &lists, options.Find().SetSort(storage.SortKeys("name"))); err != nil {
+		writeError(w, r, internalError("error fetching lists", err))
+		return
+	}
+	data := []list{}
+	for _, l := range lists {
+		data = append(data, toList(r.Context(), l))
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"data": data,
+	})
+}
+
+func createList(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name string `json:"name" validate:"notblank,max=200"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	err := checkQuota(liveConf().MaxLists, func() (int, error) {
+		return countOwnedLists(r.Context(), currentUser(r.Context()))
+	})
+	if err == errQuotaExceeded {
+		quotaExceeded(w, r, "list")
+		return
+	}
+	if err != nil {
+		writeError(w, r, internalError("error creating list", err))
+		return
+	}
+	l := listModel{
+		ID:          newID(),
+		WorkspaceID: currentWorkspace(r.Context()),
+		OwnerID:     currentUser(r.Context()),
+		Name:        req.Name,
+		Members:     []listMember{},
+		CreateAt:    time.Now(),
+	}
+	if _, err := db.Collection(listsCollection).InsertOne(r.Context(), &l); err != nil {
+		writeError(w, r, internalError("error creating list", err))
+		return
+	}
+	render(r).JSON(w, http.StatusCreated, renderer.M{
+		"message": translate(r.Context(), "list created successfully"),
+		"list_id": l.ID.String(),
+	})
+}
+
+func deleteList(w http.ResponseWriter, r *http.Request) {
+	l, ok := ownedList(w, r)
+	if !ok {
+		return
+	}
+	// The list's todos go the way removeTodo sends each one: tombstoned,
+	// announced and recorded in the activity feed.
+	ctx := r.Context()
+	var gone []todoModel
+	err := atomically(ctx, func(ctx context.Context) error {
+		var err error
+		gone, err = serverFrom(ctx).todos.DeleteMany(ctx, todoScope{WorkspaceID: l.WorkspaceID, ListIDs: []ID{l.ID}}, TodoFilter{ListID: l.ID})
+		if err != nil {
+			return err
+		}
+		if err := recordTombstones(ctx, gone...); err != nil {
+			return err
+		}
+		for _, tm := range gone {
+			if err := recordEvent(ctx, eventDeleted, tm); err != nil {
+				return err
+			}
+		}
+		return deleteOne(ctx, db.Collection(listsCollection), bson.M{"_id": l.ID})
+	})
+	if err != nil {
+		writeError(w, r, internalError("error deleting list", err))
+		return
+	}
+	ids := make([]ID, len(gone))
+	for i, tm := range gone {
+		ids[i] = tm.ID
+		publishChange(ctx, eventDeleted, tm)
+		recordActivity(ctx, currentUser(ctx), eventDeleted, tm, todoModel{})
+	}
+	if len(ids) > 0 {
+		if _, err := deleteAttachments(ctx, bson.M{"todoId": bson.M{"$in": ids}}); err != nil {
+			slog.ErrorContext(ctx, "deleting attachments", "list_id", l.ID, "err", err)
+		}
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"message": translate(r.Context(), "list deleted successfully"),
+	})
+}
+
+func addListMember(w http.ResponseWriter, r *http.Request) {
+	l, ok := ownedList(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Email      string `json:"email" validate:"required,email"`
+		Permission string `json:"permission" validate:"oneof=read write"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	var u userModel
+	err := db.Collection(usersCollection).FindOne(r.Context(), bson.M{
+		"workspaceId": l.WorkspaceID,
+		"email":       strings.ToLower(strings.TrimSpace(req.Email)),
+	}).Decode(&u)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, r, apiErr(http.StatusNotFound, "user not found"))
+		return
+	}
+	if err != nil {
+		writeError(w, r, internalError("error adding member", err))
+		return
+	}
+	if u.ID == l.OwnerID {
+		writeError(w, r, apiErr(http.StatusBadRequest, "the owner is already a member"))
+		return
+	}
+	c := db.Collection(listsCollection)
+	err = updateOne(r.Context(), c, bson.M{"_id": l.ID}, bson.M{"$pull": bson.M{"members": bson.M{"userId": u.ID}}})
+	if err == nil {
+		err = updateOne(r.Context(), c, bson.M{"_id": l.ID}, bson.M{"$push": bson.M{"members": listMember{
+			UserID:     u.ID,
+			Permission: req.Permission,
+		}}})
+	}
+	if err != nil {
+		writeError(w, r, internalError("error adding member", err))
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"message": translate(r.Context(), "member added successfully"),
+		"user_id": u.ID.String(),
+	})
+}
+
+func removeListMember(w http.ResponseWriter, r *http.Request) {
+	l, ok := ownedList(w, r)
+	if !ok {
+		return
+	}
+	userID := strings.TrimSpace(chi.URLParam(r, "userId"))
+	if !validID(userID) {
+		writeError(w, r, apiErr(http.StatusBadRequest, "The user id is invalid"))
+		return
+	}
+	if err := updateOne(r.Context(), db.Collection(listsCollection), bson.M{"_id": l.ID}, bson.M{
+		"$pull": bson.M{"members": bson.M{"userId": toID(userID)}},
+	}); err != nil {
+		writeError(w, r, internalError("error removing member", err))
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"message": translate(r.Context(), "member removed successfully"),
+	})
+}
+
+// ownedList loads the {id} list if the caller owns it, writing an error
+// response otherwise. Lists shared with the caller still report 404.
+func ownedList(w http.ResponseWriter, r *http.Request) (listModel, bool) {
+	var l listModel
+	id := strings.TrimSpace(chi.URLParam(r, "id"))
+	if !validID(id) {
+		writeError(w, r, apiErr(http.StatusBadRequest, "The id is invalid"))
+		return l, false
+	}
+	err := db.Collection(listsCollection).FindOne(r.Context(), bson.M{
+		"_id":     toID(id),
+		"ownerId": currentUser(r.Context()),
+	}).Decode(&l)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, r, apiErr(http.StatusNotFound, "list not found"))
+		return l, false
+	}
+	if err != nil {
+		writeError(w, r, internalError("error fetching list", err))
+		return l, false
+	}
+	return l, true
+}
+
+// accessibleLists returns the IDs of lists user owns or is a member of.
+// With write set, read-only memberships are excluded. List-scoped API keys
+// only ever see their list.
+func accessibleLists(ctx context.Context, p principal, write bool) ([]ID, error) {
+	member := bson.M{"userId": p.UserID}
+	if write {
+		member["permission"] = permissionWrite
+	}
+	filter := bson.M{
+		"workspaceId": p.WorkspaceID,
+		"$or": []bson.M{
+			{"ownerId": p.UserID},
+			{"members": bson.M{"$elemMatch": member}},
+		},
+	}
+	if !p.ListID.IsZero() {
+		filter["_id"] = p.ListID
+	}
+	var lists []listModel
+	err := storage.FindAll(ctx, db.Collection(listsCollection), filter, &lists, options.Find().SetProjection(bson.M{"_id": 1}))
+	ids := make([]ID, 0, len(lists))
+	for _, l := range lists {
+		ids = append(ids, l.ID)
+	}
+	return ids, err
+}
+
+// todoAccess resolves the todos p may read (or write): their own plus
+// those in lists shared with them, and never outside their workspace.
+func todoAccess(ctx context.Context, p principal, write bool) (todoScope, error) {
+	lists, err := accessibleLists(ctx, p, write)
+	s := todoScope{WorkspaceID: p.WorkspaceID, ListIDs: lists}
+	if !p.ListID.IsZero() {
+		return s, err
+	}
+	s.OwnerID = p.UserID
+	if !write {
+		// Assignees can always see what they have been asked to do.
+		s.AssigneeID = p.UserID
+	}
+	return s, err
+}
+
+func canWriteList(ctx context.Context, p principal, listID ID) (bool, error) {
+	lists, err := accessibleLists(ctx, p, true)
+	return containsID(lists, listID), err
+}
+
+func containsID(ids []ID, id ID) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// isListMember reports whether user owns or belongs to listID.
+func isListMember(ctx context.Context, user, listID ID) (bool, error) {
+	n, err := db.Collection(listsCollection).CountDocuments(ctx, bson.M{
+		"_id": listID,
+		"$or": []bson.M{{"ownerId": user}, {"members.userId": user}},
+	})
+	return n > 0, err
+}
+
+// audience lists everyone who can see tm, used to route change events.
+func audience(ctx context.Context, tm todoModel) []ID {
+	users := []ID{tm.UserID}
+	if !tm.AssigneeID.IsZero() {
+		users = append(users, tm.AssigneeID)
+	}
+	if tm.ListID.IsZero() {
+		return users
+	}
+	var l listModel
+	if err := db.Collection(listsCollection).FindOne(ctx, bson.M{"_id": tm.ListID}).Decode(&l); err != nil {
+		return users
+	}
+	users = append(users, l.OwnerID)
+	for _, m := range l.Members {
+		users = append(users, m.UserID)
+	}
+	return users
+}
+
+func toList(ctx context.Context, l listModel) list {
+	return list{
+		ID:       l.ID.String(),
+		OwnerID:  l.OwnerID.String(),
+		Name:     l.Name,
+		Members:  l.Members,
+		CreateAt: formatTime(ctx, l.CreateAt),
+	}
+}
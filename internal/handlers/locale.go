@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"golang.org/x/text/language"
+)
+
+// Messages, in API responses and on the pages, are answered in the
+// language the caller prefers by Accept-Language, from the catalogs under
+// locales/ in the assets. Each is a JSON file named after its language,
+// such as de.json, mapping English messages, or their fmt formats, to
+// translations. Messages a catalog lacks stay English.
+//
+// Timestamps are sent as RFC 3339 in the caller's time zone, which they
+// set with PUT /account/settings, or in UTC.
+
+type localeKey struct{}
+
+// locale is how a request is answered. Its zone is looked up the first
+// time it is needed, as most requests format no timestamps.
+type locale struct {
+	lang     language.Tag
+	zoneOnce sync.Once
+	zone     *time.Location
+}
+
+// catalog holds the translations of every language there is a file for.
+type catalog struct {
+	// tags lists the languages, English first as the fallback.
+	tags     []language.Tag
+	matcher  language.Matcher
+	messages map[language.Tag]map[string]string
+}
+
+var catalogs = sync.OnceValue(loadCatalogs)
+
+func loadCatalogs() catalog {
+	c := catalog{tags: []language.Tag{language.English}, messages: map[language.Tag]map[string]string{}}
+	files, _ := fs.Glob(assets(), "locales/*.json")
+	for _, file := range files {
+		tag, err := language.Parse(strings.TrimSuffix(path.Base(file), ".json"))
+		var messages map[string]string
+		if err == nil {
+			var b []byte
+			if b, err = fs.ReadFile(assets(), file); err == nil {
+				err = json.Unmarshal(b, &messages)
+			}
+		}
+		if err != nil {
+			slog.Error("i18n: skipping catalog", "file", file, "err", err)
+			continue
+		}
+		c.tags = append(c.tags, tag)
+		c.messages[tag] = messages
+	}
+	c.matcher = language.NewMatcher(c.tags)
+	return c
+}
+
+// matchLanguage picks the catalog best serving an Accept-Language header.
+func matchLanguage(accept string) language.Tag {
+	c := catalogs()
+	prefs, _, err := language.ParseAcceptLanguage(accept)
+	if err != nil || len(prefs) == 0 {
+		return language.English
+	}
+	_, i, _ := c.matcher.Match(prefs...)
+	return c.tags[i]
+}
+
+// localize sets the language requests are answered in.
+func localize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l := &locale{lang: matchLanguage(r.Header.Get("Accept-Language"))}
+		w.Header().Set("Content-Language", l.lang.String())
+		w.Header().Add("Vary", "Accept-Language")
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), localeKey{}, l)))
+	})
+}
+
+// requestLang is the language ctx's request is answered in, English
+// outside of requests.
+func requestLang(ctx context.Context) language.Tag {
+	if l, ok := ctx.Value(localeKey{}).(*locale); ok {
+		return l.lang
+	}
+	return language.English
+}
+
+// translate returns msg in the language of ctx's request. With args, msg
+// is a format and the translation is formatted with them.
+func translate(ctx context.Context, msg string, args ...any) string {
+	return translateTo(requestLang(ctx), msg, args...)
+}
+
+func translateTo(lang language.Tag, msg string, args ...any) string {
+	if t := catalogs().messages[lang][msg]; t != "" {
+		msg = t
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(msg, args...)
+	}
+	return msg
+}
+
+// requestZone is the time zone of the caller of ctx's request, UTC for
+// anonymous callers and outside of requests. It is looked up on first
+// use, which comes after authentication.
+func requestZone(ctx context.Context) *time.Location {
+	l, ok := ctx.Value(localeKey{}).(*locale)
+	if !ok {
+		return time.UTC
+	}
+	l.zoneOnce.Do(func() { l.zone = userZone(ctx, currentUser(ctx)) })
+	return l.zone
+}
+
+// withZone returns ctx with timestamps formatted in loc, for work done on
+// behalf of a user outside of their requests, such as exports.
+func withZone(ctx context.Context, loc *time.Location) context.Context {
+	l := &locale{lang: requestLang(ctx)}
+	l.zoneOnce.Do(func() { l.zone = loc })
+	return context.WithValue(ctx, localeKey{}, l)
+}
+
+// formatTime formats t as RFC 3339 in the time zone of ctx's caller, and
+// the zero time as nothing.
+func formatTime(ctx context.Context, t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.In(requestZone(ctx)).Format(time.RFC3339)
+}
+
+// userZoneTTL is how long users' time zones are remembered, and so how
+// long other instances may take to notice a change.
+const userZoneTTL = time.Minute
+
+var userZones = struct {
+	sync.Mutex
+	m map[ID]cachedZone
+}{m: map[ID]cachedZone{}}
+
+type cachedZone struct {
+	loc     *time.Location
+	expires time.Time
+}
+
+// userZone looks up the user's time zone, falling back to UTC if they
+// cannot be read.
+func userZone(ctx context.Context, id ID) *time.Location {
+	if id.IsZero() {
+		return time.UTC
+	}
+	now := time.Now()
+	userZones.Lock()
+	c, ok := userZones.m[id]
+	userZones.Unlock()
+	if ok && now.Before(c.expires) {
+		return c.loc
+	}
+	var u userModel
+	if err := db.Collection(usersCollection).FindOne(ctx, bson.M{"_id": id},
+		options.FindOne().SetProjection(bson.M{"timeZone": 1})).Decode(&u); err != nil {
+		return time.UTC
+	}
+	loc := u.location()
+	userZones.Lock()
+	defer userZones.Unlock()
+	if len(userZones.m) >= 10000 {
+		for k, c := range userZones.m {
+			if now.After(c.expires) {
+				delete(userZones.m, k)
+			}
+		}
+	}
+	userZones.m[id] = cachedZone{loc, now.Add(userZoneTTL)}
+	return loc
+}
+
+// forgetUserZone drops what was answered in the user's time zone once
+// they change it: the zone remembered and their cached responses.
+func forgetUserZone(ctx context.Context, id ID) {
+	userZones.Lock()
+	delete(userZones.m, id)
+	userZones.Unlock()
+	serverFrom(ctx).responses.forget(id)
+}
@@ -0,0 +1,190 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Logs are written to stderr as one JSON object per line, or as logfmt
+// text with TODO_LOG_FORMAT=text, for aggregators to index by field.
+// Messages below the live TODO_LOG_LEVEL are dropped. Whatever is still
+// written through the log package comes out at info.
+
+var logFormat = envString("TODO_LOG_FORMAT", "json")
+
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// logLevel follows the live settings, so a reload changes it.
+var logLevel slog.LevelVar
+
+// logger is installed as the default while the package is initialized, so
+// that init functions log through it too. Its level is info until the
+// live settings are read.
+var logger = newLogger()
+
+func newLogger() *slog.Logger {
+	opts := &slog.HandlerOptions{Level: &logLevel}
+	var h slog.Handler = slog.NewJSONHandler(os.Stderr, opts)
+	if logFormat == "text" {
+		h = slog.NewTextHandler(os.Stderr, opts)
+	}
+	l := slog.New(contextHandler{h})
+	slog.SetDefault(l)
+	return l
+}
+
+// fatal logs msg at error and exits, for failures the server cannot start
+// with.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// contextHandler adds the request ID and trace ID of the context a message
+// is logged with, for it to be found along with the rest of the request.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if id := middleware.GetReqID(ctx); id != "" {
+		rec.AddAttrs(slog.String("request_id", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		rec.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, rec)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// requestLog gathers what only handlers deeper in the chain learn about a
+// request for requestLogger to log once it is served.
+type requestLog struct {
+	user ID
+	err  error
+}
+
+type requestLogKey struct{}
+
+// noteRequestUser records the authenticated user for the request log.
+func noteRequestUser(ctx context.Context, user ID) {
+	if rl, ok := ctx.Value(requestLogKey{}).(*requestLog); ok {
+		rl.user = user
+	}
+}
+
+// noteRequestError records the cause of a server error for the request
+// log, the client being told less.
+func noteRequestError(ctx context.Context, err error) {
+	if rl, ok := ctx.Value(requestLogKey{}).(*requestLog); ok {
+		rl.err = err
+	}
+}
+
+// requestUser returns the user noted for the request log, if any.
+func requestUser(ctx context.Context) ID {
+	if rl, ok := ctx.Value(requestLogKey{}).(*requestLog); ok {
+		return rl.user
+	}
+	return ""
+}
+
+// requestLogger logs each request once it is served: at info, or at error
+// for server errors, along with their cause or else the error the JSON
+// response gave.
+func requestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rl := &requestLog{}
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		body := &serverErrorBody{ww: ww}
+		ww.Tee(body)
+		next.ServeHTTP(ww, r.WithContext(context.WithValue(r.Context(), requestLogKey{}, rl)))
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		level := slog.LevelInfo
+		if status >= 500 {
+			level = slog.LevelError
+		}
+		ctx := r.Context()
+		if !logger.Enabled(ctx, level) {
+			return
+		}
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", status),
+			slog.Int("bytes", ww.BytesWritten()),
+			slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("remote", r.RemoteAddr),
+		}
+		if rctx := chi.RouteContext(ctx); rctx != nil && rctx.RoutePattern() != "" {
+			attrs = append(attrs, slog.String("route", rctx.RoutePattern()))
+		}
+		if !rl.user.IsZero() {
+			attrs = append(attrs, slog.String("user_id", rl.user.String()))
+		}
+		if rl.err != nil {
+			attrs = append(attrs, slog.String("error", rl.err.Error()))
+		} else if msg := body.error(); msg != "" {
+			attrs = append(attrs, slog.String("error", msg))
+		}
+		slog.LogAttrs(ctx, level, "request", attrs...)
+	})
+}
+
+// maxErrorBody is how much of a server error's response is kept to find
+// the error in.
+const maxErrorBody = 4 << 10
+
+// serverErrorBody keeps the start of the response body when the status is
+// a server error; other responses are not copied.
+type serverErrorBody struct {
+	ww  middleware.WrapResponseWriter
+	buf bytes.Buffer
+}
+
+func (b *serverErrorBody) Write(p []byte) (int, error) {
+	if b.ww.Status() >= 500 && b.buf.Len() < maxErrorBody {
+		b.buf.Write(p[:min(len(p), maxErrorBody-b.buf.Len())])
+	}
+	return len(p), nil
+}
+
+// error returns the error a JSON error response carries, if any.
+func (b *serverErrorBody) error() string {
+	var resp struct {
+		Message string `json:"message"`
+		Error   string `json:"error"`
+	}
+	if json.Unmarshal(b.buf.Bytes(), &resp) != nil {
+		return ""
+	}
+	if resp.Error == "" {
+		return resp.Message
+	}
+	return resp.Error
+}
@@ -0,0 +1,325 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	htmltemplate "html/template"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// mailConf configures outgoing mail through TODO_SMTP_ADDR (host:port),
+// TODO_SMTP_USER, TODO_SMTP_PASSWORD and TODO_MAIL_FROM. The connection is
+// upgraded with STARTTLS when the server offers it; TODO_SMTP_TLS=true
+// connects over TLS from the start instead, as port 465 expects. Without an
+// SMTP server messages are written to the log, which is enough for
+// development.
+var mailConf = struct {
+	Addr, User, Password, From string
+	TLS                        bool
+}{
+	Addr:     envString("TODO_SMTP_ADDR", ""),
+	User:     envString("TODO_SMTP_USER", ""),
+	Password: envString("TODO_SMTP_PASSWORD", ""),
+	From:     envString("TODO_MAIL_FROM", "todo@localhost"),
+	TLS:      envBool("TODO_SMTP_TLS"),
+}
+
+// publicURL is where users reach the service, used for links in emails,
+// unless a Server's Config says otherwise. It defaults to the local HTTP
+// address, see loadConfig.
+var publicURL = envString("TODO_PUBLIC_URL", "")
+
+const (
+	mailWorkers = 2
+	// A message that cannot be sent is retried mailMaxAttempts times in
+	// all, the wait doubling from mailFirstRetry.
+	mailMaxAttempts = 5
+	mailFirstRetry  = 30 * time.Second
+)
+
+// mailQueue holds messages waiting for deliverMail, so that handlers never
+// wait on the SMTP server. Messages still queued are lost on shutdown.
+var mailQueue = make(chan mailMessage, 1000)
+
+type mailMessage struct {
+	To, Subject, Text, HTML string
+	attempts                int
+}
+
+// mailTemplate is one kind of email. Subject and Text are text/templates,
+// HTML an html/template rendered inside mailLayout; all three are given
+// the same data.
+type mailTemplate struct {
+	Subject, Text, HTML string
+}
+
+var mailTemplates = map[string]mailTemplate{
+	"reset": {
+		Subject: "Reset your password",
+		Text: `Someone asked to reset the password for your todo account.
+
+Use this token within an hour to choose a new one:
+
+{{.Token}}
+
+POST it to {{.URL}}/auth/reset, or ignore this email to keep your password.`,
+		HTML: `<p>Someone asked to reset the password for your todo account.</p>
+<p>Use this token within an hour to choose a new one:</p>
+<p><code>{{.Token}}</code></p>
+<p>POST it to {{.URL}}/auth/reset, or ignore this email to keep your password.</p>`,
+	},
+	"verify": {
+		Subject: "Confirm your email address",
+		Text: `Welcome! Confirm your email address within 24 hours by opening:
+
+{{.URL}}/auth/verify?token={{.Token}}`,
+		HTML: `<p>Welcome! Confirm your email address within 24 hours by opening
+<a href="{{.URL}}/auth/verify?token={{.Token}}">this link</a>.</p>`,
+	},
+	"assigned": {
+		Subject: `{{.Actor}} assigned you "{{.Todo.Title}}"`,
+		Text: `{{.Actor}} assigned you a todo:
+
+  {{.Todo.Title}}{{if .Todo.DueDate}}, due {{.Todo.DueDate}}{{end}}
+
+See it at {{.URL}}/todo/{{.Todo.ID}}`,
+		HTML: `<p>{{.Actor}} assigned you a todo:</p>
+<p><a href="{{.URL}}/todo/{{.Todo.ID}}"><strong>{{.Todo.Title}}</strong></a>{{if .Todo.DueDate}}, due {{.Todo.DueDate}}{{end}}</p>`,
+	},
+	"digest": {
+		Subject: `Your {{.Frequency}} todo digest for {{.Date}}`,
+		Text: `{{with .Overdue}}Overdue:{{range .}}
+  - {{.Title}}, due {{.DueDate}}{{end}}
+
+{{end}}{{with .DueToday}}Due today:{{range .}}
+  - {{.Title}}{{end}}
+
+{{end}}{{with .Completed}}Recently completed:{{range .}}
+  - {{.Title}}{{end}}
+
+{{end}}See all your todos at {{.URL}}/todo`,
+		HTML: `{{with .Overdue}}<h3>Overdue</h3>
+<ul>{{range .}}
+<li><a href="{{$.URL}}/todo/{{.ID}}">{{.Title}}</a>, due {{.DueDate}}</li>{{end}}
+</ul>{{end}}
+{{with .DueToday}}<h3>Due today</h3>
+<ul>{{range .}}
+<li><a href="{{$.URL}}/todo/{{.ID}}">{{.Title}}</a></li>{{end}}
+</ul>{{end}}
+{{with .Completed}}<h3>Recently completed</h3>
+<ul>{{range .}}
+<li>{{.Title}}</li>{{end}}
+</ul>{{end}}`,
+	},
+	"reminder": {
+		Subject: `Reminder: {{.Todo.Title}}`,
+		Text: `You asked to be reminded of:
+
+  {{.Todo.Title}}{{if .Todo.DueDate}}, due {{.Todo.DueDate}}{{end}}
+
+See it at {{.URL}}/todo/{{.Todo.ID}}`,
+		HTML: `<p>You asked to be reminded of:</p>
+<p><a href="{{.URL}}/todo/{{.Todo.ID}}"><strong>{{.Todo.Title}}</strong></a>{{if .Todo.DueDate}}, due {{.Todo.DueDate}}{{end}}</p>`,
+	},
+	"due-soon": {
+		Subject: `{{if eq (len .Todos) 1}}"{{(index .Todos 0).Title}}" is{{else}}{{len .Todos}} todos are{{end}} due soon`,
+		Text: `These todos are due soon:{{range .Todos}}
+  - {{.Title}}, due {{.DueDate}}{{end}}
+
+See them at {{.URL}}/todo`,
+		HTML: `<p>These todos are due soon:</p>
+<ul>{{range .Todos}}
+<li><a href="{{$.URL}}/todo/{{.ID}}">{{.Title}}</a>, due {{.DueDate}}</li>{{end}}
+</ul>`,
+	},
+}
+
+const mailLayout = `<!DOCTYPE html>
+<html><body style="font-family: sans-serif; line-height: 1.5">
+{{template "body" .}}
+</body></html>`
+
+type parsedMailTemplate struct {
+	subject, text *template.Template
+	html          *htmltemplate.Template
+}
+
+var parsedMailTemplates = parseMailTemplates()
+
+func parseMailTemplates() map[string]parsedMailTemplate {
+	parsed := make(map[string]parsedMailTemplate, len(mailTemplates))
+	for name, t := range mailTemplates {
+		layout := htmltemplate.Must(htmltemplate.New(name).Parse(mailLayout))
+		parsed[name] = parsedMailTemplate{
+			subject: template.Must(template.New(name).Parse(t.Subject)),
+			text:    template.Must(template.New(name).Parse(t.Text)),
+			html:    htmltemplate.Must(layout.New("body").Parse(t.HTML)),
+		}
+	}
+	return parsed
+}
+
+// queueMail renders the named template for to and queues the message. The
+// templates get data with URL set to the public URL of the Server ctx
+// belongs to.
+func queueMail(ctx context.Context, to, name string, data map[string]interface{}) {
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	data["URL"] = serverFrom(ctx).publicURL
+	m, err := renderMail(to, name, data)
+	if err != nil {
+		slog.Error("mail", "template", name, "to", to, "err", err)
+		return
+	}
+	enqueueMail(m)
+}
+
+func renderMail(to, name string, data map[string]interface{}) (mailMessage, error) {
+	t, ok := parsedMailTemplates[name]
+	if !ok {
+		return mailMessage{}, fmt.Errorf("no mail template %q", name)
+	}
+	var subject, text, html bytes.Buffer
+	err := t.subject.Execute(&subject, data)
+	if err == nil {
+		err = t.text.Execute(&text, data)
+	}
+	if err == nil {
+		err = t.html.ExecuteTemplate(&html, name, data)
+	}
+	return mailMessage{To: to, Subject: subject.String(), Text: text.String(), HTML: html.String()}, err
+}
+
+func enqueueMail(m mailMessage) {
+	select {
+	case mailQueue <- m:
+	default:
+		slog.Warn("mail queue full, dropped", "to", m.To, "subject", m.Subject)
+	}
+}
+
+// deliverMail starts the workers sending queued mail.
+func deliverMail() {
+	for i := 0; i < mailWorkers; i++ {
+		go func() {
+			for m := range mailQueue {
+				err := sendMail(m)
+				if err == nil {
+					continue
+				}
+				m.attempts++
+				if m.attempts >= mailMaxAttempts {
+					slog.Error("sending mail: giving up", "to", m.To, "err", err)
+					continue
+				}
+				slog.Warn("sending mail", "to", m.To, "err", err)
+				time.AfterFunc(mailFirstRetry<<(m.attempts-1), func() { enqueueMail(m) })
+			}
+		}()
+	}
+}
+
+func sendMail(m mailMessage) error {
+	if mailConf.Addr == "" {
+		slog.Info("mail", "to", m.To, "subject", m.Subject, "text", m.Text)
+		return nil
+	}
+	msg, err := buildMail(m)
+	if err != nil {
+		return err
+	}
+	host, _, err := net.SplitHostPort(mailConf.Addr)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if mailConf.User != "" {
+		auth = smtp.PlainAuth("", mailConf.User, mailConf.Password, host)
+	}
+	if !mailConf.TLS {
+		return smtp.SendMail(mailConf.Addr, auth, mailConf.From, []string{m.To}, msg)
+	}
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}, "tcp", mailConf.Addr, &tls.Config{ServerName: host})
+	if err != nil {
+		return err
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if auth != nil {
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(mailConf.From); err != nil {
+		return err
+	}
+	if err := c.Rcpt(m.To); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// buildMail formats m as a multipart/alternative message with text and
+// HTML parts.
+func buildMail(m mailMessage) ([]byte, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	_, domain, _ := strings.Cut(mailConf.From, "@")
+	fmt.Fprintf(&buf, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMessage-ID: <%s@%s>\r\n",
+		mailConf.From, m.To, mime.QEncoding.Encode("utf-8", m.Subject), time.Now().Format(time.RFC1123Z),
+		hex.EncodeToString(id), strings.Trim(domain, ">"))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\nContent-Type: multipart/alternative; boundary=%s\r\n\r\n", mw.Boundary())
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", m.Text},
+		{"text/html; charset=utf-8", m.HTML},
+	} {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qw := quotedprintable.NewWriter(pw)
+		if _, err := qw.Write([]byte(part.body)); err != nil {
+			return nil, err
+		}
+		if err := qw.Close(); err != nil {
+			return nil, err
+		}
+	}
+	err := mw.Close()
+	return buf.Bytes(), err
+}
@@ -0,0 +1,196 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// While migrations or backups run, the API can be put into maintenance:
+// read-only, refusing writes, or full, refusing everything. Refused
+// requests are answered 503 with a notice and Retry-After. The mode is
+// set at startup with --maintenance or TODO_MAINTENANCE, or by admins at
+// PUT /admin/maintenance, which every instance picks up within
+// maintenancePoll; the stricter of the two applies. /admin and /auth stay
+// open so admins can sign in, do the work and end the maintenance.
+
+const (
+	maintenanceOff      = "off"
+	maintenanceReadOnly = "read-only"
+	maintenanceFull     = "full"
+
+	settingsCollection string = "settings"
+	maintenancePoll           = 10 * time.Second
+)
+
+var maintenanceConf = struct {
+	Mode       string
+	Message    string
+	RetryAfter int
+}{
+	Mode:       envString("TODO_MAINTENANCE", maintenanceOff),
+	Message:    envString("TODO_MAINTENANCE_MESSAGE", ""),
+	RetryAfter: envInt("TODO_MAINTENANCE_RETRY_AFTER_SECONDS", 300),
+}
+
+// maintenanceModel is the mode admins set, stored for all instances.
+type maintenanceModel struct {
+	Mode       string    `bson:"mode" json:"mode" validate:"oneof=off read-only full"`
+	Message    string    `bson:"message,omitempty" json:"message,omitempty" validate:"max=500"`
+	RetryAfter int       `bson:"retryAfter,omitempty" json:"retryAfterSeconds,omitempty" validate:"min=0"`
+	UpdatedBy  ID        `bson:"updatedBy,omitempty" json:"-"`
+	UpdatedAt  time.Time `bson:"updatedAt" json:"-"`
+}
+
+// currentMaintenance is the maintenance in effect on the instance ctx
+// belongs to.
+func currentMaintenance(ctx context.Context) maintenanceModel {
+	srv := serverFrom(ctx)
+	m := maintenanceModel{
+		Mode:       srv.maintenance,
+		Message:    maintenanceConf.Message,
+		RetryAfter: maintenanceConf.RetryAfter,
+	}
+	if s := srv.storedMaintenance.Load(); s != nil && maintenanceRank(s.Mode) > maintenanceRank(m.Mode) {
+		m.Mode = s.Mode
+		if s.Message != "" {
+			m.Message = s.Message
+		}
+		if s.RetryAfter > 0 {
+			m.RetryAfter = s.RetryAfter
+		}
+	}
+	return m
+}
+
+func maintenanceRank(mode string) int {
+	switch mode {
+	case maintenanceReadOnly:
+		return 1
+	case maintenanceFull:
+		return 2
+	}
+	return 0
+}
+
+// watchMaintenance keeps the Server's storedMaintenance up to date until
+// ctx is canceled.
+func watchMaintenance(ctx context.Context) {
+	tick := time.NewTicker(maintenancePoll)
+	defer tick.Stop()
+	for {
+		if serverFrom(ctx).ready.Load() {
+			if err := loadMaintenance(ctx); err != nil {
+				slog.Error("maintenance", "err", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+func loadMaintenance(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, maintenancePoll)
+	defer cancel()
+	var m maintenanceModel
+	err := db.Collection(settingsCollection).FindOne(ctx, bson.M{"_id": "maintenance"}).Decode(&m)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		m, err = maintenanceModel{Mode: maintenanceOff}, nil
+	}
+	if err != nil {
+		return err
+	}
+	serverFrom(ctx).storedMaintenance.Store(&m)
+	return nil
+}
+
+// enforceMaintenance refuses what the maintenance in effect does not allow.
+func enforceMaintenance(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := currentMaintenance(r.Context())
+		if m.Mode == maintenanceOff || maintenanceExempt(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if m.Mode == maintenanceReadOnly {
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		message := m.Message
+		if message == "" && m.Mode == maintenanceReadOnly {
+			message = "the service is read-only for maintenance, try again later"
+		} else if message == "" {
+			message = "the service is down for maintenance, try again later"
+		}
+		if m.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(m.RetryAfter))
+		}
+		writeError(w, r, &apiError{
+			Status:  http.StatusServiceUnavailable,
+			Code:    "maintenance",
+			Message: message,
+		})
+	})
+}
+
+func maintenanceExempt(r *http.Request) bool {
+	for _, prefix := range []string{"/admin", "/auth"} {
+		if r.URL.Path == prefix || strings.HasPrefix(r.URL.Path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func maintenanceHandlers() http.Handler {
+	rg := chi.NewRouter()
+	rg.Group(func(r chi.Router) {
+		r.Get("/", fetchMaintenance)
+		r.Put("/", setMaintenance)
+	})
+	return rg
+}
+
+func fetchMaintenance(w http.ResponseWriter, r *http.Request) {
+	m := currentMaintenance(r.Context())
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"mode":              m.Mode,
+		"message":           m.Message,
+		"retryAfterSeconds": m.RetryAfter,
+		"configured":        serverFrom(r.Context()).maintenance,
+	})
+}
+
+func setMaintenance(w http.ResponseWriter, r *http.Request) {
+	var m maintenanceModel
+	if !decodeJSON(w, r, &m) {
+		return
+	}
+	m.UpdatedBy = currentUser(r.Context())
+	m.UpdatedAt = time.Now()
+	_, err := db.Collection(settingsCollection).ReplaceOne(r.Context(), bson.M{"_id": "maintenance"}, m,
+		options.Replace().SetUpsert(true))
+	if err != nil {
+		writeError(w, r, internalError("error setting maintenance", err))
+		return
+	}
+	serverFrom(r.Context()).storedMaintenance.Store(&m)
+	slog.InfoContext(r.Context(), "maintenance", "mode", m.Mode, "user_id", m.UpdatedBy.String())
+	fetchMaintenance(w, r)
+}
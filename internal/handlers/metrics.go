@@ -0,0 +1,273 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sangin4208/go-todo/internal/storage"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	mongoevent "go.mongodb.org/mongo-driver/v2/event"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Prometheus scrapes /metrics: requests by route and status, todo storage
+// and Mongo command latencies, and the depth of the job and mail queues,
+// besides the Go runtime's own. TODO_METRICS_TOKEN, if set, must be given
+// as a bearer token to scrape.
+
+var metricsToken = envString("TODO_METRICS_TOKEN", "")
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "todo_http_requests_total",
+		Help: "HTTP requests served, by method, route pattern and status.",
+	}, []string{"method", "route", "status"})
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "todo_http_request_duration_seconds",
+		Help:    "Time taken to serve HTTP requests, by method and route pattern.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+	httpInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "todo_http_requests_in_flight",
+		Help: "HTTP requests being served.",
+	})
+	httpShed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "todo_http_requests_shed_total",
+		Help: "API requests refused because too many were in flight, by reason.",
+	}, []string{"reason"})
+	storageDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "todo_storage_operation_duration_seconds",
+		Help:    "Time taken by todo storage operations, by backend, operation and outcome.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"backend", "operation", "outcome"})
+	mongoDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "todo_mongo_command_duration_seconds",
+		Help:    "Time taken by Mongo commands, by command and outcome.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"command", "outcome"})
+	mailQueueDepth = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "todo_mail_queue_depth",
+		Help: "Emails waiting to be sent.",
+	}, func() float64 { return float64(len(mailQueue)) })
+)
+
+func init() {
+	prometheus.MustRegister(httpRequests, httpDuration, httpInFlight, httpShed, storageDuration, mongoDuration, mailQueueDepth, jobQueueCollector{})
+}
+
+func metricsHandler() http.Handler {
+	h := promhttp.Handler()
+	if metricsToken == "" {
+		return h
+	}
+	return requireBearer("metrics", metricsToken)(h)
+}
+
+// requireBearer only lets requests bearing token through, for endpoints
+// meant for operators rather than users.
+func requireBearer(realm, token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="`+realm+`"`)
+				writeError(w, r, apiErr(http.StatusUnauthorized, "unauthorized"))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// instrumentRequests counts and times requests by the route pattern they
+// matched, so /todo/{id} is one series however many todos there are.
+// Requests matching no route are counted as "unmatched".
+func instrumentRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		httpInFlight.Inc()
+		defer httpInFlight.Dec()
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		httpRequests.WithLabelValues(r.Method, route, strconv.Itoa(status)).Inc()
+		httpDuration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+	})
+}
+
+// mongoMonitor times every command sent to Mongo, and traces those sent
+// within a trace.
+func mongoMonitor() *mongoevent.CommandMonitor {
+	return &mongoevent.CommandMonitor{
+		Started: startMongoSpan,
+		Succeeded: func(_ context.Context, e *mongoevent.CommandSucceededEvent) {
+			endMongoSpan(e.RequestID, nil)
+			mongoDuration.WithLabelValues(e.CommandName, "ok").Observe(e.Duration.Seconds())
+		},
+		Failed: func(_ context.Context, e *mongoevent.CommandFailedEvent) {
+			endMongoSpan(e.RequestID, e.Failure)
+			mongoDuration.WithLabelValues(e.CommandName, "error").Observe(e.Duration.Seconds())
+		},
+	}
+}
+
+// jobQueueCollector reports how many jobs are queued and running, by kind,
+// counting them in Mongo at each scrape.
+type jobQueueCollector struct{}
+
+var jobQueueDesc = prometheus.NewDesc("todo_job_queue_depth",
+	"Jobs queued or running, by kind and status.", []string{"kind", "status"}, nil)
+
+func (jobQueueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- jobQueueDesc
+}
+
+// Collect counts the jobs of the Server Run serves; embedded Servers are
+// not counted.
+func (jobQueueCollector) Collect(ch chan<- prometheus.Metric) {
+	if command == nil || !command.ready.Load() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(command.ctx, readinessTimeout)
+	defer cancel()
+	cur, err := db.Collection(jobsCollection).Aggregate(ctx, []bson.M{
+		{"$match": bson.M{"status": bson.M{"$in": []string{jobQueued, jobRunning}}}},
+		{"$group": bson.M{"_id": bson.M{"kind": "$kind", "status": "$status"}, "n": bson.M{"$sum": 1}}},
+	})
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(jobQueueDesc, err)
+		return
+	}
+	var rows []struct {
+		ID struct {
+			Kind   string `bson:"kind"`
+			Status string `bson:"status"`
+		} `bson:"_id"`
+		N int `bson:"n"`
+	}
+	if err := cur.All(ctx, &rows); err != nil {
+		ch <- prometheus.NewInvalidMetric(jobQueueDesc, err)
+		return
+	}
+	for _, row := range rows {
+		ch <- prometheus.MustNewConstMetric(jobQueueDesc, prometheus.GaugeValue, float64(row.N), row.ID.Kind, row.ID.Status)
+	}
+}
+
+// meteredTodoRepository times every call into the storage backend.
+type meteredTodoRepository struct {
+	next    TodoRepository
+	backend string
+}
+
+// start begins timing and tracing op. The function it returns is deferred
+// with a pointer to the call's error, which is only known once it returns.
+// As with Mongo commands, only calls made within a trace are traced.
+func (m meteredTodoRepository) start(ctx context.Context, op string) (context.Context, func(*error)) {
+	start := time.Now()
+	span := trace.SpanFromContext(ctx)
+	if span.SpanContext().IsValid() {
+		ctx, span = tracer.Start(ctx, "storage."+op, trace.WithAttributes(attribute.String("todo.storage.backend", m.backend)))
+	}
+	return ctx, func(err *error) {
+		outcome := "ok"
+		if *err != nil {
+			outcome = "error"
+			span.RecordError(*err)
+			span.SetStatus(codes.Error, (*err).Error())
+		}
+		if span.SpanContext().IsValid() {
+			span.End()
+		}
+		storageDuration.WithLabelValues(m.backend, op, outcome).Observe(time.Since(start).Seconds())
+	}
+}
+
+func (m meteredTodoRepository) List(ctx context.Context, s todoScope, f TodoFilter, skip, limit int) (list []todoModel, total int, err error) {
+	ctx, done := m.start(ctx, "list")
+	defer done(&err)
+	return m.next.List(ctx, s, f, skip, limit)
+}
+
+func (m meteredTodoRepository) Get(ctx context.Context, s todoScope, id ID) (tm todoModel, err error) {
+	ctx, done := m.start(ctx, "get")
+	defer done(&err)
+	return m.next.Get(ctx, s, id)
+}
+
+func (m meteredTodoRepository) Create(ctx context.Context, tm *todoModel) (err error) {
+	ctx, done := m.start(ctx, "create")
+	defer done(&err)
+	return m.next.Create(ctx, tm)
+}
+
+func (m meteredTodoRepository) Update(ctx context.Context, s todoScope, id ID, title string, completed bool) (before, after todoModel, err error) {
+	ctx, done := m.start(ctx, "update")
+	defer done(&err)
+	return m.next.Update(ctx, s, id, title, completed)
+}
+
+func (m meteredTodoRepository) Assign(ctx context.Context, s todoScope, id, assignee ID) (tm todoModel, err error) {
+	ctx, done := m.start(ctx, "assign")
+	defer done(&err)
+	return m.next.Assign(ctx, s, id, assignee)
+}
+
+func (m meteredTodoRepository) Delete(ctx context.Context, s todoScope, id ID) (tm todoModel, err error) {
+	ctx, done := m.start(ctx, "delete")
+	defer done(&err)
+	return m.next.Delete(ctx, s, id)
+}
+
+func (m meteredTodoRepository) CountOpen(ctx context.Context, user ID) (n int, err error) {
+	ctx, done := m.start(ctx, "count_open")
+	defer done(&err)
+	return m.next.CountOpen(ctx, user)
+}
+
+func (m meteredTodoRepository) DeleteExpired(ctx context.Context, now time.Time) (expired []todoModel, err error) {
+	ctx, done := m.start(ctx, "delete_expired")
+	defer done(&err)
+	return m.next.DeleteExpired(ctx, now)
+}
+
+func (m meteredTodoRepository) DeleteMany(ctx context.Context, s todoScope, f TodoFilter) (removed []todoModel, err error) {
+	ctx, done := m.start(ctx, "delete_many")
+	defer done(&err)
+	return m.next.DeleteMany(ctx, s, f)
+}
+
+func (m meteredTodoRepository) Count(ctx context.Context, s todoScope, f TodoFilter) (n int, err error) {
+	ctx, done := m.start(ctx, "count")
+	defer done(&err)
+	return m.next.Count(ctx, s, f)
+}
+
+func (m meteredTodoRepository) CountTags(ctx context.Context, s todoScope, f TodoFilter) (tags []storage.TagCount, err error) {
+	ctx, done := m.start(ctx, "count_tags")
+	defer done(&err)
+	return m.next.CountTags(ctx, s, f)
+}
+
+func (m meteredTodoRepository) CountByDay(ctx context.Context, s todoScope, f TodoFilter, completed bool, loc *time.Location) (days map[string]int, err error) {
+	ctx, done := m.start(ctx, "count_by_day")
+	defer done(&err)
+	return m.next.CountByDay(ctx, s, f, completed, loc)
+}
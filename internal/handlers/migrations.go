@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/sangin4208/go-todo/internal/storage"
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const migrationsCollection = "migrations"
+
+// skipMigrations leaves pending migrations for an admin to run through
+// POST /admin/migrations instead of applying them at startup.
+var skipMigrations = envBool("TODO_SKIP_MIGRATIONS")
+
+// migration is one versioned change to existing data. Up must be safe to
+// run again: instances starting together may both apply it, and a failure
+// part-way is retried on the next run.
+type migration struct {
+	Version int
+	Name    string
+	Up      func(ctx context.Context) error
+}
+
+// migrations run in order and are never edited once released; append new
+// ones with the next version number.
+var migrations = []migration{
+	{1, "assign pre-workspace documents to the default workspace", func(ctx context.Context) error {
+		for _, name := range []string{usersCollection, serverFrom(ctx).collection, listsCollection} {
+			if _, err := db.Collection(name).UpdateMany(ctx,
+				bson.M{"workspaceId": bson.M{"$exists": false}},
+				bson.M{"$set": bson.M{"workspaceId": defaultWorkspace}},
+			); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{2, "make emails unique per workspace instead of globally", func(ctx context.Context) error {
+		// The index is gone on databases created since workspaces, and
+		// embedded ones never had it.
+		if m, ok := mongoOf(ctx); ok {
+			m.Database.Collection(usersCollection).Indexes().DropOne(ctx, "email_1")
+		}
+		return nil
+	}},
+	{3, "give existing todos short references", func(ctx context.Context) error {
+		var pending []todoModel
+		if err := storage.FindAll(ctx, todoCollection(ctx), bson.M{"ref": bson.M{"$exists": false}}, &pending,
+			options.Find().SetSort(storage.SortKeys("createAt")).SetProjection(bson.M{"workspaceId": 1})); err != nil {
+			return err
+		}
+		for _, tm := range pending {
+			ref, err := nextTodoRef(ctx, tm.WorkspaceID)
+			if err != nil {
+				return err
+			}
+			if _, err := todoCollection(ctx).UpdateOne(ctx,
+				bson.M{"_id": tm.ID, "ref": bson.M{"$exists": false}},
+				bson.M{"$set": bson.M{"ref": ref}},
+			); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{4, "queue pending exports, webhook deliveries and reminders as jobs", func(ctx context.Context) error {
+		// Job keys keep a rerun from queueing the same work twice.
+		if err := ensureIndex(ctx, db.Collection(jobsCollection), true, "key"); err != nil {
+			return err
+		}
+		var exports []exportModel
+		if err := storage.FindAll(ctx, db.Collection(exportsCollection), bson.M{"status": exportPending}, &exports,
+			options.Find().SetProjection(bson.M{"_id": 1})); err != nil {
+			return err
+		}
+		for _, e := range exports {
+			if err := enqueueJob(ctx, jobExport, "export/"+e.ID.String(), time.Now(), exportJob{ExportID: e.ID}); err != nil {
+				return err
+			}
+		}
+		var deliveries []deliveryModel
+		if err := storage.FindAll(ctx, db.Collection(deliveriesCollection), bson.M{"status": deliveryPending}, &deliveries,
+			options.Find().SetProjection(bson.M{"attempts": 1, "nextAttemptAt": 1})); err != nil {
+			return err
+		}
+		for _, d := range deliveries {
+			if err := queueAttempt(ctx, d.ID, len(d.Attempts)+1, d.NextAttemptAt); err != nil {
+				return err
+			}
+		}
+		var reminders []scheduledReminderModel
+		if err := storage.FindAll(ctx, db.Collection(scheduledRemindersCollection), bson.M{}, &reminders); err != nil {
+			return err
+		}
+		for _, rm := range reminders {
+			if err := enqueueJob(ctx, jobReminder, "reminder/"+rm.ID.String(), rm.RemindAt, reminderJob{ReminderID: rm.ID}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{5, "move users' time zones out of their notification settings", func(ctx context.Context) error {
+		_, err := db.Collection(usersCollection).UpdateMany(ctx,
+			bson.M{"notifications.timeZone": bson.M{"$exists": true}},
+			bson.M{"$rename": bson.M{"notifications.timeZone": "timeZone"}},
+		)
+		return err
+	}},
+}
+
+type migrationModel struct {
+	Version   int       `bson:"_id"`
+	Name      string    `bson:"name"`
+	AppliedAt time.Time `bson:"appliedAt"`
+}
+
+type migrationStatus struct {
+	Version   int    `json:"version"`
+	Name      string `json:"name"`
+	AppliedAt string `json:"appliedAt,omitempty"`
+}
+
+// runMigrations applies every migration not yet recorded as applied.
+func runMigrations(ctx context.Context) (int, error) {
+	applied, err := appliedMigrations(ctx)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		slog.Info("migration", "version", m.Version, "name", m.Name)
+		if err := m.Up(ctx); err != nil {
+			return n, err
+		}
+		if _, err := db.Collection(migrationsCollection).UpdateOne(ctx,
+			bson.M{"_id": m.Version},
+			bson.M{"$setOnInsert": bson.M{"name": m.Name, "appliedAt": time.Now()}},
+			options.UpdateOne().SetUpsert(true),
+		); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+func appliedMigrations(ctx context.Context) (map[int]migrationModel, error) {
+	var records []migrationModel
+	if err := storage.FindAll(ctx, db.Collection(migrationsCollection), bson.M{}, &records); err != nil {
+		return nil, err
+	}
+	applied := make(map[int]migrationModel, len(records))
+	for _, m := range records {
+		applied[m.Version] = m
+	}
+	return applied, nil
+}
+
+func fetchMigrations(w http.ResponseWriter, r *http.Request) {
+	applied, err := appliedMigrations(r.Context())
+	if err != nil {
+		writeError(w, r, internalError("error fetching migrations", err))
+		return
+	}
+	data := []migrationStatus{}
+	for _, m := range migrations {
+		s := migrationStatus{Version: m.Version, Name: m.Name}
+		if a, ok := applied[m.Version]; ok {
+			s.AppliedAt = formatTime(r.Context(), a.AppliedAt)
+		}
+		data = append(data, s)
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"data": data,
+	})
+}
+
+func applyMigrations(w http.ResponseWriter, r *http.Request) {
+	n, err := runMigrations(r.Context())
+	if err != nil {
+		render(r).JSON(w, http.StatusInternalServerError, renderer.M{
+			"message": translate(r.Context(), "error applying migrations"),
+			"error":   err.Error(),
+			"applied": n,
+		})
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"message": translate(r.Context(), "migrations applied successfully"),
+		"applied": n,
+	})
+}
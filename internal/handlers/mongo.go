@@ -0,0 +1,224 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/sangin4208/go-todo/internal/storage"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"go.mongodb.org/mongo-driver/v2/mongo/readpref"
+	"go.mongodb.org/mongo-driver/v2/mongo/writeconcern"
+)
+
+// mongoConf configures the database connection. TODO_MONGO_URI takes any
+// standard connection string, so credentials, authMechanism (for example
+// SCRAM-SHA-256), TLS, replica sets and pool sizes are all set there.
+//
+// The driver keeps a pool of connections shared by all requests, each
+// operation checking one out for its duration. TODO_MONGO_MAX_POOL_SIZE,
+// TODO_MONGO_MIN_POOL_SIZE and TODO_MONGO_MAX_IDLE_SECONDS tune it; zero
+// keeps the driver's default (or what the URI sets).
+//
+// TODO_MONGO_READ_PREFERENCE (primary, primaryPreferred, secondary,
+// secondaryPreferred or nearest) and TODO_MONGO_WRITE_CONCERN (majority, a
+// number of members or a tag set name) suit replica sets, whose name is
+// given by TODO_MONGO_REPLICA_SET. Reading from secondaries takes load off
+// the primary but may not show a write the same client just made. The
+// TODO_MONGO_USERNAME, TODO_MONGO_PASSWORD, TODO_MONGO_AUTH_SOURCE and
+// TODO_MONGO_AUTH_MECHANISM variables keep credentials out of the URI. Each
+// of these overrides the URI when set.
+//
+// At startup the server waits for Mongo through TODO_MONGO_CONNECT_RETRIES
+// attempts with exponential backoff, then starts anyway and keeps retrying
+// in the background. Once connected, the driver reconnects on its own after
+// Mongo restarts.
+var mongoConf = struct {
+	URI        string
+	Database   string
+	Timeout    time.Duration
+	Retries    int
+	MaxBackoff time.Duration
+	MaxPool    int
+	MinPool    int
+	MaxIdle    time.Duration
+
+	ReadPreference string
+	WriteConcern   string
+	ReplicaSet     string
+	Username       string
+	Password       string
+	AuthSource     string
+	AuthMechanism  string
+}{
+	URI:        envString("TODO_MONGO_URI", "mongodb://localhost:27017"),
+	Database:   envString("TODO_MONGO_DB", "demo_todo"),
+	Timeout:    time.Duration(envInt("TODO_MONGO_TIMEOUT_SECONDS", 10)) * time.Second,
+	Retries:    envInt("TODO_MONGO_CONNECT_RETRIES", 5),
+	MaxBackoff: time.Duration(envInt("TODO_MONGO_MAX_BACKOFF_SECONDS", 30)) * time.Second,
+	MaxPool:    envInt("TODO_MONGO_MAX_POOL_SIZE", 0),
+	MinPool:    envInt("TODO_MONGO_MIN_POOL_SIZE", 0),
+	MaxIdle:    time.Duration(envInt("TODO_MONGO_MAX_IDLE_SECONDS", 0)) * time.Second,
+
+	ReadPreference: envString("TODO_MONGO_READ_PREFERENCE", ""),
+	WriteConcern:   envString("TODO_MONGO_WRITE_CONCERN", ""),
+	ReplicaSet:     envString("TODO_MONGO_REPLICA_SET", ""),
+	Username:       envString("TODO_MONGO_USERNAME", ""),
+	Password:       envString("TODO_MONGO_PASSWORD", ""),
+	AuthSource:     envString("TODO_MONGO_AUTH_SOURCE", ""),
+	AuthMechanism:  envString("TODO_MONGO_AUTH_MECHANISM", ""),
+}
+
+// connectMongo configures a client of uri for the named database. It does
+// not wait for the server: connections are made lazily and re-established
+// by the driver.
+func connectMongo(uri, name string) (database, error) {
+	opts := options.Client().
+		ApplyURI(uri).
+		SetAppName("todo").
+		SetServerSelectionTimeout(mongoConf.Timeout).
+		SetMonitor(mongoMonitor())
+	if queryTimeout > 0 {
+		// Applies to operations whose context has no deadline of its own.
+		opts.SetTimeout(queryTimeout)
+	}
+	if mongoConf.MaxPool > 0 {
+		opts.SetMaxPoolSize(uint64(mongoConf.MaxPool))
+	}
+	if mongoConf.MinPool > 0 {
+		opts.SetMinPoolSize(uint64(mongoConf.MinPool))
+	}
+	if mongoConf.MaxIdle > 0 {
+		opts.SetMaxConnIdleTime(mongoConf.MaxIdle)
+	}
+	if mongoConf.ReadPreference != "" {
+		mode, err := readpref.ModeFromString(mongoConf.ReadPreference)
+		if err != nil {
+			return nil, err
+		}
+		rp, err := readpref.New(mode)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetReadPreference(rp)
+	}
+	if mongoConf.WriteConcern != "" {
+		opts.SetWriteConcern(parseWriteConcern(mongoConf.WriteConcern))
+	}
+	if mongoConf.ReplicaSet != "" {
+		opts.SetReplicaSet(mongoConf.ReplicaSet)
+	}
+	if mongoConf.Username != "" || mongoConf.AuthMechanism != "" {
+		opts.SetAuth(options.Credential{
+			Username:      mongoConf.Username,
+			Password:      mongoConf.Password,
+			PasswordSet:   mongoConf.Password != "",
+			AuthSource:    mongoConf.AuthSource,
+			AuthMechanism: mongoConf.AuthMechanism,
+		})
+	}
+	client, err := mongo.Connect(opts)
+	if err != nil {
+		return nil, err
+	}
+	return mongoDatabase{client.Database(name)}, nil
+}
+
+func parseWriteConcern(s string) *writeconcern.WriteConcern {
+	if s == "majority" {
+		return writeconcern.Majority()
+	}
+	if n, err := strconv.Atoi(s); err == nil {
+		return &writeconcern.WriteConcern{W: n}
+	}
+	return writeconcern.Custom(s)
+}
+
+// retryWithBackoff calls f until it succeeds, doubling the wait between
+// attempts up to mongoConf.MaxBackoff. A positive attempts gives up after
+// that many tries and returns the last error.
+func retryWithBackoff(what string, attempts int, f func() error) error {
+	wait := time.Second
+	for i := 1; ; i++ {
+		err := f()
+		if err == nil || (attempts > 0 && i >= attempts) {
+			return err
+		}
+		slog.Warn(what+" failed, retrying", "attempt", i, "wait", wait.String(), "err", err)
+		time.Sleep(wait)
+		if wait *= 2; wait > mongoConf.MaxBackoff {
+			wait = mongoConf.MaxBackoff
+		}
+	}
+}
+
+func ensureIndex(ctx context.Context, c collection, unique bool, fields ...string) error {
+	_, err := createIndexes(ctx, c, mongo.IndexModel{
+		Keys:    storage.SortKeys(fields...),
+		Options: options.Index().SetUnique(unique),
+	})
+	return err
+}
+
+// ensureTTLIndex expires documents once the time in field has passed.
+func ensureTTLIndex(ctx context.Context, c collection, field string) error {
+	_, err := createIndexes(ctx, c, mongo.IndexModel{
+		Keys:    bson.D{{Key: field, Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(1),
+	})
+	return err
+}
+
+// updateOne applies update to the first document matching filter and
+// reports mongo.ErrNoDocuments if there was none.
+func updateOne(ctx context.Context, c collection, filter, update interface{}) error {
+	res, err := c.UpdateOne(ctx, filter, update)
+	if err == nil && res.MatchedCount == 0 {
+		err = mongo.ErrNoDocuments
+	}
+	return err
+}
+
+// deleteOne removes the first document matching filter and reports
+// mongo.ErrNoDocuments if there was none.
+func deleteOne(ctx context.Context, c collection, filter interface{}) error {
+	res, err := c.DeleteOne(ctx, filter)
+	if err == nil && res.DeletedCount == 0 {
+		err = mongo.ErrNoDocuments
+	}
+	return err
+}
+
+// withTransaction runs fn in a transaction, so that a failure part-way
+// through leaves nothing half done. fn must use the context it is given and
+// may be retried on transient errors. Within another transaction fn simply
+// joins it, and on standalone servers and the embedded database, which
+// cannot run transactions, fn runs once without one.
+func withTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	m, ok := mongoOf(ctx)
+	if !ok || mongo.SessionFromContext(ctx) != nil {
+		return fn(ctx)
+	}
+	sess, err := m.Client().StartSession()
+	if err != nil {
+		return err
+	}
+	defer sess.EndSession(ctx)
+	// Transactions must read from the primary whatever the client's read
+	// preference.
+	_, err = sess.WithTransaction(ctx, func(ctx context.Context) (interface{}, error) {
+		return nil, fn(ctx)
+	}, options.Transaction().SetReadPreference(readpref.Primary()))
+	var se mongo.ServerError
+	if errors.As(err, &se) && se.HasErrorCode(errIllegalOperation) {
+		return fn(ctx)
+	}
+	return err
+}
+
+// errIllegalOperation is what a standalone server answers to transactions.
+const errIllegalOperation = 20
@@ -0,0 +1,247 @@
+package handlers
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sangin4208/go-todo/internal/storage"
+	"github.com/thedevsaddam/renderer"
+	"go.etcd.io/bbolt"
+)
+
+// Config overrides settings for New, the way the command line does for
+// Run. Empty fields leave the setting to the environment, the
+// configuration file or its default.
+type Config struct {
+	// MongoURI, MongoDatabase and MongoCollection are TODO_MONGO_URI,
+	// TODO_MONGO_DB and TODO_MONGO_COLLECTION.
+	MongoURI, MongoDatabase, MongoCollection string
+	// Storage is TODO_STORAGE, where todos are kept.
+	Storage string
+	// PublicURL is TODO_PUBLIC_URL, the URL the handler is reached at.
+	PublicURL string
+	// Maintenance is TODO_MAINTENANCE: off, read-only or full.
+	Maintenance string
+}
+
+// Server is one instance of the service: the database and todo repository
+// it keeps its data in, the settings its Config overrides, the secret its
+// tokens are signed with, the caches, limits, stores and brokers it serves
+// with and the workers running in its background. Run serves one; New
+// makes as many as the embedding program likes.
+//
+// Handlers and workers find their Server in the context they are given,
+// where ServeHTTP and startWorkers put it; db acts on the Server of each
+// call's context. Everything else, such as the mail queue, tracing and
+// metrics, is configured from the environment and shared by the process.
+type Server struct {
+	mongoURI, mongoDatabase string
+	// collection, storage, publicURL and maintenance take the place of
+	// collectionName, storageBackend, publicURL and maintenanceConf.Mode.
+	collection, storage, publicURL, maintenance string
+
+	db    database
+	todos TodoRepository
+	// todoCache is the cache in front of todos, if any, so that changes
+	// made outside the repository can invalidate it.
+	todoCache *storage.Cached
+	// search is nil unless TODO_SEARCH_URL is set.
+	search *searchIndex
+	// sqliteFile or boltFile is the open sqlitePath or boltPath, shared by
+	// the todo repository and the embedded database: bbolt locks the file
+	// against being opened twice.
+	sqliteFile *sql.DB
+	boltFile   *bbolt.DB
+	// ready is set once setupDatabase has succeeded; until then requests
+	// are answered with 503.
+	ready atomic.Bool
+	// leading reports whether this instance holds the scheduler lease.
+	leading atomic.Bool
+	// storedMaintenance is the last maintenanceModel read.
+	storedMaintenance atomic.Pointer[maintenanceModel]
+
+	// changes carries the todo changes made through s to its live
+	// streams, and responses caches what its GETs answered.
+	changes   *hub
+	responses *responseCache
+	// logins and writeBuckets hold the sign-in lockouts and write rate
+	// limits.
+	logins       *loginThrottle
+	writeBuckets bucketStore
+	// blobs keeps attachments; broker is nil when no broker is configured.
+	blobs  BlobStore
+	broker EventPublisher
+	rnd    *renderer.Render
+
+	jwtSecret      []byte
+	authenticators chainAuthenticator
+	// shareKey signs share links; see loadShareKey.
+	shareKey []byte
+
+	handler http.Handler
+	// ctx carries the Server to its workers, and is canceled by Close.
+	ctx    context.Context
+	cancel context.CancelFunc
+	closed sync.Once
+}
+
+type serverKey struct{}
+
+// command is the Server Run serves, which code running outside any
+// Server's context, such as the metrics collectors, reports on.
+var command *Server
+
+// serverFrom returns the Server ctx belongs to.
+func serverFrom(ctx context.Context) *Server {
+	if s, ok := ctx.Value(serverKey{}).(*Server); ok {
+		return s
+	}
+	if command == nil {
+		panic("handlers: no Server in the context")
+	}
+	return command
+}
+
+// shared guards what the process sets up once, however many Servers it
+// runs: tracing, error reporting, the access log and MQTT.
+var shared struct {
+	sync.Once
+	err error
+}
+
+// newServer makes a Server of cfg over the settings, connects it to its
+// storage and prepares its database. Its workers are left to startWorkers.
+func newServer(cfg Config) (*Server, error) {
+	shared.Do(func() { shared.err = openShared() })
+	if shared.err != nil {
+		return nil, shared.err
+	}
+	s := &Server{
+		mongoURI:      cmp.Or(cfg.MongoURI, mongoConf.URI),
+		mongoDatabase: cmp.Or(cfg.MongoDatabase, mongoConf.Database),
+		collection:    cmp.Or(cfg.MongoCollection, collectionName),
+		storage:       cmp.Or(cfg.Storage, storageBackend),
+		publicURL:     strings.TrimRight(cmp.Or(cfg.PublicURL, publicURL), "/"),
+		maintenance:   cmp.Or(cfg.Maintenance, maintenanceConf.Mode),
+	}
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+	var err error
+	if s.jwtSecret, err = newJWTSecret(); err != nil {
+		return nil, err
+	}
+	if s.authenticators, err = newAuthenticators(); err != nil {
+		return nil, err
+	}
+	s.changes, s.logins, s.rnd = newHub(), newLoginThrottle(), renderer.New()
+	s.responses = newResponseCache(s.changes)
+	if err := s.openServices(); err != nil {
+		return nil, err
+	}
+	s.ctx, s.cancel = context.WithCancel(s.with(context.Background()))
+	if err := s.open(); err != nil {
+		s.cancel()
+		s.closeServices()
+		return nil, err
+	}
+	s.handler = router()
+	return s, nil
+}
+
+// validate checks the settings a Config can override.
+func (s *Server) validate() error {
+	var errs []error
+	if !strings.HasPrefix(s.mongoURI, "mongodb://") && !strings.HasPrefix(s.mongoURI, "mongodb+srv://") {
+		errs = append(errs, errors.New("TODO_MONGO_URI must start with mongodb:// or mongodb+srv://"))
+	}
+	if s.mongoDatabase == "" || strings.ContainsAny(s.mongoDatabase, `/\. "$`) {
+		errs = append(errs, fmt.Errorf("TODO_MONGO_DB: %q is not a database name", s.mongoDatabase))
+	}
+	if s.collection == "" || strings.Contains(s.collection, "$") || strings.HasPrefix(s.collection, "system.") {
+		errs = append(errs, fmt.Errorf("TODO_MONGO_COLLECTION: %q is not a collection name", s.collection))
+	}
+	if !strings.HasPrefix(s.publicURL, "http://") && !strings.HasPrefix(s.publicURL, "https://") {
+		errs = append(errs, fmt.Errorf("TODO_PUBLIC_URL: %q is not an http(s) URL", s.publicURL))
+	}
+	if maintenanceRank(s.maintenance) == 0 && s.maintenance != maintenanceOff {
+		errs = append(errs, fmt.Errorf("TODO_MAINTENANCE must be off, read-only or full, not %q", s.maintenance))
+	}
+	return errors.Join(errs...)
+}
+
+// jwtSecretSetting is TODO_JWT_SECRET, which tokens are signed with.
+var jwtSecretSetting = envString("TODO_JWT_SECRET", "")
+
+// newJWTSecret returns jwtSecretSetting or, if it is not set, a random
+// secret.
+func newJWTSecret() ([]byte, error) {
+	if jwtSecretSetting != "" {
+		return []byte(jwtSecretSetting), nil
+	}
+	slog.Warn("TODO_JWT_SECRET is not set, using a random secret; tokens will not survive a restart")
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	return secret, err
+}
+
+// configureOnce completes the settings for New, as loadConfig does for
+// Run, the first time it is called.
+var configureOnce = sync.OnceValue(configure)
+
+// New starts the service inside another program: it applies cfg over the
+// settings, connects to storage, starts the background workers and
+// returns the Server, which serves the API over HTTP until closed. It does
+// not listen, watch the configuration or handle signals; that is left to
+// the caller. Each Server keeps its own data, so a program can run several
+// side by side.
+func New(cfg Config) (*Server, error) {
+	if err := configureOnce(); err != nil {
+		return nil, err
+	}
+	s, err := newServer(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s.startWorkers()
+	return s, nil
+}
+
+// ServeHTTP serves the API.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r.WithContext(s.with(r.Context())))
+}
+
+// Close stops the workers, gives up the instance's leases and closes the
+// database. Requests still being served by then fail. Closing again does
+// nothing.
+func (s *Server) Close(ctx context.Context) error {
+	var err error
+	s.closed.Do(func() {
+		s.cancel()
+		releaseLeases(s.with(ctx))
+		s.closeServices()
+		err = s.db.Close(ctx)
+	})
+	return err
+}
+
+// https reports whether s is reached over HTTPS, so that its cookies
+// should be secure.
+func (s *Server) https() bool {
+	return strings.HasPrefix(s.publicURL, "https:")
+}
+
+// with returns a copy of ctx belonging to s.
+func (s *Server) with(ctx context.Context) context.Context {
+	return context.WithValue(ctx, serverKey{}, s)
+}
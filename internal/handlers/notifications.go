@@ -0,0 +1,366 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const remindersCollection string = "reminders"
+
+// The events users choose channels for, and the channels.
+const (
+	notificationAssignment = "assignment"
+	notificationDueSoon    = "dueSoon"
+	notificationReminder   = "reminder"
+
+	channelEmail   = "email"
+	channelPush    = "push"
+	channelWebhook = "webhook"
+)
+
+// notificationChannels lists the channels each event can go out on, all of
+// which it does unless the user chooses otherwise.
+var notificationChannels = map[string][]string{
+	notificationAssignment: {channelEmail, channelPush},
+	notificationDueSoon:    {channelEmail, channelPush},
+	notificationReminder:   {channelEmail, channelPush, channelWebhook},
+}
+
+type (
+	// notificationSettings says which emails and texts a user gets.
+	// Reminders and assignment emails are opt-out, digests and SMS
+	// reminders opt-in.
+	notificationSettings struct {
+		NoReminders   bool `bson:"noReminders,omitempty"`
+		NoAssignments bool `bson:"noAssignments,omitempty"`
+		// Channels holds the channels chosen for the events of
+		// notificationChannels the user changed; none turns an event off.
+		Channels map[string][]string `bson:"channels,omitempty"`
+		// DueSoonHours overrides the server-wide ReminderLead.
+		DueSoonHours int  `bson:"dueSoonHours,omitempty"`
+		SMS          bool `bson:"sms,omitempty"`
+		// Digest is digestDaily, digestWeekly or empty for none. It goes
+		// out at DigestTime (HH:MM) in the user's time zone, weekly ones
+		// on DigestWeekday; see digestUser.
+		Digest        string `bson:"digest,omitempty"`
+		DigestTime    string `bson:"digestTime,omitempty"`
+		DigestWeekday string `bson:"digestWeekday,omitempty"`
+		// LastDigest is the user's local date of the last digest sent.
+		LastDigest string `bson:"lastDigest,omitempty"`
+	}
+	notificationsRequest struct {
+		Reminders   *bool `json:"reminders"`
+		Assignments *bool `json:"assignments"`
+		// Channels maps events to the channels they go out on.
+		Channels      map[string][]string `json:"channels"`
+		DueSoonHours  *int                `json:"dueSoonHours" validate:"omitempty,min=1,max=168"`
+		SMS           *bool               `json:"sms"`
+		Digest        *string             `json:"digest" validate:"omitempty,oneof=daily weekly off"`
+		DigestTime    *string             `json:"digestTime" validate:"omitempty,datetime=15:04"`
+		DigestWeekday *string             `json:"digestWeekday" validate:"omitempty,weekday"`
+		// TimeZone sets the user's time zone, as PUT /account/settings
+		// does; it is here too since digests go out in it.
+		TimeZone *string `json:"timeZone" validate:"omitempty,timezone"`
+	}
+	// reminderModel records that a user was reminded of a todo due on
+	// DueDate, so that they are reminded once per due date.
+	reminderModel struct {
+		TodoID    ID        `bson:"todoId"`
+		UserID    ID        `bson:"userId"`
+		DueDate   time.Time `bson:"dueDate"`
+		ExpiresAt time.Time `bson:"expiresAt"`
+	}
+)
+
+// channels is where event goes out for a user with these settings.
+func (n notificationSettings) channels(event string) []string {
+	switch {
+	case event == notificationAssignment && n.NoAssignments, event == notificationDueSoon && n.NoReminders:
+		return []string{}
+	}
+	if cs, ok := n.Channels[event]; ok && cs != nil {
+		return cs
+	}
+	return notificationChannels[event]
+}
+
+func (n notificationSettings) notifies(event, channel string) bool {
+	return slices.Contains(n.channels(event), channel)
+}
+
+// dueSoonLead is how long before a todo falls due the user is reminded.
+func (n notificationSettings) dueSoonLead() time.Duration {
+	if n.DueSoonHours > 0 {
+		return time.Duration(n.DueSoonHours) * time.Hour
+	}
+	return liveConf().ReminderLead
+}
+
+// parseChannels checks that in only names channels event can go out on,
+// dropping duplicates.
+func parseChannels(event string, in []string) ([]string, bool) {
+	out := []string{}
+	for _, c := range in {
+		if !slices.Contains(notificationChannels[event], c) {
+			return nil, false
+		}
+		if !slices.Contains(out, c) {
+			out = append(out, c)
+		}
+	}
+	return out, true
+}
+
+func fetchNotifications(w http.ResponseWriter, r *http.Request) {
+	u, ok := loadCurrentUser(w, r)
+	if !ok {
+		return
+	}
+	n := u.Notifications
+	digest := n.Digest
+	if digest == "" {
+		digest = "off"
+	}
+	channels := map[string][]string{}
+	for event := range notificationChannels {
+		channels[event] = n.channels(event)
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"data": renderer.M{
+			"reminders":     !n.NoReminders,
+			"assignments":   !n.NoAssignments,
+			"channels":      channels,
+			"dueSoonHours":  int(n.dueSoonLead() / time.Hour),
+			"sms":           n.SMS,
+			"phone":         u.Phone,
+			"digest":        digest,
+			"digestTime":    n.digestTime(),
+			"digestWeekday": strings.ToLower(n.digestWeekday().String()),
+			"timeZone":      u.location().String(),
+		},
+	})
+}
+
+func updateNotifications(w http.ResponseWriter, r *http.Request) {
+	var req notificationsRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	set, unset := bson.M{}, bson.M{}
+	// Turning reminders or assignment emails back on restores the default
+	// channels, unless others are chosen at the same time.
+	if req.Reminders != nil {
+		set["notifications.noReminders"] = !*req.Reminders
+		if *req.Reminders {
+			unset["notifications.channels."+notificationDueSoon] = ""
+		}
+	}
+	if req.Assignments != nil {
+		set["notifications.noAssignments"] = !*req.Assignments
+		if *req.Assignments {
+			unset["notifications.channels."+notificationAssignment] = ""
+		}
+	}
+	for event, in := range req.Channels {
+		if _, ok := notificationChannels[event]; !ok {
+			writeError(w, r, apiErr(http.StatusBadRequest, "channels may only be chosen for "+strings.Join(slices.Sorted(maps.Keys(notificationChannels)), ", ")))
+			return
+		}
+		cs, ok := parseChannels(event, in)
+		if !ok {
+			writeError(w, r, apiErr(http.StatusBadRequest, event+" channels may only include "+strings.Join(notificationChannels[event], ", ")))
+			return
+		}
+		key := "notifications.channels." + event
+		delete(unset, key)
+		set[key] = cs
+		switch event {
+		case notificationDueSoon:
+			set["notifications.noReminders"] = len(cs) == 0
+		case notificationAssignment:
+			set["notifications.noAssignments"] = len(cs) == 0
+		}
+	}
+	if req.DueSoonHours != nil {
+		set["notifications.dueSoonHours"] = *req.DueSoonHours
+	}
+	if req.SMS != nil {
+		if *req.SMS {
+			u, ok := loadCurrentUser(w, r)
+			if !ok {
+				return
+			}
+			if !smsEnabled() || u.Phone == "" {
+				writeError(w, r, apiErr(http.StatusBadRequest, "verify a phone number before turning on SMS reminders"))
+				return
+			}
+		}
+		set["notifications.sms"] = *req.SMS
+	}
+	if req.Digest != nil {
+		if *req.Digest == "off" {
+			set["notifications.digest"] = ""
+		} else {
+			set["notifications.digest"] = *req.Digest
+		}
+	}
+	if req.DigestTime != nil {
+		t, _ := time.Parse("15:04", *req.DigestTime)
+		set["notifications.digestTime"] = t.Format("15:04")
+	}
+	if req.DigestWeekday != nil {
+		set["notifications.digestWeekday"] = strings.ToLower(*req.DigestWeekday)
+	}
+	if req.TimeZone != nil {
+		set["timeZone"] = *req.TimeZone
+	}
+	if len(set) > 0 || len(unset) > 0 {
+		update := bson.M{}
+		if len(set) > 0 {
+			update["$set"] = set
+		}
+		if len(unset) > 0 {
+			update["$unset"] = unset
+		}
+		if err := updateOne(r.Context(), db.Collection(usersCollection), bson.M{"_id": currentUser(r.Context())}, update); err != nil {
+			writeError(w, r, internalError("error updating notification settings", err))
+			return
+		}
+	}
+	if req.TimeZone != nil {
+		forgetUserZone(r.Context(), currentUser(r.Context()))
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"message": translate(r.Context(), "notification settings updated successfully"),
+	})
+}
+
+// notifyAssignment mails the todo's new assignee and pushes to their
+// browsers, as they chose, unless they assigned it to themselves.
+func notifyAssignment(ctx context.Context, actor ID, tm todoModel) {
+	if tm.AssigneeID.IsZero() || tm.AssigneeID == actor {
+		return
+	}
+	var assignee, by userModel
+	err := db.Collection(usersCollection).FindOne(ctx, bson.M{"_id": tm.AssigneeID}).Decode(&assignee)
+	if err == nil {
+		err = db.Collection(usersCollection).FindOne(ctx, bson.M{"_id": actor}).Decode(&by)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "assignment mail", "todo_id", tm.ID, "err", err)
+		return
+	}
+	if assignee.Disabled {
+		return
+	}
+	n := assignee.Notifications
+	if n.notifies(notificationAssignment, channelEmail) {
+		queueMail(ctx, assignee.Email, "assigned", map[string]interface{}{
+			"Actor": by.Email,
+			"Todo":  toTodo(ctx, tm),
+		})
+	}
+	if n.notifies(notificationAssignment, channelPush) {
+		queuePush(ctx, assignee.ID, pushMessage{
+			Title: by.Email + " assigned you a todo",
+			Body:  tm.Title,
+			URL:   serverFrom(ctx).publicURL + "/todo/" + tm.ID.String(),
+			Tag:   tm.ID.String(),
+		})
+	}
+}
+
+// sendReminders, sendDigests and sendSMSReminders run as periodic jobs,
+// see periodicJobs.
+func sendReminders(ctx context.Context, now time.Time) error {
+	cur, err := db.Collection(usersCollection).Find(ctx, bson.M{
+		"disabled":                  bson.M{"$ne": true},
+		"unverified":                bson.M{"$ne": true},
+		"notifications.noReminders": bson.M{"$ne": true},
+	})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		var u userModel
+		if err := cur.Decode(&u); err != nil {
+			return err
+		}
+		if err := remindUser(ctx, u, now); err != nil {
+			slog.Error("reminders", "user_id", u.ID, "err", err)
+		}
+	}
+	return cur.Err()
+}
+
+// remindUser mails u, and pushes to their browsers, as they chose, about
+// the todos they own or are assigned that fall due soon and that they have
+// not yet been reminded of. Overdue todos are left to the digest.
+func remindUser(ctx context.Context, u userModel, now time.Time) error {
+	n := u.Notifications
+	if len(n.channels(notificationDueSoon)) == 0 {
+		return nil
+	}
+	open := false
+	due, _, err := serverFrom(ctx).todos.List(ctx, todoScope{WorkspaceID: u.WorkspaceID, OwnerID: u.ID, AssigneeID: u.ID},
+		TodoFilter{Completed: &open, DueBefore: now.Add(n.dueSoonLead())}, 0, 0)
+	if err != nil {
+		return err
+	}
+	y, m, d := now.Date()
+	today := time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+	var remind []todo
+	for _, tm := range due {
+		if tm.DueDate.Before(today) {
+			continue
+		}
+		first, err := markReminded(ctx, db.Collection(remindersCollection), u.ID, tm)
+		if err != nil {
+			return err
+		}
+		if !first {
+			continue
+		}
+		remind = append(remind, toTodo(ctx, tm))
+		if n.notifies(notificationDueSoon, channelPush) {
+			queuePush(ctx, u.ID, pushMessage{
+				Title: "Due " + formatDueDate(tm.DueDate),
+				Body:  tm.Title,
+				URL:   serverFrom(ctx).publicURL + "/todo/" + tm.ID.String(),
+				Tag:   tm.ID.String(),
+			})
+		}
+	}
+	if len(remind) > 0 && n.notifies(notificationDueSoon, channelEmail) {
+		queueMail(ctx, u.Email, "due-soon", map[string]interface{}{"Todos": remind})
+	}
+	return nil
+}
+
+// markReminded records a reminder of the todo in c, reminders or
+// sms_reminders, reporting false if user was already reminded of it for
+// its current due date, by this or another instance.
+func markReminded(ctx context.Context, c collection, user ID, tm todoModel) (bool, error) {
+	// Matching an existing reminder for another due date updates it; with
+	// none the upsert inserts one, or fails on the unique index if there is
+	// one for this due date.
+	_, err := c.UpdateOne(ctx,
+		bson.M{"todoId": tm.ID, "userId": user, "dueDate": bson.M{"$ne": tm.DueDate}},
+		bson.M{"$set": reminderModel{TodoID: tm.ID, UserID: user, DueDate: tm.DueDate, ExpiresAt: tm.DueDate.Add(7 * 24 * time.Hour)}},
+		options.UpdateOne().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,225 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/github"
+	"golang.org/x/oauth2/google"
+)
+
+const oauthStateCookie = "oauth_state"
+
+type (
+	identity struct {
+		Provider string `bson:"provider"`
+		Subject  string `bson:"subject"`
+	}
+
+	// oauthProvider knows how to turn an access token into an external
+	// identity and (verified) email address.
+	oauthProvider struct {
+		config  *oauth2.Config
+		profile func(ctx context.Context, config *oauth2.Config, tok *oauth2.Token) (subject, email string, err error)
+	}
+)
+
+// oauthProviders holds the providers configured through the environment,
+// e.g. TODO_OAUTH_GITHUB_CLIENT_ID and TODO_OAUTH_GITHUB_CLIENT_SECRET.
+var oauthProviders = map[string]*oauthProvider{}
+
+// registerOAuthProviders sets up the sign-in providers with credentials
+// configured, once publicURL is known.
+func registerOAuthProviders() {
+	base := strings.TrimRight(envString("TODO_OAUTH_REDIRECT_BASE", ""), "/")
+	if base == "" {
+		base = publicURL
+	}
+	register := func(name string, endpoint oauth2.Endpoint, scopes []string, profile func(context.Context, *oauth2.Config, *oauth2.Token) (string, string, error)) {
+		prefix := "TODO_OAUTH_" + strings.ToUpper(name) + "_"
+		id, secret := envString(prefix+"CLIENT_ID", ""), envString(prefix+"CLIENT_SECRET", "")
+		if id == "" || secret == "" {
+			return
+		}
+		oauthProviders[name] = &oauthProvider{
+			config: &oauth2.Config{
+				ClientID:     id,
+				ClientSecret: secret,
+				Endpoint:     endpoint,
+				RedirectURL:  base + "/auth/oauth/" + name + "/callback",
+				Scopes:       scopes,
+			},
+			profile: profile,
+		}
+	}
+	register("google", google.Endpoint, []string{"openid", "email"}, googleProfile)
+	register("github", github.Endpoint, []string{"read:user", "user:email"}, githubProfile)
+	registerOIDC(base)
+}
+
+func oauthHandlers() http.Handler {
+	rg := chi.NewRouter()
+	rg.Group(func(r chi.Router) {
+		r.Get("/{provider}", oauthStart)
+		r.Get("/{provider}/callback", oauthCallback)
+	})
+	return rg
+}
+
+func oauthStart(w http.ResponseWriter, r *http.Request) {
+	p, ok := oauthProviders[chi.URLParam(r, "provider")]
+	if !ok {
+		writeError(w, r, apiErr(http.StatusNotFound, "unknown oauth provider"))
+		return
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		writeError(w, r, internalError("error starting login", err))
+		return
+	}
+	state := base64.RawURLEncoding.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    state,
+		Path:     "/auth/oauth",
+		MaxAge:   int((10 * time.Minute).Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, p.config.AuthCodeURL(state), http.StatusFound)
+}
+
+func oauthCallback(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "provider")
+	p, ok := oauthProviders[name]
+	if !ok {
+		writeError(w, r, apiErr(http.StatusNotFound, "unknown oauth provider"))
+		return
+	}
+	c, err := r.Cookie(oauthStateCookie)
+	if err != nil || c.Value == "" || c.Value != r.URL.Query().Get("state") {
+		writeError(w, r, apiErr(http.StatusBadRequest, "invalid oauth state"))
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oauthStateCookie, Path: "/auth/oauth", MaxAge: -1})
+
+	tok, err := p.config.Exchange(r.Context(), r.URL.Query().Get("code"))
+	if err != nil {
+		writeError(w, r, &apiError{
+			Status:  http.StatusUnauthorized,
+			Message: "oauth code exchange failed",
+			Err:     err,
+		})
+		return
+	}
+	subject, email, err := p.profile(r.Context(), p.config, tok)
+	if err != nil {
+		writeError(w, r, &apiError{
+			Status:  http.StatusBadGateway,
+			Message: "error fetching oauth profile",
+			Err:     err,
+		})
+		return
+	}
+	u, err := userForIdentity(r.Context(), currentWorkspace(r.Context()), identity{Provider: name, Subject: subject}, email)
+	if err != nil {
+		writeError(w, r, internalError("error signing in", err))
+		return
+	}
+	issueToken(w, r, http.StatusOK, u)
+}
+
+// userForIdentity finds the workspace user linked to an external identity,
+// linking it to an existing account with the same email or creating a new
+// account.
+func userForIdentity(ctx context.Context, ws ID, id identity, email string) (userModel, error) {
+	var u userModel
+	c := db.Collection(usersCollection)
+	err := c.FindOne(ctx, bson.M{"workspaceId": ws, "identities": bson.M{"$elemMatch": bson.M{
+		"provider": id.Provider,
+		"subject":  id.Subject,
+	}}}).Decode(&u)
+	if err != mongo.ErrNoDocuments {
+		return u, err
+	}
+	email = strings.ToLower(strings.TrimSpace(email))
+	if email == "" {
+		return u, fmt.Errorf("%s did not return a verified email", id.Provider)
+	}
+	// The provider vouches for the address, so linking also verifies it.
+	err = c.FindOneAndUpdate(ctx, bson.M{"workspaceId": ws, "email": email}, bson.M{
+		"$addToSet":    bson.M{"identities": id},
+		"$unset":       bson.M{"unverified": ""},
+		"$setOnInsert": bson.M{"_id": newID(), "role": roleMember, "createAt": time.Now()},
+	}, options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&u)
+	return u, err
+}
+
+func googleProfile(ctx context.Context, config *oauth2.Config, tok *oauth2.Token) (string, string, error) {
+	client := config.Client(ctx, tok)
+	var p struct {
+		Sub           string `json:"sub"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+	if err := getJSON(ctx, client, "https://openidconnect.googleapis.com/v1/userinfo", &p); err != nil {
+		return "", "", err
+	}
+	if !p.EmailVerified {
+		p.Email = ""
+	}
+	return p.Sub, p.Email, nil
+}
+
+func githubProfile(ctx context.Context, config *oauth2.Config, tok *oauth2.Token) (string, string, error) {
+	client := config.Client(ctx, tok)
+	var p struct {
+		ID int64 `json:"id"`
+	}
+	if err := getJSON(ctx, client, "https://api.github.com/user", &p); err != nil {
+		return "", "", err
+	}
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := getJSON(ctx, client, "https://api.github.com/user/emails", &emails); err != nil {
+		return "", "", err
+	}
+	var email string
+	for _, e := range emails {
+		if e.Primary && e.Verified {
+			email = e.Email
+		}
+	}
+	return fmt.Sprint(p.ID), email, nil
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// registerOIDC adds a generic OpenID Connect provider discovered from
+// TODO_OIDC_ISSUER (e.g. a Keycloak realm or Okta org URL). It is served
+// under /auth/oauth/{TODO_OIDC_NAME}, "oidc" by default.
+func registerOIDC(base string) {
+	issuer := envString("TODO_OIDC_ISSUER", "")
+	id, secret := envString("TODO_OIDC_CLIENT_ID", ""), envString("TODO_OIDC_CLIENT_SECRET", "")
+	if issuer == "" || id == "" {
+		return
+	}
+	name := envString("TODO_OIDC_NAME", "")
+	if name == "" {
+		name = "oidc"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		slog.Warn("oidc discovery failed, login disabled", "issuer", issuer, "provider", name, "err", err)
+		return
+	}
+	verifier := provider.Verifier(&oidc.Config{ClientID: id})
+
+	oauthProviders[name] = &oauthProvider{
+		config: &oauth2.Config{
+			ClientID:     id,
+			ClientSecret: secret,
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  base + "/auth/oauth/" + name + "/callback",
+			Scopes:       []string{oidc.ScopeOpenID, "email"},
+		},
+		profile: func(ctx context.Context, _ *oauth2.Config, tok *oauth2.Token) (string, string, error) {
+			raw, ok := tok.Extra("id_token").(string)
+			if !ok {
+				return "", "", errors.New("token response did not include an id_token")
+			}
+			idToken, err := verifier.Verify(ctx, raw)
+			if err != nil {
+				return "", "", err
+			}
+			var claims struct {
+				Email         string `json:"email"`
+				EmailVerified *bool  `json:"email_verified"`
+			}
+			if err := idToken.Claims(&claims); err != nil {
+				return "", "", err
+			}
+			// Some directories omit email_verified entirely; only an explicit
+			// false is treated as unverified.
+			if claims.EmailVerified != nil && !*claims.EmailVerified {
+				claims.Email = ""
+			}
+			return idToken.Subject, claims.Email, nil
+		},
+	}
+}
@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/sangin4208/go-todo/internal/storage"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// Events for webhooks and the broker go through a transactional outbox:
+// recordEvent writes each one to the outbox in the same transaction as the
+// change to the todo, and dispatchOutbox delivers it once committed. A
+// crash mid-request can therefore neither lose the events of a change nor
+// announce one that was rolled back. Events are delivered at least once,
+// so receivers should dedupe on the event ID.
+//
+// The guarantee needs the transaction, and so TODO_STORAGE=mongo or events
+// on a replica set. Elsewhere the event is recorded right after the change.
+
+const (
+	outboxCollection string = "outbox"
+	// outboxLease is how long a dispatcher has to deliver an event it
+	// claimed before another may claim it; a failed delivery is retried
+	// once it lapses.
+	outboxLease = time.Minute
+)
+
+// outboxKick wakes dispatchOutbox when an event has been committed.
+var outboxKick = make(chan struct{}, 1)
+
+type outboxModel struct {
+	// ID is also the event's ID for webhooks and the broker.
+	ID   ID     `bson:"_id"`
+	Type string `bson:"type"`
+	// Todo is the todo as of the change, its title encrypted as in the
+	// todo itself.
+	Todo        todoModel `bson:"todo"`
+	CreateAt    time.Time `bson:"createAt"`
+	LockedUntil time.Time `bson:"lockedUntil"`
+}
+
+// atomically runs fn, which changes todos and records their events, in a
+// transaction if todos are kept in Mongo, and then wakes the dispatcher.
+func atomically(ctx context.Context, fn func(ctx context.Context) error) error {
+	var err error
+	if serverFrom(ctx).todosInMongo() {
+		err = withTransaction(ctx, fn)
+	} else {
+		err = fn(ctx)
+	}
+	if err == nil {
+		wakeOutbox()
+	}
+	return err
+}
+
+// wakeOutbox tells dispatchOutbox that events have been committed.
+func wakeOutbox() {
+	select {
+	case outboxKick <- struct{}{}:
+	default:
+	}
+}
+
+// recordEvent adds an event to the outbox. Use the context given by
+// atomically so that it is part of the transaction.
+func recordEvent(ctx context.Context, typ string, tm todoModel) error {
+	if err := sealTodo(&tm); err != nil {
+		return err
+	}
+	now := time.Now()
+	_, err := db.Collection(outboxCollection).InsertOne(ctx, &outboxModel{
+		ID:          newID(),
+		Type:        typ,
+		Todo:        tm,
+		CreateAt:    now,
+		LockedUntil: now,
+	})
+	return err
+}
+
+// dispatchOutbox delivers events from the outbox, oldest first, until ctx
+// is canceled. Several instances may dispatch side by side; each event is
+// claimed by one at a time.
+func dispatchOutbox(ctx context.Context) {
+	poll := time.NewTicker(5 * time.Second)
+	defer poll.Stop()
+	for {
+		for {
+			e, err := claimEvent(ctx)
+			if err == mongo.ErrNoDocuments {
+				break
+			}
+			if err != nil {
+				slog.Error("outbox", "err", err)
+				break
+			}
+			if err := dispatchEvent(ctx, e); err != nil {
+				slog.Error("outbox", "event", e.Type, "todo_id", e.Todo.ID, "err", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-outboxKick:
+		case <-poll.C:
+		}
+	}
+}
+
+func claimEvent(ctx context.Context) (outboxModel, error) {
+	var e outboxModel
+	now := time.Now()
+	err := db.Collection(outboxCollection).FindOneAndUpdate(ctx,
+		bson.M{"lockedUntil": bson.M{"$lte": now}},
+		bson.M{"$set": bson.M{"lockedUntil": now.Add(outboxLease)}},
+		options.FindOneAndUpdate().SetSort(storage.SortKeys("createAt", "_id")),
+	).Decode(&e)
+	return e, err
+}
+
+// dispatchEvent announces the event and removes it from the outbox. If
+// announcing fails part-way the event stays, to be dispatched again.
+func dispatchEvent(ctx context.Context, e outboxModel) error {
+	if err := unsealTodo(&e.Todo); err != nil {
+		return err
+	}
+	if err := announce(ctx, e.ID, e.Type, e.Todo); err != nil {
+		return err
+	}
+	_, err := db.Collection(outboxCollection).DeleteOne(ctx, bson.M{"_id": e.ID})
+	return err
+}
@@ -0,0 +1,395 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// The web UI is rendered on the server. Its forms and buttons use htmx to
+// fetch fragments of HTML from /ui and swap them into the page, so there
+// is no JavaScript of our own to write or build. Browsers sign in with a
+// session cookie holding the session's refresh token, which, unlike the
+// API's, is not rotated; the sessions list and revocation cover both.
+// Without JavaScript, signing in and out and adding todos still work as
+// plain form posts.
+
+const pageSessionCookie = "todo_session"
+
+var (
+	loginPage = []string{"layout.tmpl", "login.tmpl"}
+	todosPage = []string{"layout.tmpl", "todos.tmpl"}
+	todoParts = []string{"todos.tmpl"}
+)
+
+// pageTodo is a todo as the pages show it.
+type pageTodo struct {
+	todo
+	CanWrite bool
+}
+
+// pageSession authenticates browsers by their session cookie, leaving
+// requests without a valid one anonymous.
+func pageSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := r.Cookie(pageSessionCookie)
+		if err != nil || c.Value == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		p, err := sessionPrincipal(r, c.Value)
+		switch {
+		case errors.Is(err, mongo.ErrNoDocuments), errors.Is(err, errWrongWorkspace), errors.Is(err, errAccountDisabled):
+			setPageSession(w, r, "", time.Time{})
+			next.ServeHTTP(w, r)
+		case err != nil:
+			writeError(w, r, internalError("error checking session", err))
+		default:
+			noteRequestUser(r.Context(), p.UserID)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey, p)))
+		}
+	})
+}
+
+// sessionPrincipal resolves a session's refresh token to its user, as
+// refreshSession does but without rotating it.
+func sessionPrincipal(r *http.Request, refresh string) (principal, error) {
+	now := time.Now()
+	var s sessionModel
+	err := db.Collection(sessionsCollection).FindOneAndUpdate(r.Context(), bson.M{
+		"refreshHash": hashAPIToken(refresh),
+		"expiresAt":   bson.M{"$gt": now},
+	}, bson.M{"$set": bson.M{"lastUsedAt": now, "ip": r.RemoteAddr}}).Decode(&s)
+	var u userModel
+	if err == nil {
+		err = db.Collection(usersCollection).FindOne(r.Context(), bson.M{"_id": s.UserID}).Decode(&u)
+	}
+	if err == nil && u.WorkspaceID != currentWorkspace(r.Context()) {
+		err = errWrongWorkspace
+	}
+	if err == nil && u.Disabled {
+		err = errAccountDisabled
+	}
+	if err != nil {
+		return principal{}, err
+	}
+	p := userPrincipal(u)
+	p.SessionID = s.ID
+	return p, nil
+}
+
+// setPageSession sets the session cookie, or clears it given no token.
+func setPageSession(w http.ResponseWriter, r *http.Request, refresh string, expires time.Time) {
+	c := &http.Cookie{
+		Name:     pageSessionCookie,
+		Value:    refresh,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   serverFrom(r.Context()).https(),
+		SameSite: http.SameSiteLaxMode,
+	}
+	if refresh == "" {
+		c.MaxAge = -1
+	}
+	http.SetCookie(w, c)
+}
+
+// requirePageAuth sends browsers that are not signed in to the sign-in
+// page. It must run after pageSession.
+func requirePageAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if currentUser(r.Context()).IsZero() {
+			pageRedirect(w, r, "/")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isHTMX reports whether r was made by htmx, for a fragment of a page.
+func isHTMX(r *http.Request) bool {
+	return r.Header.Get("HX-Request") == "true"
+}
+
+// pageRedirect sends the browser to url: a whole new page for htmx
+// requests, a 303 for forms posted without it.
+func pageRedirect(w http.ResponseWriter, r *http.Request, url string) {
+	if isHTMX(r) {
+		w.Header().Set("HX-Redirect", url)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Redirect(w, r, url, http.StatusSeeOther)
+}
+
+// homeHandler shows the signed-in user's todos, or the sign-in form.
+func homeHandler(w http.ResponseWriter, r *http.Request) {
+	if currentUser(r.Context()).IsZero() {
+		renderTemplate(w, r, http.StatusOK, loginPage, "", renderer.M{"CSRFToken": csrfToken(r)})
+		return
+	}
+	data, err := todoListData(r)
+	if err != nil {
+		writeError(w, r, internalError("error fetching todos", err))
+		return
+	}
+	renderTemplate(w, r, http.StatusOK, todosPage, "", data)
+}
+
+func pageLogin(w http.ResponseWriter, r *http.Request) {
+	c := credentials{
+		Email:    r.PostFormValue("email"),
+		Password: r.PostFormValue("password"),
+		Code:     r.PostFormValue("code"),
+	}
+	status := http.StatusUnauthorized
+	var err error
+	if wait := loginLockedFor(r, c.Email); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		status, err = http.StatusTooManyRequests, apiErr(http.StatusTooManyRequests, "too many failed attempts, try again later")
+	}
+	var u userModel
+	if err == nil {
+		u, err = signIn(r, c)
+	}
+	if err == nil && u.Disabled {
+		err = apiErr(http.StatusForbidden, "this account has been disabled")
+	}
+	var s sessionModel
+	var refresh string
+	if err == nil {
+		s, refresh, err = startSession(r, u)
+	}
+	var e *apiError
+	if err != nil && (!errors.As(err, &e) || e.Status >= 500) {
+		writeError(w, r, err)
+		return
+	}
+	if err != nil {
+		renderForm(w, r, status, loginPage, "login-form", renderer.M{
+			"CSRFToken": csrfToken(r),
+			"Email":     c.Email,
+			"AskCode":   c.Code != "" || e.Code == "totp_required",
+			"Error":     translate(r.Context(), e.Message),
+		})
+		return
+	}
+	setPageSession(w, r, refresh, s.ExpiresAt)
+	pageRedirect(w, r, "/")
+}
+
+func pageLogout(w http.ResponseWriter, r *http.Request) {
+	if p := currentPrincipal(r.Context()); !p.SessionID.IsZero() {
+		_, err := db.Collection(sessionsCollection).DeleteOne(r.Context(), bson.M{"_id": p.SessionID, "userId": p.UserID})
+		if err != nil {
+			writeError(w, r, internalError("error signing out", err))
+			return
+		}
+	}
+	setPageSession(w, r, "", time.Time{})
+	pageRedirect(w, r, "/")
+}
+
+func pageHandlers() http.Handler {
+	rg := chi.NewRouter()
+	rg.Group(func(r chi.Router) {
+		r.Get("/todos", pageListTodos)
+		r.Get("/todos/{id}", pageShowTodo)
+		r.Group(func(r chi.Router) {
+			r.Use(requireRole(roleAdmin, roleMember))
+			r.Post("/todos", pageCreateTodo)
+			r.Get("/todos/{id}/edit", pageEditTodo)
+			r.Put("/todos/{id}", pageUpdateTodo)
+			r.Post("/todos/{id}/toggle", pageToggleTodo)
+			r.Delete("/todos/{id}", pageDeleteTodo)
+		})
+	})
+	return rg
+}
+
+// todoListData is what the todo list shows for r: all todos, or with
+// show=open or show=done only those.
+func todoListData(r *http.Request) (renderer.M, error) {
+	show := r.FormValue("show")
+	var filter TodoFilter
+	switch show {
+	case "open", "done":
+		completed := show == "done"
+		filter.Completed = &completed
+	default:
+		show = "all"
+	}
+	p := currentPrincipal(r.Context())
+	found, _, err := findTodos(r.Context(), p, filter, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]pageTodo, len(found))
+	for i, tm := range found {
+		items[i] = pageTodo{todo: toTodo(r.Context(), tm), CanWrite: canWrite(r.Context())}
+	}
+	return renderer.M{
+		"CSRFToken": csrfToken(r),
+		"CanWrite":  canWrite(r.Context()),
+		"Show":      show,
+		"Todos":     items,
+	}, nil
+}
+
+func pageListTodos(w http.ResponseWriter, r *http.Request) {
+	if !isHTMX(r) {
+		http.Redirect(w, r, "/?"+r.URL.RawQuery, http.StatusSeeOther)
+		return
+	}
+	data, err := todoListData(r)
+	if err != nil {
+		writeError(w, r, internalError("error fetching todos", err))
+		return
+	}
+	w.Header().Add("Vary", "HX-Request")
+	renderTemplate(w, r, http.StatusOK, todoParts, "todo-list", data)
+}
+
+func pageCreateTodo(w http.ResponseWriter, r *http.Request) {
+	t := todo{Title: strings.TrimSpace(r.PostFormValue("title")), DueDate: r.PostFormValue("dueDate")}
+	var err error
+	if v := validationErrors(r.Context(), &t); len(v) > 0 {
+		err = apiErr(http.StatusUnprocessableEntity, v[0].Message)
+	}
+	if err == nil {
+		dueDate, _ := parseDueDate(t.DueDate)
+		tm := todoModel{ID: newID(), Title: t.Title, CreateAt: time.Now(), DueDate: dueDate}
+		err = insertTodo(r.Context(), currentPrincipal(r.Context()), &tm)
+	}
+	if errors.Is(err, errQuotaExceeded) {
+		err = apiErr(http.StatusUnprocessableEntity, "you have reached your limit of open todos")
+	}
+	var e *apiError
+	if err != nil && (!errors.As(err, &e) || e.Status >= 500) {
+		writeError(w, r, err)
+		return
+	}
+	if err != nil {
+		data, lerr := todoListData(r)
+		if lerr != nil {
+			writeError(w, r, internalError("error fetching todos", lerr))
+			return
+		}
+		data["Error"], data["Title"], data["DueDate"] = translate(r.Context(), e.Message), t.Title, t.DueDate
+		w.Header().Set("HX-Retarget", "#todo-form")
+		w.Header().Set("HX-Reswap", "outerHTML")
+		renderForm(w, r, http.StatusUnprocessableEntity, todosPage, "todo-form", data)
+		return
+	}
+	if !isHTMX(r) {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	data, err := todoListData(r)
+	if err != nil {
+		writeError(w, r, internalError("error fetching todos", err))
+		return
+	}
+	// A fresh form goes along, out of band, to replace the filled one.
+	data["OOB"] = true
+	renderTemplate(w, r, http.StatusOK, todoParts, "todo-added", data)
+}
+
+// pageTodoParam looks up the todo named in the URL for the caller.
+func pageTodoParam(w http.ResponseWriter, r *http.Request) (todoModel, bool) {
+	id, ok := todoIDParam(w, r)
+	if !ok {
+		return todoModel{}, false
+	}
+	tm, err := getTodo(r.Context(), currentPrincipal(r.Context()), id)
+	if err != nil {
+		writeError(w, r, err)
+		return todoModel{}, false
+	}
+	return tm, true
+}
+
+func renderTodoItem(w http.ResponseWriter, r *http.Request, tm todoModel) {
+	renderTemplate(w, r, http.StatusOK, todoParts, "todo-item", pageTodo{todo: toTodo(r.Context(), tm), CanWrite: canWrite(r.Context())})
+}
+
+func pageShowTodo(w http.ResponseWriter, r *http.Request) {
+	if tm, ok := pageTodoParam(w, r); ok {
+		renderTodoItem(w, r, tm)
+	}
+}
+
+func pageEditTodo(w http.ResponseWriter, r *http.Request) {
+	if tm, ok := pageTodoParam(w, r); ok {
+		renderTemplate(w, r, http.StatusOK, todoParts, "todo-edit", renderer.M{"Todo": toTodo(r.Context(), tm)})
+	}
+}
+
+func pageUpdateTodo(w http.ResponseWriter, r *http.Request) {
+	tm, ok := pageTodoParam(w, r)
+	if !ok {
+		return
+	}
+	t := todo{Title: strings.TrimSpace(r.PostFormValue("title"))}
+	if v := validationErrors(r.Context(), &t); len(v) > 0 {
+		edited := toTodo(r.Context(), tm)
+		edited.Title = t.Title
+		renderTemplate(w, r, http.StatusUnprocessableEntity, todoParts, "todo-edit", renderer.M{
+			"Todo":  edited,
+			"Error": v[0].Message,
+		})
+		return
+	}
+	tm, err := setTodo(r.Context(), currentPrincipal(r.Context()), tm.ID, t.Title, tm.Completed)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	renderTodoItem(w, r, tm)
+}
+
+func pageToggleTodo(w http.ResponseWriter, r *http.Request) {
+	tm, ok := pageTodoParam(w, r)
+	if !ok {
+		return
+	}
+	tm, err := setTodo(r.Context(), currentPrincipal(r.Context()), tm.ID, tm.Title, !tm.Completed)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	renderTodoItem(w, r, tm)
+}
+
+func pageDeleteTodo(w http.ResponseWriter, r *http.Request) {
+	tm, ok := pageTodoParam(w, r)
+	if !ok {
+		return
+	}
+	if err := removeTodo(r.Context(), currentPrincipal(r.Context()), tm.ID); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	// htmx swaps the item for nothing, removing it.
+	w.WriteHeader(http.StatusOK)
+}
+
+// renderForm answers a form sent with errors: htmx gets the form back
+// to swap in, plain posts the whole page around it.
+func renderForm(w http.ResponseWriter, r *http.Request, status int, page []string, form string, data any) {
+	if isHTMX(r) {
+		renderTemplate(w, r, status, page, form, data)
+		return
+	}
+	renderTemplate(w, r, status, page, "", data)
+}
@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+)
+
+// A handler that panics answers 500 instead of dropping the connection,
+// and the panic is logged with its stack. With TODO_SENTRY_DSN set, it is
+// also reported to Sentry, or anything taking Sentry's protocol such as
+// GlitchTip, along with the request, its ID and the user.
+// TODO_SENTRY_ENVIRONMENT tells deployments apart in reports.
+
+var sentryConf = struct {
+	DSN         string
+	Environment string
+}{
+	DSN:         envString("TODO_SENTRY_DSN", ""),
+	Environment: envString("TODO_SENTRY_ENVIRONMENT", "production"),
+}
+
+// sentryFlushTimeout bounds how long shutdown waits for reports to go out.
+const sentryFlushTimeout = 2 * time.Second
+
+func initSentry() error {
+	if sentryConf.DSN == "" {
+		return nil
+	}
+	return sentry.Init(sentry.ClientOptions{
+		Dsn:         sentryConf.DSN,
+		Environment: sentryConf.Environment,
+		ServerName:  instanceID,
+	})
+}
+
+func flushSentry() {
+	if sentryConf.DSN != "" {
+		sentry.Flush(sentryFlushTimeout)
+	}
+}
+
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			// The server aborts handlers this way on purpose.
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			slog.ErrorContext(r.Context(), "panic", "err", fmt.Sprint(v), "stack", string(debug.Stack()))
+			reportPanic(r, v)
+			// A response already under way can only be cut short.
+			if ww.Status() != 0 {
+				panic(http.ErrAbortHandler)
+			}
+			writeError(ww, r, apiErr(http.StatusInternalServerError, "internal server error"))
+		}()
+		next.ServeHTTP(ww, r)
+	})
+}
+
+func reportPanic(r *http.Request, v interface{}) {
+	if sentryConf.DSN == "" {
+		return
+	}
+	hub := sentry.CurrentHub().Clone()
+	hub.ConfigureScope(func(scope *sentry.Scope) {
+		scope.SetRequest(r)
+		if id := middleware.GetReqID(r.Context()); id != "" {
+			scope.SetTag("request_id", id)
+		}
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			scope.SetTag("route", rctx.RoutePattern())
+		}
+		if user := requestUser(r.Context()); !user.IsZero() {
+			scope.SetUser(sentry.User{ID: user.String()})
+		}
+	})
+	hub.RecoverWithContext(r.Context(), v)
+}
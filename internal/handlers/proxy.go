@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Behind a load balancer every request comes from the balancer, so the
+// client's address has to be taken from the X-Forwarded-For or X-Real-IP
+// header it adds. Anyone can send those headers, so they are only believed
+// from the proxies TODO_TRUSTED_PROXIES lists, as addresses or CIDRs such
+// as 10.0.0.0/8. X-Forwarded-For is read from the right, skipping trusted
+// hops, to the first address a trusted proxy vouches for. The address then
+// replaces the request's RemoteAddr, so logs, rate limits and sessions all
+// see the client.
+
+var trustedProxies = envPrefixes("TODO_TRUSTED_PROXIES")
+
+// envPrefixes reads a comma-separated setting of addresses and CIDRs.
+func envPrefixes(name string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, v := range splitSetting(envString(name, "")) {
+		p, err := netip.ParsePrefix(v)
+		if err != nil {
+			addr, aerr := netip.ParseAddr(v)
+			if aerr != nil {
+				configErrors = append(configErrors, fmt.Errorf("%s: %q is not an address or CIDR", name, v))
+				continue
+			}
+			p = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes
+}
+
+func trustedProxy(addr netip.Addr) bool {
+	return containsAddr(trustedProxies, addr)
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func realIP(next http.Handler) http.Handler {
+	if len(trustedProxies) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ip, ok := forwardedFor(r); ok {
+			r.RemoteAddr = ip.String()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forwardedFor returns the client address r's proxies give, if it came
+// through trusted ones.
+func forwardedFor(r *http.Request) (netip.Addr, bool) {
+	peer, err := netip.ParseAddr(clientIP(r.RemoteAddr))
+	if err != nil || !trustedProxy(peer) {
+		return netip.Addr{}, false
+	}
+	var hops []string
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+	if len(hops) == 0 {
+		hops = []string{r.Header.Get("X-Real-IP")}
+	}
+	var client netip.Addr
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(clientIP(strings.TrimSpace(hops[i])))
+		if err != nil {
+			// Past a hop that makes no sense nothing can be trusted.
+			break
+		}
+		client = addr.Unmap()
+		if !trustedProxy(client) {
+			break
+		}
+	}
+	return client, client.IsValid()
+}
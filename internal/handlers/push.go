@@ -0,0 +1,229 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	webpush "github.com/SherClockHolmes/webpush-go"
+	"github.com/go-chi/chi"
+	"github.com/sangin4208/go-todo/internal/storage"
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// pushConf configures Web Push, which is on when TODO_VAPID_PUBLIC_KEY and
+// TODO_VAPID_PRIVATE_KEY hold a VAPID key pair, as generated by
+// webpush.GenerateVAPIDKeys or `npx web-push generate-vapid-keys`. Push
+// services may contact TODO_VAPID_SUBJECT, an email address or https URL,
+// about the messages; it defaults to the mail sender.
+var pushConf = struct {
+	PublicKey, PrivateKey, Subject string
+}{
+	PublicKey:  envString("TODO_VAPID_PUBLIC_KEY", ""),
+	PrivateKey: envString("TODO_VAPID_PRIVATE_KEY", ""),
+	Subject:    envString("TODO_VAPID_SUBJECT", mailConf.From),
+}
+
+const (
+	pushSubscriptionsCollection string = "push_subscriptions"
+	maxPushSubscriptions               = 20
+	// pushTTL is how long push services keep a message for an offline
+	// browser.
+	pushTTL = 24 * time.Hour
+)
+
+type (
+	// pushSubscriptionModel is a browser's PushSubscription. The endpoint
+	// and keys let anyone push to the browser, so they are never shown.
+	pushSubscriptionModel struct {
+		ID        ID        `bson:"_id,omitempty"`
+		UserID    ID        `bson:"userId"`
+		Endpoint  string    `bson:"endpoint"`
+		P256dh    string    `bson:"p256dh"`
+		Auth      string    `bson:"auth"`
+		UserAgent string    `bson:"userAgent,omitempty"`
+		CreateAt  time.Time `bson:"createAt"`
+	}
+	pushSubscription struct {
+		ID        string `json:"id"`
+		UserAgent string `json:"userAgent,omitempty"`
+		CreateAt  string `json:"createAt"`
+	}
+	// pushMessage is what the service worker receives; it shows Title and
+	// Body, opening URL on click. Tag lets a newer notification about the
+	// same todo replace an older one.
+	pushMessage struct {
+		Title string `json:"title"`
+		Body  string `json:"body"`
+		URL   string `json:"url"`
+		Tag   string `json:"tag,omitempty"`
+	}
+)
+
+func pushEnabled() bool {
+	return pushConf.PublicKey != "" && pushConf.PrivateKey != ""
+}
+
+func pushHandlers() http.Handler {
+	rg := chi.NewRouter()
+	rg.Group(func(r chi.Router) {
+		r.Get("/key", fetchPushKey)
+		r.Get("/subscriptions", fetchPushSubscriptions)
+		r.Post("/subscriptions", createPushSubscription)
+		r.Delete("/subscriptions/{id}", deletePushSubscription)
+	})
+	return rg
+}
+
+// fetchPushKey gives the applicationServerKey browsers subscribe with.
+func fetchPushKey(w http.ResponseWriter, r *http.Request) {
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"data": renderer.M{"publicKey": pushConf.PublicKey},
+	})
+}
+
+func fetchPushSubscriptions(w http.ResponseWriter, r *http.Request) {
+	var subs []pushSubscriptionModel
+	if err := storage.FindAll(r.Context(), db.Collection(pushSubscriptionsCollection), bson.M{"userId": currentUser(r.Context())}, &subs,
+		options.Find().SetSort(storage.SortKeys("createAt"))); err != nil {
+		writeError(w, r, internalError("failed to fetch push subscriptions", err))
+		return
+	}
+	data := make([]pushSubscription, 0, len(subs))
+	for _, s := range subs {
+		data = append(data, toPushSubscription(s))
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"data": data,
+	})
+}
+
+// createPushSubscription registers the PushSubscription in the body, as
+// the browser serializes it. Registering an endpoint again moves it to the
+// caller.
+func createPushSubscription(w http.ResponseWriter, r *http.Request) {
+	var req webpush.Subscription
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	u, err := url.Parse(req.Endpoint)
+	if err != nil || u.Scheme != "https" || u.Host == "" || req.Keys.P256dh == "" || req.Keys.Auth == "" {
+		writeError(w, r, apiErr(http.StatusBadRequest, "a subscription needs an https endpoint and p256dh and auth keys"))
+		return
+	}
+	ctx, user := r.Context(), currentUser(r.Context())
+	n, err := db.Collection(pushSubscriptionsCollection).CountDocuments(ctx, bson.M{"userId": user, "endpoint": bson.M{"$ne": req.Endpoint}})
+	if err == nil && n >= maxPushSubscriptions {
+		writeError(w, r, apiErr(http.StatusBadRequest, "too many push subscriptions"))
+		return
+	}
+	var s pushSubscriptionModel
+	if err == nil {
+		err = db.Collection(pushSubscriptionsCollection).FindOneAndUpdate(ctx, bson.M{"endpoint": req.Endpoint},
+			bson.M{
+				"$set": bson.M{
+					"userId":    user,
+					"p256dh":    req.Keys.P256dh,
+					"auth":      req.Keys.Auth,
+					"userAgent": r.UserAgent(),
+				},
+				"$setOnInsert": bson.M{"_id": newID(), "createAt": time.Now()},
+			},
+			options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&s)
+	}
+	if err != nil {
+		writeError(w, r, internalError("error saving push subscription", err))
+		return
+	}
+	render(r).JSON(w, http.StatusCreated, renderer.M{
+		"message": translate(r.Context(), "push subscription saved successfully"),
+		"data":    toPushSubscription(s),
+	})
+}
+
+func deletePushSubscription(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSpace(chi.URLParam(r, "id"))
+	if !validID(id) {
+		writeError(w, r, apiErr(http.StatusBadRequest, "The id is invalid"))
+		return
+	}
+	res, err := db.Collection(pushSubscriptionsCollection).DeleteOne(r.Context(), bson.M{"_id": toID(id), "userId": currentUser(r.Context())})
+	if err != nil {
+		writeError(w, r, internalError("error deleting push subscription", err))
+		return
+	}
+	if res.DeletedCount == 0 {
+		writeError(w, r, apiErr(http.StatusNotFound, "push subscription not found"))
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"message": translate(r.Context(), "push subscription deleted successfully"),
+	})
+}
+
+// queuePush sends m to every browser user subscribed from, in the
+// background. Subscriptions the push service reports gone are removed;
+// other failures are logged and the message dropped.
+func queuePush(ctx context.Context, user ID, m pushMessage) {
+	if !pushEnabled() {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+		defer cancel()
+		if err := sendPush(ctx, user, m); err != nil {
+			slog.Error("push", "user_id", user, "err", err)
+		}
+	}()
+}
+
+func sendPush(ctx context.Context, user ID, m pushMessage) error {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	var subs []pushSubscriptionModel
+	if err := storage.FindAll(ctx, db.Collection(pushSubscriptionsCollection), bson.M{"userId": user}, &subs); err != nil {
+		return err
+	}
+	for _, s := range subs {
+		resp, err := webpush.SendNotificationWithContext(ctx, body, &webpush.Subscription{
+			Endpoint: s.Endpoint,
+			Keys:     webpush.Keys{P256dh: s.P256dh, Auth: s.Auth},
+		}, &webpush.Options{
+			HTTPClient:      webhookClient,
+			Subscriber:      pushConf.Subject,
+			TTL:             int(pushTTL.Seconds()),
+			VAPIDPublicKey:  pushConf.PublicKey,
+			VAPIDPrivateKey: pushConf.PrivateKey,
+		})
+		if err != nil {
+			slog.Error("push", "subscription", s.ID, "err", err)
+			continue
+		}
+		resp.Body.Close()
+		switch {
+		case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+			if _, err := db.Collection(pushSubscriptionsCollection).DeleteOne(ctx, bson.M{"_id": s.ID}); err != nil {
+				return err
+			}
+		case resp.StatusCode >= 300:
+			slog.Error("push: push service refused", "subscription", s.ID, "status", resp.Status)
+		}
+	}
+	return nil
+}
+
+func toPushSubscription(s pushSubscriptionModel) pushSubscription {
+	return pushSubscription{
+		ID:        s.ID.String(),
+		UserAgent: s.UserAgent,
+		CreateAt:  s.CreateAt.Format(time.RFC3339),
+	}
+}
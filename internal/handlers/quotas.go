@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+var errQuotaExceeded = errors.New("quota exceeded")
+
+type quotaUsage struct {
+	Used  int `json:"used"`
+	Limit int `json:"limit"`
+}
+
+func fetchQuota(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r.Context())
+	conf := liveConf()
+	openTodos, err := serverFrom(r.Context()).todos.CountOpen(r.Context(), user)
+	var lists int
+	if err == nil {
+		lists, err = countOwnedLists(r.Context(), user)
+	}
+	if err != nil {
+		writeError(w, r, internalError("error fetching quota", err))
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"data": renderer.M{
+			"openTodos": quotaUsage{Used: openTodos, Limit: conf.MaxOpenTodos},
+			"lists":     quotaUsage{Used: lists, Limit: conf.MaxLists},
+		},
+	})
+}
+
+func countOwnedLists(ctx context.Context, user ID) (int, error) {
+	n, err := db.Collection(listsCollection).CountDocuments(ctx, bson.M{"ownerId": user})
+	return int(n), err
+}
+
+// checkQuota returns errQuotaExceeded once the current usage has reached
+// limit, skipping the count entirely for disabled limits.
+func checkQuota(limit int, usage func() (int, error)) error {
+	if limit <= 0 {
+		return nil
+	}
+	used, err := usage()
+	if err != nil {
+		return err
+	}
+	if used >= limit {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+func quotaExceeded(w http.ResponseWriter, r *http.Request, what string) {
+	writeError(w, r, &apiError{
+		Status:  http.StatusPaymentRequired,
+		Code:    "quota_exceeded",
+		Message: what + " quota exceeded",
+	})
+}
@@ -0,0 +1,224 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// rateLimiter allows at most limit() events per key within a sliding
+// window. The limit is a function so it follows the live settings. State
+// is kept in memory, so limits are per process.
+type rateLimiter struct {
+	mu     sync.Mutex
+	limit  func() int
+	window time.Duration
+	hits   map[string][]time.Time
+}
+
+func newRateLimiter(limit func() int, window time.Duration) *rateLimiter {
+	return &rateLimiter{limit: limit, window: window, hits: map[string][]time.Time{}}
+}
+
+// allow records an event for key and reports whether it is within the limit.
+func (l *rateLimiter) allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	cutoff := now.Add(-l.window)
+	recent := l.hits[key][:0]
+	for _, t := range l.hits[key] {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= l.limit() {
+		l.hits[key] = recent
+		return false
+	}
+	l.hits[key] = append(recent, now)
+	// Drop idle keys now and then so the map does not grow without bound.
+	if len(l.hits) > 10000 {
+		for k, ts := range l.hits {
+			if len(ts) == 0 || ts[len(ts)-1].Before(cutoff) {
+				delete(l.hits, k)
+			}
+		}
+	}
+	return true
+}
+
+// clientIP is the remote address without its port.
+func clientIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// Writes to the API, requests other than GET, HEAD and OPTIONS, are rate
+// limited per client IP and per token, by the live settings WriteIPRate
+// and WriteTokenRate. Each key has a token bucket holding a minute's worth
+// of requests, refilled at the rate, so short bursts pass. Buckets are
+// kept in memory unless TODO_RATE_LIMIT_STORE=redis, which keeps them in
+// the Redis at TODO_REDIS_URL for all instances to share.
+var rateLimitStore = envString("TODO_RATE_LIMIT_STORE", "memory")
+
+// bucketStore takes a request from the bucket under key, which refills at
+// perMinute a minute and holds as many. If the bucket is empty it reports
+// how long until it is not.
+type bucketStore interface {
+	take(ctx context.Context, key string, perMinute int) (ok bool, wait time.Duration, err error)
+}
+
+// openWriteBuckets returns the bucketStore rateLimitStore chooses.
+func openWriteBuckets(ctx context.Context) (bucketStore, error) {
+	if rateLimitStore != "redis" {
+		return newMemoryBuckets(), nil
+	}
+	opts, err := redis.ParseURL(cacheConf.URL)
+	if err != nil {
+		return nil, err
+	}
+	rdb := redis.NewClient(opts)
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		return nil, err
+	}
+	return redisBuckets{rdb}, nil
+}
+
+// limitWrites answers 429 to writes once the bucket under the key for the
+// request is empty. Requests key returns "" for are not limited. If the
+// store fails, requests are let through rather than refused.
+func limitWrites(key func(*http.Request) string, perMinute func() int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				next.ServeHTTP(w, r)
+				return
+			}
+			k, limit := key(r), perMinute()
+			if k == "" || limit == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ok, wait, err := serverFrom(r.Context()).writeBuckets.take(r.Context(), k, limit)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "rate limit", "err", err)
+			}
+			if err != nil || ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, r, &apiError{
+				Status:  http.StatusTooManyRequests,
+				Code:    "rate_limited",
+				Message: "too many requests, try again later",
+			})
+		})
+	}
+}
+
+func writeIPKey(r *http.Request) string {
+	return "ip:" + clientIP(r.RemoteAddr)
+}
+
+// writeTokenKey keys by a hash of the token, so that tokens are not kept.
+// It runs after requireAuth, so only valid tokens get buckets.
+func writeTokenKey(r *http.Request) string {
+	token := requestToken(r)
+	if token == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return "token:" + hex.EncodeToString(sum[:16])
+}
+
+type memoryBuckets struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	at     time.Time
+}
+
+func newMemoryBuckets() *memoryBuckets {
+	return &memoryBuckets{buckets: map[string]*bucket{}}
+}
+
+func (m *memoryBuckets) take(_ context.Context, key string, perMinute int) (bool, time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	capacity, perSecond := float64(perMinute), float64(perMinute)/60
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, at: now}
+		m.buckets[key] = b
+	}
+	b.tokens = min(capacity, b.tokens+now.Sub(b.at).Seconds()*perSecond)
+	b.at = now
+	// Drop full buckets now and then so the map does not grow without
+	// bound; a missing bucket is a full one.
+	if len(m.buckets) > 10000 {
+		for k, other := range m.buckets {
+			if other.tokens+now.Sub(other.at).Seconds()*perSecond >= capacity {
+				delete(m.buckets, k)
+			}
+		}
+		m.buckets[key] = b
+	}
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / perSecond * float64(time.Second)), nil
+	}
+	b.tokens--
+	return true, 0, nil
+}
+
+type redisBuckets struct {
+	rdb *redis.Client
+}
+
+// takeScript refills and takes from a bucket in one step, by the Redis
+// server's clock so that instances agree. A bucket expires once it would
+// be full again.
+var takeScript = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local perMs = capacity / 60000
+local t = redis.call('TIME')
+local now = t[1] * 1000 + math.floor(t[2] / 1000)
+local b = redis.call('HMGET', KEYS[1], 'tokens', 'at')
+local tokens = tonumber(b[1]) or capacity
+local at = tonumber(b[2]) or now
+tokens = math.min(capacity, tokens + (now - at) * perMs)
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+else
+	wait = math.ceil((1 - tokens) / perMs)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'at', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil((capacity - tokens) / perMs) + 1)
+return wait
+`)
+
+func (b redisBuckets) take(ctx context.Context, key string, perMinute int) (bool, time.Duration, error) {
+	wait, err := takeScript.Run(ctx, b.rdb, []string{"todo:ratelimit:" + key}, perMinute).Int64()
+	if err != nil {
+		return false, 0, err
+	}
+	return wait == 0, time.Duration(wait) * time.Millisecond, nil
+}
@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const countersCollection string = "counters"
+
+// refPrefix starts every todo reference, such as T-8f, which is the base58
+// form of a per-workspace counter. References are short enough to quote in
+// chat and work wherever a todo's ID does.
+const refPrefix = "T-"
+
+// base58 leaves out 0, O, I and l, which are easily confused.
+const base58 = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+type counterModel struct {
+	ID  string `bson:"_id"`
+	Seq int64  `bson:"seq"`
+}
+
+// nextTodoRef takes the next reference in workspace.
+func nextTodoRef(ctx context.Context, workspace ID) (string, error) {
+	var c counterModel
+	err := db.Collection(countersCollection).FindOneAndUpdate(ctx,
+		bson.M{"_id": "todo:" + workspace.String()},
+		bson.M{"$inc": bson.M{"seq": 1}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&c)
+	if err != nil {
+		return "", err
+	}
+	return refPrefix + encodeBase58(c.Seq), nil
+}
+
+func encodeBase58(n int64) string {
+	var b []byte
+	for ; n > 0; n /= 58 {
+		b = append(b, base58[n%58])
+	}
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return string(b)
+}
+
+func isTodoRef(s string) bool {
+	digits := strings.TrimPrefix(s, refPrefix)
+	if len(digits) == len(s) || digits == "" {
+		return false
+	}
+	for _, c := range digits {
+		if !strings.ContainsRune(base58, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// resolveTodoID turns an ID or reference into the todo's ID. A reference
+// matching no todo p can read gives mongo.ErrNoDocuments; anything else
+// that is neither gives errInvalidID.
+func resolveTodoID(ctx context.Context, p principal, s string) (ID, error) {
+	if validID(s) {
+		return toID(s), nil
+	}
+	if !isTodoRef(s) {
+		return "", errInvalidID
+	}
+	found, _, err := findTodos(ctx, p, TodoFilter{Ref: s}, 0, 1)
+	if err != nil {
+		return "", err
+	}
+	if len(found) == 0 {
+		return "", mongo.ErrNoDocuments
+	}
+	return found[0].ID, nil
+}
+
+// todoIDParam resolves the {id} URL parameter of the todo routes, writing
+// an error response if it cannot.
+func todoIDParam(w http.ResponseWriter, r *http.Request) (ID, bool) {
+	id, err := resolveTodoID(r.Context(), currentPrincipal(r.Context()), strings.TrimSpace(chi.URLParam(r, "id")))
+	switch {
+	case err == errInvalidID:
+		writeError(w, r, apiErr(http.StatusBadRequest, "The id is invalid"))
+	case err == mongo.ErrNoDocuments:
+		writeError(w, r, apiErr(http.StatusNotFound, "todo not found"))
+	case err != nil:
+		writeError(w, r, internalError("error fetching todo", err))
+	}
+	return id, err == nil
+}
@@ -0,0 +1,214 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"os/signal"
+	"slices"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// The settings below are safe to change while the server runs. They are
+// read again when the process gets SIGHUP or the configuration file
+// changes, and swapped in whole if they are all valid; other settings only
+// take effect after a restart.
+type liveSettings struct {
+	// LogLevel is debug, info (the default), warn or error. Requests are
+	// logged at info, or at error if they failed. TODO_LOG_LEVEL.
+	LogLevel string
+
+	// Requests allowed per hour: demos started per IP (TODO_RATE_DEMOS, 5),
+	// password reset emails per IP (TODO_RATE_FORGOT_IP, 10) and per
+	// address (TODO_RATE_FORGOT_EMAIL, 3), and verification emails resent
+	// per user (TODO_RATE_VERIFY_RESEND, 3).
+	DemoRate, ForgotIPRate, ForgotEmailRate, ResendRate int
+	// Writes to the API allowed per minute per client IP
+	// (TODO_RATE_WRITES_IP, 600) and per token (TODO_RATE_WRITES_TOKEN,
+	// 120); 0 disables one. See limitWrites.
+	WriteIPRate, WriteTokenRate int
+	// Failed sign-ins allowed before lockouts start, per account
+	// (TODO_LOGIN_FAILURE_LIMIT, 5) and per IP (TODO_LOGIN_IP_FAILURE_LIMIT,
+	// 20). IPs get more room since many users may share one.
+	LoginFailureLimit, LoginIPFailureLimit int
+
+	// Quotas cap what a single account may create; 0 disables one.
+	// TODO_QUOTA_MAX_OPEN_TODOS (1000) and TODO_QUOTA_MAX_LISTS (50).
+	MaxOpenTodos, MaxLists int
+
+	// WebhookAllowPrivate lets webhooks reach loopback and private
+	// addresses, which are refused by default so that users cannot aim the
+	// server at internal services. TODO_WEBHOOK_ALLOW_PRIVATE=true.
+	WebhookAllowPrivate bool
+
+	// ReminderLead is how long before a todo's due date its owner and
+	// assignee are reminded of it, TODO_REMINDER_HOURS, 24 by default. Due
+	// dates are days, so a todo due tomorrow is reminded of from the start
+	// of today.
+	ReminderLead time.Duration
+	// Texts go out about todos tagged SMSPriorityTag (TODO_SMS_PRIORITY_TAG,
+	// "urgent") and at most SMSDailyLimit a day per user
+	// (TODO_SMS_DAILY_LIMIT, 5), verification codes included.
+	SMSPriorityTag string
+	SMSDailyLimit  int
+
+	// Features are the feature flag rules from TODO_FEATURES, by flag.
+	Features map[string]featureRule
+}
+
+var live atomic.Pointer[liveSettings]
+
+// liveConf returns the current live settings.
+func liveConf() *liveSettings {
+	return live.Load()
+}
+
+func readLiveSettings() *liveSettings {
+	return &liveSettings{
+		LogLevel:            envString("TODO_LOG_LEVEL", "info"),
+		DemoRate:            envInt("TODO_RATE_DEMOS", 5),
+		ForgotIPRate:        envInt("TODO_RATE_FORGOT_IP", 10),
+		ForgotEmailRate:     envInt("TODO_RATE_FORGOT_EMAIL", 3),
+		ResendRate:          envInt("TODO_RATE_VERIFY_RESEND", 3),
+		WriteIPRate:         envInt("TODO_RATE_WRITES_IP", 600),
+		WriteTokenRate:      envInt("TODO_RATE_WRITES_TOKEN", 120),
+		LoginFailureLimit:   envInt("TODO_LOGIN_FAILURE_LIMIT", 5),
+		LoginIPFailureLimit: envInt("TODO_LOGIN_IP_FAILURE_LIMIT", 20),
+		MaxOpenTodos:        envInt("TODO_QUOTA_MAX_OPEN_TODOS", 1000),
+		MaxLists:            envInt("TODO_QUOTA_MAX_LISTS", 50),
+		WebhookAllowPrivate: envBool("TODO_WEBHOOK_ALLOW_PRIVATE"),
+		ReminderLead:        time.Duration(envInt("TODO_REMINDER_HOURS", 24)) * time.Hour,
+		SMSPriorityTag:      envString("TODO_SMS_PRIORITY_TAG", "urgent"),
+		SMSDailyLimit:       envInt("TODO_SMS_DAILY_LIMIT", 5),
+		Features:            parseFeatures(envString("TODO_FEATURES", "")),
+	}
+}
+
+func (s *liveSettings) validate() []error {
+	var errs []error
+	if _, ok := logLevels[s.LogLevel]; !ok {
+		errs = append(errs, fmt.Errorf("TODO_LOG_LEVEL must be debug, info, warn or error, not %q", s.LogLevel))
+	}
+	for name, n := range map[string]int{
+		"TODO_RATE_DEMOS":             s.DemoRate,
+		"TODO_RATE_FORGOT_IP":         s.ForgotIPRate,
+		"TODO_RATE_FORGOT_EMAIL":      s.ForgotEmailRate,
+		"TODO_RATE_VERIFY_RESEND":     s.ResendRate,
+		"TODO_LOGIN_FAILURE_LIMIT":    s.LoginFailureLimit,
+		"TODO_LOGIN_IP_FAILURE_LIMIT": s.LoginIPFailureLimit,
+		"TODO_REMINDER_HOURS":         int(s.ReminderLead / time.Hour),
+	} {
+		if n <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be positive", name))
+		}
+	}
+	for name, n := range map[string]int{
+		"TODO_RATE_WRITES_IP":       s.WriteIPRate,
+		"TODO_RATE_WRITES_TOKEN":    s.WriteTokenRate,
+		"TODO_QUOTA_MAX_OPEN_TODOS": s.MaxOpenTodos,
+		"TODO_QUOTA_MAX_LISTS":      s.MaxLists,
+		"TODO_SMS_DAILY_LIMIT":      s.SMSDailyLimit,
+	} {
+		if n < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative", name))
+		}
+	}
+	return errs
+}
+
+// store makes s the live settings.
+func (s *liveSettings) store() {
+	live.Store(s)
+	logLevel.Set(logLevels[s.LogLevel])
+}
+
+// configPollInterval is how often the configuration file is checked for
+// changes.
+const configPollInterval = 5 * time.Second
+
+// watchConfig reloads the configuration on SIGHUP and whenever the
+// configuration file changes, until the process exits. The file is
+// polled rather than watched, which also notices it being replaced, as
+// when a mounted Kubernetes ConfigMap is updated.
+func watchConfig() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var tick <-chan time.Time
+	if configFile != "" {
+		tick = time.Tick(configPollInterval)
+	}
+	last := configFileStamp()
+	for {
+		select {
+		case <-hup:
+			slog.Info("config: reloading on SIGHUP")
+		case <-tick:
+			stamp := configFileStamp()
+			if stamp == last {
+				continue
+			}
+			last = stamp
+			slog.Info("config: reloading", "file", configFile)
+		}
+		if err := reloadConfig(); err != nil {
+			slog.Error("config: keeping the current settings", "err", err)
+		}
+	}
+}
+
+// configFileStamp identifies the configuration file's current content
+// well enough to notice edits.
+func configFileStamp() string {
+	fi, err := os.Stat(configFile)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprint(fi.ModTime().UnixNano(), fi.Size())
+}
+
+// reloadConfig reads the configuration file again and swaps in the live
+// settings, leaving everything as it was if any are invalid. Changes to
+// settings that need a restart are logged but not applied. Only
+// watchConfig calls it, so reloads never overlap.
+func reloadConfig() error {
+	prev, prevFile := maps.Clone(settings), fileSettings
+	configErrors = nil
+	fileSettings = readConfigFile(configFile)
+	s := readLiveSettings()
+	if err := errors.Join(append(configErrors, s.validate()...)...); err != nil {
+		settings, fileSettings, configErrors = prev, prevFile, nil
+		return err
+	}
+	s.store()
+	for _, name := range slices.Sorted(maps.Keys(settings)) {
+		if cur := settings[name]; cur != prev[name] {
+			slog.Info("config", "name", name, "value", redactSetting(name, cur.Value), "source", cur.Source)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(fileChanges(prevFile, fileSettings))) {
+		if settings[name] == prev[name] && settings[name].Source != "env" {
+			slog.Warn("config: changed; restart to apply it", "name", name, "file", configFile)
+		}
+	}
+	return nil
+}
+
+// fileChanges returns the names set differently in a and b.
+func fileChanges(a, b map[string]string) map[string]bool {
+	changed := map[string]bool{}
+	for name, v := range a {
+		if w, ok := b[name]; !ok || w != v {
+			changed[name] = true
+		}
+	}
+	for name := range b {
+		if _, ok := a[name]; !ok {
+			changed[name] = true
+		}
+	}
+	return changed
+}
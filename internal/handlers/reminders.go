@@ -0,0 +1,272 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/sangin4208/go-todo/internal/storage"
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// Scheduled reminders are set by a user on a todo for a time of their
+// choosing, unlike the due-soon reminders of sendReminders. Each is kept
+// until sent, by a jobReminder queued to run at its time.
+
+const (
+	scheduledRemindersCollection string = "scheduled_reminders"
+	// maxScheduledReminders bounds the reminders a user keeps on one todo.
+	maxScheduledReminders = 10
+
+	// eventReminder is sent to webhooks when a scheduled reminder is due.
+	eventReminder = "todo.reminder"
+)
+
+type (
+	scheduledReminderModel struct {
+		ID          ID        `bson:"_id,omitempty"`
+		TodoID      ID        `bson:"todoId"`
+		WorkspaceID ID        `bson:"workspaceId"`
+		UserID      ID        `bson:"userId"`
+		RemindAt    time.Time `bson:"remindAt"`
+		// Channels lists where the reminder goes; empty follows the user's
+		// notification settings.
+		Channels []string  `bson:"channels,omitempty"`
+		CreateAt time.Time `bson:"createAt"`
+	}
+	scheduledReminder struct {
+		ID       string   `json:"id"`
+		TodoID   string   `json:"todoId"`
+		RemindAt string   `json:"remindAt"`
+		Channels []string `json:"channels,omitempty"`
+		CreateAt string   `json:"createAt"`
+	}
+)
+
+// scheduledReminderHandlers is mounted under /todo/{id}/reminders. Anyone
+// who can read a todo may set reminders on it, which only they see and
+// receive.
+func scheduledReminderHandlers() http.Handler {
+	rg := chi.NewRouter()
+	rg.Group(func(r chi.Router) {
+		r.Get("/", fetchScheduledReminders)
+		r.Group(func(r chi.Router) {
+			r.Use(requireRole(roleAdmin, roleMember))
+			r.Post("/", createScheduledReminder)
+			r.Delete("/{reminderId}", deleteScheduledReminder)
+		})
+	})
+	return rg
+}
+
+func fetchScheduledReminders(w http.ResponseWriter, r *http.Request) {
+	tm, ok := readableTodo(w, r)
+	if !ok {
+		return
+	}
+	var reminders []scheduledReminderModel
+	if err := storage.FindAll(r.Context(), db.Collection(scheduledRemindersCollection),
+		bson.M{"todoId": tm.ID, "userId": currentUser(r.Context())}, &reminders,
+		options.Find().SetSort(storage.SortKeys("remindAt"))); err != nil {
+		writeError(w, r, internalError("error fetching reminders", err))
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"data": mapSlice(reminders, toScheduledReminder),
+	})
+}
+
+func createScheduledReminder(w http.ResponseWriter, r *http.Request) {
+	tm, ok := readableTodo(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		RemindAt string   `json:"remindAt" validate:"required,future"`
+		Channels []string `json:"channels"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	at, _ := time.Parse(time.RFC3339, req.RemindAt)
+	channels, ok := parseChannels(notificationReminder, req.Channels)
+	if !ok {
+		writeError(w, r, apiErr(http.StatusBadRequest, "channels may only include "+strings.Join(notificationChannels[notificationReminder], ", ")))
+		return
+	}
+	user := currentUser(r.Context())
+	n, err := db.Collection(scheduledRemindersCollection).CountDocuments(r.Context(), bson.M{"todoId": tm.ID, "userId": user})
+	if err == nil && n >= maxScheduledReminders {
+		writeError(w, r, apiErr(http.StatusForbidden, "too many reminders on this todo"))
+		return
+	}
+	rm := scheduledReminderModel{
+		ID:          newID(),
+		TodoID:      tm.ID,
+		WorkspaceID: tm.WorkspaceID,
+		UserID:      user,
+		RemindAt:    at,
+		Channels:    channels,
+		CreateAt:    time.Now(),
+	}
+	if err == nil {
+		_, err = db.Collection(scheduledRemindersCollection).InsertOne(r.Context(), &rm)
+	}
+	if err == nil {
+		if err = enqueueJob(r.Context(), jobReminder, "", at, reminderJob{ReminderID: rm.ID}); err != nil {
+			db.Collection(scheduledRemindersCollection).DeleteOne(r.Context(), bson.M{"_id": rm.ID})
+		}
+	}
+	if err != nil {
+		writeError(w, r, internalError("error creating reminder", err))
+		return
+	}
+	render(r).JSON(w, http.StatusCreated, renderer.M{
+		"message": translate(r.Context(), "reminder created successfully"),
+		"data":    toScheduledReminder(rm),
+	})
+}
+
+func deleteScheduledReminder(w http.ResponseWriter, r *http.Request) {
+	tm, ok := readableTodo(w, r)
+	if !ok {
+		return
+	}
+	id := strings.TrimSpace(chi.URLParam(r, "reminderId"))
+	if !validID(id) {
+		writeError(w, r, apiErr(http.StatusBadRequest, "The reminder id is invalid"))
+		return
+	}
+	err := deleteOne(r.Context(), db.Collection(scheduledRemindersCollection),
+		bson.M{"_id": toID(id), "todoId": tm.ID, "userId": currentUser(r.Context())})
+	if err == mongo.ErrNoDocuments {
+		writeError(w, r, apiErr(http.StatusNotFound, "reminder not found"))
+		return
+	}
+	if err != nil {
+		writeError(w, r, internalError("error deleting reminder", err))
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"message": translate(r.Context(), "reminder deleted successfully"),
+	})
+}
+
+// reminderJob is the payload of jobReminder.
+type reminderJob struct {
+	ReminderID ID `json:"reminderId"`
+}
+
+// runScheduledReminder sends a reminder that has fallen due, unless it was
+// deleted in the meantime. Reminders that fell due while no instance was
+// running are sent late rather than dropped.
+func runScheduledReminder(ctx context.Context, payload json.RawMessage) error {
+	var p reminderJob
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return permanent(err)
+	}
+	var rm scheduledReminderModel
+	err := db.Collection(scheduledRemindersCollection).FindOne(ctx, bson.M{"_id": p.ReminderID}).Decode(&rm)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return sendScheduledReminder(ctx, rm)
+}
+
+// sendScheduledReminder sends rm through its channels and removes it. It
+// is dropped unsent if the todo is done, gone or no longer visible to the
+// user. If queueing fails the reminder stays, to be sent when the job is
+// retried.
+func sendScheduledReminder(ctx context.Context, rm scheduledReminderModel) error {
+	var u userModel
+	err := db.Collection(usersCollection).FindOne(ctx, bson.M{"_id": rm.UserID}).Decode(&u)
+	var tm todoModel
+	if err == nil && !u.Disabled {
+		tm, err = getTodo(ctx, userPrincipal(u), rm.TodoID)
+	}
+	switch {
+	case err == mongo.ErrNoDocuments, u.Disabled, tm.Completed:
+	case err != nil:
+		return err
+	default:
+		if err := remindThrough(ctx, rm, u, tm); err != nil {
+			return err
+		}
+	}
+	_, err = db.Collection(scheduledRemindersCollection).DeleteOne(ctx, bson.M{"_id": rm.ID})
+	return err
+}
+
+func remindThrough(ctx context.Context, rm scheduledReminderModel, u userModel, tm todoModel) error {
+	wants := func(c string) bool {
+		if len(rm.Channels) == 0 {
+			return u.Notifications.notifies(notificationReminder, c)
+		}
+		return slices.Contains(rm.Channels, c)
+	}
+	if wants(channelWebhook) {
+		if err := remindWebhooks(ctx, rm, tm); err != nil {
+			return err
+		}
+	}
+	if wants(channelEmail) && !u.Unverified {
+		queueMail(ctx, u.Email, "reminder", map[string]interface{}{"Todo": toTodo(ctx, tm)})
+	}
+	if wants(channelPush) {
+		queuePush(ctx, u.ID, pushMessage{
+			Title: "Reminder",
+			Body:  tm.Title,
+			URL:   serverFrom(ctx).publicURL + "/todo/" + tm.ID.String(),
+			Tag:   tm.ID.String(),
+		})
+	}
+	return nil
+}
+
+// remindWebhooks delivers eventReminder to the user's own webhooks that
+// want it. The reminder's ID is the event's, so a reminder sent again after
+// a failure is not delivered twice.
+func remindWebhooks(ctx context.Context, rm scheduledReminderModel, tm todoModel) error {
+	var hooks []webhookModel
+	err := storage.FindAll(ctx, db.Collection(webhooksCollection), bson.M{
+		"workspaceId": rm.WorkspaceID,
+		"ownerId":     rm.UserID,
+		"disabled":    bson.M{"$ne": true},
+		"$or":         []bson.M{{"events": eventReminder}, {"events": bson.M{"$exists": false}}, {"events": bson.M{"$size": 0}}},
+	}, &hooks)
+	if err != nil {
+		return err
+	}
+	p := webhookPayload{
+		ID:        rm.ID.String(),
+		Event:     eventReminder,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+		Todo:      toTodo(ctx, tm),
+	}
+	for _, h := range hooks {
+		if err := queueDelivery(ctx, h, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func toScheduledReminder(rm scheduledReminderModel) scheduledReminder {
+	return scheduledReminder{
+		ID:       rm.ID.String(),
+		TodoID:   rm.TodoID.String(),
+		RemindAt: rm.RemindAt.UTC().Format(time.RFC3339),
+		Channels: rm.Channels,
+		CreateAt: rm.CreateAt.UTC().Format(time.RFC3339),
+	}
+}
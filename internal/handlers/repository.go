@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/sangin4208/go-todo/internal/storage"
+)
+
+type (
+	TodoRepository = storage.TodoRepository
+	todoScope      = storage.Scope
+	TodoFilter     = storage.Filter
+)
+
+// storageBackend selects where todos are kept, unless a Server's Config
+// says otherwise: "mongo", "events" (Mongo, event-sourced), "postgres",
+// "sqlite", "bolt" or "memory". Users, lists and everything else stay in
+// Mongo, except with sqlite and bolt, which keep them in the same file,
+// and memory, which keeps them in memory too (see openDatabase).
+var storageBackend = envString("TODO_STORAGE", "mongo")
+
+// todosInMongo reports whether todos are kept in the todo collection, as
+// they are by both the mongo and the events backends.
+func (s *Server) todosInMongo() bool {
+	return s.storage == "mongo" || s.storage == "events"
+}
+
+// queryTimeout bounds each database operation, on top of the request's own
+// context being canceled when the client goes away. Zero disables it.
+var queryTimeout = time.Duration(envInt("TODO_DB_TIMEOUT_SECONDS", 5)) * time.Second
+
+// postgresURL is the connection string used when TODO_STORAGE=postgres.
+var postgresURL = envString("TODO_POSTGRES_URL", "postgres://localhost:5432/todo")
+
+// cacheConf enables the Redis read cache when TODO_REDIS_URL is set, for
+// example redis://:password@localhost:6379/0.
+var cacheConf = struct {
+	URL              string
+	ListTTL, TodoTTL time.Duration
+}{
+	URL:     envString("TODO_REDIS_URL", ""),
+	ListTTL: time.Duration(envInt("TODO_CACHE_LIST_TTL_SECONDS", 30)) * time.Second,
+	TodoTTL: time.Duration(envInt("TODO_CACHE_TODO_TTL_SECONDS", 300)) * time.Second,
+}
+
+// openTodoRepository opens the configured backend, metered and behind the
+// circuit breaker and then the Redis cache if one is configured, so cached reads
+// are still answered while the breaker is open. Encryption comes last so
+// that the cache holds ciphertext too.
+func (s *Server) openTodoRepository(ctx context.Context) (TodoRepository, error) {
+	repo, err := s.openTodoBackend(ctx)
+	if err == nil {
+		repo = breakerTodoRepository{next: meteredTodoRepository{next: repo, backend: s.storage}}
+	}
+	if err == nil && cacheConf.URL != "" {
+		s.todoCache, err = storage.NewCached(ctx, repo, cacheConf.URL, cacheConf.ListTTL, cacheConf.TodoTTL)
+		repo = s.todoCache
+	}
+	if err == nil && encryptionKeyID != "" {
+		repo = encryptedTodoRepository{next: repo}
+	}
+	if err == nil && searchConf.URL != "" {
+		// Above encryption, so the index receives plaintext to search.
+		s.search, err = openSearchIndex(ctx)
+		repo = indexedTodoRepository{next: repo, index: s.search}
+	}
+	if err != nil || queryTimeout <= 0 {
+		return repo, err
+	}
+	return storage.WithTimeout(repo, queryTimeout), nil
+}
+
+func (s *Server) openTodoBackend(ctx context.Context) (TodoRepository, error) {
+	switch s.storage {
+	case "mongo":
+		return s.mongoTodos(), nil
+	case "events":
+		return s.eventTodos(), nil
+	case "postgres":
+		return storage.OpenPostgres(ctx, postgresURL, newID)
+	case "sqlite":
+		return storage.NewSQLite(s.sqliteFile, newID), nil
+	case "bolt":
+		return storage.NewBolt(s.boltFile, newID), nil
+	case "memory":
+		return storage.NewMemory(newID), nil
+	}
+	return nil, fmt.Errorf("unknown TODO_STORAGE %q", s.storage)
+}
+
+func (s *Server) mongoTodos() storage.Mongo {
+	return storage.NewMongo(s.db.Collection(s.collection), newID)
+}
+
+// eventTodos keeps the log in transactions of s's database.
+func (s *Server) eventTodos() storage.Events {
+	return storage.NewEvents(s.mongoTodos(), s.db.Collection(storage.TodoEventsCollection),
+		s.db.Collection(storage.TodoSnapshotsCollection), func(ctx context.Context, fn func(ctx context.Context) error) error {
+			return withTransaction(s.with(ctx), fn)
+		})
+}
+
+// replayFlag is set by --replay.
+var replayFlag bool
+
+// runReplay serves --replay, rebuilding the todos of the events backend
+// from its log. Run it with the servers stopped, since writes made during
+// the replay may be overwritten.
+func runReplay(ctx context.Context) {
+	s := serverFrom(ctx)
+	if s.storage != "events" {
+		fatal("--replay requires TODO_STORAGE=events")
+	}
+	n, err := s.eventTodos().Replay(ctx)
+	if err != nil {
+		fatal("replaying", "err", err)
+	}
+	slog.Info("replayed the event log", "todos", n)
+}
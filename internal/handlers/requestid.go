@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/middleware"
+)
+
+// Every request gets an ID: the X-Request-ID the client or a proxy in
+// front sent, if it looks like one, or a new random one. It is echoed in
+// the X-Request-ID response header, added to error responses as requestId
+// and logged with everything logged for the request, so that a failure a
+// user reports can be found in the logs.
+
+const requestIDHeader = "X-Request-ID"
+
+// validRequestID limits what is taken from clients to what is safe to
+// echo and log.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:/+=-]{1,128}$`)
+
+func requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = rand.Text()
+		}
+		w.Header().Set(requestIDHeader, id)
+		ctx := context.WithValue(r.Context(), middleware.RequestIDKey, id)
+		iw := &requestIDWriter{ResponseWriter: w, id: id}
+		next.ServeHTTP(iw, r.WithContext(ctx))
+		iw.finish()
+	})
+}
+
+// requestIDWriter holds back JSON error responses to add the request ID
+// to them, and a code to those written without writeError. Other
+// responses pass straight through.
+type requestIDWriter struct {
+	http.ResponseWriter
+	id     string
+	status int
+	// held collects an error response's body until the handler is done.
+	held *bytes.Buffer
+}
+
+func (w *requestIDWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	if status >= 400 && strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+		w.held = &bytes.Buffer{}
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *requestIDWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.held != nil {
+		return w.held.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// finish sends a held error response, with the request ID and any missing
+// code added if the body is a JSON object.
+func (w *requestIDWriter) finish() {
+	if w.held == nil {
+		return
+	}
+	body := w.held.Bytes()
+	var obj map[string]json.RawMessage
+	if json.Unmarshal(body, &obj) == nil && obj != nil {
+		id, _ := json.Marshal(w.id)
+		obj["requestId"] = id
+		if _, ok := obj["code"]; !ok {
+			obj["code"], _ = json.Marshal(statusCode(w.status))
+		}
+		if b, err := json.Marshal(obj); err == nil {
+			body = b
+		}
+	}
+	w.held = nil
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(body)
+}
+
+// Flush and Hijack keep streaming responses and WebSocket upgrades working
+// through the wrapper.
+func (w *requestIDWriter) Flush() {
+	if w.held == nil {
+		http.NewResponseController(w.ResponseWriter).Flush()
+	}
+}
+
+func (w *requestIDWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+func (w *requestIDWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	resetsCollection string = "password_resets"
+	resetTokenTTL           = time.Hour
+)
+
+var (
+	forgotByIP    = newRateLimiter(func() int { return liveConf().ForgotIPRate }, time.Hour)
+	forgotByEmail = newRateLimiter(func() int { return liveConf().ForgotEmailRate }, time.Hour)
+)
+
+type resetModel struct {
+	ID        ID        `bson:"_id,omitempty"`
+	UserID    ID        `bson:"userId"`
+	Hash      string    `bson:"hash"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+// forgotPassword emails a reset token. It answers the same way whether or
+// not the account exists so it cannot be used to enumerate users.
+func forgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if !forgotByIP.allow(clientIP(r.RemoteAddr)) {
+		writeError(w, r, apiErr(http.StatusTooManyRequests, "too many requests, try again later"))
+		return
+	}
+	email := strings.ToLower(strings.TrimSpace(req.Email))
+	ws := currentWorkspace(r.Context())
+	var u userModel
+	err := db.Collection(usersCollection).FindOne(r.Context(), bson.M{"workspaceId": ws, "email": email}).Decode(&u)
+	if err != nil && err != mongo.ErrNoDocuments {
+		writeError(w, r, internalError("error requesting password reset", err))
+		return
+	}
+	if err == nil && forgotByEmail.allow(ws.String()+"/"+email) {
+		token, err := newRefreshToken()
+		if err == nil {
+			_, err = db.Collection(resetsCollection).InsertOne(r.Context(), &resetModel{
+				ID:        newID(),
+				UserID:    u.ID,
+				Hash:      hashAPIToken(token),
+				ExpiresAt: time.Now().Add(resetTokenTTL),
+			})
+		}
+		if err != nil {
+			writeError(w, r, internalError("error requesting password reset", err))
+			return
+		}
+		queueMail(r.Context(), u.Email, "reset", map[string]interface{}{"Token": token})
+	}
+	render(r).JSON(w, http.StatusAccepted, renderer.M{
+		"message": translate(r.Context(), "if the account exists, a reset email has been sent"),
+	})
+}
+
+// resetPassword consumes a reset token, sets the new password and signs
+// the account out everywhere.
+func resetPassword(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if len(req.Password) < minPasswordLen {
+		writeError(w, r, apiErr(http.StatusBadRequest, "password must be at least 8 characters"))
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		writeError(w, r, internalError("error resetting password", err))
+		return
+	}
+	// Removing the token as it is read makes it single-use; the transaction
+	// puts it back if the rest fails.
+	err = withTransaction(r.Context(), func(ctx context.Context) error {
+		var reset resetModel
+		err := db.Collection(resetsCollection).FindOneAndDelete(ctx, bson.M{
+			"hash":      hashAPIToken(strings.TrimSpace(req.Token)),
+			"expiresAt": bson.M{"$gt": time.Now()},
+		}).Decode(&reset)
+		if err == nil {
+			err = updateOne(ctx, db.Collection(usersCollection), bson.M{"_id": reset.UserID, "workspaceId": currentWorkspace(ctx)}, bson.M{"$set": bson.M{"passwordHash": hash}})
+		}
+		if err == nil {
+			_, err = db.Collection(resetsCollection).DeleteMany(ctx, bson.M{"userId": reset.UserID})
+		}
+		if err == nil {
+			_, err = db.Collection(sessionsCollection).DeleteMany(ctx, bson.M{"userId": reset.UserID})
+		}
+		return err
+	})
+	if err == mongo.ErrNoDocuments {
+		writeError(w, r, apiErr(http.StatusBadRequest, "invalid or expired reset token"))
+		return
+	}
+	if err != nil {
+		writeError(w, r, internalError("error resetting password", err))
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"message": translate(r.Context(), "password reset successfully"),
+	})
+}
@@ -0,0 +1,217 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/middleware"
+)
+
+// Todo lists, lists and stats, which dashboards poll, are kept in memory
+// per user and query for TODO_RESPONSE_CACHE_TTL_SECONDS (10, 0 to turn
+// caching off), at most TODO_RESPONSE_CACHE_MAX_ENTRIES of them (10000).
+// A user's responses are dropped as soon as a todo they can see changes,
+// as published to live update streams, or a write of their own succeeds.
+// Other instances only hear of todo changes with change streams on, and
+// list membership changes reach the other members only through expiry,
+// hence the short lifetime.
+//
+// Responses are sent with an ETag and Cache-Control: private, no-cache, so
+// clients keep their copy and revalidate it, which costs them nothing but
+// a 304 while it is unchanged.
+
+var responseCacheConf = struct {
+	TTL        time.Duration
+	MaxEntries int
+}{
+	TTL:        time.Duration(envInt("TODO_RESPONSE_CACHE_TTL_SECONDS", 10)) * time.Second,
+	MaxEntries: envInt("TODO_RESPONSE_CACHE_MAX_ENTRIES", 10000),
+}
+
+// responseCacheStats counts lookups, published through expvar.
+var responseCacheStats = expvar.NewMap("responseCache")
+
+type cachedResponse struct {
+	contentType string
+	etag        string
+	body        []byte
+	expires     time.Time
+}
+
+type responseCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedResponse
+	// gens counts each user's invalidations. Keys include it, so counting
+	// one more retires all of the user's entries at once.
+	gens map[ID]uint64
+}
+
+// newResponseCache returns an empty responseCache, which forgets what
+// changes tells it may have gone stale.
+func newResponseCache(changes *hub) *responseCache {
+	c := &responseCache{
+		entries: make(map[string]cachedResponse),
+		gens:    make(map[ID]uint64),
+	}
+	changes.listen(func(e event) {
+		c.forget(e.Audience...)
+	})
+	return c
+}
+
+func (c *responseCache) key(p principal, r *http.Request) string {
+	c.mu.Lock()
+	gen := c.gens[p.UserID]
+	c.mu.Unlock()
+	return fmt.Sprintf("%s|%s|%s|%d|%s|%s?%s", p.WorkspaceID.String(), p.UserID.String(), p.ListID.String(), gen,
+		requestLang(r.Context()), r.URL.Path, r.URL.RawQuery)
+}
+
+func (c *responseCache) get(key string) (cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		return cachedResponse{}, false
+	}
+	return e, true
+}
+
+func (c *responseCache) put(key string, e cachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= responseCacheConf.MaxEntries {
+		now := time.Now()
+		for k, old := range c.entries {
+			if now.After(old.expires) {
+				delete(c.entries, k)
+			}
+		}
+		// Still full: make room by dropping whatever comes first.
+		for k := range c.entries {
+			if len(c.entries) < responseCacheConf.MaxEntries {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = e
+}
+
+// forget retires the users' cached responses. The entries themselves go
+// once they expire or room is needed.
+func (c *responseCache) forget(users ...ID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, u := range users {
+		c.gens[u]++
+	}
+}
+
+// cacheResponses serves GET responses from the cache, for the caller and
+// query, and caches successful ones.
+func cacheResponses(next http.Handler) http.Handler {
+	if responseCacheConf.TTL <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		responses := serverFrom(r.Context()).responses
+		key := responses.key(currentPrincipal(r.Context()), r)
+		if e, ok := responses.get(key); ok {
+			responseCacheStats.Add("hits", 1)
+			serveCached(w, r, e)
+			return
+		}
+		responseCacheStats.Add("misses", 1)
+		bw := &bufferedResponse{ResponseWriter: w}
+		next.ServeHTTP(bw, r)
+		if bw.status != http.StatusOK {
+			if bw.status != 0 {
+				w.WriteHeader(bw.status)
+			}
+			w.Write(bw.body.Bytes())
+			return
+		}
+		sum := sha256.Sum256(bw.body.Bytes())
+		e := cachedResponse{
+			contentType: w.Header().Get("Content-Type"),
+			etag:        `W/"` + hex.EncodeToString(sum[:12]) + `"`,
+			body:        bw.body.Bytes(),
+			expires:     time.Now().Add(responseCacheConf.TTL),
+		}
+		responses.put(key, e)
+		serveCached(w, r, e)
+	})
+}
+
+func serveCached(w http.ResponseWriter, r *http.Request, e cachedResponse) {
+	h := w.Header()
+	h.Set("Cache-Control", "private, no-cache")
+	h.Set("ETag", e.etag)
+	if etagMatches(r.Header.Get("If-None-Match"), e.etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	h.Set("Content-Type", e.contentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(e.body)
+}
+
+// etagMatches reports whether an If-None-Match header names etag, weakly
+// compared.
+func etagMatches(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// forgetResponses retires the caller's cached responses once a write of
+// theirs succeeds, whatever it changed.
+func forgetResponses(next http.Handler) http.Handler {
+	if responseCacheConf.TTL <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+		if ww.Status() < 400 {
+			serverFrom(r.Context()).responses.forget(currentUser(r.Context()))
+		}
+	})
+}
+
+// bufferedResponse collects a response for the handler's caller to send.
+type bufferedResponse struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedResponse) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *bufferedResponse) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(p)
+}
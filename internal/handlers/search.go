@@ -0,0 +1,515 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sangin4208/go-todo/internal/storage"
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// searchConf points at an Elasticsearch or OpenSearch cluster. When
+// TODO_SEARCH_URL is set every todo written through this server is mirrored
+// into TODO_SEARCH_INDEX and /todo/search is answered from there, with
+// highlighting and facets; otherwise it falls back to the storage backend's
+// own text search.
+//
+// The index holds titles in plaintext, even with TODO_ENCRYPTION_KEYS set.
+var searchConf = struct {
+	URL      string
+	Index    string
+	Username string
+	Password string
+}{
+	URL:      strings.TrimSuffix(envString("TODO_SEARCH_URL", ""), "/"),
+	Index:    envString("TODO_SEARCH_INDEX", "todos"),
+	Username: envString("TODO_SEARCH_USERNAME", ""),
+	Password: envString("TODO_SEARCH_PASSWORD", ""),
+}
+
+// searchFacetSize caps the buckets returned for each facet.
+const searchFacetSize = 20
+
+// searchMapping only speaks field types common to Elasticsearch 7+ and
+// OpenSearch.
+var searchMapping = renderer.M{
+	"mappings": renderer.M{
+		"properties": renderer.M{
+			"ref":         renderer.M{"type": "keyword"},
+			"workspaceId": renderer.M{"type": "keyword"},
+			"userId":      renderer.M{"type": "keyword"},
+			"listId":      renderer.M{"type": "keyword"},
+			"assigneeId":  renderer.M{"type": "keyword"},
+			"title":       renderer.M{"type": "text"},
+			"completed":   renderer.M{"type": "boolean"},
+			"createAt":    renderer.M{"type": "date"},
+			"dueDate":     renderer.M{"type": "date"},
+			"tags":        renderer.M{"type": "keyword"},
+			"expiresAt":   renderer.M{"type": "date"},
+		},
+	},
+}
+
+type (
+	// searchDoc is a todo as indexed.
+	searchDoc struct {
+		Ref         string     `json:"ref,omitempty"`
+		WorkspaceID string     `json:"workspaceId"`
+		UserID      string     `json:"userId"`
+		ListID      string     `json:"listId,omitempty"`
+		AssigneeID  string     `json:"assigneeId,omitempty"`
+		Title       string     `json:"title"`
+		Completed   bool       `json:"completed"`
+		CreateAt    time.Time  `json:"createAt"`
+		DueDate     *time.Time `json:"dueDate,omitempty"`
+		Tags        []string   `json:"tags,omitempty"`
+		ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
+	}
+	searchHit struct {
+		todo
+		// Highlights are fragments of the title with matches in <mark>.
+		Highlights []string `json:"highlights,omitempty"`
+	}
+	searchFacet struct {
+		Value string `json:"value"`
+		Count int    `json:"count"`
+	}
+)
+
+// searchIndex talks to the cluster over its REST API, which Elasticsearch
+// and OpenSearch share, rather than through either one's client library.
+type searchIndex struct {
+	client *http.Client
+}
+
+func openSearchIndex(ctx context.Context) (*searchIndex, error) {
+	s := &searchIndex{client: &http.Client{Timeout: 10 * time.Second}}
+	var status struct {
+		Error struct {
+			Type string `json:"type"`
+		} `json:"error"`
+	}
+	err := s.do(ctx, http.MethodPut, "", searchMapping, &status)
+	if err != nil && status.Error.Type != "resource_already_exists_exception" {
+		return nil, err
+	}
+	return s, nil
+}
+
+// do sends body as JSON to path under the index and decodes the response
+// into out, which also receives the body of an error response.
+func (s *searchIndex) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, searchConf.URL+"/"+searchConf.Index+path, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if searchConf.Username != "" {
+		req.SetBasicAuth(searchConf.Username, searchConf.Password)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if out != nil && len(raw) > 0 {
+		if err := json.Unmarshal(raw, out); err != nil && resp.StatusCode < 300 {
+			return err
+		}
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("search index: %s: %s", resp.Status, bytes.TrimSpace(raw))
+	}
+	return nil
+}
+
+func (s *searchIndex) put(ctx context.Context, tm todoModel) error {
+	return s.do(ctx, http.MethodPut, "/_doc/"+tm.ID.String(), toSearchDoc(tm), nil)
+}
+
+func (s *searchIndex) remove(ctx context.Context, id ID) error {
+	var res struct {
+		Result string `json:"result"`
+	}
+	err := s.do(ctx, http.MethodDelete, "/_doc/"+id.String(), nil, &res)
+	if res.Result == "not_found" {
+		return nil
+	}
+	return err
+}
+
+// search runs q over the titles of the todos in scope matching f. Of f only
+// ListID, Completed and Tag apply.
+func (s *searchIndex) search(ctx context.Context, scope todoScope, q string, f TodoFilter, skip, limit int) ([]searchHit, int, map[string][]searchFacet, error) {
+	lists := make([]string, 0, len(scope.ListIDs))
+	for _, id := range scope.ListIDs {
+		lists = append(lists, id.String())
+	}
+	readable := []renderer.M{{"terms": renderer.M{"listId": lists}}}
+	if !scope.OwnerID.IsZero() {
+		readable = append(readable, renderer.M{"term": renderer.M{"userId": scope.OwnerID.String()}})
+	}
+	if !scope.AssigneeID.IsZero() {
+		readable = append(readable, renderer.M{"term": renderer.M{"assigneeId": scope.AssigneeID.String()}})
+	}
+	filter := []renderer.M{
+		{"term": renderer.M{"workspaceId": scope.WorkspaceID.String()}},
+		{"bool": renderer.M{"should": readable, "minimum_should_match": 1}},
+		{"bool": renderer.M{"must_not": renderer.M{"range": renderer.M{"expiresAt": renderer.M{"lte": "now"}}}}},
+	}
+	if !f.ListID.IsZero() {
+		filter = append(filter, renderer.M{"term": renderer.M{"listId": f.ListID.String()}})
+	}
+	if f.Completed != nil {
+		filter = append(filter, renderer.M{"term": renderer.M{"completed": *f.Completed}})
+	}
+	if f.Tag != "" {
+		filter = append(filter, renderer.M{"term": renderer.M{"tags": f.Tag}})
+	}
+	query := renderer.M{
+		"from":             skip,
+		"size":             limit,
+		"track_total_hits": true,
+		"query": renderer.M{"bool": renderer.M{
+			"must":   renderer.M{"match": renderer.M{"title": renderer.M{"query": q, "operator": "and"}}},
+			"filter": filter,
+		}},
+		"highlight": renderer.M{
+			"fields":    renderer.M{"title": renderer.M{"number_of_fragments": 0}},
+			"pre_tags":  []string{"<mark>"},
+			"post_tags": []string{"</mark>"},
+			"encoder":   "html",
+		},
+		"aggs": renderer.M{
+			"tags":      renderer.M{"terms": renderer.M{"field": "tags", "size": searchFacetSize}},
+			"lists":     renderer.M{"terms": renderer.M{"field": "listId", "size": searchFacetSize}},
+			"completed": renderer.M{"terms": renderer.M{"field": "completed"}},
+		},
+	}
+	var res struct {
+		Hits struct {
+			Total struct {
+				Value int `json:"value"`
+			} `json:"total"`
+			Hits []struct {
+				ID        string    `json:"_id"`
+				Source    searchDoc `json:"_source"`
+				Highlight struct {
+					Title []string `json:"title"`
+				} `json:"highlight"`
+			} `json:"hits"`
+		} `json:"hits"`
+		Aggregations map[string]struct {
+			Buckets []struct {
+				Key         interface{} `json:"key"`
+				KeyAsString string      `json:"key_as_string"`
+				DocCount    int         `json:"doc_count"`
+			} `json:"buckets"`
+		} `json:"aggregations"`
+	}
+	if err := s.do(ctx, http.MethodPost, "/_search", query, &res); err != nil {
+		return nil, 0, nil, err
+	}
+	hits := []searchHit{}
+	for _, h := range res.Hits.Hits {
+		hits = append(hits, searchHit{
+			todo:       toTodo(ctx, h.Source.todoModel(ID(h.ID))),
+			Highlights: h.Highlight.Title,
+		})
+	}
+	facets := map[string][]searchFacet{}
+	for name, agg := range res.Aggregations {
+		buckets := []searchFacet{}
+		for _, b := range agg.Buckets {
+			value := b.KeyAsString
+			if value == "" {
+				value = fmt.Sprint(b.Key)
+			}
+			buckets = append(buckets, searchFacet{Value: value, Count: b.DocCount})
+		}
+		facets[name] = buckets
+	}
+	return hits, res.Hits.Total.Value, facets, nil
+}
+
+func toSearchDoc(tm todoModel) searchDoc {
+	d := searchDoc{
+		Ref:         tm.Ref,
+		WorkspaceID: tm.WorkspaceID.String(),
+		UserID:      tm.UserID.String(),
+		ListID:      tm.ListID.String(),
+		AssigneeID:  tm.AssigneeID.String(),
+		Title:       tm.Title,
+		Completed:   tm.Completed,
+		CreateAt:    tm.CreateAt,
+		Tags:        tm.Tags,
+	}
+	if !tm.DueDate.IsZero() {
+		d.DueDate = &tm.DueDate
+	}
+	if !tm.ExpiresAt.IsZero() {
+		d.ExpiresAt = &tm.ExpiresAt
+	}
+	return d
+}
+
+func (d searchDoc) todoModel(id ID) todoModel {
+	tm := todoModel{
+		ID:          id,
+		Ref:         d.Ref,
+		WorkspaceID: idOrEmpty(d.WorkspaceID),
+		UserID:      idOrEmpty(d.UserID),
+		ListID:      idOrEmpty(d.ListID),
+		AssigneeID:  idOrEmpty(d.AssigneeID),
+		Title:       d.Title,
+		Completed:   d.Completed,
+		CreateAt:    d.CreateAt.Local(),
+		Tags:        d.Tags,
+	}
+	if d.DueDate != nil {
+		tm.DueDate = d.DueDate.Local()
+	}
+	if d.ExpiresAt != nil {
+		tm.ExpiresAt = *d.ExpiresAt
+	}
+	return tm
+}
+
+// indexedTodoRepository mirrors writes into the search index. The index is
+// only a copy, so failing to update it is logged rather than failing the
+// write.
+type indexedTodoRepository struct {
+	next  TodoRepository
+	index *searchIndex
+}
+
+func (i indexedTodoRepository) indexed(ctx context.Context, tm todoModel) {
+	if err := i.index.put(ctx, tm); err != nil {
+		slog.ErrorContext(ctx, "indexing todo", "todo_id", tm.ID, "err", err)
+	}
+}
+
+func (i indexedTodoRepository) unindexed(ctx context.Context, id ID) {
+	if err := i.index.remove(ctx, id); err != nil {
+		slog.ErrorContext(ctx, "unindexing todo", "todo_id", id, "err", err)
+	}
+}
+
+func (i indexedTodoRepository) List(ctx context.Context, s todoScope, f TodoFilter, skip, limit int) ([]todoModel, int, error) {
+	return i.next.List(ctx, s, f, skip, limit)
+}
+
+func (i indexedTodoRepository) Get(ctx context.Context, s todoScope, id ID) (todoModel, error) {
+	return i.next.Get(ctx, s, id)
+}
+
+func (i indexedTodoRepository) Create(ctx context.Context, tm *todoModel) error {
+	err := i.next.Create(ctx, tm)
+	if err == nil {
+		i.indexed(ctx, *tm)
+	}
+	return err
+}
+
+func (i indexedTodoRepository) Update(ctx context.Context, s todoScope, id ID, title string, completed bool) (todoModel, todoModel, error) {
+	before, after, err := i.next.Update(ctx, s, id, title, completed)
+	if err == nil {
+		i.indexed(ctx, after)
+	}
+	return before, after, err
+}
+
+func (i indexedTodoRepository) Assign(ctx context.Context, s todoScope, id, assignee ID) (todoModel, error) {
+	tm, err := i.next.Assign(ctx, s, id, assignee)
+	if err == nil {
+		i.indexed(ctx, tm)
+	}
+	return tm, err
+}
+
+func (i indexedTodoRepository) Delete(ctx context.Context, s todoScope, id ID) (todoModel, error) {
+	tm, err := i.next.Delete(ctx, s, id)
+	if err == nil {
+		i.unindexed(ctx, id)
+	}
+	return tm, err
+}
+
+func (i indexedTodoRepository) CountOpen(ctx context.Context, user ID) (int, error) {
+	return i.next.CountOpen(ctx, user)
+}
+
+// DeleteExpired cannot see what Mongo's TTL monitor removes, so expired
+// todos may linger in the index; search filters them out.
+func (i indexedTodoRepository) DeleteExpired(ctx context.Context, now time.Time) ([]todoModel, error) {
+	expired, err := i.next.DeleteExpired(ctx, now)
+	for _, tm := range expired {
+		i.unindexed(ctx, tm.ID)
+	}
+	return expired, err
+}
+
+func (i indexedTodoRepository) DeleteMany(ctx context.Context, s todoScope, f TodoFilter) ([]todoModel, error) {
+	removed, err := i.next.DeleteMany(ctx, s, f)
+	for _, tm := range removed {
+		i.unindexed(ctx, tm.ID)
+	}
+	return removed, err
+}
+
+func (i indexedTodoRepository) Count(ctx context.Context, s todoScope, f TodoFilter) (int, error) {
+	return i.next.Count(ctx, s, f)
+}
+
+func (i indexedTodoRepository) CountTags(ctx context.Context, s todoScope, f TodoFilter) ([]storage.TagCount, error) {
+	return i.next.CountTags(ctx, s, f)
+}
+
+func (i indexedTodoRepository) CountByDay(ctx context.Context, s todoScope, f TodoFilter, completed bool, loc *time.Location) (map[string]int, error) {
+	return i.next.CountByDay(ctx, s, f, completed, loc)
+}
+
+// searchTodos answers GET /todo/search?q=, which also takes the list,
+// completed and tag filters and ?offset= and ?limit=.
+func searchTodos(w http.ResponseWriter, r *http.Request) {
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if q == "" {
+		writeError(w, r, apiErr(http.StatusBadRequest, "the q parameter is required"))
+		return
+	}
+	var f TodoFilter
+	if l := r.URL.Query().Get("list"); l != "" {
+		if !validID(l) {
+			writeError(w, r, apiErr(http.StatusBadRequest, "The list id is invalid"))
+			return
+		}
+		f.ListID = toID(l)
+	}
+	switch r.URL.Query().Get("completed") {
+	case "":
+	case "true":
+		f.Completed = new(bool)
+		*f.Completed = true
+	case "false":
+		f.Completed = new(bool)
+	default:
+		writeError(w, r, apiErr(http.StatusBadRequest, "completed must be true or false"))
+		return
+	}
+	f.Tag = r.URL.Query().Get("tag")
+	skip, limit := pagination(r)
+	ctx := r.Context()
+
+	index := serverFrom(ctx).search
+	if index == nil {
+		if encryptionKeyID != "" {
+			writeError(w, r, apiErr(http.StatusNotImplemented, "encrypted titles can only be searched with TODO_SEARCH_URL set"))
+			return
+		}
+		f.Text = q
+		found, total, err := findTodos(ctx, currentPrincipal(ctx), f, skip, limit)
+		if err != nil {
+			writeError(w, r, internalError("error searching todos", err))
+			return
+		}
+		data := []searchHit{}
+		for _, tm := range found {
+			data = append(data, searchHit{todo: toTodo(ctx, tm)})
+		}
+		render(r).JSON(w, http.StatusOK, renderer.M{
+			"data":   data,
+			"total":  total,
+			"offset": skip,
+			"limit":  limit,
+		})
+		return
+	}
+
+	scope, err := todoAccess(ctx, currentPrincipal(ctx), false)
+	var (
+		hits   []searchHit
+		total  int
+		facets map[string][]searchFacet
+	)
+	if err == nil {
+		hits, total, facets, err = index.search(ctx, scope, q, f, skip, limit)
+	}
+	if err != nil {
+		writeError(w, r, internalError("error searching todos", err))
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"data":   hits,
+		"total":  total,
+		"offset": skip,
+		"limit":  limit,
+		"facets": facets,
+	})
+}
+
+// reindexSearch copies every todo into the search index, for todos written
+// before indexing was enabled or while the cluster was unreachable. Every
+// todo has an owner, so going through the users' own todos reaches them
+// all, whichever backend keeps them.
+func reindexSearch(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	index := serverFrom(ctx).search
+	if index == nil {
+		writeError(w, r, apiErr(http.StatusBadRequest, "reindexing needs TODO_SEARCH_URL"))
+		return
+	}
+	cur, err := db.Collection(usersCollection).Find(ctx, bson.M{}, options.Find().SetProjection(bson.M{"_id": 1, "workspaceId": 1}))
+	n := 0
+	if err == nil {
+		defer cur.Close(ctx)
+		for err == nil && cur.Next(ctx) {
+			var u userModel
+			var owned []todoModel
+			if err = cur.Decode(&u); err == nil {
+				owned, _, err = serverFrom(ctx).todos.List(ctx, todoScope{WorkspaceID: u.WorkspaceID, OwnerID: u.ID}, TodoFilter{}, 0, 0)
+			}
+			for _, tm := range owned {
+				if err = index.put(ctx, tm); err != nil {
+					break
+				}
+				n++
+			}
+		}
+		if err == nil {
+			err = cur.Err()
+		}
+	}
+	if err != nil {
+		render(r).JSON(w, http.StatusInternalServerError, renderer.M{
+			"message": translate(r.Context(), "error reindexing todos"),
+			"error":   err.Error(),
+			"indexed": n,
+		})
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"message": translate(r.Context(), "todos reindexed successfully"),
+		"indexed": n,
+	})
+}
@@ -0,0 +1,220 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// devMode enables conveniences unfit for production, such as
+	// POST /admin/seed and reloading edited templates. Enable with
+	// TODO_DEV_MODE=true.
+	devMode = envBool("TODO_DEV_MODE")
+	// seedPassword is the password of every generated user.
+	seedPassword = envString("TODO_SEED_PASSWORD", "password")
+
+	defaultSeed = seedOptions{Seed: 1, Users: 10, ListsPerUser: 3, TodosPerUser: 50}
+
+	// seedFlag and seedFlagOptions are set by --seed and its options,
+	// see seedFlags.
+	seedFlag        bool
+	seedFlagOptions = defaultSeed
+
+	errAlreadySeeded = errors.New("the workspace for this seed already exists")
+)
+
+// seedFlags registers --seed and its options on the command line.
+func seedFlags() {
+	flag.BoolVar(&seedFlag, "seed", false, "generate fake users and todos, then exit")
+	flag.Int64Var(&seedFlagOptions.Seed, "seed-value", defaultSeed.Seed, "seed for the generated data")
+	flag.IntVar(&seedFlagOptions.Users, "seed-users", defaultSeed.Users, "number of users to generate")
+	flag.IntVar(&seedFlagOptions.ListsPerUser, "seed-lists", defaultSeed.ListsPerUser, "number of lists to generate per user")
+	flag.IntVar(&seedFlagOptions.TodosPerUser, "seed-todos", defaultSeed.TodosPerUser, "number of todos to generate per user")
+}
+
+// seedOptions say what seedData generates. The same options always give
+// the same users, lists and todos, apart from their IDs and from dates,
+// which are spread around the day seeding runs.
+type seedOptions struct {
+	Seed         int64 `json:"seed"`
+	Users        int   `json:"users"`
+	ListsPerUser int   `json:"listsPerUser"`
+	TodosPerUser int   `json:"todosPerUser"`
+}
+
+type seedResult struct {
+	Workspace string `json:"workspace"`
+	Users     int    `json:"users"`
+	Lists     int    `json:"lists"`
+	Todos     int    `json:"todos"`
+}
+
+var (
+	seedFirstNames = []string{"ada", "alan", "grace", "linus", "margaret", "ken", "barbara", "dennis", "frances", "edsger", "radia", "john", "hedy", "tim", "katherine", "donald"}
+	seedLastNames  = []string{"lovelace", "turing", "hopper", "torvalds", "hamilton", "thompson", "liskov", "ritchie", "allen", "dijkstra", "perlman", "backus", "lamarr", "lee", "johnson", "knuth"}
+	seedListNames  = []string{"Groceries", "Work", "Home", "Errands", "Side project", "Travel", "Reading", "Fitness"}
+	seedVerbs      = []string{"Buy", "Call", "Email", "Fix", "Review", "Plan", "Book", "Clean", "Write", "Pay", "Schedule", "Return"}
+	seedObjects    = []string{"the dentist", "milk and eggs", "the quarterly report", "the leaking tap", "flights to Lisbon", "the garage", "a birthday card", "the electricity bill", "the team offsite", "library books", "the car service", "the design doc", "a thank-you note", "the gym membership"}
+	seedTags       = []string{"home", "work", "urgent", "errand", "health", "finance", "someday"}
+)
+
+// seedData generates fake data in a new workspace, seed-<Seed>, whose users
+// all share seedPassword. The first user is the workspace's admin. Todos are
+// written through the todo repository, so they land in whichever backend
+// is configured, but no events or activity are recorded for them.
+func seedData(ctx context.Context, o seedOptions) (seedResult, error) {
+	rng := rand.New(rand.NewSource(o.Seed))
+	day := time.Now().Truncate(24 * time.Hour)
+	res := seedResult{Workspace: fmt.Sprintf("seed-%d", o.Seed)}
+	ws := workspaceModel{
+		ID:       newID(),
+		Slug:     res.Workspace,
+		Name:     fmt.Sprintf("Seed %d", o.Seed),
+		CreateAt: time.Now(),
+	}
+	if _, err := db.Collection(workspacesCollection).InsertOne(ctx, &ws); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return res, errAlreadySeeded
+		}
+		return res, err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(seedPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return res, err
+	}
+	for i := 0; i < o.Users; i++ {
+		first := seedFirstNames[rng.Intn(len(seedFirstNames))]
+		last := seedLastNames[rng.Intn(len(seedLastNames))]
+		u := userModel{
+			ID:           newID(),
+			WorkspaceID:  ws.ID,
+			Email:        fmt.Sprintf("%s.%s.%d@example.com", first, last, i+1),
+			PasswordHash: hash,
+			Role:         roleMember,
+			CreateAt:     day.Add(-time.Duration(rng.Intn(365*24)) * time.Hour),
+		}
+		if i == 0 {
+			u.Role = roleAdmin
+		}
+		if _, err := db.Collection(usersCollection).InsertOne(ctx, &u); err != nil {
+			return res, err
+		}
+		res.Users++
+
+		lists := make([]ID, 0, o.ListsPerUser)
+		for j := 0; j < o.ListsPerUser; j++ {
+			l := listModel{
+				ID:          newID(),
+				WorkspaceID: ws.ID,
+				OwnerID:     u.ID,
+				Name:        seedListNames[rng.Intn(len(seedListNames))],
+				Members:     []listMember{},
+				CreateAt:    u.CreateAt,
+			}
+			if _, err := db.Collection(listsCollection).InsertOne(ctx, &l); err != nil {
+				return res, err
+			}
+			lists = append(lists, l.ID)
+			res.Lists++
+		}
+
+		for j := 0; j < o.TodosPerUser; j++ {
+			tm := seedTodo(rng, day)
+			tm.WorkspaceID, tm.UserID = ws.ID, u.ID
+			if len(lists) > 0 && rng.Intn(2) == 0 {
+				tm.ListID = lists[rng.Intn(len(lists))]
+			}
+			if tm.Ref, err = nextTodoRef(ctx, ws.ID); err != nil {
+				return res, err
+			}
+			if err := serverFrom(ctx).todos.Create(ctx, &tm); err != nil {
+				return res, err
+			}
+			res.Todos++
+		}
+	}
+	return res, nil
+}
+
+// seedTodo makes up a todo created in the 90 days before day, of which
+// about a third are done and a third have a due date.
+func seedTodo(rng *rand.Rand, day time.Time) todoModel {
+	tm := todoModel{
+		Title:    seedVerbs[rng.Intn(len(seedVerbs))] + " " + seedObjects[rng.Intn(len(seedObjects))],
+		CreateAt: day.Add(-time.Duration(rng.Intn(90*24*60)) * time.Minute),
+	}
+	if rng.Intn(3) == 0 {
+		tm.Completed = true
+		tm.CompletedAt = tm.CreateAt.Add(time.Duration(rng.Intn(int(day.Sub(tm.CreateAt)/time.Minute)+1)) * time.Minute)
+	}
+	if rng.Intn(3) == 0 {
+		tm.DueDate = day.AddDate(0, 0, rng.Intn(37)-7)
+	}
+	for _, t := range seedTags {
+		if rng.Intn(5) == 0 {
+			tm.Tags = append(tm.Tags, t)
+		}
+	}
+	return tm
+}
+
+func (o seedOptions) validate() error {
+	if o.Seed < 0 || o.Users < 0 || o.ListsPerUser < 0 || o.TodosPerUser < 0 {
+		return errors.New("the seed and every count must not be negative")
+	}
+	return nil
+}
+
+// runSeed is the --seed mode of the binary.
+func runSeed(ctx context.Context) {
+	o := seedFlagOptions
+	if err := o.validate(); err != nil {
+		fatal(err.Error())
+	}
+	res, err := seedData(ctx, o)
+	if err != nil {
+		fatal("seeding", "err", err)
+	}
+	slog.Info("seeded", "workspace", res.Workspace, "users", res.Users, "lists", res.Lists,
+		"todos", res.Todos, "password", seedPassword)
+}
+
+// seedDatabase is the HTTP counterpart of --seed, taking seedOptions as
+// JSON. Omitted counts get the same defaults as the flags.
+func seedDatabase(w http.ResponseWriter, r *http.Request) {
+	o := defaultSeed
+	if hasBody(r) && !decodeJSON(w, r, &o) {
+		return
+	}
+	if err := o.validate(); err != nil {
+		writeError(w, r, apiErr(http.StatusBadRequest, err.Error()))
+		return
+	}
+	res, err := seedData(r.Context(), o)
+	if err == errAlreadySeeded {
+		writeError(w, r, apiErr(http.StatusConflict, err.Error()))
+		return
+	}
+	if err != nil {
+		render(r).JSON(w, http.StatusInternalServerError, renderer.M{
+			"message": translate(r.Context(), "error seeding database"),
+			"error":   err.Error(),
+			"seeded":  res,
+		})
+		return
+	}
+	render(r).JSON(w, http.StatusCreated, renderer.M{
+		"message": translate(r.Context(), "database seeded successfully"),
+		"seeded":  res,
+	})
+}
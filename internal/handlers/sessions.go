@@ -0,0 +1,243 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/sangin4208/go-todo/internal/storage"
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	sessionsCollection string = "sessions"
+	// Access tokens are not checked against the session store, so revoking
+	// a session takes effect for them within accessTokenTTL.
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+type (
+	sessionModel struct {
+		ID          ID        `bson:"_id,omitempty"`
+		UserID      ID        `bson:"userId"`
+		RefreshHash string    `bson:"refreshHash"`
+		UserAgent   string    `bson:"userAgent"`
+		IP          string    `bson:"ip"`
+		CreateAt    time.Time `bson:"createAt"`
+		LastUsedAt  time.Time `bson:"lastUsedAt"`
+		ExpiresAt   time.Time `bson:"expiresAt"`
+	}
+	session struct {
+		ID         string `json:"id"`
+		UserAgent  string `json:"userAgent"`
+		IP         string `json:"ip"`
+		CreateAt   string `json:"createAt"`
+		LastUsedAt string `json:"lastUsedAt"`
+		Current    bool   `json:"current"`
+	}
+)
+
+func sessionHandlers() http.Handler {
+	rg := chi.NewRouter()
+	rg.Group(func(r chi.Router) {
+		r.Use(requireAuth)
+		r.Get("/", fetchSessions)
+		r.Delete("/{id}", revokeSession)
+	})
+	return rg
+}
+
+// issueToken starts a new session for u and responds with a short-lived
+// access token and the refresh token that renews it.
+func issueToken(w http.ResponseWriter, r *http.Request, status int, u userModel) {
+	if u.Disabled {
+		writeError(w, r, &apiError{
+			Status:  http.StatusForbidden,
+			Code:    "account_disabled",
+			Message: "this account has been disabled",
+		})
+		return
+	}
+	s, refresh, err := startSession(r, u)
+	if err != nil {
+		tokenError(w, r, err)
+		return
+	}
+	writeTokens(w, r, status, u, s.ID, refresh)
+}
+
+// startSession records a new session for u signing in with r, returning
+// it and its refresh token.
+func startSession(r *http.Request, u userModel) (sessionModel, string, error) {
+	refresh, err := newRefreshToken()
+	if err != nil {
+		return sessionModel{}, "", err
+	}
+	now := time.Now()
+	s := sessionModel{
+		ID:          newID(),
+		UserID:      u.ID,
+		RefreshHash: hashAPIToken(refresh),
+		UserAgent:   r.UserAgent(),
+		IP:          clientIP(r.RemoteAddr),
+		CreateAt:    now,
+		LastUsedAt:  now,
+		ExpiresAt:   now.Add(refreshTokenTTL),
+	}
+	_, err = db.Collection(sessionsCollection).InsertOne(r.Context(), &s)
+	return s, refresh, err
+}
+
+// refreshSession exchanges a refresh token for a new access token. The
+// refresh token is rotated on every use.
+func refreshSession(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	refresh, err := newRefreshToken()
+	if err != nil {
+		tokenError(w, r, err)
+		return
+	}
+	now := time.Now()
+	sessions := db.Collection(sessionsCollection)
+	current := bson.M{
+		"refreshHash": hashAPIToken(req.RefreshToken),
+		"expiresAt":   bson.M{"$gt": now},
+	}
+	var s sessionModel
+	err = sessions.FindOne(r.Context(), current).Decode(&s)
+	var u userModel
+	if err == nil {
+		// Reload the user so role changes apply from the next refresh on.
+		err = db.Collection(usersCollection).FindOne(r.Context(), bson.M{"_id": s.UserID}).Decode(&u)
+	}
+	if err == nil && u.WorkspaceID != currentWorkspace(r.Context()) {
+		err = errWrongWorkspace
+	}
+	if err == nil && u.Disabled {
+		err = errAccountDisabled
+	}
+	if err == nil {
+		// Only now that the refresh is allowed is the token rotated; the
+		// filter makes sure it is used once even by concurrent requests.
+		err = sessions.FindOneAndUpdate(r.Context(), current, bson.M{"$set": bson.M{
+			"refreshHash": hashAPIToken(refresh),
+			"lastUsedAt":  now,
+			"ip":          clientIP(r.RemoteAddr),
+		}}).Decode(&s)
+	}
+	if err != nil {
+		writeError(w, r, apiErr(http.StatusUnauthorized, "invalid or expired refresh token"))
+		return
+	}
+	writeTokens(w, r, http.StatusOK, u, s.ID, refresh)
+}
+
+func logout(w http.ResponseWriter, r *http.Request) {
+	p := currentPrincipal(r.Context())
+	if p.SessionID.IsZero() {
+		writeError(w, r, apiErr(http.StatusBadRequest, "API keys have no session; delete the key instead"))
+		return
+	}
+	if err := deleteOne(r.Context(), db.Collection(sessionsCollection), bson.M{"_id": p.SessionID, "userId": p.UserID}); err != nil && err != mongo.ErrNoDocuments {
+		writeError(w, r, internalError("error logging out", err))
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"message": translate(r.Context(), "logged out successfully"),
+	})
+}
+
+func fetchSessions(w http.ResponseWriter, r *http.Request) {
+	p := currentPrincipal(r.Context())
+	var sessions []sessionModel
+	if err := storage.FindAll(r.Context(), db.Collection(sessionsCollection), bson.M{
+		"userId":    p.UserID,
+		"expiresAt": bson.M{"$gt": time.Now()},
+	}, &sessions, options.Find().SetSort(storage.SortKeys("-lastUsedAt"))); err != nil {
+		writeError(w, r, internalError("error fetching sessions", err))
+		return
+	}
+	data := []session{}
+	for _, s := range sessions {
+		data = append(data, session{
+			ID:         s.ID.String(),
+			UserAgent:  s.UserAgent,
+			IP:         s.IP,
+			CreateAt:   formatTime(r.Context(), s.CreateAt),
+			LastUsedAt: formatTime(r.Context(), s.LastUsedAt),
+			Current:    s.ID == p.SessionID,
+		})
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"data": data,
+	})
+}
+
+func revokeSession(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSpace(chi.URLParam(r, "id"))
+	if !validID(id) {
+		writeError(w, r, apiErr(http.StatusBadRequest, "The id is invalid"))
+		return
+	}
+	err := deleteOne(r.Context(), db.Collection(sessionsCollection), bson.M{
+		"_id":    toID(id),
+		"userId": currentUser(r.Context()),
+	})
+	if err == mongo.ErrNoDocuments {
+		writeError(w, r, apiErr(http.StatusNotFound, "session not found"))
+		return
+	}
+	if err != nil {
+		writeError(w, r, internalError("error revoking session", err))
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"message": translate(r.Context(), "session revoked successfully"),
+	})
+}
+
+func writeTokens(w http.ResponseWriter, r *http.Request, status int, u userModel, sessionID ID, refresh string) {
+	expires := time.Now().Add(accessTokenTTL)
+	token, err := signToken(r.Context(), principal{
+		UserID:      u.ID,
+		WorkspaceID: u.WorkspaceID,
+		Role:        u.Role,
+		SessionID:   sessionID,
+		Unverified:  u.Unverified,
+	}, expires)
+	if err != nil {
+		tokenError(w, r, err)
+		return
+	}
+	render(r).JSON(w, status, renderer.M{
+		"token":         token,
+		"expiresAt":     expires.Format(time.RFC3339),
+		"refreshToken":  refresh,
+		"user_id":       u.ID.String(),
+		"emailVerified": !u.Unverified,
+	})
+}
+
+func newRefreshToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func tokenError(w http.ResponseWriter, r *http.Request, err error) {
+	writeError(w, r, internalError("error issuing token", err))
+}
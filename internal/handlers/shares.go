@@ -0,0 +1,279 @@
+package handlers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/sangin4208/go-todo/internal/storage"
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	sharesCollection string = "shares"
+	shareKindList           = "list"
+	shareKindTodo           = "todo"
+)
+
+type (
+	shareModel struct {
+		ID          ID        `bson:"_id,omitempty"`
+		WorkspaceID ID        `bson:"workspaceId"`
+		OwnerID     ID        `bson:"ownerId"`
+		Kind        string    `bson:"kind"`
+		TargetID    ID        `bson:"targetId"`
+		CreateAt    time.Time `bson:"createAt"`
+	}
+	share struct {
+		ID       string `json:"id"`
+		Kind     string `json:"kind"`
+		TargetID string `json:"targetId"`
+		URL      string `json:"url"`
+		CreateAt string `json:"createAt"`
+	}
+)
+
+// shareHandlers manages the caller's share links. The links themselves are
+// served by viewShare without authentication.
+func shareHandlers() http.Handler {
+	rg := chi.NewRouter()
+	rg.Group(func(r chi.Router) {
+		r.Get("/", fetchShares)
+		r.Group(func(r chi.Router) {
+			r.Use(requireRole(roleAdmin, roleMember))
+			r.Post("/", createShare)
+			r.Delete("/{id}", deleteShare)
+		})
+	})
+	return rg
+}
+
+func fetchShares(w http.ResponseWriter, r *http.Request) {
+	var shares []shareModel
+	if err := storage.FindAll(r.Context(), db.Collection(sharesCollection), bson.M{"ownerId": currentUser(r.Context())}, &shares, options.Find().SetSort(storage.SortKeys("-createAt"))); err != nil {
+		writeError(w, r, internalError("error fetching shares", err))
+		return
+	}
+	data := []share{}
+	for _, s := range shares {
+		data = append(data, toShare(r.Context(), s))
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"data": data,
+	})
+}
+
+// createShare links to a list the caller can write to, or to a single todo
+// they own or could edit.
+func createShare(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ListID string `json:"listId"`
+		TodoID string `json:"todoId"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	p := currentPrincipal(r.Context())
+	s := shareModel{
+		ID:          newID(),
+		WorkspaceID: p.WorkspaceID,
+		OwnerID:     p.UserID,
+		CreateAt:    time.Now(),
+	}
+	var allowed bool
+	var err error
+	switch {
+	case req.ListID != "" && req.TodoID == "" && validID(req.ListID):
+		s.Kind, s.TargetID = shareKindList, toID(req.ListID)
+		allowed, err = canWriteList(r.Context(), p, s.TargetID)
+	case req.TodoID != "" && req.ListID == "" && validID(req.TodoID):
+		s.Kind, s.TargetID = shareKindTodo, toID(req.TodoID)
+		var tm todoModel
+		tm, err = getTodo(r.Context(), p, s.TargetID)
+		if err == nil {
+			allowed = tm.UserID == p.UserID
+			if !allowed && !tm.ListID.IsZero() {
+				allowed, err = canWriteList(r.Context(), p, tm.ListID)
+			}
+		}
+		if err == mongo.ErrNoDocuments {
+			err = nil
+		}
+	default:
+		writeError(w, r, apiErr(http.StatusBadRequest, "exactly one valid listId or todoId is required"))
+		return
+	}
+	if err == nil && !allowed {
+		writeError(w, r, apiErr(http.StatusNotFound, s.Kind+" not found"))
+		return
+	}
+	if err == nil {
+		_, err = db.Collection(sharesCollection).InsertOne(r.Context(), &s)
+	}
+	if err != nil {
+		writeError(w, r, internalError("error creating share", err))
+		return
+	}
+	render(r).JSON(w, http.StatusCreated, renderer.M{
+		"message": translate(r.Context(), "share created successfully"),
+		"data":    toShare(r.Context(), s),
+	})
+}
+
+// deleteShare revokes a link; it stops working immediately.
+func deleteShare(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSpace(chi.URLParam(r, "id"))
+	if !validID(id) {
+		writeError(w, r, apiErr(http.StatusBadRequest, "The id is invalid"))
+		return
+	}
+	err := deleteOne(r.Context(), db.Collection(sharesCollection), bson.M{
+		"_id":     toID(id),
+		"ownerId": currentUser(r.Context()),
+	})
+	if err == mongo.ErrNoDocuments {
+		writeError(w, r, apiErr(http.StatusNotFound, "share not found"))
+		return
+	}
+	if err != nil {
+		writeError(w, r, internalError("error deleting share", err))
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"message": translate(r.Context(), "share revoked successfully"),
+	})
+}
+
+// viewShare renders a shared list or todo read-only, as JSON when asked
+// for it and as HTML otherwise.
+func viewShare(w http.ResponseWriter, r *http.Request) {
+	s, err := lookupShare(r.Context(), chi.URLParam(r, "token"))
+	var title string
+	var todos []todoModel
+	if err == nil {
+		title, todos, err = sharedTodos(r.Context(), s)
+	}
+	if err == mongo.ErrNoDocuments {
+		writeError(w, r, apiErr(http.StatusNotFound, "share not found"))
+		return
+	}
+	if err != nil {
+		writeError(w, r, internalError("error fetching share", err))
+		return
+	}
+	data := []todo{}
+	for _, tm := range todos {
+		t := toTodo(r.Context(), tm)
+		// Internal IDs mean nothing to anonymous viewers.
+		t.ListID, t.AssigneeID = "", ""
+		data = append(data, t)
+	}
+	if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		render(r).JSON(w, http.StatusOK, renderer.M{
+			"title": title,
+			"data":  data,
+		})
+		return
+	}
+	renderPage(w, r, []string{"share.tmpl"}, renderer.M{
+		"Title": title,
+		"Todos": data,
+	})
+}
+
+// lookupShare checks a share token's signature and that it has not been
+// revoked.
+func lookupShare(ctx context.Context, token string) (shareModel, error) {
+	var s shareModel
+	id, sig, ok := strings.Cut(token, ".")
+	if !ok || !validID(id) || !hmac.Equal([]byte(sig), []byte(shareSignature(ctx, id))) {
+		return s, mongo.ErrNoDocuments
+	}
+	err := db.Collection(sharesCollection).FindOne(ctx, bson.M{"_id": toID(id)}).Decode(&s)
+	return s, err
+}
+
+// sharedTodos returns what a share shows and its title. A shared todo is
+// looked up as its sharer sees it, and a shared list only shown while its
+// sharer can still write to it, so the share stops working if they lose
+// access.
+func sharedTodos(ctx context.Context, s shareModel) (string, []todoModel, error) {
+	if s.Kind == shareKindTodo {
+		scope, err := todoAccess(ctx, principal{UserID: s.OwnerID, WorkspaceID: s.WorkspaceID}, false)
+		if err != nil {
+			return "", nil, err
+		}
+		tm, err := serverFrom(ctx).todos.Get(ctx, scope, s.TargetID)
+		return tm.Title, []todoModel{tm}, err
+	}
+	ok, err := canWriteList(ctx, principal{UserID: s.OwnerID, WorkspaceID: s.WorkspaceID}, s.TargetID)
+	if err != nil {
+		return "", nil, err
+	}
+	if !ok {
+		return "", nil, mongo.ErrNoDocuments
+	}
+	var l listModel
+	if err := db.Collection(listsCollection).FindOne(ctx, bson.M{"_id": s.TargetID, "workspaceId": s.WorkspaceID}).Decode(&l); err != nil {
+		return "", nil, err
+	}
+	shared, _, err := serverFrom(ctx).todos.List(ctx, todoScope{WorkspaceID: l.WorkspaceID, ListIDs: []ID{l.ID}}, TodoFilter{ListID: l.ID}, 0, 0)
+	return l.Name, shared, err
+}
+
+// shareKeySetting is the settings document holding the key share links are
+// signed with when TODO_JWT_SECRET is not set.
+const shareKeySetting = "shareKey"
+
+// loadShareKey sets the key s signs share links with: TODO_JWT_SECRET if it
+// is set, so that links made before keep working, and otherwise a random
+// key kept in the database, so that they survive a restart all the same.
+func (s *Server) loadShareKey(ctx context.Context) error {
+	if jwtSecretSetting != "" {
+		s.shareKey = []byte(jwtSecretSetting)
+		return nil
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	settings := db.Collection(settingsCollection)
+	// Only the first instance to get here stores its key.
+	_, err := settings.InsertOne(ctx, bson.M{"_id": shareKeySetting, "key": key})
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		return err
+	}
+	var stored struct {
+		Key []byte `bson:"key"`
+	}
+	if err := settings.FindOne(ctx, bson.M{"_id": shareKeySetting}).Decode(&stored); err != nil {
+		return err
+	}
+	s.shareKey = stored.Key
+	return nil
+}
+
+func shareSignature(ctx context.Context, id string) string {
+	mac := hmac.New(sha256.New, serverFrom(ctx).shareKey)
+	mac.Write([]byte("share:" + id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func toShare(ctx context.Context, s shareModel) share {
+	return share{
+		ID:       s.ID.String(),
+		Kind:     s.Kind,
+		TargetID: s.TargetID.String(),
+		URL:      serverFrom(ctx).publicURL + "/s/" + s.ID.String() + "." + shareSignature(ctx, s.ID.String()),
+		CreateAt: formatTime(ctx, s.CreateAt),
+	}
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// At most TODO_MAX_IN_FLIGHT API requests (512, 0 for no limit) are served
+// at once. Up to TODO_MAX_QUEUED more (256) wait for a slot, for at most
+// TODO_QUEUE_TIMEOUT_MS (100); the rest are answered 503 at once. When
+// Mongo slows down, requests then fail fast instead of piling up
+// goroutines and memory until the process falls over. WebSockets and
+// event streams are not counted, since they stay open for hours.
+
+var loadConf = struct {
+	MaxInFlight, MaxQueued int
+	QueueTimeout           time.Duration
+}{
+	MaxInFlight:  envInt("TODO_MAX_IN_FLIGHT", 512),
+	MaxQueued:    envInt("TODO_MAX_QUEUED", 256),
+	QueueTimeout: time.Duration(envInt("TODO_QUEUE_TIMEOUT_MS", 100)) * time.Millisecond,
+}
+
+func shedLoad(next http.Handler) http.Handler {
+	if loadConf.MaxInFlight <= 0 {
+		return next
+	}
+	slots := make(chan struct{}, loadConf.MaxInFlight)
+	var queued atomic.Int64
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isStream(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		select {
+		case slots <- struct{}{}:
+		default:
+			if queued.Add(1) > int64(loadConf.MaxQueued) {
+				queued.Add(-1)
+				shed(w, r, "queue full")
+				return
+			}
+			timer := time.NewTimer(loadConf.QueueTimeout)
+			select {
+			case slots <- struct{}{}:
+				timer.Stop()
+				queued.Add(-1)
+			case <-timer.C:
+				queued.Add(-1)
+				shed(w, r, "queue timeout")
+				return
+			case <-r.Context().Done():
+				timer.Stop()
+				queued.Add(-1)
+				return
+			}
+		}
+		defer func() { <-slots }()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isStream reports whether r opens a WebSocket or an event stream.
+func isStream(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
+		strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+func shed(w http.ResponseWriter, r *http.Request, reason string) {
+	httpShed.WithLabelValues(reason).Inc()
+	w.Header().Set("Retry-After", "1")
+	writeError(w, r, &apiError{
+		Status:  http.StatusServiceUnavailable,
+		Code:    "overloaded",
+		Message: "server busy, try again shortly",
+	})
+}
@@ -0,0 +1,243 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// Slack integration has two halves. A list's owner can connect the list
+// to a channel's incoming webhook, PUT /lists/{id}/slack, to have new,
+// completed and deleted todos posted there. And with the signing secret of
+// a Slack app in TODO_SLACK_SIGNING_SECRET, the app's /todo slash command
+// can be pointed at POST /slack/commands, letting users who have linked
+// their account, see chat.go, add, list and complete todos from Slack; in a
+// channel connected to a list, the command works on that list.
+
+const (
+	slackProvider = "slack"
+	// slackMaxSkew is how old a signed request may be, against replays.
+	slackMaxSkew = 5 * time.Minute
+)
+
+var slackSigningSecret = envString("TODO_SLACK_SIGNING_SECRET", "")
+
+type (
+	// listSlack connects a list to a Slack channel.
+	listSlack struct {
+		WebhookURL string `bson:"webhookUrl"`
+		// ChannelID, if set, makes /todo in that channel use the list.
+		ChannelID string `bson:"channelId,omitempty"`
+	}
+	// slackResponse answers a slash command.
+	slackResponse struct {
+		ResponseType string `json:"response_type"`
+		Text         string `json:"text"`
+	}
+)
+
+func connectListSlack(w http.ResponseWriter, r *http.Request) {
+	l, ok := ownedList(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		WebhookURL string `json:"webhookUrl"`
+		ChannelID  string `json:"channelId"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	u, err := url.Parse(strings.TrimSpace(req.WebhookURL))
+	if err != nil || u.Scheme != "https" || u.Host != "hooks.slack.com" {
+		writeError(w, r, apiErr(http.StatusBadRequest, "webhookUrl must be a Slack incoming webhook, https://hooks.slack.com/..."))
+		return
+	}
+	s := listSlack{WebhookURL: u.String(), ChannelID: strings.TrimSpace(req.ChannelID)}
+	if err := updateOne(r.Context(), db.Collection(listsCollection), bson.M{"_id": l.ID}, bson.M{"$set": bson.M{"slack": s}}); err != nil {
+		writeError(w, r, internalError("error connecting list to Slack", err))
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"message": translate(r.Context(), "list connected to Slack successfully"),
+	})
+}
+
+func disconnectListSlack(w http.ResponseWriter, r *http.Request) {
+	l, ok := ownedList(w, r)
+	if !ok {
+		return
+	}
+	if err := updateOne(r.Context(), db.Collection(listsCollection), bson.M{"_id": l.ID}, bson.M{"$unset": bson.M{"slack": ""}}); err != nil {
+		writeError(w, r, internalError("error disconnecting list from Slack", err))
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"message": translate(r.Context(), "list disconnected from Slack successfully"),
+	})
+}
+
+// verifySlackRequest checks the signature Slack puts on every request,
+// returning the body it covers.
+func verifySlackRequest(r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	if err != nil {
+		return nil, false
+	}
+	ts := r.Header.Get("X-Slack-Request-Timestamp")
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || time.Since(time.Unix(sec, 0)).Abs() > slackMaxSkew {
+		return nil, false
+	}
+	mac := hmac.New(sha256.New, []byte(slackSigningSecret))
+	fmt.Fprintf(mac, "v0:%s:", ts)
+	mac.Write(body)
+	want := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	return body, hmac.Equal([]byte(want), []byte(r.Header.Get("X-Slack-Signature")))
+}
+
+// slackCommand serves the /todo slash command:
+//
+//	/todo link <code>   link this Slack user to an account
+//	/todo add <title>   add a todo
+//	/todo list          show open todos
+//	/todo done <ref>    complete a todo
+func slackCommand(w http.ResponseWriter, r *http.Request) {
+	body, ok := verifySlackRequest(r)
+	if !ok {
+		writeError(w, r, apiErr(http.StatusUnauthorized, "invalid Slack signature"))
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		writeError(w, r, &apiError{
+			Status:  http.StatusBadRequest,
+			Message: "invalid request body",
+			Err:     err,
+		})
+		return
+	}
+	ctx := r.Context()
+	id := identity{Provider: slackProvider, Subject: form.Get("team_id") + "/" + form.Get("user_id")}
+	verb, arg, _ := strings.Cut(strings.TrimSpace(form.Get("text")), " ")
+	arg = strings.TrimSpace(arg)
+	if verb == "link" {
+		render(r).JSON(w, http.StatusOK, slackReply(chatLink(ctx, id, arg)))
+		return
+	}
+	u, p, err := chatUser(ctx, id)
+	if err == errChatNotLinked {
+		render(r).JSON(w, http.StatusOK, slackReply(chatReply{Text: "Link your account first: POST " + serverFrom(ctx).publicURL +
+			"/account/slack/link, then send /todo link <code>."}))
+		return
+	}
+	if err != nil {
+		render(r).JSON(w, http.StatusOK, slackReply(chatReply{Text: "Something went wrong: " + err.Error()}))
+		return
+	}
+	var listID ID
+	if channel := form.Get("channel_id"); channel != "" {
+		var l listModel
+		err := db.Collection(listsCollection).FindOne(ctx, bson.M{"workspaceId": u.WorkspaceID, "slack.channelId": channel}).Decode(&l)
+		if err == nil {
+			if ok, _ := canWriteList(ctx, p, l.ID); ok {
+				listID = l.ID
+			}
+		}
+	}
+
+	var res chatReply
+	switch verb {
+	case "add":
+		res = chatAdd(ctx, p, listID, arg, "/todo add")
+	case "list":
+		res = chatList(ctx, p, TodoFilter{ListID: listID})
+	case "done":
+		res = chatDone(ctx, p, arg, "/todo done")
+	default:
+		res = chatReply{Text: "Usage: /todo add <title>, /todo list, /todo done <ref> or /todo link <code>."}
+	}
+	render(r).JSON(w, http.StatusOK, slackReply(res))
+}
+
+// slackReply formats r for Slack, showing public replies to the channel.
+func slackReply(r chatReply) slackResponse {
+	res := slackResponse{ResponseType: "ephemeral", Text: slackEscape(r.Text)}
+	if r.Public {
+		res.ResponseType = "in_channel"
+	}
+	return res
+}
+
+// slackEscape escapes the characters Slack gives meaning to in messages.
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+// notifySlack posts new, completed and deleted todos to the Slack channel
+// connected to their list. Posting is best effort: failures are logged and
+// the message is not retried.
+func notifySlack(ctx context.Context, typ string, tm todoModel) {
+	if tm.ListID.IsZero() {
+		return
+	}
+	var text string
+	switch typ {
+	case eventCreated:
+		text = "New todo"
+	case eventCompleted:
+		text = "Completed"
+	case eventDeleted:
+		text = "Deleted"
+	default:
+		return
+	}
+	var l listModel
+	err := db.Collection(listsCollection).FindOne(ctx, bson.M{"_id": tm.ListID, "slack": bson.M{"$exists": true}}).Decode(&l)
+	if err == mongo.ErrNoDocuments {
+		return
+	}
+	if err == nil {
+		text = fmt.Sprintf("%s in *%s*: %s %s", text, slackEscape(l.Name), tm.Ref, slackEscape(tm.Title))
+		err = postSlack(ctx, l.Slack.WebhookURL, text)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "slack", "todo_id", tm.ID, "err", err)
+	}
+}
+
+func postSlack(ctx context.Context, webhookURL, text string) error {
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("slack answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// smsConf configures SMS reminders through Twilio, which are on when
+// TODO_TWILIO_ACCOUNT_SID, TODO_TWILIO_AUTH_TOKEN and TODO_TWILIO_FROM are
+// set; TODO_TWILIO_FROM is a sending number or a messaging service SID.
+// Users who verify a phone number and opt in get a text about overdue
+// todos and about todos tagged with the SMSPriorityTag live setting that
+// fall due soon. Texts cost money, so each user gets at most SMSDailyLimit
+// a day.
+var smsConf = struct {
+	AccountSID, AuthToken, From string
+}{
+	AccountSID: envString("TODO_TWILIO_ACCOUNT_SID", ""),
+	AuthToken:  envString("TODO_TWILIO_AUTH_TOKEN", ""),
+	From:       envString("TODO_TWILIO_FROM", ""),
+}
+
+const (
+	phoneVerificationsCollection string = "phone_verifications"
+	smsUsageCollection                  = "sms_usage"
+	smsRemindersCollection              = "sms_reminders"
+	phoneCodeTTL                        = 10 * time.Minute
+	maxPhoneCodeAttempts                = 5
+	// maxSMSLength keeps a text within a few segments.
+	maxSMSLength = 320
+)
+
+var (
+	// e164 matches phone numbers in international format, as Twilio wants.
+	e164      = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+	smsClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// phoneVerificationModel is a code texted to a number the user wants
+// reminders at, one per user.
+type phoneVerificationModel struct {
+	UserID    ID        `bson:"_id"`
+	Phone     string    `bson:"phone"`
+	Hash      string    `bson:"hash"`
+	Attempts  int       `bson:"attempts"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+func smsEnabled() bool {
+	return smsConf.AccountSID != "" && smsConf.AuthToken != "" && smsConf.From != ""
+}
+
+// startPhoneVerification texts a code to the number in the body; the
+// number is the user's once the code is confirmed.
+func startPhoneVerification(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Phone string `json:"phone"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	phone := strings.NewReplacer(" ", "", "-", "", "(", "", ")", "").Replace(req.Phone)
+	if !e164.MatchString(phone) {
+		writeError(w, r, apiErr(http.StatusBadRequest, "phone must be in international format, such as +14155550123"))
+		return
+	}
+	ctx, user := r.Context(), currentUser(r.Context())
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		writeError(w, r, internalError("error creating verification code", err))
+		return
+	}
+	code := fmt.Sprintf("%06d", n)
+	ok, err := claimSMS(ctx, user, time.Now())
+	if err == nil && !ok {
+		writeError(w, r, apiErr(http.StatusTooManyRequests, "daily text limit reached, try again tomorrow"))
+		return
+	}
+	if err == nil {
+		_, err = db.Collection(phoneVerificationsCollection).ReplaceOne(ctx, bson.M{"_id": user}, phoneVerificationModel{
+			UserID:    user,
+			Phone:     phone,
+			Hash:      hashAPIToken(code),
+			ExpiresAt: time.Now().Add(phoneCodeTTL),
+		}, options.Replace().SetUpsert(true))
+	}
+	if err == nil {
+		err = sendSMS(ctx, phone, "Your todo verification code is "+code)
+	}
+	if err != nil {
+		writeError(w, r, internalError("error sending verification code", err))
+		return
+	}
+	render(r).JSON(w, http.StatusAccepted, renderer.M{
+		"message": translate(r.Context(), "verification code sent"),
+	})
+}
+
+func confirmPhone(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Code string `json:"code"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	ctx, user := r.Context(), currentUser(r.Context())
+	// Counting the attempt first bounds guessing even under concurrency.
+	var v phoneVerificationModel
+	err := db.Collection(phoneVerificationsCollection).FindOneAndUpdate(ctx, bson.M{
+		"_id":       user,
+		"attempts":  bson.M{"$lt": maxPhoneCodeAttempts},
+		"expiresAt": bson.M{"$gt": time.Now()},
+	}, bson.M{"$inc": bson.M{"attempts": 1}}).Decode(&v)
+	if err == mongo.ErrNoDocuments || err == nil && v.Hash != hashAPIToken(strings.TrimSpace(req.Code)) {
+		writeError(w, r, apiErr(http.StatusBadRequest, "invalid or expired code"))
+		return
+	}
+	if err == nil {
+		err = updateOne(ctx, db.Collection(usersCollection), bson.M{"_id": user}, bson.M{"$set": bson.M{"phone": v.Phone}})
+	}
+	if err == nil {
+		err = deleteOne(ctx, db.Collection(phoneVerificationsCollection), bson.M{"_id": user})
+	}
+	if err != nil {
+		writeError(w, r, internalError("error verifying phone", err))
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"message": translate(r.Context(), "phone verified successfully"),
+	})
+}
+
+func deletePhone(w http.ResponseWriter, r *http.Request) {
+	if err := updateOne(r.Context(), db.Collection(usersCollection), bson.M{"_id": currentUser(r.Context())},
+		bson.M{"$unset": bson.M{"phone": "", "notifications.sms": ""}}); err != nil {
+		writeError(w, r, internalError("error removing phone", err))
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"message": translate(r.Context(), "phone removed successfully"),
+	})
+}
+
+// claimSMS counts a text to user against today's limit, reporting false
+// when the limit is reached. Counts are kept per user and UTC day in
+// sms_usage.
+func claimSMS(ctx context.Context, user ID, now time.Time) (bool, error) {
+	day := now.UTC().Format("2006-01-02")
+	// Like markReminded, the upsert fails on the _id once today's count
+	// has reached the limit.
+	_, err := db.Collection(smsUsageCollection).UpdateOne(ctx,
+		bson.M{"_id": user.String() + ":" + day, "count": bson.M{"$lt": liveConf().SMSDailyLimit}},
+		bson.M{
+			"$inc":         bson.M{"count": 1},
+			"$setOnInsert": bson.M{"userId": user, "expiresAt": now.Add(48 * time.Hour)},
+		},
+		options.UpdateOne().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func sendSMSReminders(ctx context.Context, now time.Time) error {
+	cur, err := db.Collection(usersCollection).Find(ctx, bson.M{
+		"disabled":          bson.M{"$ne": true},
+		"phone":             bson.M{"$exists": true},
+		"notifications.sms": true,
+	})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		var u userModel
+		if err := cur.Decode(&u); err != nil {
+			return err
+		}
+		if err := textUser(ctx, u, now); err != nil {
+			slog.Error("sms reminders", "user_id", u.ID, "err", err)
+		}
+	}
+	return cur.Err()
+}
+
+// textUser texts u about their overdue todos and priority todos due soon,
+// each once per due date. Past the daily limit they are not texted again.
+func textUser(ctx context.Context, u userModel, now time.Time) error {
+	scope := todoScope{WorkspaceID: u.WorkspaceID, OwnerID: u.ID, AssigneeID: u.ID}
+	y, m, d := now.Date()
+	today := time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+	open := false
+	todos := serverFrom(ctx).todos
+	overdue, _, err := todos.List(ctx, scope, TodoFilter{Completed: &open, DueBefore: today}, 0, 0)
+	if err != nil {
+		return err
+	}
+	urgent, _, err := todos.List(ctx, scope, TodoFilter{Completed: &open, Tag: liveConf().SMSPriorityTag, DueBefore: now.Add(u.Notifications.dueSoonLead())}, 0, 0)
+	if err != nil {
+		return err
+	}
+	var lines []string
+	seen := map[ID]bool{}
+	for _, tm := range append(overdue, urgent...) {
+		if seen[tm.ID] {
+			continue
+		}
+		seen[tm.ID] = true
+		first, err := markReminded(ctx, db.Collection(smsRemindersCollection), u.ID, tm)
+		if err != nil {
+			return err
+		}
+		if first {
+			lines = append(lines, fmt.Sprintf("%s %s, due %s", tm.Ref, tm.Title, formatDueDate(tm.DueDate)))
+		}
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	if ok, err := claimSMS(ctx, u.ID, now); err != nil || !ok {
+		return err
+	}
+	body := []rune("Todo reminder: " + strings.Join(lines, "; "))
+	if len(body) > maxSMSLength {
+		body = append(body[:maxSMSLength-1], '…')
+	}
+	return sendSMS(ctx, u.Phone, string(body))
+}
+
+// sendSMS sends body to the number through Twilio's Messages API.
+func sendSMS(ctx context.Context, to, body string) error {
+	form := url.Values{"To": {to}, "Body": {body}}
+	if strings.HasPrefix(smsConf.From, "MG") {
+		form.Set("MessagingServiceSid", smsConf.From)
+	} else {
+		form.Set("From", smsConf.From)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		"https://api.twilio.com/2010-04-01/Accounts/"+url.PathEscape(smsConf.AccountSID)+"/Messages.json",
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(smsConf.AccountSID, smsConf.AuthToken)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := smsClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var res struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&res)
+		return fmt.Errorf("twilio answered %s: %s", resp.Status, res.Message)
+	}
+	return nil
+}
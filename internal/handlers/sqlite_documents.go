@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"database/sql"
+
+	"github.com/sangin4208/go-todo/internal/docstore"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// sqlitePath is the database file used when TODO_STORAGE=sqlite.
+var sqlitePath = envString("TODO_SQLITE_PATH", "todo.db")
+
+// sqliteDocumentStore keeps the embedded database in the documents table of
+// the SQLite file the todos are in, one BSON document per row.
+type sqliteDocumentStore struct {
+	db *sql.DB
+}
+
+func (s sqliteDocumentStore) Load(fn func(collection string, doc bson.Raw) error) error {
+	rows, err := s.db.Query(`SELECT collection, doc FROM documents ORDER BY rowid`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var doc []byte
+		if err := rows.Scan(&name, &doc); err != nil {
+			return err
+		}
+		if err := fn(name, doc); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s sqliteDocumentStore) Write(changes []docstore.Change) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, c := range changes {
+		if c.Doc == nil {
+			_, err = tx.Exec(`DELETE FROM documents WHERE collection = ? AND id = ?`, c.Collection, c.ID)
+		} else {
+			// An upsert rather than REPLACE keeps the rowid, and so the
+			// order documents are loaded in.
+			_, err = tx.Exec(`INSERT INTO documents (collection, id, doc) VALUES (?, ?, ?)
+				ON CONFLICT (collection, id) DO UPDATE SET doc = excluded.doc`,
+				c.Collection, c.ID, []byte(c.Doc))
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Close closes the file, todo repository and all, at shutdown.
+func (s sqliteDocumentStore) Close() error {
+	return s.db.Close()
+}
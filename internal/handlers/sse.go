@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sseHeartbeat = 30 * time.Second
+	// sseRetry is the reconnection delay suggested to clients.
+	sseRetry = 5 * time.Second
+)
+
+// sseEpoch tells this process's event IDs, <epoch>-<seq>, from those of
+// another instance or an earlier run, which cannot be replayed.
+var sseEpoch = strconv.FormatInt(time.Now().UnixNano(), 36)
+
+// eventStreamToken reads the access token from ?access_token= on requests
+// for an event stream, since EventSource cannot set headers. Prefer the
+// Authorization header where the client allows it: URLs end up in logs.
+func eventStreamToken(r *http.Request) string {
+	if !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		return ""
+	}
+	return r.URL.Query().Get("access_token")
+}
+
+// streamEvents serves GET /todo/events, a Server-Sent Events stream of the
+// changes watchTodosWS sends, for clients whose proxies do not pass
+// WebSockets through. A client reconnecting with Last-Event-ID (or
+// ?lastEventId=) first gets what it missed; if that is no longer known, as
+// after reconnecting to another instance, it gets a reset event and should
+// refetch its todos.
+func streamEvents(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	// The stream outlives the server's read and write timeouts.
+	err := rc.SetReadDeadline(time.Time{})
+	if err == nil {
+		err = rc.SetWriteDeadline(time.Time{})
+	}
+	if err != nil {
+		writeError(w, r, internalError("streaming is not supported", err))
+		return
+	}
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("lastEventId")
+	}
+	user, changes := currentUser(r.Context()), serverFrom(r.Context()).changes
+	var (
+		ch     chan event
+		missed []event
+		replay = true
+	)
+	if lastID == "" {
+		ch = changes.subscribe(user)
+	} else if seq, ok := parseEventID(lastID); ok {
+		ch, missed, replay = changes.subscribeSince(user, seq)
+	} else {
+		ch, replay = changes.subscribe(user), false
+	}
+	defer changes.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stop nginx from buffering the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetry.Milliseconds())
+	if !replay {
+		fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+	}
+	for _, e := range missed {
+		if err := writeEvent(r.Context(), w, e); err != nil {
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			// Comments keep proxies from closing an idle stream.
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case e := <-ch:
+			if err := writeEvent(r.Context(), w, e); err != nil {
+				slog.ErrorContext(r.Context(), "event stream", "err", err)
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func writeEvent(ctx context.Context, w http.ResponseWriter, e event) error {
+	data, err := json.Marshal(changeMessage{Type: e.Type, Todo: toTodo(ctx, e.Todo)})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s-%d\nevent: %s\ndata: %s\n\n", sseEpoch, e.Seq, e.Type, data)
+	return err
+}
+
+// parseEventID returns the sequence number of an event ID from this
+// process.
+func parseEventID(id string) (uint64, bool) {
+	epoch, seq, ok := strings.Cut(id, "-")
+	if !ok || epoch != sseEpoch {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(seq, 10, 64)
+	return n, err == nil
+}
@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/thedevsaddam/renderer"
+)
+
+const (
+	trendDays   = 30
+	heatmapDays = 365
+	// maxHeatmapDays bounds the from-to range asked for, a leap year.
+	maxHeatmapDays = 366
+)
+
+type (
+	tagCount struct {
+		Tag       string `json:"tag"`
+		Total     int    `json:"total"`
+		Completed int    `json:"completed"`
+	}
+	dayCount struct {
+		Date  string `json:"date"`
+		Count int    `json:"count"`
+	}
+	summary struct {
+		Total     int `json:"total"`
+		Open      int `json:"open"`
+		Completed int `json:"completed"`
+		Overdue   int `json:"overdue"`
+	}
+)
+
+func statsHandlers() http.Handler {
+	rg := chi.NewRouter()
+	rg.Group(func(r chi.Router) {
+		r.Use(cacheResponses)
+		r.Get("/", fetchStats)
+		r.Get("/heatmap", fetchHeatmap)
+	})
+	return rg
+}
+
+func fetchStats(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	now := time.Now()
+	todos := serverFrom(ctx).todos
+	owned := todoScope{WorkspaceID: currentWorkspace(ctx), OwnerID: currentUser(ctx)}
+	done, open := true, false
+
+	var s summary
+	var err error
+	if s.Total, err = todos.Count(ctx, owned, TodoFilter{}); err != nil {
+		statsError(w, r, err)
+		return
+	}
+	if s.Completed, err = todos.Count(ctx, owned, TodoFilter{Completed: &done}); err != nil {
+		statsError(w, r, err)
+		return
+	}
+	if s.Overdue, err = todos.Count(ctx, owned, TodoFilter{Completed: &open, DueBefore: now}); err != nil {
+		statsError(w, r, err)
+		return
+	}
+	s.Open = s.Total - s.Completed
+
+	counts, err := todos.CountTags(ctx, owned, TodoFilter{})
+	if err != nil {
+		statsError(w, r, err)
+		return
+	}
+	tags := make([]tagCount, len(counts))
+	for i, c := range counts {
+		tags[i] = tagCount{Tag: c.Tag, Total: c.Total, Completed: c.Completed}
+	}
+
+	// Days run midnight to midnight where the user is, as on the heatmap,
+	// the oldest of them whole.
+	loc := requestZone(ctx)
+	local := now.In(loc)
+	since := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc).AddDate(0, 0, -trendDays)
+	days, err := todos.CountByDay(ctx, owned, TodoFilter{CreatedAfter: since.Add(-time.Nanosecond)}, false, loc)
+	if err != nil {
+		statsError(w, r, err)
+		return
+	}
+	trend := make([]dayCount, 0, len(days))
+	for date, n := range days {
+		trend = append(trend, dayCount{Date: date, Count: n})
+	}
+	sort.Slice(trend, func(i, j int) bool { return trend[i].Date < trend[j].Date })
+
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"data": renderer.M{
+			"total":     s.Total,
+			"open":      s.Open,
+			"completed": s.Completed,
+			"overdue":   s.Overdue,
+			"tags":      tags,
+			"created":   trend,
+		},
+	})
+}
+
+func fetchHeatmap(w http.ResponseWriter, r *http.Request) {
+	loc := requestZone(r.Context())
+	if tz := r.URL.Query().Get("tz"); tz != "" {
+		l, err := time.LoadLocation(tz)
+		if err != nil {
+			writeError(w, r, apiErr(http.StatusBadRequest, "tz must be an IANA time zone name"))
+			return
+		}
+		loc = l
+	}
+
+	now := time.Now().In(loc)
+	to := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	from := to.AddDate(0, 0, -heatmapDays+1)
+	var err error
+	if v := r.URL.Query().Get("from"); v != "" {
+		if from, err = time.ParseInLocation("2006-01-02", v, loc); err != nil {
+			writeError(w, r, apiErr(http.StatusBadRequest, "from must be formatted as 2006-01-02"))
+			return
+		}
+	}
+	if v := r.URL.Query().Get("to"); v != "" {
+		if to, err = time.ParseInLocation("2006-01-02", v, loc); err != nil {
+			writeError(w, r, apiErr(http.StatusBadRequest, "to must be formatted as 2006-01-02"))
+			return
+		}
+	}
+	if to.Before(from) {
+		writeError(w, r, apiErr(http.StatusBadRequest, "from must not be after to"))
+		return
+	}
+	if !to.Before(from.AddDate(0, 0, maxHeatmapDays)) {
+		writeError(w, r, apiErr(http.StatusBadRequest, fmt.Sprintf("from and to must span at most %d days", maxHeatmapDays)))
+		return
+	}
+
+	// CompletedAfter is exclusive, and from is the first day to count.
+	done := true
+	counts, err := serverFrom(r.Context()).todos.CountByDay(r.Context(), todoScope{WorkspaceID: currentWorkspace(r.Context()), OwnerID: currentUser(r.Context())},
+		TodoFilter{Completed: &done, CompletedAfter: from.Add(-time.Nanosecond)}, true, loc)
+	if err != nil {
+		statsError(w, r, err)
+		return
+	}
+
+	// Fill in the empty days so clients can render the grid directly.
+	heatmap := []dayCount{}
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		key := d.Format("2006-01-02")
+		heatmap = append(heatmap, dayCount{Date: key, Count: counts[key]})
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"data": heatmap,
+	})
+}
+
+func statsError(w http.ResponseWriter, r *http.Request, err error) {
+	writeError(w, r, internalError("error computing stats", err))
+}
@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// The functions below are shared by the HTTP, gRPC and GraphQL handlers so
+// every transport goes through the same access checks and emits the same
+// events and activity, whatever TodoRepository is in use. Every operation is
+// scoped to the caller's workspace and to what they may access: their own
+// todos plus those in lists shared with them. Anything else behaves as if
+// it did not exist.
+
+func listTodos(ctx context.Context, p principal) ([]todoModel, error) {
+	todos, _, err := findTodos(ctx, p, TodoFilter{}, 0, 0)
+	return todos, err
+}
+
+// findTodos returns one page of the todos p can read matching f, newest
+// first, along with the total number of matches. A zero limit returns every
+// match.
+func findTodos(ctx context.Context, p principal, f TodoFilter, skip, limit int) ([]todoModel, int, error) {
+	scope, err := todoAccess(ctx, p, false)
+	if err != nil {
+		return nil, 0, err
+	}
+	return serverFrom(ctx).todos.List(ctx, scope, f, skip, limit)
+}
+
+func getTodo(ctx context.Context, p principal, id ID) (todoModel, error) {
+	scope, err := todoAccess(ctx, p, false)
+	if err != nil {
+		return todoModel{}, err
+	}
+	return serverFrom(ctx).todos.Get(ctx, scope, id)
+}
+
+func insertTodo(ctx context.Context, p principal, tm *todoModel) error {
+	if !p.ListID.IsZero() && tm.ListID.IsZero() {
+		tm.ListID = p.ListID
+	}
+	if !tm.ListID.IsZero() {
+		ok, err := canWriteList(ctx, p, tm.ListID)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errListNotFound
+		}
+	}
+	if err := checkQuota(liveConf().MaxOpenTodos, func() (int, error) {
+		return serverFrom(ctx).todos.CountOpen(ctx, p.UserID)
+	}); err != nil {
+		return err
+	}
+	tm.UserID = p.UserID
+	tm.WorkspaceID = p.WorkspaceID
+	tm.UpdatedAt = time.Now()
+	ref, err := nextTodoRef(ctx, p.WorkspaceID)
+	if err != nil {
+		return err
+	}
+	tm.Ref = ref
+	err = atomically(ctx, func(ctx context.Context) error {
+		if err := serverFrom(ctx).todos.Create(ctx, tm); err != nil {
+			return err
+		}
+		return recordEvent(ctx, eventCreated, *tm)
+	})
+	if err != nil {
+		return err
+	}
+	publishChange(ctx, eventCreated, *tm)
+	recordActivity(ctx, p.UserID, eventCreated, todoModel{}, *tm)
+	return nil
+}
+
+func setTodo(ctx context.Context, p principal, id ID, title string, completed bool) (todoModel, error) {
+	return setTodoAt(ctx, p, id, time.Time{}, title, completed)
+}
+
+// setTodoAt is setTodo for the todo as it was last changed at changedAt,
+// unless that is zero: if it has changed since, it is left alone and
+// mongo.ErrNoDocuments returned.
+func setTodoAt(ctx context.Context, p principal, id ID, changedAt time.Time, title string, completed bool) (todoModel, error) {
+	scope, err := todoAccess(ctx, p, true)
+	if err != nil {
+		return todoModel{}, err
+	}
+	scope.ChangedAt = changedAt
+	var before, tm todoModel
+	err = atomically(ctx, func(ctx context.Context) error {
+		var err error
+		if before, tm, err = serverFrom(ctx).todos.Update(ctx, scope, id, title, completed); err != nil {
+			return err
+		}
+		if err := recordEvent(ctx, eventUpdated, tm); err != nil {
+			return err
+		}
+		if tm.Completed && !before.Completed {
+			return recordEvent(ctx, eventCompleted, tm)
+		}
+		return nil
+	})
+	if err != nil {
+		return tm, err
+	}
+	publishChange(ctx, eventUpdated, tm)
+	recordActivity(ctx, p.UserID, eventUpdated, before, tm)
+	return tm, nil
+}
+
+func removeTodo(ctx context.Context, p principal, id ID) error {
+	return removeTodoAt(ctx, p, id, time.Time{})
+}
+
+// removeTodoAt is removeTodo for the todo as it was last changed at
+// changedAt, as setTodoAt is setTodo.
+func removeTodoAt(ctx context.Context, p principal, id ID, changedAt time.Time) error {
+	scope, err := todoAccess(ctx, p, true)
+	if err != nil {
+		return err
+	}
+	scope.ChangedAt = changedAt
+	var tm todoModel
+	err = atomically(ctx, func(ctx context.Context) error {
+		var err error
+		if tm, err = serverFrom(ctx).todos.Delete(ctx, scope, id); err != nil {
+			return err
+		}
+		if err := recordTombstones(ctx, tm); err != nil {
+			return err
+		}
+		return recordEvent(ctx, eventDeleted, tm)
+	})
+	if err != nil {
+		return err
+	}
+	publishChange(ctx, eventDeleted, tm)
+	recordActivity(ctx, p.UserID, eventDeleted, tm, todoModel{})
+	if _, err := deleteAttachments(ctx, bson.M{"todoId": tm.ID}); err != nil {
+		slog.ErrorContext(ctx, "deleting attachments", "todo_id", tm.ID, "err", err)
+	}
+	return nil
+}
+
+// expireTodos deletes expired todos once a minute, much as Mongo's TTL
+// monitor does for the mongo backend, and announces each deletion. Only
+// the leader does, so that each deletion is announced once. It stops when
+// ctx is canceled.
+func expireTodos(ctx context.Context) {
+	tick := time.NewTicker(time.Minute)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+		if !isLeader(ctx) {
+			continue
+		}
+		expired, err := serverFrom(ctx).todos.DeleteExpired(ctx, time.Now())
+		if err != nil {
+			slog.Error("todo expiry", "err", err)
+		}
+		if err := recordTombstones(ctx, expired...); err != nil {
+			slog.Error("todo expiry", "err", err)
+		}
+		for _, tm := range expired {
+			if err := recordEvent(ctx, eventDeleted, tm); err != nil {
+				slog.Error("todo expiry", "err", err)
+			}
+			publishChange(ctx, eventDeleted, tm)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// callTaskAPI sends body, if any, as JSON and decodes the answer into out,
+// if any. 404 and 410 become errRemoteNotFound.
+func callTaskAPI(ctx context.Context, c *http.Client, method, url string, body, out interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return errRemoteNotFound
+	case resp.StatusCode >= 300:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: %s: %s", method, req.URL.Path, resp.Status, bytes.TrimSpace(msg))
+	case out == nil || resp.StatusCode == http.StatusNoContent:
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// googleTasks syncs with the user's default Google Tasks list.
+type googleTasks struct {
+	client *http.Client
+}
+
+const googleTasksURL = "https://tasks.googleapis.com/tasks/v1/lists/@default/tasks"
+
+type googleTask struct {
+	ID      string `json:"id,omitempty"`
+	Title   string `json:"title"`
+	Status  string `json:"status"`
+	Due     string `json:"due,omitempty"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+func (g googleTasks) List(ctx context.Context) ([]remoteTask, error) {
+	var tasks []remoteTask
+	page := ""
+	for {
+		var res struct {
+			Items         []googleTask `json:"items"`
+			NextPageToken string       `json:"nextPageToken"`
+		}
+		q := url.Values{"showCompleted": {"true"}, "showHidden": {"true"}, "maxResults": {"100"}}
+		if page != "" {
+			q.Set("pageToken", page)
+		}
+		if err := callTaskAPI(ctx, g.client, http.MethodGet, googleTasksURL+"?"+q.Encode(), nil, &res); err != nil {
+			return nil, err
+		}
+		for _, t := range res.Items {
+			if !t.Deleted {
+				tasks = append(tasks, t.remote())
+			}
+		}
+		if page = res.NextPageToken; page == "" {
+			return tasks, nil
+		}
+	}
+}
+
+func (g googleTasks) Get(ctx context.Context, id string) (remoteTask, error) {
+	var t googleTask
+	if err := callTaskAPI(ctx, g.client, http.MethodGet, googleTasksURL+"/"+url.PathEscape(id), nil, &t); err != nil {
+		return remoteTask{}, err
+	}
+	if t.Deleted {
+		return remoteTask{}, errRemoteNotFound
+	}
+	return t.remote(), nil
+}
+
+func (g googleTasks) Create(ctx context.Context, t remoteTask) (string, error) {
+	gt := googleTask{Title: t.Title, Status: googleStatus(t.Completed)}
+	if !t.DueDate.IsZero() {
+		// Google keeps due dates as midnight UTC, ignoring the time.
+		gt.Due = formatDueDate(t.DueDate) + "T00:00:00.000Z"
+	}
+	var created googleTask
+	err := callTaskAPI(ctx, g.client, http.MethodPost, googleTasksURL, gt, &created)
+	return created.ID, err
+}
+
+func (g googleTasks) Update(ctx context.Context, before, after remoteTask) error {
+	patch := map[string]interface{}{"title": after.Title, "status": googleStatus(after.Completed)}
+	if !after.Completed {
+		patch["completed"] = nil
+	}
+	return callTaskAPI(ctx, g.client, http.MethodPatch, googleTasksURL+"/"+url.PathEscape(before.ID), patch, nil)
+}
+
+func (g googleTasks) Delete(ctx context.Context, id string) error {
+	return callTaskAPI(ctx, g.client, http.MethodDelete, googleTasksURL+"/"+url.PathEscape(id), nil, nil)
+}
+
+func (t googleTask) remote() remoteTask {
+	r := remoteTask{ID: t.ID, Title: t.Title, Completed: t.Status == "completed"}
+	if d, err := time.Parse(time.RFC3339, t.Due); err == nil {
+		r.DueDate, _ = parseDueDate(d.UTC().Format("2006-01-02"))
+	}
+	return r
+}
+
+func googleStatus(completed bool) string {
+	if completed {
+		return "completed"
+	}
+	return "needsAction"
+}
+
+// todoistTasks syncs with every project of a Todoist account; new todos go
+// to the inbox.
+type todoistTasks struct {
+	client *http.Client
+}
+
+const todoistTasksURL = "https://api.todoist.com/rest/v2/tasks"
+
+type todoistTask struct {
+	ID          string `json:"id"`
+	Content     string `json:"content"`
+	IsCompleted bool   `json:"is_completed"`
+	Due         *struct {
+		Date string `json:"date"`
+	} `json:"due"`
+}
+
+// List returns open tasks only; Todoist lists no others.
+func (t todoistTasks) List(ctx context.Context) ([]remoteTask, error) {
+	var res []todoistTask
+	if err := callTaskAPI(ctx, t.client, http.MethodGet, todoistTasksURL, nil, &res); err != nil {
+		return nil, err
+	}
+	tasks := make([]remoteTask, 0, len(res))
+	for _, tt := range res {
+		tasks = append(tasks, tt.remote())
+	}
+	return tasks, nil
+}
+
+func (t todoistTasks) Get(ctx context.Context, id string) (remoteTask, error) {
+	var tt todoistTask
+	err := callTaskAPI(ctx, t.client, http.MethodGet, todoistTasksURL+"/"+url.PathEscape(id), nil, &tt)
+	return tt.remote(), err
+}
+
+func (t todoistTasks) Create(ctx context.Context, task remoteTask) (string, error) {
+	body := map[string]string{"content": task.Title}
+	if !task.DueDate.IsZero() {
+		body["due_date"] = formatDueDate(task.DueDate)
+	}
+	var created todoistTask
+	if err := callTaskAPI(ctx, t.client, http.MethodPost, todoistTasksURL, body, &created); err != nil {
+		return "", err
+	}
+	if task.Completed {
+		if err := callTaskAPI(ctx, t.client, http.MethodPost, todoistTasksURL+"/"+url.PathEscape(created.ID)+"/close", nil, nil); err != nil {
+			return created.ID, err
+		}
+	}
+	return created.ID, nil
+}
+
+func (t todoistTasks) Update(ctx context.Context, before, after remoteTask) error {
+	u := todoistTasksURL + "/" + url.PathEscape(before.ID)
+	if after.Title != before.Title {
+		if err := callTaskAPI(ctx, t.client, http.MethodPost, u, map[string]string{"content": after.Title}, nil); err != nil {
+			return err
+		}
+	}
+	switch {
+	case after.Completed && !before.Completed:
+		return callTaskAPI(ctx, t.client, http.MethodPost, u+"/close", nil, nil)
+	case !after.Completed && before.Completed:
+		return callTaskAPI(ctx, t.client, http.MethodPost, u+"/reopen", nil, nil)
+	}
+	return nil
+}
+
+func (t todoistTasks) Delete(ctx context.Context, id string) error {
+	return callTaskAPI(ctx, t.client, http.MethodDelete, todoistTasksURL+"/"+url.PathEscape(id), nil, nil)
+}
+
+func (tt todoistTask) remote() remoteTask {
+	r := remoteTask{ID: tt.ID, Title: tt.Content, Completed: tt.IsCompleted}
+	if tt.Due != nil && len(tt.Due.Date) >= 10 {
+		r.DueDate, _ = parseDueDate(tt.Due.Date[:10])
+	}
+	return r
+}
@@ -0,0 +1,626 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/sangin4208/go-todo/internal/storage"
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// Task sync keeps a user's todos in step with Google Tasks or Todoist, so
+// that their apps can be used against this server. A connection is made
+// through OAuth, with the client of TODO_SYNC_GOOGLE_CLIENT_ID and
+// TODO_SYNC_GOOGLE_CLIENT_SECRET or the TODOIST equivalents, and then
+// synced every TODO_SYNC_INTERVAL_MINUTES, 10 by default.
+//
+// Each synced todo is mapped to a remote task along with a fingerprint of
+// the title and completion both had when last in step. A side whose
+// fingerprint moved has changed; when both have, the connection's conflict
+// rule, "remote" (the default) or "local", says which wins. A deletion
+// travels to the other side unless that side changed meanwhile, in which
+// case the deleted item is recreated. Open items that are not yet mapped
+// are copied across; due dates travel with new items only, as todos cannot
+// have theirs changed.
+
+const (
+	syncConnectionsCollection string = "sync_connections"
+	syncMappingsCollection           = "sync_mappings"
+	syncStatesCollection             = "sync_states"
+	syncPreferLocal                  = "local"
+	syncPreferRemote                 = "remote"
+)
+
+var (
+	syncInterval      = time.Duration(envInt("TODO_SYNC_INTERVAL_MINUTES", 10)) * time.Minute
+	errRemoteNotFound = errors.New("remote task not found")
+	// taskServices holds the sync providers configured through the
+	// environment.
+	taskServices = map[string]*taskServiceProvider{}
+)
+
+type (
+	// remoteTask is a task as the sync providers have it.
+	remoteTask struct {
+		ID        string
+		Title     string
+		Completed bool
+		DueDate   time.Time
+	}
+	// TaskService reads and writes the tasks of one connected account.
+	TaskService interface {
+		// List returns the account's tasks. Providers may leave completed
+		// tasks out; Get still finds those.
+		List(ctx context.Context) ([]remoteTask, error)
+		// Get returns errRemoteNotFound for deleted tasks.
+		Get(ctx context.Context, id string) (remoteTask, error)
+		Create(ctx context.Context, t remoteTask) (string, error)
+		Update(ctx context.Context, before, after remoteTask) error
+		Delete(ctx context.Context, id string) error
+	}
+	taskServiceProvider struct {
+		config *oauth2.Config
+		open   func(client *http.Client) TaskService
+	}
+
+	syncConnectionModel struct {
+		ID          ID     `bson:"_id,omitempty"`
+		UserID      ID     `bson:"userId"`
+		WorkspaceID ID     `bson:"workspaceId"`
+		Provider    string `bson:"provider"`
+		// Token is the OAuth token as sealed JSON.
+		Token      string    `bson:"token"`
+		Prefer     string    `bson:"prefer"`
+		NextSyncAt time.Time `bson:"nextSyncAt"`
+		LastSyncAt time.Time `bson:"lastSyncAt,omitempty"`
+		LastError  string    `bson:"lastError,omitempty"`
+		CreateAt   time.Time `bson:"createAt"`
+	}
+	syncConnection struct {
+		ID         string `json:"id"`
+		Provider   string `json:"provider"`
+		Prefer     string `json:"prefer"`
+		LastSyncAt string `json:"lastSyncAt,omitempty"`
+		LastError  string `json:"lastError,omitempty"`
+		CreateAt   string `json:"createAt"`
+	}
+	// syncMappingModel pairs a todo with a remote task.
+	syncMappingModel struct {
+		ID           ID     `bson:"_id,omitempty"`
+		ConnectionID ID     `bson:"connectionId"`
+		TodoID       ID     `bson:"todoId"`
+		RemoteID     string `bson:"remoteId"`
+		// Fingerprint is what both sides had when last in step.
+		Fingerprint string `bson:"fingerprint"`
+	}
+	// syncStateModel ties an OAuth state to the user connecting.
+	syncStateModel struct {
+		State       string    `bson:"_id"`
+		UserID      ID        `bson:"userId"`
+		WorkspaceID ID        `bson:"workspaceId"`
+		Provider    string    `bson:"provider"`
+		ExpiresAt   time.Time `bson:"expiresAt"`
+	}
+)
+
+// registerTaskServices sets up the task services with credentials
+// configured, once publicURL is known.
+func registerTaskServices() {
+	register := func(name string, endpoint oauth2.Endpoint, scopes []string, open func(*http.Client) TaskService) {
+		prefix := "TODO_SYNC_" + strings.ToUpper(name) + "_"
+		id, secret := envString(prefix+"CLIENT_ID", ""), envString(prefix+"CLIENT_SECRET", "")
+		if id == "" || secret == "" {
+			return
+		}
+		taskServices[name] = &taskServiceProvider{
+			config: &oauth2.Config{
+				ClientID:     id,
+				ClientSecret: secret,
+				Endpoint:     endpoint,
+				RedirectURL:  publicURL + "/sync/" + name + "/callback",
+				Scopes:       scopes,
+			},
+			open: open,
+		}
+	}
+	register("google", google.Endpoint, []string{"https://www.googleapis.com/auth/tasks"},
+		func(c *http.Client) TaskService { return googleTasks{c} })
+	register("todoist", oauth2.Endpoint{
+		AuthURL:  "https://todoist.com/oauth/authorize",
+		TokenURL: "https://todoist.com/oauth/access_token",
+	}, []string{"data:read_write,data:delete"},
+		func(c *http.Client) TaskService { return todoistTasks{c} })
+}
+
+func syncHandlers() http.Handler {
+	rg := chi.NewRouter()
+	rg.Group(func(r chi.Router) {
+		r.Get("/", fetchSyncConnections)
+		r.Post("/{provider}", connectSync)
+		r.Put("/{id}", updateSyncConnection)
+		r.Delete("/{id}", deleteSyncConnection)
+		r.Post("/{id}/run", runSyncConnection)
+	})
+	return rg
+}
+
+func fetchSyncConnections(w http.ResponseWriter, r *http.Request) {
+	var conns []syncConnectionModel
+	if err := storage.FindAll(r.Context(), db.Collection(syncConnectionsCollection), bson.M{"userId": currentUser(r.Context())}, &conns,
+		options.Find().SetSort(storage.SortKeys("createAt"))); err != nil {
+		writeError(w, r, internalError("failed to fetch sync connections", err))
+		return
+	}
+	data := make([]syncConnection, 0, len(conns))
+	for _, c := range conns {
+		data = append(data, toSyncConnection(c))
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"data": data,
+	})
+}
+
+// connectSync starts connecting the caller to provider, answering with the
+// URL to send them to. The API takes bearer tokens, which a browser does
+// not carry through redirects, so the callback knows the user by state.
+func connectSync(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "provider")
+	p, ok := taskServices[name]
+	if !ok {
+		writeError(w, r, apiErr(http.StatusNotFound, "unknown sync provider"))
+		return
+	}
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	state := base64.RawURLEncoding.EncodeToString(b)
+	if err == nil {
+		_, err = db.Collection(syncStatesCollection).InsertOne(r.Context(), &syncStateModel{
+			State:       state,
+			UserID:      currentUser(r.Context()),
+			WorkspaceID: currentWorkspace(r.Context()),
+			Provider:    name,
+			ExpiresAt:   time.Now().Add(10 * time.Minute),
+		})
+	}
+	if err != nil {
+		writeError(w, r, internalError("error starting sync connection", err))
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"data": renderer.M{"url": p.config.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.ApprovalForce)},
+	})
+}
+
+// syncCallback completes a connection once the provider sends the user
+// back.
+func syncCallback(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "provider")
+	p, ok := taskServices[name]
+	if !ok {
+		writeError(w, r, apiErr(http.StatusNotFound, "unknown sync provider"))
+		return
+	}
+	var s syncStateModel
+	err := db.Collection(syncStatesCollection).FindOneAndDelete(r.Context(), bson.M{
+		"_id":       r.URL.Query().Get("state"),
+		"provider":  name,
+		"expiresAt": bson.M{"$gt": time.Now()},
+	}).Decode(&s)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, r, apiErr(http.StatusBadRequest, "invalid oauth state"))
+		return
+	}
+	var tok *oauth2.Token
+	if err == nil {
+		tok, err = p.config.Exchange(r.Context(), r.URL.Query().Get("code"))
+		if err != nil {
+			writeError(w, r, &apiError{
+				Status:  http.StatusUnauthorized,
+				Message: "oauth code exchange failed",
+				Err:     err,
+			})
+			return
+		}
+	}
+	c := syncConnectionModel{
+		ID:          newID(),
+		UserID:      s.UserID,
+		WorkspaceID: s.WorkspaceID,
+		Provider:    name,
+		Prefer:      syncPreferRemote,
+		NextSyncAt:  time.Now(),
+		CreateAt:    time.Now(),
+	}
+	if err == nil {
+		c.Token, err = sealToken(tok)
+	}
+	if err == nil {
+		_, err = db.Collection(syncConnectionsCollection).InsertOne(r.Context(), &c)
+	}
+	if err != nil {
+		writeError(w, r, internalError("error saving sync connection", err))
+		return
+	}
+	render(r).JSON(w, http.StatusCreated, renderer.M{
+		"message": translate(r.Context(), "connected to %s, the first sync runs shortly", name),
+		"data":    toSyncConnection(c),
+	})
+}
+
+func updateSyncConnection(w http.ResponseWriter, r *http.Request) {
+	c, ok := ownSyncConnection(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Prefer string `json:"prefer" validate:"oneof=local remote"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if err := updateOne(r.Context(), db.Collection(syncConnectionsCollection), bson.M{"_id": c.ID}, bson.M{"$set": bson.M{"prefer": req.Prefer}}); err != nil {
+		writeError(w, r, internalError("error updating sync connection", err))
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"message": translate(r.Context(), "sync connection updated successfully"),
+	})
+}
+
+// deleteSyncConnection stops syncing; todos and remote tasks both stay.
+func deleteSyncConnection(w http.ResponseWriter, r *http.Request) {
+	c, ok := ownSyncConnection(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	err := deleteOne(ctx, db.Collection(syncConnectionsCollection), bson.M{"_id": c.ID})
+	if err == nil {
+		_, err = db.Collection(syncMappingsCollection).DeleteMany(ctx, bson.M{"connectionId": c.ID})
+	}
+	if err != nil {
+		writeError(w, r, internalError("error deleting sync connection", err))
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"message": translate(r.Context(), "sync connection deleted successfully"),
+	})
+}
+
+// runSyncConnection syncs now rather than at the next interval.
+func runSyncConnection(w http.ResponseWriter, r *http.Request) {
+	c, ok := ownSyncConnection(w, r)
+	if !ok {
+		return
+	}
+	err := syncConnectionNow(r.Context(), c)
+	if err != nil {
+		writeError(w, r, &apiError{Status: http.StatusBadGateway, Message: "sync failed", Err: err})
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"message": translate(r.Context(), "synced successfully"),
+	})
+}
+
+// ownSyncConnection loads the caller's {id} connection, writing an error
+// response if there is none.
+func ownSyncConnection(w http.ResponseWriter, r *http.Request) (syncConnectionModel, bool) {
+	var c syncConnectionModel
+	id := strings.TrimSpace(chi.URLParam(r, "id"))
+	if !validID(id) {
+		writeError(w, r, apiErr(http.StatusBadRequest, "The id is invalid"))
+		return c, false
+	}
+	err := db.Collection(syncConnectionsCollection).FindOne(r.Context(), bson.M{
+		"_id":    toID(id),
+		"userId": currentUser(r.Context()),
+	}).Decode(&c)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, r, apiErr(http.StatusNotFound, "sync connection not found"))
+		return c, false
+	}
+	if err != nil {
+		writeError(w, r, internalError("failed to fetch sync connection", err))
+		return c, false
+	}
+	return c, true
+}
+
+// syncTasks syncs connections as they fall due until ctx is canceled.
+// Claiming a connection moves its next sync on, so every instance can run
+// this without two syncing one connection at once.
+func syncTasks(ctx context.Context) {
+	tick := time.NewTicker(time.Minute)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+		for {
+			var c syncConnectionModel
+			err := db.Collection(syncConnectionsCollection).FindOneAndUpdate(ctx,
+				bson.M{"nextSyncAt": bson.M{"$lte": time.Now()}},
+				bson.M{"$set": bson.M{"nextSyncAt": time.Now().Add(syncInterval)}}).Decode(&c)
+			if err == mongo.ErrNoDocuments {
+				break
+			}
+			if err != nil {
+				slog.Error("task sync", "err", err)
+				break
+			}
+			if err := syncConnectionNow(ctx, c); err != nil {
+				slog.Error("task sync", "connection", c.ID, "err", err)
+			}
+		}
+	}
+}
+
+// syncConnectionNow syncs c and records the outcome on it.
+func syncConnectionNow(ctx context.Context, c syncConnectionModel) error {
+	err := syncConnectionTasks(ctx, c)
+	set := bson.M{"lastSyncAt": time.Now(), "lastError": ""}
+	if err != nil {
+		set["lastError"] = err.Error()
+	}
+	if _, uerr := db.Collection(syncConnectionsCollection).UpdateOne(ctx, bson.M{"_id": c.ID}, bson.M{"$set": set}); uerr != nil && err == nil {
+		err = uerr
+	}
+	return err
+}
+
+func syncConnectionTasks(ctx context.Context, c syncConnectionModel) error {
+	provider, ok := taskServices[c.Provider]
+	if !ok {
+		return errors.New("sync provider " + c.Provider + " is not configured")
+	}
+	var u userModel
+	if err := db.Collection(usersCollection).FindOne(ctx, bson.M{"_id": c.UserID}).Decode(&u); err != nil {
+		return err
+	}
+	if u.Disabled {
+		return errors.New("account is disabled")
+	}
+	p := userPrincipal(u)
+	tok, err := unsealToken(c.Token)
+	if err != nil {
+		return err
+	}
+	ts := provider.config.TokenSource(ctx, tok)
+	svc := provider.open(oauth2.NewClient(ctx, ts))
+	// Refreshed tokens are kept whatever becomes of the sync.
+	defer func() {
+		fresh, err := ts.Token()
+		if err != nil || fresh.AccessToken == tok.AccessToken {
+			return
+		}
+		sealed, err := sealToken(fresh)
+		if err == nil {
+			_, err = db.Collection(syncConnectionsCollection).UpdateOne(ctx, bson.M{"_id": c.ID}, bson.M{"$set": bson.M{"token": sealed}})
+		}
+		if err != nil {
+			slog.Error("task sync: saving token", "connection", c.ID, "err", err)
+		}
+	}()
+
+	owned, _, err := findTodos(ctx, p, TodoFilter{}, 0, 0)
+	if err != nil {
+		return err
+	}
+	local := map[ID]todoModel{}
+	for _, tm := range owned {
+		// Only the user's own todos are synced, not those shared with them.
+		if tm.UserID == u.ID {
+			local[tm.ID] = tm
+		}
+	}
+	tasks, err := svc.List(ctx)
+	if err != nil {
+		return err
+	}
+	remote := map[string]remoteTask{}
+	for _, t := range tasks {
+		remote[t.ID] = t
+	}
+	var mappings []syncMappingModel
+	if err := storage.FindAll(ctx, db.Collection(syncMappingsCollection), bson.M{"connectionId": c.ID}, &mappings); err != nil {
+		return err
+	}
+
+	s := taskSync{c: c, p: p, svc: svc}
+	mappedTodos, mappedTasks := map[ID]bool{}, map[string]bool{}
+	for _, m := range mappings {
+		mappedTodos[m.TodoID], mappedTasks[m.RemoteID] = true, true
+		tm, lok := local[m.TodoID]
+		t, rok := remote[m.RemoteID]
+		if !rok {
+			if t, err = svc.Get(ctx, m.RemoteID); err == nil {
+				rok = true
+			} else if err != errRemoteNotFound {
+				return err
+			}
+		}
+		if err := s.reconcile(ctx, m, tm, lok, t, rok); err != nil {
+			return err
+		}
+	}
+	for _, tm := range owned {
+		if tm.UserID == u.ID && !tm.Completed && !mappedTodos[tm.ID] {
+			if err := s.push(ctx, tm); err != nil {
+				return err
+			}
+		}
+	}
+	for _, t := range tasks {
+		if !t.Completed && !mappedTasks[t.ID] {
+			if err := s.pull(ctx, t); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// taskSync carries what reconciling one connection needs.
+type taskSync struct {
+	c   syncConnectionModel
+	p   principal
+	svc TaskService
+}
+
+// reconcile brings a mapped todo and task back in step, following the
+// rules at the top of this file.
+func (s taskSync) reconcile(ctx context.Context, m syncMappingModel, tm todoModel, lok bool, t remoteTask, rok bool) error {
+	localChanged := lok && todoFingerprint(tm) != m.Fingerprint
+	remoteChanged := rok && taskFingerprint(t) != m.Fingerprint
+	switch {
+	case !lok && !rok:
+		return s.unmap(ctx, m)
+	case !lok && remoteChanged:
+		if err := s.unmap(ctx, m); err != nil {
+			return err
+		}
+		return s.pull(ctx, t)
+	case !lok:
+		if err := s.svc.Delete(ctx, t.ID); err != nil && err != errRemoteNotFound {
+			return err
+		}
+		return s.unmap(ctx, m)
+	case !rok && localChanged:
+		if err := s.unmap(ctx, m); err != nil {
+			return err
+		}
+		return s.push(ctx, tm)
+	case !rok:
+		if err := removeTodo(ctx, s.p, tm.ID); err != nil && err != mongo.ErrNoDocuments {
+			return err
+		}
+		return s.unmap(ctx, m)
+	}
+	if localChanged && remoteChanged {
+		localChanged = s.c.Prefer == syncPreferLocal
+		remoteChanged = !localChanged
+	}
+	switch {
+	case localChanged:
+		after := t
+		after.Title, after.Completed = tm.Title, tm.Completed
+		if err := s.svc.Update(ctx, t, after); err != nil {
+			return err
+		}
+		return s.remap(ctx, m, todoFingerprint(tm))
+	case remoteChanged:
+		updated, err := setTodo(ctx, s.p, tm.ID, t.Title, t.Completed)
+		if err != nil {
+			return err
+		}
+		return s.remap(ctx, m, todoFingerprint(updated))
+	}
+	return nil
+}
+
+// push creates a task for the todo.
+func (s taskSync) push(ctx context.Context, tm todoModel) error {
+	id, err := s.svc.Create(ctx, remoteTask{Title: tm.Title, Completed: tm.Completed, DueDate: tm.DueDate})
+	if err != nil {
+		return err
+	}
+	return s.mapTodo(ctx, tm.ID, id, todoFingerprint(tm))
+}
+
+// pull creates a todo for the task.
+func (s taskSync) pull(ctx context.Context, t remoteTask) error {
+	tm := todoModel{ID: newID(), Title: t.Title, DueDate: t.DueDate, CreateAt: time.Now()}
+	if err := insertTodo(ctx, s.p, &tm); err != nil {
+		return err
+	}
+	if t.Completed {
+		var err error
+		if tm, err = setTodo(ctx, s.p, tm.ID, tm.Title, true); err != nil {
+			return err
+		}
+	}
+	return s.mapTodo(ctx, tm.ID, t.ID, taskFingerprint(t))
+}
+
+func (s taskSync) mapTodo(ctx context.Context, todo ID, remote, fingerprint string) error {
+	_, err := db.Collection(syncMappingsCollection).InsertOne(ctx, &syncMappingModel{
+		ID:           newID(),
+		ConnectionID: s.c.ID,
+		TodoID:       todo,
+		RemoteID:     remote,
+		Fingerprint:  fingerprint,
+	})
+	return err
+}
+
+func (s taskSync) remap(ctx context.Context, m syncMappingModel, fingerprint string) error {
+	return updateOne(ctx, db.Collection(syncMappingsCollection), bson.M{"_id": m.ID}, bson.M{"$set": bson.M{"fingerprint": fingerprint}})
+}
+
+func (s taskSync) unmap(ctx context.Context, m syncMappingModel) error {
+	_, err := db.Collection(syncMappingsCollection).DeleteOne(ctx, bson.M{"_id": m.ID})
+	return err
+}
+
+func todoFingerprint(tm todoModel) string {
+	return fingerprint(tm.Title, tm.Completed)
+}
+
+func taskFingerprint(t remoteTask) string {
+	return fingerprint(t.Title, t.Completed)
+}
+
+func fingerprint(title string, completed bool) string {
+	if completed {
+		return hashAPIToken("x:" + title)
+	}
+	return hashAPIToken(" :" + title)
+}
+
+func sealToken(tok *oauth2.Token) (string, error) {
+	b, err := json.Marshal(tok)
+	if err != nil {
+		return "", err
+	}
+	return seal(string(b))
+}
+
+func unsealToken(s string) (*oauth2.Token, error) {
+	b, err := unseal(s)
+	if err != nil {
+		return nil, err
+	}
+	var tok oauth2.Token
+	err = json.Unmarshal([]byte(b), &tok)
+	return &tok, err
+}
+
+func toSyncConnection(c syncConnectionModel) syncConnection {
+	s := syncConnection{
+		ID:        c.ID.String(),
+		Provider:  c.Provider,
+		Prefer:    c.Prefer,
+		LastError: c.LastError,
+		CreateAt:  c.CreateAt.Format(time.RFC3339),
+	}
+	if !c.LastSyncAt.IsZero() {
+		s.LastSyncAt = c.LastSyncAt.Format(time.RFC3339)
+	}
+	return s
+}
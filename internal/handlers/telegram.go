@@ -0,0 +1,210 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// telegramConf configures the Telegram bot, which is on when
+// TODO_TELEGRAM_TOKEN holds the token BotFather gave. The bot long-polls
+// Telegram for messages, which works from behind NAT but from one instance
+// only. With TODO_TELEGRAM_WEBHOOK_SECRET set Telegram instead posts them to
+// TODO_PUBLIC_URL/telegram/webhook, proving itself with the secret, which
+// suits deployments with several instances.
+var telegramConf = struct {
+	Token, WebhookSecret string
+}{
+	Token:         envString("TODO_TELEGRAM_TOKEN", ""),
+	WebhookSecret: envString("TODO_TELEGRAM_WEBHOOK_SECRET", ""),
+}
+
+const (
+	telegramProvider = "telegram"
+	// telegramPollTimeout is how long a getUpdates call waits for messages.
+	telegramPollTimeout = 50 * time.Second
+)
+
+var telegramClient = &http.Client{Timeout: telegramPollTimeout + 10*time.Second}
+
+type (
+	telegramUpdate struct {
+		UpdateID int64            `json:"update_id"`
+		Message  *telegramMessage `json:"message"`
+	}
+	telegramMessage struct {
+		Chat struct {
+			ID   int64  `json:"id"`
+			Type string `json:"type"`
+		} `json:"chat"`
+		Text string `json:"text"`
+	}
+)
+
+// startTelegram registers the webhook, or starts polling for updates
+// handled by the Server ctx belongs to.
+func startTelegram(ctx context.Context) {
+	if telegramConf.WebhookSecret != "" {
+		err := telegramCall(ctx, "setWebhook", map[string]interface{}{
+			"url":             serverFrom(ctx).publicURL + "/telegram/webhook",
+			"secret_token":    telegramConf.WebhookSecret,
+			"allowed_updates": []string{"message"},
+		}, nil)
+		if err != nil {
+			slog.Error("telegram: setting webhook", "err", err)
+		}
+		return
+	}
+	// getUpdates fails while a webhook is set.
+	if err := telegramCall(ctx, "deleteWebhook", map[string]interface{}{}, nil); err != nil {
+		slog.Error("telegram: deleting webhook", "err", err)
+	}
+	go pollTelegram(ctx)
+}
+
+// pollTelegram long-polls for messages until ctx is canceled. Telegram
+// lets one poller at a time have the updates; others get errors, which
+// are logged.
+func pollTelegram(ctx context.Context) {
+	var offset int64
+	for ctx.Err() == nil {
+		var updates []telegramUpdate
+		err := telegramCall(ctx, "getUpdates", map[string]interface{}{
+			"offset":          offset,
+			"timeout":         int(telegramPollTimeout.Seconds()),
+			"allowed_updates": []string{"message"},
+		}, &updates)
+		if err != nil {
+			slog.Error("telegram: polling", "err", err)
+			time.Sleep(10 * time.Second)
+			continue
+		}
+		for _, u := range updates {
+			offset = u.UpdateID + 1
+			handleTelegramUpdate(ctx, u)
+		}
+	}
+}
+
+func telegramWebhook(w http.ResponseWriter, r *http.Request) {
+	secret := r.Header.Get("X-Telegram-Bot-Api-Secret-Token")
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(telegramConf.WebhookSecret)) != 1 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var u telegramUpdate
+	// Updates carry far more fields than are read here, so unknown ones
+	// are let through.
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes)).Decode(&u); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	// Telegram redelivers an update until it is acknowledged, so failures
+	// are answered with a message to the user rather than an error here.
+	handleTelegramUpdate(r.Context(), u)
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleTelegramUpdate runs the command in a message to the bot:
+//
+//	/start <code>, /link <code>   link this chat to an account
+//	/add <title>                  add a todo
+//	/today                        show todos due today or overdue
+//	/list                         show open todos
+//	/done <ref>                   complete a todo
+//
+// Only private chats are served; the chat ID is what is linked.
+func handleTelegramUpdate(ctx context.Context, u telegramUpdate) {
+	m := u.Message
+	if m == nil || m.Chat.Type != "private" || !strings.HasPrefix(m.Text, "/") {
+		return
+	}
+	cmd, arg, _ := strings.Cut(strings.TrimSpace(m.Text), " ")
+	// Commands may name the bot, as /add@todo_bot.
+	cmd, _, _ = strings.Cut(cmd, "@")
+	arg = strings.TrimSpace(arg)
+	id := identity{Provider: telegramProvider, Subject: strconv.FormatInt(m.Chat.ID, 10)}
+
+	var res chatReply
+	if (cmd == "/start" || cmd == "/link") && arg != "" {
+		res = chatLink(ctx, id, arg)
+	} else if user, p, err := chatUser(ctx, id); err == errChatNotLinked {
+		res = chatReply{Text: "Link your account first: POST " + serverFrom(ctx).publicURL +
+			"/account/telegram/link, then send /link <code>."}
+	} else if err != nil {
+		res = chatReply{Text: "Something went wrong: " + err.Error()}
+	} else {
+		switch cmd {
+		case "/add":
+			res = chatAdd(ctx, p, "", arg, "/add")
+		case "/today":
+			// Due dates are days in the server's zone; compare them with
+			// the day it is for the user, as digests do.
+			date := time.Now().In(user.location()).Format("2006-01-02")
+			today, _ := time.ParseInLocation("2006-01-02", date, time.Local)
+			res = chatList(ctx, p, TodoFilter{DueBefore: today.AddDate(0, 0, 1)})
+		case "/list":
+			res = chatList(ctx, p, TodoFilter{})
+		case "/done":
+			res = chatDone(ctx, p, arg, "/done")
+		default:
+			res = chatReply{Text: "Commands: /add <title>, /today, /list, /done <ref> and /link <code>."}
+		}
+	}
+	err := telegramCall(ctx, "sendMessage", map[string]interface{}{
+		"chat_id": m.Chat.ID,
+		"text":    res.Text,
+	}, nil)
+	if err != nil {
+		slog.Error("telegram: replying", "chat", m.Chat.ID, "err", err)
+	}
+}
+
+// telegramCall calls a Bot API method, decoding its result into result
+// unless that is nil.
+func telegramCall(ctx context.Context, method string, params interface{}, result interface{}) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		"https://api.telegram.org/bot"+telegramConf.Token+"/"+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := telegramClient.Do(req)
+	if err != nil {
+		// The error quotes the URL, which holds the token.
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return fmt.Errorf("%s: %w", method, err)
+	}
+	defer resp.Body.Close()
+	var res struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return fmt.Errorf("%s: %w", method, err)
+	}
+	if !res.OK {
+		return fmt.Errorf("%s: %s", method, res.Description)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(res.Result, result)
+}
@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/russross/blackfriday/v2"
+)
+
+// localeFuncs are the helpers every page can use, answering in the
+// language and time zone of ctx's request:
+//
+//	{{ t "Sign in" }}               the message translated
+//	{{ lang }}                      the language, as en or de
+//	{{ relDate .DueDate }}          today, tomorrow, in 3 days, 2 weeks ago
+//	{{ markdown .Title }}           the text rendered as Markdown
+//	{{ plural (len .Todos) "todo" }} 1 todo, 2 todos; irregular words
+//	                                take the plural too: "entry" "entries"
+//
+// Counted words are translated as "%d todo" and "%d todos".
+func localeFuncs(ctx context.Context) template.FuncMap {
+	lang := requestLang(ctx)
+	return template.FuncMap{
+		"t": func(msg string, args ...any) string {
+			return translateTo(lang, msg, args...)
+		},
+		"lang": lang.String,
+		"relDate": func(v any) string {
+			return relDate(ctx, v)
+		},
+		"markdown": markdown,
+		"plural": func(n int, word string, forms ...string) string {
+			return plural(ctx, n, word, forms...)
+		},
+	}
+}
+
+// templateFuncs are the helpers templates are parsed with, standing in
+// for those renderTemplate binds to each request.
+var templateFuncs = localeFuncs(context.Background())
+
+// parsedTemplates holds each set of template files once parsed, keyed by
+// the files' names. In dev mode the files are checked on every use and
+// parsed again when they have changed.
+var parsedTemplates = struct {
+	sync.Mutex
+	sets map[string]templateSet
+}{sets: map[string]templateSet{}}
+
+type templateSet struct {
+	t     *template.Template
+	stamp string
+}
+
+// loadTemplates returns the named template files under templates/ in
+// the assets, parsed together with templateFuncs.
+func loadTemplates(files []string) (*template.Template, error) {
+	key := strings.Join(files, ",")
+	parsedTemplates.Lock()
+	defer parsedTemplates.Unlock()
+	set, ok := parsedTemplates.sets[key]
+	if ok && !devMode {
+		return set.t, nil
+	}
+	paths := make([]string, len(files))
+	for i, file := range files {
+		paths[i] = "templates/" + file
+	}
+	stamp := templateStamp(paths)
+	if ok && stamp == set.stamp {
+		return set.t, nil
+	}
+	t, err := template.New(path.Base(paths[0])).Funcs(templateFuncs).ParseFS(assets(), paths...)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		slog.Info("templates: reloaded", "files", key)
+	}
+	parsedTemplates.sets[key] = templateSet{t, stamp}
+	return t, nil
+}
+
+// templateStamp identifies the template files' current content well
+// enough to notice edits, the way configFileStamp does.
+func templateStamp(paths []string) string {
+	var b strings.Builder
+	for _, p := range paths {
+		if fi, err := fs.Stat(assets(), p); err == nil {
+			fmt.Fprint(&b, fi.ModTime().UnixNano(), fi.Size(), ";")
+		}
+	}
+	return b.String()
+}
+
+// relDate describes a day relative to today in the time zone of ctx's
+// caller: a time.Time, or a string holding a date (2006-01-02) or an
+// RFC 3339 time. Anything else is returned as it is.
+func relDate(ctx context.Context, v any) string {
+	loc := requestZone(ctx)
+	var t time.Time
+	switch v := v.(type) {
+	case time.Time:
+		t = v
+	case string:
+		var err error
+		if t, err = time.ParseInLocation(time.DateOnly, v, loc); err != nil {
+			if t, err = time.Parse(time.RFC3339, v); err != nil {
+				return v
+			}
+		}
+	default:
+		return fmt.Sprint(v)
+	}
+	if t.IsZero() {
+		return ""
+	}
+	y, m, d := time.Now().In(loc).Date()
+	today := time.Date(y, m, d, 0, 0, 0, 0, loc)
+	y, m, d = t.In(loc).Date()
+	days := int(math.Round(time.Date(y, m, d, 0, 0, 0, 0, loc).Sub(today).Hours() / 24))
+	switch days {
+	case 0:
+		return translate(ctx, "today")
+	case 1:
+		return translate(ctx, "tomorrow")
+	case -1:
+		return translate(ctx, "yesterday")
+	}
+	n := days
+	if n < 0 {
+		n = -n
+	}
+	var s string
+	switch {
+	case n < 14:
+		s = plural(ctx, n, "day")
+	case n < 60:
+		s = plural(ctx, n/7, "week")
+	case n < 365:
+		s = plural(ctx, n/30, "month")
+	default:
+		s = plural(ctx, n/365, "year")
+	}
+	if days < 0 {
+		return translate(ctx, "%s ago", s)
+	}
+	return translate(ctx, "in %s", s)
+}
+
+// plural counts n of word, taking the plural form from forms if given,
+// or adding an s.
+func plural(ctx context.Context, n int, word string, forms ...string) string {
+	if n != 1 {
+		if len(forms) > 0 {
+			word = forms[0]
+		} else {
+			word += "s"
+		}
+	}
+	return translate(ctx, "%d "+word, n)
+}
+
+// markdownFlags keep rendered Markdown from carrying anything the page
+// would not: links must be to http, https, ftp or mailto and open in a
+// new tab, and images, which the Content-Security-Policy would block
+// anyway, are left out.
+const markdownFlags = blackfriday.CommonHTMLFlags | blackfriday.SkipImages | blackfriday.Safelink |
+	blackfriday.NofollowLinks | blackfriday.NoreferrerLinks | blackfriday.HrefTargetBlank |
+	blackfriday.NoopenerLinks
+
+// markdown renders s as Markdown.
+func markdown(s string) template.HTML {
+	r := markdownRenderer{blackfriday.NewHTMLRenderer(blackfriday.HTMLRendererParameters{Flags: markdownFlags})}
+	return template.HTML(blackfriday.Run([]byte(s), blackfriday.WithRenderer(r)))
+}
+
+// markdownRenderer shows raw HTML as the text it is rather than passing
+// it through, so a title like "Buy <milk>" reads as written and cannot
+// inject markup.
+type markdownRenderer struct {
+	*blackfriday.HTMLRenderer
+}
+
+func (r markdownRenderer) RenderNode(w io.Writer, node *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+	if node.Type == blackfriday.HTMLSpan || node.Type == blackfriday.HTMLBlock {
+		template.HTMLEscape(w, node.Literal)
+		return blackfriday.GoToNext
+	}
+	return r.HTMLRenderer.RenderNode(w, node, entering)
+}
@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Lockouts start once an account or IP reaches its failure limit, the
+// LoginFailureLimit or LoginIPFailureLimit live setting.
+const (
+	baseLockout = 30 * time.Second
+	maxLockout  = time.Hour
+	// failureMemory is how long a key stays tracked after its last failure.
+	failureMemory = 24 * time.Hour
+	// maxFailureKeys is how many keys are tracked before the throttle
+	// sweeps out those it no longer needs.
+	maxFailureKeys = 10000
+)
+
+// loginThrottle counts failed sign-ins and locks keys out for exponentially
+// longer periods once they exceed their limit. It lives in memory, so each
+// process throttles independently.
+type loginThrottle struct {
+	mu       sync.Mutex
+	failures map[string]*failureRecord
+}
+
+type failureRecord struct {
+	count       int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+func newLoginThrottle() *loginThrottle {
+	return &loginThrottle{failures: map[string]*failureRecord{}}
+}
+
+// lockedFor reports how much longer key is locked out.
+func (t *loginThrottle) lockedFor(key string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f, ok := t.failures[key]
+	if !ok {
+		return 0
+	}
+	if time.Since(f.lastFailure) > failureMemory {
+		delete(t.failures, key)
+		return 0
+	}
+	return time.Until(f.lockedUntil)
+}
+
+// fail records a failure for key and returns the lockout it triggered, if
+// any: baseLockout once limit is reached, doubling with each further failure.
+func (t *loginThrottle) fail(key string, limit int) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	f, ok := t.failures[key]
+	if !ok {
+		if len(t.failures) >= maxFailureKeys {
+			t.sweep(now)
+		}
+		f = &failureRecord{}
+		t.failures[key] = f
+	}
+	f.count++
+	f.lastFailure = now
+	if f.count < limit {
+		return 0
+	}
+	lockout := time.Duration(float64(baseLockout) * math.Pow(2, float64(f.count-limit)))
+	if lockout > maxLockout || lockout <= 0 {
+		lockout = maxLockout
+	}
+	f.lockedUntil = now.Add(lockout)
+	return lockout
+}
+
+// sweep drops keys whose failures have been forgotten so the map does not
+// grow without bound, as sign-ins with ever new emails would make it. If
+// that is not enough, keys not locked out go too, losing their count.
+func (t *loginThrottle) sweep(now time.Time) {
+	for k, f := range t.failures {
+		if now.Sub(f.lastFailure) > failureMemory {
+			delete(t.failures, k)
+		}
+	}
+	if len(t.failures) < maxFailureKeys {
+		return
+	}
+	for k, f := range t.failures {
+		if !f.lockedUntil.After(now) {
+			delete(t.failures, k)
+		}
+	}
+}
+
+func (t *loginThrottle) reset(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.failures, key)
+}
+
+// loginKeys are the throttle keys for a sign-in attempt.
+func loginKeys(r *http.Request, email string) (ip, account string) {
+	return "ip:" + clientIP(r.RemoteAddr),
+		"account:" + currentWorkspace(r.Context()).String() + "/" + strings.ToLower(strings.TrimSpace(email))
+}
+
+// checkLoginLockout answers 429 if either the account or the client is
+// locked out.
+func checkLoginLockout(w http.ResponseWriter, r *http.Request, email string) bool {
+	wait := loginLockedFor(r, email)
+	if wait <= 0 {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeError(w, r, &apiError{
+		Status:  http.StatusTooManyRequests,
+		Code:    "login_locked",
+		Message: "too many failed attempts, try again later",
+	})
+	return false
+}
+
+// loginLockedFor returns how long sign-ins to email from r's IP remain
+// locked out, if they are.
+func loginLockedFor(r *http.Request, email string) time.Duration {
+	ip, account := loginKeys(r, email)
+	logins := serverFrom(r.Context()).logins
+	wait := logins.lockedFor(ip)
+	if d := logins.lockedFor(account); d > wait {
+		wait = d
+	}
+	if wait > 0 {
+		securityEvent(r, "login.blocked", email, "")
+	}
+	return wait
+}
+
+func loginFailed(r *http.Request, email, reason string) {
+	ip, account := loginKeys(r, email)
+	securityEvent(r, "login.failed", email, reason)
+	logins := serverFrom(r.Context()).logins
+	if d := logins.fail(account, liveConf().LoginFailureLimit); d > 0 {
+		securityEvent(r, "login.locked", email, "account locked for "+d.String())
+	}
+	if d := logins.fail(ip, liveConf().LoginIPFailureLimit); d > 0 {
+		securityEvent(r, "login.locked", email, "ip locked for "+d.String())
+	}
+}
+
+func loginSucceeded(r *http.Request, u userModel) {
+	_, account := loginKeys(r, u.Email)
+	serverFrom(r.Context()).logins.reset(account)
+	securityEvent(r, "login.succeeded", u.Email, u.ID.String())
+}
+
+// securityEvent logs an authentication event.
+func securityEvent(r *http.Request, event, email, detail string) {
+	ws := currentWorkspace(r.Context())
+	slog.InfoContext(r.Context(), "security", "event", event, "workspace", ws.String(), "email", email,
+		"ip", clientIP(r.RemoteAddr), "detail", detail)
+}
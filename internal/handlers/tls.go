@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// The server speaks HTTPS itself when given a certificate and key,
+// TODO_TLS_CERT and TODO_TLS_KEY (PEM files, the certificate followed by
+// any intermediates). TODO_HTTP_REDIRECT_ADDR, e.g. ":80", additionally
+// serves plain HTTP there that only redirects to HTTPS.
+//
+// Alternatively TODO_ACME_DOMAINS, a comma-separated list of host names,
+// has certificates for them issued and renewed by Let's Encrypt, or the
+// ACME directory at TODO_ACME_DIRECTORY. Let's Encrypt contacts
+// TODO_ACME_EMAIL about expiring certificates. Certificates are kept in
+// TODO_ACME_CACHE_DIR ("acme"), which instances sharing the domains should
+// share too. Challenges are answered on the redirect listener, which
+// defaults to :80 for ACME since that is where they arrive, and on the
+// HTTPS listener.
+
+func tlsEnabled() bool {
+	return serverConf.TLSCert != "" || serverConf.ACMEDomains != ""
+}
+
+func acmeDomains() []string {
+	var domains []string
+	for _, d := range strings.Split(serverConf.ACMEDomains, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			domains = append(domains, strings.ToLower(d))
+		}
+	}
+	return domains
+}
+
+// certManager gets and renews the ACME certificates, nil unless
+// TODO_ACME_DOMAINS is set.
+var certManager = sync.OnceValue(func() *autocert.Manager {
+	domains := acmeDomains()
+	if len(domains) == 0 {
+		return nil
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(serverConf.ACMECacheDir),
+		Email:      serverConf.ACMEEmail,
+	}
+	if serverConf.ACMEDirectory != "" {
+		m.Client = &acme.Client{DirectoryURL: serverConf.ACMEDirectory}
+	}
+	return m
+})
+
+// newTLSConfig allows TLS 1.2 and later with forward-secret AEAD ciphers
+// only. TLS 1.3 suites are not configurable and all qualify.
+func newTLSConfig() *tls.Config {
+	c := &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		},
+	}
+	if m := certManager(); m != nil {
+		c.GetCertificate = m.GetCertificate
+		// Listed in order of preference, ahead of the ACME challenge
+		// protocol, which clients only offer when asking for it.
+		c.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+	}
+	return c
+}
+
+// serverProtocols enables HTTP/2 alongside HTTP/1.1, negotiated over TLS.
+// TODO_H2C=true also accepts HTTP/2 on a plain listener, for proxies that
+// forward cleartext HTTP/2 with prior knowledge, such as Envoy in front of
+// gRPC-web clients; that listener should then be reachable from the proxy
+// only. A client may have TODO_HTTP2_MAX_STREAMS (250) requests in flight
+// on one connection, each with its own write timeout.
+func serverProtocols() (*http.Protocols, *http.HTTP2Config) {
+	var p http.Protocols
+	p.SetHTTP1(true)
+	p.SetHTTP2(true)
+	p.SetUnencryptedHTTP2(serverConf.H2C)
+	return &p, &http.HTTP2Config{MaxConcurrentStreams: serverConf.HTTP2MaxStreams}
+}
+
+// serveRedirects runs the HTTP to HTTPS redirect listener, returning it
+// for shutdown, or nil if there is none.
+func serveRedirects() *http.Server {
+	addr, handler := serverConf.RedirectAddr, http.Handler(http.HandlerFunc(redirectHTTPS))
+	if m := certManager(); m != nil {
+		if addr == "" {
+			addr = ":80"
+		}
+		handler = m.HTTPHandler(handler)
+	}
+	if addr == "" {
+		return nil
+	}
+	srv := &http.Server{
+		Addr:         addr,
+		Handler:      handler,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 5 * time.Second,
+		IdleTimeout:  serverConf.IdleTimeout,
+		ErrorLog:     slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
+	}
+	lis, err := listen(addr, "redirect")
+	if err != nil {
+		slog.Error("redirect listen", "err", err)
+		return nil
+	}
+	go func() {
+		slog.Info("redirecting HTTP to HTTPS", "addr", lis.Addr().String())
+		if err := srv.Serve(lis); err != nil && err != http.ErrServerClosed {
+			slog.Error("redirect serve", "err", err)
+		}
+	}()
+	return srv
+}
+
+// redirectHTTPS sends the request to the same host and path over HTTPS.
+// The redirect is permanent and keeps the method and body, so API clients
+// posting to the plain address are not turned into GETs.
+func redirectHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if _, port, err := net.SplitHostPort(serverConf.Addr); err == nil && isTCPAddr(serverConf.Addr) && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+}
@@ -0,0 +1,217 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/sangin4208/go-todo/internal/storage"
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	tokensCollection string = "api_tokens"
+	apiTokenPrefix          = "todo_"
+)
+
+type (
+	apiTokenModel struct {
+		ID         ID        `bson:"_id,omitempty"`
+		UserID     ID        `bson:"userId"`
+		Name       string    `bson:"name"`
+		Hash       string    `bson:"hash"`
+		Hint       string    `bson:"hint"`
+		CreateAt   time.Time `bson:"createAt"`
+		LastUsedAt time.Time `bson:"lastUsedAt,omitempty"`
+		// Optional restrictions; the zero values grant the owner's full access.
+		ReadOnly  bool      `bson:"readOnly,omitempty"`
+		ListID    ID        `bson:"listId,omitempty"`
+		ExpiresAt time.Time `bson:"expiresAt,omitempty"`
+	}
+	apiToken struct {
+		ID         string `json:"id"`
+		Name       string `json:"name"`
+		Hint       string `json:"hint"`
+		CreateAt   string `json:"createAt"`
+		LastUsedAt string `json:"lastUsedAt,omitempty"`
+		ReadOnly   bool   `json:"readOnly,omitempty"`
+		ListID     string `json:"listId,omitempty"`
+		ExpiresAt  string `json:"expiresAt,omitempty"`
+	}
+)
+
+func tokenHandlers() http.Handler {
+	rg := chi.NewRouter()
+	rg.Group(func(r chi.Router) {
+		r.Use(requireAuth)
+		r.Get("/", fetchAPITokens)
+		r.With(requireSecondFactor).Post("/", createAPIToken)
+		r.Delete("/{id}", deleteAPIToken)
+	})
+	return rg
+}
+
+func fetchAPITokens(w http.ResponseWriter, r *http.Request) {
+	var tokens []apiTokenModel
+	if err := storage.FindAll(r.Context(), db.Collection(tokensCollection), bson.M{"userId": currentUser(r.Context())}, &tokens, options.Find().SetSort(storage.SortKeys("-createAt"))); err != nil {
+		writeError(w, r, internalError("error fetching tokens", err))
+		return
+	}
+	list := []apiToken{}
+	for _, t := range tokens {
+		at := apiToken{
+			ID:       t.ID.String(),
+			Name:     t.Name,
+			Hint:     t.Hint,
+			CreateAt: formatTime(r.Context(), t.CreateAt),
+			ReadOnly: t.ReadOnly,
+			ListID:   t.ListID.String(),
+		}
+		if !t.LastUsedAt.IsZero() {
+			at.LastUsedAt = formatTime(r.Context(), t.LastUsedAt)
+		}
+		if !t.ExpiresAt.IsZero() {
+			at.ExpiresAt = formatTime(r.Context(), t.ExpiresAt)
+		}
+		list = append(list, at)
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"data": list,
+	})
+}
+
+// createAPIToken mints a key, optionally restricted to reading, to a
+// single list and/or until an expiry time.
+func createAPIToken(w http.ResponseWriter, r *http.Request) {
+	p := currentPrincipal(r.Context())
+	if p.ReadOnly || !p.ListID.IsZero() {
+		writeError(w, r, apiErr(http.StatusForbidden, "scoped tokens cannot create tokens"))
+		return
+	}
+	var req struct {
+		Name      string `json:"name" validate:"notblank,max=100"`
+		ReadOnly  bool   `json:"readOnly"`
+		ListID    string `json:"listId" validate:"omitempty,id"`
+		ExpiresAt string `json:"expiresAt" validate:"omitempty,future"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	var expires time.Time
+	if req.ExpiresAt != "" {
+		expires, _ = time.Parse(time.RFC3339, req.ExpiresAt)
+	}
+	var listID ID
+	if req.ListID != "" {
+		if !validID(req.ListID) {
+			writeError(w, r, apiErr(http.StatusBadRequest, "The list id is invalid"))
+			return
+		}
+		listID = toID(req.ListID)
+		lists, err := accessibleLists(r.Context(), p, !req.ReadOnly)
+		if err != nil {
+			writeError(w, r, internalError("error creating token", err))
+			return
+		}
+		if !containsID(lists, listID) {
+			writeError(w, r, apiErr(http.StatusNotFound, "list not found"))
+			return
+		}
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		writeError(w, r, internalError("error creating token", err))
+		return
+	}
+	plain := apiTokenPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	t := apiTokenModel{
+		ID:        newID(),
+		UserID:    currentUser(r.Context()),
+		Name:      req.Name,
+		Hash:      hashAPIToken(plain),
+		Hint:      plain[len(plain)-4:],
+		CreateAt:  time.Now(),
+		ReadOnly:  req.ReadOnly,
+		ListID:    listID,
+		ExpiresAt: expires,
+	}
+	if _, err := db.Collection(tokensCollection).InsertOne(r.Context(), &t); err != nil {
+		writeError(w, r, internalError("error creating token", err))
+		return
+	}
+	// The plaintext token is only ever returned here.
+	render(r).JSON(w, http.StatusCreated, renderer.M{
+		"message":  translate(r.Context(), "token created successfully"),
+		"token_id": t.ID.String(),
+		"token":    plain,
+	})
+}
+
+func deleteAPIToken(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSpace(chi.URLParam(r, "id"))
+	if !validID(id) {
+		writeError(w, r, apiErr(http.StatusBadRequest, "The id is invalid"))
+		return
+	}
+	err := deleteOne(r.Context(), db.Collection(tokensCollection), bson.M{
+		"_id":    toID(id),
+		"userId": currentUser(r.Context()),
+	})
+	if err == mongo.ErrNoDocuments {
+		writeError(w, r, apiErr(http.StatusNotFound, "token not found"))
+		return
+	}
+	if err != nil {
+		writeError(w, r, internalError("error deleting token", err))
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"message": translate(r.Context(), "token deleted successfully"),
+	})
+}
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// lookupAPIToken resolves an unexpired API key to its owner, carrying over
+// the key's restrictions, and records its use.
+func lookupAPIToken(ctx context.Context, token string) (principal, error) {
+	var t apiTokenModel
+	if err := db.Collection(tokensCollection).FindOneAndUpdate(ctx, bson.M{
+		"hash": hashAPIToken(token),
+		"$or": []bson.M{
+			{"expiresAt": bson.M{"$exists": false}},
+			{"expiresAt": bson.M{"$gt": time.Now()}},
+		},
+	}, bson.M{"$set": bson.M{"lastUsedAt": time.Now()}}).Decode(&t); err != nil {
+		return principal{}, err
+	}
+	// API keys act with the owner's current role.
+	var u userModel
+	if err := db.Collection(usersCollection).FindOne(ctx, bson.M{"_id": t.UserID}, options.FindOne().SetProjection(bson.M{"role": 1, "workspaceId": 1, "unverified": 1, "disabled": 1})).Decode(&u); err != nil {
+		return principal{}, err
+	}
+	if u.Disabled {
+		return principal{}, errAccountDisabled
+	}
+	return principal{
+		UserID:      t.UserID,
+		WorkspaceID: u.WorkspaceID,
+		Role:        u.Role,
+		Unverified:  u.Unverified,
+		ReadOnly:    t.ReadOnly,
+		ListID:      t.ListID,
+	}, nil
+}
@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"github.com/pquerna/otp/totp"
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+const (
+	totpIssuer        = "todo-go"
+	totpHeader        = "X-OTP"
+	recoveryCodeCount = 10
+)
+
+func totpHandlers() http.Handler {
+	rg := chi.NewRouter()
+	rg.Group(func(r chi.Router) {
+		r.Use(requireAuth)
+		r.Post("/enroll", enrollTOTP)
+		r.Post("/verify", verifyTOTP)
+		r.Group(func(r chi.Router) {
+			r.Use(requireSecondFactor)
+			r.Delete("/", disableTOTP)
+			r.Post("/recovery-codes", regenerateRecoveryCodes)
+		})
+	})
+	return rg
+}
+
+// enrollTOTP generates a pending secret. It only takes effect once a code
+// generated from it is confirmed through verifyTOTP.
+func enrollTOTP(w http.ResponseWriter, r *http.Request) {
+	u, ok := loadCurrentUser(w, r)
+	if !ok {
+		return
+	}
+	if u.TOTPEnabled {
+		writeError(w, r, apiErr(http.StatusConflict, "two-factor authentication is already enabled"))
+		return
+	}
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: totpIssuer, AccountName: u.Email})
+	if err == nil {
+		err = updateOne(r.Context(), db.Collection(usersCollection), bson.M{"_id": u.ID}, bson.M{"$set": bson.M{"totpPendingSecret": key.Secret()}})
+	}
+	if err != nil {
+		writeError(w, r, internalError("error enrolling authenticator", err))
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"secret":          key.Secret(),
+		"provisioningUri": key.URL(),
+	})
+}
+
+func verifyTOTP(w http.ResponseWriter, r *http.Request) {
+	u, ok := loadCurrentUser(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Code string `json:"code"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if u.TOTPPending == "" || !totp.Validate(strings.TrimSpace(req.Code), u.TOTPPending) {
+		writeError(w, r, apiErr(http.StatusUnprocessableEntity, "invalid verification code"))
+		return
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err == nil {
+		err = updateOne(r.Context(), db.Collection(usersCollection), bson.M{"_id": u.ID}, bson.M{
+			"$set": bson.M{
+				"totpSecret":    u.TOTPPending,
+				"totpEnabled":   true,
+				"recoveryCodes": hashes,
+			},
+			"$unset": bson.M{"totpPendingSecret": ""},
+		})
+	}
+	if err != nil {
+		writeError(w, r, internalError("error enabling two-factor authentication", err))
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"message":       translate(r.Context(), "two-factor authentication enabled"),
+		"recoveryCodes": codes,
+	})
+}
+
+func disableTOTP(w http.ResponseWriter, r *http.Request) {
+	if err := updateOne(r.Context(), db.Collection(usersCollection), bson.M{"_id": currentUser(r.Context())}, bson.M{
+		"$unset": bson.M{
+			"totpSecret":        "",
+			"totpPendingSecret": "",
+			"totpEnabled":       "",
+			"recoveryCodes":     "",
+		},
+	}); err != nil {
+		writeError(w, r, internalError("error disabling two-factor authentication", err))
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"message": translate(r.Context(), "two-factor authentication disabled"),
+	})
+}
+
+func regenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	codes, hashes, err := newRecoveryCodes()
+	if err == nil {
+		err = updateOne(r.Context(), db.Collection(usersCollection), bson.M{"_id": currentUser(r.Context())}, bson.M{
+			"$set": bson.M{"recoveryCodes": hashes},
+		})
+	}
+	if err != nil {
+		writeError(w, r, internalError("error generating recovery codes", err))
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"recoveryCodes": codes,
+	})
+}
+
+// requireSecondFactor gates sensitive actions: callers with two-factor
+// authentication enabled must send a current code in the X-OTP header.
+func requireSecondFactor(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, ok := loadCurrentUser(w, r)
+		if !ok {
+			return
+		}
+		if u.TOTPEnabled {
+			valid, err := checkSecondFactor(r.Context(), u, r.Header.Get(totpHeader))
+			if err != nil {
+				writeError(w, r, internalError("error checking second factor", err))
+				return
+			}
+			if !valid {
+				writeError(w, r, &apiError{
+					Status:  http.StatusForbidden,
+					Code:    "totp_required",
+					Message: "a valid two-factor code is required",
+				})
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkSecondFactor accepts either a current TOTP code or one of the user's
+// recovery codes, which is consumed.
+func checkSecondFactor(ctx context.Context, u userModel, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return false, nil
+	}
+	if totp.Validate(code, u.TOTPSecret) {
+		return true, nil
+	}
+	hash := hashAPIToken(strings.ToLower(code))
+	for _, h := range u.RecoveryCodes {
+		if h == hash {
+			err := updateOne(ctx, db.Collection(usersCollection), bson.M{"_id": u.ID}, bson.M{"$pull": bson.M{"recoveryCodes": hash}})
+			return err == nil, err
+		}
+	}
+	return false, nil
+}
+
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		codes[i] = fmt.Sprintf("%x-%x", b[:2], b[2:])
+		hashes[i] = hashAPIToken(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+func loadCurrentUser(w http.ResponseWriter, r *http.Request) (userModel, bool) {
+	var u userModel
+	if err := db.Collection(usersCollection).FindOne(r.Context(), bson.M{"_id": currentUser(r.Context())}).Decode(&u); err != nil {
+		writeError(w, r, apiErr(http.StatusUnauthorized, "authentication required"))
+		return u, false
+	}
+	return u, true
+}
@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	mongoevent "go.mongodb.org/mongo-driver/v2/event"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Requests, todo storage calls and Mongo commands are traced with
+// OpenTelemetry and exported over OTLP/HTTP to TODO_OTLP_ENDPOINT, e.g.
+// http://collector:4318, or wherever the standard OTEL_EXPORTER_OTLP_*
+// variables say. Without either, tracing is off. TODO_TRACE_SAMPLE_PERCENT
+// (100) of traces starting here are kept; traces started by a caller that
+// sent a W3C traceparent header follow the caller's decision.
+
+var traceConf = struct {
+	Endpoint      string
+	SamplePercent int
+}{
+	Endpoint:      envString("TODO_OTLP_ENDPOINT", ""),
+	SamplePercent: envInt("TODO_TRACE_SAMPLE_PERCENT", 100),
+}
+
+var tracer = otel.Tracer("github.com/sangin4208/go-todo")
+
+// tracerProvider is set while tracing is on, for flushing at shutdown.
+var tracerProvider *sdktrace.TracerProvider
+
+func tracingEnabled() bool {
+	return traceConf.Endpoint != "" || envString("OTEL_EXPORTER_OTLP_ENDPOINT", "") != "" ||
+		envString("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "") != ""
+}
+
+// initTracing installs the exporting tracer provider and the W3C trace
+// context propagator. Spans are exported in the background; the exporter
+// does not connect until then, so a missing collector only costs dropped
+// spans.
+func initTracing() error {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if !tracingEnabled() {
+		return nil
+	}
+	if traceConf.SamplePercent < 0 || traceConf.SamplePercent > 100 {
+		return fmt.Errorf("TODO_TRACE_SAMPLE_PERCENT must be between 0 and 100, not %d", traceConf.SamplePercent)
+	}
+	var opts []otlptracehttp.Option
+	if traceConf.Endpoint != "" {
+		opts = append(opts, otlptracehttp.WithEndpointURL(traceConf.Endpoint))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return err
+	}
+	res, err := resource.New(context.Background(),
+		resource.WithAttributes(semconv.ServiceName("todo"), semconv.ServiceInstanceID(instanceID)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return err
+	}
+	tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(float64(traceConf.SamplePercent)/100))),
+	)
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		slog.Error("tracing", "err", err)
+	}))
+	return nil
+}
+
+// shutdownTracing exports the spans still buffered.
+func shutdownTracing(ctx context.Context) {
+	if tracerProvider == nil {
+		return
+	}
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		slog.Error("tracing", "err", err)
+	}
+}
+
+// traceRequests gives each request a server span, continuing the trace
+// from the traceparent header if there is one. The span is named after
+// the route pattern it matched, which is only known once routed.
+func traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(semconv.HTTPRequestMethodKey.String(r.Method), semconv.URLPath(r.URL.Path)))
+		defer span.End()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(ctx))
+		if rctx := chi.RouteContext(ctx); rctx != nil && rctx.RoutePattern() != "" {
+			span.SetName(r.Method + " " + rctx.RoutePattern())
+			span.SetAttributes(semconv.HTTPRoute(rctx.RoutePattern()))
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	})
+}
+
+// mongoSpans holds the span of each Mongo command in flight, by request
+// ID, from the command monitor's started event to its outcome.
+var mongoSpans sync.Map
+
+// startMongoSpan starts a client span for a Mongo command. Commands sent
+// outside a trace, such as the job workers polling, get none.
+func startMongoSpan(ctx context.Context, e *mongoevent.CommandStartedEvent) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return
+	}
+	attrs := []trace.SpanStartOption{
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemNameMongoDB, semconv.DBOperationName(e.CommandName), semconv.DBNamespace(e.DatabaseName)),
+	}
+	name := e.CommandName
+	if coll, ok := e.Command.Lookup(e.CommandName).StringValueOK(); ok {
+		name += " " + coll
+		attrs = append(attrs, trace.WithAttributes(semconv.DBCollectionName(coll)))
+	}
+	_, span := tracer.Start(ctx, name, attrs...)
+	mongoSpans.Store(e.RequestID, span)
+}
+
+func endMongoSpan(requestID int64, err error) {
+	s, ok := mongoSpans.LoadAndDelete(requestID)
+	if !ok {
+		return
+	}
+	span := s.(trace.Span)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,96 @@
+//go:build unix
+
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// SIGUSR2 upgrades the server in place: the process starts its executable
+// again, passing on its listeners, and once the new process serves shuts
+// down as on SIGINT. Connections are accepted throughout, so a deploy
+// replaces the binary and signals the running process rather than
+// restarting it. If the new process is not serving within upgradeTimeout,
+// the old one carries on. Supervisors can follow the new process through
+// TODO_PID_FILE.
+const (
+	upgradeTimeout = 30 * time.Second
+	upgradeDrain   = time.Second
+)
+
+// handleUpgrades upgrades on SIGUSR2, stopping this process through stop
+// once it has been replaced.
+func handleUpgrades(stop chan<- os.Signal) {
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+	for range usr2 {
+		slog.Info("upgrade: starting a new process")
+		if err := upgrade(); err != nil {
+			slog.Error("upgrade", "err", err)
+			continue
+		}
+		slog.Info("upgrade: the new process is serving, shutting down")
+		closeListeners()
+		// A shutting down server drops connections whose request it has
+		// not read yet, so give those accepted last a moment.
+		time.Sleep(upgradeDrain)
+		stop <- syscall.SIGTERM
+		return
+	}
+}
+
+func upgrade() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	names, files, err := listenerFiles()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	ready, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), upgradeEnv+"="+strings.Join(names, ","))
+	cmd.ExtraFiles = append(files, w)
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		// Reads nothing if the new process exits before it serves.
+		_, err := ready.Read(make([]byte, 1))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			go cmd.Wait()
+			return errors.New("the new process exited before serving")
+		}
+		return nil
+	case <-time.After(upgradeTimeout):
+		cmd.Process.Kill()
+		go cmd.Wait()
+		return errors.New("the new process did not start serving in time")
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package handlers
+
+import "os"
+
+// handleUpgrades does nothing: in-place upgrades need Unix signals.
+func handleUpgrades(stop chan<- os.Signal) {}
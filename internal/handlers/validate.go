@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/thedevsaddam/renderer"
+)
+
+// Request bodies declare their rules in validate struct tags, which
+// decodeJSON checks once a body is decoded. A body breaking any of them is
+// answered 422 with every violation, each naming the field as the client
+// sent it:
+//
+//	{"message": "title is required", "code": "validation_failed",
+//	 "errors": [{"field": "title", "rule": "required", "message": "title is required"}]}
+//
+// Besides the validator's own rules, there are:
+//
+//	id       a todo, list or user id
+//	notblank a string that is more than whitespace
+//	future   an RFC 3339 timestamp in the future
+//	weekday  the English name of a day
+//
+// Rules depending on stored data, such as whether a list exists, stay in
+// the handlers.
+
+var validate = newValidator()
+
+func newValidator() *validator.Validate {
+	v := validator.New(validator.WithRequiredStructEnabled())
+	v.RegisterTagNameFunc(func(f reflect.StructField) string {
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			return ""
+		}
+		if name == "" {
+			return f.Name
+		}
+		return name
+	})
+	v.RegisterValidation("id", func(fl validator.FieldLevel) bool {
+		return validID(fl.Field().String())
+	})
+	v.RegisterValidation("notblank", func(fl validator.FieldLevel) bool {
+		return strings.TrimSpace(fl.Field().String()) != ""
+	})
+	v.RegisterValidation("future", func(fl validator.FieldLevel) bool {
+		t, err := time.Parse(time.RFC3339, fl.Field().String())
+		return err == nil && t.After(time.Now())
+	})
+	v.RegisterValidation("weekday", func(fl validator.FieldLevel) bool {
+		n := notificationSettings{DigestWeekday: fl.Field().String()}
+		return strings.EqualFold(n.digestWeekday().String(), fl.Field().String())
+	})
+	return v
+}
+
+// violation is one broken rule in a request body.
+type violation struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// validRequest checks v against its validate tags, answering 422 and
+// returning false if it breaks any.
+func validRequest(w http.ResponseWriter, r *http.Request, v any) bool {
+	if reflect.Indirect(reflect.ValueOf(v)).Kind() != reflect.Struct {
+		return true
+	}
+	violations := validationErrors(r.Context(), v)
+	if len(violations) == 0 {
+		return true
+	}
+	render(r).JSON(w, http.StatusUnprocessableEntity, renderer.M{
+		"message": violations[0].Message,
+		"code":    "validation_failed",
+		"errors":  violations,
+	})
+	return false
+}
+
+// validationErrors returns the rules the struct v breaks, described in the
+// language of ctx's request.
+func validationErrors(ctx context.Context, v any) []violation {
+	var errs validator.ValidationErrors
+	if !errors.As(validate.Struct(v), &errs) {
+		return nil
+	}
+	violations := make([]violation, len(errs))
+	for i, fe := range errs {
+		violations[i] = violation{
+			Field:   fieldPath(fe),
+			Rule:    fe.Tag(),
+			Message: violationMessage(ctx, fe),
+		}
+	}
+	return violations
+}
+
+// fieldPath is fe's field as the client sent it, such as tags[2], without
+// the name of the Go type it was decoded into.
+func fieldPath(fe validator.FieldError) string {
+	_, path, _ := strings.Cut(fe.Namespace(), ".")
+	return path
+}
+
+func violationMessage(ctx context.Context, fe validator.FieldError) string {
+	field := fieldPath(fe)
+	switch fe.Tag() {
+	case "required", "notblank":
+		return translate(ctx, "%s is required", field)
+	case "min", "max":
+		bound := "at least"
+		if fe.Tag() == "max" {
+			bound = "at most"
+		}
+		switch fe.Kind() {
+		case reflect.Slice, reflect.Map:
+			return translate(ctx, "%s must be "+bound+" %s items", field, fe.Param())
+		case reflect.Int, reflect.Int64, reflect.Float64:
+			return translate(ctx, "%s must be "+bound+" %s", field, fe.Param())
+		}
+		return translate(ctx, "%s must be "+bound+" %s characters", field, fe.Param())
+	case "oneof":
+		return translate(ctx, "%s must be one of %s", field, strings.Join(strings.Fields(fe.Param()), ", "))
+	case "datetime":
+		return translate(ctx, "%s must be formatted as %s", field, fe.Param())
+	case "email":
+		return translate(ctx, "%s must be a valid email address", field)
+	case "url", "http_url":
+		return translate(ctx, "%s must be an absolute http or https URL", field)
+	case "timezone":
+		return translate(ctx, "%s must be an IANA time zone name", field)
+	case "id":
+		return translate(ctx, "%s must be a valid id", field)
+	case "future":
+		return translate(ctx, "%s must be a future RFC 3339 timestamp", field)
+	case "weekday":
+		return translate(ctx, "%s must be the English name of a day", field)
+	}
+	return translate(ctx, "%s is invalid", field)
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+const (
+	verificationsCollection string = "email_verifications"
+	verificationTTL                = 24 * time.Hour
+)
+
+var resendByUser = newRateLimiter(func() int { return liveConf().ResendRate }, time.Hour)
+
+type verificationModel struct {
+	ID        ID        `bson:"_id,omitempty"`
+	UserID    ID        `bson:"userId"`
+	Hash      string    `bson:"hash"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+// sendVerification mails u a link confirming their address. Until it is
+// followed the account can read but not write.
+func sendVerification(ctx context.Context, u userModel) error {
+	token, err := newRefreshToken()
+	if err != nil {
+		return err
+	}
+	if _, err := db.Collection(verificationsCollection).InsertOne(ctx, &verificationModel{
+		ID:        newID(),
+		UserID:    u.ID,
+		Hash:      hashAPIToken(token),
+		ExpiresAt: time.Now().Add(verificationTTL),
+	}); err != nil {
+		return err
+	}
+	queueMail(ctx, u.Email, "verify", map[string]interface{}{"Token": token})
+	return nil
+}
+
+func verifyEmail(w http.ResponseWriter, r *http.Request) {
+	var v verificationModel
+	err := db.Collection(verificationsCollection).FindOneAndDelete(r.Context(), bson.M{
+		"hash":      hashAPIToken(strings.TrimSpace(r.URL.Query().Get("token"))),
+		"expiresAt": bson.M{"$gt": time.Now()},
+	}).Decode(&v)
+	if err == nil {
+		err = updateOne(r.Context(), db.Collection(usersCollection), bson.M{"_id": v.UserID}, bson.M{"$unset": bson.M{"unverified": ""}})
+	}
+	if err == mongo.ErrNoDocuments {
+		writeError(w, r, apiErr(http.StatusBadRequest, "invalid or expired verification link"))
+		return
+	}
+	if err == nil {
+		_, err = db.Collection(verificationsCollection).DeleteMany(r.Context(), bson.M{"userId": v.UserID})
+	}
+	if err != nil {
+		writeError(w, r, internalError("error verifying email", err))
+		return
+	}
+	// Existing access tokens still carry the unverified flag; the next
+	// refresh picks up the change.
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"message": translate(r.Context(), "email verified successfully"),
+	})
+}
+
+func resendVerification(w http.ResponseWriter, r *http.Request) {
+	u, ok := loadCurrentUser(w, r)
+	if !ok {
+		return
+	}
+	if !u.Unverified {
+		writeError(w, r, apiErr(http.StatusConflict, "email is already verified"))
+		return
+	}
+	if !resendByUser.allow(u.ID.String()) {
+		writeError(w, r, apiErr(http.StatusTooManyRequests, "too many requests, try again later"))
+		return
+	}
+	if err := sendVerification(r.Context(), u); err != nil {
+		writeError(w, r, internalError("error sending verification email", err))
+		return
+	}
+	render(r).JSON(w, http.StatusAccepted, renderer.M{
+		"message": translate(r.Context(), "verification email sent"),
+	})
+}
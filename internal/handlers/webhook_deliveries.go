@@ -0,0 +1,339 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/sangin4208/go-todo/internal/storage"
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	deliveriesCollection string = "webhook_deliveries"
+	webhookSecretPrefix         = "whsec_"
+	// A failed delivery is retried webhookMaxAttempts times in all, the
+	// wait doubling from webhookFirstRetry: about an hour altogether.
+	webhookMaxAttempts = 8
+	webhookFirstRetry  = 30 * time.Second
+	// deliveryRetention is how long the delivery log is kept.
+	deliveryRetention = 30 * 24 * time.Hour
+
+	deliveryPending   = "pending"
+	deliverySucceeded = "succeeded"
+	deliveryFailed    = "failed"
+)
+
+type (
+	// deliveryModel logs the attempts to deliver one payload to a webhook.
+	// Payload is kept verbatim so redeliveries send the same body.
+	deliveryModel struct {
+		ID            ID                `bson:"_id,omitempty"`
+		WebhookID     ID                `bson:"webhookId"`
+		EventID       ID                `bson:"eventId"`
+		OwnerID       ID                `bson:"ownerId"`
+		Event         string            `bson:"event"`
+		Payload       string            `bson:"payload"`
+		Status        string            `bson:"status"`
+		Attempts      []deliveryAttempt `bson:"attempts"`
+		NextAttemptAt time.Time         `bson:"nextAttemptAt,omitempty"`
+		CreateAt      time.Time         `bson:"createAt"`
+		ExpiresAt     time.Time         `bson:"expiresAt"`
+	}
+	deliveryAttempt struct {
+		At time.Time `bson:"at" json:"at"`
+		// StatusCode is the receiver's answer, if there was one.
+		StatusCode int    `bson:"statusCode,omitempty" json:"statusCode,omitempty"`
+		Error      string `bson:"error,omitempty" json:"error,omitempty"`
+		DurationMS int64  `bson:"durationMs" json:"durationMs"`
+	}
+	delivery struct {
+		ID            string            `json:"id"`
+		EventID       string            `json:"eventId"`
+		Event         string            `json:"event"`
+		Status        string            `json:"status"`
+		Attempts      []deliveryAttempt `json:"attempts"`
+		NextAttemptAt string            `json:"nextAttemptAt,omitempty"`
+		CreateAt      string            `json:"createAt"`
+		Payload       json.RawMessage   `json:"payload,omitempty"`
+	}
+)
+
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return webhookSecretPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// signPayload computes the X-Signature header, t=<unix time>,v1=<hex>,
+// where v1 is the HMAC-SHA256 of "<unix time>.<body>" keyed with the
+// webhook's secret. Receivers should recompute it and reject deliveries
+// whose time is too far from their own clock, to defeat replays.
+func signPayload(secret string, at time.Time, body []byte) string {
+	t := strconv.FormatInt(at.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(t + "."))
+	mac.Write(body)
+	return "t=" + t + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// queueDelivery logs a new delivery and queues its first attempt. An event
+// already delivered to the webhook is not delivered again.
+func queueDelivery(ctx context.Context, h webhookModel, p webhookPayload) error {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	d := deliveryModel{
+		ID:            newID(),
+		WebhookID:     h.ID,
+		EventID:       toID(p.ID),
+		OwnerID:       h.OwnerID,
+		Event:         p.Event,
+		Payload:       string(body),
+		Status:        deliveryPending,
+		Attempts:      []deliveryAttempt{},
+		NextAttemptAt: now,
+		CreateAt:      now,
+		ExpiresAt:     now.Add(deliveryRetention),
+	}
+	res, err := db.Collection(deliveriesCollection).UpdateOne(ctx,
+		bson.M{"webhookId": h.ID, "eventId": d.EventID},
+		bson.M{"$setOnInsert": &d}, options.UpdateOne().SetUpsert(true))
+	if err != nil || res.UpsertedCount == 0 {
+		return err
+	}
+	return queueAttempt(ctx, d.ID, 1, now)
+}
+
+// deliveryJob is the payload of jobWebhookDelivery.
+type deliveryJob struct {
+	DeliveryID ID `json:"deliveryId"`
+}
+
+// queueAttempt queues the nth attempt of a delivery. Each attempt is one
+// job, keyed by its number so it is never queued twice.
+func queueAttempt(ctx context.Context, id ID, n int, at time.Time) error {
+	return enqueueJob(ctx, jobWebhookDelivery, id.String()+"/"+strconv.Itoa(n), at, deliveryJob{DeliveryID: id})
+}
+
+func runDelivery(ctx context.Context, payload json.RawMessage) error {
+	var p deliveryJob
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return permanent(err)
+	}
+	return attemptDelivery(ctx, p.DeliveryID)
+}
+
+// attemptDelivery sends a pending delivery once and logs the outcome,
+// queueing a retry after a failure unless attempts have run out. The
+// delivery keeps its own backoff, so the job only fails when the log
+// cannot be written.
+func attemptDelivery(ctx context.Context, id ID) error {
+	var d deliveryModel
+	err := db.Collection(deliveriesCollection).FindOne(ctx, bson.M{"_id": id, "status": deliveryPending}).Decode(&d)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var h webhookModel
+	err = db.Collection(webhooksCollection).FindOne(ctx, bson.M{"_id": d.WebhookID}).Decode(&h)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+	start := time.Now()
+	attempt := deliveryAttempt{At: start}
+	switch {
+	case err == mongo.ErrNoDocuments:
+		attempt.Error = "the webhook was deleted"
+	case h.Disabled:
+		attempt.Error = "the webhook is disabled"
+	default:
+		attempt.StatusCode, err = sendDelivery(ctx, h, d)
+		if err != nil {
+			attempt.Error = err.Error()
+		}
+	}
+	attempt.DurationMS = time.Since(start).Milliseconds()
+
+	update := bson.M{"$push": bson.M{"attempts": attempt}}
+	n := len(d.Attempts) + 1
+	var retryAt time.Time
+	switch {
+	case attempt.Error == "":
+		update["$set"] = bson.M{"status": deliverySucceeded}
+		update["$unset"] = bson.M{"nextAttemptAt": ""}
+	case n >= webhookMaxAttempts || err == mongo.ErrNoDocuments || h.Disabled:
+		update["$set"] = bson.M{"status": deliveryFailed}
+		update["$unset"] = bson.M{"nextAttemptAt": ""}
+	default:
+		retryAt = time.Now().Add(webhookFirstRetry << (n - 1))
+		update["$set"] = bson.M{
+			"status":        deliveryPending,
+			"nextAttemptAt": retryAt,
+		}
+	}
+	if _, err := db.Collection(deliveriesCollection).UpdateOne(ctx, bson.M{"_id": d.ID}, update); err != nil {
+		return err
+	}
+	if retryAt.IsZero() {
+		return nil
+	}
+	return queueAttempt(ctx, d.ID, n+1, retryAt)
+}
+
+// sendDelivery POSTs the payload, returning the receiver's status code and
+// an error unless it was a 2xx.
+func sendDelivery(ctx context.Context, h webhookModel, d deliveryModel) (int, error) {
+	body := []byte(d.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-todo-webhooks")
+	req.Header.Set("X-Webhook-Event", d.Event)
+	req.Header.Set("X-Webhook-Delivery", d.ID.String())
+	req.Header.Set("X-Webhook-Attempt", strconv.Itoa(len(d.Attempts)+1))
+	if h.Secret != "" {
+		req.Header.Set("X-Signature", signPayload(h.Secret, time.Now(), body))
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("the receiver answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// fetchDeliveries pages through a webhook's delivery log, newest first,
+// leaving out payloads.
+func fetchDeliveries(w http.ResponseWriter, r *http.Request) {
+	h, ok := ownWebhook(w, r)
+	if !ok {
+		return
+	}
+	filter := bson.M{"webhookId": h.ID}
+	if s := r.URL.Query().Get("status"); s != "" {
+		filter["status"] = s
+	}
+	skip, limit := pagination(r)
+	var deliveries []deliveryModel
+	total, err := storage.FindPage(r.Context(), db.Collection(deliveriesCollection), filter, "-createAt", skip, limit, &deliveries)
+	if err != nil {
+		writeError(w, r, internalError("error fetching deliveries", err))
+		return
+	}
+	data := []delivery{}
+	for _, d := range deliveries {
+		out := toDelivery(r.Context(), d)
+		out.Payload = nil
+		data = append(data, out)
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"data":   data,
+		"total":  total,
+		"offset": skip,
+		"limit":  limit,
+	})
+}
+
+func fetchDelivery(w http.ResponseWriter, r *http.Request) {
+	d, ok := ownDelivery(w, r)
+	if !ok {
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"data": toDelivery(r.Context(), d),
+	})
+}
+
+// redeliverWebhook sends a delivery again straight away, with the same ID
+// and body. Retries continue afterwards only if attempts remain.
+func redeliverWebhook(w http.ResponseWriter, r *http.Request) {
+	d, ok := ownDelivery(w, r)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	_, err := db.Collection(deliveriesCollection).UpdateOne(r.Context(), bson.M{"_id": d.ID}, bson.M{"$set": bson.M{
+		"status":        deliveryPending,
+		"nextAttemptAt": now,
+	}})
+	if err == nil {
+		err = queueAttempt(r.Context(), d.ID, len(d.Attempts)+1, now)
+	}
+	if err != nil {
+		writeError(w, r, internalError("error scheduling redelivery", err))
+		return
+	}
+	render(r).JSON(w, http.StatusAccepted, renderer.M{
+		"message": translate(r.Context(), "redelivery scheduled"),
+	})
+}
+
+// ownDelivery loads the {deliveryId} delivery of the caller's {id} webhook,
+// writing an error response if there is none.
+func ownDelivery(w http.ResponseWriter, r *http.Request) (deliveryModel, bool) {
+	var d deliveryModel
+	h, ok := ownWebhook(w, r)
+	if !ok {
+		return d, false
+	}
+	id := strings.TrimSpace(chi.URLParam(r, "deliveryId"))
+	if !validID(id) {
+		writeError(w, r, apiErr(http.StatusBadRequest, "The delivery id is invalid"))
+		return d, false
+	}
+	err := db.Collection(deliveriesCollection).FindOne(r.Context(), bson.M{"_id": toID(id), "webhookId": h.ID}).Decode(&d)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, r, apiErr(http.StatusNotFound, "delivery not found"))
+		return d, false
+	}
+	if err != nil {
+		writeError(w, r, internalError("error fetching delivery", err))
+		return d, false
+	}
+	return d, true
+}
+
+func toDelivery(ctx context.Context, d deliveryModel) delivery {
+	out := delivery{
+		ID:       d.ID.String(),
+		EventID:  d.EventID.String(),
+		Event:    d.Event,
+		Status:   d.Status,
+		Attempts: d.Attempts,
+		CreateAt: formatTime(ctx, d.CreateAt),
+		Payload:  json.RawMessage(d.Payload),
+	}
+	if out.Attempts == nil {
+		out.Attempts = []deliveryAttempt{}
+	}
+	if d.Status == deliveryPending && !d.NextAttemptAt.IsZero() {
+		out.NextAttemptAt = formatTime(ctx, d.NextAttemptAt)
+	}
+	return out
+}
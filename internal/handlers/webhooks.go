@@ -0,0 +1,303 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/sangin4208/go-todo/internal/storage"
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	webhooksCollection string = "webhooks"
+	maxWebhooks               = 20
+)
+
+var (
+	webhookEvents = []string{eventCreated, eventUpdated, eventCompleted, eventDeleted, eventReminder}
+	webhookClient = &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{Timeout: 5 * time.Second, Control: webhookDialControl}).DialContext,
+		},
+		// Redirects could lead anywhere; receivers must give the final URL.
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	errPrivateAddress = errors.New("webhooks may not target private addresses")
+)
+
+type (
+	webhookModel struct {
+		ID          ID     `bson:"_id,omitempty"`
+		WorkspaceID ID     `bson:"workspaceId"`
+		OwnerID     ID     `bson:"ownerId"`
+		URL         string `bson:"url"`
+		// Secret signs deliveries, see signPayload.
+		Secret string `bson:"secret,omitempty"`
+		// Events lists the event types sent; empty means all of them.
+		Events   []string  `bson:"events,omitempty"`
+		Disabled bool      `bson:"disabled,omitempty"`
+		CreateAt time.Time `bson:"createAt"`
+	}
+	webhook struct {
+		ID       string   `json:"id"`
+		URL      string   `json:"url"`
+		Events   []string `json:"events"`
+		Active   bool     `json:"active"`
+		CreateAt string   `json:"createAt"`
+	}
+	webhookRequest struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+		Active *bool    `json:"active"`
+	}
+	// webhookPayload is the JSON body POSTed to a webhook.
+	webhookPayload struct {
+		ID        string `json:"id"`
+		Event     string `json:"event"`
+		CreatedAt string `json:"createdAt"`
+		Todo      todo   `json:"todo"`
+	}
+)
+
+// webhookHandlers is mounted under /webhooks. Users manage their own
+// webhooks, which receive changes to every todo they can see.
+func webhookHandlers() http.Handler {
+	rg := chi.NewRouter()
+	rg.Group(func(r chi.Router) {
+		r.Get("/", fetchWebhooks)
+		r.Get("/{id}", fetchWebhook)
+		r.Get("/{id}/deliveries", fetchDeliveries)
+		r.Get("/{id}/deliveries/{deliveryId}", fetchDelivery)
+		r.Group(func(r chi.Router) {
+			r.Use(requireRole(roleAdmin, roleMember))
+			r.Post("/", createWebhook)
+			r.Put("/{id}", updateWebhook)
+			r.Delete("/{id}", deleteWebhook)
+			r.Post("/{id}/deliveries/{deliveryId}/redeliver", redeliverWebhook)
+		})
+	})
+	return rg
+}
+
+func fetchWebhooks(w http.ResponseWriter, r *http.Request) {
+	var hooks []webhookModel
+	if err := storage.FindAll(r.Context(), db.Collection(webhooksCollection), bson.M{"ownerId": currentUser(r.Context())}, &hooks,
+		options.Find().SetSort(storage.SortKeys("createAt"))); err != nil {
+		writeError(w, r, internalError("error fetching webhooks", err))
+		return
+	}
+	data := []webhook{}
+	for _, h := range hooks {
+		data = append(data, toWebhook(r.Context(), h))
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"data": data,
+	})
+}
+
+func fetchWebhook(w http.ResponseWriter, r *http.Request) {
+	h, ok := ownWebhook(w, r)
+	if !ok {
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"data": toWebhook(r.Context(), h),
+	})
+}
+
+func createWebhook(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeWebhookRequest(w, r)
+	if !ok {
+		return
+	}
+	user := currentUser(r.Context())
+	n, err := db.Collection(webhooksCollection).CountDocuments(r.Context(), bson.M{"ownerId": user})
+	if err == nil && n >= maxWebhooks {
+		writeError(w, r, apiErr(http.StatusForbidden, fmt.Sprintf("no more than %d webhooks are allowed", maxWebhooks)))
+		return
+	}
+	h := webhookModel{
+		ID:          newID(),
+		WorkspaceID: currentWorkspace(r.Context()),
+		OwnerID:     user,
+		URL:         req.URL,
+		Events:      req.Events,
+		Disabled:    req.Active != nil && !*req.Active,
+		CreateAt:    time.Now(),
+	}
+	if err == nil {
+		h.Secret, err = newWebhookSecret()
+	}
+	if err == nil {
+		_, err = db.Collection(webhooksCollection).InsertOne(r.Context(), &h)
+	}
+	if err != nil {
+		writeError(w, r, internalError("error creating webhook", err))
+		return
+	}
+	// The secret is only ever returned here.
+	render(r).JSON(w, http.StatusCreated, renderer.M{
+		"message":    translate(r.Context(), "webhook created successfully"),
+		"webhook_id": h.ID.String(),
+		"secret":     h.Secret,
+	})
+}
+
+func updateWebhook(w http.ResponseWriter, r *http.Request) {
+	h, ok := ownWebhook(w, r)
+	if !ok {
+		return
+	}
+	req, ok := decodeWebhookRequest(w, r)
+	if !ok {
+		return
+	}
+	set := bson.M{"url": req.URL, "events": req.Events}
+	if req.Active != nil {
+		set["disabled"] = !*req.Active
+	}
+	if _, err := db.Collection(webhooksCollection).UpdateOne(r.Context(), bson.M{"_id": h.ID}, bson.M{"$set": set}); err != nil {
+		writeError(w, r, internalError("error updating webhook", err))
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"message": translate(r.Context(), "webhook updated successfully"),
+	})
+}
+
+func deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	h, ok := ownWebhook(w, r)
+	if !ok {
+		return
+	}
+	err := deleteOne(r.Context(), db.Collection(webhooksCollection), bson.M{"_id": h.ID})
+	if err == nil {
+		_, err = db.Collection(deliveriesCollection).DeleteMany(r.Context(), bson.M{"webhookId": h.ID})
+	}
+	if err != nil {
+		writeError(w, r, internalError("error deleting webhook", err))
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"message": translate(r.Context(), "webhook deleted successfully"),
+	})
+}
+
+// ownWebhook loads the caller's {id} webhook, writing an error response if
+// there is none.
+func ownWebhook(w http.ResponseWriter, r *http.Request) (webhookModel, bool) {
+	var h webhookModel
+	id := strings.TrimSpace(chi.URLParam(r, "id"))
+	if !validID(id) {
+		writeError(w, r, apiErr(http.StatusBadRequest, "The id is invalid"))
+		return h, false
+	}
+	err := db.Collection(webhooksCollection).FindOne(r.Context(), bson.M{
+		"_id":     toID(id),
+		"ownerId": currentUser(r.Context()),
+	}).Decode(&h)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, r, apiErr(http.StatusNotFound, "webhook not found"))
+		return h, false
+	}
+	if err != nil {
+		writeError(w, r, internalError("error fetching webhook", err))
+		return h, false
+	}
+	return h, true
+}
+
+func decodeWebhookRequest(w http.ResponseWriter, r *http.Request) (webhookRequest, bool) {
+	var req webhookRequest
+	if !decodeJSON(w, r, &req) {
+		return req, false
+	}
+	u, err := url.Parse(strings.TrimSpace(req.URL))
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		writeError(w, r, apiErr(http.StatusBadRequest, "url must be an absolute http or https URL"))
+		return req, false
+	}
+	req.URL = u.String()
+	for _, e := range req.Events {
+		if !slices.Contains(webhookEvents, e) {
+			writeError(w, r, apiErr(http.StatusBadRequest, "events may only include "+strings.Join(webhookEvents, ", ")))
+			return req, false
+		}
+	}
+	return req, true
+}
+
+// notifyWebhooks records a delivery of the event to every active webhook
+// whose owner can see the todo and that wants it.
+func notifyWebhooks(ctx context.Context, id ID, typ string, tm todoModel) error {
+	var hooks []webhookModel
+	err := storage.FindAll(ctx, db.Collection(webhooksCollection), bson.M{
+		"workspaceId": tm.WorkspaceID,
+		"ownerId":     bson.M{"$in": audience(ctx, tm)},
+		"disabled":    bson.M{"$ne": true},
+		"$or":         []bson.M{{"events": typ}, {"events": bson.M{"$exists": false}}, {"events": bson.M{"$size": 0}}},
+	}, &hooks)
+	if err != nil {
+		return err
+	}
+	p := webhookPayload{
+		ID:        id.String(),
+		Event:     typ,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+		Todo:      toTodo(ctx, tm),
+	}
+	for _, h := range hooks {
+		if err := queueDelivery(ctx, h, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// webhookDialControl refuses connections to non-public addresses, checked
+// after DNS resolution so a hostname cannot smuggle one in.
+func webhookDialControl(network, address string, _ syscall.RawConn) error {
+	if liveConf().WebhookAllowPrivate {
+		return nil
+	}
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	ip := ap.Addr().Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsUnspecified() || ip.IsMulticast() {
+		return errPrivateAddress
+	}
+	return nil
+}
+
+func toWebhook(ctx context.Context, h webhookModel) webhook {
+	events := h.Events
+	if len(events) == 0 {
+		events = webhookEvents
+	}
+	return webhook{
+		ID:       h.ID.String(),
+		URL:      h.URL,
+		Events:   events,
+		Active:   !h.Disabled,
+		CreateAt: formatTime(ctx, h.CreateAt),
+	}
+}
@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	workspacesCollection string = "workspaces"
+	defaultWorkspaceSlug        = "default"
+	workspaceHeader             = "X-Workspace"
+)
+
+var (
+	// defaultWorkspace is used when a request names no workspace. Documents
+	// written before workspaces existed are moved into it at startup.
+	defaultWorkspace ID
+	// workspaceDomain enables subdomain routing: with it set to
+	// "todo.example.com", acme.todo.example.com resolves to workspace "acme".
+	workspaceDomain = strings.ToLower(envString("TODO_WORKSPACE_DOMAIN", ""))
+	slugPattern     = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,38}[a-z0-9]$`)
+)
+
+type workspaceModel struct {
+	ID       ID        `bson:"_id,omitempty"`
+	Slug     string    `bson:"slug"`
+	Name     string    `bson:"name"`
+	CreateAt time.Time `bson:"createAt"`
+	// Demo workspaces are deleted once they expire.
+	Demo      bool      `bson:"demo,omitempty"`
+	ExpiresAt time.Time `bson:"expiresAt,omitempty"`
+}
+
+// ensureWorkspaces creates the default workspace. Documents that predate
+// multi-tenancy are moved into it by migration 1.
+func ensureWorkspaces(ctx context.Context) error {
+	c := db.Collection(workspacesCollection)
+	if err := ensureIndex(ctx, c, true, "slug"); err != nil {
+		return err
+	}
+	var ws workspaceModel
+	if err := c.FindOneAndUpdate(ctx, bson.M{"slug": defaultWorkspaceSlug}, bson.M{
+		"$setOnInsert": bson.M{
+			"_id":      newID(),
+			"name":     "Default",
+			"createAt": time.Now(),
+		},
+	}, options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&ws); err != nil {
+		return err
+	}
+	defaultWorkspace = ws.ID
+	return nil
+}
+
+// resolveTenant determines the workspace a request targets from the
+// X-Workspace header, the request's subdomain or, in demo mode, the demo
+// cookie.
+func resolveTenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := lookupWorkspace(r.Context(), workspaceSlug(r))
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, apiErr(http.StatusNotFound, "workspace not found"))
+			return
+		}
+		if err != nil {
+			writeError(w, r, internalError("error resolving workspace", err))
+			return
+		}
+		ctx := context.WithValue(r.Context(), workspaceKey, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func workspaceSlug(r *http.Request) string {
+	if slug := r.Header.Get(workspaceHeader); slug != "" {
+		return strings.ToLower(slug)
+	}
+	if workspaceDomain != "" {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.ToLower(host)
+		if strings.HasSuffix(host, "."+workspaceDomain) {
+			return strings.TrimSuffix(host, "."+workspaceDomain)
+		}
+	}
+	if demoMode {
+		if c, err := r.Cookie(demoCookie); err == nil {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+func lookupWorkspace(ctx context.Context, slug string) (ID, error) {
+	if slug == "" || slug == defaultWorkspaceSlug {
+		return defaultWorkspace, nil
+	}
+	var ws workspaceModel
+	err := db.Collection(workspacesCollection).FindOne(ctx, bson.M{
+		"slug": slug,
+		"$or": []bson.M{
+			{"expiresAt": bson.M{"$exists": false}},
+			{"expiresAt": bson.M{"$gt": time.Now()}},
+		},
+	}, options.FindOne().SetProjection(bson.M{"_id": 1})).Decode(&ws)
+	return ws.ID, err
+}
+
+// createWorkspace registers a new, empty workspace. The first account
+// registered in it becomes its admin.
+func createWorkspace(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Slug string `json:"slug"`
+		Name string `json:"name"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	req.Slug = strings.ToLower(strings.TrimSpace(req.Slug))
+	if !slugPattern.MatchString(req.Slug) {
+		writeError(w, r, apiErr(http.StatusBadRequest, "slug must be 3-40 lowercase letters, digits or dashes"))
+		return
+	}
+	ws := workspaceModel{
+		ID:       newID(),
+		Slug:     req.Slug,
+		Name:     strings.TrimSpace(req.Name),
+		CreateAt: time.Now(),
+	}
+	if ws.Name == "" {
+		ws.Name = ws.Slug
+	}
+	if _, err := db.Collection(workspacesCollection).InsertOne(r.Context(), &ws); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			writeError(w, r, apiErr(http.StatusConflict, "slug is already taken"))
+			return
+		}
+		writeError(w, r, internalError("error creating workspace", err))
+		return
+	}
+	render(r).JSON(w, http.StatusCreated, renderer.M{
+		"message":      translate(r.Context(), "workspace created successfully"),
+		"workspace_id": ws.ID.String(),
+		"slug":         ws.Slug,
+	})
+}
+
+func currentWorkspace(ctx context.Context) ID {
+	id, _ := ctx.Value(workspaceKey).(ID)
+	return id
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// wsProtocol is the WebSocket subprotocol carrying the access token,
+	// since browsers cannot set headers on WebSocket requests:
+	//
+	//	new WebSocket(url, ["bearer", token])
+	wsProtocol     = "bearer"
+	wsWriteTimeout = 10 * time.Second
+	wsPingInterval = 30 * time.Second
+)
+
+// The default origin check only accepts pages served from this host.
+var wsUpgrader = websocket.Upgrader{
+	Subprotocols: []string{wsProtocol},
+}
+
+// changeMessage is how live update streams describe a change.
+type changeMessage struct {
+	Type string `json:"type"`
+	Todo todo   `json:"todo"`
+}
+
+// websocketToken reads the access token offered as the second subprotocol
+// of a WebSocket handshake, after wsProtocol.
+func websocketToken(r *http.Request) string {
+	if !websocket.IsWebSocketUpgrade(r) {
+		return ""
+	}
+	protocols := websocket.Subprotocols(r)
+	if len(protocols) != 2 || protocols[0] != wsProtocol {
+		return ""
+	}
+	return strings.TrimSpace(protocols[1])
+}
+
+// watchTodosWS upgrades GET /todo/ws to a WebSocket and sends a
+// changeMessage for every change to a todo the caller can see, so open
+// tabs stay in sync. Messages from the client are ignored. A client too
+// slow to keep up misses changes and should refetch when it reconnects.
+func watchTodosWS(w http.ResponseWriter, r *http.Request) {
+	changes := serverFrom(r.Context()).changes
+	ch := changes.subscribe(currentUser(r.Context()))
+	defer changes.unsubscribe(ch)
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already answered the request.
+		return
+	}
+	defer conn.Close()
+
+	// Reading is needed to notice pongs and the client going away.
+	closed := make(chan struct{})
+	conn.SetReadDeadline(time.Now().Add(2 * wsPingInterval))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * wsPingInterval))
+	})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+				return
+			}
+		case e := <-ch:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := conn.WriteJSON(changeMessage{Type: e.Type, Todo: toTodo(r.Context(), e.Todo)}); err != nil {
+				slog.ErrorContext(r.Context(), "websocket", "err", err)
+				return
+			}
+		}
+	}
+}
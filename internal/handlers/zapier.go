@@ -0,0 +1,242 @@
+package handlers
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// The /zapier routes follow the conventions of Zapier, and suit IFTTT's
+// webhooks and similar no-code tools just as well: API keys go in the
+// X-API-Key header, objects are flat, and polling triggers return a bare
+// array, newest first, whose id fields tell items already seen from new
+// ones.
+
+const (
+	apiKeyHeader = "X-API-Key"
+	// zapierPollLimit is how many items a trigger returns; Zapier only
+	// looks at the first page.
+	zapierPollLimit = 50
+	// zapierCompletedWindow is how far back the completed todo trigger
+	// looks.
+	zapierCompletedWindow = 7 * 24 * time.Hour
+)
+
+// zapierTodo is a todo flattened the way Zapier field mapping likes it.
+type zapierTodo struct {
+	ID          string `json:"id"`
+	TodoID      string `json:"todo_id"`
+	Ref         string `json:"ref,omitempty"`
+	Title       string `json:"title"`
+	Completed   bool   `json:"completed"`
+	ListID      string `json:"list_id,omitempty"`
+	DueDate     string `json:"due_date,omitempty"`
+	Tags        string `json:"tags,omitempty"`
+	CreatedAt   string `json:"created_at"`
+	CompletedAt string `json:"completed_at,omitempty"`
+}
+
+func zapierHandlers() http.Handler {
+	rg := chi.NewRouter()
+	rg.Get("/me", zapierMe)
+	rg.Get("/triggers/new-todo", zapierNewTodos)
+	rg.Get("/triggers/completed-todo", zapierCompletedTodos)
+	rg.Group(func(r chi.Router) {
+		r.Use(requireRole(roleAdmin, roleMember))
+		r.Post("/actions/create-todo", zapierCreateTodo)
+		r.Post("/actions/complete-todo", zapierCompleteTodo)
+	})
+	return rg
+}
+
+// apiKey returns the API token in the X-API-Key header. Only API tokens
+// are taken from it, never session tokens.
+func apiKey(r *http.Request) string {
+	if key := strings.TrimSpace(r.Header.Get(apiKeyHeader)); strings.HasPrefix(key, apiTokenPrefix) {
+		return key
+	}
+	return ""
+}
+
+func toZapierTodo(tm todoModel) zapierTodo {
+	z := zapierTodo{
+		ID:        tm.ID.String(),
+		TodoID:    tm.ID.String(),
+		Ref:       tm.Ref,
+		Title:     tm.Title,
+		Completed: tm.Completed,
+		ListID:    tm.ListID.String(),
+		DueDate:   formatDueDate(tm.DueDate),
+		Tags:      strings.Join(tm.Tags, ", "),
+		CreatedAt: tm.CreateAt.UTC().Format(time.RFC3339),
+	}
+	if !tm.CompletedAt.IsZero() {
+		z.CompletedAt = tm.CompletedAt.UTC().Format(time.RFC3339)
+	}
+	return z
+}
+
+// zapierMe is the authentication test Zapier runs when a key is added; its
+// answer labels the connection.
+func zapierMe(w http.ResponseWriter, r *http.Request) {
+	var u userModel
+	err := db.Collection(usersCollection).FindOne(r.Context(), bson.M{"_id": currentUser(r.Context())},
+		options.FindOne().SetProjection(bson.M{"email": 1})).Decode(&u)
+	if err != nil {
+		writeError(w, r, internalError("failed to fetch account", err))
+		return
+	}
+	render(r).JSON(w, http.StatusOK, renderer.M{
+		"id":    u.ID.String(),
+		"email": u.Email,
+	})
+}
+
+// zapierFilter reads the optional list_id and tag query parameters that
+// triggers can be narrowed with.
+func zapierFilter(w http.ResponseWriter, r *http.Request) (TodoFilter, bool) {
+	var f TodoFilter
+	if list := r.URL.Query().Get("list_id"); list != "" {
+		if !validID(list) {
+			writeError(w, r, apiErr(http.StatusBadRequest, "The list id is invalid"))
+			return f, false
+		}
+		f.ListID = toID(list)
+	}
+	f.Tag = r.URL.Query().Get("tag")
+	return f, true
+}
+
+func zapierNewTodos(w http.ResponseWriter, r *http.Request) {
+	f, ok := zapierFilter(w, r)
+	if !ok {
+		return
+	}
+	found, _, err := findTodos(r.Context(), currentPrincipal(r.Context()), f, 0, zapierPollLimit)
+	if err != nil {
+		writeError(w, r, internalError("failed to fetch todos", err))
+		return
+	}
+	render(r).JSON(w, http.StatusOK, mapSlice(found, toZapierTodo))
+}
+
+// zapierCompletedTodos lists todos completed lately, most recently
+// completed first. The id includes the completion time, so a todo reopened
+// and completed again triggers again.
+func zapierCompletedTodos(w http.ResponseWriter, r *http.Request) {
+	f, ok := zapierFilter(w, r)
+	if !ok {
+		return
+	}
+	done := true
+	f.Completed, f.CompletedAfter = &done, time.Now().Add(-zapierCompletedWindow)
+	found, _, err := findTodos(r.Context(), currentPrincipal(r.Context()), f, 0, 0)
+	if err != nil {
+		writeError(w, r, internalError("failed to fetch todos", err))
+		return
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].CompletedAt.After(found[j].CompletedAt) })
+	if len(found) > zapierPollLimit {
+		found = found[:zapierPollLimit]
+	}
+	items := make([]zapierTodo, 0, len(found))
+	for _, tm := range found {
+		z := toZapierTodo(tm)
+		z.ID = tm.ID.String() + "-" + strconv.FormatInt(tm.CompletedAt.Unix(), 10)
+		items = append(items, z)
+	}
+	render(r).JSON(w, http.StatusOK, items)
+}
+
+func zapierCreateTodo(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Title   string `json:"title" validate:"notblank,max=500"`
+		ListID  string `json:"list_id" validate:"omitempty,id"`
+		DueDate string `json:"due_date"`
+		// Tags are comma separated, as Zapier fields are plain text.
+		Tags string `json:"tags"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	req.Title = strings.TrimSpace(req.Title)
+	dueDate, err := parseDueDate(strings.TrimSpace(req.DueDate))
+	if err != nil {
+		writeError(w, r, apiErr(http.StatusBadRequest, "due_date must be formatted as 2006-01-02"))
+		return
+	}
+	tm := todoModel{
+		ID:       newID(),
+		ListID:   idOrEmpty(req.ListID),
+		Title:    req.Title,
+		CreateAt: time.Now(),
+		DueDate:  dueDate,
+	}
+	for _, tag := range strings.Split(req.Tags, ",") {
+		tm.Tags = appendTag(tm.Tags, tag)
+	}
+	err = insertTodo(r.Context(), currentPrincipal(r.Context()), &tm)
+	if err == errListNotFound {
+		writeError(w, r, apiErr(http.StatusNotFound, "list not found"))
+		return
+	}
+	if err == errQuotaExceeded {
+		quotaExceeded(w, r, "open todo")
+		return
+	}
+	if err != nil {
+		writeError(w, r, internalError("error creating todo", err))
+		return
+	}
+	render(r).JSON(w, http.StatusCreated, toZapierTodo(tm))
+}
+
+// zapierCompleteTodo completes the todo given by id or by reference, which
+// is what users are likely to have at hand.
+func zapierCompleteTodo(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID string `json:"id"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	ctx, p := r.Context(), currentPrincipal(r.Context())
+	ref := strings.TrimSpace(req.ID)
+	var tm todoModel
+	var err error
+	switch {
+	case validID(ref):
+		tm, err = getTodo(ctx, p, toID(ref))
+	case isTodoRef(ref):
+		var found []todoModel
+		found, _, err = findTodos(ctx, p, TodoFilter{Ref: strings.ToUpper(ref)}, 0, 1)
+		if err == nil && len(found) == 0 {
+			err = mongo.ErrNoDocuments
+		}
+		if err == nil {
+			tm = found[0]
+		}
+	default:
+		err = mongo.ErrNoDocuments
+	}
+	if err == nil {
+		tm, err = setTodo(ctx, p, tm.ID, tm.Title, true)
+	}
+	if err == mongo.ErrNoDocuments {
+		writeError(w, r, apiErr(http.StatusNotFound, "todo not found"))
+		return
+	}
+	if err != nil {
+		writeError(w, r, internalError("failed to complete todo", err))
+		return
+	}
+	render(r).JSON(w, http.StatusOK, toZapierTodo(tm))
+}
@@ -0,0 +1,79 @@
+// Package model holds the documents the todo service stores, shared by
+// its storage backends and handlers.
+package model
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// ID identifies a stored document of any kind: a todo, user, list and so
+// on. It holds the ID's canonical text, 24 lowercase hex digits for an
+// ObjectID or a lowercase hyphenated UUID, and the empty string when unset.
+// Handlers should check input with ValidID rather than assuming a format.
+type ID string
+
+// NewID returns a new ID of the given format: "uuid" for a UUIDv7, whose
+// time-ordered prefix keeps SQL indexes compact, or else an ObjectID.
+func NewID(format string) ID {
+	if format == "uuid" {
+		return ID(uuid.Must(uuid.NewV7()).String())
+	}
+	return ID(bson.NewObjectID().Hex())
+}
+
+// ValidID reports whether s is an ObjectID or a UUID.
+func ValidID(s string) bool {
+	if _, err := bson.ObjectIDFromHex(s); err == nil {
+		return true
+	}
+	return len(s) == 36 && uuid.Validate(s) == nil
+}
+
+func (id ID) IsZero() bool {
+	return id == ""
+}
+
+func (id ID) String() string {
+	return string(id)
+}
+
+// MarshalBSONValue stores ObjectIDs as ObjectIDs, as they were before IDs
+// could be anything else, and UUIDs as strings. An empty ID is stored as
+// the zero ObjectID.
+func (id ID) MarshalBSONValue() (byte, []byte, error) {
+	if id == "" {
+		return marshalBSONValue(bson.ObjectID{})
+	}
+	if oid, err := bson.ObjectIDFromHex(string(id)); err == nil {
+		return marshalBSONValue(oid)
+	}
+	return marshalBSONValue(string(id))
+}
+
+func (id *ID) UnmarshalBSONValue(typ byte, data []byte) error {
+	v := bson.RawValue{Type: bson.Type(typ), Value: data}
+	switch v.Type {
+	case bson.TypeObjectID:
+		oid := v.ObjectID()
+		if oid.IsZero() {
+			*id = ""
+		} else {
+			*id = ID(oid.Hex())
+		}
+	case bson.TypeString:
+		*id = ID(v.StringValue())
+	case bson.TypeNull, bson.TypeUndefined:
+		*id = ""
+	default:
+		return fmt.Errorf("cannot decode %s into an ID", v.Type)
+	}
+	return nil
+}
+
+func marshalBSONValue(v interface{}) (byte, []byte, error) {
+	typ, data, err := bson.MarshalValue(v)
+	return byte(typ), data, err
+}
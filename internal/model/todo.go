@@ -0,0 +1,34 @@
+package model
+
+import "time"
+
+// Todo is a todo as stored.
+type Todo struct {
+	ID ID `bson:"_id,omitempty"`
+	// Ref is the todo's short reference, such as TODO-42.
+	Ref         string    `bson:"ref,omitempty"`
+	WorkspaceID ID        `bson:"workspaceId"`
+	UserID      ID        `bson:"userId"`
+	ListID      ID        `bson:"listId,omitempty"`
+	AssigneeID  ID        `bson:"assigneeId,omitempty"`
+	Title       string    `bson:"title"`
+	Completed   bool      `bson:"completed"`
+	CreateAt    time.Time `bson:"createAt"`
+	CompletedAt time.Time `bson:"completedAt,omitempty"`
+	// UpdatedAt is when the todo last changed, for delta sync. Todos
+	// older than the field have none, and their CreateAt stands in.
+	UpdatedAt time.Time `bson:"updatedAt,omitempty"`
+	DueDate   time.Time `bson:"dueDate,omitempty"`
+	Tags      []string  `bson:"tags,omitempty"`
+	// ExpiresAt, when set, is when the todo deletes itself.
+	ExpiresAt time.Time `bson:"expiresAt,omitempty"`
+}
+
+// ChangedAt is when the todo last changed, what storage.Filter's
+// UpdatedAfter compares against.
+func (tm Todo) ChangedAt() time.Time {
+	if tm.UpdatedAt.IsZero() {
+		return tm.CreateAt
+	}
+	return tm.UpdatedAt
+}
@@ -0,0 +1,341 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"sort"
+	"time"
+
+	"github.com/sangin4208/go-todo/internal/model"
+	"go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+var (
+	// boltTodos maps a todo's boltKey to its BSON document.
+	boltTodos = []byte("todos")
+	// boltByCompleted indexes todos by completion: a 0 or 1 byte followed
+	// by the ID.
+	boltByCompleted = []byte("todos_by_completed")
+	// boltByDue indexes todos with a due date by the big-endian Unix time
+	// of that date followed by the ID, so keys sort in date order.
+	boltByDue = []byte("todos_by_due")
+)
+
+// Bolt stores todos in an embedded bbolt file, needing no database
+// process. Filters on completion or due date walk the matching index
+// instead of every todo.
+type Bolt struct {
+	db    *bbolt.DB
+	newID func() model.ID
+}
+
+// NewBolt returns a Bolt keeping todos in db, opened with OpenBolt, and
+// giving new ones IDs from newID.
+func NewBolt(db *bbolt.DB, newID func() model.ID) Bolt {
+	return Bolt{db: db, newID: newID}
+}
+
+// OpenBolt opens the file at path and creates the buckets Bolt needs,
+// along with any others given, for whatever else the file is to hold.
+func OpenBolt(path string, buckets ...[]byte) (*bbolt.DB, error) {
+	b, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = b.Update(func(tx *bbolt.Tx) error {
+		for _, name := range append([][]byte{boltTodos, boltByCompleted, boltByDue}, buckets...) {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+func (r Bolt) List(_ context.Context, s Scope, f Filter, skip, limit int) ([]model.Todo, int, error) {
+	var matches []model.Todo
+	err := r.db.View(func(tx *bbolt.Tx) error {
+		todos := tx.Bucket(boltTodos)
+		visit := func(id []byte) error {
+			tm, err := boltGet(todos, id)
+			if err == nil && InScope(s, tm) && f.Matches(tm) {
+				matches = append(matches, tm)
+			}
+			return err
+		}
+		switch {
+		case f.Completed != nil:
+			prefix := []byte{completedKey(*f.Completed)}
+			c := tx.Bucket(boltByCompleted).Cursor()
+			for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+				if err := visit(k[1:]); err != nil {
+					return err
+				}
+			}
+		case !f.DueBefore.IsZero():
+			end := dueKey(f.DueBefore, "")
+			c := tx.Bucket(boltByDue).Cursor()
+			for k, _ := c.First(); k != nil && bytes.Compare(k, end) < 0; k, _ = c.Next() {
+				if err := visit(k[8:]); err != nil {
+					return err
+				}
+			}
+		default:
+			return todos.ForEach(func(k, _ []byte) error { return visit(k) })
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].CreateAt.After(matches[j].CreateAt)
+	})
+	total := len(matches)
+	if skip >= total {
+		return nil, total, nil
+	}
+	matches = matches[skip:]
+	if limit > 0 && limit < len(matches) {
+		matches = matches[:limit]
+	}
+	return matches, total, nil
+}
+
+func (r Bolt) Get(_ context.Context, s Scope, id model.ID) (model.Todo, error) {
+	var tm model.Todo
+	err := r.db.View(func(tx *bbolt.Tx) error {
+		var err error
+		tm, err = boltScoped(tx, s, id)
+		return err
+	})
+	return tm, err
+}
+
+func (r Bolt) Create(_ context.Context, tm *model.Todo) error {
+	if tm.ID.IsZero() {
+		tm.ID = r.newID()
+	}
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		if tx.Bucket(boltTodos).Get(boltKey(tm.ID)) != nil {
+			return DuplicateKey("_id_", tm.ID)
+		}
+		return boltPut(tx, model.Todo{}, *tm)
+	})
+}
+
+func (r Bolt) Update(_ context.Context, s Scope, id model.ID, title string, completed bool) (model.Todo, model.Todo, error) {
+	var before, after model.Todo
+	err := r.db.Update(func(tx *bbolt.Tx) error {
+		var err error
+		if before, err = boltScoped(tx, s, id); err != nil {
+			return err
+		}
+		after = CopyTodo(before)
+		after.Title, after.Completed, after.UpdatedAt = title, completed, time.Now()
+		if !completed {
+			after.CompletedAt = time.Time{}
+		} else if after.CompletedAt.IsZero() {
+			after.CompletedAt = time.Now()
+		}
+		return boltPut(tx, before, after)
+	})
+	return before, after, err
+}
+
+func (r Bolt) Assign(_ context.Context, s Scope, id, assignee model.ID) (model.Todo, error) {
+	var tm model.Todo
+	err := r.db.Update(func(tx *bbolt.Tx) error {
+		before, err := boltScoped(tx, s, id)
+		if err != nil {
+			return err
+		}
+		tm = CopyTodo(before)
+		tm.AssigneeID, tm.UpdatedAt = assignee, time.Now()
+		return boltPut(tx, before, tm)
+	})
+	return tm, err
+}
+
+func (r Bolt) Delete(_ context.Context, s Scope, id model.ID) (model.Todo, error) {
+	var tm model.Todo
+	err := r.db.Update(func(tx *bbolt.Tx) error {
+		var err error
+		if tm, err = boltScoped(tx, s, id); err != nil {
+			return err
+		}
+		boltUnindex(tx, tm)
+		return tx.Bucket(boltTodos).Delete(boltKey(tm.ID))
+	})
+	return tm, err
+}
+
+func (r Bolt) CountOpen(_ context.Context, user model.ID) (int, error) {
+	n := 0
+	err := r.db.View(func(tx *bbolt.Tx) error {
+		todos := tx.Bucket(boltTodos)
+		prefix := []byte{completedKey(false)}
+		c := tx.Bucket(boltByCompleted).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			tm, err := boltGet(todos, k[1:])
+			if err != nil {
+				return err
+			}
+			if tm.UserID == user {
+				n++
+			}
+		}
+		return nil
+	})
+	return n, err
+}
+
+func (r Bolt) DeleteExpired(_ context.Context, now time.Time) ([]model.Todo, error) {
+	var expired []model.Todo
+	err := r.db.Update(func(tx *bbolt.Tx) error {
+		todos := tx.Bucket(boltTodos)
+		err := todos.ForEach(func(k, _ []byte) error {
+			tm, err := boltGet(todos, k)
+			if err == nil && !tm.ExpiresAt.IsZero() && !tm.ExpiresAt.After(now) {
+				expired = append(expired, tm)
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		// Deleting while iterating with ForEach is not allowed.
+		for _, tm := range expired {
+			boltUnindex(tx, tm)
+			if err := todos.Delete(boltKey(tm.ID)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return expired, nil
+}
+
+func (r Bolt) DeleteMany(_ context.Context, s Scope, f Filter) ([]model.Todo, error) {
+	var removed []model.Todo
+	err := r.db.Update(func(tx *bbolt.Tx) error {
+		todos := tx.Bucket(boltTodos)
+		err := todos.ForEach(func(k, _ []byte) error {
+			tm, err := boltGet(todos, k)
+			if err == nil && InScope(s, tm) && f.Matches(tm) {
+				removed = append(removed, tm)
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		for _, tm := range removed {
+			boltUnindex(tx, tm)
+			if err := todos.Delete(boltKey(tm.ID)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
+
+func (r Bolt) Count(ctx context.Context, s Scope, f Filter) (int, error) {
+	_, total, err := r.List(ctx, s, f, 0, 0)
+	return total, err
+}
+
+func (r Bolt) CountTags(ctx context.Context, s Scope, f Filter) ([]TagCount, error) {
+	todos, _, err := r.List(ctx, s, f, 0, 0)
+	return CountTags(todos), err
+}
+
+func (r Bolt) CountByDay(ctx context.Context, s Scope, f Filter, completed bool, loc *time.Location) (map[string]int, error) {
+	todos, _, err := r.List(ctx, s, f, 0, 0)
+	return CountByDay(todos, completed, loc), err
+}
+
+func boltGet(todos *bbolt.Bucket, id []byte) (model.Todo, error) {
+	var tm model.Todo
+	doc := todos.Get(id)
+	if doc == nil {
+		return tm, mongo.ErrNoDocuments
+	}
+	err := bson.Unmarshal(doc, &tm)
+	return tm, err
+}
+
+func boltScoped(tx *bbolt.Tx, s Scope, id model.ID) (model.Todo, error) {
+	tm, err := boltGet(tx.Bucket(boltTodos), boltKey(id))
+	if err == nil && !InScope(s, tm) {
+		err = mongo.ErrNoDocuments
+	}
+	return tm, err
+}
+
+// boltPut stores after, replacing before's index entries with its own.
+func boltPut(tx *bbolt.Tx, before, after model.Todo) error {
+	doc, err := bson.Marshal(after)
+	if err != nil {
+		return err
+	}
+	if !before.ID.IsZero() {
+		boltUnindex(tx, before)
+	}
+	if err := tx.Bucket(boltTodos).Put(boltKey(after.ID), doc); err != nil {
+		return err
+	}
+	key := append([]byte{completedKey(after.Completed)}, boltKey(after.ID)...)
+	if err := tx.Bucket(boltByCompleted).Put(key, nil); err != nil {
+		return err
+	}
+	if after.DueDate.IsZero() {
+		return nil
+	}
+	return tx.Bucket(boltByDue).Put(dueKey(after.DueDate, after.ID), nil)
+}
+
+func boltUnindex(tx *bbolt.Tx, tm model.Todo) {
+	tx.Bucket(boltByCompleted).Delete(append([]byte{completedKey(tm.Completed)}, boltKey(tm.ID)...))
+	if !tm.DueDate.IsZero() {
+		tx.Bucket(boltByDue).Delete(dueKey(tm.DueDate, tm.ID))
+	}
+}
+
+func completedKey(completed bool) byte {
+	if completed {
+		return 1
+	}
+	return 0
+}
+
+func dueKey(due time.Time, id model.ID) []byte {
+	key := make([]byte, 8)
+	// Flipping the sign bit keeps dates before 1970 in order.
+	binary.BigEndian.PutUint64(key, uint64(due.Unix())^1<<63)
+	return append(key, boltKey(id)...)
+}
+
+// boltKey is the 12 bytes of an ObjectID, as todos were keyed before other
+// IDs were allowed, or the text of any other ID.
+func boltKey(id model.ID) []byte {
+	if oid, err := bson.ObjectIDFromHex(string(id)); err == nil {
+		return oid[:]
+	}
+	return []byte(id)
+}
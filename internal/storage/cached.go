@@ -0,0 +1,213 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sangin4208/go-todo/internal/model"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// cacheStats counts lookups, published through expvar at /admin/vars.
+var cacheStats = expvar.NewMap("todoCache")
+
+// Cached answers List and Get from Redis when it can. A todo is cached
+// under its ID and checked against the caller's scope on the way out, so
+// it is shared by everyone who can see it. Lists are cached per scope and
+// filter under a workspace generation that every write bumps, which drops
+// all of the workspace's cached lists at once. Redis errors fall through
+// to the underlying repository.
+type Cached struct {
+	next             TodoRepository
+	rdb              *redis.Client
+	listTTL, todoTTL time.Duration
+}
+
+// NewCached returns a Cached in front of next, keeping lists for listTTL
+// and todos for todoTTL in the Redis server at url, for example
+// redis://:password@localhost:6379/0.
+func NewCached(ctx context.Context, next TodoRepository, url string, listTTL, todoTTL time.Duration) (*Cached, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	rdb := redis.NewClient(opts)
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		return nil, err
+	}
+	return &Cached{next: next, rdb: rdb, listTTL: listTTL, todoTTL: todoTTL}, nil
+}
+
+type cachedPage struct {
+	Todos []model.Todo `bson:"todos"`
+	Total int          `bson:"total"`
+}
+
+func (c *Cached) List(ctx context.Context, s Scope, f Filter, skip, limit int) ([]model.Todo, int, error) {
+	gen, err := c.rdb.Get(ctx, generationKey(s.WorkspaceID)).Int64()
+	if err != nil && err != redis.Nil {
+		c.failed(err)
+		return c.next.List(ctx, s, f, skip, limit)
+	}
+	key := listKey(gen, s, f, skip, limit)
+	var page cachedPage
+	if c.lookup(ctx, key, &page) {
+		return page.Todos, page.Total, nil
+	}
+	todos, total, err := c.next.List(ctx, s, f, skip, limit)
+	if err == nil {
+		c.store(ctx, key, cachedPage{Todos: todos, Total: total}, c.listTTL)
+	}
+	return todos, total, err
+}
+
+func (c *Cached) Get(ctx context.Context, s Scope, id model.ID) (model.Todo, error) {
+	var tm model.Todo
+	if c.lookup(ctx, todoKey(id), &tm) && InScope(s, tm) {
+		return tm, nil
+	}
+	tm, err := c.next.Get(ctx, s, id)
+	if err == nil {
+		c.store(ctx, todoKey(id), tm, c.todoTTL)
+	}
+	return tm, err
+}
+
+func (c *Cached) Create(ctx context.Context, tm *model.Todo) error {
+	err := c.next.Create(ctx, tm)
+	if err == nil {
+		c.Invalidate(ctx, *tm)
+	}
+	return err
+}
+
+func (c *Cached) Update(ctx context.Context, s Scope, id model.ID, title string, completed bool) (model.Todo, model.Todo, error) {
+	before, after, err := c.next.Update(ctx, s, id, title, completed)
+	if err == nil {
+		c.Invalidate(ctx, after)
+	}
+	return before, after, err
+}
+
+func (c *Cached) Assign(ctx context.Context, s Scope, id, assignee model.ID) (model.Todo, error) {
+	tm, err := c.next.Assign(ctx, s, id, assignee)
+	if err == nil {
+		c.Invalidate(ctx, tm)
+	}
+	return tm, err
+}
+
+func (c *Cached) Delete(ctx context.Context, s Scope, id model.ID) (model.Todo, error) {
+	tm, err := c.next.Delete(ctx, s, id)
+	if err == nil {
+		c.Invalidate(ctx, tm)
+	}
+	return tm, err
+}
+
+func (c *Cached) CountOpen(ctx context.Context, user model.ID) (int, error) {
+	return c.next.CountOpen(ctx, user)
+}
+
+func (c *Cached) DeleteExpired(ctx context.Context, now time.Time) ([]model.Todo, error) {
+	expired, err := c.next.DeleteExpired(ctx, now)
+	for _, tm := range expired {
+		c.Invalidate(ctx, tm)
+	}
+	return expired, err
+}
+
+func (c *Cached) DeleteMany(ctx context.Context, s Scope, f Filter) ([]model.Todo, error) {
+	removed, err := c.next.DeleteMany(ctx, s, f)
+	for _, tm := range removed {
+		c.Invalidate(ctx, tm)
+	}
+	return removed, err
+}
+
+func (c *Cached) Count(ctx context.Context, s Scope, f Filter) (int, error) {
+	return c.next.Count(ctx, s, f)
+}
+
+func (c *Cached) CountTags(ctx context.Context, s Scope, f Filter) ([]TagCount, error) {
+	return c.next.CountTags(ctx, s, f)
+}
+
+func (c *Cached) CountByDay(ctx context.Context, s Scope, f Filter, completed bool, loc *time.Location) (map[string]int, error) {
+	return c.next.CountByDay(ctx, s, f, completed, loc)
+}
+
+func (c *Cached) lookup(ctx context.Context, key string, v interface{}) bool {
+	b, err := c.rdb.Get(ctx, key).Bytes()
+	if err == nil {
+		err = bson.Unmarshal(b, v)
+	}
+	if err != nil {
+		if err != redis.Nil {
+			c.failed(err)
+		}
+		cacheStats.Add("misses", 1)
+		return false
+	}
+	cacheStats.Add("hits", 1)
+	return true
+}
+
+func (c *Cached) store(ctx context.Context, key string, v interface{}, ttl time.Duration) {
+	b, err := bson.Marshal(v)
+	if err == nil {
+		err = c.rdb.Set(ctx, key, b, ttl).Err()
+	}
+	if err != nil {
+		c.failed(err)
+	}
+}
+
+// Invalidate drops what is cached of tm, as every write through c does:
+// the todo's own entry goes and the workspace's cached lists are retired.
+// Changes made around c must call it themselves.
+func (c *Cached) Invalidate(ctx context.Context, tm model.Todo) {
+	_, err := c.rdb.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.Del(ctx, todoKey(tm.ID))
+		p.Incr(ctx, generationKey(tm.WorkspaceID))
+		return nil
+	})
+	if err != nil {
+		c.failed(err)
+	}
+}
+
+func (c *Cached) failed(err error) {
+	cacheStats.Add("errors", 1)
+	slog.Error("todo cache", "err", err)
+}
+
+func todoKey(id model.ID) string {
+	return "todo:" + id.String()
+}
+
+func generationKey(workspace model.ID) string {
+	return "todos:" + workspace.String() + ":gen"
+}
+
+func listKey(gen int64, s Scope, f Filter, skip, limit int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s|%s|", s.OwnerID.String(), s.AssigneeID.String())
+	for _, id := range s.ListIDs {
+		b.WriteString(id.String())
+	}
+	fmt.Fprintf(&b, "|%s|%s|%s|%s|%q|%d|%d|%d|%d|%d", f.ListID.String(), f.AssigneeID.String(), f.Tag, f.Ref, f.Text,
+		f.DueBefore.Unix(), f.CompletedAfter.Unix(), f.UpdatedAfter.UnixNano(), skip, limit)
+	if f.Completed != nil {
+		fmt.Fprintf(&b, "|%t", *f.Completed)
+	}
+	sum := sha256.Sum256([]byte(b.String()))
+	return fmt.Sprintf("todos:%s:%d:%s", s.WorkspaceID.String(), gen, hex.EncodeToString(sum[:16]))
+}
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"context"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// Collection is the part of *mongo.Collection that Mongo and Events use,
+// which *docstore.Collection implements too.
+type Collection interface {
+	Name() string
+	Find(ctx context.Context, filter any, opts ...options.Lister[options.FindOptions]) (*mongo.Cursor, error)
+	FindOne(ctx context.Context, filter any, opts ...options.Lister[options.FindOneOptions]) *mongo.SingleResult
+	CountDocuments(ctx context.Context, filter any, opts ...options.Lister[options.CountOptions]) (int64, error)
+	Aggregate(ctx context.Context, pipeline any, opts ...options.Lister[options.AggregateOptions]) (*mongo.Cursor, error)
+	InsertOne(ctx context.Context, document any, opts ...options.Lister[options.InsertOneOptions]) (*mongo.InsertOneResult, error)
+	InsertMany(ctx context.Context, documents any, opts ...options.Lister[options.InsertManyOptions]) (*mongo.InsertManyResult, error)
+	DeleteOne(ctx context.Context, filter any, opts ...options.Lister[options.DeleteOneOptions]) (*mongo.DeleteResult, error)
+	DeleteMany(ctx context.Context, filter any, opts ...options.Lister[options.DeleteManyOptions]) (*mongo.DeleteResult, error)
+	UpdateOne(ctx context.Context, filter, update any, opts ...options.Lister[options.UpdateOneOptions]) (*mongo.UpdateResult, error)
+	UpdateMany(ctx context.Context, filter, update any, opts ...options.Lister[options.UpdateManyOptions]) (*mongo.UpdateResult, error)
+	ReplaceOne(ctx context.Context, filter, replacement any, opts ...options.Lister[options.ReplaceOptions]) (*mongo.UpdateResult, error)
+	FindOneAndDelete(ctx context.Context, filter any, opts ...options.Lister[options.FindOneAndDeleteOptions]) *mongo.SingleResult
+	FindOneAndUpdate(ctx context.Context, filter, update any, opts ...options.Lister[options.FindOneAndUpdateOptions]) *mongo.SingleResult
+}
+
+// SortKeys turns field names into a sort or index specification; a leading
+// "-" sorts that field descending.
+func SortKeys(fields ...string) bson.D {
+	keys := bson.D{}
+	for _, f := range fields {
+		if strings.HasPrefix(f, "-") {
+			keys = append(keys, bson.E{Key: f[1:], Value: -1})
+		} else {
+			keys = append(keys, bson.E{Key: f, Value: 1})
+		}
+	}
+	return keys
+}
+
+// FindAll decodes every document matching filter into results.
+func FindAll(ctx context.Context, c Collection, filter interface{}, results interface{}, opts ...options.Lister[options.FindOptions]) error {
+	cur, err := c.Find(ctx, filter, opts...)
+	if err != nil {
+		return err
+	}
+	return cur.All(ctx, results)
+}
+
+// FindPage decodes one page of the documents matching filter, ordered by
+// sort (see SortKeys), into results and returns the total number of
+// matches. A zero limit returns every match.
+func FindPage(ctx context.Context, c Collection, filter interface{}, sort string, skip, limit int, results interface{}) (int, error) {
+	total, err := c.CountDocuments(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	return int(total), FindAll(ctx, c, filter, results, options.Find().
+		SetSort(SortKeys(sort)).
+		SetSkip(int64(skip)).
+		SetLimit(int64(limit)))
+}
+
+// AggregateAll runs pipeline on c and decodes every result into results.
+func AggregateAll(ctx context.Context, c Collection, pipeline interface{}, results interface{}) error {
+	cur, err := c.Aggregate(ctx, pipeline)
+	if err != nil {
+		return err
+	}
+	return cur.All(ctx, results)
+}
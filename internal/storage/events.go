@@ -0,0 +1,318 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/sangin4208/go-todo/internal/model"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// Events keeps todos as an event log: every change appends an event to
+// the todo_events collection, the record of truth, and the todo collection
+// is only a projection of the log, kept up to date in the same transaction
+// and queried exactly as by Mongo. The log gives a todo's whole history,
+// and Replay rebuilds the projection from it, starting from each todo's
+// latest snapshot.
+const (
+	TodoEventsCollection    string = "todo_events"
+	TodoSnapshotsCollection string = "todo_snapshots"
+	// snapshotEvery is how many events a todo gets between snapshots.
+	snapshotEvery = 50
+)
+
+const (
+	todoEventCreated    = "created"
+	todoEventRetitled   = "retitled"
+	todoEventCompleted  = "completed"
+	todoEventReopened   = "reopened"
+	todoEventAssigned   = "assigned"
+	todoEventUnassigned = "unassigned"
+	todoEventDeleted    = "deleted"
+)
+
+type (
+	todoEventModel struct {
+		ID     model.ID `bson:"_id"`
+		TodoID model.ID `bson:"todoId"`
+		// Seq numbers a todo's events from 1. The unique index on todoId
+		// and seq stops two writers from appending the same one.
+		Seq  int       `bson:"seq"`
+		Type string    `bson:"type"`
+		At   time.Time `bson:"at"`
+		// Todo is the new todo, on created events.
+		Todo       *model.Todo `bson:"todo,omitempty"`
+		Title      string      `bson:"title,omitempty"`
+		AssigneeID model.ID    `bson:"assigneeId,omitempty"`
+	}
+	// todoSnapshotModel is a todo as of its event Seq.
+	todoSnapshotModel struct {
+		TodoID model.ID   `bson:"_id"`
+		Seq    int        `bson:"seq"`
+		Todo   model.Todo `bson:"todo"`
+	}
+)
+
+// Events appends changes to the event log and folds them into the todo
+// collection, which its Mongo reads as usual.
+type Events struct {
+	Mongo
+	events, snapshots Collection
+	transact          Transactor
+}
+
+// Transactor runs fn in a transaction, or joins the one ctx is in. fn must
+// use the context it is given and may be retried.
+type Transactor func(ctx context.Context, fn func(ctx context.Context) error) error
+
+// NewEvents returns an Events projecting onto m's collection, keeping its
+// log and snapshots in the collections named TodoEventsCollection and
+// TodoSnapshotsCollection and running each change through transact.
+func NewEvents(m Mongo, events, snapshots Collection, transact Transactor) Events {
+	return Events{Mongo: m, events: events, snapshots: snapshots, transact: transact}
+}
+
+func (r Events) Create(ctx context.Context, tm *model.Todo) error {
+	if tm.ID.IsZero() {
+		tm.ID = r.newID()
+	}
+	return r.transact(ctx, func(ctx context.Context) error {
+		created := *tm
+		if err := r.appendTodoEvents(ctx, tm.ID, 0, todoEventModel{Type: todoEventCreated, At: tm.CreateAt, Todo: &created}); err != nil {
+			return err
+		}
+		_, err := r.todos.InsertOne(ctx, tm)
+		return err
+	})
+}
+
+func (r Events) Update(ctx context.Context, s Scope, id model.ID, title string, completed bool) (model.Todo, model.Todo, error) {
+	var before, after model.Todo
+	err := r.transact(ctx, func(ctx context.Context) error {
+		var err error
+		if before, err = r.Get(ctx, s, id); err != nil {
+			return err
+		}
+		var events []todoEventModel
+		if title != before.Title {
+			events = append(events, todoEventModel{Type: todoEventRetitled, Title: title})
+		}
+		if completed && !before.Completed {
+			events = append(events, todoEventModel{Type: todoEventCompleted})
+		} else if !completed && before.Completed {
+			events = append(events, todoEventModel{Type: todoEventReopened})
+		}
+		after, err = r.change(ctx, before, events...)
+		return err
+	})
+	return before, after, err
+}
+
+func (r Events) Assign(ctx context.Context, s Scope, id, assignee model.ID) (model.Todo, error) {
+	var tm model.Todo
+	err := r.transact(ctx, func(ctx context.Context) error {
+		before, err := r.Get(ctx, s, id)
+		if err != nil {
+			return err
+		}
+		e := todoEventModel{Type: todoEventAssigned, AssigneeID: assignee}
+		if assignee.IsZero() {
+			e = todoEventModel{Type: todoEventUnassigned}
+		}
+		tm, err = r.change(ctx, before, e)
+		return err
+	})
+	return tm, err
+}
+
+func (r Events) Delete(ctx context.Context, s Scope, id model.ID) (model.Todo, error) {
+	var tm model.Todo
+	err := r.transact(ctx, func(ctx context.Context) error {
+		var err error
+		if tm, err = r.Get(ctx, s, id); err != nil {
+			return err
+		}
+		return r.remove(ctx, tm)
+	})
+	return tm, err
+}
+
+// DeleteExpired records the deletion of expired todos. The todo collection
+// has no TTL index with this backend, so that every deletion is logged.
+func (r Events) DeleteExpired(ctx context.Context, now time.Time) ([]model.Todo, error) {
+	var expired []model.Todo
+	if err := FindAll(ctx, r.todos, bson.M{"expiresAt": bson.M{"$lte": now}}, &expired); err != nil {
+		return nil, err
+	}
+	for i, tm := range expired {
+		if err := r.transact(ctx, func(ctx context.Context) error { return r.remove(ctx, tm) }); err != nil {
+			return expired[:i], err
+		}
+	}
+	return expired, nil
+}
+
+// DeleteMany records the deletion of every todo it removes, in one
+// transaction.
+func (r Events) DeleteMany(ctx context.Context, s Scope, f Filter) ([]model.Todo, error) {
+	var removed []model.Todo
+	err := r.transact(ctx, func(ctx context.Context) error {
+		var err error
+		if removed, _, err = r.List(ctx, s, f, 0, 0); err != nil {
+			return err
+		}
+		for _, tm := range removed {
+			if err := r.remove(ctx, tm); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// change appends events to the todo and applies them to its projection,
+// returning the todo as changed.
+func (r Events) change(ctx context.Context, tm model.Todo, events ...todoEventModel) (model.Todo, error) {
+	if len(events) == 0 {
+		return tm, nil
+	}
+	seq, err := r.lastTodoSeq(ctx, tm.ID)
+	if err != nil {
+		return tm, err
+	}
+	now := time.Now()
+	for i := range events {
+		events[i].At = now
+		applyTodoEvent(&tm, events[i])
+	}
+	if err := r.appendTodoEvents(ctx, tm.ID, seq, events...); err != nil {
+		return tm, err
+	}
+	if seq/snapshotEvery != (seq+len(events))/snapshotEvery {
+		if err := r.snapshotTodo(ctx, seq+len(events), tm); err != nil {
+			return tm, err
+		}
+	}
+	_, err = r.todos.ReplaceOne(ctx, bson.M{"_id": tm.ID}, tm)
+	return tm, err
+}
+
+func (r Events) remove(ctx context.Context, tm model.Todo) error {
+	seq, err := r.lastTodoSeq(ctx, tm.ID)
+	if err == nil {
+		err = r.appendTodoEvents(ctx, tm.ID, seq, todoEventModel{Type: todoEventDeleted, At: time.Now()})
+	}
+	if err == nil {
+		_, err = r.snapshots.DeleteOne(ctx, bson.M{"_id": tm.ID})
+	}
+	if err == nil {
+		_, err = r.todos.DeleteOne(ctx, bson.M{"_id": tm.ID})
+	}
+	return err
+}
+
+// appendTodoEvents adds events to the todo's log after its event seq.
+func (r Events) appendTodoEvents(ctx context.Context, todoID model.ID, seq int, events ...todoEventModel) error {
+	docs := make([]interface{}, len(events))
+	for i, e := range events {
+		seq++
+		e.ID, e.TodoID, e.Seq = r.newID(), todoID, seq
+		docs[i] = e
+	}
+	_, err := r.events.InsertMany(ctx, docs)
+	return err
+}
+
+func (r Events) lastTodoSeq(ctx context.Context, todoID model.ID) (int, error) {
+	var e todoEventModel
+	err := r.events.FindOne(ctx, bson.M{"todoId": todoID},
+		options.FindOne().SetSort(SortKeys("-seq")).SetProjection(bson.M{"seq": 1})).Decode(&e)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	return e.Seq, err
+}
+
+func (r Events) snapshotTodo(ctx context.Context, seq int, tm model.Todo) error {
+	_, err := r.snapshots.ReplaceOne(ctx, bson.M{"_id": tm.ID},
+		todoSnapshotModel{TodoID: tm.ID, Seq: seq, Todo: tm}, options.Replace().SetUpsert(true))
+	return err
+}
+
+// applyTodoEvent folds one event into the todo.
+func applyTodoEvent(tm *model.Todo, e todoEventModel) {
+	switch e.Type {
+	case todoEventCreated:
+		*tm = *e.Todo
+	case todoEventRetitled:
+		tm.Title = e.Title
+	case todoEventCompleted:
+		tm.Completed = true
+		tm.CompletedAt = e.At
+	case todoEventReopened:
+		tm.Completed = false
+		tm.CompletedAt = time.Time{}
+	case todoEventAssigned:
+		tm.AssigneeID = e.AssigneeID
+	case todoEventUnassigned:
+		tm.AssigneeID = ""
+	}
+	if e.Type != todoEventCreated {
+		tm.UpdatedAt = e.At
+	}
+}
+
+// replayTodo folds the todo's events after its latest snapshot, returning
+// false if it has been deleted.
+func (r Events) replayTodo(ctx context.Context, todoID model.ID) (model.Todo, bool, error) {
+	var snap todoSnapshotModel
+	err := r.snapshots.FindOne(ctx, bson.M{"_id": todoID}).Decode(&snap)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return snap.Todo, false, err
+	}
+	var events []todoEventModel
+	if err := FindAll(ctx, r.events, bson.M{"todoId": todoID, "seq": bson.M{"$gt": snap.Seq}},
+		&events, options.Find().SetSort(SortKeys("seq"))); err != nil {
+		return snap.Todo, false, err
+	}
+	tm, exists := snap.Todo, snap.Seq > 0
+	for _, e := range events {
+		if e.Type == todoEventDeleted {
+			return tm, false, nil
+		}
+		applyTodoEvent(&tm, e)
+		exists = true
+	}
+	return tm, exists, nil
+}
+
+// Replay rebuilds the todo collection from the event log, returning how
+// many todos it holds afterwards. Writes made meanwhile may be lost.
+func (r Events) Replay(ctx context.Context) (int, error) {
+	var logged []struct {
+		ID model.ID `bson:"_id"`
+	}
+	if err := AggregateAll(ctx, r.events, []bson.M{
+		{"$group": bson.M{"_id": "$todoId"}},
+	}, &logged); err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, l := range logged {
+		id := l.ID
+		tm, exists, err := r.replayTodo(ctx, id)
+		if err == nil && exists {
+			_, err = r.todos.ReplaceOne(ctx, bson.M{"_id": id}, tm, options.Replace().SetUpsert(true))
+			n++
+		} else if err == nil {
+			_, err = r.todos.DeleteOne(ctx, bson.M{"_id": id})
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
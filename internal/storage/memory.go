@@ -0,0 +1,287 @@
+package storage
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sangin4208/go-todo/internal/model"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// Memory keeps todos in process memory, for demos and integration tests.
+// Nothing survives a restart.
+type Memory struct {
+	mu    sync.RWMutex
+	todos map[model.ID]model.Todo
+	newID func() model.ID
+}
+
+// NewMemory returns an empty Memory giving new todos IDs from newID.
+func NewMemory(newID func() model.ID) *Memory {
+	return &Memory{todos: make(map[model.ID]model.Todo), newID: newID}
+}
+
+func (r *Memory) List(_ context.Context, s Scope, f Filter, skip, limit int) ([]model.Todo, int, error) {
+	r.mu.RLock()
+	var matches []model.Todo
+	for _, tm := range r.todos {
+		if InScope(s, tm) && f.Matches(tm) {
+			matches = append(matches, CopyTodo(tm))
+		}
+	}
+	r.mu.RUnlock()
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].CreateAt.After(matches[j].CreateAt)
+	})
+	total := len(matches)
+	if skip >= total {
+		return nil, total, nil
+	}
+	matches = matches[skip:]
+	if limit > 0 && limit < len(matches) {
+		matches = matches[:limit]
+	}
+	return matches, total, nil
+}
+
+func (r *Memory) Get(_ context.Context, s Scope, id model.ID) (model.Todo, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	tm, ok := r.todos[id]
+	if !ok || !InScope(s, tm) {
+		return model.Todo{}, mongo.ErrNoDocuments
+	}
+	return CopyTodo(tm), nil
+}
+
+func (r *Memory) Create(_ context.Context, tm *model.Todo) error {
+	if tm.ID.IsZero() {
+		tm.ID = r.newID()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, taken := r.todos[tm.ID]; taken {
+		return DuplicateKey("_id_", tm.ID)
+	}
+	r.todos[tm.ID] = CopyTodo(*tm)
+	return nil
+}
+
+func (r *Memory) Update(_ context.Context, s Scope, id model.ID, title string, completed bool) (model.Todo, model.Todo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	before, ok := r.todos[id]
+	if !ok || !InScope(s, before) {
+		return model.Todo{}, model.Todo{}, mongo.ErrNoDocuments
+	}
+	after := CopyTodo(before)
+	after.Title, after.Completed, after.UpdatedAt = title, completed, time.Now()
+	if !completed {
+		after.CompletedAt = time.Time{}
+	} else if after.CompletedAt.IsZero() {
+		after.CompletedAt = time.Now()
+	}
+	r.todos[id] = after
+	return CopyTodo(before), CopyTodo(after), nil
+}
+
+func (r *Memory) Assign(_ context.Context, s Scope, id, assignee model.ID) (model.Todo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tm, ok := r.todos[id]
+	if !ok || !InScope(s, tm) {
+		return model.Todo{}, mongo.ErrNoDocuments
+	}
+	tm.AssigneeID, tm.UpdatedAt = assignee, time.Now()
+	r.todos[id] = tm
+	return CopyTodo(tm), nil
+}
+
+func (r *Memory) Delete(_ context.Context, s Scope, id model.ID) (model.Todo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tm, ok := r.todos[id]
+	if !ok || !InScope(s, tm) {
+		return model.Todo{}, mongo.ErrNoDocuments
+	}
+	delete(r.todos, id)
+	return tm, nil
+}
+
+func (r *Memory) CountOpen(_ context.Context, user model.ID) (int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	n := 0
+	for _, tm := range r.todos {
+		if tm.UserID == user && !tm.Completed {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (r *Memory) DeleteExpired(_ context.Context, now time.Time) ([]model.Todo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var expired []model.Todo
+	for id, tm := range r.todos {
+		if !tm.ExpiresAt.IsZero() && !tm.ExpiresAt.After(now) {
+			expired = append(expired, tm)
+			delete(r.todos, id)
+		}
+	}
+	return expired, nil
+}
+
+func (r *Memory) DeleteMany(_ context.Context, s Scope, f Filter) ([]model.Todo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var removed []model.Todo
+	for id, tm := range r.todos {
+		if InScope(s, tm) && f.Matches(tm) {
+			removed = append(removed, tm)
+			delete(r.todos, id)
+		}
+	}
+	return removed, nil
+}
+
+func (r *Memory) Count(_ context.Context, s Scope, f Filter) (int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	n := 0
+	for _, tm := range r.todos {
+		if InScope(s, tm) && f.Matches(tm) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (r *Memory) CountTags(ctx context.Context, s Scope, f Filter) ([]TagCount, error) {
+	todos, _, err := r.List(ctx, s, f, 0, 0)
+	return CountTags(todos), err
+}
+
+func (r *Memory) CountByDay(ctx context.Context, s Scope, f Filter, completed bool, loc *time.Location) (map[string]int, error) {
+	todos, _, err := r.List(ctx, s, f, 0, 0)
+	return CountByDay(todos, completed, loc), err
+}
+
+// CountTags tallies the tags of todos as TodoRepository.CountTags does, for
+// backends that can't group by tag themselves.
+func CountTags(todos []model.Todo) []TagCount {
+	counts := map[string]*TagCount{}
+	for _, tm := range todos {
+		for _, tag := range tm.Tags {
+			c, ok := counts[tag]
+			if !ok {
+				c = &TagCount{Tag: tag}
+				counts[tag] = c
+			}
+			c.Total++
+			if tm.Completed {
+				c.Completed++
+			}
+		}
+	}
+	tags := make([]TagCount, 0, len(counts))
+	for _, c := range counts {
+		tags = append(tags, *c)
+	}
+	SortTagCounts(tags)
+	return tags
+}
+
+// SortTagCounts puts tags in CountTags order.
+func SortTagCounts(tags []TagCount) {
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].Total != tags[j].Total {
+			return tags[i].Total > tags[j].Total
+		}
+		return tags[i].Tag < tags[j].Tag
+	})
+}
+
+// CountByDay tallies todos by day as TodoRepository.CountByDay does.
+func CountByDay(todos []model.Todo, completed bool, loc *time.Location) map[string]int {
+	days := map[string]int{}
+	for _, tm := range todos {
+		at := tm.CreateAt
+		if completed {
+			at = tm.CompletedAt
+		}
+		if !at.IsZero() {
+			days[at.In(loc).Format("2006-01-02")]++
+		}
+	}
+	return days
+}
+
+// InScope reports whether tm is within s, for backends that can't query
+// by scope.
+func InScope(s Scope, tm model.Todo) bool {
+	if tm.WorkspaceID != s.WorkspaceID {
+		return false
+	}
+	if from, to := s.ChangedWithin(); !s.ChangedAt.IsZero() && (tm.ChangedAt().Before(from) || !tm.ChangedAt().Before(to)) {
+		return false
+	}
+	return (!tm.ListID.IsZero() && slices.Contains(s.ListIDs, tm.ListID)) ||
+		(!s.OwnerID.IsZero() && tm.UserID == s.OwnerID) ||
+		(!s.AssigneeID.IsZero() && tm.AssigneeID == s.AssigneeID)
+}
+
+// Matches reports whether tm passes f.
+func (f Filter) Matches(tm model.Todo) bool {
+	if !f.ListID.IsZero() && tm.ListID != f.ListID {
+		return false
+	}
+	if !f.AssigneeID.IsZero() && tm.AssigneeID != f.AssigneeID {
+		return false
+	}
+	if f.Ref != "" && tm.Ref != f.Ref {
+		return false
+	}
+	for _, word := range strings.Fields(strings.ToLower(f.Text)) {
+		if !strings.Contains(strings.ToLower(tm.Title), word) {
+			return false
+		}
+	}
+	if f.Completed != nil && tm.Completed != *f.Completed {
+		return false
+	}
+	if !f.DueBefore.IsZero() && (tm.DueDate.IsZero() || !tm.DueDate.Before(f.DueBefore)) {
+		return false
+	}
+	if !f.CreatedAfter.IsZero() && !tm.CreateAt.After(f.CreatedAfter) {
+		return false
+	}
+	if !f.CompletedAfter.IsZero() && !tm.CompletedAt.After(f.CompletedAfter) {
+		return false
+	}
+	if !f.UpdatedAfter.IsZero() && !tm.ChangedAt().After(f.UpdatedAfter) {
+		return false
+	}
+	if f.Tag != "" {
+		for _, t := range tm.Tags {
+			if t == f.Tag {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// CopyTodo keeps callers from sharing the stored tags slice.
+func CopyTodo(tm model.Todo) model.Todo {
+	if tm.Tags != nil {
+		tm.Tags = append([]string(nil), tm.Tags...)
+	}
+	return tm
+}
@@ -0,0 +1,253 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/sangin4208/go-todo/internal/model"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// Mongo stores todos in a Mongo collection, or one of the embedded
+// database's.
+type Mongo struct {
+	todos Collection
+	newID func() model.ID
+}
+
+// NewMongo returns a Mongo keeping todos in the todos collection and
+// giving new ones IDs from newID.
+func NewMongo(todos Collection, newID func() model.ID) Mongo {
+	return Mongo{todos: todos, newID: newID}
+}
+
+// TodoIndexes back the queries run against the todo collection: scoped
+// listing newest first, list and assignee lookups, the completion, due date
+// and tag filters, text search on titles, delta sync, expiry, and
+// references.
+var TodoIndexes = []mongo.IndexModel{
+	{Keys: SortKeys("workspaceId", "userId", "-createAt")},
+	{Keys: SortKeys("listId", "-createAt")},
+	{Keys: SortKeys("assigneeId")},
+	{Keys: SortKeys("userId", "completed")},
+	{Keys: SortKeys("dueDate")},
+	{Keys: SortKeys("tags")},
+	{Keys: SortKeys("workspaceId", "updatedAt")},
+	{Keys: bson.D{{Key: "title", Value: "text"}}},
+	{Keys: SortKeys("workspaceId", "ref"), Options: options.Index().SetUnique(true).
+		SetPartialFilterExpression(bson.M{"ref": bson.M{"$exists": true}})},
+}
+
+// TodoTTLIndex lets Mongo delete expired todos, on which Mongo's
+// DeleteExpired relies. Events must do without it, to log every deletion.
+var TodoTTLIndex = mongo.IndexModel{Keys: SortKeys("expiresAt"), Options: options.Index().SetExpireAfterSeconds(0)}
+
+func (r Mongo) List(ctx context.Context, s Scope, f Filter, skip, limit int) ([]model.Todo, int, error) {
+	var todos []model.Todo
+	total, err := FindPage(ctx, r.todos, todoQuery(s, f), "-createAt", skip, limit, &todos)
+	return todos, total, err
+}
+
+func (r Mongo) Get(ctx context.Context, s Scope, id model.ID) (model.Todo, error) {
+	var tm model.Todo
+	err := r.todos.FindOne(ctx, scopedID(s, id)).Decode(&tm)
+	return tm, err
+}
+
+func (r Mongo) Create(ctx context.Context, tm *model.Todo) error {
+	if tm.ID.IsZero() {
+		tm.ID = r.newID()
+	}
+	_, err := r.todos.InsertOne(ctx, tm)
+	return err
+}
+
+// Update reads the todo and then updates it only if it is unchanged since,
+// going round again if another write got in between, so that before and
+// after are the two sides of this one change.
+func (r Mongo) Update(ctx context.Context, s Scope, id model.ID, title string, completed bool) (model.Todo, model.Todo, error) {
+	c := r.todos
+	for {
+		var before, after model.Todo
+		if err := c.FindOne(ctx, scopedID(s, id)).Decode(&before); err != nil {
+			return before, after, err
+		}
+		unchanged := bson.M{"_id": id, "title": before.Title, "completed": before.Completed, "updatedAt": before.UpdatedAt}
+		if before.UpdatedAt.IsZero() {
+			unchanged["updatedAt"] = bson.M{"$exists": false}
+		}
+		update := bson.M{"$set": bson.M{"title": title, "completed": completed, "updatedAt": time.Now()}}
+		if completed {
+			// $min keeps the original completion time on later edits.
+			update["$min"] = bson.M{"completedAt": time.Now()}
+		} else {
+			update["$unset"] = bson.M{"completedAt": ""}
+		}
+		err := c.FindOneAndUpdate(ctx, unchanged, update,
+			options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&after)
+		if err != mongo.ErrNoDocuments {
+			return before, after, err
+		}
+	}
+}
+
+func (r Mongo) Assign(ctx context.Context, s Scope, id, assignee model.ID) (model.Todo, error) {
+	update := bson.M{"$set": bson.M{"assigneeId": assignee, "updatedAt": time.Now()}}
+	if assignee.IsZero() {
+		update = bson.M{"$unset": bson.M{"assigneeId": ""}, "$set": bson.M{"updatedAt": time.Now()}}
+	}
+	var tm model.Todo
+	err := r.todos.FindOneAndUpdate(ctx, scopedID(s, id), update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&tm)
+	return tm, err
+}
+
+func (r Mongo) Delete(ctx context.Context, s Scope, id model.ID) (model.Todo, error) {
+	var tm model.Todo
+	err := r.todos.FindOneAndDelete(ctx, scopedID(s, id)).Decode(&tm)
+	return tm, err
+}
+
+func (r Mongo) CountOpen(ctx context.Context, user model.ID) (int, error) {
+	n, err := r.todos.CountDocuments(ctx, bson.M{"userId": user, "completed": false})
+	return int(n), err
+}
+
+// DeleteExpired has nothing to do: the TTL index on expiresAt removes
+// expired todos, within a minute or so of their expiry.
+func (r Mongo) DeleteExpired(context.Context, time.Time) ([]model.Todo, error) {
+	return nil, nil
+}
+
+// DeleteMany deletes by ID what it found, so that a todo added meanwhile
+// is neither deleted nor left out of the result.
+func (r Mongo) DeleteMany(ctx context.Context, s Scope, f Filter) ([]model.Todo, error) {
+	var removed []model.Todo
+	if err := FindAll(ctx, r.todos, todoQuery(s, f), &removed); err != nil || len(removed) == 0 {
+		return nil, err
+	}
+	ids := make([]model.ID, len(removed))
+	for i, tm := range removed {
+		ids[i] = tm.ID
+	}
+	_, err := r.todos.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	return removed, err
+}
+
+func (r Mongo) Count(ctx context.Context, s Scope, f Filter) (int, error) {
+	n, err := r.todos.CountDocuments(ctx, todoQuery(s, f))
+	return int(n), err
+}
+
+func (r Mongo) CountTags(ctx context.Context, s Scope, f Filter) ([]TagCount, error) {
+	tags := []TagCount{}
+	err := AggregateAll(ctx, r.todos, []bson.M{
+		{"$match": todoQuery(s, f)},
+		{"$unwind": "$tags"},
+		{"$group": bson.M{
+			"_id":       "$tags",
+			"total":     bson.M{"$sum": 1},
+			"completed": bson.M{"$sum": bson.M{"$cond": []interface{}{"$completed", 1, 0}}},
+		}},
+		{"$sort": SortKeys("-total", "_id")},
+	}, &tags)
+	return tags, err
+}
+
+func (r Mongo) CountByDay(ctx context.Context, s Scope, f Filter, completed bool, loc *time.Location) (map[string]int, error) {
+	field := "createAt"
+	if completed {
+		field = "completedAt"
+	}
+	var days []struct {
+		Date  string `bson:"_id"`
+		Count int    `bson:"count"`
+	}
+	err := AggregateAll(ctx, r.todos, []bson.M{
+		{"$match": bson.M{"$and": []bson.M{todoQuery(s, f), {field: bson.M{"$type": "date"}}}}},
+		{"$group": bson.M{
+			"_id": bson.M{"$dateToString": bson.M{
+				"format":   "%Y-%m-%d",
+				"date":     "$" + field,
+				"timezone": loc.String(),
+			}},
+			"count": bson.M{"$sum": 1},
+		}},
+	}, &days)
+	counts := make(map[string]int, len(days))
+	for _, d := range days {
+		counts[d.Date] = d.Count
+	}
+	return counts, err
+}
+
+// todoQuery matches the todos passing f within s.
+func todoQuery(s Scope, f Filter) bson.M {
+	filter := bson.M{}
+	if !f.ListID.IsZero() {
+		filter["listId"] = f.ListID
+	}
+	if !f.AssigneeID.IsZero() {
+		filter["assigneeId"] = f.AssigneeID
+	}
+	if f.Completed != nil {
+		filter["completed"] = *f.Completed
+	}
+	if f.Tag != "" {
+		filter["tags"] = f.Tag
+	}
+	if f.Ref != "" {
+		filter["ref"] = f.Ref
+	}
+	if words := strings.Fields(f.Text); len(words) > 0 {
+		// Quoting each word makes the text search require all of them.
+		filter["$text"] = bson.M{"$search": `"` + strings.Join(words, `" "`) + `"`}
+	}
+	if !f.DueBefore.IsZero() {
+		filter["dueDate"] = bson.M{"$lt": f.DueBefore}
+	}
+	if !f.CreatedAfter.IsZero() {
+		filter["createAt"] = bson.M{"$gt": f.CreatedAfter}
+	}
+	if !f.CompletedAfter.IsZero() {
+		filter["completedAt"] = bson.M{"$gt": f.CompletedAfter}
+	}
+	if !f.UpdatedAfter.IsZero() {
+		filter["$or"] = []bson.M{
+			{"updatedAt": bson.M{"$gt": f.UpdatedAfter}},
+			{"updatedAt": bson.M{"$exists": false}, "createAt": bson.M{"$gt": f.UpdatedAfter}},
+		}
+	}
+	return bson.M{"$and": []bson.M{scopeQuery(s), filter}}
+}
+
+func scopeQuery(s Scope) bson.M {
+	lists := s.ListIDs
+	if lists == nil {
+		lists = []model.ID{}
+	}
+	or := []bson.M{{"listId": bson.M{"$in": lists}}}
+	if !s.OwnerID.IsZero() {
+		or = append(or, bson.M{"userId": s.OwnerID})
+	}
+	if !s.AssigneeID.IsZero() {
+		or = append(or, bson.M{"assigneeId": s.AssigneeID})
+	}
+	q := bson.M{"workspaceId": s.WorkspaceID, "$or": or}
+	if !s.ChangedAt.IsZero() {
+		from, to := s.ChangedWithin()
+		within := bson.M{"$gte": from, "$lt": to}
+		q = bson.M{"$and": []bson.M{q, {"$or": []bson.M{
+			{"updatedAt": within},
+			{"updatedAt": bson.M{"$exists": false}, "createAt": within},
+		}}}}
+	}
+	return q
+}
+
+func scopedID(s Scope, id model.ID) bson.M {
+	return bson.M{"$and": []bson.M{scopeQuery(s), {"_id": id}}}
+}
@@ -0,0 +1,414 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/sangin4208/go-todo/internal/model"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// postgresMigrations creates and evolves the schema. Entries are applied in
+// order and recorded in schema_migrations, so only ever append to the list.
+var postgresMigrations = []string{
+	`CREATE TABLE todos (
+		id           char(24) PRIMARY KEY,
+		workspace_id char(24) NOT NULL,
+		user_id      char(24) NOT NULL,
+		list_id      char(24),
+		assignee_id  char(24),
+		title        text NOT NULL,
+		completed    boolean NOT NULL DEFAULT false,
+		create_at    timestamptz NOT NULL,
+		completed_at timestamptz,
+		due_date     timestamptz,
+		tags         text[]
+	)`,
+	`CREATE INDEX todos_workspace_user ON todos (workspace_id, user_id, create_at DESC)`,
+	`CREATE INDEX todos_list ON todos (list_id) WHERE list_id IS NOT NULL`,
+	`CREATE INDEX todos_assignee ON todos (assignee_id) WHERE assignee_id IS NOT NULL`,
+	`ALTER TABLE todos ADD COLUMN expires_at timestamptz`,
+	`CREATE INDEX todos_expires ON todos (expires_at) WHERE expires_at IS NOT NULL`,
+	`ALTER TABLE todos
+		ALTER COLUMN id TYPE text,
+		ALTER COLUMN workspace_id TYPE text,
+		ALTER COLUMN user_id TYPE text,
+		ALTER COLUMN list_id TYPE text,
+		ALTER COLUMN assignee_id TYPE text`,
+	`ALTER TABLE todos ADD COLUMN ref text`,
+	`CREATE UNIQUE INDEX todos_ref ON todos (workspace_id, ref) WHERE ref IS NOT NULL`,
+	`ALTER TABLE todos ADD COLUMN updated_at timestamptz`,
+	`CREATE INDEX todos_updated ON todos (workspace_id, (COALESCE(updated_at, create_at)))`,
+}
+
+// Postgres stores todos in PostgreSQL. IDs are kept in their text form,
+// ObjectID or UUID, so URLs and references from Mongo documents (lists,
+// comments, shares) are unaffected by the choice of backend.
+type Postgres struct {
+	pool  *pgxpool.Pool
+	newID func() model.ID
+}
+
+const todoColumns = `id, workspace_id, user_id, list_id, assignee_id, title, completed, create_at, completed_at, due_date, tags, expires_at, ref, updated_at`
+
+// OpenPostgres connects to the database at url, migrates it and returns a
+// Postgres giving new todos IDs from newID.
+func OpenPostgres(ctx context.Context, url string, newID func() model.ID) (Postgres, error) {
+	pool, err := pgxpool.New(ctx, url)
+	if err != nil {
+		return Postgres{}, err
+	}
+	if err := migratePostgres(ctx, pool); err != nil {
+		pool.Close()
+		return Postgres{}, err
+	}
+	return Postgres{pool: pool, newID: newID}, nil
+}
+
+// migratePostgres applies pending migrations, each in its own transaction.
+// The advisory lock keeps instances starting together from racing.
+func migratePostgres(ctx context.Context, pool *pgxpool.Pool) error {
+	if _, err := pool.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    integer PRIMARY KEY,
+		applied_at timestamptz NOT NULL DEFAULT now()
+	)`); err != nil {
+		return err
+	}
+	for i, stmt := range postgresMigrations {
+		version := i + 1
+		err := pgx.BeginFunc(ctx, pool, func(tx pgx.Tx) error {
+			if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(7251)`); err != nil {
+				return err
+			}
+			var applied bool
+			if err := tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)`, version).Scan(&applied); err != nil || applied {
+				return err
+			}
+			if _, err := tx.Exec(ctx, stmt); err != nil {
+				return err
+			}
+			_, err := tx.Exec(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, version)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+	}
+	return nil
+}
+
+func (r Postgres) List(ctx context.Context, s Scope, f Filter, skip, limit int) ([]model.Todo, int, error) {
+	var q sqlQuery
+	where := postgresWhere(&q, s, f)
+	var total int
+	if err := r.pool.QueryRow(ctx, `SELECT count(*) FROM todos WHERE `+where, q.args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	page := ` ORDER BY create_at DESC OFFSET ` + q.arg(skip)
+	if limit > 0 {
+		page += ` LIMIT ` + q.arg(limit)
+	}
+	todos, err := scanTodos(r.pool.Query(ctx, `SELECT `+todoColumns+` FROM todos WHERE `+where+page, q.args...))
+	if err != nil {
+		return nil, 0, err
+	}
+	return todos, total, nil
+}
+
+// postgresWhere is the WHERE clause for the todos passing f within s.
+func postgresWhere(q *sqlQuery, s Scope, f Filter) string {
+	where := q.scope(s)
+	if !f.ListID.IsZero() {
+		where += " AND list_id = " + q.arg(f.ListID.String())
+	}
+	if !f.AssigneeID.IsZero() {
+		where += " AND assignee_id = " + q.arg(f.AssigneeID.String())
+	}
+	if f.Completed != nil {
+		where += " AND completed = " + q.arg(*f.Completed)
+	}
+	if f.Ref != "" {
+		where += " AND ref = " + q.arg(f.Ref)
+	}
+	for _, word := range strings.Fields(f.Text) {
+		where += ` AND title ILIKE ` + q.arg(likePattern(word)) + ` ESCAPE '\'`
+	}
+	if f.Tag != "" {
+		where += " AND " + q.arg(f.Tag) + " = ANY(tags)"
+	}
+	if !f.DueBefore.IsZero() {
+		where += " AND due_date < " + q.arg(f.DueBefore)
+	}
+	if !f.CreatedAfter.IsZero() {
+		where += " AND create_at > " + q.arg(f.CreatedAfter)
+	}
+	if !f.CompletedAfter.IsZero() {
+		where += " AND completed_at > " + q.arg(f.CompletedAfter)
+	}
+	if !f.UpdatedAfter.IsZero() {
+		where += " AND COALESCE(updated_at, create_at) > " + q.arg(f.UpdatedAfter)
+	}
+	return where
+}
+
+func (r Postgres) Get(ctx context.Context, s Scope, id model.ID) (model.Todo, error) {
+	var q sqlQuery
+	where := q.scopedID(s, id)
+	return scanTodo(r.pool.QueryRow(ctx, `SELECT `+todoColumns+` FROM todos WHERE `+where, q.args...))
+}
+
+func (r Postgres) Create(ctx context.Context, tm *model.Todo) error {
+	if tm.ID.IsZero() {
+		tm.ID = r.newID()
+	}
+	_, err := r.pool.Exec(ctx, `INSERT INTO todos (`+todoColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)`,
+		tm.ID.String(), tm.WorkspaceID.String(), tm.UserID.String(), nullID(tm.ListID), nullID(tm.AssigneeID),
+		tm.Title, tm.Completed, tm.CreateAt, nullTime(tm.CompletedAt), nullTime(tm.DueDate), tm.Tags, nullTime(tm.ExpiresAt), nullString(tm.Ref),
+		nullTime(tm.UpdatedAt))
+	var e *pgconn.PgError
+	if errors.As(err, &e) && e.Code == "23505" {
+		if e.ConstraintName == "todos_ref" {
+			return DuplicateKey("ref", tm.Ref)
+		}
+		return DuplicateKey("_id_", tm.ID)
+	}
+	return err
+}
+
+func (r Postgres) Update(ctx context.Context, s Scope, id model.ID, title string, completed bool) (model.Todo, model.Todo, error) {
+	var before, after model.Todo
+	err := pgx.BeginFunc(ctx, r.pool, func(tx pgx.Tx) error {
+		var q sqlQuery
+		where := q.scopedID(s, id)
+		var err error
+		before, err = scanTodo(tx.QueryRow(ctx, `SELECT `+todoColumns+` FROM todos WHERE `+where+` FOR UPDATE`, q.args...))
+		if err != nil {
+			return err
+		}
+		// Like Mongo's $min, keep the original completion time on later edits.
+		after, err = scanTodo(tx.QueryRow(ctx, `UPDATE todos SET title = $1, completed = $2,
+			completed_at = CASE WHEN $2 THEN COALESCE(completed_at, $3) END, updated_at = $3
+			WHERE id = $4 RETURNING `+todoColumns, title, completed, time.Now(), id.String()))
+		return err
+	})
+	return before, after, err
+}
+
+func (r Postgres) Assign(ctx context.Context, s Scope, id, assignee model.ID) (model.Todo, error) {
+	q := sqlQuery{args: []interface{}{nullID(assignee), time.Now()}}
+	where := q.scopedID(s, id)
+	return scanTodo(r.pool.QueryRow(ctx, `UPDATE todos SET assignee_id = $1, updated_at = $2 WHERE `+where+` RETURNING `+todoColumns, q.args...))
+}
+
+func (r Postgres) Delete(ctx context.Context, s Scope, id model.ID) (model.Todo, error) {
+	var q sqlQuery
+	where := q.scopedID(s, id)
+	return scanTodo(r.pool.QueryRow(ctx, `DELETE FROM todos WHERE `+where+` RETURNING `+todoColumns, q.args...))
+}
+
+func (r Postgres) CountOpen(ctx context.Context, user model.ID) (int, error) {
+	var n int
+	err := r.pool.QueryRow(ctx, `SELECT count(*) FROM todos WHERE user_id = $1 AND NOT completed`, user.String()).Scan(&n)
+	return n, err
+}
+
+func (r Postgres) DeleteExpired(ctx context.Context, now time.Time) ([]model.Todo, error) {
+	return scanTodos(r.pool.Query(ctx, `DELETE FROM todos WHERE expires_at <= $1 RETURNING `+todoColumns, now))
+}
+
+func (r Postgres) DeleteMany(ctx context.Context, s Scope, f Filter) ([]model.Todo, error) {
+	var q sqlQuery
+	where := postgresWhere(&q, s, f)
+	return scanTodos(r.pool.Query(ctx, `DELETE FROM todos WHERE `+where+` RETURNING `+todoColumns, q.args...))
+}
+
+func (r Postgres) Count(ctx context.Context, s Scope, f Filter) (int, error) {
+	var q sqlQuery
+	where := postgresWhere(&q, s, f)
+	var n int
+	err := r.pool.QueryRow(ctx, `SELECT count(*) FROM todos WHERE `+where, q.args...).Scan(&n)
+	return n, err
+}
+
+func (r Postgres) CountTags(ctx context.Context, s Scope, f Filter) ([]TagCount, error) {
+	var q sqlQuery
+	where := postgresWhere(&q, s, f)
+	rows, err := r.pool.Query(ctx, `SELECT tag, count(*), count(*) FILTER (WHERE completed)
+		FROM todos, unnest(tags) AS tag WHERE `+where+` GROUP BY tag ORDER BY count(*) DESC, tag`, q.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tags := []TagCount{}
+	for rows.Next() {
+		var c TagCount
+		if err := rows.Scan(&c.Tag, &c.Total, &c.Completed); err != nil {
+			return nil, err
+		}
+		tags = append(tags, c)
+	}
+	return tags, rows.Err()
+}
+
+func (r Postgres) CountByDay(ctx context.Context, s Scope, f Filter, completed bool, loc *time.Location) (map[string]int, error) {
+	column := "create_at"
+	if completed {
+		column = "completed_at"
+	}
+	var q sqlQuery
+	where := postgresWhere(&q, s, f)
+	day := `to_char(` + column + ` AT TIME ZONE ` + q.arg(loc.String()) + `, 'YYYY-MM-DD')`
+	rows, err := r.pool.Query(ctx, `SELECT `+day+`, count(*) FROM todos WHERE `+where+` AND `+column+` IS NOT NULL GROUP BY 1`, q.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	days := map[string]int{}
+	for rows.Next() {
+		var key string
+		var n int
+		if err := rows.Scan(&key, &n); err != nil {
+			return nil, err
+		}
+		days[key] = n
+	}
+	return days, rows.Err()
+}
+
+// scanTodos reads every row of a query selecting todoColumns.
+func scanTodos(rows pgx.Rows, err error) ([]model.Todo, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var todos []model.Todo
+	for rows.Next() {
+		tm, err := scanTodo(rows)
+		if err != nil {
+			return nil, err
+		}
+		todos = append(todos, tm)
+	}
+	return todos, rows.Err()
+}
+
+// sqlQuery collects numbered arguments while a WHERE clause is built.
+type sqlQuery struct {
+	// mark prefixes placeholders: "$" (the default) for Postgres, "?" for
+	// SQLite.
+	mark string
+	args []interface{}
+}
+
+// arg adds v and returns its placeholder.
+func (q *sqlQuery) arg(v interface{}) string {
+	q.args = append(q.args, v)
+	mark := q.mark
+	if mark == "" {
+		mark = "$"
+	}
+	return mark + strconv.Itoa(len(q.args))
+}
+
+// scope is the SQL counterpart of scopeQuery.
+func (q *sqlQuery) scope(s Scope) string {
+	or := []string{"FALSE"}
+	if len(s.ListIDs) > 0 {
+		lists := make([]string, 0, len(s.ListIDs))
+		for _, id := range s.ListIDs {
+			lists = append(lists, q.arg(id.String()))
+		}
+		or[0] = "list_id IN (" + strings.Join(lists, ", ") + ")"
+	}
+	if !s.OwnerID.IsZero() {
+		or = append(or, "user_id = "+q.arg(s.OwnerID.String()))
+	}
+	if !s.AssigneeID.IsZero() {
+		or = append(or, "assignee_id = "+q.arg(s.AssigneeID.String()))
+	}
+	where := "workspace_id = " + q.arg(s.WorkspaceID.String()) + " AND (" + strings.Join(or, " OR ") + ")"
+	if !s.ChangedAt.IsZero() {
+		from, to := s.ChangedWithin()
+		where += " AND COALESCE(updated_at, create_at) >= " + q.arg(from.UTC()) +
+			" AND COALESCE(updated_at, create_at) < " + q.arg(to.UTC())
+	}
+	return where
+}
+
+// likePattern matches strings containing s.
+func likePattern(s string) string {
+	return "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s) + "%"
+}
+
+func (q *sqlQuery) scopedID(s Scope, id model.ID) string {
+	return q.scope(s) + " AND id = " + q.arg(id.String())
+}
+
+// scanTodo reads one row selected with todoColumns. A missing row is
+// reported as mongo.ErrNoDocuments, as TodoRepository requires.
+func scanTodo(row pgx.Row) (model.Todo, error) {
+	var tm model.Todo
+	var id, workspace, user string
+	var list, assignee *string
+	var completedAt, dueDate, expiresAt, updatedAt *time.Time
+	var ref *string
+	err := row.Scan(&id, &workspace, &user, &list, &assignee, &tm.Title, &tm.Completed,
+		&tm.CreateAt, &completedAt, &dueDate, &tm.Tags, &expiresAt, &ref, &updatedAt)
+	if err == pgx.ErrNoRows {
+		return tm, mongo.ErrNoDocuments
+	}
+	if err != nil {
+		return tm, err
+	}
+	tm.ID, tm.WorkspaceID, tm.UserID = model.ID(id), model.ID(workspace), model.ID(user)
+	if list != nil {
+		tm.ListID = model.ID(*list)
+	}
+	if assignee != nil {
+		tm.AssigneeID = model.ID(*assignee)
+	}
+	if completedAt != nil {
+		tm.CompletedAt = *completedAt
+	}
+	if dueDate != nil {
+		tm.DueDate = *dueDate
+	}
+	if expiresAt != nil {
+		tm.ExpiresAt = *expiresAt
+	}
+	if ref != nil {
+		tm.Ref = *ref
+	}
+	if updatedAt != nil {
+		tm.UpdatedAt = *updatedAt
+	}
+	return tm, nil
+}
+
+func nullID(id model.ID) interface{} {
+	if id.IsZero() {
+		return nil
+	}
+	return id.String()
+}
+
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
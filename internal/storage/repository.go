@@ -0,0 +1,115 @@
+// Package storage defines where todos are kept: the TodoRepository every
+// backend implements and the scope and filters they apply, with the
+// in-memory backend and wrappers that need nothing but the interface.
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sangin4208/go-todo/internal/model"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// TodoRepository persists todos. Every method is confined to a Scope:
+// todos outside it behave as if they did not exist, and lookups of missing
+// todos return mongo.ErrNoDocuments so callers can map it to a 404
+// regardless of the backend.
+type TodoRepository interface {
+	// List returns one page of matching todos, newest first, and the total
+	// number of matches. A zero limit returns every match.
+	List(ctx context.Context, s Scope, f Filter, skip, limit int) ([]model.Todo, int, error)
+	Get(ctx context.Context, s Scope, id model.ID) (model.Todo, error)
+	// Create stores a new todo, giving it an ID unless it has one. An ID
+	// already taken, in any scope, is a DuplicateKey error.
+	Create(ctx context.Context, tm *model.Todo) error
+	// Update sets the title and completion state, returning the todo as it
+	// was before and after the change.
+	Update(ctx context.Context, s Scope, id model.ID, title string, completed bool) (before, after model.Todo, err error)
+	// Assign sets, or with an empty assignee clears, the todo's assignee.
+	Assign(ctx context.Context, s Scope, id, assignee model.ID) (model.Todo, error)
+	// Delete removes the todo and returns what was removed.
+	Delete(ctx context.Context, s Scope, id model.ID) (model.Todo, error)
+	// CountOpen counts the incomplete todos user owns, for quotas.
+	CountOpen(ctx context.Context, user model.ID) (int, error)
+	// DeleteExpired removes todos whose ExpiresAt is not after now and
+	// returns them. Backends that expire todos on their own return nothing.
+	DeleteExpired(ctx context.Context, now time.Time) ([]model.Todo, error)
+	// DeleteMany removes every todo matching f within s and returns what
+	// was removed, for deleting a list or an account.
+	DeleteMany(ctx context.Context, s Scope, f Filter) ([]model.Todo, error)
+	// Count counts the todos matching f within s.
+	Count(ctx context.Context, s Scope, f Filter) (int, error)
+	// CountTags counts, for every tag on the todos matching f within s, the
+	// todos carrying it and how many of those are completed. The most used
+	// tags come first, ties in tag order.
+	CountTags(ctx context.Context, s Scope, f Filter) ([]TagCount, error)
+	// CountByDay counts the todos matching f within s by the day, in loc,
+	// on which they were created or, if completed is set, completed. Days
+	// are keyed as 2006-01-02 and days without todos are left out.
+	CountByDay(ctx context.Context, s Scope, f Filter, completed bool, loc *time.Location) (map[string]int, error)
+}
+
+// TagCount is one tag's entry in CountTags.
+type TagCount struct {
+	Tag       string `bson:"_id"`
+	Total     int    `bson:"total"`
+	Completed int    `bson:"completed"`
+}
+
+// Scope describes which todos a caller may touch: those in the
+// workspace that they own, that sit in one of ListIDs, or (for reads) that
+// are assigned to them. It is resolved from lists and roles before reaching
+// the repository so backends need not know about either.
+type Scope struct {
+	WorkspaceID model.ID
+	// OwnerID is empty when the caller is confined to ListIDs.
+	OwnerID    model.ID
+	ListIDs    []model.ID
+	AssigneeID model.ID
+	// ChangedAt, unless zero, further confines s to todos last changed at
+	// that time (see model.Todo.ChangedAt), so that a write to a todo read
+	// before applies only if nothing has changed it since. Times are
+	// compared to the millisecond, the least precision a backend keeps.
+	ChangedAt time.Time
+}
+
+// ChangedWithin returns the millisecond ChangedAt falls in, from inclusive
+// to exclusive.
+func (s Scope) ChangedWithin() (from, to time.Time) {
+	from = s.ChangedAt.Truncate(time.Millisecond)
+	return from, from.Add(time.Millisecond)
+}
+
+// Filter narrows List; zero fields match everything.
+type Filter struct {
+	ListID     model.ID
+	AssigneeID model.ID
+	Completed  *bool
+	Tag        string
+	// DueBefore matches todos due earlier than it.
+	DueBefore time.Time
+	// CreatedAfter matches todos created later than it.
+	CreatedAfter time.Time
+	// CompletedAfter matches todos completed later than it.
+	CompletedAfter time.Time
+	// UpdatedAfter matches todos changed later than it.
+	UpdatedAfter time.Time
+	// Ref matches the todo with that reference.
+	Ref string
+	// Text matches todos whose title contains every word of it. Mongo uses
+	// its text index, with stemming; other backends match substrings,
+	// ignoring case.
+	Text string
+}
+
+// DuplicateKey is the error a backend returns when a write would give two
+// todos the same ID or reference: Mongo's duplicate key error, so that
+// mongo.IsDuplicateKeyError recognizes it whichever backend returned it.
+func DuplicateKey(index string, key any) error {
+	return mongo.WriteException{WriteErrors: []mongo.WriteError{{
+		Code:    11000,
+		Message: fmt.Sprintf("E11000 duplicate key error collection: todos index: %s dup key: %v", index, key),
+	}}}
+}
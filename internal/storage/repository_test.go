@@ -0,0 +1,223 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/sangin4208/go-todo/internal/model"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// The backends below need no server, so every one of them is held to the
+// same contract here. Mongo, events and Postgres share their queries with
+// these or with each other but need a database to run against.
+func TestTodoRepositories(t *testing.T) {
+	backends := map[string]func(t *testing.T) TodoRepository{
+		"memory": func(*testing.T) TodoRepository { return NewMemory(newID) },
+		"sqlite": func(t *testing.T) TodoRepository {
+			conn, err := OpenSQLite(context.Background(), filepath.Join(t.TempDir(), "todo.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { conn.Close() })
+			return NewSQLite(conn, newID)
+		},
+		"bolt": func(t *testing.T) TodoRepository {
+			b, err := OpenBolt(filepath.Join(t.TempDir(), "todo.bolt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { b.Close() })
+			return NewBolt(b, newID)
+		},
+	}
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			testTodoRepository(t, open(t))
+		})
+	}
+}
+
+func newID() model.ID {
+	return model.NewID("objectid")
+}
+
+func testTodoRepository(t *testing.T, r TodoRepository) {
+	ctx := context.Background()
+	workspace, other := newID(), newID()
+	alice, bob := newID(), newID()
+	list := newID()
+	// Stored times lose precision in some backends.
+	now := time.Now().Truncate(time.Second)
+	day := func(n int) time.Time { return now.AddDate(0, 0, n) }
+
+	create := func(tm model.Todo) model.Todo {
+		t.Helper()
+		if err := r.Create(ctx, &tm); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		if tm.ID.IsZero() {
+			t.Fatal("Create left the model.ID empty")
+		}
+		return tm
+	}
+	groceries := create(model.Todo{WorkspaceID: workspace, UserID: alice, ListID: list, Title: "buy milk",
+		Tags: []string{"home", "shop"}, CreateAt: day(-3)})
+	taxes := create(model.Todo{WorkspaceID: workspace, UserID: alice, Title: "file taxes",
+		Tags: []string{"home"}, DueDate: day(-1), CreateAt: day(-2)})
+	report := create(model.Todo{WorkspaceID: workspace, UserID: bob, ListID: list, AssigneeID: alice, Title: "write report",
+		CreateAt: day(-1)})
+	expiring := create(model.Todo{WorkspaceID: workspace, UserID: bob, Title: "call back",
+		CreateAt: now, ExpiresAt: day(-1)})
+	elsewhere := create(model.Todo{WorkspaceID: other, UserID: alice, Title: "buy milk", CreateAt: now})
+
+	// Taking another's ID, even from outside its scope, must not replace it.
+	clash := model.Todo{ID: groceries.ID, WorkspaceID: other, UserID: bob, Title: "mine now", CreateAt: now}
+	if err := r.Create(ctx, &clash); !mongo.IsDuplicateKeyError(err) {
+		t.Errorf("Create with a taken ID: err = %v, want a duplicate key error", err)
+	}
+
+	ids := func(todos []model.Todo) []model.ID {
+		out := []model.ID{}
+		for _, tm := range todos {
+			out = append(out, tm.ID)
+		}
+		return out
+	}
+	find := func(s Scope, f Filter, skip, limit int) ([]model.ID, int) {
+		t.Helper()
+		found, total, err := r.List(ctx, s, f, skip, limit)
+		if err != nil {
+			t.Fatalf("List: %v", err)
+		}
+		return ids(found), total
+	}
+	expect := func(what string, got, want []model.ID) {
+		t.Helper()
+		if !slices.Equal(got, want) {
+			t.Errorf("%s = %v, want %v", what, got, want)
+		}
+	}
+
+	owned := Scope{WorkspaceID: workspace, OwnerID: alice}
+	reader := Scope{WorkspaceID: workspace, OwnerID: alice, AssigneeID: alice}
+	member := Scope{WorkspaceID: workspace, ListIDs: []model.ID{list}}
+
+	got, total := find(owned, Filter{}, 0, 0)
+	expect("owned todos", got, []model.ID{taxes.ID, groceries.ID})
+	if total != 2 {
+		t.Errorf("total = %d, want 2", total)
+	}
+	got, _ = find(reader, Filter{}, 0, 0)
+	expect("readable todos", got, []model.ID{report.ID, taxes.ID, groceries.ID})
+	got, total = find(reader, Filter{}, 1, 1)
+	expect("second page", got, []model.ID{taxes.ID})
+	if total != 3 {
+		t.Errorf("paged total = %d, want 3", total)
+	}
+	got, _ = find(member, Filter{}, 0, 0)
+	expect("list todos", got, []model.ID{report.ID, groceries.ID})
+	got, _ = find(reader, Filter{Tag: "shop"}, 0, 0)
+	expect("tagged todos", got, []model.ID{groceries.ID})
+	got, _ = find(reader, Filter{DueBefore: now}, 0, 0)
+	expect("overdue todos", got, []model.ID{taxes.ID})
+	got, _ = find(reader, Filter{Text: "MILK"}, 0, 0)
+	expect("matching todos", got, []model.ID{groceries.ID})
+	got, _ = find(reader, Filter{CreatedAfter: day(-2)}, 0, 0)
+	expect("recent todos", got, []model.ID{report.ID})
+	got, _ = find(Scope{WorkspaceID: other, OwnerID: alice}, Filter{}, 0, 0)
+	expect("other workspace", got, []model.ID{elsewhere.ID})
+
+	if _, err := r.Get(ctx, owned, report.ID); err != mongo.ErrNoDocuments {
+		t.Errorf("Get out of scope: err = %v, want mongo.ErrNoDocuments", err)
+	}
+	if tm, err := r.Get(ctx, member, report.ID); err != nil || tm.Title != report.Title || tm.AssigneeID != alice {
+		t.Errorf("Get = %+v, %v", tm, err)
+	}
+
+	before, after, err := r.Update(ctx, owned, groceries.ID, "buy oat milk", true)
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if before.Title != "buy milk" || before.Completed || after.Title != "buy oat milk" || !after.Completed ||
+		after.CompletedAt.IsZero() || after.UpdatedAt.IsZero() {
+		t.Errorf("Update = %+v, %+v", before, after)
+	}
+	if _, _, err := r.Update(ctx, owned, report.ID, "x", true); err != mongo.ErrNoDocuments {
+		t.Errorf("Update out of scope: err = %v, want mongo.ErrNoDocuments", err)
+	}
+	got, _ = find(reader, Filter{UpdatedAfter: day(-2)}, 0, 0)
+	expect("updated todos", got, []model.ID{report.ID, groceries.ID})
+
+	// A write confined to the todo as it was before the update misses it.
+	stale, current := owned, owned
+	stale.ChangedAt, current.ChangedAt = before.ChangedAt(), after.ChangedAt()
+	if _, _, err := r.Update(ctx, stale, groceries.ID, "buy milk", false); err != mongo.ErrNoDocuments {
+		t.Errorf("Update of a changed todo: err = %v, want mongo.ErrNoDocuments", err)
+	}
+	if _, err := r.Delete(ctx, stale, groceries.ID); err != mongo.ErrNoDocuments {
+		t.Errorf("Delete of a changed todo: err = %v, want mongo.ErrNoDocuments", err)
+	}
+	if _, again, err := r.Update(ctx, current, groceries.ID, "buy oat milk", true); err != nil || again.Title != "buy oat milk" {
+		t.Errorf("Update of an unchanged todo = %+v, %v", again, err)
+	}
+
+	if tm, err := r.Assign(ctx, owned, taxes.ID, bob); err != nil || tm.AssigneeID != bob {
+		t.Errorf("Assign = %+v, %v", tm, err)
+	}
+	if tm, err := r.Assign(ctx, owned, taxes.ID, ""); err != nil || !tm.AssigneeID.IsZero() {
+		t.Errorf("unassign = %+v, %v", tm, err)
+	}
+
+	done := true
+	if n, err := r.Count(ctx, reader, Filter{Completed: &done}); err != nil || n != 1 {
+		t.Errorf("Count = %d, %v, want 1", n, err)
+	}
+	if n, err := r.CountOpen(ctx, alice); err != nil || n != 2 {
+		t.Errorf("CountOpen = %d, %v, want 2 (one in another workspace)", n, err)
+	}
+	tags, err := r.CountTags(ctx, reader, Filter{})
+	want := []TagCount{{Tag: "home", Total: 2, Completed: 1}, {Tag: "shop", Total: 1, Completed: 1}}
+	if err != nil || !slices.Equal(tags, want) {
+		t.Errorf("CountTags = %v, %v, want %v", tags, err, want)
+	}
+	days, err := r.CountByDay(ctx, reader, Filter{}, false, time.UTC)
+	if err != nil || len(days) != 3 || days[day(-3).UTC().Format("2006-01-02")] != 1 {
+		t.Errorf("CountByDay(created) = %v, %v", days, err)
+	}
+	days, err = r.CountByDay(ctx, reader, Filter{Completed: &done}, true, time.UTC)
+	if err != nil || len(days) != 1 || days[after.CompletedAt.UTC().Format("2006-01-02")] != 1 {
+		t.Errorf("CountByDay(completed) = %v, %v", days, err)
+	}
+
+	removed, err := r.DeleteMany(ctx, member, Filter{ListID: list})
+	if err != nil {
+		t.Fatalf("DeleteMany: %v", err)
+	}
+	got = ids(removed)
+	slices.Sort(got)
+	wantIDs := []model.ID{groceries.ID, report.ID}
+	slices.Sort(wantIDs)
+	expect("removed todos", got, wantIDs)
+	got, _ = find(reader, Filter{}, 0, 0)
+	expect("todos left", got, []model.ID{taxes.ID})
+
+	if tm, err := r.Delete(ctx, owned, taxes.ID); err != nil || tm.ID != taxes.ID {
+		t.Errorf("Delete = %+v, %v", tm, err)
+	}
+	if _, err := r.Delete(ctx, owned, taxes.ID); err != mongo.ErrNoDocuments {
+		t.Errorf("Delete twice: err = %v, want mongo.ErrNoDocuments", err)
+	}
+
+	expired, err := r.DeleteExpired(ctx, now)
+	if err != nil {
+		t.Fatalf("DeleteExpired: %v", err)
+	}
+	expect("expired todos", ids(expired), []model.ID{expiring.ID})
+	if _, err := r.Get(ctx, Scope{WorkspaceID: workspace, OwnerID: bob}, expiring.ID); err != mongo.ErrNoDocuments {
+		t.Errorf("Get expired: err = %v, want mongo.ErrNoDocuments", err)
+	}
+}
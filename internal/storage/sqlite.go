@@ -0,0 +1,338 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sangin4208/go-todo/internal/model"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// sqliteMigrations mirrors postgresMigrations; the schema version is kept in
+// PRAGMA user_version. Only ever append to the list.
+var sqliteMigrations = []string{
+	`CREATE TABLE todos (
+		id           TEXT PRIMARY KEY,
+		workspace_id TEXT NOT NULL,
+		user_id      TEXT NOT NULL,
+		list_id      TEXT,
+		assignee_id  TEXT,
+		title        TEXT NOT NULL,
+		completed    BOOLEAN NOT NULL DEFAULT 0,
+		create_at    DATETIME NOT NULL,
+		completed_at DATETIME,
+		due_date     DATETIME,
+		tags         TEXT
+	)`,
+	`CREATE INDEX todos_workspace_user ON todos (workspace_id, user_id, create_at DESC)`,
+	`CREATE INDEX todos_list ON todos (list_id) WHERE list_id IS NOT NULL`,
+	`CREATE INDEX todos_assignee ON todos (assignee_id) WHERE assignee_id IS NOT NULL`,
+	`ALTER TABLE todos ADD COLUMN expires_at DATETIME`,
+	`CREATE INDEX todos_expires ON todos (expires_at) WHERE expires_at IS NOT NULL`,
+	`ALTER TABLE todos ADD COLUMN ref TEXT`,
+	`CREATE UNIQUE INDEX todos_ref ON todos (workspace_id, ref) WHERE ref IS NOT NULL`,
+	`ALTER TABLE todos ADD COLUMN updated_at DATETIME`,
+	`CREATE INDEX todos_updated ON todos (workspace_id, COALESCE(updated_at, create_at))`,
+	// Everything but the todos, as BSON, for the embedded database
+	// sharing the file.
+	`CREATE TABLE documents (
+		collection TEXT NOT NULL,
+		id         BLOB NOT NULL,
+		doc        BLOB NOT NULL,
+		PRIMARY KEY (collection, id)
+	)`,
+}
+
+// SQLite stores todos in a local SQLite file. Times are written in UTC so
+// that they sort correctly as text.
+type SQLite struct {
+	db    *sql.DB
+	newID func() model.ID
+}
+
+// NewSQLite returns a SQLite keeping todos in db, opened with OpenSQLite,
+// and giving new ones IDs from newID.
+func NewSQLite(db *sql.DB, newID func() model.ID) SQLite {
+	return SQLite{db: db, newID: newID}
+}
+
+// OpenSQLite opens and migrates the file at path. The driver is pure Go,
+// so the binary needs no C toolchain or shared libraries.
+func OpenSQLite(ctx context.Context, path string) (*sql.DB, error) {
+	conn, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	// A single connection serializes writers, which SQLite requires anyway.
+	conn.SetMaxOpenConns(1)
+	if err := migrateSQLite(ctx, conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func migrateSQLite(ctx context.Context, conn *sql.DB) error {
+	var version int
+	if err := conn.QueryRowContext(ctx, `PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+	for i := version; i < len(sqliteMigrations); i++ {
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if _, err = tx.ExecContext(ctx, sqliteMigrations[i]); err == nil {
+			_, err = tx.ExecContext(ctx, fmt.Sprintf(`PRAGMA user_version = %d`, i+1))
+		}
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+		if err != nil {
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+func (r SQLite) List(ctx context.Context, s Scope, f Filter, skip, limit int) ([]model.Todo, int, error) {
+	q := sqlQuery{mark: "?"}
+	where := sqliteWhere(&q, s, f)
+	var total int
+	if err := r.db.QueryRowContext(ctx, `SELECT count(*) FROM todos WHERE `+where, q.args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	if limit <= 0 {
+		limit = -1
+	}
+	page := ` ORDER BY create_at DESC LIMIT ` + q.arg(limit) + ` OFFSET ` + q.arg(skip)
+	todos, err := scanSQLiteTodos(r.db.QueryContext(ctx, `SELECT `+todoColumns+` FROM todos WHERE `+where+page, q.args...))
+	if err != nil {
+		return nil, 0, err
+	}
+	return todos, total, nil
+}
+
+// sqliteWhere is the WHERE clause for the todos passing f within s.
+func sqliteWhere(q *sqlQuery, s Scope, f Filter) string {
+	where := q.scope(s)
+	if !f.ListID.IsZero() {
+		where += " AND list_id = " + q.arg(f.ListID.String())
+	}
+	if !f.AssigneeID.IsZero() {
+		where += " AND assignee_id = " + q.arg(f.AssigneeID.String())
+	}
+	if f.Completed != nil {
+		where += " AND completed = " + q.arg(*f.Completed)
+	}
+	if f.Ref != "" {
+		where += " AND ref = " + q.arg(f.Ref)
+	}
+	// LIKE ignores case in SQLite, for ASCII letters at least.
+	for _, word := range strings.Fields(f.Text) {
+		where += ` AND title LIKE ` + q.arg(likePattern(word)) + ` ESCAPE '\'`
+	}
+	if f.Tag != "" {
+		where += " AND EXISTS (SELECT 1 FROM json_each(tags) WHERE value = " + q.arg(f.Tag) + ")"
+	}
+	if !f.DueBefore.IsZero() {
+		where += " AND due_date < " + q.arg(f.DueBefore.UTC())
+	}
+	if !f.CreatedAfter.IsZero() {
+		where += " AND create_at > " + q.arg(f.CreatedAfter.UTC())
+	}
+	if !f.CompletedAfter.IsZero() {
+		where += " AND completed_at > " + q.arg(f.CompletedAfter.UTC())
+	}
+	if !f.UpdatedAfter.IsZero() {
+		where += " AND COALESCE(updated_at, create_at) > " + q.arg(f.UpdatedAfter.UTC())
+	}
+	return where
+}
+
+func (r SQLite) Get(ctx context.Context, s Scope, id model.ID) (model.Todo, error) {
+	q := sqlQuery{mark: "?"}
+	where := q.scopedID(s, id)
+	return scanSQLiteTodo(r.db.QueryRowContext(ctx, `SELECT `+todoColumns+` FROM todos WHERE `+where, q.args...))
+}
+
+func (r SQLite) Create(ctx context.Context, tm *model.Todo) error {
+	if tm.ID.IsZero() {
+		tm.ID = r.newID()
+	}
+	_, err := r.db.ExecContext(ctx, `INSERT INTO todos (`+todoColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		tm.ID.String(), tm.WorkspaceID.String(), tm.UserID.String(), nullID(tm.ListID), nullID(tm.AssigneeID),
+		tm.Title, tm.Completed, tm.CreateAt.UTC(), nullTime(tm.CompletedAt.UTC()), nullTime(tm.DueDate.UTC()), jsonTags(tm.Tags),
+		nullTime(tm.ExpiresAt.UTC()), nullString(tm.Ref), nullTime(tm.UpdatedAt.UTC()))
+	var e *sqlite.Error
+	if errors.As(err, &e) {
+		switch e.Code() {
+		case sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY:
+			return DuplicateKey("_id_", tm.ID)
+		case sqlite3.SQLITE_CONSTRAINT_UNIQUE:
+			return DuplicateKey("ref", tm.Ref)
+		}
+	}
+	return err
+}
+
+func (r SQLite) Update(ctx context.Context, s Scope, id model.ID, title string, completed bool) (model.Todo, model.Todo, error) {
+	var before, after model.Todo
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return before, after, err
+	}
+	defer tx.Rollback()
+	q := sqlQuery{mark: "?"}
+	where := q.scopedID(s, id)
+	if before, err = scanSQLiteTodo(tx.QueryRowContext(ctx, `SELECT `+todoColumns+` FROM todos WHERE `+where, q.args...)); err != nil {
+		return before, after, err
+	}
+	after, err = scanSQLiteTodo(tx.QueryRowContext(ctx, `UPDATE todos SET title = ?1, completed = ?2,
+		completed_at = CASE WHEN ?2 THEN COALESCE(completed_at, ?3) END, updated_at = ?3
+		WHERE id = ?4 RETURNING `+todoColumns, title, completed, time.Now().UTC(), id.String()))
+	if err == nil {
+		err = tx.Commit()
+	}
+	return before, after, err
+}
+
+func (r SQLite) Assign(ctx context.Context, s Scope, id, assignee model.ID) (model.Todo, error) {
+	q := sqlQuery{mark: "?", args: []interface{}{nullID(assignee), time.Now().UTC()}}
+	where := q.scopedID(s, id)
+	return scanSQLiteTodo(r.db.QueryRowContext(ctx, `UPDATE todos SET assignee_id = ?1, updated_at = ?2 WHERE `+where+` RETURNING `+todoColumns, q.args...))
+}
+
+func (r SQLite) Delete(ctx context.Context, s Scope, id model.ID) (model.Todo, error) {
+	q := sqlQuery{mark: "?"}
+	where := q.scopedID(s, id)
+	return scanSQLiteTodo(r.db.QueryRowContext(ctx, `DELETE FROM todos WHERE `+where+` RETURNING `+todoColumns, q.args...))
+}
+
+func (r SQLite) CountOpen(ctx context.Context, user model.ID) (int, error) {
+	var n int
+	err := r.db.QueryRowContext(ctx, `SELECT count(*) FROM todos WHERE user_id = ? AND NOT completed`, user.String()).Scan(&n)
+	return n, err
+}
+
+func (r SQLite) DeleteExpired(ctx context.Context, now time.Time) ([]model.Todo, error) {
+	return scanSQLiteTodos(r.db.QueryContext(ctx, `DELETE FROM todos WHERE expires_at <= ? RETURNING `+todoColumns, now.UTC()))
+}
+
+func (r SQLite) DeleteMany(ctx context.Context, s Scope, f Filter) ([]model.Todo, error) {
+	q := sqlQuery{mark: "?"}
+	where := sqliteWhere(&q, s, f)
+	return scanSQLiteTodos(r.db.QueryContext(ctx, `DELETE FROM todos WHERE `+where+` RETURNING `+todoColumns, q.args...))
+}
+
+func (r SQLite) Count(ctx context.Context, s Scope, f Filter) (int, error) {
+	q := sqlQuery{mark: "?"}
+	where := sqliteWhere(&q, s, f)
+	var n int
+	err := r.db.QueryRowContext(ctx, `SELECT count(*) FROM todos WHERE `+where, q.args...).Scan(&n)
+	return n, err
+}
+
+func (r SQLite) CountTags(ctx context.Context, s Scope, f Filter) ([]TagCount, error) {
+	q := sqlQuery{mark: "?"}
+	where := sqliteWhere(&q, s, f)
+	rows, err := r.db.QueryContext(ctx, `SELECT tag.value, count(*), sum(completed)
+		FROM todos, json_each(todos.tags) AS tag WHERE `+where+` GROUP BY tag.value ORDER BY count(*) DESC, tag.value`, q.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tags := []TagCount{}
+	for rows.Next() {
+		var c TagCount
+		if err := rows.Scan(&c.Tag, &c.Total, &c.Completed); err != nil {
+			return nil, err
+		}
+		tags = append(tags, c)
+	}
+	return tags, rows.Err()
+}
+
+// CountByDay groups in Go, SQLite knowing nothing of time zones.
+func (r SQLite) CountByDay(ctx context.Context, s Scope, f Filter, completed bool, loc *time.Location) (map[string]int, error) {
+	todos, _, err := r.List(ctx, s, f, 0, 0)
+	return CountByDay(todos, completed, loc), err
+}
+
+// scanSQLiteTodos reads every row of a query selecting todoColumns.
+func scanSQLiteTodos(rows *sql.Rows, err error) ([]model.Todo, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var todos []model.Todo
+	for rows.Next() {
+		tm, err := scanSQLiteTodo(rows)
+		if err != nil {
+			return nil, err
+		}
+		todos = append(todos, tm)
+	}
+	return todos, rows.Err()
+}
+
+// scanSQLiteTodo is scanTodo for database/sql rows, with tags kept as a
+// JSON array.
+func scanSQLiteTodo(row interface{ Scan(...interface{}) error }) (model.Todo, error) {
+	var tm model.Todo
+	var id, workspace, user string
+	var list, assignee, ref sql.NullString
+	var completedAt, dueDate, expiresAt, updatedAt sql.NullTime
+	err := row.Scan(&id, &workspace, &user, &list, &assignee, &tm.Title, &tm.Completed,
+		&tm.CreateAt, &completedAt, &dueDate, (*jsonTags)(&tm.Tags), &expiresAt, &ref, &updatedAt)
+	if err == sql.ErrNoRows {
+		return tm, mongo.ErrNoDocuments
+	}
+	if err != nil {
+		return tm, err
+	}
+	tm.ID, tm.WorkspaceID, tm.UserID = model.ID(id), model.ID(workspace), model.ID(user)
+	if list.Valid {
+		tm.ListID = model.ID(list.String)
+	}
+	if assignee.Valid {
+		tm.AssigneeID = model.ID(assignee.String)
+	}
+	tm.CompletedAt, tm.DueDate, tm.ExpiresAt, tm.UpdatedAt = completedAt.Time, dueDate.Time, expiresAt.Time, updatedAt.Time
+	tm.Ref = ref.String
+	return tm, nil
+}
+
+// jsonTags stores a todo's tags in a TEXT column as a JSON array.
+type jsonTags []string
+
+func (t jsonTags) Value() (driver.Value, error) {
+	if len(t) == 0 {
+		return nil, nil
+	}
+	b, err := json.Marshal([]string(t))
+	return string(b), err
+}
+
+func (t *jsonTags) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*t = nil
+		return nil
+	case string:
+		return json.Unmarshal([]byte(v), (*[]string)(t))
+	case []byte:
+		return json.Unmarshal(v, (*[]string)(t))
+	}
+	return fmt.Errorf("unsupported tags value %T", src)
+}
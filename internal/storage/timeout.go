@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/sangin4208/go-todo/internal/model"
+)
+
+// WithTimeout bounds every call to next by d, on top of the caller's own
+// context.
+func WithTimeout(next TodoRepository, d time.Duration) TodoRepository {
+	return timeoutTodoRepository{next: next, d: d}
+}
+
+type timeoutTodoRepository struct {
+	next TodoRepository
+	d    time.Duration
+}
+
+func (t timeoutTodoRepository) List(ctx context.Context, s Scope, f Filter, skip, limit int) ([]model.Todo, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.d)
+	defer cancel()
+	return t.next.List(ctx, s, f, skip, limit)
+}
+
+func (t timeoutTodoRepository) Get(ctx context.Context, s Scope, id model.ID) (model.Todo, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.d)
+	defer cancel()
+	return t.next.Get(ctx, s, id)
+}
+
+func (t timeoutTodoRepository) Create(ctx context.Context, tm *model.Todo) error {
+	ctx, cancel := context.WithTimeout(ctx, t.d)
+	defer cancel()
+	return t.next.Create(ctx, tm)
+}
+
+func (t timeoutTodoRepository) Update(ctx context.Context, s Scope, id model.ID, title string, completed bool) (model.Todo, model.Todo, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.d)
+	defer cancel()
+	return t.next.Update(ctx, s, id, title, completed)
+}
+
+func (t timeoutTodoRepository) Assign(ctx context.Context, s Scope, id, assignee model.ID) (model.Todo, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.d)
+	defer cancel()
+	return t.next.Assign(ctx, s, id, assignee)
+}
+
+func (t timeoutTodoRepository) Delete(ctx context.Context, s Scope, id model.ID) (model.Todo, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.d)
+	defer cancel()
+	return t.next.Delete(ctx, s, id)
+}
+
+func (t timeoutTodoRepository) CountOpen(ctx context.Context, user model.ID) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.d)
+	defer cancel()
+	return t.next.CountOpen(ctx, user)
+}
+
+func (t timeoutTodoRepository) DeleteExpired(ctx context.Context, now time.Time) ([]model.Todo, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.d)
+	defer cancel()
+	return t.next.DeleteExpired(ctx, now)
+}
+
+func (t timeoutTodoRepository) DeleteMany(ctx context.Context, s Scope, f Filter) ([]model.Todo, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.d)
+	defer cancel()
+	return t.next.DeleteMany(ctx, s, f)
+}
+
+func (t timeoutTodoRepository) Count(ctx context.Context, s Scope, f Filter) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.d)
+	defer cancel()
+	return t.next.Count(ctx, s, f)
+}
+
+func (t timeoutTodoRepository) CountTags(ctx context.Context, s Scope, f Filter) ([]TagCount, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.d)
+	defer cancel()
+	return t.next.CountTags(ctx, s, f)
+}
+
+func (t timeoutTodoRepository) CountByDay(ctx context.Context, s Scope, f Filter, completed bool, loc *time.Location) (map[string]int, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.d)
+	defer cancel()
+	return t.next.CountByDay(ctx, s, f, completed, loc)
+}
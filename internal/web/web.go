@@ -0,0 +1,12 @@
+// Package web holds the pages' templates and the static files they use,
+// built into the binary so it serves them from wherever it runs.
+package web
+
+import "embed"
+
+// FS holds templates/, the html/template pages, static/, served as they
+// are under /static/, and locales/, the translations of messages, one
+// JSON file per language.
+//
+//go:embed templates static locales
+var FS embed.FS
@@ -1,206 +1,11 @@
+// Command todo serves the todo API over HTTP and gRPC. See the server
+// package to embed the API in another program instead.
 package main
 
-import (
-	"context"
-	"encoding/json"
-	"log"
-	"net/http"
-	"os"
-	"os/signal"
-	"strings"
-	"time"
+import "github.com/sangin4208/go-todo/internal/handlers"
 
-	"github.com/go-chi/chi"
-	"github.com/go-chi/chi/middleware"
-	"github.com/thedevsaddam/renderer"
-	mgo "gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
-)
-
-var rnd *renderer.Render
-var db *mgo.Database
-
-const (
-	hostName       string = "localhost:27017"
-	dbName         string = "demo_todo"
-	collectionName string = "todo"
-	port           string = ":8080"
-)
-
-type (
-	todoModel struct {
-		ID        bson.ObjectId `bson:"_id,omitempty"`
-		Title     string        `bson:"title"`
-		Completed bool          `bson:"completed"`
-		CreateAt  time.Time     `bson:"createAt"`
-	}
-	todo struct {
-		ID        string `json:"id"`
-		Title     string `json:"title"`
-		Completed bool   `json:"completed"`
-		CreateAt  string `json:"createAt"`
-	}
-)
-
-func init() {
-	rnd = renderer.New()
-	sess, err := mgo.Dial(hostName)
-	checkErr(err)
-	sess.SetMode(mgo.Monotonic, true)
-	db = sess.DB(dbName)
-}
-
-func homeHandler(w http.ResponseWriter, r *http.Request) {
-	err := rnd.Template(w, http.StatusOK, []string{"/static/home.tmpl"}, nil)
-	checkErr(err)
-}
-func fetchTodos(w http.ResponseWriter, r *http.Request) {
-	var todos []todoModel
-	if err := db.C(collectionName).Find(bson.M{}).All(&todos); err != nil {
-		rnd.JSON(w, http.StatusProcessing, renderer.M{
-			"message": "error fetching todos",
-			"error":   err.Error(),
-		})
-	}
-	var todoList []todo
-	for _, t := range todos {
-		todoList = append(todoList, todo{
-			ID:        t.ID.Hex(),
-			Title:     t.Title,
-			Completed: t.Completed,
-			CreateAt:  t.CreateAt.Format("2006-01-02 15:04:05"),
-		})
-	}
-	err := rnd.JSON(w, http.StatusOK, renderer.M{
-		"data": todoList,
-	})
-	checkErr(err)
-}
-
-func createTodo(w http.ResponseWriter, r *http.Request) {
-	var t todo
-	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
-		rnd.JSON(w, http.StatusProcessing, err)
-		return
-	}
-
-	if t.Title == "" {
-		rnd.JSON(w, http.StatusBadRequest, renderer.M{
-			"message": "title is required",
-		})
-	}
-	tm := todoModel{
-		ID:        bson.NewObjectId(),
-		Title:     t.Title,
-		Completed: false,
-		CreateAt:  time.Now(),
-	}
-	if err := db.C(collectionName).Insert(&tm); err != nil {
-		rnd.JSON(w, http.StatusProcessing, renderer.M{
-			"message": "error creating todo",
-			"error":   err.Error(),
-		})
-		return
-	}
-
-	rnd.JSON(w, http.StatusOK, renderer.M{
-		"message": "todo created successfully",
-		"todo_id": tm.ID.Hex(),
-	})
-}
-
-func deleteTodo(w http.ResponseWriter, r *http.Request) {
-	id := strings.TrimSpace(chi.URLParam(r, "id"))
-	if !bson.IsObjectIdHex(id) {
-		rnd.JSON(w, http.StatusBadRequest, renderer.M{
-			"message": "The id is invalid",
-		})
-		if err := db.C(collectionName).RemoveId(bson.ObjectIdHex(id)); err != nil {
-			rnd.JSON(w, http.StatusProcessing, renderer.M{
-				"message": "error deleting todo",
-				"error":   err.Error(),
-			})
-			return
-		}
-		rnd.JSON(w, http.StatusOK, renderer.M{
-			"message": "todo deleted successfully",
-		})
-	}
-}
-func updateTodo(w http.ResponseWriter, r *http.Request) {
-	id := strings.TrimSpace(chi.URLParam(r, "id"))
-	if !bson.IsObjectIdHex(id) {
-		rnd.JSON(w, http.StatusBadRequest, renderer.M{
-			"message": "The id is invalid",
-		})
-	}
-	var t todo
-	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
-		rnd.JSON(w, http.StatusProcessing, err)
-	}
-	if t.Title == "" {
-		rnd.JSON(w, http.StatusBadRequest, renderer.M{
-			"message": "the title field is required",
-		})
-		return
-	}
-	if err := db.C(collectionName).Update(
-		bson.M{"_id": bson.ObjectIdHex(id)},
-		bson.M{"title": t.Title, "completed": t.Completed},
-	); err != nil {
-		rnd.JSON(w, http.StatusProcessing, renderer.M{
-			"message": "failed to update todo",
-			"error":   err,
-		})
-	}
-}
+//go:generate buf generate
 
 func main() {
-	stopChan := make(chan os.Signal)
-	signal.Notify(stopChan, os.Interrupt)
-
-	r := chi.NewRouter()
-	r.Use(middleware.Logger)
-	r.Get("/", homeHandler)
-	r.Mount("/todo", todoHandlers())
-
-	srv := &http.Server{
-		Addr:         port,
-		Handler:      r,
-		ReadTimeout:  60 * time.Second,
-		WriteTimeout: 60 * time.Second,
-		IdleTimeout:  60 * time.Second,
-	}
-
-	go func() {
-		log.Println("Listening on port", port)
-		if err := srv.ListenAndServe(); err != nil {
-			log.Printf("listen: %s\n", err)
-		}
-	}()
-	<-stopChan
-	log.Println("shutting down swerver")
-	ctx, cancle := context.WithTimeout(context.Background(), 5*time.Second)
-	srv.Shutdown(ctx)
-	defer func() {
-		cancle()
-		log.Println("server gracefully stopped")
-	}()
-}
-
-func todoHandlers() http.Handler {
-	rg := chi.NewRouter()
-	rg.Group(func(r chi.Router) {
-		r.Get("/", fetchTodos)
-		r.Post("/", createTodo)
-		r.Put("/{id}", updateTodo)
-		r.Delete("/{id}", deleteTodo)
-	})
-	return rg
-}
-
-func checkErr(err error) {
-	if err != nil {
-		log.Fatal(err)
-	}
+	handlers.Run()
 }
@@ -0,0 +1,28 @@
+// Package server embeds the todo API in other Go programs:
+//
+//	s, err := server.New(server.Config{MongoURI: "mongodb://localhost:27017"})
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer s.Close(context.Background())
+//	http.Handle("/", s)
+//
+// Settings not given in the Config are read from TODO_* environment
+// variables and the TODO_CONFIG file, as they are by the todo command.
+package server
+
+import (
+	"github.com/sangin4208/go-todo/internal/handlers"
+)
+
+// Config overrides settings; empty fields keep the environment's.
+type Config = handlers.Config
+
+// Server serves the todo API over HTTP until closed.
+type Server = handlers.Server
+
+// New starts the todo service and returns the Server serving its API.
+// Each Server keeps its own data, so several can run in one process.
+func New(cfg Config) (*Server, error) {
+	return handlers.New(cfg)
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newServer(t *testing.T) *Server {
+	t.Helper()
+	s, err := New(Config{Storage: "memory"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close(context.Background()) })
+	return s
+}
+
+func serve(s *Server, method, path, token, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+// Servers in one process keep their data to themselves, and close on
+// their own.
+func TestServers(t *testing.T) {
+	a, b := newServer(t), newServer(t)
+	const account = `{"email":"alice@example.com","password":"correct horse battery"}`
+
+	register := func(s *Server) string {
+		t.Helper()
+		w := serve(s, http.MethodPost, "/auth/register", "", account)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("register: %d %s", w.Code, w.Body)
+		}
+		var res struct {
+			Token string `json:"token"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || res.Token == "" {
+			t.Fatalf("register: token missing from %s", w.Body)
+		}
+		return res.Token
+	}
+	register(a)
+	tokenB := register(b)
+	if w := serve(a, http.MethodPost, "/auth/register", "", account); w.Code != http.StatusConflict {
+		t.Errorf("registering twice with one server: %d, want %d", w.Code, http.StatusConflict)
+	}
+
+	// Nor do they share lockouts.
+	const wrong = `{"email":"alice@example.com","password":"wrong horse battery"}`
+	for range 5 {
+		serve(a, http.MethodPost, "/auth/login", "", wrong)
+	}
+	if w := serve(a, http.MethodPost, "/auth/login", "", wrong); w.Code != http.StatusTooManyRequests {
+		t.Errorf("signing in after failing repeatedly: %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if w := serve(b, http.MethodPost, "/auth/login", "", wrong); w.Code != http.StatusUnauthorized {
+		t.Errorf("signing in to the other server: %d %s, want %d", w.Code, w.Body, http.StatusUnauthorized)
+	}
+
+	if err := a.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(b, http.MethodGet, "/todo", tokenB, ""); w.Code != http.StatusOK {
+		t.Errorf("after closing the other server: %d %s", w.Code, w.Body)
+	}
+}